@@ -0,0 +1,183 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// registerTokenEnv is the environment variable the agent takes the token from without -token-file.
+const registerTokenEnv = "GORB_REGISTER_TOKEN"
+
+var errMissingToken = errors.New("registration token is required, use -token-file or " + registerTokenEnv)
+
+// registrationAgent keeps a backend registered with GORB instances.
+type registrationAgent struct {
+	client *http.Client
+	token  string
+	body   []byte
+	// urls of the backend registration at each GORB instance
+	urls []string
+}
+
+func (a *registrationAgent) request(method, target string, body []byte) (int, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var response errorResponse
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &response) == nil && response.Error != "" {
+			return resp.StatusCode, errors.New(response.Error)
+		}
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// register registers the backend with every GORB instance or renews its registration.
+func (a *registrationAgent) register() {
+	for _, target := range a.urls {
+		if status, err := a.request(http.MethodPut, target, a.body); err != nil {
+			log.Errorf("error while registering at %s: %s", target, err)
+		} else if status == http.StatusCreated {
+			log.Infof("registered at %s", target)
+		} else {
+			log.Debugf("registration at %s is renewed", target)
+		}
+	}
+}
+
+// deregister removes the backend from every GORB instance.
+func (a *registrationAgent) deregister() {
+	for _, target := range a.urls {
+		if _, err := a.request(http.MethodDelete, target, nil); err != nil {
+			log.Errorf("error while deregistering at %s: %s", target, err)
+		} else {
+			log.Infof("deregistered at %s", target)
+		}
+	}
+}
+
+// agentCommand registers this server as a backend of a service and sends heartbeats
+// until it is stopped, the backend is deregistered on SIGINT or SIGTERM.
+func agentCommand(args []string) error {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "usage: gorb agent -url <urls> -service <vsID> -host <address> -port <port> [options]\n\n"+
+			"Registers this server as a backend of the service and renews the registration until the agent\n"+
+			"is stopped. GORB removes the backend once heartbeats are missing for the ttl.\n\n")
+		flags.PrintDefaults()
+	}
+	hostname, _ := os.Hostname()
+	var (
+		urls      = flags.String("url", "", "comma delimited base URLs of GORB instances, e.g. http://lb1:4672")
+		service   = flags.String("service", "", "ID of the service to register with")
+		id        = flags.String("id", hostname, "backend ID")
+		host      = flags.String("host", "", "backend address")
+		port      = flags.Uint("port", 0, "backend port")
+		locality  = flags.String("locality", "", "locality label of the backend")
+		color     = flags.String("color", "", "color of the backend in blue/green deployments")
+		priority  = flags.Int("priority", 0, "priority of the backend in failover services")
+		tags      = flags.String("tags", "", "comma delimited tags of the backend matched by backend filters")
+		ttl       = flags.String("ttl", "30s", "time GORB keeps the backend without heartbeats, they are sent every third of it")
+		tokenFile = flags.String("token-file", "", "file with the registration token, "+registerTokenEnv+" if omitted")
+		verbose   = flags.Bool("v", false, "log every heartbeat")
+	)
+	flags.Parse(args)
+
+	if *urls == "" || *service == "" || *id == "" || *host == "" || *port == 0 || *port > 65535 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	interval, err := util.ParseInterval(*ttl)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return core.ErrInvalidTTL
+	}
+	token := os.Getenv(registerTokenEnv)
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		token = string(bytes.TrimSpace(data))
+	}
+	if token == "" {
+		return errMissingToken
+	}
+
+	body, err := json.Marshal(registration{BackendOptions: core.BackendOptions{Host: *host, Port: uint16(*port),
+		Locality: *locality, Color: *color, Priority: *priority, Tags: splitList(*tags)}, TTL: *ttl})
+	if err != nil {
+		return err
+	}
+	agent := &registrationAgent{client: &http.Client{Timeout: interval / 3}, token: token, body: body}
+	for _, base := range splitList(*urls) {
+		agent.urls = append(agent.urls, strings.TrimSuffix(base, "/")+"/register/"+
+			url.PathEscape(*service)+"/"+url.PathEscape(*id))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval / 3)
+	defer ticker.Stop()
+	for {
+		agent.register()
+		select {
+		case <-ticker.C:
+		case sig := <-signals:
+			log.Infof("received %s, deregistering", sig)
+			agent.deregister()
+			return nil
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/keepalived"
+	"github.com/qk4l/gorb/util"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+var errInvalidStore = errors.New("store content is invalid")
+
+// commands are run instead of the daemon if the first argument matches.
+var commands = map[string]func(args []string) error{
+	"import-keepalived": importKeepalivedCommand,
+	"import-ipvsadm":    importIpvsadmCommand,
+	"validate":          validateCommand,
+	"migrate":           migrateCommand,
+	"agent":             agentCommand,
+}
+
+// runCommand runs a command if the first argument names one and reports if it was found.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	command, exists := commands[args[0]]
+	if !exists {
+		return false, nil
+	}
+	return true, command(args[1:])
+}
+
+// renderImport renders converted services as YAML documents accepted by POST /plan,
+// warnings are rendered as comments.
+func renderImport(services map[string]*core.ServiceConfig, warnings []string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, warning := range warnings {
+		fmt.Fprintf(&b, "# warning: %s\n", warning)
+	}
+	for _, service := range services {
+		service.APIVersion = core.ServiceConfigVersion
+	}
+	if err := yaml.NewEncoder(&b).Encode(services); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// importCommand converts a file (stdin if omitted) with convert and prints GORB services.
+func importCommand(name, usage string, args []string,
+	convert func(io.Reader) (map[string]*core.ServiceConfig, []string, error)) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+	}
+	flags.Parse(args)
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	services, warnings, err := convert(input)
+	if err != nil {
+		return err
+	}
+	output, err := renderImport(services, warnings)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(output)
+	return err
+}
+
+func convertKeepalived(r io.Reader) (map[string]*core.ServiceConfig, []string, error) {
+	result, err := keepalived.Convert(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Services, result.Warnings, nil
+}
+
+func importKeepalivedCommand(args []string) error {
+	return importCommand("import-keepalived", "usage: gorb import-keepalived [keepalived.conf]\n\n"+
+		"Converts virtual servers of keepalived configuration (stdin if omitted) into GORB services.\n",
+		args, convertKeepalived)
+}
+
+func importIpvsadmCommand(args []string) error {
+	return importCommand("import-ipvsadm", "usage: gorb import-ipvsadm [rules]\n\n"+
+		"Converts rules in `ipvsadm -Sn` format (stdin if omitted) into GORB services.\n",
+		args, core.ParseIpvsadm)
+}
+
+// renderValidation renders the plan and problems of store content found by validation.
+func renderValidation(w io.Writer, validation *core.StoreValidation) {
+	for _, op := range validation.Plan.Operations {
+		fmt.Fprintf(w, "%s %s\n", op.Action, op)
+	}
+	for _, skipped := range validation.Plan.Skipped {
+		fmt.Fprintf(w, "invalid %s: %s\n", skipped.Object, skipped.Error)
+	}
+	for _, failed := range validation.Errors {
+		fmt.Fprintf(w, "failed %s: %s\n", failed.Object, failed.Error)
+	}
+	addresses := make([]string, 0, len(validation.DuplicateServices))
+	for address := range validation.DuplicateServices {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		fmt.Fprintf(w, "duplicate %s: %s\n", address, strings.Join(validation.DuplicateServices[address], ", "))
+	}
+}
+
+func validateCommand(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "usage: gorb validate -store <urls> [options]\n\n"+
+			"Loads store content the way synchronization does, applies it to in-memory IPVS and reports\n"+
+			"the resulting plan and all errors. Exits with non-zero status if the content is invalid.\n\n")
+		flags.PrintDefaults()
+	}
+	var (
+		urls          = flags.String("store", "", "comma delimited list of store urls, e.g. file:///etc/gorb")
+		overlays      = flags.String("store-overlays", "", "semicolon delimited list of stores layered on top of -store")
+		servicePath   = flags.String("store-service-path", "services", "store service path")
+		backendPath   = flags.String("store-backend-path", "backends", "store backend path")
+		canonicalIDs  = flags.Bool("store-canonical-ids", false, "derive service and backend IDs from their addresses")
+		ageKey        = flags.String("store-age-key", "", "file with age identities decrypting encrypted store values")
+		host          = flags.String("host", "", "default VIP of services without host, e.g. address of -i interface")
+		backendCIDRs  = flags.String("backend-cidrs", "", "comma delimited networks backends are allowed in")
+		jsonOutput    = flags.Bool("json", false, "print the result as JSON")
+		verboseOutput = flags.Bool("v", false, "log synchronization steps")
+	)
+	flags.Parse(args)
+
+	if *urls == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if !*verboseOutput {
+		log.SetLevel(log.WarnLevel)
+	}
+	var defaultHost net.IP
+	if *host != "" {
+		if defaultHost = net.ParseIP(*host); defaultHost == nil {
+			return fmt.Errorf("invalid default host '%s'", *host)
+		}
+	}
+	networks, err := core.ParseBackendNetworks(splitList(*backendCIDRs))
+	if err != nil {
+		return err
+	}
+
+	validation, err := core.ValidateStore(core.StoreOptions{
+		URLs:         strings.Split(*urls, ","),
+		Overlays:     splitOverlays(*overlays),
+		ServicePath:  *servicePath,
+		BackendPath:  *backendPath,
+		CanonicalIDs: *canonicalIDs,
+		AgeKeyFile:   *ageKey,
+	}, defaultHost, networks)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		os.Stdout.Write(util.MustMarshal(validation, util.JSONOptions{Indent: true}))
+		fmt.Println()
+	} else {
+		renderValidation(os.Stdout, validation)
+	}
+	if !validation.Valid() {
+		return errInvalidStore
+	}
+	return nil
+}
+
+// migrateCommand rewrites service documents (stdin if omitted) in the current layout.
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), "usage: gorb migrate [-w] [file ...]\n\n"+
+			"Rewrites service documents of file stores (stdin if omitted) in the current layout.\n\n")
+		flags.PrintDefaults()
+	}
+	write := flags.Bool("w", false, "write the result to the files instead of stdout")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		output, err := core.MigrateServiceDocument(data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+
+	for i, name := range flags.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		output, err := core.MigrateServiceDocument(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !*write {
+			if i > 0 {
+				fmt.Println("---")
+			}
+			os.Stdout.Write(output)
+		} else if !bytes.Equal(data, output) {
+			if err := os.WriteFile(name, output, 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+// subscribeBackend subscribes the backend to the monitor and attaches it to the
+// backend, so the monitor is released on its removal. Context mutex must be held.
+func (ctx *Context) subscribeBackend(vs *Service, rs *Backend, monitor *sharedMonitor) {
+	id := pulse.ID{VsID: vs.vsID, RsID: rs.rsID}
+	if running, exists := ctx.monitors[monitor.key]; exists {
+		// another sync worker could have started a monitor of the target meanwhile
+		monitor = running
+	}
+	ctx.subscribeMonitor(monitor, id)
+	rs.unsubscribe = func() { ctx.unsubscribeMonitor(monitor, id) }
+}
+
+// ActivateBackend starts health checks of the backend created inactive and
+// brings it to traffic with its weight, so backends could be provisioned long
+// before they are launched.
+func (ctx *Context) ActivateBackend(vsID, rsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	rs, exists := vs.backends[rsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, rs.version); err != nil {
+		return err
+	}
+	if !rs.inactive {
+		return nil
+	}
+
+	// the monitor is looked up again, the one of creation might be stopped since then
+	monitor, err := ctx.backendMonitor(rs.options.host.String(), rs.options.Port, ctx.backendPulse(vs, rs.options))
+	if err != nil {
+		return err
+	}
+	rs.inactive = false
+	ctx.subscribeBackend(vs, rs, monitor)
+	// deleted, drained, excluded and removed backends stay hidden
+	if vs.deleteTimer == nil && rs.deleteTimer == nil && !rs.drained && !rs.excluded && rs.removalTimer == nil {
+		ctx.unhideBackend(vs, rs)
+	}
+	ctx.recordEvent(vsID, rsID, EventActivated, "activated")
+	log.Infof("backend [%s/%s] has been activated", vsID, rsID)
+	ctx.evaluateStatus(vs)
+	if vs.options.Failover != nil {
+		go ctx.requestReweight(vsID)
+	}
+	ctx.revision++
+	rs.version = ctx.revision
+	return nil
+}
@@ -0,0 +1,49 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActivateBackend(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Host: "localhost", Port: 80},
+		ServiceBackends: map[string]*BackendOptions{
+			"a":      {Host: "127.0.1.1", Port: 8080},
+			"launch": {Host: "127.0.1.2", Port: 8080, Inactive: true},
+		},
+	}))
+	vs := c.services["web"]
+	backend, err := c.GetBackend("web", "launch")
+	require.NoError(t, err)
+	assert.True(t, backend.Inactive)
+	assert.Zero(t, backend.Options.weight)
+	assert.Len(t, c.monitors, 1, "inactive backend isn't monitored")
+	assert.Equal(t, 1, vs.statusBackends())
+
+	// neither pulse nor enabling bring the inactive backend to traffic
+	c.processPulseUpdate(make(map[pulse.ID]int32), pulse.Update{Source: pulse.ID{VsID: "web", RsID: "launch"},
+		Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	require.NoError(t, c.DrainBackend("web", "launch", Precondition{}))
+	require.NoError(t, c.EnableBackend("web", "launch", Precondition{}))
+	assert.Zero(t, vs.backends["launch"].options.weight)
+
+	require.NoError(t, c.ActivateBackend("web", "launch", Precondition{}))
+	backend, err = c.GetBackend("web", "launch")
+	require.NoError(t, err)
+	assert.False(t, backend.Inactive)
+	assert.Equal(t, int32(100), backend.Options.weight)
+	assert.Len(t, c.monitors, 2)
+	assert.Equal(t, 2, vs.statusBackends())
+	assert.NoError(t, c.ActivateBackend("web", "launch", Precondition{}), "activation is idempotent")
+
+	assert.ErrorIs(t, c.ActivateBackend("web", "missing", Precondition{}), ErrObjectNotFound)
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/qk4l/gorb/hooks"
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible alert errors.
+var (
+	ErrUnknownAlertMetric   = errors.New("specified alert metric is unknown")
+	ErrUnknownAlertOperator = errors.New("specified alert operator is unknown")
+	ErrDuplicateAlert       = errors.New("alert names must be unique within a service")
+)
+
+// Metrics of a service alerts could be declared on.
+const (
+	AlertMetricBackends        = "backends"
+	AlertMetricHealthyBackends = "healthy_backends"
+	AlertMetricHealth          = "health"
+)
+
+var alertOperators = map[string]func(value, threshold float64) bool{
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+// AlertRule describes a threshold of a service metric, e.g. healthy_backends < 2.
+// The alert fires while the condition holds.
+type AlertRule struct {
+	// Name of the alert, default is the condition itself.
+	Name string `json:"name" yaml:"name"`
+	// Metric is one of backends, healthy_backends or health.
+	Metric    string  `json:"metric" yaml:"metric"`
+	Operator  string  `json:"operator" yaml:"operator"`
+	Threshold float64 `json:"threshold" yaml:"threshold"`
+}
+
+func (a AlertRule) condition() string {
+	return fmt.Sprintf("%s %s %g", a.Metric, a.Operator, a.Threshold)
+}
+
+// Validate fills missing fields and validates alert configuration.
+func (a *AlertRule) Validate() error {
+	switch a.Metric {
+	case AlertMetricBackends, AlertMetricHealthyBackends, AlertMetricHealth:
+	default:
+		return ErrUnknownAlertMetric
+	}
+	if _, ok := alertOperators[a.Operator]; !ok {
+		return ErrUnknownAlertOperator
+	}
+	if a.Name == "" {
+		a.Name = a.condition()
+	}
+	return nil
+}
+
+func validateAlerts(alerts []AlertRule) error {
+	names := make(map[string]bool, len(alerts))
+	for i := range alerts {
+		if err := alerts[i].Validate(); err != nil {
+			return err
+		}
+		if names[alerts[i].Name] {
+			return ErrDuplicateAlert
+		}
+		names[alerts[i].Name] = true
+	}
+	return nil
+}
+
+func equalAlerts(a, b []AlertRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// alertMetrics returns current values of metrics alerts could be declared on.
+func (vs *Service) alertMetrics() map[string]float64 {
+	return map[string]float64{
+		AlertMetricBackends:        float64(len(vs.backends)),
+		AlertMetricHealthyBackends: float64(vs.healthyBackends()),
+		AlertMetricHealth:          vs.health(),
+	}
+}
+
+// evaluateAlerts updates state of service alerts and notifies hooks about
+// fired and resolved ones. Context mutex must be held.
+func (ctx *Context) evaluateAlerts(vs *Service) {
+	if len(vs.options.Alerts) == 0 {
+		return
+	}
+	if vs.firingAlerts == nil {
+		vs.firingAlerts = make(map[string]bool)
+	}
+	metrics := vs.alertMetrics()
+	for _, alert := range vs.options.Alerts {
+		value := metrics[alert.Metric]
+		firing := alertOperators[alert.Operator](value, alert.Threshold)
+		if firing == vs.firingAlerts[alert.Name] {
+			continue
+		}
+		vs.firingAlerts[alert.Name] = firing
+
+		event := hooks.Event{
+			Type:   hooks.EventAlertResolved,
+			VsID:   vs.vsID,
+			Alert:  alert.Name,
+			Reason: fmt.Sprintf("%s is %g, condition %s", alert.Metric, value, alert.condition()),
+		}
+		if firing {
+			event.Type = hooks.EventAlertFiring
+			log.Warnf("alert %q of service [%s] is firing: %s", alert.Name, vs.vsID, event.Reason)
+		} else {
+			log.Infof("alert %q of service [%s] is resolved: %s", alert.Name, vs.vsID, event.Reason)
+		}
+		ctx.recordEvent(vs.vsID, "", EventAlert, "alert %q %s: %s", alert.Name, event.Type, event.Reason)
+		ctx.hooks.Notify(event)
+	}
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceLoad is an aggregate load of a virtual service reported to autoscalers.
+type ServiceLoad struct {
+	VsID            string  `json:"vs_id"`
+	Backends        int     `json:"backends"`
+	HealthyBackends int     `json:"healthy_backends"`
+	PendingBackends int     `json:"pending_backends"`
+	Health          float64 `json:"health"`
+	// ActiveConns is omitted if IPVS is unable to report connections.
+	ActiveConns *uint64 `json:"active_conns,omitempty"`
+}
+
+// ServicesLoad returns aggregate load of all virtual services.
+func (ctx *Context) ServicesLoad() []ServiceLoad {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	counter, _ := ctx.ipvs.(IpvsConnCounter)
+	loads := make([]ServiceLoad, 0, len(ctx.services))
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		load := ServiceLoad{VsID: vsID, Backends: len(vs.backends), Health: vs.CalcServiceStat().Health}
+		for _, rs := range vs.backends {
+			switch {
+			case rs.options.pending:
+				load.PendingBackends++
+			case rs.metrics.Status == pulse.StatusUp:
+				load.HealthyBackends++
+			}
+		}
+		if counter != nil {
+			if conns, err := counter.GetActiveConns(vs.options.host.String(), vs.options.Port, vs.options.protocol); err != nil {
+				log.Warnf("unable to get active connections of service [%s]: %s", vsID, err)
+			} else {
+				var total uint64
+				for _, rs := range vs.backends {
+					total += uint64(conns[net.JoinHostPort(rs.options.host.String(), fmt.Sprint(rs.options.Port))])
+				}
+				load.ActiveConns = &total
+			}
+		}
+		loads = append(loads, load)
+	}
+	return loads
+}
+
+// PreRegisterBackends registers incoming backends announced by autoscaler.
+// They are pending with zero weight until their first successful health check.
+// Backends are registered all or none, ones created before a failure are removed.
+func (ctx *Context) PreRegisterBackends(vsID string, backends map[string]*BackendOptions) error {
+	backends, errs := normalizeIDs(backends, NormalizeBackendID)
+	if len(errs) > 0 {
+		return errs[sortedKeys(errs)[0]]
+	}
+	for rsID, opts := range backends {
+		if opts == nil {
+			return objectError(ErrMissingEndpoint, "rsID", rsID)
+		}
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	for rsID := range backends {
+		if vs.BackendExist(rsID) || len(vs.rangeMembers(rsID)) > 0 {
+			return objectError(ErrObjectExists, "rsID", rsID)
+		}
+	}
+	var created []string
+	for _, rsID := range sortedKeys(backends) {
+		opts := backends[rsID]
+		opts.pending = true
+		if err := ctx.createBackend(vsID, rsID, opts); err != nil {
+			for _, createdID := range created {
+				if _, err := ctx.removeBackend(vsID, createdID); err != nil {
+					log.Errorf("error while removing pre-registered backend [%s/%s]: %s", vsID, createdID, err)
+				}
+			}
+			return fmt.Errorf("backend [%s/%s]: %w", vsID, rsID, err)
+		}
+		created = append(created, rsID)
+	}
+	for _, rsID := range created {
+		log.Infof("backend [%s/%s] is pending until its first successful health check", vsID, rsID)
+	}
+	return nil
+}
+
+// activatePendingBackend gives full weight to a pending backend after its first
+// successful health check. Context mutex must be held.
+func (ctx *Context) activatePendingBackend(vs *Service, rs *Backend) {
+	rs.options.pending = false
+	log.Infof("pending backend [%s/%s] has passed health check", vs.vsID, rs.rsID)
+	if _, err := ctx.updateBackend(vs.vsID, rs.rsID, ctx.backendWeight(vs, rs.options)); err != nil {
+		log.Errorf("error while activating pending backend: %s", err)
+	}
+	ctx.evaluateStatus(vs)
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+)
+
+// ErrInvalidBackendSelector is returned for selectors matching nothing.
+var ErrInvalidBackendSelector = errors.New("backend selector must have addresses, IDs or tags")
+
+// BackendFilter keeps backends of the service out of traffic regardless of the
+// way they are added, e.g. by the store, self-registration or backend ranges.
+// Filtered backends still exist, so whatever adds them doesn't try again.
+type BackendFilter struct {
+	// Include admits backends matching it only, all backends are admitted if it's nil.
+	Include *BackendSelector `json:"include,omitempty" yaml:"include,omitempty"`
+	// Exclude keeps backends matching it out even if they match Include.
+	Exclude *BackendSelector `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+}
+
+// BackendSelector matches backends with any of the addresses, IDs or tags.
+type BackendSelector struct {
+	// Addresses are IPs or CIDRs of backends.
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+	// IDs are shell patterns of backend IDs, e.g. "web-*".
+	IDs []string `json:"ids,omitempty" yaml:"ids,omitempty"`
+	// Tags of backends, see BackendOptions.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	// Addresses parsed into networks
+	networks []netip.Prefix
+}
+
+// Validate validates backend filter configuration.
+func (f *BackendFilter) Validate() error {
+	if f.Include != nil {
+		if err := f.Include.Validate(); err != nil {
+			return fieldError("include", err)
+		}
+	}
+	if f.Exclude != nil {
+		if err := f.Exclude.Validate(); err != nil {
+			return fieldError("exclude", err)
+		}
+	}
+	return nil
+}
+
+// Validate parses addresses and validates ID patterns of the selector.
+func (s *BackendSelector) Validate() error {
+	if len(s.Addresses) == 0 && len(s.IDs) == 0 && len(s.Tags) == 0 {
+		return ErrInvalidBackendSelector
+	}
+	s.networks = make([]netip.Prefix, 0, len(s.Addresses))
+	for _, address := range s.Addresses {
+		network, err := netip.ParsePrefix(address)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(address)
+			if addrErr != nil {
+				return fieldError("addresses", fmt.Errorf("%w: %s", ErrInvalidBackendSelector, address))
+			}
+			network = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		s.networks = append(s.networks, network.Masked())
+	}
+	for _, pattern := range s.IDs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fieldError("ids", fmt.Errorf("%w: %s", err, pattern))
+		}
+	}
+	return nil
+}
+
+// matches tells if the backend has any of the addresses, IDs or tags.
+func (s *BackendSelector) matches(rsID string, opts *BackendOptions) bool {
+	if addr, ok := netip.AddrFromSlice(opts.host); ok {
+		addr = addr.Unmap()
+		for _, network := range s.networks {
+			if network.Contains(addr) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range s.IDs {
+		if matched, _ := path.Match(pattern, rsID); matched {
+			return true
+		}
+	}
+	for _, tag := range s.Tags {
+		if slices.Contains(opts.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes tells if the backend is kept out of traffic by the filter.
+func (f *BackendFilter) excludes(rsID string, opts *BackendOptions) bool {
+	if f == nil {
+		return false
+	}
+	if f.Include != nil && !f.Include.matches(rsID, opts) {
+		return true
+	}
+	return f.Exclude != nil && f.Exclude.matches(rsID, opts)
+}
+
+func equalBackendSelectors(a, b *BackendSelector) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return slices.Equal(a.Addresses, b.Addresses) && slices.Equal(a.IDs, b.IDs) && slices.Equal(a.Tags, b.Tags)
+}
+
+func equalBackendFilters(a, b *BackendFilter) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equalBackendSelectors(a.Include, b.Include) && equalBackendSelectors(a.Exclude, b.Exclude)
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendFilter(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	options := func() *ServiceOptions {
+		return &ServiceOptions{Host: "localhost", Port: 80, BackendFilter: &BackendFilter{
+			Include: &BackendSelector{Addresses: []string{"127.0.1.0/24"}},
+			Exclude: &BackendSelector{Addresses: []string{"127.0.1.3"}, IDs: []string{"canary-*"}, Tags: []string{"maintenance"}},
+		}}
+	}
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions: options(),
+		ServiceBackends: map[string]*BackendOptions{
+			"a":        {Host: "127.0.1.1", Port: 8080},
+			"b":        {Host: "127.0.1.2", Port: 8080, Tags: []string{"maintenance"}},
+			"c":        {Host: "127.0.1.3", Port: 8080},
+			"canary-1": {Host: "127.0.1.4", Port: 8080},
+			"outside":  {Host: "127.0.2.1", Port: 8080},
+		},
+	}))
+	vs := c.services["web"]
+	for _, rsID := range []string{"b", "c", "canary-1", "outside"} {
+		backend, err := c.GetBackend("web", rsID)
+		require.NoError(t, err)
+		assert.True(t, backend.Excluded, rsID)
+		assert.Zero(t, backend.Options.weight, rsID)
+	}
+	backend, err := c.GetBackend("web", "a")
+	require.NoError(t, err)
+	assert.False(t, backend.Excluded)
+	assert.Equal(t, int32(100), backend.Options.weight)
+
+	// pulse, enabling and restoring don't bring excluded backends back
+	c.processPulseUpdate(make(map[pulse.ID]int32), pulse.Update{Source: pulse.ID{VsID: "web", RsID: "b"},
+		Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	require.NoError(t, c.DrainBackend("web", "b", Precondition{}))
+	require.NoError(t, c.EnableBackend("web", "b", Precondition{}))
+	assert.Zero(t, vs.backends["b"].options.weight)
+	assert.Equal(t, 1, vs.statusBackends())
+
+	// the service is recreated with the changed filter
+	config := vs.config()
+	config.ServiceOptions = options()
+	config.ServiceOptions.BackendFilter.Include = nil
+	_, err = c.PutService("web", config, Precondition{})
+	require.NoError(t, err)
+	assert.False(t, c.services["web"].backends["outside"].excluded)
+	assert.True(t, c.services["web"].backends["canary-1"].excluded)
+
+	for _, selector := range []*BackendSelector{{}, {Addresses: []string{"backend"}}, {IDs: []string{"["}}} {
+		err = (&ServiceOptions{Host: "localhost", Port: 80, BackendFilter: &BackendFilter{Exclude: selector}}).Validate(nil)
+		assert.Error(t, err)
+		assert.Contains(t, ErrorField(err), "backend_filter.exclude")
+	}
+}
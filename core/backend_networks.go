@@ -0,0 +1,48 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrBackendNotAllowed is returned for backends outside of networks allowed by ContextOptions.
+var ErrBackendNotAllowed = errors.New("backend address is outside of allowed networks")
+
+// backendNetworks restrict addresses of backends, any address is allowed if empty.
+type backendNetworks []*net.IPNet
+
+// ParseBackendNetworks parses networks in CIDR notation, e.g. 10.0.0.0/8.
+func ParseBackendNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// check checks the resolved backend address is within one of the networks.
+func (n backendNetworks) check(host net.IP) error {
+	if len(n) == 0 {
+		return nil
+	}
+	for _, network := range n {
+		if network.Contains(host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is not in %s", ErrBackendNotAllowed, host, n)
+}
+
+func (n backendNetworks) String() string {
+	networks := make([]string, 0, len(n))
+	for _, network := range n {
+		networks = append(networks, network.String())
+	}
+	return strings.Join(networks, ", ")
+}
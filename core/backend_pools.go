@@ -0,0 +1,203 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible backend pool errors.
+var (
+	ErrPoolInUse      = errors.New("backend pool is referenced by services")
+	ErrPooledBackend  = errors.New("backend belongs to a backend pool, change the pool instead")
+	ErrPoolNotDefined = errors.New("backend pool referenced by the service isn't defined")
+)
+
+// BackendPoolConfig describes backends shared by services referencing the pool.
+// Each backend of the pool is checked by a single pulse monitor regardless of a
+// number of services.
+type BackendPoolConfig struct {
+	Pulse    *pulse.Options             `json:"pulse" yaml:"pulse"`
+	Backends map[string]*BackendOptions `json:"backends" yaml:"backends"`
+}
+
+// Validate fills missing fields and validates backend pool configuration.
+func (c *BackendPoolConfig) Validate() error {
+	if c.Pulse == nil {
+		c.Pulse = &pulse.Options{}
+	}
+	if err := c.Pulse.Validate(); err != nil {
+		return err
+	}
+	for rsID, opts := range c.Backends {
+		if err := validateBackendID(rsID); err != nil {
+			return err
+		}
+		if opts == nil {
+			return objectError(ErrMissingEndpoint, "rsID", rsID)
+		}
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("backend [%s]: %w", rsID, err)
+		}
+	}
+	return nil
+}
+
+// BackendPoolInfo contains information about a backend pool and services referencing it.
+type BackendPoolInfo struct {
+	*BackendPoolConfig
+	Services []string `json:"services"`
+	Version  uint64   `json:"version"`
+}
+
+// poolBackend returns options of the pool backend for a service.
+func poolBackend(poolID string, opts *BackendOptions) *BackendOptions {
+	backend := *opts
+	backend.pool = poolID
+	return &backend
+}
+
+// poolServices returns services referencing the pool. Context mutex must be held.
+func (ctx *Context) poolServices(poolID string) []*Service {
+	var services []*Service
+	for _, vsID := range sortedKeys(ctx.services) {
+		if vs := ctx.services[vsID]; vs.options.Pool == poolID {
+			services = append(services, vs)
+		}
+	}
+	return services
+}
+
+// addPoolBackends adds backends of the pool referenced by the service. Context mutex must be held.
+func (ctx *Context) addPoolBackends(vs *Service) error {
+	pool, exists := ctx.backendPools[vs.options.Pool]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrPoolNotDefined, vs.options.Pool)
+	}
+	for _, rsID := range sortedKeys(pool.Backends) {
+		if err := ctx.createBackend(vs.vsID, rsID, poolBackend(vs.options.Pool, pool.Backends[rsID])); err != nil {
+			return fmt.Errorf("backend [%s/%s] of pool [%s]: %w", vs.vsID, rsID, vs.options.Pool, err)
+		}
+	}
+	return nil
+}
+
+// PutBackendPool creates the backend pool or updates the existing one together with
+// backends of services referencing it.
+func (ctx *Context) PutBackendPool(poolID string, config *BackendPoolConfig, pre Precondition) (created bool, err error) {
+	if err := validateID(poolID); err != nil {
+		return false, err
+	}
+	if err := config.Validate(); err != nil {
+		return false, err
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	_, exists := ctx.backendPools[poolID]
+	if err := ctx.checkPrecondition(pre, exists, ctx.poolVersions[poolID]); err != nil {
+		return false, err
+	}
+	return ctx.putBackendPool(poolID, config)
+}
+
+// putBackendPool creates the backend pool or updates the existing one. Context mutex must be held.
+func (ctx *Context) putBackendPool(poolID string, config *BackendPoolConfig) (created bool, err error) {
+	for _, vs := range ctx.poolServices(poolID) {
+		if err := vs.options.checkBackendPorts(config.Backends); err != nil {
+			return false, fmt.Errorf("service [%s]: %w", vs.vsID, err)
+		}
+	}
+
+	previous, exists := ctx.backendPools[poolID]
+	if ctx.backendPools == nil {
+		ctx.backendPools = make(map[string]*BackendPoolConfig)
+		ctx.poolVersions = make(map[string]uint64)
+	}
+	ctx.backendPools[poolID] = config
+	ctx.revision++
+	ctx.poolVersions[poolID] = ctx.revision
+
+	// monitors are restarted with new pulse options, so backends are recreated
+	pulseChanged := exists && !reflect.DeepEqual(previous.Pulse, config.Pulse)
+	for _, vs := range ctx.poolServices(poolID) {
+		for _, rsID := range sortedKeys(vs.backends) {
+			rs := vs.backends[rsID]
+			if rs.options.pool != poolID {
+				continue
+			}
+			opts, keep := config.Backends[rsID]
+			if !keep || pulseChanged {
+				if _, err := ctx.removeBackend(vs.vsID, rsID); err != nil {
+					return false, err
+				}
+			} else if !rs.options.CompareStoreOptions(opts) {
+				if err := ctx.applySyncOperation(&SyncOperation{Action: SyncActionUpdate, VsID: vs.vsID, RsID: rsID,
+					backend: poolBackend(poolID, opts)}); err != nil {
+					return false, err
+				}
+			}
+		}
+		for _, rsID := range sortedKeys(config.Backends) {
+			if vs.BackendExist(rsID) {
+				continue
+			}
+			if err := ctx.createBackend(vs.vsID, rsID, poolBackend(poolID, config.Backends[rsID])); err != nil {
+				return false, fmt.Errorf("backend [%s/%s]: %w", vs.vsID, rsID, err)
+			}
+		}
+	}
+	log.Infof("backend pool [%s] has %d backend(s)", poolID, len(config.Backends))
+	return !exists, nil
+}
+
+// GetBackendPool returns information about the backend pool.
+func (ctx *Context) GetBackendPool(poolID string) (*BackendPoolInfo, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	config, exists := ctx.backendPools[poolID]
+	if !exists {
+		return nil, objectError(ErrObjectNotFound, "pool", poolID)
+	}
+	info := &BackendPoolInfo{BackendPoolConfig: config, Services: []string{}, Version: ctx.poolVersions[poolID]}
+	for _, vs := range ctx.poolServices(poolID) {
+		info.Services = append(info.Services, vs.vsID)
+	}
+	return info, nil
+}
+
+// ListBackendPools returns IDs of all backend pools.
+func (ctx *Context) ListBackendPools() []string {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	return sortedKeys(ctx.backendPools)
+}
+
+// RemoveBackendPool removes the backend pool unless services reference it.
+func (ctx *Context) RemoveBackendPool(poolID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if _, exists := ctx.backendPools[poolID]; !exists {
+		return objectError(ErrObjectNotFound, "pool", poolID)
+	}
+	if err := ctx.checkPrecondition(pre, true, ctx.poolVersions[poolID]); err != nil {
+		return err
+	}
+	return ctx.removeBackendPool(poolID)
+}
+
+// removeBackendPool removes the backend pool unless services reference it. Context mutex must be held.
+func (ctx *Context) removeBackendPool(poolID string) error {
+	if len(ctx.poolServices(poolID)) > 0 {
+		return ErrPoolInUse
+	}
+	delete(ctx.backendPools, poolID)
+	delete(ctx.poolVersions, poolID)
+	return nil
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendPool(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	err := c.CreateService("web", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Port: 80, Pool: "shared"}})
+	assert.ErrorIs(t, err, ErrPoolNotDefined)
+
+	created, err := c.PutBackendPool("shared", &BackendPoolConfig{Backends: map[string]*BackendOptions{
+		"a": {Host: "127.0.0.2", Port: 8080},
+		"b": {Host: "127.0.0.3", Port: 8080},
+	}}, Precondition{})
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	for vsID, port := range map[string]uint16{"web": 80, "api": 8000} {
+		require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Port: port, Pool: "shared"}}))
+		backend, err := c.GetBackend(vsID, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "shared", backend.Pool)
+	}
+	assert.Len(t, c.monitors, 2, "a single monitor per pool backend")
+	keyA := monitorKey("127.0.0.2", 8080, c.backendPools["shared"].Pulse)
+	assert.Equal(t, []pulse.ID{{VsID: "api", RsID: "a"}, {VsID: "web", RsID: "a"}},
+		c.pulseTargets(pulse.Update{Source: c.monitors[keyA].id}))
+
+	info, err := c.GetBackendPool("shared")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api", "web"}, info.Services)
+
+	// pooled backends are changed through the pool only
+	_, err = c.PutBackend("web", "a", &BackendOptions{Host: "127.0.0.4", Port: 8080}, Precondition{})
+	assert.Equal(t, ErrPooledBackend, err)
+	assert.Equal(t, ErrPoolInUse, c.RemoveBackendPool("shared", Precondition{}))
+
+	created, err = c.PutBackendPool("shared", &BackendPoolConfig{Backends: map[string]*BackendOptions{
+		"b": {Host: "127.0.0.3", Port: 8080},
+	}}, Precondition{})
+	require.NoError(t, err)
+	assert.False(t, created)
+	for _, vsID := range []string{"web", "api"} {
+		_, err = c.GetBackend(vsID, "a")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	}
+	assert.NotContains(t, c.monitors, keyA)
+	assert.Contains(t, c.monitors, monitorKey("127.0.0.3", 8080, c.backendPools["shared"].Pulse))
+
+	for _, vsID := range []string{"web", "api"} {
+		_, err = c.RemoveService(vsID)
+		require.NoError(t, err)
+	}
+	assert.Empty(t, c.monitors)
+	require.NoError(t, c.RemoveBackendPool("shared", Precondition{}))
+	assert.Empty(t, c.ListBackendPools())
+}
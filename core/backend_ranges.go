@@ -0,0 +1,230 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRangeBackends limits a number of backends a backend range expands into.
+const maxRangeBackends = 256
+
+// Possible backend range errors.
+var (
+	ErrInvalidBackendRange = errors.New("backend range must be a CIDR like 10.0.0.0/28 or " +
+		"a range of addresses like 10.0.0.1-10.0.0.14")
+	ErrBackendRangeTooLarge   = fmt.Errorf("backend range can't have more than %d addresses", maxRangeBackends)
+	ErrBackendRangeNotAllowed = errors.New("backend ranges are allowed in backends of services only")
+	ErrRangeBackend           = errors.New("backend belongs to a backend range, change the range instead")
+)
+
+// backendRange is a backend with a range of addresses as its host. It's expanded
+// into a pending backend per address, and pulse monitors of these backends find
+// out which addresses are actually in use.
+type backendRange struct {
+	rsID    string
+	options *BackendOptions
+}
+
+// rangeAddresses returns addresses of the host if it's a CIDR or a range of
+// addresses, and nil otherwise. Network and broadcast addresses of IPv4
+// networks are skipped.
+func rangeAddresses(host string) ([]netip.Addr, error) {
+	var first, last netip.Addr
+	if strings.Contains(host, "/") {
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackendRange, host)
+		}
+		prefix = prefix.Masked()
+		first, last = prefix.Addr(), lastAddr(prefix)
+		if first.Is4() && prefix.Bits() < 31 {
+			first, last = first.Next(), last.Prev()
+		}
+	} else if from, to, found := strings.Cut(host, "-"); found {
+		var err error
+		// host names could contain dashes as well
+		if first, err = netip.ParseAddr(from); err != nil {
+			return nil, nil
+		}
+		if last, err = netip.ParseAddr(to); err != nil {
+			return nil, nil
+		}
+		if first.Is4() != last.Is4() || first.Compare(last) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidBackendRange, host)
+		}
+	} else {
+		return nil, nil
+	}
+
+	var addrs []netip.Addr
+	for addr := first; addr.IsValid() && addr.Compare(last) <= 0; addr = addr.Next() {
+		if len(addrs) == maxRangeBackends {
+			return nil, fmt.Errorf("%w: %s", ErrBackendRangeTooLarge, host)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// lastAddr returns the last address of the network.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// expandBackendRange returns backends of the range keyed by their IDs, which are
+// the range ID followed by the address, e.g. "app-10.0.0.1". It returns nil if
+// the backend isn't a range.
+func expandBackendRange(rsID string, opts *BackendOptions) (map[string]*BackendOptions, error) {
+	addrs, err := rangeAddresses(opts.Host)
+	if err != nil {
+		return nil, fieldError("host", err)
+	}
+	if addrs == nil {
+		return nil, nil
+	}
+
+	template := &backendRange{rsID: rsID, options: opts}
+	members := make(map[string]*BackendOptions, len(addrs))
+	for _, addr := range addrs {
+		memberID := rsID + "-" + addr.String()
+		if err := validateID(memberID); err != nil {
+			return nil, err
+		}
+		member := *opts
+		member.Host = addr.String()
+		member.pending = true
+		member.rangeOf = template
+		members[memberID] = &member
+	}
+	return members, nil
+}
+
+// expandBackendRanges replaces backend ranges with backends they expand into.
+// Invalid ranges and ranges expanding into IDs of other backends are returned
+// in errs keyed by their IDs.
+func expandBackendRanges(backends map[string]*BackendOptions) (expanded map[string]*BackendOptions,
+	errs map[string]error) {
+	if backends == nil {
+		return nil, nil
+	}
+	expanded = make(map[string]*BackendOptions, len(backends))
+	ranges := make(map[string]map[string]*BackendOptions)
+	for _, rsID := range sortedKeys(backends) {
+		opts := backends[rsID]
+		if opts == nil {
+			expanded[rsID] = nil
+			continue
+		}
+		members, err := expandBackendRange(rsID, opts)
+		switch {
+		case err != nil:
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[rsID] = err
+		case members != nil:
+			ranges[rsID] = members
+		default:
+			expanded[rsID] = opts
+		}
+	}
+	for _, rsID := range sortedKeys(ranges) {
+		for memberID := range ranges[rsID] {
+			if _, exists := expanded[memberID]; exists {
+				if errs == nil {
+					errs = make(map[string]error)
+				}
+				errs[rsID] = objectError(ErrObjectExists, "rsID", memberID)
+			}
+		}
+		if _, invalid := errs[rsID]; !invalid {
+			for memberID, member := range ranges[rsID] {
+				expanded[memberID] = member
+			}
+		}
+	}
+	return expanded, errs
+}
+
+// rangeMembers returns backends expanded from the backend range ordered by IDs.
+func (vs *Service) rangeMembers(rsID string) []*Backend {
+	var members []*Backend
+	for _, memberID := range sortedKeys(vs.backends) {
+		if rangeOf := vs.backends[memberID].options.rangeOf; rangeOf != nil && rangeOf.rsID == rsID {
+			members = append(members, vs.backends[memberID])
+		}
+	}
+	return members
+}
+
+// backendOptions returns options of the backend or the backend range.
+func (vs *Service) backendOptions(rsID string) (*BackendOptions, bool) {
+	if rs, exists := vs.backends[rsID]; exists {
+		return rs.options, true
+	}
+	if members := vs.rangeMembers(rsID); len(members) > 0 {
+		return members[0].options.rangeOf.options, true
+	}
+	return nil, false
+}
+
+// rangeVersion returns the version of the backend range, which is the version of
+// its latest backend.
+func rangeVersion(members []*Backend) uint64 {
+	var version uint64
+	for _, rs := range members {
+		version = max(version, rs.version)
+	}
+	return version
+}
+
+// rangeInfo returns information about the backend range, it's pending until any
+// of its backends is found.
+func rangeInfo(members []*Backend) *BackendInfo {
+	info := &BackendInfo{Options: members[0].options.rangeOf.options, Version: rangeVersion(members), Pending: true}
+	for _, rs := range members {
+		info.Backends = append(info.Backends, rs.rsID)
+		info.Pending = info.Pending && rs.options.pending
+	}
+	return info
+}
+
+// createBackendRange creates backends expanded from the backend range. Backends
+// created before a failure are removed. Context mutex must be held.
+func (ctx *Context) createBackendRange(vs *Service, rsID string, members map[string]*BackendOptions) error {
+	if vs.BackendExist(rsID) {
+		return objectError(ErrObjectExists, "rsID", rsID)
+	}
+	log.Infof("creating %d backend(s) of range [%s/%s]", len(members), vs.vsID, rsID)
+	for _, memberID := range sortedKeys(members) {
+		if err := ctx.createBackend(vs.vsID, memberID, members[memberID]); err != nil {
+			if len(vs.rangeMembers(rsID)) > 0 {
+				if _, err := ctx.removeBackend(vs.vsID, rsID); err != nil {
+					log.Errorf("failed to clean up backend range [%s/%s]: %s", vs.vsID, rsID, err)
+				}
+			}
+			return fmt.Errorf("backend [%s/%s] of range [%s]: %w", vs.vsID, memberID, rsID, err)
+		}
+	}
+	return nil
+}
+
+// removeBackendRange removes all backends of the backend range and returns its
+// options. Context mutex must be held.
+func (ctx *Context) removeBackendRange(vs *Service, members []*Backend) (*BackendOptions, error) {
+	for _, rs := range members {
+		if _, err := ctx.removeBackend(vs.vsID, rs.rsID); err != nil {
+			return nil, err
+		}
+	}
+	return members[0].options.rangeOf.options, nil
+}
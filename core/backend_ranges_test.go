@@ -0,0 +1,122 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeAddresses(t *testing.T) {
+	addrs, err := rangeAddresses("10.1.2.5/29")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("10.1.2.1"), netip.MustParseAddr("10.1.2.2"),
+		netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("10.1.2.4"), netip.MustParseAddr("10.1.2.5"),
+		netip.MustParseAddr("10.1.2.6")}, addrs)
+
+	addrs, err = rangeAddresses("10.1.2.254-10.1.3.1")
+	require.NoError(t, err)
+	assert.Len(t, addrs, 4)
+	addrs, err = rangeAddresses("fd00::/126")
+	require.NoError(t, err)
+	assert.Len(t, addrs, 4)
+	addrs, err = rangeAddresses("10.1.2.1/31")
+	require.NoError(t, err)
+	assert.Len(t, addrs, 2)
+
+	for _, host := range []string{"10.1.2.1", "backend-1.local", "localhost"} {
+		addrs, err = rangeAddresses(host)
+		assert.NoError(t, err)
+		assert.Nil(t, addrs, host)
+	}
+	for _, host := range []string{"10.1.2.0/33", "10.1.2.9-10.1.2.1", "10.1.2.1-fd00::1"} {
+		_, err = rangeAddresses(host)
+		assert.ErrorIs(t, err, ErrInvalidBackendRange, host)
+	}
+	_, err = rangeAddresses("10.0.0.0/16")
+	assert.ErrorIs(t, err, ErrBackendRangeTooLarge)
+}
+
+func TestBackendRange(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	template := func(host string) map[string]*BackendOptions {
+		return map[string]*BackendOptions{"app": {Host: host, Port: 8080}}
+	}
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80},
+		ServiceBackends: template("127.0.1.0/30"),
+	}))
+	vs := c.services["web"]
+	assert.Equal(t, []string{"app-127.0.1.1", "app-127.0.1.2"}, sortedKeys(vs.backends))
+	backend, err := c.GetBackend("web", "app-127.0.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "app", backend.Range)
+	assert.True(t, backend.Pending)
+	assert.Zero(t, backend.Options.weight)
+	assert.Equal(t, ServiceDown, vs.status())
+
+	// the backend found at its address makes the service healthy, the other one doesn't count
+	c.processPulseUpdate(make(map[pulse.ID]int32), pulse.Update{Source: pulse.ID{VsID: "web", RsID: "app-127.0.1.1"},
+		Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.False(t, vs.backends["app-127.0.1.1"].options.pending)
+	assert.Equal(t, int32(100), vs.backends["app-127.0.1.1"].options.weight)
+	assert.Equal(t, ServiceHealthy, vs.status())
+
+	// the range is kept in the configuration instead of its backends
+	assert.Equal(t, template("127.0.1.0/30"), vs.config().ServiceBackends)
+	created, err := c.PutService("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80},
+		ServiceBackends: template("127.0.1.0/30"),
+	}, Precondition{})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.False(t, vs.backends["app-127.0.1.1"].options.pending, "unchanged range isn't recreated")
+
+	// backends of the range are changed with the range only
+	_, err = c.PutBackend("web", "app-127.0.1.1", &BackendOptions{Host: "127.0.1.1", Port: 8081}, Precondition{})
+	assert.Equal(t, ErrRangeBackend, err)
+	assert.Equal(t, ErrRangeBackend, c.DeleteBackend("web", "app-127.0.1.2", Precondition{}))
+	created, err = c.PutBackend("web", "app", &BackendOptions{Host: "127.0.1.1-127.0.1.3", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, []string{"app-127.0.1.1", "app-127.0.1.2", "app-127.0.1.3"}, sortedKeys(vs.backends))
+	backend, err = c.GetBackend("web", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app-127.0.1.1", "app-127.0.1.2", "app-127.0.1.3"}, backend.Backends)
+	assert.Equal(t, "127.0.1.1-127.0.1.3", backend.Options.Host)
+	assert.Equal(t, vs.backends["app-127.0.1.3"].version, backend.Version)
+
+	// backends of the range are rolled back if any of them can't be created
+	require.NoError(t, c.CreateBackend("web", "single", &BackendOptions{Host: "127.0.2.2", Port: 8080}))
+	err = c.CreateBackend("web", "other", &BackendOptions{Host: "127.0.2.0/30", Port: 8080})
+	assert.ErrorIs(t, err, ErrDuplicateBackend)
+	assert.False(t, vs.BackendExist("other"))
+	assert.ErrorIs(t, c.CreateBackend("web", "app", &BackendOptions{Host: "127.0.3.0/30", Port: 8080}), ErrObjectExists)
+
+	require.NoError(t, c.DeleteBackend("web", "app", Precondition{}))
+	assert.Equal(t, []string{"single"}, sortedKeys(vs.backends))
+
+	// store ranges are expanded, so their backends are synchronized one by one
+	config := &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"app":     {Host: "127.0.1.0/30", Port: 8080},
+			"invalid": {Host: "127.0.1.0/40", Port: 8080},
+		},
+	}
+	config.validate(nil, nil)
+	assert.Equal(t, []string{"app-127.0.1.1", "app-127.0.1.2"}, sortedKeys(config.ServiceBackends))
+	assert.True(t, config.ServiceBackends["app-127.0.1.1"].pending)
+	assert.ErrorIs(t, config.invalidBackends["invalid"], ErrInvalidBackendRange)
+	assert.Equal(t, "host", ErrorField(config.invalidBackends["invalid"]))
+
+	// ranges aren't expanded in backend pools
+	err = (&BackendOptions{Host: "127.0.1.0/30", Port: 8080}).Validate()
+	assert.ErrorIs(t, err, ErrBackendRangeNotAllowed)
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backupVersion is a version of backup archive format.
+const backupVersion = 1
+
+// Possible backup errors.
+var (
+	ErrBackupKeyMissing = errors.New("backup signing key is not configured")
+	ErrInvalidBackup    = errors.New("backup archive is malformed or has unsupported version")
+	ErrBackupSignature  = errors.New("backup signature doesn't match")
+)
+
+// BackupBackend is a backend configuration with its current weight.
+type BackupBackend struct {
+	Options *BackendOptions `json:"options"`
+	Weight  int32           `json:"weight"`
+}
+
+// BackupService is a service configuration with its backends.
+type BackupService struct {
+	Options  *ServiceOptions           `json:"options"`
+	Backends map[string]*BackupBackend `json:"backends"`
+}
+
+// backupArchive is a signed backup of all services. Signature is HMAC-SHA256
+// of the raw payload, so the payload is kept as is until it is verified.
+type backupArchive struct {
+	Version   int             `json:"version"`
+	Created   time.Time       `json:"created"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+func signBackup(payload, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backup returns a signed archive of all services including pulse options
+// and current weights of backends.
+func (ctx *Context) Backup(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrBackupKeyMissing
+	}
+
+	ctx.mutex.RLock()
+	services := make(map[string]*BackupService, len(ctx.services))
+	for vsID, vs := range ctx.services {
+		service := &BackupService{Options: vs.options, Backends: make(map[string]*BackupBackend, len(vs.backends))}
+		for rsID, rs := range vs.backends {
+			service.Backends[rsID] = &BackupBackend{Options: rs.options, Weight: rs.options.weight}
+		}
+		services[vsID] = service
+	}
+	payload, err := json.Marshal(services)
+	ctx.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&backupArchive{
+		Version:   backupVersion,
+		Created:   time.Now().UTC(),
+		Payload:   payload,
+		Signature: signBackup(payload, key),
+	})
+}
+
+// Restore brings services to the state of the signed archive created by Backup.
+// Services and backends missing in the archive are removed.
+func (ctx *Context) Restore(data, key []byte) (*StoreSyncResult, error) {
+	if len(key) == 0 {
+		return nil, ErrBackupKeyMissing
+	}
+	if ctx.StoreManaged() {
+		return nil, ErrStoreManaged
+	}
+
+	var archive backupArchive
+	if err := json.Unmarshal(data, &archive); err != nil || archive.Version != backupVersion {
+		return nil, ErrInvalidBackup
+	}
+	if !hmac.Equal([]byte(archive.Signature), []byte(signBackup(archive.Payload, key))) {
+		return nil, ErrBackupSignature
+	}
+	var backup map[string]*BackupService
+	if err := json.Unmarshal(archive.Payload, &backup); err != nil {
+		return nil, ErrInvalidBackup
+	}
+
+	services := make(map[string]*ServiceConfig, len(backup))
+	for vsID, service := range backup {
+		if service == nil {
+			return nil, fmt.Errorf("%w: service [%s] is empty", ErrInvalidBackup, vsID)
+		}
+		config := &ServiceConfig{ServiceOptions: service.Options, ServiceBackends: make(map[string]*BackendOptions)}
+		for rsID, backend := range service.Backends {
+			if backend == nil {
+				return nil, fmt.Errorf("%w: backend [%s/%s] is empty", ErrInvalidBackup, vsID, rsID)
+			}
+			config.ServiceBackends[rsID] = backend.Options
+		}
+		services[vsID] = config
+	}
+	services = normalizeServiceIDs(services)
+	validateServiceConfigs(services, ctx.endpoint, ctx.backendNetworks)
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	log.Infof("restoring %d service(s) from backup created at %s", len(services), archive.Created)
+	result := newStoreSyncResult()
+	ctx.applySyncPlan(context.Background(), ctx.planSync(services), result)
+	// weights are restored as is, pulse adjusts them on the next status change
+	for vsID, service := range backup {
+		for rsID, backend := range service.Backends {
+			vs, exists := ctx.services[vsID]
+			if !exists {
+				continue
+			}
+			rs, exists := vs.backends[rsID]
+			if !exists || rs.options.weight == backend.Weight {
+				continue
+			}
+			if _, err := ctx.updateBackend(vsID, rsID, backend.Weight); err != nil {
+				result.addError(fmt.Sprintf("[%s/%s]", vsID, rsID), err)
+			}
+		}
+	}
+	result.finish()
+	return result, result.Err()
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSwitchSteps is a number of weight changes during a gradual color switch.
+const defaultSwitchSteps = 10
+
+// Bounds of gradual color switch steps, so the switch doesn't spin on weight changes.
+const (
+	maxSwitchSteps    = 1000
+	minSwitchInterval = 10 * time.Millisecond
+)
+
+// ErrInvalidSwitchSteps is returned for gradual color switches with too many steps.
+var ErrInvalidSwitchSteps = errors.New("color switch must have up to 1000 steps at least 10ms apart")
+
+// colorFactor returns a share of max weight for backends of the color.
+// Backends without color aren't affected by color switching.
+func (vs *Service) colorFactor(color string) float64 {
+	switch {
+	case vs.activeColor == "" || color == "":
+		return 1
+	case color == vs.activeColor:
+		return vs.switchProgress
+	case color == vs.previousColor:
+		return 1 - vs.switchProgress
+	}
+	return 0
+}
+
+func (vs *Service) hasColor(color string) bool {
+	for _, rs := range vs.backends {
+		if rs.options.Color == color {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelSwitch stops gradual color switch if it is in progress.
+func (vs *Service) cancelSwitch() {
+	if vs.switchCancel != nil {
+		close(vs.switchCancel)
+		vs.switchCancel = nil
+	}
+}
+
+// SwitchColor moves all traffic of the virtual service to backends of the color.
+// With non-zero duration weights are moved gradually in steps, otherwise at once.
+func (ctx *Context) SwitchColor(vsID, color string, duration time.Duration, steps int, pre Precondition) error {
+	if steps <= 0 {
+		steps = defaultSwitchSteps
+	}
+	if duration > 0 && (steps > maxSwitchSteps || duration/time.Duration(steps) < minSwitchInterval) {
+		return fieldError("steps", ErrInvalidSwitchSteps)
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	if !vs.hasColor(color) {
+		return objectError(ErrObjectNotFound, "color", color)
+	}
+
+	vs.cancelSwitch()
+	if color != vs.activeColor {
+		vs.previousColor, vs.activeColor = vs.activeColor, color
+		vs.switchProgress = 0
+		ctx.revision++
+		vs.version = ctx.revision
+	}
+
+	if duration <= 0 {
+		log.Infof("switching service [%s] to color %s", vsID, color)
+		vs.switchProgress = 1
+		go ctx.requestReweight(vsID)
+		return nil
+	}
+
+	log.Infof("switching service [%s] to color %s in %s", vsID, color, duration)
+	vs.switchCancel = make(chan struct{})
+	go ctx.switchGradually(vs, duration/time.Duration(steps), 1/float64(steps), vs.switchCancel)
+	return nil
+}
+
+func (ctx *Context) switchGradually(vs *Service, interval time.Duration, step float64, cancel chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-cancel:
+			return
+		case <-ctx.stopCh:
+			return
+		}
+
+		ctx.mutex.Lock()
+		select {
+		case <-cancel:
+			ctx.mutex.Unlock()
+			return
+		default:
+		}
+		vs.switchProgress += step
+		done := vs.switchProgress >= 1-step/2
+		if done {
+			vs.switchProgress = 1
+			vs.switchCancel = nil
+		}
+		log.Infof("switching service [%s] to color %s: %.0f%%", vs.vsID, vs.activeColor, vs.switchProgress*100)
+		ctx.mutex.Unlock()
+
+		ctx.requestReweight(vs.vsID)
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible precondition errors.
+var (
+	ErrPreconditionFailed = errors.New("object doesn't match the precondition, it has been modified concurrently")
+	ErrVersionRequired    = errors.New("version of the object is required to modify it in strict mode")
+)
+
+// Precondition of a write, so concurrent modifications could be detected.
+type Precondition struct {
+	// Version the object must have, any version if zero
+	Version uint64
+	// MustExist requires the object to exist
+	MustExist bool
+	// MustNotExist requires the object to be absent
+	MustNotExist bool
+}
+
+func (p Precondition) check(exists bool, version uint64) error {
+	switch {
+	case p.MustExist && !exists, p.MustNotExist && exists:
+		return ErrPreconditionFailed
+	case p.Version != 0 && (!exists || version != p.Version):
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// checkPrecondition checks the precondition of a write. In strict mode
+// existing objects could be modified only if their version is known.
+// Context mutex must be held.
+func (ctx *Context) checkPrecondition(pre Precondition, exists bool, version uint64) error {
+	if ctx.strictVersions && exists && pre.Version == 0 {
+		return ErrVersionRequired
+	}
+	return pre.check(exists, version)
+}
+
+// PutService creates the service or updates options of the existing one.
+// Backends of the existing service are kept unless the config has them.
+// Putting the same options again changes nothing, so it's safe to retry.
+func (ctx *Context) PutService(vsID string, config *ServiceConfig, pre Precondition) (created bool, err error) {
+	if config.ServiceOptions == nil {
+		return false, ErrMissingEndpoint
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	var version uint64
+	if exists {
+		if vs.options.group != "" {
+			return false, ErrGroupMember
+		}
+		version = vs.version
+	}
+	if err := ctx.checkPrecondition(pre, exists, version); err != nil {
+		return false, err
+	}
+	return ctx.putService(vsID, config)
+}
+
+// putService creates the service or updates options of the existing one.
+// Context mutex must be held.
+func (ctx *Context) putService(vsID string, config *ServiceConfig) (created bool, err error) {
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return true, ctx.createService(vsID, config)
+	}
+
+	if err := config.ServiceOptions.Validate(ctx.endpoint); err != nil {
+		return false, err
+	}
+	if vs.options.CompareStoreOptions(config.ServiceOptions) && vs.sameBackends(config.ServiceBackends) {
+		log.Debugf("service [%s] is up to date", vsID)
+		return false, nil
+	}
+	previous := vs.config()
+	if config.ServiceBackends == nil {
+		config = &ServiceConfig{ServiceOptions: config.ServiceOptions, ServiceBackends: previous.ServiceBackends}
+	}
+	return false, ctx.applySyncOperation(&SyncOperation{Action: SyncActionUpdate, VsID: vsID, service: config})
+}
+
+// sameBackends checks if the service has the backends, nil backends are always the same.
+func (vs *Service) sameBackends(backends map[string]*BackendOptions) bool {
+	if backends == nil {
+		return true
+	}
+	current := vs.config().ServiceBackends
+	if len(backends) != len(current) {
+		return false
+	}
+	for rsID, opts := range backends {
+		rs, exists := current[rsID]
+		if !exists || opts == nil || !rs.CompareStoreOptions(opts) {
+			return false
+		}
+	}
+	return true
+}
+
+// PutBackend creates the backend or updates options of the existing one.
+// Putting the same options again changes nothing, so it's safe to retry.
+func (ctx *Context) PutBackend(vsID, rsID string, opts *BackendOptions, pre Precondition) (created bool, err error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return false, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if vs.options.group != "" {
+		return false, ErrGroupMember
+	}
+	rs, exists := vs.backends[rsID]
+	var version uint64
+	if exists {
+		if rs.options.pool != "" {
+			return false, ErrPooledBackend
+		}
+		if rs.options.rangeOf != nil {
+			return false, ErrRangeBackend
+		}
+		version = rs.version
+	} else if members := vs.rangeMembers(rsID); len(members) > 0 {
+		exists, version = true, rangeVersion(members)
+	}
+	if err := ctx.checkPrecondition(pre, exists, version); err != nil {
+		return false, err
+	}
+	return ctx.putBackend(vs, rsID, opts)
+}
+
+// putBackend creates the backend or updates options of the existing one.
+// Context mutex must be held.
+func (ctx *Context) putBackend(vs *Service, rsID string, opts *BackendOptions) (created bool, err error) {
+	vsID := vs.vsID
+	current, exists := vs.backendOptions(rsID)
+	if !exists {
+		return true, ctx.createBackend(vsID, rsID, opts)
+	}
+
+	if members, err := expandBackendRange(rsID, opts); err != nil {
+		return false, err
+	} else if members == nil {
+		if err := opts.Validate(); err != nil {
+			return false, err
+		}
+	}
+	if current.CompareStoreOptions(opts) {
+		log.Debugf("backend [%s/%s] is up to date", vsID, rsID)
+		return false, nil
+	}
+	return false, ctx.applySyncOperation(&SyncOperation{Action: SyncActionUpdate, VsID: vsID, RsID: rsID, backend: opts})
+}
+
+// PutBackends reconciles backends of the service with the complete desired set:
+// missing backends are created, changed ones are updated and absent ones are
+// removed. Backends of pools and self-registered backends are left as is.
+// Applied operations are returned, putting the same set again changes nothing.
+// Operations applied before a failure are kept, so it's safe to retry.
+// The precondition is checked against the version of the service.
+func (ctx *Context) PutBackends(vsID string, backends map[string]*BackendOptions, pre Precondition) ([]*SyncOperation, error) {
+	backends, errs := normalizeIDs(backends, NormalizeBackendID)
+	if len(errs) > 0 {
+		return nil, errs[sortedKeys(errs)[0]]
+	}
+	backends, errs = expandBackendRanges(backends)
+	if len(errs) > 0 {
+		rsID := sortedKeys(errs)[0]
+		return nil, fmt.Errorf("backend [%s]: %w", rsID, errs[rsID])
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if vs.options.group != "" {
+		return nil, ErrGroupMember
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return nil, err
+	}
+
+	var removes, updates, creates []*SyncOperation
+	for _, rsID := range sortedKeys(backends) {
+		opts := backends[rsID]
+		if opts == nil {
+			return nil, fmt.Errorf("backend [%s/%s]: %w", vsID, rsID, ErrMissingEndpoint)
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("backend [%s/%s]: %w", vsID, rsID, err)
+		}
+		if err := vs.options.checkBackendPort(rsID, opts.Port); err != nil {
+			return nil, err
+		}
+		rs, exists := vs.backends[rsID]
+		switch {
+		case !exists:
+			creates = append(creates, &SyncOperation{Action: SyncActionCreate, VsID: vsID, RsID: rsID,
+				backend: opts, Desired: backendObject(opts)})
+		case rs.options.pool != "":
+			return nil, ErrPooledBackend
+		case !rs.options.CompareStoreOptions(opts):
+			updates = append(updates, &SyncOperation{Action: SyncActionUpdate, VsID: vsID, RsID: rsID,
+				backend: opts, Current: backendObject(rs.options), Desired: backendObject(opts)})
+		}
+	}
+	for _, rsID := range sortedKeys(vs.backends) {
+		rs := vs.backends[rsID]
+		if _, desired := backends[rsID]; desired || rs.options.pool != "" || rs.leaseTimer != nil {
+			continue
+		}
+		removes = append(removes, &SyncOperation{Action: SyncActionRemove, VsID: vsID, RsID: rsID,
+			Current: backendObject(rs.options)})
+	}
+
+	// removals go first to free addresses of replaced backends
+	applied := []*SyncOperation{}
+	var err error
+apply:
+	for _, ops := range [][]*SyncOperation{removes, updates, creates} {
+		for _, op := range ops {
+			if err = ctx.applySyncOperation(op); err != nil {
+				log.Errorf("error while reconciling backends of service [%s], %s %s failed: %s", vsID, op.Action, op, err)
+				break apply
+			}
+			applied = append(applied, op)
+		}
+	}
+	if len(applied) > 0 {
+		ctx.revision++
+		vs.version = ctx.revision
+	}
+	switch {
+	case err != nil:
+		return applied, err
+	case len(applied) == 0:
+		log.Debugf("backends of service [%s] are up to date", vsID)
+	default:
+		log.Infof("backends of service [%s] are reconciled with %d operation(s)", vsID, len(applied))
+	}
+	return applied, nil
+}
+
+// DeleteService removes the service if it matches the precondition.
+func (ctx *Context) DeleteService(vsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if exists {
+		if vs.options.group != "" {
+			return ErrGroupMember
+		}
+		if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+			return err
+		}
+		if ctx.deleteGracePeriod > 0 {
+			ctx.softDeleteService(vs)
+			return nil
+		}
+	}
+	_, err := ctx.removeService(vsID)
+	return err
+}
+
+// DeleteBackend removes the backend if it matches the precondition.
+func (ctx *Context) DeleteBackend(vsID, rsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if vs, exists := ctx.services[vsID]; exists {
+		if vs.options.group != "" {
+			return ErrGroupMember
+		}
+		if rs, exists := vs.backends[rsID]; exists {
+			if rs.options.pool != "" {
+				return ErrPooledBackend
+			}
+			if rs.options.rangeOf != nil {
+				return ErrRangeBackend
+			}
+			if err := ctx.checkPrecondition(pre, true, rs.version); err != nil {
+				return err
+			}
+			if ctx.deleteGracePeriod > 0 {
+				ctx.softDeleteBackend(vs, rs)
+				return nil
+			}
+		}
+	}
+	_, err := ctx.removeBackend(vsID, rsID)
+	return err
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ipvsConnTable is a text dump of the IPVS connection table of the network namespace.
+const ipvsConnTable = "/proc/net/ip_vs_conn"
+
+// Paging of service connections.
+const (
+	defaultConnectionsLimit = 100
+	maxConnectionsLimit     = 1000
+)
+
+// ErrInvalidPage is returned if offset or limit of a page are out of range.
+var ErrInvalidPage = fmt.Errorf("offset and limit must not be negative, limit must not exceed %d", maxConnectionsLimit)
+
+var errIpvsConnListUnsupported = errors.New("IPVS implementation doesn't list connections")
+
+// IpvsConn is an entry of the IPVS connection table.
+type IpvsConn struct {
+	Protocol   uint16
+	ClientIP   string
+	ClientPort uint16
+	VIP        string
+	Port       uint16
+	DestIP     string
+	DestPort   uint16
+	State      string
+	// Expires is a number of seconds until the entry expires.
+	Expires uint32
+}
+
+// IpvsConnLister is implemented by IPVS clients able to list the connection table.
+type IpvsConnLister interface {
+	// ListConns returns connections to the virtual service.
+	ListConns(vip string, port uint16, protocol uint16) ([]IpvsConn, error)
+}
+
+// ListConns returns connections to the virtual service from the connection table.
+// The table isn't exposed via netlink, so it's read from procfs.
+func (ipvs *ipvsClient) ListConns(vip string, port uint16, protocol uint16) ([]IpvsConn, error) {
+	table, err := os.Open(ipvsConnTable)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Close()
+	return parseIpvsConns(table, vip, port, protocol)
+}
+
+// parseIpvsConns parses lines of the connection table, e.g.
+// TCP C0A80001 D2B4 0A000001 0050 0A000002 1F90 ESTABLISHED     899
+// IPv6 addresses are written in the colon separated form.
+func parseIpvsConns(r io.Reader, vip string, port uint16, protocol uint16) ([]IpvsConn, error) {
+	conns := []IpvsConn{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 9 || fields[0] == "Pro" {
+			continue
+		}
+		conn, err := parseIpvsConn(fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPVS connection %q: %w", scanner.Text(), err)
+		}
+		if conn.Protocol == protocol && conn.Port == port && net.ParseIP(conn.VIP).Equal(net.ParseIP(vip)) {
+			conns = append(conns, conn)
+		}
+	}
+	return conns, scanner.Err()
+}
+
+func parseIpvsConn(fields []string) (IpvsConn, error) {
+	conn := IpvsConn{State: fields[7]}
+	switch fields[0] {
+	case "TCP":
+		conn.Protocol = syscall.IPPROTO_TCP
+	case "UDP":
+		conn.Protocol = syscall.IPPROTO_UDP
+	case "SCTP":
+		conn.Protocol = syscall.IPPROTO_SCTP
+	default:
+		return conn, fmt.Errorf("unknown protocol %s", fields[0])
+	}
+	for i, addr := range []struct {
+		ip   *string
+		port *uint16
+	}{{&conn.ClientIP, &conn.ClientPort}, {&conn.VIP, &conn.Port}, {&conn.DestIP, &conn.DestPort}} {
+		ip, err := parseConnIP(fields[1+2*i])
+		if err != nil {
+			return conn, err
+		}
+		port, err := strconv.ParseUint(fields[2+2*i], 16, 16)
+		if err != nil {
+			return conn, err
+		}
+		*addr.ip, *addr.port = ip, uint16(port)
+	}
+	expires, err := strconv.ParseUint(fields[8], 10, 32)
+	if err != nil {
+		return conn, err
+	}
+	conn.Expires = uint32(expires)
+	return conn, nil
+}
+
+// parseConnIP parses IPv4 addresses written as hex numbers and IPv6 ones.
+func parseConnIP(s string) (string, error) {
+	if strings.Contains(s, ":") {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip.String(), nil
+		}
+		return "", fmt.Errorf("invalid address %s", s)
+	}
+	value, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return "", err
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(value))
+	return ip.String(), nil
+}
+
+// ConnectionsQuery selects a page of service connections.
+type ConnectionsQuery struct {
+	// RsID limits connections to the ones of the backend, all connections are returned if empty.
+	RsID   string
+	Offset int
+	// Limit is a page size, 100 by default.
+	Limit int
+}
+
+// ServiceConnection is a connection to a virtual service.
+type ServiceConnection struct {
+	Client  string `json:"client"`
+	Backend string `json:"backend"`
+	// RsID is empty if the destination isn't a backend of the service, e.g. a sorry server.
+	RsID  string `json:"rs_id,omitempty"`
+	State string `json:"state"`
+	// Expires is a number of seconds until the connection expires.
+	Expires uint32 `json:"expires"`
+}
+
+// ServiceConnections is a page of connections to a virtual service.
+type ServiceConnections struct {
+	Total       int                 `json:"total"`
+	Offset      int                 `json:"offset"`
+	Connections []ServiceConnection `json:"connections"`
+}
+
+// serviceConns returns IPVS connections to the virtual service and IDs of its
+// backends keyed by their addresses. The backend, if any, must exist.
+func (ctx *Context) serviceConns(vsID, rsID string) ([]IpvsConn, map[string]string, error) {
+	lister, ok := ctx.ipvs.(IpvsConnLister)
+	if !ok {
+		return nil, nil, errIpvsConnListUnsupported
+	}
+
+	ctx.mutex.RLock()
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		ctx.mutex.RUnlock()
+		return nil, nil, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if _, exists := vs.backends[rsID]; rsID != "" && !exists {
+		ctx.mutex.RUnlock()
+		return nil, nil, objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	vip, port, protocol := vs.options.host.String(), vs.options.Port, vs.options.protocol
+	backends := make(map[string]string, len(vs.backends))
+	for rsID, rs := range vs.backends {
+		backends[net.JoinHostPort(rs.options.host.String(), fmt.Sprint(rs.options.Port))] = rsID
+	}
+	ctx.mutex.RUnlock()
+
+	conns, err := lister.ListConns(vip, port, protocol)
+	if err != nil {
+		log.Errorf("failed to list IPVS connections of service %s: %s", vsID, err)
+		return nil, nil, ErrIpvsSyscallFailed
+	}
+	return conns, backends, nil
+}
+
+// ServiceConnections returns a page of IPVS connections to the virtual service
+// ordered by backend and client addresses.
+func (ctx *Context) ServiceConnections(vsID string, query ConnectionsQuery) (*ServiceConnections, error) {
+	if query.Limit == 0 {
+		query.Limit = defaultConnectionsLimit
+	}
+	if query.Offset < 0 || query.Limit < 0 || query.Limit > maxConnectionsLimit {
+		return nil, ErrInvalidPage
+	}
+
+	conns, backends, err := ctx.serviceConns(vsID, query.RsID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []ServiceConnection{}
+	for _, conn := range conns {
+		backend := net.JoinHostPort(conn.DestIP, fmt.Sprint(conn.DestPort))
+		if query.RsID != "" && backends[backend] != query.RsID {
+			continue
+		}
+		result = append(result, ServiceConnection{
+			Client:  net.JoinHostPort(conn.ClientIP, fmt.Sprint(conn.ClientPort)),
+			Backend: backend,
+			RsID:    backends[backend],
+			State:   conn.State,
+			Expires: conn.Expires,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Backend != result[j].Backend {
+			return result[i].Backend < result[j].Backend
+		}
+		return result[i].Client < result[j].Client
+	})
+
+	page := &ServiceConnections{Total: len(result), Offset: query.Offset, Connections: []ServiceConnection{}}
+	if query.Offset < len(result) {
+		page.Connections = result[query.Offset:min(query.Offset+query.Limit, len(result))]
+	}
+	return page, nil
+}
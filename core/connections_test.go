@@ -0,0 +1,79 @@
+package core
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const ipvsConnTableSample = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP 0A000064 D2B4 7F000001 0050 7F000003 1F90 ESTABLISHED     899
+TCP 0A000065 D2B5 7F000001 0050 7F000002 1F90 FIN_WAIT         60
+TCP 0A000064 0000 7F000001 0050 7F000002 1F90 NONE            300
+UDP 0A000064 D2B4 7F000001 0050 7F000002 1F90 UDP              30
+TCP 2001:0db8:0000:0000:0000:0000:0000:0001 D2B4 2001:0db8:0000:0000:0000:0000:0000:00ff 0050 2001:0db8:0000:0000:0000:0000:0000:0002 0050 SYN_RECV 10
+`
+
+// connTableIpvs serves the sample connection table.
+type connTableIpvs struct {
+	Ipvs
+}
+
+func (connTableIpvs) ListConns(vip string, port uint16, protocol uint16) ([]IpvsConn, error) {
+	return parseIpvsConns(strings.NewReader(ipvsConnTableSample), vip, port, protocol)
+}
+
+func TestParseIpvsConns(t *testing.T) {
+	conns, err := parseIpvsConns(strings.NewReader(ipvsConnTableSample), "127.0.0.1", 80, syscall.IPPROTO_TCP)
+	require.NoError(t, err)
+	require.Len(t, conns, 3)
+	assert.Equal(t, IpvsConn{Protocol: syscall.IPPROTO_TCP, ClientIP: "10.0.0.100", ClientPort: 53940,
+		VIP: "127.0.0.1", Port: 80, DestIP: "127.0.0.3", DestPort: 8080, State: "ESTABLISHED", Expires: 899}, conns[0])
+
+	conns, err = parseIpvsConns(strings.NewReader(ipvsConnTableSample), "2001:db8::ff", 80, syscall.IPPROTO_TCP)
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	assert.Equal(t, "2001:db8::2", conns[0].DestIP)
+
+	_, err = parseIpvsConns(strings.NewReader("ICMP 0A000064 D2B4 7F000001 0050 7F000003 1F90 NONE 1\n"),
+		"127.0.0.1", 80, syscall.IPPROTO_TCP)
+	assert.Error(t, err)
+}
+
+func TestServiceConnections(t *testing.T) {
+	c := newContext(connTableIpvs{NewMemoryIpvs()}, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	page, err := c.ServiceConnections(vsID, ConnectionsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, page.Total)
+	require.Len(t, page.Connections, 3)
+	assert.Equal(t, ServiceConnection{Client: "10.0.0.100:0", Backend: "127.0.0.2:8080", RsID: rsID,
+		State: "NONE", Expires: 300}, page.Connections[0])
+	assert.Empty(t, page.Connections[2].RsID)
+
+	page, err = c.ServiceConnections(vsID, ConnectionsQuery{Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 3, page.Total)
+	require.Len(t, page.Connections, 1)
+	assert.Equal(t, "10.0.0.101:53941", page.Connections[0].Client)
+
+	page, err = c.ServiceConnections(vsID, ConnectionsQuery{RsID: rsID, Offset: 5})
+	require.NoError(t, err)
+	assert.Equal(t, 2, page.Total)
+	assert.Empty(t, page.Connections)
+
+	_, err = c.ServiceConnections(vsID, ConnectionsQuery{Limit: 5000})
+	assert.Equal(t, ErrInvalidPage, err)
+	_, err = c.ServiceConnections(vsID, ConnectionsQuery{RsID: "unknown"})
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
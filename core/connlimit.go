@@ -0,0 +1,183 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible connection limit errors.
+var (
+	ErrUnknownConnLimitAction = errors.New("specified connection limit action is unknown")
+	ErrInvalidConnLimit       = errors.New("connection limit rate must be positive")
+	ErrConnLimitFailed        = errors.New("error while applying connection limits")
+	ErrTarpitUnsupported      = errors.New("tarpit connection limit action is not supported, nftables has no tarpit target")
+)
+
+// nftTable is nftables table owned by GORB. It is replaced as a whole on every change.
+const nftTable = "gorb"
+
+// ConnLimitOptions describe a limit of new connections to a virtual service.
+type ConnLimitOptions struct {
+	// Rate of new connections per second.
+	Rate uint32 `json:"rate" yaml:"rate"`
+	// Burst of new connections allowed over the rate. Default is the rate.
+	Burst uint32 `json:"burst" yaml:"burst"`
+	// Action for connections beyond the limit: drop or reject. Tarpitting isn't supported.
+	Action string `json:"action" yaml:"action"`
+}
+
+// Validate fills missing fields and validates connection limit configuration.
+func (o *ConnLimitOptions) Validate() error {
+	if o.Rate == 0 {
+		return ErrInvalidConnLimit
+	}
+	if o.Burst == 0 {
+		o.Burst = o.Rate
+	}
+	if o.Action == "" {
+		o.Action = "drop"
+	}
+	o.Action = strings.ToLower(o.Action)
+	switch o.Action {
+	case "drop", "reject":
+	case "tarpit":
+		// TARPIT is an xtables-addons target of iptables only
+		return ErrTarpitUnsupported
+	default:
+		return ErrUnknownConnLimitAction
+	}
+	return nil
+}
+
+// ConnLimit is a limit of new connections to a virtual service.
+type ConnLimit struct {
+	VsID     string
+	Host     net.IP
+	Port     uint16
+	Protocol string
+	Options  ConnLimitOptions
+}
+
+// ConnLimiter enforces limits of new connections to virtual services.
+type ConnLimiter interface {
+	// Apply replaces all previously applied limits.
+	Apply(limits []ConnLimit) error
+}
+
+// nftConnLimiter enforces limits with nftables before packets reach IPVS.
+type nftConnLimiter struct{}
+
+// NewConnLimiter creates nftables based connection limiter used by default.
+func NewConnLimiter() ConnLimiter {
+	return nftConnLimiter{}
+}
+
+func (nftConnLimiter) Apply(limits []ConnLimit) error {
+	return runNft(nftRuleset(limits))
+}
+
+// runNft runs the nftables script.
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// nftRuleset builds nftables script atomically replacing GORB table.
+func nftRuleset(limits []ConnLimit) string {
+	var b strings.Builder
+	// declaring the table first makes deletion safe if it doesn't exist yet
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", nftTable, nftTable)
+	if len(limits) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "table inet %s {\n\tchain conn_limit {\n", nftTable)
+	b.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+	for _, limit := range limits {
+		family := "ip"
+		if limit.Host.To4() == nil {
+			family = "ip6"
+		}
+		action := limit.Options.Action
+		if action == "reject" && limit.Protocol == "tcp" {
+			action = "reject with tcp reset"
+		}
+		fmt.Fprintf(&b, "\t\t%s daddr %s %s dport %d ct state new limit rate over %d/second burst %d packets counter %s comment %q\n",
+			family, limit.Host, limit.Protocol, limit.Port, limit.Options.Rate, limit.Options.Burst, action, limit.VsID)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// applyConnLimits enforces connection limits of all services. Context mutex must be held.
+func (ctx *Context) applyConnLimits() error {
+	var limits []ConnLimit
+	for _, vsID := range sortedKeys(ctx.services) {
+		options := ctx.services[vsID].options
+		if options.ConnLimit == nil {
+			continue
+		}
+		limits = append(limits, ConnLimit{
+			VsID:     vsID,
+			Host:     options.host,
+			Port:     options.Port,
+			Protocol: options.Protocol,
+			Options:  *options.ConnLimit,
+		})
+	}
+	// don't touch nftables at all unless limits have ever been used
+	if len(limits) == 0 && !ctx.connLimitsApplied {
+		return nil
+	}
+	if ctx.connLimiter == nil {
+		ctx.connLimiter = NewConnLimiter()
+	}
+	if err := ctx.connLimiter.Apply(limits); err != nil {
+		log.Errorf("unable to apply connection limits: %s", err)
+		return ErrConnLimitFailed
+	}
+	ctx.connLimitsApplied = len(limits) > 0
+	return nil
+}
+
+// SetConnLimit changes the limit of new connections to the virtual service.
+// Nil options remove the limit.
+func (ctx *Context) SetConnLimit(vsID string, options *ConnLimitOptions, pre Precondition) error {
+	if options != nil {
+		if err := options.Validate(); err != nil {
+			return err
+		}
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	previous := vs.options.ConnLimit
+	vs.options.ConnLimit = options
+	if err := ctx.applyConnLimits(); err != nil {
+		vs.options.ConnLimit = previous
+		return err
+	}
+	ctx.revision++
+	vs.version = ctx.revision
+	log.Infof("connection limit of service [%s] has been changed", vsID)
+	return nil
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingConnLimiter struct {
+	applied [][]ConnLimit
+}
+
+func (l *recordingConnLimiter) Apply(limits []ConnLimit) error {
+	l.applied = append(l.applied, limits)
+	return nil
+}
+
+func TestNftRuleset(t *testing.T) {
+	assert.Equal(t, "table inet gorb\ndelete table inet gorb\n", nftRuleset(nil))
+
+	ruleset := nftRuleset([]ConnLimit{
+		{VsID: "web", Host: net.ParseIP("10.0.0.1"), Port: 80, Protocol: "tcp",
+			Options: ConnLimitOptions{Rate: 100, Burst: 200, Action: "reject"}},
+		{VsID: "dns", Host: net.ParseIP("fd00::1"), Port: 53, Protocol: "udp",
+			Options: ConnLimitOptions{Rate: 50, Burst: 50, Action: "drop"}},
+	})
+	assert.Contains(t, ruleset, "type filter hook input priority filter; policy accept;")
+	assert.Contains(t, ruleset, `ip daddr 10.0.0.1 tcp dport 80 ct state new limit rate over 100/second burst 200 packets counter reject with tcp reset comment "web"`)
+	assert.Contains(t, ruleset, `ip6 daddr fd00::1 udp dport 53 ct state new limit rate over 50/second burst 50 packets counter drop comment "dns"`)
+}
+
+func TestConnLimitValidate(t *testing.T) {
+	opts := &ConnLimitOptions{Rate: 10}
+	require.NoError(t, opts.Validate())
+	assert.Equal(t, ConnLimitOptions{Rate: 10, Burst: 10, Action: "drop"}, *opts)
+
+	assert.Equal(t, ErrInvalidConnLimit, (&ConnLimitOptions{}).Validate())
+	assert.Equal(t, ErrUnknownConnLimitAction, (&ConnLimitOptions{Rate: 1, Action: "delay"}).Validate())
+	assert.Equal(t, ErrTarpitUnsupported, (&ConnLimitOptions{Rate: 1, Action: "tarpit"}).Validate())
+}
+
+func TestSetConnLimit(t *testing.T) {
+	limiter := &recordingConnLimiter{}
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.connLimiter = limiter
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", vsID).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}))
+	assert.Empty(t, limiter.applied, "nftables must not be touched without limits")
+
+	require.NoError(t, c.SetConnLimit(vsID, &ConnLimitOptions{Rate: 100}, Precondition{}))
+	require.Len(t, limiter.applied, 1)
+	assert.Equal(t, uint32(100), limiter.applied[0][0].Options.Burst)
+
+	_, err := c.RemoveService(vsID)
+	require.NoError(t, err)
+	require.Len(t, limiter.applied, 2)
+	assert.Empty(t, limiter.applied[1])
+
+	assert.ErrorIs(t, c.SetConnLimit(vsID, nil, Precondition{}), ErrObjectNotFound)
+}
@@ -21,12 +21,16 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/qk4l/gorb/disco"
+	"github.com/qk4l/gorb/hooks"
 	"github.com/qk4l/gorb/pulse"
 	"github.com/qk4l/gorb/util"
 	"github.com/vishvananda/netlink"
@@ -42,6 +46,8 @@ var (
 	schedulerFlags = map[string]int{
 		"sh-fallback": gnl2go.IP_VS_SVC_F_SCHED_SH_FALLBACK,
 		"sh-port":     gnl2go.IP_VS_SVC_F_SCHED_SH_PORT,
+		"mh-fallback": gnl2go.IP_VS_SVC_F_SCHED1,
+		"mh-port":     gnl2go.IP_VS_SVC_F_SCHED2,
 		"flag-1":      gnl2go.IP_VS_SVC_F_SCHED1,
 		"flag-2":      gnl2go.IP_VS_SVC_F_SCHED2,
 		"flag-3":      gnl2go.IP_VS_SVC_F_SCHED3,
@@ -54,6 +60,8 @@ var (
 	ErrObjectExists      = errors.New("specified object already exists")
 	ErrObjectNotFound    = errors.New("unable to locate specified object")
 	ErrIncompatibleAFs   = errors.New("incompatible address families")
+	ErrDuplicateBackend  = errors.New("another backend of the service has the same address")
+	ErrBackendPort       = errors.New("backends of dr and tunnel services must listen on the service port")
 )
 
 // Fallback options
@@ -67,14 +75,83 @@ const (
 // Context abstacts away the underlying IPVS bindings implementation.
 type Context struct {
 	ipvs         Ipvs
+	ipvsQueue    *queuedIpvs
 	endpoint     net.IP
 	services     map[string]*Service
 	mutex        sync.RWMutex
-	pulseCh      chan pulse.Update
+	pulses       *pulse.Queue
+	reweightCh   chan string
 	disco        disco.Driver
+	hooks        *hooks.Dispatcher
 	stopCh       chan struct{}
 	vipInterface netlink.Link
 	store        *Store
+	locality     string
+	// strictVersions requires a version of existing objects on their modification
+	strictVersions bool
+	// deleteGracePeriod keeps deleted objects out of traffic before their removal
+	deleteGracePeriod time.Duration
+	// removalDelay keeps backends gone from discovery out of traffic before their removal
+	removalDelay time.Duration
+	// eventHistory is a number of lifecycle events kept per service
+	eventHistory int
+	events       map[string][]ServiceEvent
+	// removedEvents are IDs of removed services with history, the oldest first
+	removedEvents []string
+	// traceParent is a context of the traced operation running under the mutex
+	traceParent atomic.Value
+	// pulsesPaused counts store synchronizations pausing processing of pulse updates
+	pulsesPaused atomic.Int32
+
+	connLimiter       ConnLimiter
+	connLimitsApplied bool
+	// revision is incremented on every change of services or backends
+	revision uint64
+	plans    map[string]*Plan
+	// monitors are pulse monitors shared by backends keyed by their targets
+	monitors     map[string]*sharedMonitor
+	backendPools map[string]*BackendPoolConfig
+	// poolVersions are versions of backend pools, pools are compared with mirrored ones
+	poolVersions map[string]uint64
+	// frozen are IDs of services excluded from store synchronization
+	frozen map[string]bool
+	// backendNetworks backends are allowed in
+	backendNetworks backendNetworks
+	// vipInterfaces services could select with their vip_interface option by name
+	vipInterfaces map[string]netlink.Link
+	// adoptVips makes services remove VIPs which were present before them
+	adoptVips bool
+	// coldStart is set until the first store synchronization is over if VIPs are deferred
+	coldStart bool
+	// syncedRevisions are store revisions of services in sync after the last synchronization
+	syncedRevisions map[string]uint64
+	// syncedAt is the context revision after the last synchronization
+	syncedAt uint64
+	// monitorGeneration tells runs of shared monitors of the same target apart
+	monitorGeneration uint64
+	// monitorSubscribers is a number of backends subscribed to monitors
+	monitorSubscribers int
+	// connExpirer removes connections to failed and removed backends
+	connExpirer ConnExpirer
+	// connExpiry removes connections of all services, not only ones flushing conntrack
+	connExpiry bool
+	// clientPinner steers pinned clients to fwmark services of their backends
+	clientPinner ClientPinner
+	pinsApplied  bool
+	// stashCh runs functions in the notification loop owning the stash
+	stashCh chan func(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time)
+	// syncWorkers is a number of concurrent workers of the first synchronization
+	syncWorkers int
+	startup     startupTracker
+	// checkSchedulers checks scheduler modules of services of the first synchronization
+	checkSchedulers bool
+	// resolvedHosts, initialPools and deferredExposes are set during the first synchronization
+	resolvedHosts   map[string]resolvedHost
+	initialPools    map[poolKey]gnl2go.Pool
+	deferredExposes map[string]*Service
+	// syncLock is held by workers creating objects of the first synchronization,
+	// they release it while waiting for IPVS
+	syncLock *sync.Mutex
 }
 
 type Ipvs interface {
@@ -90,17 +167,62 @@ type Ipvs interface {
 	// Unforture not work =(
 	// GetPoolForService(svc gnl2go.Service) (gnl2go.Pool, error)
 	GetPools() ([]gnl2go.Pool, error)
+	GetTimeouts() (IpvsTimeouts, error)
+	SetTimeouts(timeouts IpvsTimeouts) error
 }
 
 // NewContext creates a new Context and initializes IPVS.
 func NewContext(options ContextOptions) (*Context, error) {
 	log.Info("initializing IPVS context")
 
+	if options.Ipvs == nil {
+		options.Ipvs = NewIpvs()
+	}
+
+	var ledger *ledgerIpvs
+	if options.Ledger != "" {
+		entries, err := loadLedger(options.Ledger)
+		if err != nil {
+			return nil, err
+		}
+		ledger = &ledgerIpvs{Ipvs: options.Ipvs, ledger: entries}
+		options.Ipvs = ledger
+	} else if options.CleanupOrphans {
+		return nil, ErrLedgerRequired
+	}
+
+	queue := newQueuedIpvs(options.Ipvs, options.IpvsQueueDepth)
 	ctx := &Context{
-		ipvs:     &gnl2go.IpvsClient{},
-		services: make(map[string]*Service),
-		pulseCh:  make(chan pulse.Update),
-		stopCh:   make(chan struct{}),
+		ipvs:       queue,
+		ipvsQueue:  queue,
+		services:   make(map[string]*Service),
+		pulses:     pulse.NewQueue(pulseQueueSize),
+		reweightCh: make(chan string),
+		stashCh:    make(chan func(map[pulse.ID]int32, map[pulse.ID]time.Time)),
+		stopCh:     make(chan struct{}),
+		locality:   options.Locality,
+
+		strictVersions:    options.StrictVersions,
+		deleteGracePeriod: options.DeleteGracePeriod,
+		removalDelay:      options.RemovalDelay,
+		eventHistory:      options.EventHistory,
+		connLimiter:       options.ConnLimiter,
+		connExpirer:       options.ConnExpirer,
+		clientPinner:      options.ClientPinner,
+		backendNetworks:   options.BackendNetworks,
+		adoptVips:         options.AdoptVips,
+		coldStart:         options.DeferVips,
+		syncWorkers:       options.SyncWorkers,
+		checkSchedulers:   options.CheckSchedulers,
+	}
+	if ctx.syncWorkers <= 0 {
+		ctx.syncWorkers = DefaultSyncWorkers
+	}
+	if ctx.connExpirer == nil {
+		ctx.connExpirer = NewConnExpirer()
+	}
+	if options.Tracing {
+		ctx.ipvs = &tracedIpvs{Ipvs: ctx.ipvs, ctx: ctx}
 	}
 
 	if len(options.Disco) > 0 {
@@ -110,7 +232,7 @@ func NewContext(options ContextOptions) (*Context, error) {
 
 		ctx.disco, err = disco.New(&disco.Options{
 			Type: "consul",
-			Args: util.DynamicMap{"URL": options.Disco}})
+			Args: util.DynamicMap{"URL": options.Disco, "Proxy": options.DiscoProxy}})
 
 		if err != nil {
 			return nil, err
@@ -119,6 +241,10 @@ func NewContext(options ContextOptions) (*Context, error) {
 		ctx.disco, _ = disco.New(&disco.Options{Type: "none"})
 	}
 
+	if options.Hooks.Exec != "" || options.Hooks.URL != "" {
+		ctx.hooks = hooks.New(&options.Hooks)
+	}
+
 	if len(options.Endpoints) > 0 {
 		// TODO(@kobolog): Bind virtual services on multiple endpoints.
 		ctx.endpoint = options.Endpoints[0]
@@ -142,6 +268,30 @@ func NewContext(options ContextOptions) (*Context, error) {
 		return nil, ErrIpvsSyscallFailed
 	}
 
+	if options.CleanupOrphans {
+		services, dests, err := ledger.cleanupOrphans()
+		if err != nil {
+			log.Errorf("unable to clean up orphaned IPVS entries: %s", err)
+			ctx.Close()
+			return nil, ErrIpvsSyscallFailed
+		}
+		log.Infof("removed %d orphaned IPVS service(s) and %d destination(s)", services, dests)
+	}
+
+	if !options.IpvsTimeouts.IsZero() {
+		if err := ctx.SetIpvsTimeouts(options.IpvsTimeouts); err != nil {
+			ctx.Close()
+			return nil, err
+		}
+	}
+
+	if options.ExpireConns {
+		if err := ctx.enableConnExpiry(); err != nil {
+			ctx.Close()
+			return nil, err
+		}
+	}
+
 	if options.VipInterface != "" {
 		var err error
 		if ctx.vipInterface, err = netlink.LinkByName(options.VipInterface); err != nil {
@@ -152,10 +302,22 @@ func NewContext(options ContextOptions) (*Context, error) {
 		}
 		log.Infof("VIPs will be added to interface '%s'", ctx.vipInterface.Attrs().Name)
 	}
+	if err := ctx.initVipInterfaces(options.VipInterfaces); err != nil {
+		ctx.Close()
+		return nil, err
+	}
 
 	// Fire off a pulse notifications sink goroutine.
 	go ctx.run()
 
+	if options.PrometheusURL != "" {
+		if options.WeightMetricsInterval <= 0 {
+			options.WeightMetricsInterval = 30 * time.Second
+		}
+		log.Infof("evaluating weight metrics with Prometheus on %s", options.PrometheusURL)
+		go ctx.runWeightMetrics(options.PrometheusURL, options.WeightMetricsInterval)
+	}
+
 	return ctx, nil
 }
 
@@ -174,8 +336,35 @@ func (ctx *Context) Close() {
 	ctx.ipvs.Exit()
 }
 
+// GetIpvsTimeouts returns current IPVS protocol timeouts.
+func (ctx *Context) GetIpvsTimeouts() (IpvsTimeouts, error) {
+	timeouts, err := ctx.ipvs.GetTimeouts()
+	if err != nil {
+		log.Errorf("error while getting IPVS timeouts: %s", err)
+		return timeouts, ErrIpvsSyscallFailed
+	}
+	return timeouts, nil
+}
+
+// SetIpvsTimeouts sets IPVS protocol timeouts. Zero timeouts are left unchanged.
+func (ctx *Context) SetIpvsTimeouts(timeouts IpvsTimeouts) error {
+	log.Infof("setting IPVS timeouts tcp: %ds, tcpfin: %ds, udp: %ds", timeouts.TCP, timeouts.TCPFin, timeouts.UDP)
+	if err := ctx.ipvs.SetTimeouts(timeouts); err != nil {
+		log.Errorf("error while setting IPVS timeouts: %s", err)
+		return ErrIpvsSyscallFailed
+	}
+	return nil
+}
+
 // ipvs.GetPoolForService() not works =( impement via iteration
 func (ctx *Context) GetPoolForService(svc gnl2go.Service) (gnl2go.Pool, error) {
+	if ctx.initialPools != nil {
+		// pools read once for the first synchronization
+		if pool, exists := ctx.initialPools[newPoolKey(svc)]; exists {
+			return pool, nil
+		}
+		return gnl2go.Pool{}, fmt.Errorf("service doesn't exist\n")
+	}
 	ipvs_pools, err := ctx.ipvs.GetPools()
 	if err != nil {
 		log.Errorf("Failed to get pools from ipvs: %s", err)
@@ -192,10 +381,25 @@ func (ctx *Context) GetPoolForService(svc gnl2go.Service) (gnl2go.Pool, error) {
 	return gnl2go.Pool{}, fmt.Errorf("service doesn't exist\n")
 }
 
+// serviceFlags converts scheduler flags of service options into IPVS flags, nil if there are none.
+func serviceFlags(shFlags string) []byte {
+	var flags int
+	for _, flag := range strings.Split(shFlags, "|") {
+		flags = flags | schedulerFlags[flag]
+	}
+	if flags == 0 {
+		return nil
+	}
+	return gnl2go.U32ToBinFlags(uint32(flags))
+}
+
 // CreateService registers a new virtual service with IPVS.
 func (ctx *Context) createService(vsID string, serviceConfig *ServiceConfig) error {
+	if err := validateID(vsID); err != nil {
+		return err
+	}
 	serviceOptions := serviceConfig.ServiceOptions
-	if err := serviceOptions.Validate(ctx.endpoint); err != nil {
+	if err := serviceOptions.validateWith(ctx.endpoint, ctx.resolveHost); err != nil {
 		return err
 	}
 
@@ -203,18 +407,35 @@ func (ctx *Context) createService(vsID string, serviceConfig *ServiceConfig) err
 		return ErrObjectExists
 	}
 
-	if ctx.vipInterface != nil {
-		ifName := ctx.vipInterface.Attrs().Name
-		vip := &netlink.Addr{IPNet: &net.IPNet{
-			IP: net.ParseIP(serviceOptions.host.String()), Mask: net.IPv4Mask(255, 255, 255, 255)}}
-		if err := netlink.AddrAdd(ctx.vipInterface, vip); err != nil {
-			log.Infof(
-				"failed to add VIP %s to interface '%s' for service [%s]: %s",
-				serviceOptions.host, ifName, vsID, err)
-		} else {
-			serviceOptions.delIfAddr = true
+	pool, exists := ctx.backendPools[serviceOptions.Pool]
+	if serviceOptions.Pool != "" && !exists {
+		return fmt.Errorf("%w: %s", ErrPoolNotDefined, serviceOptions.Pool)
+	}
+
+	// rejected before the service is programmed, so it isn't left half-created
+	if err := serviceOptions.checkBackendPorts(serviceConfig.ServiceBackends); err != nil {
+		return err
+	}
+	if pool != nil {
+		if err := serviceOptions.checkBackendPorts(pool.Backends); err != nil {
+			return err
+		}
+	}
+
+	vipInterface, err := ctx.serviceVipInterface(serviceOptions)
+	if err != nil {
+		return err
+	}
+	if vipInterface != nil && ctx.coldStart {
+		// only the label is checked, the VIP is added once a backend is healthy
+		if _, err := vipAddr(vipInterface, serviceOptions); err != nil {
+			return err
+		}
+		log.Infof("VIP %s of service [%s] is deferred until a backend is healthy", serviceOptions.host, vsID)
+	} else if vipInterface != nil {
+		if err := ctx.addVip(vsID, vipInterface, serviceOptions); err != nil {
+			return err
 		}
-		log.Infof("VIP %s has been added to interface '%s'", serviceOptions.host, ifName)
 	}
 
 	log.Infof("creating virtual service [%s] on %s:%d", vsID, serviceOptions.host,
@@ -225,49 +446,69 @@ func (ctx *Context) createService(vsID string, serviceConfig *ServiceConfig) err
 		VIP:   serviceOptions.host.String(),
 		Port:  serviceOptions.Port,
 		Sched: serviceOptions.LbMethod,
+		Flags: serviceFlags(serviceOptions.ShFlags),
 	}
 
-	var flags int
-	for _, flag := range strings.Split(serviceOptions.ShFlags, "|") {
-		flags = flags | schedulerFlags[flag]
-		if flags != 0 {
-			svc.Flags = gnl2go.U32ToBinFlags(uint32(flags))
-		}
-	}
-
-	_, err := ctx.GetPoolForService(svc)
+	_, err = ctx.GetPoolForService(svc)
 
 	if err == nil {
 		log.Infof("Service %s:%d already existed skip creation", svc.VIP, svc.Port)
 	} else {
-		if flags != 0 {
-			if err := ctx.ipvs.AddServiceWithFlags(
-				svc.VIP,
-				svc.Port,
-				svc.Proto,
-				svc.Sched,
-				svc.Flags,
-			); err != nil {
-				log.Errorf("error while creating virtual service: %s", err)
-				return ErrIpvsSyscallFailed
+		err = ctx.withoutSyncLock(func() error {
+			switch {
+			case serviceOptions.Netmask != 0:
+				return ctx.addServiceWithNetmask(svc, serviceOptions.netmask)
+			case svc.Flags != nil:
+				return ctx.ipvs.AddServiceWithFlags(
+					svc.VIP,
+					svc.Port,
+					svc.Proto,
+					svc.Sched,
+					svc.Flags,
+				)
+			default:
+				return ctx.ipvs.AddService(
+					svc.VIP,
+					svc.Port,
+					svc.Proto,
+					svc.Sched,
+				)
 			}
-		} else {
-			if err := ctx.ipvs.AddService(
-				svc.VIP,
-				svc.Port,
-				svc.Proto,
-				svc.Sched,
-			); err != nil {
-				log.Errorf("error while creating virtual service: %s", err)
-				return ErrIpvsSyscallFailed
+		})
+		if err != nil {
+			log.Errorf("error while creating virtual service: %s", err)
+			if err := schedulerModuleError(svc.Sched); err != nil {
+				log.Error(err)
 			}
+			return ErrIpvsSyscallFailed
+		}
+		if ctx.initialPools != nil {
+			// backends of the new service are created with the pools of the first synchronization
+			ctx.initialPools[newPoolKey(svc)] = gnl2go.Pool{Service: svc}
 		}
 	}
 
-	ctx.services[vsID] = &Service{vsID: vsID, options: serviceOptions, svc: svc, backends: make(map[string]*Backend)}
+	ctx.revision++
+	ctx.services[vsID] = &Service{vsID: vsID, options: serviceOptions, svc: svc, backends: make(map[string]*Backend),
+		activeColor: serviceOptions.ActiveColor, switchProgress: 1, version: ctx.revision,
+		vipDeferred: vipInterface != nil && ctx.coldStart}
+	ctx.recordEvent(vsID, "", EventCreated, "created on %s:%d/%s", serviceOptions.host, serviceOptions.Port,
+		serviceOptions.Protocol)
+
+	if serviceOptions.ConnLimit != nil {
+		// the service is still usable, so failed limits are only reported
+		ctx.applyConnLimits()
+	}
 
-	if err := ctx.disco.Expose(vsID, serviceOptions.host.String(), serviceOptions.Port); err != nil {
-		log.Errorf("error while exposing service to Disco: %s", err)
+	// services gated on their status are exposed once it's known
+	if serviceOptions.DiscoStatus == "" && ctx.deferredExposes != nil {
+		// services of the first synchronization are exposed concurrently once it's over
+		ctx.deferredExposes[vsID] = ctx.services[vsID]
+	} else if serviceOptions.DiscoStatus == "" {
+		if err := ctx.disco.Expose(vsID, serviceOptions.host.String(), serviceOptions.Port); err != nil {
+			log.Errorf("error while exposing service to Disco: %s", err)
+		}
+		ctx.services[vsID].exposed = true
 	}
 
 	// init backends
@@ -277,6 +518,13 @@ func (ctx *Context) createService(vsID string, serviceConfig *ServiceConfig) err
 			return err
 		}
 	}
+	if serviceOptions.Pool != "" {
+		if err := ctx.addPoolBackends(ctx.services[vsID]); err != nil {
+			return err
+		}
+	}
+	ctx.evaluateAlerts(ctx.services[vsID])
+	ctx.evaluateStatus(ctx.services[vsID])
 
 	return nil
 }
@@ -288,6 +536,26 @@ func (ctx *Context) CreateService(vsID string, serviceConfig *ServiceConfig) err
 	return ctx.createService(vsID, serviceConfig)
 }
 
+// validateBackend validates options of the backend of the service, so it could be
+// checked before the backend it replaces is removed. Context mutex must be held.
+func (ctx *Context) validateBackend(vs *Service, rsID string, opts *BackendOptions) error {
+	if err := opts.validateWith(ctx.resolveHost); err != nil {
+		return err
+	}
+	if util.AddrFamily(opts.host) != util.AddrFamily(vs.options.host) {
+		return ErrIncompatibleAFs
+	}
+	if err := ctx.backendNetworks.check(opts.host); err != nil {
+		log.Errorf("backend [%s/%s] can't be created: %s", vs.vsID, rsID, err)
+		return err
+	}
+	if err := vs.options.checkBackendPort(rsID, opts.Port); err != nil {
+		log.Errorf("backend [%s/%s] can't be created: %s", vs.vsID, rsID, err)
+		return err
+	}
+	return nil
+}
+
 // CreateBackend registers a new backend with a virtual service.
 func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error {
 	var skipCreation bool
@@ -295,17 +563,41 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 	// Validate input
 	vs, exists := ctx.services[vsID]
 	if !exists {
-		return fmt.Errorf("%w vsID: %s", ErrObjectNotFound, vsID)
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := validateBackendID(rsID); err != nil {
+		return err
+	}
+	members, err := expandBackendRange(rsID, opts)
+	if err != nil {
+		return err
+	}
+	if members != nil {
+		return ctx.createBackendRange(vs, rsID, members)
 	}
 	if vs.BackendExist(rsID) {
-		return fmt.Errorf("%w rsID: %s", ErrObjectExists, rsID)
+		return objectError(ErrObjectExists, "rsID", rsID)
 	}
-	if err := opts.Validate(); err != nil {
+	if err := ctx.validateBackend(vs, rsID, opts); err != nil {
 		return err
 	}
+	if vs.options.isSorryServer(opts.host, opts.Port) {
+		log.Errorf("backend [%s/%s] has the address %s:%d of the sorry server", vsID, rsID, opts.host, opts.Port)
+		return ErrDuplicateBackend
+	}
+	// pulse monitors of both backends would fight over the same IPVS destination weight
+	for otherID, other := range vs.backends {
+		if other.options.host.Equal(opts.host) && other.options.Port == opts.Port {
+			log.Errorf("backend [%s/%s] has the same address %s:%d as backend [%s/%s]",
+				vsID, rsID, opts.host, opts.Port, vsID, otherID)
+			return ErrDuplicateBackend
+		}
+	}
 
-	if util.AddrFamily(opts.host) != util.AddrFamily(vs.options.host) {
-		return ErrIncompatibleAFs
+	// backends with the same target are checked by a single monitor
+	monitor, err := ctx.backendMonitor(opts.host.String(), opts.Port, ctx.backendPulse(vs, opts))
+	if err != nil {
+		return err
 	}
 
 	log.Infof("creating backend [%s] on %s:%d for virtual service [%s]",
@@ -316,9 +608,13 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 
 	var newDest = gnl2go.Dest{
 		IP:     opts.host.String(),
-		Weight: vs.options.MaxWeight,
+		Weight: ctx.backendWeight(vs, opts),
 		Port:   opts.Port,
 	}
+	excluded := vs.options.BackendFilter.excludes(rsID, opts)
+	if excluded || opts.Inactive {
+		newDest.Weight = 0
+	}
 
 	pool, err := ctx.GetPoolForService(vs.svc)
 	if err != nil {
@@ -328,21 +624,16 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 
 	for _, dest := range pool.Dests {
 		if dest.IP == newDest.IP && dest.Port == newDest.Port {
-			log.Infof("Backend %s:%d already existed in service [%s]. Skip creation", newDest.IP, newDest.Port, vsID)
+			log.Infof("Backend %s:%d not managed by GORB already existed in service [%s]. Skip creation",
+				newDest.IP, newDest.Port, vsID)
 			skipCreation = true
 		}
 	}
 
 	if skipCreation == false {
-		if err := ctx.ipvs.AddDestPort(
-			vs.options.host.String(),
-			vs.options.Port,
-			newDest.IP,
-			newDest.Port,
-			vs.options.protocol,
-			newDest.Weight,
-			vs.options.methodID,
-		); err != nil {
+		if err := ctx.withoutSyncLock(func() error {
+			return ctx.addDest(vs, newDest.IP, newDest.Port, newDest.Weight)
+		}); err != nil {
 			log.Errorf("error while creating backend [%s/%s]: %s", vsID, rsID, err)
 			return ErrIpvsSyscallFailed
 		}
@@ -352,10 +643,33 @@ func (ctx *Context) createBackend(vsID, rsID string, opts *BackendOptions) error
 	if err != nil {
 		return err
 	}
+	opts.weight = newDest.Weight
+	rs := vs.backends[rsID]
+	if excluded || opts.Inactive {
+		// excluded and inactive backends are hidden from the start, so pulse doesn't bring them in
+		rs.hidden, rs.restoreWeight = true, ctx.backendWeight(vs, opts)
+	}
+	if excluded {
+		rs.excluded = true
+		log.Infof("backend [%s/%s] is excluded by the backend filter of the service", vsID, rsID)
+	}
+	ctx.revision++
+	rs.version = ctx.revision
+	ctx.recordEvent(vsID, rsID, EventBackendAdded, "added on %s:%d with weight %d", opts.host, opts.Port, opts.weight)
+
+	if opts.Inactive {
+		// the monitor is subscribed on activation
+		rs.inactive = true
+		log.Infof("backend [%s/%s] is inactive until it is activated", vsID, rsID)
+		return nil
+	}
+	// Subscribe the backend to the pulse goroutine, attach it to the Context.
+	ctx.subscribeBackend(vs, rs, monitor)
 
-	// Fire off the configured pulse goroutine, attach it to the Context.
-	go vs.backends[rsID].monitor.Loop(pulse.ID{VsID: vsID, RsID: rsID}, ctx.pulseCh, ctx.stopCh)
-
+	if vs.options.Failover != nil {
+		// the active backend is elected once all backends of a new service are created
+		go ctx.requestReweight(vsID)
+	}
 	return nil
 }
 
@@ -371,25 +685,17 @@ func (ctx *Context) updateBackend(vsID, rsID string, weight int32) (int32, error
 
 	vs, exists := ctx.services[vsID]
 	if !exists {
-		return 0, fmt.Errorf("%w vsID: %s", ErrObjectNotFound, vsID)
+		return 0, objectError(ErrObjectNotFound, "vsID", vsID)
 	}
 	rs, exists := vs.backends[rsID]
 	if !exists {
-		return 0, ErrObjectNotFound
+		return 0, objectError(ErrObjectNotFound, "rsID", rsID)
 	}
 
 	log.Infof("updating backend [%s/%s] with weight: %d", vsID, rsID,
 		weight)
 
-	if err := ctx.ipvs.UpdateDestPort(
-		rs.service.options.host.String(),
-		rs.service.options.Port,
-		rs.options.host.String(),
-		rs.options.Port,
-		rs.service.options.protocol,
-		weight,
-		vs.options.methodID,
-	); err != nil {
+	if err := ctx.setDestWeight(vs, rs, weight); err != nil {
 		log.Errorf("error while updating backend [%s/%s]", vsID, rsID)
 		return 0, ErrIpvsSyscallFailed
 	}
@@ -420,19 +726,11 @@ func (ctx *Context) UpdateBackend(vsID, rsID string, weight int32) (int32, error
 func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 	vs, exists := ctx.services[vsID]
 	if !exists {
-		return nil, fmt.Errorf("%w vsID: %s", ErrObjectNotFound, vsID)
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
 	}
 
-	if ctx.vipInterface != nil && vs.options.delIfAddr == true {
-		ifName := ctx.vipInterface.Attrs().Name
-		vip := &netlink.Addr{IPNet: &net.IPNet{
-			IP: net.ParseIP(vs.options.host.String()), Mask: net.IPv4Mask(255, 255, 255, 255)}}
-		if err := netlink.AddrDel(ctx.vipInterface, vip); err != nil {
-			log.Infof(
-				"failed to delete VIP %s to interface '%s' for service [%s]: %s",
-				vs.options.host, ifName, vsID, err)
-		}
-		log.Infof("VIP %s has been deleted from interface '%s'", vs.options.host, ifName)
+	if vipInterface, _ := ctx.serviceVipInterface(vs.options); vipInterface != nil && vs.options.delIfAddr == true {
+		ctx.delVip(vsID, vipInterface, vs.options)
 	}
 
 	log.Infof("removing virtual service [%s] from %s:%d", vsID,
@@ -447,13 +745,25 @@ func (ctx *Context) removeService(vsID string) (*ServiceOptions, error) {
 		log.Errorf("error while removing virtual service [%s] from ipvs: %s", vsID, err)
 		return nil, ErrIpvsSyscallFailed
 	}
+	ctx.forgetInitialPool(vs.svc, "", 0)
 
+	ctx.removePins(vs, "")
 	delete(ctx.services, vsID)
+	ctx.revision++
+	ctx.recordEvent(vsID, "", EventRemoved, "removed from %s:%d/%s", vs.options.host, vs.options.Port,
+		vs.options.Protocol)
+	ctx.keepRemovedEvents(vsID)
 	vs.Cleanup()
 
+	if vs.options.ConnLimit != nil {
+		ctx.applyConnLimits()
+	}
+
 	// TODO(@kobolog): This will never happen in case of gorb-link.
-	if err := ctx.disco.Remove(vsID); err != nil {
-		log.Errorf("error while removing service from Disco: %s", err)
+	if vs.exposed {
+		if err := ctx.disco.Remove(vsID); err != nil {
+			log.Errorf("error while removing service from Disco: %s", err)
+		}
 	}
 
 	return vs.options, nil
@@ -470,16 +780,21 @@ func (ctx *Context) RemoveService(vsID string) (*ServiceOptions, error) {
 func (ctx *Context) removeBackend(vsID, rsID string) (*BackendOptions, error) {
 	vs, exist := ctx.services[vsID]
 	if !exist {
-		return nil, fmt.Errorf("%w vsID: %s", ErrObjectNotFound, vsID)
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
 	}
 	rs, exists := vs.backends[rsID]
 	if !exists {
-		return nil, ErrObjectNotFound
+		if members := vs.rangeMembers(rsID); len(members) > 0 {
+			return ctx.removeBackendRange(vs, members)
+		}
+		return nil, objectError(ErrObjectNotFound, "rsID", rsID)
 	}
 
 	log.Infof("removing backend [%s/%s]", vsID, rsID)
 
-	if err := ctx.ipvs.DelDestPort(
+	if rs.dropped {
+		log.Infof("destination of backend [%s/%s] is already dropped", vsID, rsID)
+	} else if err := ctx.ipvs.DelDestPort(
 		vs.options.host.String(),
 		vs.options.Port,
 		rs.options.host.String(),
@@ -489,8 +804,22 @@ func (ctx *Context) removeBackend(vsID, rsID string) (*BackendOptions, error) {
 		log.Errorf("error while removing backend [%s/%s] form ipvs: %s", vsID, rsID, err)
 		return nil, ErrIpvsSyscallFailed
 	}
-
-	return vs.RemoveBackend(rsID)
+	ctx.forgetInitialPool(vs.svc, rs.options.host.String(), rs.options.Port)
+
+	ctx.removePins(vs, rsID)
+	// flows of a backend replaced at the same address mustn't continue to the new one
+	ctx.expireConns(vsID+"/"+rsID, ConnDest{VIP: vs.options.host, Port: vs.options.Port,
+		Protocol: vs.options.protocol, RIP: rs.options.host, RPort: rs.options.Port}, vs.options.FlushConntrack)
+
+	ctx.revision++
+	ctx.recordEvent(vsID, rsID, EventBackendRemoved, "removed from %s:%d", rs.options.host, rs.options.Port)
+	options, err := vs.RemoveBackend(rsID)
+	ctx.evaluateAlerts(vs)
+	ctx.evaluateStatus(vs)
+	if vs.options.Failover != nil && rsID == vs.failoverActive {
+		go ctx.requestReweight(vsID)
+	}
+	return options, err
 }
 
 // RemoveBackend deregisters a backend.
@@ -522,6 +851,39 @@ type ServiceInfo struct {
 	Backends      []string        `json:"backends"`
 	BackendsCount uint16          `json:"backends_count"`
 	FallBack      string          `json:"fallback"`
+	// ActiveColor of backends receiving traffic and progress of switching to it
+	ActiveColor    string  `json:"active_color,omitempty"`
+	SwitchProgress float64 `json:"switch_progress,omitempty"`
+	// Version of the service changed on every modification of its options
+	Version uint64 `json:"version"`
+	// DeletedAt is set for deleted services until the end of the grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// HealthyBackends is a number of backends up and receiving traffic
+	HealthyBackends uint16 `json:"healthy_backends"`
+	// BackendStatuses break backends down by their status
+	BackendStatuses BackendStatuses `json:"backend_statuses"`
+	// Status is healthy, degraded or down depending on the fraction of healthy backends
+	Status ServiceStatus `json:"status"`
+	// Alerts are states of service alerts keyed by their names, true if firing
+	Alerts map[string]bool `json:"alerts,omitempty"`
+	// Group is ID of the service group the service belongs to
+	Group string `json:"group,omitempty"`
+	// Frozen services are excluded from store synchronization
+	Frozen bool `json:"frozen,omitempty"`
+	// SorryServerActive is true while the sorry server is inserted instead of unhealthy backends
+	SorryServerActive bool `json:"sorry_server_active,omitempty"`
+	// FailoverBackend is ID of the backend receiving traffic of a failover service
+	FailoverBackend string `json:"failover_backend,omitempty"`
+	// WeightsHeld services keep weights of backends regardless of health checks
+	WeightsHeld bool `json:"weights_held,omitempty"`
+}
+
+// BackendStatuses are numbers of service backends by their status. Disabled
+// backends are drained or deleted, backends neither up nor disabled are down.
+type BackendStatuses struct {
+	Up       int `json:"up"`
+	Down     int `json:"down"`
+	Disabled int `json:"disabled"`
 }
 
 // GetService returns information about a virtual service.
@@ -532,9 +894,10 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 	vs, exists := ctx.services[vsID]
 
 	if !exists {
-		return nil, ErrObjectNotFound
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
 	}
 	serviceStats := vs.CalcServiceStat()
+	serviceStats.Frozen = ctx.frozen[vsID]
 
 	return serviceStats, nil
 }
@@ -543,6 +906,29 @@ func (ctx *Context) GetService(vsID string) (*ServiceInfo, error) {
 type BackendInfo struct {
 	Options *BackendOptions `json:"options"`
 	Metrics pulse.Metrics   `json:"metrics"`
+	Pending bool            `json:"pending,omitempty"`
+	// Version of the backend changed on every modification of its options
+	Version uint64 `json:"version"`
+	// DeletedAt is set for deleted backends until the end of the grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Pool is ID of the backend pool the backend belongs to
+	Pool string `json:"pool,omitempty"`
+	// Range is ID of the backend range the backend is expanded from
+	Range string `json:"range,omitempty"`
+	// Excluded is true while the backend is kept out of traffic by the backend filter of the service
+	Excluded bool `json:"excluded,omitempty"`
+	// Inactive is true until the backend created inactive is activated
+	Inactive bool `json:"inactive,omitempty"`
+	// Backends are IDs of backends the backend range expands into
+	Backends []string `json:"backends,omitempty"`
+	// Dropped is true while the destination of the down backend is removed from IPVS
+	Dropped bool `json:"dropped,omitempty"`
+	// Drained is true while the backend is taken out of traffic until it is enabled
+	Drained bool `json:"drained,omitempty"`
+	// LeaseExpires is set for self-registered backends, which are removed unless they renew registration
+	LeaseExpires *time.Time `json:"lease_expires,omitempty"`
+	// RemovalAt is set for backends gone from discovery until their delayed removal
+	RemovalAt *time.Time `json:"removal_at,omitempty"`
 }
 
 // GetBackend returns information about a backend.
@@ -552,15 +938,32 @@ func (ctx *Context) GetBackend(vsID, rsID string) (*BackendInfo, error) {
 
 	vs, exists := ctx.services[vsID]
 	if !exists {
-		return nil, fmt.Errorf("%w vsID: %s", ErrObjectNotFound, vsID)
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
 	}
 
 	rs, exists := vs.backends[rsID]
 	if !exists {
-		return nil, fmt.Errorf("%w rsID: %s", ErrObjectNotFound, rsID)
+		if members := vs.rangeMembers(rsID); len(members) > 0 {
+			return rangeInfo(members), nil
+		}
+		return nil, objectError(ErrObjectNotFound, "rsID", rsID)
 	}
 
-	return &BackendInfo{rs.options, rs.metrics}, nil
+	info := &BackendInfo{Options: rs.options, Metrics: rs.metrics, Pending: rs.options.pending, Version: rs.version,
+		Pool: rs.options.pool, Dropped: rs.dropped, Drained: rs.drained, Excluded: rs.excluded, Inactive: rs.inactive}
+	if rs.options.rangeOf != nil {
+		info.Range = rs.options.rangeOf.rsID
+	}
+	if !rs.deletedAt.IsZero() {
+		info.DeletedAt = &rs.deletedAt
+	}
+	if rs.leaseTimer != nil {
+		info.LeaseExpires = &rs.leaseExpires
+	}
+	if rs.removalTimer != nil {
+		info.RemovalAt = &rs.removalAt
+	}
+	return info, nil
 }
 
 // SetStore if external kvstore exists, set store to context
@@ -576,121 +979,87 @@ func (ctx *Context) StoreExist() bool {
 	return true
 }
 
+// StoreManaged Checks if services are managed by store right now.
+// Services could be changed via API while periodic store sync is paused.
+func (ctx *Context) StoreManaged() bool {
+	if !ctx.StoreExist() {
+		return false
+	}
+	return !ctx.store.SyncPaused()
+}
+
 func (ctx *Context) CompareWith(storeServices map[string]*ServiceConfig) *StoreSyncStatus {
 	ctx.mutex.RLock()
 	defer ctx.mutex.RUnlock()
 	syncStatus := &StoreSyncStatus{}
 
-	// find removed services in store
-	for vsID, service := range ctx.services {
-		if storeServiceOptions, ok := storeServices[vsID]; !ok {
-			log.Debugf("service [%s] not found in store", vsID)
-			syncStatus.RemovedServices = append(syncStatus.RemovedServices, vsID)
-		} else {
-			// find updated services in store
-			if !service.options.CompareStoreOptions(storeServiceOptions.ServiceOptions) {
-				log.Debugf("service [%s] is outdated.", vsID)
-				syncStatus.UpdatedServices = append(syncStatus.UpdatedServices, vsID)
-			}
-			for rsID, backend := range service.backends {
-				backendName := fmt.Sprintf("[%s/%s]", vsID, rsID)
-				if storeBackendOptions, ok := storeServiceOptions.ServiceBackends[rsID]; !ok {
-					log.Debugf("backend %s not found in store", backendName)
-					syncStatus.RemovedBackends = append(syncStatus.RemovedBackends, backendName)
-				} else {
-					// find updated backends
-					if !backend.options.CompareStoreOptions(storeBackendOptions) {
-						log.Debugf("backend %s is outdated.", backendName)
-						syncStatus.UpdatedBackends = append(syncStatus.UpdatedBackends, backendName)
-					}
-					delete(storeServiceOptions.ServiceBackends, rsID)
-				}
-			}
-			// find new Backends
-			for rsID, storeBackend := range storeServiceOptions.ServiceBackends {
-				backendName := fmt.Sprintf("[%s/%s]", storeBackend.vsID, rsID)
-				log.Debugf("new backend %s found.", backendName)
-				syncStatus.NewBackends = append(syncStatus.NewBackends, backendName)
-			}
-			delete(storeServices, vsID)
+	for _, op := range ctx.planSync(storeServices).Operations {
+		switch {
+		case op.Action == SyncActionRemove && op.RsID == "":
+			syncStatus.RemovedServices = append(syncStatus.RemovedServices, op.VsID)
+		case op.Action == SyncActionRemove:
+			syncStatus.RemovedBackends = append(syncStatus.RemovedBackends, op.String())
+		case op.Action == SyncActionUpdate && op.RsID == "":
+			syncStatus.UpdatedServices = append(syncStatus.UpdatedServices, op.VsID)
+		case op.Action == SyncActionUpdate:
+			syncStatus.UpdatedBackends = append(syncStatus.UpdatedBackends, op.String())
+		case op.Action == SyncActionCreate && op.RsID == "":
+			syncStatus.NewServices = append(syncStatus.NewServices, op.VsID)
+		case op.Action == SyncActionCreate:
+			syncStatus.NewBackends = append(syncStatus.NewBackends, op.String())
 		}
 	}
 
-	// find new services
-	for id, _ := range storeServices {
-		log.Debugf("new service [%s] found.", id)
-		syncStatus.NewServices = append(syncStatus.NewServices, id)
-	}
-
 	syncStatus.Status = syncStatus.CheckStatus()
 	return syncStatus
 }
 
-func (ctx *Context) Synchronize(storeServicesConfig map[string]*ServiceConfig) error {
+// Synchronize applies store configuration to GORB. A failed operation doesn't
+// stop synchronization: remaining operations are applied and all failures are
+// reported with SyncError.
+func (ctx *Context) Synchronize(storeServicesConfig map[string]*ServiceConfig) (*StoreSyncResult, error) {
+	return ctx.synchronize(context.Background(), storeServicesConfig)
+}
+
+func (ctx *Context) synchronize(parent context.Context, storeServicesConfig map[string]*ServiceConfig) (*StoreSyncResult, error) {
+	// pulse updates wait for the sync, they're resumed once the mutex is released
+	ctx.pausePulses()
+	defer ctx.resumePulses()
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
+	defer ctx.withTraceParent(parent)()
 	defer log.Info("============================ END SYNC ============================")
 	log.Info("============================== SYNC ==============================")
 
+	result := newStoreSyncResult()
+	defer result.finish()
+
 	log.Debug("external store content")
 	for vsID, service := range storeServicesConfig {
 		log.Debugf("SERVICE[%s]: %#v", vsID, service)
 	}
 
-	log.Info("sync services")
-	// synchronize services with store
-	for vsID, service := range ctx.services {
-		if storeService, ok := storeServicesConfig[vsID]; !ok {
-			log.Debugf("service [%s] not found. removing", vsID)
-			if _, err := ctx.removeService(vsID); err != nil {
-				return err
-			}
-		} else {
-			if !service.options.CompareStoreOptions(storeService.ServiceOptions) {
-				if _, err := ctx.removeService(vsID); err != nil {
-					return err
-				}
-				if err := ctx.createService(vsID, storeService); err != nil {
-					return err
-				}
-			}
-			for rsID, backend := range service.backends {
-				if storeBackendOptions, ok := storeService.ServiceBackends[rsID]; !ok {
-					log.Debugf("backend [%s/%s] not found in store", vsID, rsID)
-					if _, err := ctx.removeBackend(vsID, rsID); err != nil {
-						return err
-					}
-				} else {
-					// find updated backends
-					if !backend.options.CompareStoreOptions(storeBackendOptions) {
-						log.Debugf("backend [%s/%s] is outdated.", vsID, rsID)
-						if _, err := ctx.removeBackend(vsID, rsID); err != nil {
-							return err
-						}
-						if err := ctx.createBackend(vsID, rsID, storeBackendOptions); err != nil {
-							return err
-						}
-
-					}
-					delete(storeService.ServiceBackends, rsID)
-				}
-			}
-			log.Infof("create new backends for [%s]. count: %d", vsID, len(storeService.ServiceBackends))
-			for rsID, storeBackendOptions := range storeService.ServiceBackends {
-				if err := ctx.createBackend(vsID, rsID, storeBackendOptions); err != nil {
-					return err
-				}
-			}
-			delete(storeServicesConfig, vsID)
+	plan := ctx.planSync(storeServicesConfig)
+	initial := ctx.startup.begin(len(plan.Operations))
+	if initial {
+		if ctx.checkSchedulers {
+			ctx.checkPlannedSchedulers(plan)
 		}
+		ctx.prepareInitialSync(plan)
+		ctx.startup.setPhase(StartupApplying)
 	}
-	log.Infof("create new services. count: %d", len(storeServicesConfig))
-	for id, storeServiceOptions := range storeServicesConfig {
-		if err := ctx.createService(id, storeServiceOptions); err != nil {
-			return err
-		}
+	failed := ctx.applySyncPlan(parent, plan, result)
+	if initial {
+		ctx.finishInitialSync()
+		ctx.startup.setPhase(StartupDone)
 	}
+	ctx.recordSyncedRevisions(storeServicesConfig, failed)
+	ctx.coldStart = false
 
+	if err := result.Err(); err != nil {
+		log.Errorf("synced with store with %d error(s)", len(result.Errors))
+		return result, err
+	}
 	log.Info("Successfully synced with store")
-	return nil
+	return result, nil
 }
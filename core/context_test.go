@@ -1,15 +1,27 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"syscall"
 
 	"github.com/qk4l/gorb/disco"
 	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/tehnerd/gnl2go"
+	"github.com/vishvananda/netlink"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 type fakeDisco struct {
@@ -78,6 +90,16 @@ func (f *fakeIpvs) GetPools() ([]gnl2go.Pool, error) {
 	return poolArray, nil
 }
 
+func (f *fakeIpvs) GetTimeouts() (IpvsTimeouts, error) {
+	args := f.Called()
+	return args.Get(0).(IpvsTimeouts), args.Error(1)
+}
+
+func (f *fakeIpvs) SetTimeouts(timeouts IpvsTimeouts) error {
+	args := f.Called(timeouts)
+	return args.Error(0)
+}
+
 func newRoutineContext(services map[string]*Service, ipvs Ipvs) *Context {
 	c := newContext(ipvs, &fakeDisco{})
 	c.services = services
@@ -86,11 +108,13 @@ func newRoutineContext(services map[string]*Service, ipvs Ipvs) *Context {
 
 func newContext(ipvs Ipvs, disco disco.Driver) *Context {
 	return &Context{
-		ipvs:     ipvs,
-		services: map[string]*Service{},
-		pulseCh:  make(chan pulse.Update),
-		stopCh:   make(chan struct{}),
-		disco:    disco,
+		ipvs:       ipvs,
+		services:   map[string]*Service{},
+		pulses:     pulse.NewQueue(pulseQueueSize),
+		reweightCh: make(chan string),
+		stashCh:    make(chan func(map[pulse.ID]int32, map[pulse.ID]time.Time)),
+		stopCh:     make(chan struct{}),
+		disco:      disco,
 	}
 }
 
@@ -248,6 +272,28 @@ func TestStatusDownDuringIncreasingWeight(t *testing.T) {
 	mockIpvs.AssertExpectations(t)
 }
 
+func TestPulseUpdateHoldsFlappingBackendAtReducedWeight(t *testing.T) {
+	stash := make(map[pulse.ID]int32)
+	backends := map[string]*Backend{rsID: &Backend{service: &virtualService, options: &BackendOptions{weight: 100}}}
+	services := map[string]*Service{vsID: &virtualService}
+	services[vsID].backends = backends
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(services, mockIpvs)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(25), mock.Anything).Return(nil)
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusFlapping, Health: 0.25}})
+
+	assert.Equal(t, map[pulse.ID]int32{pulse.ID{VsID: vsID, RsID: rsID}: 100}, stash)
+	mockIpvs.AssertExpectations(t)
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(100), mock.Anything).Return(nil)
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+
+	assert.Empty(t, stash)
+	mockIpvs.AssertExpectations(t)
+}
+
 func TestServiceIsCreatedWithGenericCustomFlags(t *testing.T) {
 	options := &serviceConfig
 	options.ServiceOptions.ShFlags = "flag-1|flag-2|flag-3"
@@ -264,3 +310,1269 @@ func TestServiceIsCreatedWithGenericCustomFlags(t *testing.T) {
 	mockIpvs.AssertExpectations(t)
 	mockDisco.AssertExpectations(t)
 }
+
+func TestSynchronizeReportsAppliedChanges(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "wrr").Return(nil)
+	mockIpvs.On("DelService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP)).Return(nil)
+	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	mockDisco.On("Remove", vsID).Return(nil)
+
+	result, err := c.Synchronize(map[string]*ServiceConfig{
+		vsID: {ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	assert.Empty(t, result.Errors)
+
+	result, err = c.Synchronize(map[string]*ServiceConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.Created)
+	assert.Equal(t, 1, result.Removed)
+	assert.Empty(t, c.services)
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestSynchronizeContinuesOnError(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "wrr").Return(errors.New("EEXIST"))
+	mockIpvs.On("AddService", "127.0.0.1", uint16(81), uint16(syscall.IPPROTO_TCP), "wrr").Return(nil)
+	mockDisco.On("Expose", "good", "127.0.0.1", uint16(81)).Return(nil)
+
+	result, err := c.Synchronize(map[string]*ServiceConfig{
+		"bad":  {ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}},
+		"good": {ServiceOptions: &ServiceOptions{Port: 81, Host: "localhost"}},
+	})
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, ErrIpvsSyscallFailed))
+	assert.Equal(t, 1, result.Created)
+	assert.Len(t, result.Errors, 1)
+	assert.Equal(t, "[bad]", result.Errors[0].Object)
+	assert.Contains(t, c.services, "good")
+	mockIpvs.AssertExpectations(t)
+	mockDisco.AssertExpectations(t)
+}
+
+func TestSynchronizeRollsBackFailedServiceUpdate(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	mockDisco := &fakeDisco{}
+	c := newContext(mockIpvs, mockDisco)
+
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "wrr").Return(nil)
+	mockIpvs.On("AddService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP), "unknown").Return(errors.New("ENOENT"))
+	mockIpvs.On("DelService", "127.0.0.1", uint16(80), uint16(syscall.IPPROTO_TCP)).Return(nil)
+	mockDisco.On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	mockDisco.On("Remove", vsID).Return(nil)
+
+	assert.NoError(t, c.createService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}))
+
+	result, err := c.Synchronize(map[string]*ServiceConfig{
+		vsID: {ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", LbMethod: "unknown"}},
+	})
+	assert.Error(t, err)
+	assert.Len(t, result.Errors, 1)
+	assert.Equal(t, 0, result.Updated)
+	assert.Equal(t, "wrr", c.services[vsID].options.LbMethod)
+	mockIpvs.AssertNumberOfCalls(t, "AddService", 3)
+}
+
+func TestSetIpvsTimeouts(t *testing.T) {
+	mockIpvs := &fakeIpvs{}
+	c := newContext(mockIpvs, &fakeDisco{})
+	timeouts := IpvsTimeouts{TCP: 7200, UDP: 300}
+
+	mockIpvs.On("SetTimeouts", timeouts).Return(nil).Once()
+	mockIpvs.On("SetTimeouts", timeouts).Return(errors.New("EINVAL")).Once()
+
+	assert.NoError(t, c.SetIpvsTimeouts(timeouts))
+	assert.Equal(t, ErrIpvsSyscallFailed, c.SetIpvsTimeouts(timeouts))
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestApplyPlan(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	defer close(c.stopCh)
+
+	desired := func() map[string]*ServiceConfig {
+		return map[string]*ServiceConfig{vsID: {
+			ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp"},
+			ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+		}}
+	}
+
+	// IDs of requested services are normalized
+	normalizedVsID, normalizedRsID := strings.ToLower(vsID), strings.ToLower(rsID)
+	c.disco.(*fakeDisco).On("Expose", normalizedVsID, "127.0.0.1", uint16(80)).Return(nil)
+
+	plan := c.CreatePlan(desired())
+	require.Len(t, plan.Operations, 1)
+	assert.Equal(t, SyncActionCreate, plan.Operations[0].Action)
+	assert.Equal(t, normalizedVsID, plan.Operations[0].VsID)
+	assert.Nil(t, plan.Operations[0].Current)
+	assert.Equal(t, uint16(8080), plan.Operations[0].Desired.ServiceBackends[normalizedRsID].Port)
+	outdated := c.CreatePlan(map[string]*ServiceConfig{})
+
+	result, err := c.ApplyPlan(plan.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	assert.True(t, c.services[normalizedVsID].BackendExist(normalizedRsID))
+
+	_, err = c.ApplyPlan(plan.ID)
+	assert.Equal(t, ErrObjectNotFound, err)
+	_, err = c.ApplyPlan(outdated.ID)
+	assert.Equal(t, ErrPlanOutdated, err)
+
+	assert.Empty(t, c.CreatePlan(desired()).Operations)
+}
+
+func TestLocalitySpillOver(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.locality = "az1"
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", Locality: &LocalityOptions{RemoteWeight: 10}},
+		ServiceBackends: map[string]*BackendOptions{
+			"local":  {Host: "127.0.0.2", Port: 8080, Locality: "az1"},
+			"remote": {Host: "127.0.0.3", Port: 8080, Locality: "az2"},
+		},
+	}))
+	weights := func() map[string]int32 {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return map[string]int32{
+			"local":  c.services[vsID].backends["local"].options.weight,
+			"remote": c.services[vsID].backends["remote"].options.weight,
+		}
+	}
+	// local backends have not been checked yet, so remote ones take traffic
+	assert.Equal(t, map[string]int32{"local": 100, "remote": 100}, weights())
+
+	stash := map[pulse.ID]int32{}
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: "local"}, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, map[string]int32{"local": 100, "remote": 10}, weights())
+
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: "local"}, Metrics: pulse.Metrics{Status: pulse.StatusDown, Health: 0.4}})
+	assert.Equal(t, map[string]int32{"local": 0, "remote": 100}, weights())
+}
+
+func TestSwitchColor(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", ActiveColor: "blue"},
+		ServiceBackends: map[string]*BackendOptions{
+			"blue":  {Host: "127.0.0.2", Port: 8080, Color: "blue"},
+			"green": {Host: "127.0.0.3", Port: 8080, Color: "green"},
+			"plain": {Host: "127.0.0.4", Port: 8080},
+		},
+	}))
+	weights := func() map[string]int32 {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		weights := map[string]int32{}
+		for rsID, rs := range c.services[vsID].backends {
+			weights[rsID] = rs.options.weight
+		}
+		return weights
+	}
+	assert.Equal(t, map[string]int32{"blue": 100, "green": 0, "plain": 100}, weights())
+
+	assert.ErrorIs(t, c.SwitchColor(vsID, "red", 0, 0, Precondition{}), ErrObjectNotFound)
+	assert.ErrorIs(t, c.SwitchColor(vsID, "green", time.Second, 2e9, Precondition{}), ErrInvalidSwitchSteps)
+	assert.ErrorIs(t, c.SwitchColor(vsID, "green", time.Second, 101, Precondition{}), ErrInvalidSwitchSteps)
+
+	stash := map[pulse.ID]int32{}
+	require.NoError(t, c.SwitchColor(vsID, "green", 0, 0, Precondition{}))
+	c.applyWeights(stash, <-c.reweightCh)
+	assert.Equal(t, map[string]int32{"blue": 0, "green": 100, "plain": 100}, weights())
+
+	require.NoError(t, c.SwitchColor(vsID, "blue", 40*time.Millisecond, 2, Precondition{}))
+	c.applyWeights(stash, <-c.reweightCh)
+	assert.Equal(t, map[string]int32{"blue": 50, "green": 50, "plain": 100}, weights())
+	c.applyWeights(stash, <-c.reweightCh)
+	assert.Equal(t, map[string]int32{"blue": 100, "green": 0, "plain": 100}, weights())
+
+	info, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, "blue", info.ActiveColor)
+	assert.Equal(t, float64(1), info.SwitchProgress)
+}
+
+func TestPendingBackends(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"old": {Host: "127.0.0.2", Port: 8080}},
+	}))
+	assert.ErrorIs(t, c.PreRegisterBackends("unknown", nil), ErrObjectNotFound)
+	// backends are registered all or none
+	assert.ErrorIs(t, c.PreRegisterBackends(vsID, map[string]*BackendOptions{
+		"a": {Host: "127.0.0.4", Port: 8080}, "b": nil}), ErrMissingEndpoint)
+	assert.ErrorIs(t, c.PreRegisterBackends(vsID, map[string]*BackendOptions{
+		"a": {Host: "127.0.0.4", Port: 8080}, "old": {Host: "127.0.0.5", Port: 8080}}), ErrObjectExists)
+	assert.ErrorIs(t, c.PreRegisterBackends(vsID, map[string]*BackendOptions{
+		"a": {Host: "127.0.0.4", Port: 8080}, "b": {Host: "127.0.0.2", Port: 8080}}), ErrDuplicateBackend)
+	_, err := c.GetBackend(vsID, "a")
+	assert.ErrorIs(t, err, ErrObjectNotFound, "backends created before the failure are removed")
+	require.NoError(t, c.PreRegisterBackends(vsID, map[string]*BackendOptions{"new": {Host: "127.0.0.3", Port: 8080}}))
+
+	backend, err := c.GetBackend(vsID, "new")
+	require.NoError(t, err)
+	assert.True(t, backend.Pending)
+	assert.Equal(t, int32(0), backend.Options.weight)
+
+	zero := uint64(0)
+	assert.Equal(t, []ServiceLoad{{VsID: vsID, Backends: 2, HealthyBackends: 1, PendingBackends: 1, ActiveConns: &zero}},
+		c.ServicesLoad())
+
+	stash := map[pulse.ID]int32{}
+	id := pulse.ID{VsID: vsID, RsID: "new"}
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.True(t, backend.Options.pending)
+
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}})
+	assert.False(t, backend.Options.pending)
+	assert.Equal(t, int32(100), backend.Options.weight)
+	assert.NotContains(t, stash, id)
+}
+
+func TestDuplicateBackendAddress(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2", Port: 8080}},
+	}))
+	assert.Equal(t, ErrDuplicateBackend, c.CreateBackend(vsID, "b", &BackendOptions{Host: "127.0.0.2", Port: 8080}))
+	assert.NoError(t, c.CreateBackend(vsID, "c", &BackendOptions{Host: "127.0.0.2", Port: 8081}))
+
+	config := &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.2", Port: 8080},
+		},
+	}
+	config.validate(nil, nil)
+	assert.Contains(t, config.ServiceBackends, "a")
+	assert.ErrorIs(t, config.invalidBackends["b"], ErrDuplicateBackend)
+}
+
+func TestBackendNetworks(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	networks, err := ParseBackendNetworks([]string{"127.0.0.0/30", "10.0.0.0/8"})
+	require.NoError(t, err)
+	c.backendNetworks = networks
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2", Port: 8080}},
+	}))
+	err = c.CreateBackend(vsID, "b", &BackendOptions{Host: "127.0.0.5", Port: 8080})
+	assert.ErrorIs(t, err, ErrBackendNotAllowed)
+	assert.EqualError(t, err, "backend address is outside of allowed networks: 127.0.0.5 is not in 127.0.0.0/30, 10.0.0.0/8")
+
+	config := &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "10.1.0.1", Port: 8080},
+			"b": {Host: "8.8.8.8", Port: 8080},
+		},
+	}
+	config.validate(nil, c.backendNetworks)
+	assert.Contains(t, config.ServiceBackends, "a")
+	assert.ErrorIs(t, config.invalidBackends["b"], ErrBackendNotAllowed)
+
+	_, err = ParseBackendNetworks([]string{"10.0.0.0"})
+	assert.Error(t, err)
+}
+
+func TestDuplicates(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	for vsID, port := range map[string]uint16{"a": 80, "b": 80, "c": 81} {
+		require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+			ServiceOptions:  &ServiceOptions{Port: port, Host: "localhost"},
+			ServiceBackends: map[string]*BackendOptions{"web": {Host: "127.0.0.2", Port: 8080}},
+		}))
+	}
+	require.NoError(t, ipvs.AddService("127.0.0.9", 80, syscall.IPPROTO_TCP, "wrr"))
+	require.NoError(t, ipvs.AddDestPort("127.0.0.1", 81, "127.0.0.3", 8080, syscall.IPPROTO_TCP, 1, 0))
+
+	report, err := c.Duplicates()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"127.0.0.1:80/tcp": {"a", "b"}}, report.Services)
+	assert.Equal(t, map[string][]string{"127.0.0.2:8080": {"a/web", "b/web", "c/web"}}, report.Backends)
+	assert.Equal(t, []string{"127.0.0.9:80/tcp"}, report.StaleServices)
+	assert.Equal(t, []string{"c/127.0.0.3:8080"}, report.StaleBackends)
+}
+
+func TestIpvsTable(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	require.NoError(t, ipvs.AddDestPort("127.0.0.1", 80, "127.0.0.3", 8080, syscall.IPPROTO_TCP, 5, 0))
+	require.NoError(t, ipvs.AddService("127.0.0.9", 53, syscall.IPPROTO_UDP, "rr"))
+
+	table, err := c.IpvsTable()
+	require.NoError(t, err)
+	assert.Equal(t, []IpvsTableService{
+		{VIP: "127.0.0.1", Port: 80, Protocol: "tcp", Scheduler: "wrr", VsID: vsID, Destinations: []IpvsTableDest{
+			{IP: "127.0.0.2", Port: 8080, Weight: 100, RsID: rsID},
+			{IP: "127.0.0.3", Port: 8080, Weight: 5},
+		}},
+		{VIP: "127.0.0.9", Port: 53, Protocol: "udp", Scheduler: "rr", Destinations: []IpvsTableDest{}},
+	}, table)
+}
+
+func TestIpvsDrift(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.3", Port: 8080},
+		},
+	}))
+	report, err := c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Equal(t, &DriftReport{Missing: []DriftEntry{}, Extra: []DriftEntry{}, Modified: []DriftEntry{}}, report)
+
+	require.NoError(t, ipvs.DelDestPort("127.0.0.1", 80, "127.0.0.2", 8080, syscall.IPPROTO_TCP))
+	require.NoError(t, ipvs.UpdateDestPort("127.0.0.1", 80, "127.0.0.3", 8080, syscall.IPPROTO_TCP, 7, 0))
+	require.NoError(t, ipvs.AddDestPort("127.0.0.1", 80, "127.0.0.4", 8080, syscall.IPPROTO_TCP, 1, 0))
+	require.NoError(t, ipvs.AddService("127.0.0.9", 53, syscall.IPPROTO_UDP, "rr"))
+
+	report, err = c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Equal(t, []DriftEntry{{VsID: vsID, RsID: "a", Address: "127.0.0.2:8080"}}, report.Missing)
+	assert.Equal(t, []DriftEntry{{VsID: vsID, Address: "127.0.0.4:8080"}, {Address: "127.0.0.9:53/udp"}}, report.Extra)
+	assert.Equal(t, []DriftEntry{{VsID: vsID, RsID: "b", Address: "127.0.0.3:8080",
+		Field: "weight", Expected: "100", Actual: "7"}}, report.Modified)
+
+	// the IPVS service is still the one of the service if its scheduler is changed
+	require.NoError(t, ipvs.(IpvsServiceUpdater).UpdateService("127.0.0.1", 80, syscall.IPPROTO_TCP, "rr", nil, 1<<32-1))
+	report, err = c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Len(t, report.Missing, 1)
+	assert.Contains(t, report.Modified, DriftEntry{VsID: vsID, Address: "127.0.0.1:80/tcp",
+		Field: "scheduler", Expected: "wrr", Actual: "rr"})
+	assert.Equal(t, vsID, c.serviceByAddress(gnl2go.Service{VIP: "127.0.0.1", Port: 80,
+		Proto: syscall.IPPROTO_TCP, Sched: "rr"}).vsID)
+}
+
+func TestBackupRestore(t *testing.T) {
+	key := []byte("secret")
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", "web", "127.0.0.1", uint16(80)).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", "web").Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"web-1": {Host: "127.0.0.2", Port: 8080}},
+	}))
+	_, err := c.UpdateBackend("web", "web-1", 42)
+	require.NoError(t, err)
+
+	_, err = c.Backup(nil)
+	assert.Equal(t, ErrBackupKeyMissing, err)
+	archive, err := c.Backup(key)
+	require.NoError(t, err)
+
+	_, err = c.RemoveService("web")
+	require.NoError(t, err)
+	_, err = c.Restore(archive, []byte("other"))
+	assert.Equal(t, ErrBackupSignature, err)
+	_, err = c.Restore([]byte("{}"), key)
+	assert.Equal(t, ErrInvalidBackup, err)
+
+	result, err := c.Restore(archive, key)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	backend, err := c.GetBackend("web", "web-1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(42), backend.Options.weight)
+}
+
+func TestPutService(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", vsID).Return(nil)
+	defer close(c.stopCh)
+
+	config := func(port uint16) *ServiceConfig {
+		return &ServiceConfig{ServiceOptions: &ServiceOptions{Port: port, Host: "localhost"}}
+	}
+
+	created, err := c.PutService(vsID, config(80), Precondition{MustNotExist: true})
+	require.NoError(t, err)
+	assert.True(t, created)
+	created, err = c.PutBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	assert.True(t, created)
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	version := service.Version
+
+	// the same options change nothing
+	created, err = c.PutService(vsID, config(80), Precondition{Version: version})
+	require.NoError(t, err)
+	assert.False(t, created)
+	service, err = c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, version, service.Version)
+
+	_, err = c.PutService(vsID, config(80), Precondition{MustNotExist: true})
+	assert.Equal(t, ErrPreconditionFailed, err)
+
+	// an update keeps backends and changes version
+	_, err = c.PutService(vsID, config(81), Precondition{Version: version})
+	require.NoError(t, err)
+	service, err = c.GetService(vsID)
+	require.NoError(t, err)
+	assert.NotEqual(t, version, service.Version)
+	assert.Equal(t, []string{rsID}, service.Backends)
+
+	_, err = c.PutService(vsID, config(82), Precondition{Version: version})
+	assert.Equal(t, ErrPreconditionFailed, err)
+	assert.Equal(t, ErrPreconditionFailed, c.DeleteService(vsID, Precondition{Version: version}))
+
+	backend, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	_, err = c.PutBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8081}, Precondition{Version: backend.Version})
+	require.NoError(t, err)
+	assert.Equal(t, ErrPreconditionFailed, c.DeleteBackend(vsID, rsID, Precondition{Version: backend.Version}))
+
+	assert.NoError(t, c.DeleteService(vsID, Precondition{Version: service.Version}))
+}
+
+func TestPutBackends(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.3", Port: 8080},
+		},
+	}))
+	_, err := c.RegisterBackend(vsID, "self", &BackendOptions{Host: "127.0.0.9", Port: 8080}, time.Hour)
+	require.NoError(t, err)
+
+	desired := map[string]*BackendOptions{
+		"B": {Host: "127.0.0.3", Port: 8081},
+		"c": {Host: "127.0.0.4", Port: 8080},
+	}
+	operations, err := c.PutBackends(vsID, desired, Precondition{})
+	require.NoError(t, err)
+	actions := make([]string, 0, len(operations))
+	for _, op := range operations {
+		actions = append(actions, fmt.Sprintf("%s %s", op.Action, op))
+	}
+	assert.Equal(t, []string{"remove [virtualServiceId/a]", "update [virtualServiceId/b]", "create [virtualServiceId/c]"}, actions)
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b", "c", "self"}, service.Backends, "self-registered backends are kept")
+
+	// the same set changes nothing
+	operations, err = c.PutBackends(vsID, desired, Precondition{})
+	require.NoError(t, err)
+	assert.Empty(t, operations)
+
+	_, err = c.PutBackends(vsID, map[string]*BackendOptions{"d": {Port: 8080}}, Precondition{})
+	assert.ErrorIs(t, err, ErrMissingEndpoint)
+	_, err = c.PutBackends(vsID, map[string]*BackendOptions{"d": {Host: "127.0.0.5", Port: 8080}, "D": {Host: "127.0.0.6", Port: 8080}}, Precondition{})
+	assert.ErrorIs(t, err, ErrDuplicateID)
+	service, err = c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Len(t, service.Backends, 3, "invalid sets aren't applied")
+}
+
+func TestStrictVersions(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.strictVersions = true
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	config := &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}
+	_, err := c.PutService(vsID, config, Precondition{})
+	require.NoError(t, err)
+	_, err = c.PutBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+
+	_, err = c.PutService(vsID, config, Precondition{})
+	assert.Equal(t, ErrVersionRequired, err)
+	assert.Equal(t, ErrVersionRequired, c.DeleteBackend(vsID, rsID, Precondition{MustExist: true}))
+
+	// resources of services and backends are versioned with them
+	assert.Equal(t, ErrVersionRequired, c.DrainBackend(vsID, rsID, Precondition{}))
+	assert.Equal(t, ErrVersionRequired, c.SetConnLimit(vsID, &ConnLimitOptions{Rate: 100}, Precondition{}))
+	_, err = c.PutBackends(vsID, map[string]*BackendOptions{}, Precondition{})
+	assert.Equal(t, ErrVersionRequired, err)
+	backend, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	require.NoError(t, c.DrainBackend(vsID, rsID, Precondition{Version: backend.Version}))
+	assert.Equal(t, ErrPreconditionFailed, c.EnableBackend(vsID, rsID, Precondition{Version: backend.Version}),
+		"draining changes the version of backend")
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	require.NoError(t, c.HoldWeights(vsID, Precondition{Version: service.Version}))
+	assert.Equal(t, ErrPreconditionFailed, c.ReleaseWeights(vsID, Precondition{Version: service.Version}))
+
+	backend, err = c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.NoError(t, c.DeleteBackend(vsID, rsID, Precondition{Version: backend.Version}))
+
+	// groups are versioned by their services and backends
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	groupConfig := &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Ports: []uint16{81, 82}}}
+	_, err = c.PutServiceGroup("web", groupConfig, Precondition{})
+	require.NoError(t, err)
+	_, err = c.PutServiceGroup("web", groupConfig, Precondition{})
+	assert.Equal(t, ErrVersionRequired, err)
+	group, err := c.GetServiceGroup("web")
+	require.NoError(t, err)
+	_, err = c.PutGroupBackend("web", rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, ErrPreconditionFailed, c.RemoveServiceGroup("web", Precondition{Version: group.Version}),
+		"backends change the version of group")
+	assert.Equal(t, ErrVersionRequired, c.RemoveGroupBackend("web", rsID, Precondition{}))
+	group, err = c.GetServiceGroup("web")
+	require.NoError(t, err)
+	assert.NoError(t, c.RemoveServiceGroup("web", Precondition{Version: group.Version}))
+
+	// pools are versioned on their own
+	poolConfig := &BackendPoolConfig{Backends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}}}
+	_, err = c.PutBackendPool("shared", poolConfig, Precondition{})
+	require.NoError(t, err)
+	_, err = c.PutBackendPool("shared", poolConfig, Precondition{})
+	assert.Equal(t, ErrVersionRequired, err)
+	pool, err := c.GetBackendPool("shared")
+	require.NoError(t, err)
+	assert.Equal(t, ErrPreconditionFailed, c.RemoveBackendPool("shared", Precondition{Version: pool.Version + 1}))
+	assert.NoError(t, c.RemoveBackendPool("shared", Precondition{Version: pool.Version}))
+}
+
+func TestSoftDelete(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.deleteGracePeriod = time.Hour
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	ipvsWeight := func() int32 {
+		pools, err := c.ipvs.GetPools()
+		require.NoError(t, err)
+		require.Len(t, pools, 1)
+		require.Len(t, pools[0].Dests, 1)
+		return pools[0].Dests[0].Weight
+	}
+
+	_, err := c.PutService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}, Precondition{})
+	require.NoError(t, err)
+	_, err = c.PutBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, ErrNotDeleted, c.RestoreBackend(vsID, rsID, Precondition{}))
+
+	require.NoError(t, c.DeleteBackend(vsID, rsID, Precondition{}))
+	backend, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.NotNil(t, backend.DeletedAt)
+	assert.Equal(t, int32(0), ipvsWeight())
+
+	require.NoError(t, c.DeleteService(vsID, Precondition{}))
+	require.NoError(t, c.RestoreBackend(vsID, rsID, Precondition{}))
+	assert.Equal(t, int32(0), ipvsWeight(), "backends of deleted service stay out of traffic")
+
+	require.NoError(t, c.RestoreService(vsID, Precondition{}))
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Nil(t, service.DeletedAt)
+	assert.Equal(t, int32(100), ipvsWeight())
+
+	c.mutex.Lock()
+	c.deleteGracePeriod = time.Millisecond
+	c.mutex.Unlock()
+	require.NoError(t, c.DeleteBackend(vsID, rsID, Precondition{}))
+	assert.Eventually(t, func() bool {
+		_, err := c.GetBackend(vsID, rsID)
+		return errors.Is(err, ErrObjectNotFound)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCalcServiceStat(t *testing.T) {
+	vs := &Service{options: &ServiceOptions{MaxWeight: 100}}
+	vs.backends = map[string]*Backend{
+		"up":      {options: &BackendOptions{}, metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}},
+		"down":    {options: &BackendOptions{}, metrics: pulse.Metrics{Status: pulse.StatusDown, Health: 0.5}},
+		"drained": {options: &BackendOptions{}, metrics: pulse.Metrics{Status: pulse.StatusDown}, drained: true},
+	}
+
+	info := vs.CalcServiceStat()
+	assert.Equal(t, 0.75, info.Health, "drained backends don't drag health down")
+	assert.Equal(t, BackendStatuses{Up: 1, Down: 1, Disabled: 1}, info.BackendStatuses)
+
+	// health of backends is weighted by their share of traffic
+	vs.activeColor, vs.previousColor, vs.switchProgress = "green", "blue", 0.75
+	vs.backends["up"].options.Color = "green"
+	vs.backends["down"].options.Color = "blue"
+	assert.Equal(t, 0.875, vs.CalcServiceStat().Health)
+
+	vs.backends = map[string]*Backend{"drained": vs.backends["drained"]}
+	assert.Equal(t, 0.0, vs.CalcServiceStat().Health, "service without enabled backends isn't healthy")
+}
+
+func TestDrainBackend(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.deleteGracePeriod = time.Hour
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	weight := func() int32 {
+		pool, err := c.GetPoolForService(c.services[vsID].svc)
+		require.NoError(t, err)
+		return pool.Dests[0].Weight
+	}
+
+	assert.ErrorIs(t, c.DrainBackend(vsID, "unknown", Precondition{}), ErrObjectNotFound)
+	require.NoError(t, c.DrainBackend(vsID, rsID, Precondition{}))
+	require.NoError(t, c.DrainBackend(vsID, rsID, Precondition{}))
+	assert.Equal(t, int32(0), weight())
+	info, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.True(t, info.Drained)
+
+	// health checks don't bring drained backends back
+	stash := make(map[pulse.ID]int32)
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID},
+		Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, int32(0), weight())
+
+	// neither does restoring the deleted service
+	require.NoError(t, c.DeleteService(vsID, Precondition{}))
+	require.NoError(t, c.RestoreService(vsID, Precondition{}))
+	assert.Equal(t, int32(0), weight())
+
+	require.NoError(t, c.EnableBackend(vsID, rsID, Precondition{}))
+	assert.Equal(t, int32(100), weight())
+	info, err = c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.False(t, info.Drained)
+}
+
+func TestEvents(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.eventHistory = 3
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", vsID).Return(nil)
+	defer close(c.stopCh)
+
+	_, err := c.Events(vsID)
+	assert.True(t, errors.Is(err, ErrObjectNotFound))
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}))
+	require.NoError(t, c.CreateBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}))
+	_, err = c.RemoveBackend(vsID, rsID)
+	require.NoError(t, err)
+
+	events, err := c.Events(vsID)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, EventCreated, events[0].Type)
+	assert.Equal(t, EventBackendAdded, events[1].Type)
+	assert.Equal(t, rsID, events[1].RsID)
+	assert.Equal(t, EventBackendRemoved, events[2].Type)
+
+	_, err = c.RemoveService(vsID)
+	require.NoError(t, err)
+	events, err = c.Events(vsID)
+	require.NoError(t, err, "history of removed service is kept")
+	require.Len(t, events, 3)
+	assert.Equal(t, EventBackendAdded, events[0].Type)
+	assert.Equal(t, EventRemoved, events[2].Type)
+
+	// history of services removed long ago is dropped
+	for i := range removedEventHistories {
+		removed := fmt.Sprintf("removed-%d", i)
+		c.events[removed] = []ServiceEvent{{Type: EventRemoved}}
+		c.removedEvents = append(c.removedEvents, removed)
+	}
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}}))
+	_, err = c.RemoveService(vsID)
+	require.NoError(t, err)
+	assert.Len(t, c.events, removedEventHistories)
+	_, err = c.Events("removed-0")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = c.Events(vsID)
+	assert.NoError(t, err, "history of the service removed again is kept")
+}
+
+func TestAlerts(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	options := &ServiceOptions{Port: 80, Host: "localhost",
+		Alerts: []AlertRule{{Metric: "unknown", Operator: "<", Threshold: 2}}}
+	assert.ErrorIs(t, options.Validate(nil), ErrUnknownAlertMetric)
+
+	options.Alerts = []AlertRule{{Metric: AlertMetricHealthyBackends, Operator: "<", Threshold: 2}}
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: options, ServiceBackends: map[string]*BackendOptions{
+		"a": {Host: "127.0.0.2", Port: 8080},
+		"b": {Host: "127.0.0.3", Port: 8080},
+	}}))
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"healthy_backends < 2": false}, service.Alerts)
+
+	_, err = c.RemoveBackend(vsID, "a")
+	require.NoError(t, err)
+	service, err = c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"healthy_backends < 2": true}, service.Alerts)
+}
+
+func TestServiceStatus(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	c.eventHistory = 10
+	defer close(c.stopCh)
+
+	options := &ServiceOptions{Port: 80, Host: "localhost", StatusThresholds: &StatusThresholds{Degraded: 0.5, Down: 0.6}}
+	assert.ErrorIs(t, options.Validate(nil), ErrInvalidStatusThresholds)
+
+	options.StatusThresholds = &StatusThresholds{Down: 0.25}
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: options, ServiceBackends: map[string]*BackendOptions{
+		"a": {Host: "127.0.0.2", Port: 8080},
+		"b": {Host: "127.0.0.3", Port: 8080},
+		"c": {Host: "127.0.0.4", Port: 8080},
+		"d": {Host: "127.0.0.5", Port: 8080},
+	}}))
+	service, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, ServiceHealthy, service.Status)
+
+	vs := c.services[vsID]
+	for _, step := range []struct {
+		rsID   string
+		status pulse.StatusType
+		want   ServiceStatus
+	}{
+		{"a", pulse.StatusDown, ServiceDegraded},
+		{"b", pulse.StatusDown, ServiceDegraded},
+		{"c", pulse.StatusDown, ServiceDown},
+		{"c", pulse.StatusUp, ServiceDegraded},
+	} {
+		vs.backends[step.rsID].metrics.Status = step.status
+		c.evaluateStatus(vs)
+		service, err = c.GetService(vsID)
+		require.NoError(t, err)
+		assert.Equal(t, step.want, service.Status)
+	}
+
+	events, err := c.Events(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, EventStatusChanged, events[len(events)-1].Type)
+}
+
+func TestDiscoStatus(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", vsID).Return(nil)
+	defer close(c.stopCh)
+
+	options := &ServiceOptions{Port: 80, Host: "localhost", DiscoStatus: ServiceDown}
+	assert.ErrorIs(t, options.Validate(nil), ErrUnknownDiscoStatus)
+
+	options.DiscoStatus = ServiceDegraded
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: options, ServiceBackends: map[string]*BackendOptions{
+		"a": {Host: "127.0.0.2", Port: 8080},
+		"b": {Host: "127.0.0.3", Port: 8080},
+	}}))
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Expose", 1)
+
+	// the service is removed from discovery while it's down
+	vs := c.services[vsID]
+	vs.backends["a"].metrics.Status = pulse.StatusDown
+	vs.backends["b"].metrics.Status = pulse.StatusDown
+	c.evaluateStatus(vs)
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Remove", 1)
+
+	vs.backends["a"].metrics.Status = pulse.StatusUp
+	c.evaluateStatus(vs)
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Expose", 2)
+
+	_, err := c.RemoveService(vsID)
+	require.NoError(t, err)
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Remove", 2)
+}
+
+func TestDNSRecords(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	for vsID, port := range map[string]uint16{"http": 80, "https": 443} {
+		require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+			ServiceOptions:  &ServiceOptions{Port: port, Host: "localhost", DNSName: "Web.LB."},
+			ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2", Port: 8080}},
+		}))
+	}
+
+	// services on the same VIP give a single record
+	records, exists := c.DNSRecords("web.lb.")
+	assert.True(t, exists)
+	require.Len(t, records, 1)
+	assert.Equal(t, "127.0.0.1", records[0].IP.String())
+	assert.Equal(t, int32(200), records[0].Weight)
+
+	for _, vsID := range []string{"http", "https"} {
+		c.services[vsID].backends["a"].metrics.Status = pulse.StatusDown
+	}
+	records, exists = c.DNSRecords("web.lb")
+	assert.True(t, exists)
+	assert.Empty(t, records)
+
+	_, exists = c.DNSRecords("api.lb.")
+	assert.False(t, exists)
+}
+
+func TestTracedSync(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.ipvs = &tracedIpvs{Ipvs: c.ipvs, ctx: c}
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "store.sync")
+	_, err := c.synchronize(ctx, map[string]*ServiceConfig{
+		vsID: {ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"}},
+	})
+	require.NoError(t, err)
+	span.End()
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Contains(t, spans, "sync.create")
+	require.Contains(t, spans, "ipvs.AddService")
+	assert.Equal(t, spans["store.sync"].SpanContext().SpanID(), spans["sync.create"].Parent().SpanID())
+	assert.Equal(t, spans["sync.create"].SpanContext().SpanID(), spans["ipvs.AddService"].Parent().SpanID())
+}
+
+func TestUnknownVipInterface(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	defer close(c.stopCh)
+
+	err := c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", VipInterface: "eth1"},
+	})
+	assert.ErrorIs(t, err, ErrUnknownVipInterface)
+	_, err = c.GetService(vsID)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	pools, err := c.ipvs.GetPools()
+	require.NoError(t, err)
+	assert.Empty(t, pools)
+}
+
+func TestSharedVipHandover(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.vipInterface = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lo-test"}}
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	for _, port := range []uint16{80, 443} {
+		require.NoError(t, c.CreateService(fmt.Sprintf("web-%d", port), &ServiceConfig{
+			ServiceOptions: &ServiceOptions{Port: port, Host: "localhost"},
+		}))
+	}
+	// the dummy link doesn't exist, so the owner is set as if the VIP was added
+	c.services["web-80"].options.delIfAddr = true
+	c.services["web-80"].options.vipAdopted = true
+
+	_, err := c.RemoveService("web-80")
+	require.NoError(t, err)
+	assert.True(t, c.services["web-443"].options.delIfAddr)
+	assert.True(t, c.services["web-443"].options.vipAdopted)
+}
+
+func TestDeferredVip(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.vipInterface = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lo-test"}}
+	c.coldStart = true
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	_, err := c.Synchronize(map[string]*ServiceConfig{vsID: {
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 80}},
+	}})
+	require.NoError(t, err)
+	assert.True(t, c.services[vsID].vipDeferred)
+	assert.False(t, c.coldStart)
+
+	stash := make(map[pulse.ID]int32)
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.True(t, c.services[vsID].vipDeferred)
+	c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID}, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.False(t, c.services[vsID].vipDeferred)
+
+	// services created after the first synchronization get their VIPs at once
+	require.NoError(t, c.CreateService("web", &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 443, Host: "localhost"}}))
+	assert.False(t, c.services["web"].vipDeferred)
+}
+
+func TestSorryServer(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.ErrorIs(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", SorryServer: "[::1]:8080"},
+	}), ErrInvalidSorryServer)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost", SorryServer: "127.0.0.9:8080"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	assert.ErrorIs(t, c.CreateBackend(vsID, "sorry", &BackendOptions{Host: "127.0.0.9", Port: 8080}), ErrDuplicateBackend)
+
+	dests := func() []string {
+		pool, err := c.GetPoolForService(c.services[vsID].svc)
+		require.NoError(t, err)
+		var dests []string
+		for _, dest := range pool.Dests {
+			dests = append(dests, fmt.Sprintf("%s:%d/%d", dest.IP, dest.Port, dest.Weight))
+		}
+		return dests
+	}
+	assert.Equal(t, []string{"127.0.0.2:8080/100"}, dests())
+
+	stash := make(map[pulse.ID]int32)
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.ElementsMatch(t, []string{"127.0.0.2:8080/0", "127.0.0.9:8080/1"}, dests())
+	info, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.True(t, info.SorryServerActive)
+
+	report, err := c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Empty(t, report.Extra)
+
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, []string{"127.0.0.2:8080/100"}, dests())
+	assert.False(t, c.services[vsID].sorryActive)
+}
+
+func TestFailover(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", Failover: &FailoverOptions{}},
+		ServiceBackends: map[string]*BackendOptions{
+			"primary": {Host: "127.0.0.2", Port: 8080, Priority: 10},
+			"standby": {Host: "127.0.0.3", Port: 8080, Priority: 5},
+		},
+	}))
+	weights := func() map[string]int32 {
+		weights := make(map[string]int32)
+		for rsID, rs := range c.services[vsID].backends {
+			weights[rsID] = rs.options.weight
+		}
+		return weights
+	}
+	assert.Equal(t, map[string]int32{"primary": 0, "standby": 0}, weights())
+
+	stash := make(map[pulse.ID]int32)
+	c.applyWeights(stash, vsID)
+	assert.Equal(t, map[string]int32{"primary": 100, "standby": 0}, weights())
+
+	// the standby is promoted on failure of the primary
+	primary := pulse.ID{VsID: vsID, RsID: "primary"}
+	c.processPulseUpdate(stash, pulse.Update{Source: primary, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Equal(t, map[string]int32{"primary": 0, "standby": 100}, weights())
+	info, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, "standby", info.FailoverBackend)
+
+	// without preemption the recovered primary stays idle
+	c.processPulseUpdate(stash, pulse.Update{Source: primary, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, map[string]int32{"primary": 0, "standby": 100}, weights())
+
+	c.services[vsID].options.Failover.Preempt = true
+	c.processPulseUpdate(stash, pulse.Update{Source: primary, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, map[string]int32{"primary": 100, "standby": 0}, weights())
+}
+
+func TestDropDownBackends(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.ErrorIs(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", DownBackends: "remove"},
+	}), ErrUnknownDownBackends)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost", DownBackends: DownBackendsDrop},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	dests := func() int {
+		pool, err := c.GetPoolForService(c.services[vsID].svc)
+		require.NoError(t, err)
+		return len(pool.Dests)
+	}
+
+	stash := make(map[pulse.ID]int32)
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Equal(t, 0, dests())
+	info, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.True(t, info.Dropped)
+	report, err := c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Empty(t, report.Missing)
+
+	// the destination is added back with the stashed weight on recovery
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	assert.Equal(t, 1, dests())
+	assert.False(t, c.services[vsID].backends[rsID].dropped)
+	assert.Equal(t, int32(100), c.services[vsID].backends[rsID].options.weight)
+
+	// dropped backends are removed without touching IPVS
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	_, err = c.RemoveBackend(vsID, rsID)
+	require.NoError(t, err)
+}
+
+func TestHoldWeights(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	weight := func() int32 {
+		pool, err := c.GetPoolForService(c.services[vsID].svc)
+		require.NoError(t, err)
+		return pool.Dests[0].Weight
+	}
+	stash := make(map[pulse.ID]int32)
+	update := func(status pulse.StatusType) {
+		c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: vsID, RsID: rsID},
+			Metrics: pulse.Metrics{Status: status, Health: 1}})
+	}
+
+	assert.ErrorIs(t, c.HoldWeights("unknown", Precondition{}), ErrObjectNotFound)
+	require.NoError(t, c.HoldWeights(vsID, Precondition{}))
+	require.NoError(t, c.HoldWeights(vsID, Precondition{}))
+	info, err := c.GetService(vsID)
+	require.NoError(t, err)
+	assert.True(t, info.WeightsHeld)
+
+	// metrics are still collected, but weights are kept
+	update(pulse.StatusDown)
+	assert.Equal(t, int32(100), weight())
+	backend, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.Equal(t, pulse.StatusDown, backend.Metrics.Status)
+	assert.Empty(t, stash)
+
+	require.NoError(t, c.ReleaseWeights(vsID, Precondition{}))
+	update(pulse.StatusDown)
+	assert.Equal(t, int32(0), weight())
+	update(pulse.StatusUp)
+	assert.Equal(t, int32(100), weight())
+	info, err = c.GetService(vsID)
+	require.NoError(t, err)
+	assert.False(t, info.WeightsHeld)
+}
+
+func TestStash(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.3", Port: 8080},
+		},
+	}))
+	go c.run()
+	defer close(c.stopCh)
+	assert.Empty(t, c.Stash())
+
+	require.True(t, c.pulses.Push(pulse.Update{Source: pulse.ID{VsID: vsID, RsID: "b"},
+		Metrics: pulse.Metrics{Status: pulse.StatusDown}}))
+	var stash []StashedBackend
+	require.Eventually(t, func() bool {
+		stash = c.Stash()
+		return len(stash) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "b", stash[0].RsID)
+	assert.Equal(t, int32(100), stash[0].Weight)
+	assert.Equal(t, int32(0), stash[0].CurrentWeight)
+	assert.Equal(t, "Down", stash[0].Status)
+	assert.WithinDuration(t, time.Now(), stash[0].StashedAt, time.Second)
+
+	require.True(t, c.pulses.Push(pulse.Update{Source: pulse.ID{VsID: vsID, RsID: "b"},
+		Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}}))
+	require.Eventually(t, func() bool {
+		return len(c.Stash()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPulsesPausedDuringSync(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	go c.run()
+	defer close(c.stopCh)
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+
+	// a sync holds the mutex, updates are left in the queue meanwhile
+	c.pausePulses()
+	c.mutex.Lock()
+	require.True(t, c.pulses.Push(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}}))
+	require.True(t, c.pulses.Push(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 0.5}}))
+	time.Sleep(50 * time.Millisecond)
+	stats := c.pulses.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, uint64(1), stats.Coalesced)
+	c.mutex.Unlock()
+	c.resumePulses()
+
+	// only the latest update is applied
+	require.Eventually(t, func() bool {
+		return c.pulses.Stats().Processed == 1
+	}, time.Second, 10*time.Millisecond)
+	c.mutex.RLock()
+	assert.Equal(t, pulse.StatusUp, c.services[vsID].backends[rsID].metrics.Status)
+	assert.Equal(t, 0.5, c.services[vsID].backends[rsID].metrics.Health)
+	c.mutex.RUnlock()
+
+	// an update which has waited for the mutex is skipped if a newer one is queued
+	require.True(t, c.pulses.Push(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}}))
+	c.pausePulses()
+	c.processPulseUpdate(make(map[pulse.ID]int32), pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Equal(t, pulse.StatusUp, c.services[vsID].backends[rsID].metrics.Status)
+	c.resumePulses()
+	require.Eventually(t, func() bool {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return c.services[vsID].backends[rsID].metrics.Health == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSetStashedWeight(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	go c.run()
+	defer close(c.stopCh)
+
+	assert.Equal(t, ErrNotStashed, c.SetStashedWeight(vsID, rsID, 50, Precondition{}))
+	assert.ErrorIs(t, c.SetStashedWeight(vsID, "unknown", 50, Precondition{}), ErrObjectNotFound)
+
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	require.True(t, c.pulses.Push(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}}))
+	require.Eventually(t, func() bool {
+		return len(c.Stash()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, ErrInvalidStashedWeight, c.SetStashedWeight(vsID, rsID, 101, Precondition{}))
+	require.NoError(t, c.SetStashedWeight(vsID, rsID, 50, Precondition{}))
+	assert.Equal(t, int32(50), c.Stash()[0].Weight)
+
+	// the backend recovers to the overridden weight
+	require.True(t, c.pulses.Push(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}}))
+	require.Eventually(t, func() bool {
+		return len(c.Stash()) == 0
+	}, time.Second, 10*time.Millisecond)
+	pool, err := c.GetPoolForService(c.services[vsID].svc)
+	require.NoError(t, err)
+	assert.Equal(t, int32(50), pool.Dests[0].Weight)
+}
+
+func TestTrackStash(t *testing.T) {
+	a, b := pulse.ID{VsID: vsID, RsID: "a"}, pulse.ID{VsID: vsID, RsID: "b"}
+	start := time.Now()
+	stashedAt := map[pulse.ID]time.Time{a: start}
+	trackStash(map[pulse.ID]int32{b: 100}, stashedAt, start.Add(time.Minute))
+	assert.Equal(t, map[pulse.ID]time.Time{b: start.Add(time.Minute)}, stashedAt)
+	trackStash(map[pulse.ID]int32{b: 50}, stashedAt, start.Add(time.Hour))
+	assert.Equal(t, map[pulse.ID]time.Time{b: start.Add(time.Minute)}, stashedAt)
+}
+
+func TestServiceStates(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost", MaxWeight: 50},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	states := c.ServiceStates()
+	require.Len(t, states, 1)
+	assert.Equal(t, "127.0.0.1", states[0].Host)
+	assert.Equal(t, "tcp", states[0].Protocol)
+	assert.Equal(t, ServiceHealthy, states[0].Status)
+	assert.Equal(t, 1, states[0].HealthyBackends)
+	// in-memory IPVS reports zero counters of its services
+	assert.Equal(t, &IpvsStats{}, states[0].Traffic)
+	assert.Equal(t, []BackendState{{RsID: rsID, Host: "127.0.0.2", Port: 8080, Status: pulse.StatusUp, Weight: 50}},
+		states[0].Backends)
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"time"
+
 	"github.com/qk4l/gorb/pulse"
 	log "github.com/sirupsen/logrus"
 	"github.com/tehnerd/gnl2go"
@@ -11,8 +13,35 @@ type Backend struct {
 	rsID    string
 	options *BackendOptions
 	service *Service
-	monitor *pulse.Pulse
-	metrics pulse.Metrics
+	// unsubscribe detaches the backend from its shared pulse monitor
+	unsubscribe func()
+	metrics     pulse.Metrics
+	// version is a context revision of the last modification
+	version uint64
+
+	// hidden backends of deleted services or deleted backends get no traffic,
+	// restoreWeight is their weight before deletion
+	hidden        bool
+	restoreWeight int32
+	// deleteTimer removes deleted backend after the grace period
+	deleteTimer *time.Timer
+	deletedAt   time.Time
+	// weightMetrics are values of service weight metrics evaluated for the backend
+	weightMetrics map[string]float64
+	// dropped is set while the destination of the down backend is removed from IPVS
+	dropped bool
+	// drained backends are hidden until they are enabled
+	drained bool
+	// excluded backends are hidden by the backend filter of the service
+	excluded bool
+	// inactive backends are hidden and unmonitored until they are activated
+	inactive bool
+	// removalTimer removes backend gone from discovery after the removal delay
+	removalTimer *time.Timer
+	removalAt    time.Time
+	// leaseTimer removes self-registered backend missing heartbeats
+	leaseTimer   *time.Timer
+	leaseExpires time.Time
 }
 
 // UpdateWeight save new weight and return prev
@@ -34,9 +63,15 @@ func (rs *Backend) Cleanup() {
 		rs.rsID,
 	)
 
-	// Stop the pulse goroutine.
-	rs.monitor.Stop()
-
+	if rs.deleteTimer != nil {
+		rs.deleteTimer.Stop()
+	}
+	if rs.removalTimer != nil {
+		rs.removalTimer.Stop()
+	}
+	if rs.unsubscribe != nil {
+		rs.unsubscribe()
+	}
 }
 
 // Service VS entity of gorb
@@ -45,6 +80,33 @@ type Service struct {
 	options  *ServiceOptions
 	svc      gnl2go.Service
 	backends map[string]*Backend
+	// version is a context revision of the last modification
+	version uint64
+	// deleteTimer removes deleted service after the grace period
+	deleteTimer *time.Timer
+	deletedAt   time.Time
+	// firingAlerts are states of alerts keyed by their names
+	firingAlerts map[string]bool
+	// lastStatus is the service status reported the last time
+	lastStatus ServiceStatus
+	// exposed is set while the service is registered in discovery
+	exposed bool
+	// vipDeferred is set until the VIP is added after a backend is found healthy
+	vipDeferred bool
+	// sorryActive is set while the sorry server destination is inserted
+	sorryActive bool
+	// failoverActive is ID of the backend receiving traffic of a failover service
+	failoverActive string
+	// pins of client subnets to backends keyed by the subnets
+	pins map[string]*clientPin
+	// weightsHeld services keep weights of backends as is regardless of pulse
+	weightsHeld bool
+
+	// blue/green deployment state, see SwitchColor
+	activeColor    string
+	previousColor  string
+	switchProgress float64
+	switchCancel   chan struct{}
 }
 
 func (vs *Service) GetBackend(rsID string) (*Backend, bool) {
@@ -56,7 +118,76 @@ func (vs *Service) BackendExist(rsID string) bool {
 	if _, ok := vs.backends[rsID]; ok {
 		return true
 	}
-	return false
+	return len(vs.rangeMembers(rsID)) > 0
+}
+
+// healthy tells if the backend is up and could receive traffic.
+func (rs *Backend) healthy() bool {
+	return rs.metrics.Status == pulse.StatusUp && !rs.hidden && !rs.options.pending
+}
+
+// healthyBackends counts backends which are up and could receive traffic.
+func (vs *Service) healthyBackends() int {
+	healthy := 0
+	for _, rs := range vs.backends {
+		if rs.healthy() {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// statusBackends counts backends the service status is derived from, excluded,
+// inactive and undiscovered backends don't affect it.
+func (vs *Service) statusBackends() int {
+	counted := 0
+	for _, rs := range vs.backends {
+		if !rs.excluded && !rs.inactive && !rs.undiscovered() {
+			counted++
+		}
+	}
+	return counted
+}
+
+// disabled backends are taken out of traffic administratively, i.e. drained or deleted.
+func (rs *Backend) disabled() bool {
+	return rs.drained || rs.hidden
+}
+
+// undiscovered backends of ranges haven't passed a health check yet, so there
+// might be nothing at their addresses.
+func (rs *Backend) undiscovered() bool {
+	return rs.options.rangeOf != nil && rs.options.pending
+}
+
+// health is the average health of backends weighted by the share of traffic they
+// get while healthy, so disabled backends and backends of inactive colors don't
+// drag it down. Service without such backends could not be healthy.
+func (vs *Service) health() float64 {
+	var health, total float64
+	for _, rs := range vs.backends {
+		if rs.disabled() || rs.undiscovered() {
+			continue
+		}
+		weight := float64(vs.options.MaxWeight) * vs.colorFactor(rs.options.Color)
+		health += rs.GetHealth() * weight
+		total += weight
+	}
+	if total == 0 {
+		return 0
+	}
+	return health / total
+}
+
+// backendByAddress returns ID of the backend with the address, empty if there is none.
+func (vs *Service) backendByAddress(ip string, port uint16) string {
+	for _, rsID := range sortedKeys(vs.backends) {
+		options := vs.backends[rsID].options
+		if options.host.String() == ip && options.Port == port {
+			return rsID
+		}
+	}
+	return ""
 }
 
 // CreateBackend registers a new backend in the virtual service.
@@ -69,11 +200,7 @@ func (vs *Service) CreateBackend(rsID string, opts *BackendOptions) error {
 		rsID,
 		vs.vsID)
 
-	p, err := pulse.New(opts.host.String(), opts.Port, vs.options.Pulse)
-	if err != nil {
-		return err
-	}
-	vs.backends[rsID] = &Backend{options: opts, service: vs, monitor: p}
+	vs.backends[rsID] = &Backend{rsID: rsID, options: opts, service: vs}
 
 	return nil
 }
@@ -92,34 +219,81 @@ func (vs *Service) RemoveBackend(rsID string) (*BackendOptions, error) {
 
 // Cleanup remove service backends, gracefully stops backend monitoring
 func (vs *Service) Cleanup() {
+	vs.cancelSwitch()
+	if vs.deleteTimer != nil {
+		vs.deleteTimer.Stop()
+	}
 	for rsID, backend := range vs.backends {
 		log.Infof("cleaning up now orphaned backend [%s/%s]", vs.vsID, rsID)
 
-		// Stop the pulse goroutine.
-		backend.monitor.Stop()
+		if backend.deleteTimer != nil {
+			backend.deleteTimer.Stop()
+		}
+		// Detach from the pulse goroutine.
+		if backend.unsubscribe != nil {
+			backend.unsubscribe()
+		}
 
 		delete(vs.backends, rsID)
 	}
 }
 
+// config returns current service configuration with its backends
+func (vs *Service) config() *ServiceConfig {
+	backends := make(map[string]*BackendOptions, len(vs.backends))
+	for rsID, rs := range vs.backends {
+		switch {
+		case rs.options.pool != "":
+			// backends of the pool are added with the service
+		case rs.options.rangeOf != nil:
+			// backends of the range are expanded from it
+			backends[rs.options.rangeOf.rsID] = rs.options.rangeOf.options
+		default:
+			backends[rsID] = rs.options
+		}
+	}
+	return &ServiceConfig{ServiceOptions: vs.options, ServiceBackends: backends}
+}
+
 func (vs *Service) CalcServiceStat() *ServiceInfo {
 	status := &ServiceInfo{
 		Options:       vs.options,
 		Backends:      make([]string, 0, len(vs.backends)),
 		BackendsCount: uint16(len(vs.backends)),
 		FallBack:      vs.options.Fallback,
+		Version:       vs.version,
+		Group:         vs.options.group,
+	}
+	if !vs.deletedAt.IsZero() {
+		status.DeletedAt = &vs.deletedAt
+	}
+	if len(vs.options.Alerts) > 0 {
+		status.Alerts = make(map[string]bool, len(vs.options.Alerts))
+		for _, alert := range vs.options.Alerts {
+			status.Alerts[alert.Name] = vs.firingAlerts[alert.Name]
+		}
+	}
+	if vs.activeColor != "" {
+		status.ActiveColor = vs.activeColor
+		status.SwitchProgress = vs.switchProgress
 	}
 
-	if status.BackendsCount != 0 {
-		// Calculate backends health
-		for rsKey, rs := range vs.backends {
-			status.Health += rs.GetHealth()
-			status.Backends = append(status.Backends, rsKey)
+	status.HealthyBackends = uint16(vs.healthyBackends())
+	status.SorryServerActive = vs.sorryActive
+	status.FailoverBackend = vs.failoverActive
+	status.WeightsHeld = vs.weightsHeld
+	status.Status = vs.status()
+	status.Health = vs.health()
+	for rsKey, rs := range vs.backends {
+		status.Backends = append(status.Backends, rsKey)
+		switch {
+		case rs.disabled():
+			status.BackendStatuses.Disabled++
+		case rs.metrics.Status == pulse.StatusUp:
+			status.BackendStatuses.Up++
+		default:
+			status.BackendStatuses.Down++
 		}
-		status.Health /= float64(status.BackendsCount)
-	} else {
-		// Service without backends could not be healthy
-		status.Health = 0.0
 	}
 	return status
 }
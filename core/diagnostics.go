@@ -0,0 +1,295 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+)
+
+// DuplicatesReport lists objects sharing the same address and IPVS entries not owned by GORB.
+type DuplicatesReport struct {
+	// Services sharing the same VIP, port and protocol keyed by "vip:port/protocol"
+	Services map[string][]string `json:"services"`
+	// Backends sharing the same address across services keyed by "ip:port", values are "vsID/rsID"
+	Backends map[string][]string `json:"backends"`
+	// StaleServices IPVS services not owned by any GORB service, "vip:port/protocol"
+	StaleServices []string `json:"stale_services"`
+	// StaleBackends IPVS destinations of GORB services not owned by any backend, "vsID/ip:port"
+	StaleBackends []string `json:"stale_backends"`
+}
+
+func protocolName(protocol uint16) string {
+	switch protocol {
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	}
+	return fmt.Sprint(protocol)
+}
+
+func serviceAddress(vip string, port uint16, protocol uint16) string {
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(vip, fmt.Sprint(port)), protocolName(protocol))
+}
+
+// serviceByAddress returns the service owning IPVS service, nil if there is none.
+// Context mutex must be held.
+func (ctx *Context) serviceByAddress(svc gnl2go.Service) *Service {
+	key := newPoolKey(svc).address()
+	for _, vsID := range sortedKeys(ctx.services) {
+		if newPoolKey(ctx.services[vsID].svc).address() == key {
+			return ctx.services[vsID]
+		}
+	}
+	return nil
+}
+
+// Duplicates reports services and backends sharing the same address
+// and IPVS entries left behind or created outside of GORB.
+func (ctx *Context) Duplicates() (*DuplicatesReport, error) {
+	pools, err := ctx.ipvs.GetPools()
+	if err != nil {
+		log.Errorf("failed to get pools from IPVS: %s", err)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	report := &DuplicatesReport{
+		Services:      make(map[string][]string),
+		Backends:      make(map[string][]string),
+		StaleServices: []string{},
+		StaleBackends: []string{},
+	}
+	services := make(map[string][]string)
+	backends := make(map[string][]string)
+	backendServices := make(map[string]map[string]bool)
+	// owners of IPVS destinations keyed by service address and destination address
+	owned := make(map[string]map[string]bool)
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		address := serviceAddress(vs.options.host.String(), vs.options.Port, vs.options.protocol)
+		services[address] = append(services[address], vsID)
+		if owned[address] == nil {
+			owned[address] = make(map[string]bool)
+		}
+		if vs.sorryActive {
+			owned[address][net.JoinHostPort(vs.options.sorryHost.String(), fmt.Sprint(vs.options.sorryPort))] = true
+		}
+		for _, rsID := range sortedKeys(vs.backends) {
+			options := vs.backends[rsID].options
+			dest := net.JoinHostPort(options.host.String(), fmt.Sprint(options.Port))
+			owned[address][dest] = true
+			backends[dest] = append(backends[dest], fmt.Sprintf("%s/%s", vsID, rsID))
+			if backendServices[dest] == nil {
+				backendServices[dest] = make(map[string]bool)
+			}
+			backendServices[dest][vsID] = true
+		}
+	}
+	for address, ids := range services {
+		if len(ids) > 1 {
+			report.Services[address] = ids
+		}
+	}
+	for dest, ids := range backends {
+		if len(backendServices[dest]) > 1 {
+			report.Backends[dest] = ids
+		}
+	}
+
+	for _, pool := range pools {
+		if vs, _ := ctx.pinByMark(pool.Service.FWMark); vs != nil {
+			continue
+		}
+		address := serviceAddress(pool.Service.VIP, pool.Service.Port, pool.Service.Proto)
+		dests, exists := owned[address]
+		if !exists {
+			report.StaleServices = append(report.StaleServices, address)
+			continue
+		}
+		for _, dest := range pool.Dests {
+			if !dests[net.JoinHostPort(dest.IP, fmt.Sprint(dest.Port))] {
+				report.StaleBackends = append(report.StaleBackends,
+					fmt.Sprintf("%s/%s", services[address][0], net.JoinHostPort(dest.IP, fmt.Sprint(dest.Port))))
+			}
+		}
+	}
+	sort.Strings(report.StaleServices)
+	sort.Strings(report.StaleBackends)
+	return report, nil
+}
+
+// IpvsTableService is an IPVS service as seen by the kernel.
+type IpvsTableService struct {
+	VIP       string `json:"vip"`
+	Port      uint16 `json:"port"`
+	Protocol  string `json:"protocol"`
+	FWMark    uint32 `json:"fwmark,omitempty"`
+	Scheduler string `json:"scheduler"`
+	Flags     uint32 `json:"flags"`
+	// VsID of the GORB service owning the entry, empty if it isn't managed by GORB
+	VsID         string          `json:"vs_id,omitempty"`
+	Destinations []IpvsTableDest `json:"destinations"`
+}
+
+// IpvsTableDest is an IPVS destination as seen by the kernel.
+type IpvsTableDest struct {
+	IP     string `json:"ip"`
+	Port   uint16 `json:"port"`
+	Weight int32  `json:"weight"`
+	// RsID of the GORB backend owning the entry, empty if it isn't managed by GORB
+	RsID string `json:"rs_id,omitempty"`
+}
+
+// IpvsTable returns actual IPVS services and destinations including ones not managed by GORB.
+func (ctx *Context) IpvsTable() ([]IpvsTableService, error) {
+	pools, err := ctx.ipvs.GetPools()
+	if err != nil {
+		log.Errorf("failed to get pools from IPVS: %s", err)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	table := make([]IpvsTableService, 0, len(pools))
+	for _, pool := range pools {
+		service := IpvsTableService{
+			VIP:          pool.Service.VIP,
+			Port:         pool.Service.Port,
+			Protocol:     protocolName(pool.Service.Proto),
+			FWMark:       pool.Service.FWMark,
+			Scheduler:    pool.Service.Sched,
+			Destinations: make([]IpvsTableDest, 0, len(pool.Dests)),
+		}
+		if len(pool.Service.Flags) >= 4 {
+			service.Flags = binary.LittleEndian.Uint32(pool.Service.Flags)
+		}
+		vs := ctx.serviceByAddress(pool.Service)
+		pinned, pin := ctx.pinByMark(pool.Service.FWMark)
+		if pinned != nil {
+			vs = pinned
+		}
+		if vs != nil {
+			service.VsID = vs.vsID
+		}
+		for _, dest := range pool.Dests {
+			tableDest := IpvsTableDest{IP: dest.IP, Port: dest.Port, Weight: dest.Weight}
+			if pin != nil {
+				tableDest.RsID = pin.rsID
+			} else if vs != nil {
+				tableDest.RsID = vs.backendByAddress(dest.IP, dest.Port)
+				if tableDest.RsID == "" && vs.sorryActive && vs.options.isSorryServer(net.ParseIP(dest.IP), dest.Port) {
+					tableDest.RsID = sorryServerID
+				}
+			}
+			service.Destinations = append(service.Destinations, tableDest)
+		}
+		table = append(table, service)
+	}
+	return table, nil
+}
+
+// DriftEntry is a difference between GORB services and IPVS.
+type DriftEntry struct {
+	VsID    string `json:"vs_id,omitempty"`
+	RsID    string `json:"rs_id,omitempty"`
+	Address string `json:"address"`
+	// Field, Expected and Actual are set for modified entries only
+	Field    string `json:"field,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// DriftReport lists differences between GORB services and IPVS.
+type DriftReport struct {
+	// Missing GORB services and backends without IPVS entries
+	Missing []DriftEntry `json:"missing"`
+	// Extra IPVS entries not owned by GORB services and backends
+	Extra []DriftEntry `json:"extra"`
+	// Modified IPVS entries differing from GORB services and backends
+	Modified []DriftEntry `json:"modified"`
+}
+
+// IpvsDrift compares GORB services with actual IPVS table without changing anything.
+func (ctx *Context) IpvsDrift() (*DriftReport, error) {
+	pools, err := ctx.ipvs.GetPools()
+	if err != nil {
+		log.Errorf("failed to get pools from IPVS: %s", err)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	report := &DriftReport{Missing: []DriftEntry{}, Extra: []DriftEntry{}, Modified: []DriftEntry{}}
+	// pools are matched to services the way serviceByAddress does
+	indexes := make(map[poolKey]int, len(pools))
+	for i, pool := range pools {
+		indexes[newPoolKey(pool.Service).address()] = i
+	}
+	owned := make(map[int]bool, len(pools))
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		address := serviceAddress(vs.options.host.String(), vs.options.Port, vs.options.protocol)
+		index, exists := indexes[newPoolKey(vs.svc).address()]
+		if !exists {
+			report.Missing = append(report.Missing, DriftEntry{VsID: vsID, Address: address})
+			for _, rsID := range sortedKeys(vs.backends) {
+				options := vs.backends[rsID].options
+				report.Missing = append(report.Missing, DriftEntry{VsID: vsID, RsID: rsID,
+					Address: net.JoinHostPort(options.host.String(), fmt.Sprint(options.Port))})
+			}
+			continue
+		}
+		owned[index] = true
+		pool := pools[index]
+		if pool.Service.Sched != vs.svc.Sched {
+			report.Modified = append(report.Modified, DriftEntry{VsID: vsID, Address: address,
+				Field: "scheduler", Expected: vs.svc.Sched, Actual: pool.Service.Sched})
+		}
+
+		dests := make(map[string]gnl2go.Dest, len(pool.Dests))
+		for _, dest := range pool.Dests {
+			dests[net.JoinHostPort(dest.IP, fmt.Sprint(dest.Port))] = dest
+		}
+		if vs.sorryActive {
+			delete(dests, net.JoinHostPort(vs.options.sorryHost.String(), fmt.Sprint(vs.options.sorryPort)))
+		}
+		for _, rsID := range sortedKeys(vs.backends) {
+			options := vs.backends[rsID].options
+			destAddress := net.JoinHostPort(options.host.String(), fmt.Sprint(options.Port))
+			dest, exists := dests[destAddress]
+			if !exists && vs.backends[rsID].dropped {
+				continue
+			}
+			if !exists {
+				report.Missing = append(report.Missing, DriftEntry{VsID: vsID, RsID: rsID, Address: destAddress})
+				continue
+			}
+			delete(dests, destAddress)
+			if dest.Weight != options.weight {
+				report.Modified = append(report.Modified, DriftEntry{VsID: vsID, RsID: rsID, Address: destAddress,
+					Field: "weight", Expected: fmt.Sprint(options.weight), Actual: fmt.Sprint(dest.Weight)})
+			}
+		}
+		for _, destAddress := range sortedKeys(dests) {
+			report.Extra = append(report.Extra, DriftEntry{VsID: vsID, Address: destAddress})
+		}
+	}
+
+	for i, pool := range pools {
+		if vs, _ := ctx.pinByMark(pool.Service.FWMark); !owned[i] && vs == nil {
+			report.Extra = append(report.Extra,
+				DriftEntry{Address: serviceAddress(pool.Service.VIP, pool.Service.Port, pool.Service.Proto)})
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"net"
+	"strings"
+)
+
+// DNSRecord is a VIP a DNS name of services resolves to.
+type DNSRecord struct {
+	IP net.IP
+	// Weight is a total weight of backends of services on the VIP.
+	Weight int32
+}
+
+func normalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// DNSRecords returns VIPs of services with the DNS name which aren't down and have
+// backends receiving traffic. Exists is false if no service has the name.
+func (ctx *Context) DNSRecords(name string) (records []DNSRecord, exists bool) {
+	name = normalizeDNSName(name)
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	// services on different ports of the same VIP give a single record
+	index := make(map[string]int)
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		if vs.options.DNSName == "" || vs.options.DNSName != name {
+			continue
+		}
+		exists = true
+		if !vs.deletedAt.IsZero() || vs.status() == ServiceDown {
+			continue
+		}
+		var weight int32
+		for _, rs := range vs.backends {
+			if !rs.hidden {
+				weight += rs.options.weight
+			}
+		}
+		if weight <= 0 {
+			continue
+		}
+		ip := vs.options.host.String()
+		if i, ok := index[ip]; ok {
+			records[i].Weight += weight
+			continue
+		}
+		index[ip] = len(records)
+		records = append(records, DNSRecord{IP: vs.options.host, Weight: weight})
+	}
+	return records, exists
+}
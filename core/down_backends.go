@@ -0,0 +1,62 @@
+package core
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible handling of down backends.
+const (
+	// DownBackendsQuiescent keeps destinations of down backends with zero weight,
+	// so established connections are kept until they time out.
+	DownBackendsQuiescent = "quiescent"
+	// DownBackendsDrop removes destinations of down backends, so persistence
+	// templates and connections don't pin clients to them.
+	DownBackendsDrop = "drop"
+)
+
+// ErrUnknownDownBackends is returned if handling of down backends is unknown.
+var ErrUnknownDownBackends = errors.New("down backends must be quiescent or drop")
+
+func (o *ServiceOptions) validateDownBackends() error {
+	o.DownBackends = strings.ToLower(o.DownBackends)
+	switch o.DownBackends {
+	case "":
+		o.DownBackends = DownBackendsQuiescent
+	case DownBackendsQuiescent, DownBackendsDrop:
+	default:
+		return ErrUnknownDownBackends
+	}
+	return nil
+}
+
+// setDestWeight sets weight of the backend destination. Destinations of down
+// backends of drop services are removed instead of getting zero weight and
+// added back once they get weight again.
+func (ctx *Context) setDestWeight(vs *Service, rs *Backend, weight int32) error {
+	drop := vs.options.DownBackends == DownBackendsDrop && weight == 0 && rs.metrics.Status != pulse.StatusUp
+	rip, rport := rs.options.host.String(), rs.options.Port
+	switch {
+	case drop && rs.dropped:
+		return nil
+	case drop:
+		log.Infof("dropping destination of down backend [%s/%s]", vs.vsID, rs.rsID)
+		if err := ctx.ipvs.DelDestPort(vs.options.host.String(), vs.options.Port, rip, rport,
+			vs.options.protocol); err != nil {
+			return err
+		}
+		rs.dropped = true
+	case rs.dropped:
+		log.Infof("restoring destination of backend [%s/%s]", vs.vsID, rs.rsID)
+		if err := ctx.addDest(vs, rip, rport, weight); err != nil {
+			return err
+		}
+		rs.dropped = false
+	default:
+		return ctx.updateDest(rs, weight)
+	}
+	return nil
+}
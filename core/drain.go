@@ -0,0 +1,57 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// DrainBackend takes the backend out of traffic until it is enabled, keeping
+// established connections. Health checks go on, but don't bring it back.
+func (ctx *Context) DrainBackend(vsID, rsID string, pre Precondition) error {
+	return ctx.setBackendDrained(vsID, rsID, true, pre)
+}
+
+// EnableBackend brings the drained backend back to traffic with its previous weight.
+func (ctx *Context) EnableBackend(vsID, rsID string, pre Precondition) error {
+	return ctx.setBackendDrained(vsID, rsID, false, pre)
+}
+
+func (ctx *Context) setBackendDrained(vsID, rsID string, drained bool, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	rs, exists := vs.backends[rsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, rs.version); err != nil {
+		return err
+	}
+	if rs.drained == drained {
+		return nil
+	}
+
+	rs.drained = drained
+	if drained {
+		ctx.hideBackend(vs, rs)
+		ctx.recordEvent(vsID, rsID, EventDrained, "drained")
+		log.Infof("backend [%s/%s] has been drained", vsID, rsID)
+	} else {
+		// deleted backends stay hidden until they are restored, excluded ones for good
+		if rs.deleteTimer == nil && vs.deleteTimer == nil && !rs.excluded && !rs.inactive && rs.removalTimer == nil {
+			ctx.unhideBackend(vs, rs)
+		}
+		ctx.recordEvent(vsID, rsID, EventEnabled, "enabled")
+		log.Infof("backend [%s/%s] has been enabled", vsID, rsID)
+	}
+	ctx.evaluateStatus(vs)
+	if vs.options.Failover != nil {
+		go ctx.requestReweight(vsID)
+	}
+	ctx.revision++
+	rs.version = ctx.revision
+	return nil
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode is a stable machine-readable class of errors, so API clients could
+// handle errors without matching their messages.
+type ErrorCode string
+
+// Possible error codes.
+const (
+	CodeObjectNotFound     ErrorCode = "object_not_found"
+	CodeObjectExists       ErrorCode = "object_exists"
+	CodeConflict           ErrorCode = "conflict"
+	CodeValidationFailed   ErrorCode = "validation_failed"
+	CodePreconditionFailed ErrorCode = "precondition_failed"
+	CodeVersionRequired    ErrorCode = "version_required"
+	CodeIpvsError          ErrorCode = "ipvs_error"
+	CodeInternalError      ErrorCode = "internal_error"
+	CodeTimeout            ErrorCode = "timeout"
+)
+
+// errorCodes classify sentinel errors, errors not listed are validation errors.
+var errorCodes = []struct {
+	code ErrorCode
+	errs []error
+}{
+	{CodeObjectNotFound, []error{ErrObjectNotFound}},
+	{CodeObjectExists, []error{ErrObjectExists, ErrDuplicateBackend}},
+	{CodeConflict, []error{ErrPlanOutdated, ErrGroupMember, ErrPooledBackend, ErrRangeBackend, ErrPoolInUse, ErrSyncInProgress,
+		ErrNotRegistered, ErrNotStashed}},
+	{CodePreconditionFailed, []error{ErrPreconditionFailed}},
+	{CodeVersionRequired, []error{ErrVersionRequired}},
+	{CodeIpvsError, []error{ErrIpvsSyscallFailed}},
+	{CodeInternalError, []error{ErrConnLimitFailed, ErrPinFailed}},
+	{CodeTimeout, []error{ErrSyncTimeout}},
+}
+
+// ErrorCodeOf returns the code of the error, wrapped errors have codes of the
+// errors they wrap.
+func ErrorCodeOf(err error) ErrorCode {
+	for _, class := range errorCodes {
+		for _, target := range class.errs {
+			if errors.Is(err, target) {
+				return class.code
+			}
+		}
+	}
+	return CodeValidationFailed
+}
+
+// FieldError is a validation error of a field of options. Field is a path of the
+// field in JSON documents, e.g. "tunnel.port" or "service_backends.web-1.host".
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError attributes the error to the field, paths of nested field errors are
+// prefixed with the field.
+func fieldError(field string, err error) error {
+	if nested, ok := err.(*FieldError); ok {
+		return &FieldError{Field: field + "." + nested.Field, Err: nested.Err}
+	}
+	return &FieldError{Field: field, Err: err}
+}
+
+// ErrorField returns the field path of validation errors, it's empty for other errors.
+func ErrorField(err error) string {
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) {
+		return fieldErr.Field
+	}
+	return ""
+}
+
+// objectErr is an error about an object identified by its ID, e.g. a missing backend.
+type objectErr struct {
+	err  error
+	kind string
+	id   string
+}
+
+// objectError wraps the error with the kind and ID of the object, which are kept
+// as details of the error.
+func objectError(err error, kind, id string) error {
+	return &objectErr{err: err, kind: kind, id: id}
+}
+
+func (e *objectErr) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.err, e.kind, e.id)
+}
+
+func (e *objectErr) Unwrap() error {
+	return e.err
+}
+
+// detailKeys of object kinds differing from the kinds used in messages.
+var detailKeys = map[string]string{"vsID": "vs_id", "rsID": "rs_id"}
+
+// ErrorDetails returns IDs of objects the error is about keyed by their kinds,
+// e.g. {"vs_id": "web", "rs_id": "web-1"}, or nil if there are none.
+func ErrorDetails(err error) map[string]string {
+	var details map[string]string
+	for ; err != nil; err = errors.Unwrap(err) {
+		object, ok := err.(*objectErr)
+		if !ok {
+			continue
+		}
+		if details == nil {
+			details = make(map[string]string)
+		}
+		key, ok := detailKeys[object.kind]
+		if !ok {
+			key = object.kind
+		}
+		details[key] = object.id
+	}
+	return details
+}
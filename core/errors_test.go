@@ -0,0 +1,48 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCodeOf(t *testing.T) {
+	assert.Equal(t, CodeObjectNotFound, ErrorCodeOf(objectError(ErrObjectNotFound, "vsID", vsID)))
+	assert.Equal(t, CodeObjectExists, ErrorCodeOf(fmt.Errorf("%w: web-1", ErrDuplicateBackend)))
+	assert.Equal(t, CodeConflict, ErrorCodeOf(ErrPlanOutdated))
+	assert.Equal(t, CodeIpvsError, ErrorCodeOf(ErrIpvsSyscallFailed))
+	assert.Equal(t, CodeValidationFailed, ErrorCodeOf(ErrMissingEndpoint))
+	assert.Equal(t, CodeValidationFailed, ErrorCodeOf(errors.New("unknown")))
+}
+
+func TestErrorField(t *testing.T) {
+	err := (&ServiceOptions{Port: 80, Host: "localhost", Protocol: "sctp"}).Validate(nil)
+	assert.ErrorIs(t, err, ErrUnknownProtocol)
+	assert.Equal(t, "protocol", ErrorField(err))
+	assert.Equal(t, CodeValidationFailed, ErrorCodeOf(err))
+
+	err = (&BackendOptions{Host: "localhost"}).Validate()
+	assert.ErrorIs(t, err, ErrMissingEndpoint)
+	assert.Equal(t, "port", ErrorField(err))
+
+	err = fieldError("service_backends.web-1", fieldError("host", ErrMissingEndpoint))
+	assert.EqualError(t, err, "service_backends.web-1.host: endpoint information is missing")
+	assert.Equal(t, "service_backends.web-1.host", ErrorField(err))
+	assert.Empty(t, ErrorField(ErrObjectNotFound))
+}
+
+func TestErrorDetails(t *testing.T) {
+	c := newRoutineContext(map[string]*Service{vsID: {options: virtualService.options, backends: map[string]*Backend{}}}, nil)
+
+	_, err := c.GetService("missing")
+	assert.EqualError(t, err, "unable to locate specified object vsID: missing")
+	assert.Equal(t, map[string]string{"vs_id": "missing"}, ErrorDetails(err))
+
+	_, err = c.GetBackend(vsID, "missing")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.Equal(t, map[string]string{"rs_id": "missing"}, ErrorDetails(err))
+
+	assert.Nil(t, ErrorDetails(ErrObjectNotFound))
+}
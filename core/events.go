@@ -0,0 +1,107 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// removedEventHistories is a number of removed services whose history is kept,
+// so history of short-lived services doesn't pile up.
+const removedEventHistories = 1000
+
+// EventType is a kind of service lifecycle event.
+type EventType string
+
+// Possible service lifecycle events.
+const (
+	EventCreated        EventType = "created"
+	EventRemoved        EventType = "removed"
+	EventDeleted        EventType = "deleted"
+	EventRestored       EventType = "restored"
+	EventBackendAdded   EventType = "backend_added"
+	EventBackendRemoved EventType = "backend_removed"
+	EventHealthChanged  EventType = "health_changed"
+	EventSynced         EventType = "synced"
+	EventAlert          EventType = "alert"
+	EventStatusChanged  EventType = "status_changed"
+	EventFrozen         EventType = "frozen"
+	EventUnfrozen       EventType = "unfrozen"
+	EventSorryServer    EventType = "sorry_server"
+	EventFailover       EventType = "failover"
+	EventDrained        EventType = "drained"
+	EventEnabled        EventType = "enabled"
+	EventPinned         EventType = "pinned"
+	EventUnpinned       EventType = "unpinned"
+	EventWeightsHeld    EventType = "weights_held"
+	EventHoldReleased   EventType = "hold_released"
+	EventStashUpdated   EventType = "stash_updated"
+	EventRemovalDelayed EventType = "removal_delayed"
+	EventReturned       EventType = "returned"
+	EventActivated      EventType = "activated"
+	EventUpdated        EventType = "updated"
+)
+
+// ServiceEvent is a single lifecycle event of a service or its backend.
+type ServiceEvent struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// RsID is set for events of backends
+	RsID    string `json:"rs_id,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// recordEvent keeps the event in the service history, the oldest events are
+// dropped beyond the history size. Context mutex must be held.
+func (ctx *Context) recordEvent(vsID, rsID string, eventType EventType, format string, args ...interface{}) {
+	if ctx.eventHistory <= 0 {
+		return
+	}
+	if ctx.events == nil {
+		ctx.events = make(map[string][]ServiceEvent)
+	}
+	events := append(ctx.events[vsID], ServiceEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		RsID:    rsID,
+		Message: fmt.Sprintf(format, args...),
+	})
+	if len(events) > ctx.eventHistory {
+		events = append([]ServiceEvent(nil), events[len(events)-ctx.eventHistory:]...)
+	}
+	ctx.events[vsID] = events
+}
+
+// keepRemovedEvents keeps history of the removed service, dropping history of
+// services removed long ago beyond the limit. Context mutex must be held.
+func (ctx *Context) keepRemovedEvents(vsID string) {
+	if _, exists := ctx.events[vsID]; !exists {
+		return
+	}
+	ctx.removedEvents = append(slices.DeleteFunc(ctx.removedEvents, func(id string) bool {
+		return id == vsID
+	}), vsID)
+	for len(ctx.removedEvents) > removedEventHistories {
+		oldest := ctx.removedEvents[0]
+		ctx.removedEvents = ctx.removedEvents[1:]
+		// history of re-created services is kept along with them
+		if _, exists := ctx.services[oldest]; !exists {
+			delete(ctx.events, oldest)
+		}
+	}
+}
+
+// Events returns the last lifecycle events of the service, the oldest first.
+// History of recently removed services is kept, so their removal could be looked up too.
+func (ctx *Context) Events(vsID string) ([]ServiceEvent, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	events, exists := ctx.events[vsID]
+	if !exists {
+		if _, exists := ctx.services[vsID]; !exists {
+			return nil, objectError(ErrObjectNotFound, "vsID", vsID)
+		}
+	}
+	return append([]ServiceEvent{}, events...), nil
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+	"github.com/vishvananda/netlink"
+)
+
+// Possible connection expiry errors.
+var (
+	ErrConnExpiryFailed     = errors.New("error while enabling expiry of connections to failed backends")
+	ErrFlushConntrackMethod = errors.New("conntrack flushing requires nat forwarding method")
+)
+
+// expirySysctls make IPVS drop connections to removed destinations on their next
+// packet and expire persistence templates of quiescent destinations, so sticky
+// clients aren't pinned to a failed backend until the templates time out.
+var expirySysctls = []string{
+	"net.ipv4.vs.expire_nodest_conn",
+	"net.ipv4.vs.expire_quiescent_template",
+}
+
+// ConnDest is a destination of a virtual service connections are expired of.
+type ConnDest struct {
+	VIP      net.IP
+	Port     uint16
+	Protocol uint16
+	RIP      net.IP
+	RPort    uint16
+}
+
+// ConnExpirer removes connections to failed backends.
+type ConnExpirer interface {
+	// Enable sets up IPVS to expire connections and persistence templates
+	// of removed and quiescent destinations.
+	Enable() error
+	// Expire removes tracked connections to the destination and returns their number.
+	Expire(dest ConnDest) (uint, error)
+}
+
+// kernelConnExpirer manages IPVS sysctls and removes conntrack entries via netlink.
+type kernelConnExpirer struct{}
+
+// NewConnExpirer creates sysctl and conntrack based connection expirer used by default.
+func NewConnExpirer() ConnExpirer {
+	return kernelConnExpirer{}
+}
+
+func (kernelConnExpirer) Enable() error {
+	for _, name := range expirySysctls {
+		if err := util.SetSysctl(name, "1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kernelConnExpirer) Expire(dest ConnDest) (uint, error) {
+	filter, family, err := conntrackFilter(dest)
+	if err != nil {
+		return 0, err
+	}
+	return netlink.ConntrackDeleteFilters(netlink.ConntrackTable, family, filter)
+}
+
+// conntrackFilter matches connections to the VIP answered by the backend,
+// which is how IPVS NAT connections are tracked.
+func conntrackFilter(dest ConnDest) (*netlink.ConntrackFilter, netlink.InetFamily, error) {
+	family := netlink.InetFamily(syscall.AF_INET)
+	if dest.VIP.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	filter := &netlink.ConntrackFilter{}
+	if err := filter.AddIP(netlink.ConntrackOrigDstIP, dest.VIP); err != nil {
+		return nil, 0, err
+	}
+	if err := filter.AddIP(netlink.ConntrackReplySrcIP, dest.RIP); err != nil {
+		return nil, 0, err
+	}
+	if err := filter.AddProtocol(uint8(dest.Protocol)); err != nil {
+		return nil, 0, err
+	}
+	if err := filter.AddPort(netlink.ConntrackOrigDstPort, dest.Port); err != nil {
+		return nil, 0, err
+	}
+	return filter, family, nil
+}
+
+// validateFlushConntrack checks conntrack flushing is used by NAT services only,
+// connections of other services aren't tracked by the balancer.
+func (o *ServiceOptions) validateFlushConntrack() error {
+	if o.FlushConntrack && o.methodID != gnl2go.IPVS_MASQUERADING {
+		return ErrFlushConntrackMethod
+	}
+	return nil
+}
+
+// enableConnExpiry sets up IPVS to expire connections of failed backends of all services.
+func (ctx *Context) enableConnExpiry() error {
+	if err := ctx.connExpirer.Enable(); err != nil {
+		log.Errorf("unable to enable expiry of connections: %s", err)
+		return ErrConnExpiryFailed
+	}
+	ctx.connExpiry = true
+	return nil
+}
+
+// expireConns removes tracked connections to the backend which went down or was
+// removed, so clients reconnect to healthy backends at once instead of timing out.
+// Connections are removed if expiry is enabled for all services or the flush is
+// requested by the service.
+func (ctx *Context) expireConns(source string, dest ConnDest, flush bool) {
+	if ctx.connExpirer == nil || !ctx.connExpiry && !flush {
+		return
+	}
+	expired, err := ctx.connExpirer.Expire(dest)
+	if err != nil {
+		log.Errorf("error while expiring connections of backend %s: %s", source, err)
+		return
+	}
+	log.Infof("expired %d connection(s) of backend %s", expired, source)
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingConnExpirer struct {
+	enableErr error
+	enabled   bool
+	expired   []ConnDest
+}
+
+func (e *recordingConnExpirer) Enable() error {
+	e.enabled = true
+	return e.enableErr
+}
+
+func (e *recordingConnExpirer) Expire(dest ConnDest) (uint, error) {
+	e.expired = append(e.expired, dest)
+	return 1, nil
+}
+
+func TestExpireConns(t *testing.T) {
+	_, err := NewContext(ContextOptions{Ipvs: NewMemoryIpvs(), ExpireConns: true,
+		ConnExpirer: &recordingConnExpirer{enableErr: errors.New("read-only file system")}})
+	assert.ErrorIs(t, err, ErrConnExpiryFailed)
+
+	expirer := &recordingConnExpirer{}
+	c, err := NewContext(ContextOptions{Ipvs: NewMemoryIpvs(), ExpireConns: true, ConnExpirer: expirer})
+	require.NoError(t, err)
+	close(c.stopCh)
+	assert.True(t, expirer.enabled)
+	assert.True(t, c.connExpiry)
+
+	c = newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.connExpirer, c.connExpiry = expirer, true
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	stash := make(map[pulse.ID]int32)
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	require.Len(t, expirer.expired, 1)
+	assert.Equal(t, ConnDest{VIP: net.ParseIP("127.0.0.1"), Port: 80, Protocol: syscall.IPPROTO_TCP,
+		RIP: net.ParseIP("127.0.0.2"), RPort: 8080}, expirer.expired[0])
+
+	// connections are expired on transition only
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Len(t, expirer.expired, 1)
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1}})
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+	assert.Len(t, expirer.expired, 2)
+}
+
+func TestFlushConntrack(t *testing.T) {
+	assert.ErrorIs(t, (&ServiceOptions{Port: 80, Host: "127.0.0.1", FwdMethod: "dr", FlushConntrack: true}).Validate(nil),
+		ErrFlushConntrackMethod)
+
+	expirer := &recordingConnExpirer{}
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.connExpirer = expirer
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	for port, id := range map[uint16]string{80: "flushed", 81: "kept"} {
+		require.NoError(t, c.CreateService(id, &ServiceConfig{
+			ServiceOptions: &ServiceOptions{Port: port, Host: "localhost", FlushConntrack: id == "flushed"},
+			ServiceBackends: map[string]*BackendOptions{
+				rsID:    {Host: "127.0.0.2", Port: 8080},
+				"other": {Host: "127.0.0.3", Port: 8080},
+			},
+		}))
+	}
+
+	stash := make(map[pulse.ID]int32)
+	for _, id := range []string{"flushed", "kept"} {
+		c.processPulseUpdate(stash, pulse.Update{Source: pulse.ID{VsID: id, RsID: rsID},
+			Metrics: pulse.Metrics{Status: pulse.StatusDown}})
+		_, err := c.RemoveBackend(id, "other")
+		require.NoError(t, err)
+	}
+	require.Len(t, expirer.expired, 2)
+	assert.Equal(t, net.ParseIP("127.0.0.2"), expirer.expired[0].RIP)
+	assert.Equal(t, net.ParseIP("127.0.0.3"), expirer.expired[1].RIP)
+}
+
+func TestConntrackFilter(t *testing.T) {
+	_, family, err := conntrackFilter(ConnDest{VIP: net.ParseIP("fd00::1"), Port: 53, Protocol: syscall.IPPROTO_UDP,
+		RIP: net.ParseIP("fd00::2"), RPort: 53})
+	require.NoError(t, err)
+	assert.EqualValues(t, syscall.AF_INET6, family)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// FailoverOptions make a service send traffic to a single backend at a time,
+// e.g. to a primary database which must not receive split traffic.
+type FailoverOptions struct {
+	// Preempt moves traffic back to a healthy backend of higher priority, otherwise
+	// the active backend keeps it while it's healthy.
+	Preempt bool `json:"preempt,omitempty" yaml:"preempt,omitempty"`
+}
+
+// failoverStandby tells if the backend of a failover service isn't the active
+// one, so it gets no traffic.
+func (vs *Service) failoverStandby(opts *BackendOptions) bool {
+	if vs.options.Failover == nil {
+		return false
+	}
+	active, exists := vs.backends[vs.failoverActive]
+	return !exists || active.options != opts
+}
+
+// electFailoverBackend picks the healthy backend of the highest priority as the
+// active one, ties are broken by backend IDs. Without preemption the active
+// backend is kept while it's healthy. If no backend is healthy, the active one
+// is kept until another one recovers. Context mutex must be held.
+func (ctx *Context) electFailoverBackend(vs *Service) {
+	if vs.options.Failover == nil {
+		return
+	}
+	current, exists := vs.backends[vs.failoverActive]
+	currentHealthy := exists && current.healthy()
+	if currentHealthy && !vs.options.Failover.Preempt {
+		return
+	}
+
+	var best *Backend
+	for _, rsID := range sortedKeys(vs.backends) {
+		rs := vs.backends[rsID]
+		if rs.healthy() && (best == nil || rs.options.Priority > best.options.Priority) {
+			best = rs
+		}
+	}
+	if best == nil || currentHealthy && current.options.Priority >= best.options.Priority {
+		return
+	}
+
+	if exists {
+		log.Warnf("failing over service [%s] from backend [%s] to [%s]", vs.vsID, vs.failoverActive, best.rsID)
+	} else {
+		log.Infof("backend [%s/%s] is active", vs.vsID, best.rsID)
+	}
+	ctx.recordEvent(vs.vsID, best.rsID, EventFailover, "active backend changed from %q", vs.failoverActive)
+	vs.failoverActive = best.rsID
+}
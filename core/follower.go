@@ -0,0 +1,177 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPrimaryUnavailable is returned if configuration of the primary GORB can't be read.
+var ErrPrimaryUnavailable = errors.New("primary GORB is unavailable")
+
+// MirrorConfig is configuration of all services and backend pools, which
+// follower GORBs mirror instead of reading a store.
+type MirrorConfig struct {
+	// Revision is the context revision the configuration is taken at
+	Revision uint64                        `json:"revision"`
+	Services map[string]json.RawMessage    `json:"services"`
+	Pools    map[string]*BackendPoolConfig `json:"pools"`
+}
+
+// MirrorConfig returns configuration of services and backend pools with the
+// revision it's taken at. Deleted objects waiting for their removal are left
+// out, so followers don't carry traffic primary has taken away from them.
+func (ctx *Context) MirrorConfig() (*MirrorConfig, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	config := &MirrorConfig{
+		Revision: ctx.revision,
+		Services: make(map[string]json.RawMessage, len(ctx.services)),
+		Pools:    maps.Clone(ctx.backendPools),
+	}
+	for vsID, vs := range ctx.services {
+		if vs.deleteTimer != nil {
+			continue
+		}
+		service := vs.config()
+		for rsID, rs := range vs.backends {
+			if rs.deleteTimer != nil || rs.removalTimer != nil {
+				delete(service.ServiceBackends, rsID)
+			}
+		}
+		// services are encoded under the lock, since their options are shared
+		raw, err := json.Marshal(service)
+		if err != nil {
+			return nil, err
+		}
+		config.Services[vsID] = raw
+	}
+	if config.Pools == nil {
+		config.Pools = map[string]*BackendPoolConfig{}
+	}
+	return config, nil
+}
+
+// primarySource reads configuration of the primary GORB followed instead of store layers.
+type primarySource struct {
+	url    string
+	client *http.Client
+
+	// mutex serializes reads, so the cached configuration is reused by one of them
+	mutex sync.Mutex
+	// etag and body of the previous read, unchanged configuration isn't sent again
+	etag string
+	body []byte
+}
+
+func newPrimarySource(primaryURL string, options StoreOptions) (*primarySource, error) {
+	proxy, err := util.ProxyFunc(options.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	return &primarySource{
+		url:    strings.TrimSuffix(primaryURL, "/") + "/mirror",
+		client: &http.Client{Transport: transport, Timeout: options.SyncTimeout},
+	}, nil
+}
+
+// read returns services and backend pools of the primary. Revisions of services
+// are hashes of their configuration, so unchanged services aren't compared.
+func (p *primarySource) read() (map[string]*ServiceConfig, map[string]*BackendPoolConfig, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPrimaryUnavailable, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Debugf("configuration of primary %s hasn't changed", p.url)
+	case http.StatusOK:
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrPrimaryUnavailable, err)
+		}
+		p.etag, p.body = resp.Header.Get("ETag"), body
+	default:
+		return nil, nil, fmt.Errorf("%w: %s responded with %s", ErrPrimaryUnavailable, p.url, resp.Status)
+	}
+
+	// configuration is decoded on every read, since options are modified during synchronization
+	var config MirrorConfig
+	if err := json.Unmarshal(p.body, &config); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrPrimaryUnavailable, err)
+	}
+	services := make(map[string]*ServiceConfig, len(config.Services))
+	for vsID, raw := range config.Services {
+		service := &ServiceConfig{}
+		if err := json.Unmarshal(raw, service); err != nil {
+			service.err = err
+		}
+		h := fnv.New64a()
+		h.Write([]byte(vsID))
+		h.Write(raw)
+		service.revision = h.Sum64()
+		services[vsID] = service
+	}
+	return services, config.Pools, nil
+}
+
+// mirrorBackendPools creates and updates backend pools of the primary, so its
+// services referencing them could be synchronized.
+func (ctx *Context) mirrorBackendPools(pools map[string]*BackendPoolConfig) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	for _, poolID := range sortedKeys(pools) {
+		pool := pools[poolID]
+		if pool == nil || validateID(poolID) != nil || pool.Validate() != nil {
+			log.Warnf("skipping invalid backend pool [%s] of primary", poolID)
+			continue
+		}
+		if current, exists := ctx.backendPools[poolID]; exists && reflect.DeepEqual(current, pool) {
+			continue
+		}
+		if _, err := ctx.putBackendPool(poolID, pool); err != nil {
+			log.Errorf("error while mirroring backend pool [%s]: %s", poolID, err)
+		}
+	}
+}
+
+// removeMirroredBackendPools removes backend pools the primary doesn't have
+// once services referencing them are synchronized.
+func (ctx *Context) removeMirroredBackendPools(pools map[string]*BackendPoolConfig) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	for _, poolID := range sortedKeys(ctx.backendPools) {
+		if _, exists := pools[poolID]; exists {
+			continue
+		}
+		if err := ctx.removeBackendPool(poolID); err != nil {
+			log.Errorf("error while removing backend pool [%s] missing on primary: %s", poolID, err)
+		}
+	}
+}
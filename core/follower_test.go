@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollower(t *testing.T) {
+	primary := newContext(NewMemoryIpvs(), &fakeDisco{})
+	primary.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	primary.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(primary.stopCh)
+	_, err := primary.PutBackendPool("shared", &BackendPoolConfig{Backends: map[string]*BackendOptions{
+		"shared-1": {Host: "127.0.2.1", Port: 8080},
+	}}, Precondition{})
+	require.NoError(t, err)
+	require.NoError(t, primary.CreateService("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80, Pool: "shared"},
+		ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.1.1", Port: 8080}},
+	}))
+	require.NoError(t, primary.CreateService("api", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Host: "localhost", Port: 81},
+	}))
+
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		config, err := primary.MirrorConfig()
+		require.NoError(t, err)
+		etag := strconv.Quote(strconv.FormatUint(config.Revision, 10))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(config)
+	}))
+	defer server.Close()
+
+	follower := newContext(NewMemoryIpvs(), &fakeDisco{})
+	follower.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	follower.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(follower.stopCh)
+	s, err := newStore(StoreOptions{Primary: server.URL}, follower)
+	require.NoError(t, err)
+	follower.SetStore(s)
+	assert.True(t, follower.StoreManaged())
+
+	require.NoError(t, s.syncWithStore(context.Background()))
+	assert.Equal(t, []string{"api", "web"}, sortedKeys(follower.services))
+	assert.Equal(t, []string{"a", "shared-1"}, sortedKeys(follower.services["web"].backends))
+	pool := follower.backendPools["shared"]
+	require.NotNil(t, pool)
+
+	// unchanged configuration isn't sent and applied again
+	require.NoError(t, s.syncWithStore(context.Background()))
+	assert.Equal(t, 1, notModified)
+	last, err := s.LastSync()
+	require.NoError(t, err)
+	assert.Equal(t, 2, last.Unchanged)
+	assert.Same(t, pool, follower.backendPools["shared"])
+
+	// changes of the primary are mirrored
+	_, err = primary.RemoveService("web")
+	require.NoError(t, err)
+	require.NoError(t, primary.RemoveBackendPool("shared", Precondition{}))
+	require.NoError(t, primary.CreateBackend("api", "b", &BackendOptions{Host: "127.0.1.2", Port: 8080}))
+	require.NoError(t, s.syncWithStore(context.Background()))
+	assert.Equal(t, []string{"api"}, sortedKeys(follower.services))
+	assert.Equal(t, []string{"b"}, sortedKeys(follower.services["api"].backends))
+	assert.Empty(t, follower.ListBackendPools())
+	assert.Equal(t, 3, requests)
+
+	server.Close()
+	assert.ErrorIs(t, s.syncWithStore(context.Background()), ErrPrimaryUnavailable)
+	assert.Equal(t, []string{"api"}, sortedKeys(follower.services), "services are kept while primary is unavailable")
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// FreezeService excludes the service from store synchronization, so it could be
+// pinned in an emergency while the rest of services stay store-driven. Frozen
+// services could be changed through the API even if services are managed by store.
+// The freeze is bound to the service ID, so it is kept while the service is
+// re-created or removed until UnfreezeService.
+func (ctx *Context) FreezeService(vsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	if ctx.frozen[vsID] {
+		return nil
+	}
+	if ctx.frozen == nil {
+		ctx.frozen = make(map[string]bool)
+	}
+	ctx.frozen[vsID] = true
+	// plans built before are outdated, they could change the frozen service
+	ctx.revision++
+	vs.version = ctx.revision
+	ctx.recordEvent(vsID, "", EventFrozen, "excluded from store synchronization")
+	log.Warnf("service [%s] is frozen, store synchronization won't change it", vsID)
+	return nil
+}
+
+// UnfreezeService returns the service to store synchronization.
+// The freeze of removed service could be released without a precondition.
+func (ctx *Context) UnfreezeService(vsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if exists {
+		if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+			return err
+		}
+	} else if err := pre.check(false, 0); err != nil {
+		return err
+	}
+	if !ctx.frozen[vsID] {
+		if !exists {
+			return objectError(ErrObjectNotFound, "vsID", vsID)
+		}
+		return nil
+	}
+	delete(ctx.frozen, vsID)
+	ctx.revision++
+	if exists {
+		vs.version = ctx.revision
+	}
+	ctx.recordEvent(vsID, "", EventUnfrozen, "returned to store synchronization")
+	log.Infof("service [%s] is unfrozen", vsID)
+	return nil
+}
+
+// StoreManagedService checks if the service could be changed by store only,
+// i.e. services are managed by store and the service isn't frozen.
+func (ctx *Context) StoreManagedService(vsID string) bool {
+	if !ctx.StoreManaged() {
+		return false
+	}
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	return !ctx.frozen[vsID]
+}
+
+// syncFrozen checks if synchronization must leave the service as is, because
+// it's frozen through the API or in store content. Context mutex must be held.
+func (ctx *Context) syncFrozen(vsID string, storeService *ServiceConfig) bool {
+	if ctx.frozen[vsID] {
+		return true
+	}
+	return storeService != nil && storeService.err == nil && storeService.ServiceOptions.Frozen
+}
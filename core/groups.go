@@ -0,0 +1,335 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible service group errors.
+var (
+	ErrGroupMember       = errors.New("service is a member of a service group, change the group instead")
+	ErrInvalidGroupPorts = errors.New("ports of a service group must be distinct and non-zero")
+	ErrGroupPorts        = errors.New("ports are supported by service groups only")
+	ErrGroupHost6        = errors.New("host6 is supported by service groups only")
+)
+
+// ServiceGroupInfo contains information about services of a group keyed by their IDs.
+type ServiceGroupInfo struct {
+	Ports    []uint16                `json:"ports"`
+	Services map[string]*ServiceInfo `json:"services"`
+	Version  uint64                  `json:"version"`
+}
+
+// isServiceGroup reports whether the service is expanded to several services.
+func isServiceGroup(options *ServiceOptions) bool {
+	return len(options.Ports) > 0 || options.Host6 != ""
+}
+
+// groupMemberID returns ID of the group service listening on the port, e.g. "web-443".
+func groupMemberID(groupID string, port uint16) string {
+	return fmt.Sprintf("%s-%d", groupID, port)
+}
+
+// groupFamily is a VIP of a service group with a suffix of IDs of its services.
+type groupFamily struct {
+	suffix, host, network string
+}
+
+// groupFamilies returns VIPs of the group, dual-stack groups have a service per
+// address family with "-v4" and "-v6" suffixes.
+func groupFamilies(options *ServiceOptions) []groupFamily {
+	if options.Host6 == "" {
+		return []groupFamily{{host: options.Host}}
+	}
+	return []groupFamily{{"-v4", options.Host, "ip4"}, {"-v6", options.Host6, "ip6"}}
+}
+
+// expandServiceGroup returns configurations of services of the group, one per port
+// and address family. Services share options and backends, backends without a port
+// listen on the port of their service and dual-stack services get backends of their
+// address family only.
+func expandServiceGroup(groupID string, config *ServiceConfig) (map[string]*ServiceConfig, error) {
+	if config.ServiceOptions == nil {
+		return nil, ErrMissingEndpoint
+	}
+	if !isServiceGroup(config.ServiceOptions) {
+		return nil, ErrInvalidGroupPorts
+	}
+	ports := config.ServiceOptions.Ports
+	if len(ports) == 0 {
+		if config.ServiceOptions.Port == 0 {
+			return nil, ErrMissingEndpoint
+		}
+		ports = []uint16{config.ServiceOptions.Port}
+	}
+	seen := make(map[uint16]bool, len(ports))
+	for _, port := range ports {
+		if port == 0 || seen[port] {
+			return nil, ErrInvalidGroupPorts
+		}
+		seen[port] = true
+	}
+
+	members := make(map[string]*ServiceConfig, len(ports))
+	for _, port := range ports {
+		for _, family := range groupFamilies(config.ServiceOptions) {
+			options := *config.ServiceOptions
+			options.Port, options.Ports, options.group = port, nil, groupID
+			options.Host, options.Host6, options.network = family.host, "", family.network
+
+			var backends map[string]*BackendOptions
+			if config.ServiceBackends != nil {
+				backends = make(map[string]*BackendOptions, len(config.ServiceBackends))
+				for rsID, backend := range config.ServiceBackends {
+					if backend != nil {
+						var ok bool
+						if backend, ok = groupBackend(backend, port, family.network); !ok {
+							continue
+						}
+					}
+					backends[rsID] = backend
+				}
+			}
+			vsID := groupID
+			if len(config.ServiceOptions.Ports) > 0 {
+				vsID = groupMemberID(groupID, port)
+			}
+			// IDs of services are checked before any of them is created
+			if err := validateID(vsID + family.suffix); err != nil {
+				return nil, fmt.Errorf("%w: group ID is too long for ID of its service", err)
+			}
+			members[vsID+family.suffix] = &ServiceConfig{ServiceOptions: &options, ServiceBackends: backends,
+				revision: config.revision}
+		}
+	}
+	return members, nil
+}
+
+// groupBackend returns options of a group backend for the service listening on the
+// port. Backends of dual-stack services are resolved within the network of the
+// service, ok is false if the backend has no address there.
+func groupBackend(opts *BackendOptions, port uint16, network string) (backend *BackendOptions, ok bool) {
+	copied := *opts
+	if copied.Port == 0 {
+		copied.Port = port
+	}
+	if network != "" && copied.Host != "" {
+		if ip := net.ParseIP(copied.Host); ip != nil {
+			if (ip.To4() != nil) != (network == "ip4") {
+				return nil, false
+			}
+		} else if addrs, err := rangeAddresses(copied.Host); err == nil && addrs != nil {
+			if addrs[0].Is4() != (network == "ip4") {
+				return nil, false
+			}
+		} else if addr, err := net.ResolveIPAddr(network, copied.Host); err == nil {
+			copied.Host = addr.IP.String()
+		} else {
+			return nil, false
+		}
+	}
+	return &copied, true
+}
+
+// expandServiceGroups replaces service groups with their services. Groups which
+// couldn't be expanded are marked invalid, so they are skipped during synchronization.
+func expandServiceGroups(services map[string]*ServiceConfig) {
+	for _, groupID := range sortedKeys(services) {
+		config := services[groupID]
+		if config == nil || config.err != nil || config.ServiceOptions == nil || !isServiceGroup(config.ServiceOptions) {
+			continue
+		}
+		members, err := expandServiceGroup(groupID, config)
+		if err != nil {
+			config.err = err
+			continue
+		}
+		delete(services, groupID)
+		for vsID, member := range members {
+			if _, exists := services[vsID]; exists {
+				log.Warnf("service [%s] of group [%s] duplicates another service", vsID, groupID)
+				member = &ServiceConfig{err: fmt.Errorf("%w: %s", ErrDuplicateID, vsID)}
+			}
+			services[vsID] = member
+		}
+	}
+}
+
+// groupServices returns services of the group sorted by their ports and IDs. Context mutex must be held.
+func (ctx *Context) groupServices(groupID string) []*Service {
+	var members []*Service
+	for _, vs := range ctx.services {
+		if vs.options.group == groupID {
+			members = append(members, vs)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].options.Port < members[j].options.Port ||
+			members[i].options.Port == members[j].options.Port && members[i].vsID < members[j].vsID
+	})
+	return members
+}
+
+// groupVersion returns the latest version of services of the group and their
+// backends, so any change of the group changes its version.
+func groupVersion(members []*Service) uint64 {
+	var version uint64
+	for _, vs := range members {
+		version = max(version, vs.version)
+		for _, rs := range vs.backends {
+			version = max(version, rs.version)
+		}
+	}
+	return version
+}
+
+// PutServiceGroup creates services of the group listening on its ports or updates
+// existing ones. Services of ports removed from the group are removed too.
+func (ctx *Context) PutServiceGroup(groupID string, config *ServiceConfig, pre Precondition) (created bool, err error) {
+	if err := validateID(groupID); err != nil {
+		return false, err
+	}
+	members, err := expandServiceGroup(groupID, config)
+	if err != nil {
+		return false, err
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	for vsID := range members {
+		if vs, exists := ctx.services[vsID]; exists && vs.options.group != groupID {
+			return false, objectError(ErrObjectExists, "vsID", vsID)
+		}
+	}
+
+	existing := ctx.groupServices(groupID)
+	if err := ctx.checkPrecondition(pre, len(existing) > 0, groupVersion(existing)); err != nil {
+		return false, err
+	}
+	for _, vsID := range sortedKeys(members) {
+		if _, err := ctx.putService(vsID, members[vsID]); err != nil {
+			return false, fmt.Errorf("service [%s]: %w", vsID, err)
+		}
+	}
+	for _, vs := range existing {
+		if _, exists := members[vs.vsID]; !exists {
+			log.Infof("removing service [%s] of port %d removed from group [%s]", vs.vsID, vs.options.Port, groupID)
+			if _, err := ctx.removeService(vs.vsID); err != nil {
+				return false, err
+			}
+		}
+	}
+	return len(existing) == 0, nil
+}
+
+// GetServiceGroup returns information about services of the group.
+func (ctx *Context) GetServiceGroup(groupID string) (*ServiceGroupInfo, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	members := ctx.groupServices(groupID)
+	if len(members) == 0 {
+		return nil, objectError(ErrObjectNotFound, "group", groupID)
+	}
+	info := &ServiceGroupInfo{Services: make(map[string]*ServiceInfo, len(members)), Version: groupVersion(members)}
+	for _, vs := range members {
+		// services of both address families listen on the same port
+		if n := len(info.Ports); n == 0 || info.Ports[n-1] != vs.options.Port {
+			info.Ports = append(info.Ports, vs.options.Port)
+		}
+		info.Services[vs.vsID] = vs.CalcServiceStat()
+	}
+	return info, nil
+}
+
+// RemoveServiceGroup removes all services of the group.
+func (ctx *Context) RemoveServiceGroup(groupID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	members := ctx.groupServices(groupID)
+	if len(members) == 0 {
+		return objectError(ErrObjectNotFound, "group", groupID)
+	}
+	if err := ctx.checkPrecondition(pre, true, groupVersion(members)); err != nil {
+		return err
+	}
+	for _, vs := range members {
+		if _, err := ctx.removeService(vs.vsID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutGroupBackend creates the backend in all services of the group or updates
+// existing ones, so backends of the group can't drift apart. The precondition
+// is checked against the version of the group.
+func (ctx *Context) PutGroupBackend(groupID, rsID string, opts *BackendOptions, pre Precondition) (created bool, err error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	members := ctx.groupServices(groupID)
+	if len(members) == 0 {
+		return false, objectError(ErrObjectNotFound, "group", groupID)
+	}
+	exists := false
+	for _, vs := range members {
+		_, found := vs.backends[rsID]
+		exists = exists || found
+	}
+	if err := ctx.checkPrecondition(pre, exists, groupVersion(members)); err != nil {
+		return false, err
+	}
+	matched := false
+	for _, vs := range members {
+		backend, ok := groupBackend(opts, vs.options.Port, vs.options.network)
+		if !ok {
+			continue
+		}
+		matched = true
+		memberCreated, err := ctx.putBackend(vs, rsID, backend)
+		if err != nil {
+			return false, fmt.Errorf("service [%s]: %w", vs.vsID, err)
+		}
+		created = created || memberCreated
+	}
+	if !matched {
+		return false, ErrIncompatibleAFs
+	}
+	return created, nil
+}
+
+// RemoveGroupBackend removes the backend from all services of the group.
+// The precondition is checked against the version of the group.
+func (ctx *Context) RemoveGroupBackend(groupID, rsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	members := ctx.groupServices(groupID)
+	if len(members) == 0 {
+		return objectError(ErrObjectNotFound, "group", groupID)
+	}
+	if err := ctx.checkPrecondition(pre, true, groupVersion(members)); err != nil {
+		return err
+	}
+	found := false
+	for _, vs := range members {
+		if _, exists := vs.backends[rsID]; !exists {
+			continue
+		}
+		found = true
+		if _, err := ctx.removeBackend(vs.vsID, rsID); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	return nil
+}
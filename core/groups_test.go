@@ -0,0 +1,132 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceGroup(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	_, err := c.PutServiceGroup("web", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Ports: []uint16{80, 80}}}, Precondition{})
+	assert.Equal(t, ErrInvalidGroupPorts, err)
+
+	created, err := c.PutServiceGroup("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Ports: []uint16{80, 443}},
+		ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2"}},
+	}, Precondition{})
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	group, err := c.GetServiceGroup("web")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{80, 443}, group.Ports)
+	assert.Equal(t, "web", group.Services["web-443"].Group)
+	backend, err := c.GetBackend("web-443", "a")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(443), backend.Options.Port, "backend listens on the port of its service")
+
+	// services of the group are changed through the group only
+	_, err = c.PutBackend("web-80", "b", &BackendOptions{Host: "127.0.0.3", Port: 80}, Precondition{})
+	assert.Equal(t, ErrGroupMember, err)
+	assert.Equal(t, ErrGroupMember, c.DeleteService("web-80", Precondition{}))
+
+	created, err = c.PutGroupBackend("web", "b", &BackendOptions{Host: "127.0.0.3", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	assert.True(t, created)
+	for _, vsID := range []string{"web-80", "web-443"} {
+		backend, err := c.GetBackend(vsID, "b")
+		require.NoError(t, err)
+		assert.Equal(t, uint16(8080), backend.Options.Port)
+	}
+	require.NoError(t, c.RemoveGroupBackend("web", "a", Precondition{}))
+	_, err = c.GetBackend("web-80", "a")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// removed ports are removed from the group, backends are kept if not set
+	created, err = c.PutServiceGroup("web", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Ports: []uint16{443}}}, Precondition{})
+	require.NoError(t, err)
+	assert.False(t, created)
+	_, err = c.GetService("web-80")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	group, err = c.GetServiceGroup("web")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, group.Services["web-443"].Backends)
+
+	require.NoError(t, c.RemoveServiceGroup("web", Precondition{}))
+	_, err = c.GetServiceGroup("web")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestExpandServiceGroups(t *testing.T) {
+	services := map[string]*ServiceConfig{
+		"web": {
+			ServiceOptions:  &ServiceOptions{Host: "localhost", Ports: []uint16{80, 443}},
+			ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2"}},
+		},
+		"web-443": {ServiceOptions: &ServiceOptions{Host: "localhost", Port: 8443}},
+		"invalid": {ServiceOptions: &ServiceOptions{Host: "localhost", Ports: []uint16{0}}},
+		"dual":    {ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Host6: "::1", Port: 53}},
+	}
+	validateServiceConfigs(services, nil, nil)
+
+	assert.NotContains(t, services, "web")
+	require.Contains(t, services, "web-80")
+	assert.NoError(t, services["web-80"].err)
+	assert.Equal(t, "web", services["web-80"].ServiceOptions.group)
+	assert.Equal(t, uint16(80), services["web-80"].ServiceBackends["a"].Port)
+	assert.ErrorIs(t, services["web-443"].err, ErrDuplicateID)
+	assert.Equal(t, ErrInvalidGroupPorts, services["invalid"].err)
+	require.Contains(t, services, "dual-v6")
+	assert.Equal(t, "::1", services["dual-v6"].ServiceOptions.Host)
+	assert.Equal(t, "127.0.0.1", services["dual-v4"].ServiceOptions.Host)
+}
+
+func TestDualStackServiceGroup(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	_, err := c.PutServiceGroup("web", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Host6: "::1", Port: 80},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "fd00::2", Port: 8080},
+		},
+	}, Precondition{})
+	require.NoError(t, err)
+
+	group, err := c.GetServiceGroup("web")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{80}, group.Ports)
+	require.Contains(t, group.Services, "web-v4")
+	require.Contains(t, group.Services, "web-v6")
+	assert.Equal(t, []string{"a"}, group.Services["web-v4"].Backends)
+	assert.Equal(t, []string{"b"}, group.Services["web-v6"].Backends)
+
+	// backends are added to services of their address family only
+	_, err = c.PutGroupBackend("web", "c", &BackendOptions{Host: "fd00::3", Port: 8080}, Precondition{})
+	require.NoError(t, err)
+	_, err = c.GetBackend("web-v4", "c")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = c.GetBackend("web-v6", "c")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, (&ServiceOptions{Host: "127.0.0.1", Host6: "::1", Port: 80}).Validate(nil), ErrGroupHost6)
+
+	// IDs of group services are checked before any of them is created
+	long := strings.Repeat("g", maxIDLength-len("-443-v6")+1)
+	_, err = c.PutServiceGroup(long, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Host6: "::1", Ports: []uint16{80, 443}},
+	}, Precondition{})
+	assert.ErrorIs(t, err, ErrInvalidID)
+	_, err = c.GetServiceGroup(long)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible ID errors.
+var (
+	ErrInvalidID = errors.New("ID must be 1-64 characters long and contain only letters, digits, " +
+		"'.', '_', ':' and '-'")
+	ErrDuplicateID = errors.New("several objects have the same normalized ID")
+	ErrReservedID  = errors.New("backend ID is reserved for a service resource of the API")
+)
+
+const maxIDLength = 64
+
+var idPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+func validateID(id string) error {
+	if len(id) > maxIDLength || !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// reservedBackendIDs are resources of services in the API, which would shadow
+// backends with the same ID at /service/<service>/<backend>.
+var reservedBackendIDs = []string{"backends", "conn_limit", "connections", "events", "freeze",
+	"persistence", "pins", "restore", "simulate", "switch", "weight_hold"}
+
+func validateBackendID(rsID string) error {
+	if err := validateID(rsID); err != nil {
+		return err
+	}
+	if slices.Contains(reservedBackendIDs, rsID) {
+		return fmt.Errorf("%w: %q", ErrReservedID, rsID)
+	}
+	return nil
+}
+
+// NormalizeID validates service or backend ID and converts it to lower case,
+// so IDs differing only in case refer to the same object.
+func NormalizeID(id string) (string, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if err := validateID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// NormalizeBackendID is NormalizeID of backends, which also rejects IDs
+// reserved for resources of services.
+func NormalizeBackendID(id string) (string, error) {
+	id, err := NormalizeID(id)
+	if err != nil {
+		return "", err
+	}
+	if err := validateBackendID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// normalizeIDs re-keys objects by IDs normalized with normalize. Invalid and colliding
+// IDs are returned in errs keyed by the normalized (or original if invalid) ID.
+func normalizeIDs[V any](objects map[string]V, normalize func(string) (string, error)) (normalized map[string]V, errs map[string]error) {
+	normalized = make(map[string]V, len(objects))
+	originals := make(map[string][]string)
+	for _, id := range sortedKeys(objects) {
+		normalizedID, err := normalize(id)
+		if err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[id] = err
+			continue
+		}
+		originals[normalizedID] = append(originals[normalizedID], id)
+		normalized[normalizedID] = objects[id]
+	}
+	for normalizedID, ids := range originals {
+		if len(ids) > 1 {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			sort.Strings(ids)
+			errs[normalizedID] = fmt.Errorf("%w: %s", ErrDuplicateID, strings.Join(ids, ", "))
+			log.Warnf("IDs %s refer to the same object [%s]", strings.Join(ids, ", "), normalizedID)
+		}
+	}
+	return normalized, errs
+}
+
+// normalizeServiceIDs re-keys services and their backends by normalized IDs.
+// Services and backends with invalid or colliding IDs are marked invalid,
+// so they are skipped during synchronization.
+func normalizeServiceIDs(services map[string]*ServiceConfig) map[string]*ServiceConfig {
+	normalized, errs := normalizeIDs(services, NormalizeID)
+	for id, err := range errs {
+		normalized[id] = &ServiceConfig{err: err}
+	}
+	for _, service := range normalized {
+		if service.err != nil || service.ServiceBackends == nil {
+			continue
+		}
+		var backendErrs map[string]error
+		service.ServiceBackends, backendErrs = normalizeIDs(service.ServiceBackends, NormalizeBackendID)
+		for rsID, err := range backendErrs {
+			delete(service.ServiceBackends, rsID)
+			if service.invalidBackends == nil {
+				service.invalidBackends = make(map[string]error)
+			}
+			service.invalidBackends[rsID] = err
+		}
+	}
+	return normalized
+}
+
+// canonicalServiceIDs re-keys validated services by their host, port and protocol,
+// e.g. "10.0.0.1-80-tcp", and backends by their host and port, e.g. "10.1.0.1-8080".
+// It is used when store naming is inconsistent.
+func canonicalServiceIDs(services map[string]*ServiceConfig) map[string]*ServiceConfig {
+	canonical := make(map[string]*ServiceConfig, len(services))
+	originals := make(map[string][]string)
+	for _, id := range sortedKeys(services) {
+		service := services[id]
+		canonicalID := id
+		if service.err == nil {
+			options := service.ServiceOptions
+			canonicalID = fmt.Sprintf("%s-%d-%s", options.host, options.Port, options.Protocol)
+			backends := make(map[string]*BackendOptions, len(service.ServiceBackends))
+			for _, rsID := range sortedKeys(service.ServiceBackends) {
+				backend := service.ServiceBackends[rsID]
+				canonicalRsID := fmt.Sprintf("%s-%d", backend.host, backend.Port)
+				if _, exists := backends[canonicalRsID]; exists {
+					log.Warnf("backend [%s/%s] duplicates [%s/%s]. skipping", id, rsID, canonicalID, canonicalRsID)
+					continue
+				}
+				backends[canonicalRsID] = backend
+			}
+			service.ServiceBackends = backends
+		}
+		originals[canonicalID] = append(originals[canonicalID], id)
+		canonical[canonicalID] = service
+	}
+	for canonicalID, ids := range originals {
+		if len(ids) > 1 {
+			log.Warnf("services %s have the same canonical ID [%s]", strings.Join(ids, ", "), canonicalID)
+			canonical[canonicalID] = &ServiceConfig{err: fmt.Errorf("%w: %s", ErrDuplicateID, strings.Join(ids, ", "))}
+		}
+	}
+	return canonical
+}
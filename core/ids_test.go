@@ -0,0 +1,79 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeID(t *testing.T) {
+	id, err := NormalizeID(" Web-Frontend_1.prod:80 ")
+	require.NoError(t, err)
+	assert.Equal(t, "web-frontend_1.prod:80", id)
+
+	for _, invalid := range []string{"", "web frontend", "web/frontend", string(make([]byte, maxIDLength+1))} {
+		_, err := NormalizeID(invalid)
+		assert.True(t, errors.Is(err, ErrInvalidID), invalid)
+	}
+}
+
+func TestNormalizeBackendID(t *testing.T) {
+	id, err := NormalizeBackendID("Events-1")
+	require.NoError(t, err)
+	assert.Equal(t, "events-1", id)
+
+	for _, reserved := range []string{"events", "Conn_Limit", "backends"} {
+		_, err := NormalizeBackendID(reserved)
+		assert.ErrorIs(t, err, ErrReservedID, reserved)
+	}
+	_, err = NormalizeBackendID("bad id")
+	assert.ErrorIs(t, err, ErrInvalidID)
+	_, err = NormalizeID("events")
+	assert.NoError(t, err, "services could have reserved IDs")
+}
+
+func TestNormalizeServiceIDs(t *testing.T) {
+	services := normalizeServiceIDs(map[string]*ServiceConfig{
+		"Web":    {ServiceOptions: &ServiceOptions{Port: 80}},
+		"web":    {ServiceOptions: &ServiceOptions{Port: 80}},
+		"bad id": {ServiceOptions: &ServiceOptions{Port: 80}},
+		"DB": {
+			ServiceOptions: &ServiceOptions{Port: 5432},
+			ServiceBackends: map[string]*BackendOptions{
+				"Primary": {Port: 5432},
+				"replica": {Port: 5432},
+				"REPLICA": {Port: 5432},
+				"Switch":  {Port: 5432},
+			},
+		},
+	})
+
+	assert.True(t, errors.Is(services["web"].err, ErrDuplicateID))
+	assert.True(t, errors.Is(services["bad id"].err, ErrInvalidID))
+	require.NoError(t, services["db"].err)
+	assert.Contains(t, services["db"].ServiceBackends, "primary")
+	assert.NotContains(t, services["db"].ServiceBackends, "replica")
+	assert.True(t, errors.Is(services["db"].invalidBackends["replica"], ErrDuplicateID))
+	assert.True(t, errors.Is(services["db"].invalidBackends["Switch"], ErrReservedID))
+}
+
+func TestCanonicalServiceIDs(t *testing.T) {
+	service := func() *ServiceConfig {
+		return &ServiceConfig{
+			ServiceOptions: &ServiceOptions{Port: 80, Protocol: "tcp", host: net.ParseIP("10.0.0.1")},
+			ServiceBackends: map[string]*BackendOptions{
+				"a": {Port: 8080, host: net.ParseIP("10.1.0.1")},
+			},
+		}
+	}
+
+	services := canonicalServiceIDs(map[string]*ServiceConfig{"web": service()})
+	require.Contains(t, services, "10.0.0.1-80-tcp")
+	assert.Contains(t, services["10.0.0.1-80-tcp"].ServiceBackends, "10.1.0.1-8080")
+
+	services = canonicalServiceIDs(map[string]*ServiceConfig{"web": service(), "frontend": service()})
+	assert.True(t, errors.Is(services["10.0.0.1-80-tcp"].err, ErrDuplicateID))
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/qk4l/gorb/util"
+	"github.com/tehnerd/gnl2go"
+)
+
+var (
+	errIpvsNotInitialized   = errors.New("IPVS netlink family is not resolved")
+	errIpvsStatsUnsupported = errors.New("IPVS implementation doesn't report traffic counters")
+)
+
+// IpvsTimeouts are IPVS protocol timeouts in seconds.
+// Zero value means the timeout is left unchanged.
+type IpvsTimeouts struct {
+	TCP    uint32 `json:"tcp"`
+	TCPFin uint32 `json:"tcp_fin"`
+	UDP    uint32 `json:"udp"`
+}
+
+// IsZero checks if all timeouts are unset.
+func (t IpvsTimeouts) IsZero() bool {
+	return t.TCP == 0 && t.TCPFin == 0 && t.UDP == 0
+}
+
+// IpvsConnCounter is implemented by IPVS clients able to report active connections.
+type IpvsConnCounter interface {
+	// GetActiveConns returns active connections of service destinations keyed by "ip:port".
+	GetActiveConns(vip string, port uint16, protocol uint16) (map[string]uint32, error)
+}
+
+// IpvsStats are cumulative traffic counters of an IPVS service.
+type IpvsStats struct {
+	Conns    uint64
+	InPkts   uint64
+	OutPkts  uint64
+	InBytes  uint64
+	OutBytes uint64
+}
+
+// IpvsStatsReader is implemented by IPVS clients able to report traffic counters.
+type IpvsStatsReader interface {
+	// GetServiceStats returns counters of all services keyed by gnl2go.Service.ToString().
+	GetServiceStats() (map[string]IpvsStats, error)
+}
+
+// ipvsClient extends GNL2GO IPVS client with commands it doesn't support.
+type ipvsClient struct {
+	gnl2go.IpvsClient
+}
+
+// NewIpvs creates IPVS netlink client used by default.
+func NewIpvs() Ipvs {
+	return &ipvsClient{}
+}
+
+func (ipvs *ipvsClient) messageType() (*gnl2go.MessageType, error) {
+	family, exists := gnl2go.MT2Family["IPVS"]
+	if !exists {
+		return nil, errIpvsNotInitialized
+	}
+	mt, exists := gnl2go.Family2MT[family]
+	if !exists {
+		return nil, errIpvsNotInitialized
+	}
+	return mt, nil
+}
+
+// GetTimeouts returns current IPVS protocol timeouts.
+func (ipvs *ipvsClient) GetTimeouts() (IpvsTimeouts, error) {
+	var timeouts IpvsTimeouts
+
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return timeouts, err
+	}
+	msg, err := mt.InitGNLMessageStr("GET_CONFIG", gnl2go.REQUEST)
+	if err != nil {
+		return timeouts, err
+	}
+	resp, err := ipvs.Sock.Query(msg)
+	if err != nil {
+		return timeouts, err
+	}
+	if len(resp) != 1 {
+		return timeouts, errors.New("unexpected IPVS config response")
+	}
+
+	for name, value := range map[string]*uint32{
+		"TIMEOUT_TCP":     &timeouts.TCP,
+		"TIMEOUT_TCP_FIN": &timeouts.TCPFin,
+		"TIMEOUT_UDP":     &timeouts.UDP,
+	} {
+		if attr, ok := resp[0].GetAttrList(name).(*gnl2go.U32Type); ok {
+			*value = uint32(*attr)
+		}
+	}
+	return timeouts, nil
+}
+
+// SetTimeouts sets IPVS protocol timeouts. Zero timeouts are left unchanged by the kernel.
+func (ipvs *ipvsClient) SetTimeouts(timeouts IpvsTimeouts) error {
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return err
+	}
+	msg, err := mt.InitGNLMessageStr("SET_CONFIG", gnl2go.ACK_REQUEST)
+	if err != nil {
+		return err
+	}
+	tcp := gnl2go.U32Type(timeouts.TCP)
+	tcpFin := gnl2go.U32Type(timeouts.TCPFin)
+	udp := gnl2go.U32Type(timeouts.UDP)
+	msg.AttrMap["TIMEOUT_TCP"] = &tcp
+	msg.AttrMap["TIMEOUT_TCP_FIN"] = &tcpFin
+	msg.AttrMap["TIMEOUT_UDP"] = &udp
+	return ipvs.Sock.Execute(msg)
+}
+
+// GetActiveConns returns active connections of service destinations.
+func (ipvs *ipvsClient) GetActiveConns(vip string, port uint16, protocol uint16) (map[string]uint32, error) {
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return nil, err
+	}
+	svc := gnl2go.Service{VIP: vip, Port: port, Proto: protocol}
+	attrList, err := svc.CreateAttrList()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := mt.InitGNLMessageStr("GET_DEST", gnl2go.MATCH_ROOT_REQUEST)
+	if err != nil {
+		return nil, err
+	}
+	svcAttrList := gnl2go.CreateAttrListType(gnl2go.ATLName2ATL["IpvsServiceAttrList"])
+	svcAttrList.Set(attrList)
+	msg.AttrMap["SERVICE"] = &svcAttrList
+	resps, err := ipvs.Sock.Query(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make(map[string]uint32, len(resps))
+	for _, resp := range resps {
+		destAttrList, ok := resp.GetAttrList("DEST").(*gnl2go.AttrListType)
+		if !ok {
+			continue
+		}
+		dest := gnl2go.Dest{AF: uint16(util.AddrFamily(net.ParseIP(vip)))}
+		if err := dest.InitFromAttrList(destAttrList.Amap); err != nil {
+			return nil, err
+		}
+		if active, ok := destAttrList.Amap["ACTIVE_CONNS"].(*gnl2go.U32Type); ok {
+			conns[net.JoinHostPort(dest.IP, fmt.Sprint(dest.Port))] = uint32(*active)
+		}
+	}
+	return conns, nil
+}
+
+// GetServiceStats returns traffic counters of all services.
+func (ipvs *ipvsClient) GetServiceStats() (map[string]IpvsStats, error) {
+	brief, err := ipvs.GetAllStatsBrief()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]IpvsStats, len(brief))
+	for key, counters := range brief {
+		values := counters.GetStats()
+		stats[key] = IpvsStats{Conns: values["CONNS"], InPkts: values["INPKTS"], OutPkts: values["OUTPKTS"],
+			InBytes: values["INBYTES"], OutBytes: values["OUTBYTES"]}
+	}
+	return stats, nil
+}
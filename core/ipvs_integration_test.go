@@ -0,0 +1,63 @@
+//go:build integration && linux
+
+package core
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+)
+
+// The kernel integration suite runs with:
+//
+//	sudo go test -tags integration -run Kernel ./core
+//
+// It needs root and the ip_vs module, each test gets its own network namespace,
+// so IPVS of the host isn't touched.
+
+// kernelIpvs returns IPVS backends of the kernel initialized in a new network namespace.
+// Netlink sockets stay in the namespace they are created in, so the backends could
+// be used from any goroutine afterwards.
+func kernelIpvs(t *testing.T) map[string]Ipvs {
+	if os.Geteuid() != 0 {
+		t.Skip("kernel integration suite must run as root")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	host, err := netns.Get()
+	require.NoError(t, err)
+	defer host.Close()
+	ns, err := netns.New()
+	require.NoError(t, err)
+	defer netns.Set(host)
+	t.Cleanup(func() { ns.Close() })
+
+	backends := map[string]Ipvs{"gnl2go": NewIpvs()}
+	for name, ipvs := range backends {
+		if err := ipvs.Init(); err != nil {
+			t.Skipf("IPVS backend %s isn't available, is ip_vs loaded? %s", name, err)
+		}
+		t.Cleanup(ipvs.Exit)
+	}
+	return backends
+}
+
+func TestKernelIpvs(t *testing.T) {
+	for name, ipvs := range kernelIpvs(t) {
+		t.Run(name, func(t *testing.T) {
+			testIpvsBackend(t, ipvs)
+		})
+	}
+}
+
+func TestKernelContext(t *testing.T) {
+	for name, ipvs := range kernelIpvs(t) {
+		t.Run(name, func(t *testing.T) {
+			testContextIpvs(t, ipvs)
+		})
+	}
+}
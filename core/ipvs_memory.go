@@ -0,0 +1,384 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/qk4l/gorb/util"
+	"github.com/tehnerd/gnl2go"
+)
+
+// Schedulers supported by IPVS in mainline kernels.
+var ipvsSchedulers = map[string]bool{
+	"rr": true, "wrr": true, "lc": true, "wlc": true, "lblc": true, "lblcr": true, "dh": true,
+	"sh": true, "sed": true, "nq": true, "fo": true, "ovf": true, "mh": true, "twos": true,
+}
+
+// Kernel defaults of IPVS protocol timeouts.
+var defaultIpvsTimeouts = IpvsTimeouts{TCP: 900, TCPFin: 120, UDP: 300}
+
+type memoryServiceKey struct {
+	vip      string
+	port     uint16
+	protocol uint16
+}
+
+type memoryService struct {
+	svc   gnl2go.Service
+	dests []gnl2go.Dest
+	// forwarding methods of dests
+	fwd map[string]uint32
+	// tunnel encapsulation of dests, missing for plain IPIP
+	tunnels map[string]DestTunnel
+	// netmask of the service in the kernel form, zero for the full address
+	netmask uint32
+}
+
+type memoryFwmKey struct {
+	fwmark uint32
+	af     uint16
+}
+
+// memoryIpvs is an in-memory IPVS implementation. It mimics kernel behavior
+// and errors, so GORB could be run without root privileges and ip_vs module.
+type memoryIpvs struct {
+	mutex    sync.Mutex
+	services map[memoryServiceKey]*memoryService
+	// fwmark services are kept apart, since they have no address
+	fwmServices map[memoryFwmKey]*memoryService
+	timeouts    IpvsTimeouts
+}
+
+// NewMemoryIpvs creates in-memory IPVS implementation.
+func NewMemoryIpvs() Ipvs {
+	return &memoryIpvs{services: make(map[memoryServiceKey]*memoryService),
+		fwmServices: make(map[memoryFwmKey]*memoryService), timeouts: defaultIpvsTimeouts}
+}
+
+func destKey(ip string, port uint16) string {
+	return net.JoinHostPort(ip, fmt.Sprint(port))
+}
+
+func (m *memoryIpvs) Init() error {
+	return nil
+}
+
+func (m *memoryIpvs) Exit() {}
+
+func (m *memoryIpvs) Flush() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.services = make(map[memoryServiceKey]*memoryService)
+	m.fwmServices = make(map[memoryFwmKey]*memoryService)
+	return nil
+}
+
+func (m *memoryIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return m.AddServiceWithFlags(vip, port, protocol, sched, gnl2go.BIN_NO_FLAGS)
+}
+
+func (m *memoryIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	ip := net.ParseIP(vip)
+	if ip == nil {
+		return syscall.EINVAL
+	}
+	if !ipvsSchedulers[sched] {
+		return syscall.ENOENT
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := memoryServiceKey{vip, port, protocol}
+	if _, exists := m.services[key]; exists {
+		return syscall.EEXIST
+	}
+	m.services[key] = &memoryService{
+		svc: gnl2go.Service{
+			Proto: protocol,
+			VIP:   vip,
+			Port:  port,
+			Sched: sched,
+			AF:    uint16(util.AddrFamily(ip)),
+			Flags: flags,
+		},
+		fwd:     make(map[string]uint32),
+		tunnels: make(map[string]DestTunnel),
+	}
+	return nil
+}
+
+func (m *memoryIpvs) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	if err := m.AddServiceWithFlags(vip, port, protocol, sched, flags); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.services[memoryServiceKey{vip, port, protocol}].netmask = netmask
+	return nil
+}
+
+func (m *memoryIpvs) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	if !ipvsSchedulers[sched] {
+		return syscall.ENOENT
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, exists := m.services[memoryServiceKey{vip, port, protocol}]
+	if !exists {
+		return syscall.ESRCH
+	}
+	service.svc.Sched, service.svc.Flags, service.netmask = sched, flags, netmask
+	return nil
+}
+
+func (m *memoryIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := memoryServiceKey{vip, port, protocol}
+	if _, exists := m.services[key]; !exists {
+		return syscall.ESRCH
+	}
+	delete(m.services, key)
+	return nil
+}
+
+func (m *memoryIpvs) findDest(vip string, vport uint16, rip string, rport uint16, protocol uint16) (*memoryService, int, error) {
+	service, exists := m.services[memoryServiceKey{vip, vport, protocol}]
+	if !exists {
+		return nil, 0, syscall.ESRCH
+	}
+	for i, dest := range service.dests {
+		if dest.IP == rip && dest.Port == rport {
+			return service, i, nil
+		}
+	}
+	return service, -1, nil
+}
+
+func (m *memoryIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	ip := net.ParseIP(rip)
+	if ip == nil || weight < 0 {
+		return syscall.EINVAL
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, i, err := m.findDest(vip, vport, rip, rport, protocol)
+	if err != nil {
+		return err
+	}
+	if i >= 0 {
+		return syscall.EEXIST
+	}
+	service.dests = append(service.dests, gnl2go.Dest{IP: rip, Port: rport, Weight: weight, AF: uint16(util.AddrFamily(ip))})
+	service.fwd[destKey(rip, rport)] = fwd
+	return nil
+}
+
+func (m *memoryIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	if weight < 0 {
+		return syscall.EINVAL
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, i, err := m.findDest(vip, vport, rip, rport, protocol)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return syscall.ENOENT
+	}
+	service.dests[i].Weight = weight
+	service.fwd[destKey(rip, rport)] = fwd
+	// the kernel resets encapsulation missing in updates
+	delete(service.tunnels, destKey(rip, rport))
+	return nil
+}
+
+func (m *memoryIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, i, err := m.findDest(vip, vport, rip, rport, protocol)
+	if err != nil {
+		return err
+	}
+	if i < 0 {
+		return syscall.ENOENT
+	}
+	service.dests = append(service.dests[:i], service.dests[i+1:]...)
+	delete(service.fwd, destKey(rip, rport))
+	delete(service.tunnels, destKey(rip, rport))
+	return nil
+}
+
+func (m *memoryIpvs) setDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, tunnel DestTunnel) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if service, i, err := m.findDest(vip, vport, rip, rport, protocol); err == nil && i >= 0 {
+		service.tunnels[destKey(rip, rport)] = tunnel
+	}
+}
+
+func (m *memoryIpvs) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	if err := m.AddDestPort(vip, vport, rip, rport, protocol, weight, fwd); err != nil {
+		return err
+	}
+	m.setDestTunnel(vip, vport, rip, rport, protocol, tunnel)
+	return nil
+}
+
+func (m *memoryIpvs) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	if err := m.UpdateDestPort(vip, vport, rip, rport, protocol, weight, fwd); err != nil {
+		return err
+	}
+	m.setDestTunnel(vip, vport, rip, rport, protocol, tunnel)
+	return nil
+}
+
+func (m *memoryIpvs) AddFWMService(fwmark uint32, sched string, af uint16) error {
+	if fwmark == 0 || (af != syscall.AF_INET && af != syscall.AF_INET6) {
+		return syscall.EINVAL
+	}
+	if !ipvsSchedulers[sched] {
+		return syscall.ENOENT
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := memoryFwmKey{fwmark, af}
+	if _, exists := m.fwmServices[key]; exists {
+		return syscall.EEXIST
+	}
+	m.fwmServices[key] = &memoryService{
+		svc:     gnl2go.Service{FWMark: fwmark, AF: af, Sched: sched},
+		fwd:     make(map[string]uint32),
+		tunnels: make(map[string]DestTunnel),
+	}
+	return nil
+}
+
+func (m *memoryIpvs) DelFWMService(fwmark uint32, af uint16) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	key := memoryFwmKey{fwmark, af}
+	if _, exists := m.fwmServices[key]; !exists {
+		return syscall.ESRCH
+	}
+	delete(m.fwmServices, key)
+	return nil
+}
+
+func (m *memoryIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	ip := net.ParseIP(rip)
+	if ip == nil || weight < 0 {
+		return syscall.EINVAL
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, exists := m.fwmServices[memoryFwmKey{fwmark, vaf}]
+	if !exists {
+		return syscall.ESRCH
+	}
+	for _, dest := range service.dests {
+		if dest.IP == rip && dest.Port == port {
+			return syscall.EEXIST
+		}
+	}
+	service.dests = append(service.dests, gnl2go.Dest{IP: rip, Port: port, Weight: weight, AF: uint16(util.AddrFamily(ip))})
+	service.fwd[destKey(rip, port)] = fwd
+	return nil
+}
+
+func (m *memoryIpvs) GetPools() ([]gnl2go.Pool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pools := make([]gnl2go.Pool, 0, len(m.services)+len(m.fwmServices))
+	for _, service := range m.services {
+		pools = append(pools, gnl2go.Pool{
+			Service: service.svc,
+			Dests:   append([]gnl2go.Dest(nil), service.dests...),
+		})
+	}
+	for _, service := range m.fwmServices {
+		pools = append(pools, gnl2go.Pool{
+			Service: service.svc,
+			Dests:   append([]gnl2go.Dest(nil), service.dests...),
+		})
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].Service.FWMark != pools[j].Service.FWMark {
+			return pools[i].Service.FWMark < pools[j].Service.FWMark
+		}
+		return pools[i].Service.ToString() < pools[j].Service.ToString()
+	})
+	return pools, nil
+}
+
+func (m *memoryIpvs) GetTimeouts() (IpvsTimeouts, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.timeouts, nil
+}
+
+func (m *memoryIpvs) SetTimeouts(timeouts IpvsTimeouts) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if timeouts.TCP != 0 {
+		m.timeouts.TCP = timeouts.TCP
+	}
+	if timeouts.TCPFin != 0 {
+		m.timeouts.TCPFin = timeouts.TCPFin
+	}
+	if timeouts.UDP != 0 {
+		m.timeouts.UDP = timeouts.UDP
+	}
+	return nil
+}
+
+// GetActiveConns reports no connections, since in-memory IPVS doesn't forward traffic.
+func (m *memoryIpvs) GetActiveConns(vip string, port uint16, protocol uint16) (map[string]uint32, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service, exists := m.services[memoryServiceKey{vip, port, protocol}]
+	if !exists {
+		return nil, syscall.ESRCH
+	}
+	conns := make(map[string]uint32, len(service.dests))
+	for _, dest := range service.dests {
+		conns[destKey(dest.IP, dest.Port)] = 0
+	}
+	return conns, nil
+}
+
+// GetServiceStats reports zero counters, since in-memory IPVS doesn't forward traffic.
+func (m *memoryIpvs) GetServiceStats() (map[string]IpvsStats, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := make(map[string]IpvsStats, len(m.services)+len(m.fwmServices))
+	for _, service := range m.services {
+		stats[service.svc.ToString()] = IpvsStats{}
+	}
+	for _, service := range m.fwmServices {
+		stats[service.svc.ToString()] = IpvsStats{}
+	}
+	return stats, nil
+}
+
+// ListConns reports no connections, since in-memory IPVS doesn't forward traffic.
+func (m *memoryIpvs) ListConns(vip string, port uint16, protocol uint16) ([]IpvsConn, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.services[memoryServiceKey{vip, port, protocol}]; !exists {
+		return nil, syscall.ESRCH
+	}
+	return []IpvsConn{}, nil
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryIpvs(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	require.NoError(t, ipvs.Init())
+
+	assert.NoError(t, ipvs.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+	assert.Equal(t, syscall.EEXIST, ipvs.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+	assert.Equal(t, syscall.ENOENT, ipvs.AddService("10.0.0.1", 81, syscall.IPPROTO_TCP, "unknown"))
+
+	assert.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+	assert.Equal(t, syscall.EEXIST, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+	assert.Equal(t, syscall.ESRCH, ipvs.AddDestPort("10.0.0.2", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+	assert.NoError(t, ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 50, 0))
+
+	pools, err := ipvs.GetPools()
+	require.NoError(t, err)
+	require.Len(t, pools, 1)
+	require.Len(t, pools[0].Dests, 1)
+	assert.Equal(t, int32(50), pools[0].Dests[0].Weight)
+
+	assert.NoError(t, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP))
+	assert.Equal(t, syscall.ENOENT, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP))
+	assert.NoError(t, ipvs.DelService("10.0.0.1", 80, syscall.IPPROTO_TCP))
+
+	pools, err = ipvs.GetPools()
+	require.NoError(t, err)
+	assert.Empty(t, pools)
+}
+
+func TestContextWithMemoryIpvs(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+
+	err := c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", Pulse: nil},
+		ServiceBackends: map[string]*BackendOptions{
+			rsID: {Host: "127.0.0.2", Port: 8080},
+		},
+	})
+	require.NoError(t, err)
+
+	pools, err := ipvs.GetPools()
+	require.NoError(t, err)
+	require.Len(t, pools, 1)
+	assert.Equal(t, "wrr", pools[0].Service.Sched)
+	require.Len(t, pools[0].Dests, 1)
+	assert.Equal(t, int32(100), pools[0].Dests[0].Weight)
+	close(c.stopCh)
+}
+
+func TestContextWithTunnel(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	err := c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", FwdMethod: "tunnel",
+			Tunnel: &TunnelOptions{Type: "gue", Port: 6080, Checksum: "csum"}},
+		ServiceBackends: map[string]*BackendOptions{
+			rsID: {Host: "127.0.0.2", Port: 80},
+		},
+	})
+	require.NoError(t, err)
+
+	service := ipvs.(*memoryIpvs).services[memoryServiceKey{"127.0.0.1", 80, syscall.IPPROTO_TCP}]
+	require.NotNil(t, service)
+	tunnel := DestTunnel{Type: tunnelTypeGUE, Port: 6080, Flags: tunnelFlagCsum}
+	assert.Equal(t, tunnel, service.tunnels[destKey("127.0.0.2", 80)])
+
+	// encapsulation is kept by weight updates
+	_, err = c.UpdateBackend(vsID, rsID, 50)
+	require.NoError(t, err)
+	assert.Equal(t, tunnel, service.tunnels[destKey("127.0.0.2", 80)])
+}
+
+func TestBackendPortOfDirectRouting(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	config := &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", FwdMethod: "dr"},
+		ServiceBackends: map[string]*BackendOptions{
+			rsID: {Host: "127.0.0.2", Port: 8080},
+		},
+	}
+	err := c.CreateService(vsID, config)
+	assert.ErrorIs(t, err, ErrBackendPort)
+	assert.EqualError(t, err, "backends of dr and tunnel services must listen on the service port: "+
+		"backend [realServerID] port 8080, service port 80, dr forwarding doesn't map ports")
+	assert.Empty(t, c.services, "service with mismatched backends must not be created")
+
+	config.ServiceBackends[rsID].Port = 80
+	require.NoError(t, c.CreateService(vsID, config))
+	assert.ErrorIs(t, c.CreateBackend(vsID, "other", &BackendOptions{Host: "127.0.0.3", Port: 8080}), ErrBackendPort)
+	assert.NoError(t, c.CreateBackend(vsID, "other", &BackendOptions{Host: "127.0.0.3", Port: 80}))
+}
@@ -0,0 +1,355 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+)
+
+// DefaultIpvsQueueDepth is a number of IPVS operations allowed to wait for the worker.
+const DefaultIpvsQueueDepth = 1024
+
+// Possible IPVS queue errors.
+var (
+	ErrIpvsQueueFull    = errors.New("IPVS operation queue is full")
+	errIpvsQueueStopped = errors.New("IPVS operation queue is stopped")
+)
+
+// IpvsOperationStats are counters of calls of an IPVS operation.
+type IpvsOperationStats struct {
+	Calls  uint64 `json:"calls"`
+	Errors uint64 `json:"errors"`
+	// Latency is the total time calls took, Wait is the total time they were queued for.
+	Latency time.Duration `json:"latency"`
+	Wait    time.Duration `json:"wait"`
+}
+
+// IpvsQueueStats are counters of the IPVS operation queue.
+type IpvsQueueStats struct {
+	// Depth is a number of operations allowed to wait, Pending are waiting now.
+	Depth   int `json:"depth"`
+	Pending int `json:"pending"`
+	// Rejected operations didn't fit into the queue.
+	Rejected   uint64                        `json:"rejected"`
+	Operations map[string]IpvsOperationStats `json:"operations"`
+}
+
+type ipvsOperation struct {
+	name     string
+	call     func() error
+	queuedAt time.Time
+	done     chan error
+}
+
+// queuedIpvs runs IPVS calls one by one on a single worker, so netlink access is
+// serialized no matter which locks callers hold. Callers wait for results of
+// their calls, but fail at once if the queue is full instead of piling up.
+type queuedIpvs struct {
+	Ipvs
+	ops    chan *ipvsOperation
+	stopCh chan struct{}
+	doneCh chan struct{}
+	once   sync.Once
+
+	mutex    sync.Mutex
+	rejected uint64
+	stats    map[string]IpvsOperationStats
+	// enqueued is called once the next write is queued, so its caller could let
+	// others go on while the write waits for its turn
+	enqueued atomic.Pointer[func()]
+}
+
+func newQueuedIpvs(ipvs Ipvs, depth int) *queuedIpvs {
+	if depth <= 0 {
+		depth = DefaultIpvsQueueDepth
+	}
+	q := &queuedIpvs{
+		Ipvs:   ipvs,
+		ops:    make(chan *ipvsOperation, depth),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+		stats:  make(map[string]IpvsOperationStats),
+	}
+	go q.run()
+	return q
+}
+
+func (q *queuedIpvs) run() {
+	defer close(q.doneCh)
+	for {
+		select {
+		case op := <-q.ops:
+			start := time.Now()
+			err := op.call()
+			q.record(op.name, start.Sub(op.queuedAt), time.Since(start), err)
+			op.done <- err
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+func (q *queuedIpvs) record(name string, wait, latency time.Duration, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats[name]
+	stats.Calls++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.Latency += latency
+	stats.Wait += wait
+	q.stats[name] = stats
+}
+
+// do queues the write call and waits for its result.
+func (q *queuedIpvs) do(name string, call func() error) error {
+	return q.perform(name, call, true)
+}
+
+// read queues the read call and waits for its result. Reads don't call enqueued,
+// since they could come from callers not holding the context mutex.
+func (q *queuedIpvs) read(name string, call func() error) error {
+	return q.perform(name, call, false)
+}
+
+func (q *queuedIpvs) perform(name string, call func() error, write bool) error {
+	op := &ipvsOperation{name: name, call: call, queuedAt: time.Now(), done: make(chan error, 1)}
+	select {
+	case <-q.stopCh:
+		return errIpvsQueueStopped
+	case q.ops <- op:
+		if enqueued := q.enqueued.Load(); write && enqueued != nil && q.enqueued.CompareAndSwap(enqueued, nil) {
+			(*enqueued)()
+		}
+	default:
+		q.mutex.Lock()
+		q.rejected++
+		q.mutex.Unlock()
+		log.Warnf("IPVS operation queue is full, rejecting %s", name)
+		return ErrIpvsQueueFull
+	}
+	select {
+	case err := <-op.done:
+		return err
+	case <-q.doneCh:
+		// the worker could have run the operation before it stopped
+		select {
+		case err := <-op.done:
+			return err
+		default:
+			return errIpvsQueueStopped
+		}
+	}
+}
+
+// Stats returns counters of the queue and its operations.
+func (q *queuedIpvs) Stats() IpvsQueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := IpvsQueueStats{Depth: cap(q.ops), Pending: len(q.ops), Rejected: q.rejected,
+		Operations: make(map[string]IpvsOperationStats, len(q.stats))}
+	for name, operation := range q.stats {
+		stats.Operations[name] = operation
+	}
+	return stats
+}
+
+// IpvsQueueStats returns counters of the IPVS operation queue, or nil if IPVS
+// calls aren't queued.
+func (ctx *Context) IpvsQueueStats() *IpvsQueueStats {
+	if ctx.ipvsQueue == nil {
+		return nil
+	}
+	stats := ctx.ipvsQueue.Stats()
+	return &stats
+}
+
+// Exit stops the worker, operations still queued are abandoned.
+func (q *queuedIpvs) Exit() {
+	q.once.Do(func() {
+		close(q.stopCh)
+		<-q.doneCh
+		q.Ipvs.Exit()
+	})
+}
+
+func (q *queuedIpvs) Flush() error {
+	return q.do("Flush", q.Ipvs.Flush)
+}
+
+func (q *queuedIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return q.do("AddService", func() error {
+		return q.Ipvs.AddService(vip, port, protocol, sched)
+	})
+}
+
+func (q *queuedIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	return q.do("AddService", func() error {
+		return q.Ipvs.AddServiceWithFlags(vip, port, protocol, sched, flags)
+	})
+}
+
+func (q *queuedIpvs) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	netmasker, ok := q.Ipvs.(IpvsNetmasker)
+	if !ok {
+		return ErrNetmaskUnsupported
+	}
+	return q.do("AddService", func() error {
+		return netmasker.AddServiceWithNetmask(vip, port, protocol, sched, flags, netmask)
+	})
+}
+
+func (q *queuedIpvs) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	updater, ok := q.Ipvs.(IpvsServiceUpdater)
+	if !ok {
+		return ErrServiceUpdateUnsupported
+	}
+	return q.do("UpdateService", func() error {
+		return updater.UpdateService(vip, port, protocol, sched, flags, netmask)
+	})
+}
+
+func (q *queuedIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	return q.do("DelService", func() error {
+		return q.Ipvs.DelService(vip, port, protocol)
+	})
+}
+
+func (q *queuedIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return q.do("AddDest", func() error {
+		return q.Ipvs.AddDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+	})
+}
+
+func (q *queuedIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return q.do("UpdateDest", func() error {
+		return q.Ipvs.UpdateDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+	})
+}
+
+func (q *queuedIpvs) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := q.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return q.do("AddDest", func() error {
+		return tunneler.AddDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+	})
+}
+
+func (q *queuedIpvs) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := q.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return q.do("UpdateDest", func() error {
+		return tunneler.UpdateDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+	})
+}
+
+func (q *queuedIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	return q.do("DelDest", func() error {
+		return q.Ipvs.DelDestPort(vip, vport, rip, rport, protocol)
+	})
+}
+
+func (q *queuedIpvs) AddFWMService(fwmark uint32, sched string, af uint16) error {
+	fwmarker, ok := q.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return q.do("AddService", func() error {
+		return fwmarker.AddFWMService(fwmark, sched, af)
+	})
+}
+
+func (q *queuedIpvs) DelFWMService(fwmark uint32, af uint16) error {
+	fwmarker, ok := q.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return q.do("DelService", func() error {
+		return fwmarker.DelFWMService(fwmark, af)
+	})
+}
+
+func (q *queuedIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	fwmarker, ok := q.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return q.do("AddDest", func() error {
+		return fwmarker.AddFWMDestFWD(fwmark, rip, vaf, port, weight, fwd)
+	})
+}
+
+func (q *queuedIpvs) SetTimeouts(timeouts IpvsTimeouts) error {
+	return q.do("SetTimeouts", func() error {
+		return q.Ipvs.SetTimeouts(timeouts)
+	})
+}
+
+// Reads share the netlink socket with writes, so they are queued too.
+
+func (q *queuedIpvs) GetTimeouts() (timeouts IpvsTimeouts, err error) {
+	err = q.read("GetTimeouts", func() error {
+		timeouts, err = q.Ipvs.GetTimeouts()
+		return err
+	})
+	return timeouts, err
+}
+
+func (q *queuedIpvs) GetPools() (pools []gnl2go.Pool, err error) {
+	err = q.read("GetPools", func() error {
+		pools, err = q.Ipvs.GetPools()
+		return err
+	})
+	return pools, err
+}
+
+func (q *queuedIpvs) GetActiveConns(vip string, port uint16, protocol uint16) (conns map[string]uint32, err error) {
+	counter, ok := q.Ipvs.(IpvsConnCounter)
+	if !ok {
+		return nil, errIpvsConnsUnsupported
+	}
+	err = q.read("GetActiveConns", func() error {
+		conns, err = counter.GetActiveConns(vip, port, protocol)
+		return err
+	})
+	return conns, err
+}
+
+func (q *queuedIpvs) ListConns(vip string, port uint16, protocol uint16) (conns []IpvsConn, err error) {
+	lister, ok := q.Ipvs.(IpvsConnLister)
+	if !ok {
+		return nil, errIpvsConnListUnsupported
+	}
+	err = q.read("ListConns", func() error {
+		conns, err = lister.ListConns(vip, port, protocol)
+		return err
+	})
+	return conns, err
+}
+
+func (q *queuedIpvs) GetServiceStats() (stats map[string]IpvsStats, err error) {
+	reader, ok := q.Ipvs.(IpvsStatsReader)
+	if !ok {
+		return nil, errIpvsStatsUnsupported
+	}
+	err = q.read("GetServiceStats", func() error {
+		stats, err = reader.GetServiceStats()
+		return err
+	})
+	return stats, err
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingIpvs blocks destination updates until released and tracks how many
+// calls run at once.
+type blockingIpvs struct {
+	Ipvs
+	release chan struct{}
+	running atomic.Int32
+	overlap atomic.Bool
+}
+
+func (b *blockingIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	if b.running.Add(1) > 1 {
+		b.overlap.Store(true)
+	}
+	defer b.running.Add(-1)
+	<-b.release
+	return b.Ipvs.UpdateDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+}
+
+func TestQueuedIpvs(t *testing.T) {
+	ipvs := &blockingIpvs{Ipvs: NewMemoryIpvs(), release: make(chan struct{})}
+	q := newQueuedIpvs(ipvs, 2)
+	defer q.Exit()
+
+	require.NoError(t, q.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+	require.NoError(t, q.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+
+	// one call runs and two wait, the next one doesn't fit
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- q.UpdateDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 50, 0)
+		}()
+	}
+	require.Eventually(t, func() bool { return ipvs.running.Load() == 1 && q.Stats().Pending == 2 },
+		time.Second, time.Millisecond)
+	assert.Equal(t, ErrIpvsQueueFull, q.DelService("10.0.0.1", 80, syscall.IPPROTO_TCP))
+
+	close(ipvs.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.False(t, ipvs.overlap.Load())
+
+	stats := q.Stats()
+	assert.Equal(t, 2, stats.Depth)
+	assert.Equal(t, 0, stats.Pending)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Equal(t, uint64(3), stats.Operations["UpdateDest"].Calls)
+	assert.Equal(t, uint64(1), stats.Operations["AddService"].Calls)
+	assert.NotZero(t, stats.Operations["UpdateDest"].Wait)
+	_, exists := stats.Operations["DelService"]
+	assert.False(t, exists)
+
+	// failed calls are counted as errors
+	assert.Error(t, q.DelService("10.0.0.2", 80, syscall.IPPROTO_TCP))
+	assert.Equal(t, uint64(1), q.Stats().Operations["DelService"].Errors)
+
+	q.Exit()
+	assert.Equal(t, errIpvsQueueStopped, q.Flush())
+}
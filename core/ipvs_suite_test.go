@@ -0,0 +1,185 @@
+package core
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tehnerd/gnl2go"
+)
+
+// findPool returns the pool of the IPVS service, pools aren't ordered by every backend.
+func findPool(t *testing.T, ipvs Ipvs, vip string, port uint16, protocol uint16) *gnl2go.Pool {
+	pools, err := ipvs.GetPools()
+	require.NoError(t, err)
+	for i := range pools {
+		if svc := pools[i].Service; svc.VIP == vip && svc.Port == port && svc.Proto == protocol {
+			return &pools[i]
+		}
+	}
+	return nil
+}
+
+// testIpvsBackend exercises data plane paths GORB relies on, so every IPVS
+// backend behaves the same way. It runs against the in-memory IPVS in unit
+// tests and against the kernel in the integration suite. IPVS must be empty.
+func testIpvsBackend(t *testing.T, ipvs Ipvs) {
+	t.Run("services", func(t *testing.T) {
+		require.NoError(t, ipvs.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+		assert.Error(t, ipvs.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+		require.NoError(t, ipvs.AddService("10.0.0.1", 53, syscall.IPPROTO_UDP, "rr"))
+		require.NoError(t, ipvs.AddService("fd00::1", 80, syscall.IPPROTO_TCP, "wrr"))
+
+		pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		assert.Equal(t, "wrr", pool.Service.Sched)
+		assert.Equal(t, uint16(syscall.AF_INET), pool.Service.AF)
+		pool = findPool(t, ipvs, "fd00::1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		assert.Equal(t, uint16(syscall.AF_INET6), pool.Service.AF)
+		assert.NotNil(t, findPool(t, ipvs, "10.0.0.1", 53, syscall.IPPROTO_UDP))
+	})
+
+	t.Run("destinations", func(t *testing.T) {
+		require.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+		assert.Error(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+		assert.Error(t, ipvs.AddDestPort("10.0.0.2", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+		require.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.2", 8080, syscall.IPPROTO_TCP, 0, 0))
+		require.NoError(t, ipvs.AddDestPort("fd00::1", 80, "fd01::1", 8080, syscall.IPPROTO_TCP, 10, 0))
+
+		require.NoError(t, ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 50, 0))
+		assert.Error(t, ipvs.UpdateDestPort("10.0.0.1", 80, "10.1.0.9", 8080, syscall.IPPROTO_TCP, 50, 0))
+
+		pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		weights := make(map[string]int32)
+		for _, dest := range pool.Dests {
+			weights[destKey(dest.IP, dest.Port)] = dest.Weight
+		}
+		assert.Equal(t, map[string]int32{"10.1.0.1:8080": 50, "10.1.0.2:8080": 0}, weights)
+		pool = findPool(t, ipvs, "fd00::1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		require.Len(t, pool.Dests, 1)
+		assert.Equal(t, "fd01::1", pool.Dests[0].IP)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		counter, ok := ipvs.(IpvsConnCounter)
+		if !ok {
+			t.Skip("connection counters aren't supported")
+		}
+		conns, err := counter.GetActiveConns("10.0.0.1", 80, syscall.IPPROTO_TCP)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]uint32{"10.1.0.1:8080": 0, "10.1.0.2:8080": 0}, conns)
+		_, err = counter.GetActiveConns("10.0.0.2", 80, syscall.IPPROTO_TCP)
+		assert.Error(t, err)
+
+		if lister, ok := ipvs.(IpvsConnLister); ok {
+			list, err := lister.ListConns("10.0.0.1", 80, syscall.IPPROTO_TCP)
+			require.NoError(t, err)
+			assert.Empty(t, list)
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		require.NoError(t, ipvs.SetTimeouts(IpvsTimeouts{TCP: 600, TCPFin: 60, UDP: 120}))
+		timeouts, err := ipvs.GetTimeouts()
+		require.NoError(t, err)
+		assert.Equal(t, IpvsTimeouts{TCP: 600, TCPFin: 60, UDP: 120}, timeouts)
+	})
+
+	t.Run("fwmark", func(t *testing.T) {
+		fwmarker, ok := ipvs.(IpvsFwmarker)
+		if !ok {
+			t.Skip("fwmark services aren't supported")
+		}
+		require.NoError(t, fwmarker.AddFWMService(pinMarkBase+1, "wrr", syscall.AF_INET))
+		require.NoError(t, fwmarker.AddFWMDestFWD(pinMarkBase+1, "10.1.0.1", syscall.AF_INET, 8080, 1, 0))
+		pools, err := ipvs.GetPools()
+		require.NoError(t, err)
+		var pool *gnl2go.Pool
+		for i := range pools {
+			if pools[i].Service.FWMark == pinMarkBase+1 {
+				pool = &pools[i]
+			}
+		}
+		require.NotNil(t, pool)
+		require.Len(t, pool.Dests, 1)
+		assert.Equal(t, "10.1.0.1", pool.Dests[0].IP)
+		require.NoError(t, fwmarker.DelFWMService(pinMarkBase+1, syscall.AF_INET))
+	})
+
+	t.Run("service update", func(t *testing.T) {
+		updater, ok := ipvs.(IpvsServiceUpdater)
+		if !ok {
+			t.Skip("service updates aren't supported")
+		}
+		require.NoError(t, updater.UpdateService("10.0.0.1", 80, syscall.IPPROTO_TCP, "rr", gnl2go.U32ToBinFlags(0),
+			1<<32-1))
+		assert.Error(t, updater.UpdateService("10.0.0.2", 80, syscall.IPPROTO_TCP, "rr", gnl2go.U32ToBinFlags(0),
+			1<<32-1))
+		pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		assert.Equal(t, "rr", pool.Service.Sched)
+		assert.Len(t, pool.Dests, 2, "destinations are kept")
+	})
+
+	t.Run("removal", func(t *testing.T) {
+		require.NoError(t, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.2", 8080, syscall.IPPROTO_TCP))
+		assert.Error(t, ipvs.DelDestPort("10.0.0.1", 80, "10.1.0.2", 8080, syscall.IPPROTO_TCP))
+		pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+		require.NotNil(t, pool)
+		assert.Len(t, pool.Dests, 1)
+
+		require.NoError(t, ipvs.DelService("10.0.0.1", 80, syscall.IPPROTO_TCP))
+		assert.Error(t, ipvs.DelService("10.0.0.1", 80, syscall.IPPROTO_TCP))
+		assert.Nil(t, findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP))
+
+		require.NoError(t, ipvs.Flush())
+		pools, err := ipvs.GetPools()
+		require.NoError(t, err)
+		assert.Empty(t, pools)
+	})
+}
+
+// testContextIpvs runs service and backend lifecycle of the context against the IPVS backend.
+func testContextIpvs(t *testing.T, ipvs Ipvs) {
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "10.0.0.1", uint16(80)).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", vsID).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "10.0.0.1", Port: 80, MaxWeight: 50},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "10.1.0.1", Port: 8080}},
+	}))
+	require.NoError(t, c.CreateBackend(vsID, "other", &BackendOptions{Host: "10.1.0.2", Port: 8080}))
+	_, err := c.UpdateBackend(vsID, rsID, 7)
+	require.NoError(t, err)
+
+	pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+	require.NotNil(t, pool)
+	weights := make(map[string]int32)
+	for _, dest := range pool.Dests {
+		weights[destKey(dest.IP, dest.Port)] = dest.Weight
+	}
+	assert.Equal(t, map[string]int32{"10.1.0.1:8080": 7, "10.1.0.2:8080": 50}, weights)
+	drift, err := c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Empty(t, drift.Missing)
+	assert.Empty(t, drift.Extra)
+
+	_, err = c.RemoveBackend(vsID, "other")
+	require.NoError(t, err)
+	_, err = c.RemoveService(vsID)
+	require.NoError(t, err)
+	assert.Nil(t, findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP))
+}
+
+func TestMemoryIpvsSuite(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	require.NoError(t, ipvs.Init())
+	testIpvsBackend(t, ipvs)
+	testContextIpvs(t, ipvs)
+}
@@ -0,0 +1,273 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ipvsadm forwarding method options and their GORB names
+var ipvsadmFwdMethods = map[string]string{
+	"-g": "dr", "--gatewaying": "dr",
+	"-m": "nat", "--masquerading": "nat",
+	"-i": "tunnel", "--ipip": "tunnel",
+}
+
+// ipvsadmRule is a single parsed rule of ipvsadm -S output.
+type ipvsadmRule struct {
+	command   string
+	protocol  string
+	address   string
+	server    string
+	scheduler string
+	flags     string
+	fwd       string
+	weight    string
+	persist   bool
+	tunnel    *TunnelOptions
+}
+
+func parseIpvsadmRule(fields []string) (*ipvsadmRule, error) {
+	rule := &ipvsadmRule{command: fields[0]}
+	for i := 1; i < len(fields); i++ {
+		option := fields[i]
+		value := func() (string, error) {
+			if i+1 >= len(fields) {
+				return "", fmt.Errorf("option %s requires a value", option)
+			}
+			i++
+			return fields[i], nil
+		}
+		var err error
+		switch option {
+		case "-t", "--tcp-service":
+			rule.protocol = "tcp"
+			rule.address, err = value()
+		case "-u", "--udp-service":
+			rule.protocol = "udp"
+			rule.address, err = value()
+		case "-f", "--fwmark-service":
+			return nil, fmt.Errorf("fwmark services are not supported")
+		case "-s", "--scheduler":
+			rule.scheduler, err = value()
+		case "-b", "--sched-flags":
+			rule.flags, err = value()
+		case "-r", "--real-server":
+			rule.server, err = value()
+		case "-w", "--weight":
+			rule.weight, err = value()
+		case "-p", "--persistent":
+			rule.persist = true
+			// timeout of persistence is optional
+			if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+				i++
+			}
+		case "-g", "--gatewaying", "-m", "--masquerading", "-i", "--ipip":
+			rule.fwd = ipvsadmFwdMethods[option]
+		case "--tun-type":
+			rule.tunnelOptions().Type, err = value()
+		case "--tun-port":
+			var port string
+			if port, err = value(); err == nil {
+				var value uint64
+				value, err = strconv.ParseUint(port, 10, 16)
+				rule.tunnelOptions().Port = uint16(value)
+			}
+		case "--tun-csum":
+			rule.tunnelOptions().Checksum = "csum"
+		case "--tun-remcsum":
+			rule.tunnelOptions().Checksum = "remcsum"
+		case "-x", "--u-threshold", "-y", "--l-threshold", "-M", "--netmask", "--pe":
+			// not supported by GORB, skip the value
+			_, err = value()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rule.address == "" {
+		return nil, fmt.Errorf("virtual service address is missing")
+	}
+	return rule, nil
+}
+
+func (r *ipvsadmRule) tunnelOptions() *TunnelOptions {
+	if r.tunnel == nil {
+		r.tunnel = &TunnelOptions{}
+	}
+	return r.tunnel
+}
+
+func splitIpvsadmAddress(address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, uint16(value), nil
+}
+
+// ParseIpvsadm converts rules in `ipvsadm -Sn` format into GORB services.
+// Service IDs are "<host>-<port>-<protocol>", backend IDs are "<host>-<port>".
+// The common weight of real servers becomes the maximum weight of their service
+// and real servers with zero weight are imported as inactive ones.
+// Rules GORB couldn't express exactly are reported as warnings.
+func ParseIpvsadm(r io.Reader) (map[string]*ServiceConfig, []string, error) {
+	var (
+		services = make(map[string]*ServiceConfig)
+		warnings []string
+		// service IDs by "protocol address" and common weights of their real servers
+		ids     = make(map[string]string)
+		weights = make(map[string]int32)
+	)
+	warnf := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "-A", "--add-service", "-a", "--add-server":
+		default:
+			warnf("line %d: command %s is not supported", line, fields[0])
+			continue
+		}
+		rule, err := parseIpvsadmRule(fields)
+		if err != nil {
+			warnf("line %d: %s", line, err)
+			continue
+		}
+		host, port, err := splitIpvsadmAddress(rule.address)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		key := rule.protocol + " " + rule.address
+
+		if rule.command == "-A" || rule.command == "--add-service" {
+			vsID := fmt.Sprintf("%s-%d-%s", host, port, rule.protocol)
+			ids[key] = vsID
+			services[vsID] = &ServiceConfig{
+				ServiceOptions: &ServiceOptions{
+					Host:       host,
+					Port:       port,
+					Protocol:   rule.protocol,
+					LbMethod:   rule.scheduler,
+					ShFlags:    strings.ReplaceAll(rule.flags, ",", "|"),
+					Persistent: rule.persist,
+				},
+				ServiceBackends: make(map[string]*BackendOptions),
+			}
+			continue
+		}
+
+		vsID, exists := ids[key]
+		if !exists {
+			warnf("line %d: real server of unknown service %s", line, rule.address)
+			continue
+		}
+		if rule.server == "" {
+			warnf("line %d: real server address is missing", line)
+			continue
+		}
+		rsHost, rsPort, err := splitIpvsadmAddress(rule.server)
+		if err != nil {
+			// port of real server could be omitted for DR and tunneling
+			rsHost, rsPort = strings.Trim(rule.server, "[]"), port
+		}
+		weight := int64(-1)
+		if rule.weight != "" {
+			if weight, err = strconv.ParseInt(rule.weight, 10, 32); err != nil || weight < 0 {
+				warnf("line %d: invalid weight %q of real server %s", line, rule.weight, rule.server)
+				weight = -1
+			}
+		}
+		service := services[vsID]
+		// drained real servers are kept inactive until they are activated
+		service.ServiceBackends[fmt.Sprintf("%s-%d", rsHost, rsPort)] = &BackendOptions{Host: rsHost, Port: rsPort,
+			Inactive: weight == 0}
+
+		options := service.ServiceOptions
+		if rule.fwd != "" && options.FwdMethod == "" {
+			options.FwdMethod = rule.fwd
+			options.Tunnel = rule.tunnel
+		} else if rule.fwd != "" && rule.fwd != options.FwdMethod {
+			warnf("line %d: service %s: per real server forwarding methods are not supported, %s is used",
+				line, vsID, options.FwdMethod)
+		}
+		if weight <= 0 {
+			continue
+		}
+		// the common weight of real servers is the maximum weight of the service
+		if common, exists := weights[vsID]; !exists {
+			weights[vsID] = int32(weight)
+			options.MaxWeight = int32(weight)
+		} else if common != int32(weight) {
+			warnf("line %d: service %s: per real server weights are not supported, %d is used", line, vsID, common)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return services, warnings, nil
+}
+
+// ExportIpvsadm returns services and backends with their current weights
+// in `ipvsadm -Sn` format, so they could be loaded with `ipvsadm -R`.
+// Persistence isn't exported since GORB doesn't set it in IPVS.
+func (ctx *Context) ExportIpvsadm() string {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	var b strings.Builder
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		options := vs.options
+		protocol := "-t"
+		if options.protocol == syscall.IPPROTO_UDP {
+			protocol = "-u"
+		}
+		address := net.JoinHostPort(options.host.String(), fmt.Sprint(options.Port))
+		fmt.Fprintf(&b, "-A %s %s -s %s", protocol, address, options.LbMethod)
+		if options.ShFlags != "" {
+			fmt.Fprintf(&b, " -b %s", strings.ReplaceAll(options.ShFlags, "|", ","))
+		}
+		b.WriteString("\n")
+
+		fwd := "-m"
+		switch options.FwdMethod {
+		case "dr":
+			fwd = "-g"
+		case "tunnel", "ipip":
+			fwd = "-i"
+			if tunnel := options.Tunnel; tunnel != nil {
+				fwd += " --tun-type " + tunnel.Type
+				if tunnel.Port != 0 {
+					fwd += fmt.Sprintf(" --tun-port %d", tunnel.Port)
+				}
+				switch tunnel.Checksum {
+				case "csum":
+					fwd += " --tun-csum"
+				case "remcsum":
+					fwd += " --tun-remcsum"
+				}
+			}
+		}
+		for _, rsID := range sortedKeys(vs.backends) {
+			backend := vs.backends[rsID].options
+			fmt.Fprintf(&b, "-a %s %s -r %s %s -w %d\n", protocol, address,
+				net.JoinHostPort(backend.host.String(), fmt.Sprint(backend.Port)), fwd, backend.weight)
+		}
+	}
+	return b.String()
+}
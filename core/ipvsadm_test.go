@@ -0,0 +1,92 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const ipvsadmRules = `-A -t 127.0.0.1:80 -s sh -b sh-port,sh-fallback -p 300
+-a -t 127.0.0.1:80 -r 127.0.0.2:8080 -m -w 1
+-a -t 127.0.0.1:80 -r 127.0.0.3:8080 -g -w 2
+-A -u 127.0.0.1:53 -s rr
+-a -u 127.0.0.1:53 -r 127.0.0.4 -g -w 1
+-A -f 1 -s rr
+-a -t 127.0.0.9:80 -r 127.0.0.5:80 -m -w 1
+-A -u 127.0.0.1:443 -s rr
+-a -u 127.0.0.1:443 -r 127.0.0.6:443 -i --tun-type gue --tun-port 6080 --tun-remcsum -w 1
+-a -u 127.0.0.1:443 -r 127.0.0.7:443 -i -w 0
+`
+
+func TestParseIpvsadm(t *testing.T) {
+	services, warnings, err := ParseIpvsadm(strings.NewReader(ipvsadmRules))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]*ServiceConfig{
+		"127.0.0.1-80-tcp": {
+			ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 80, Protocol: "tcp", LbMethod: "sh",
+				ShFlags: "sh-port|sh-fallback", Persistent: true, FwdMethod: "nat", MaxWeight: 1},
+			ServiceBackends: map[string]*BackendOptions{
+				"127.0.0.2-8080": {Host: "127.0.0.2", Port: 8080},
+				"127.0.0.3-8080": {Host: "127.0.0.3", Port: 8080},
+			},
+		},
+		"127.0.0.1-53-udp": {
+			ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 53, Protocol: "udp", LbMethod: "rr", FwdMethod: "dr",
+				MaxWeight: 1},
+			ServiceBackends: map[string]*BackendOptions{
+				"127.0.0.4-53": {Host: "127.0.0.4", Port: 53},
+			},
+		},
+		"127.0.0.1-443-udp": {
+			ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 443, Protocol: "udp", LbMethod: "rr",
+				FwdMethod: "tunnel", Tunnel: &TunnelOptions{Type: "gue", Port: 6080, Checksum: "remcsum"}, MaxWeight: 1},
+			ServiceBackends: map[string]*BackendOptions{
+				"127.0.0.6-443": {Host: "127.0.0.6", Port: 443},
+				"127.0.0.7-443": {Host: "127.0.0.7", Port: 443, Inactive: true},
+			},
+		},
+	}, services)
+	assert.Equal(t, []string{
+		"line 3: service 127.0.0.1-80-tcp: per real server forwarding methods are not supported, nat is used",
+		"line 3: service 127.0.0.1-80-tcp: per real server weights are not supported, 1 is used",
+		"line 6: fwmark services are not supported",
+		"line 7: real server of unknown service 127.0.0.9:80",
+	}, warnings)
+}
+
+func TestExportIpvsadm(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	// weights and drained real servers are kept
+	rules := "-A -t 127.0.0.1:80 -s sh -b sh-port\n" +
+		"-a -t 127.0.0.1:80 -r 127.0.0.2:80 -g -w 5\n" +
+		"-a -t 127.0.0.1:80 -r 127.0.0.3:80 -g -w 0\n"
+	services, _, err := ParseIpvsadm(strings.NewReader(rules))
+	require.NoError(t, err)
+	for vsID, service := range services {
+		require.NoError(t, c.CreateService(vsID, service))
+	}
+
+	assert.Equal(t, rules, c.ExportIpvsadm())
+}
+
+func TestExportIpvsadmTunnel(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	rules := "-A -u 127.0.0.1:443 -s wrr\n" +
+		"-a -u 127.0.0.1:443 -r 127.0.0.2:443 -i --tun-type gue --tun-port 6080 --tun-csum -w 100\n"
+	services, _, err := ParseIpvsadm(strings.NewReader(rules))
+	require.NoError(t, err)
+	for vsID, service := range services {
+		require.NoError(t, c.CreateService(vsID, service))
+	}
+	assert.Equal(t, rules, c.ExportIpvsadm())
+}
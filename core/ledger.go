@@ -0,0 +1,329 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrLedgerRequired is returned if orphans cleanup is requested without a ledger.
+var ErrLedgerRequired = errors.New("cleanup of orphaned IPVS entries requires an ownership ledger")
+
+// LedgerService is an IPVS service created by GORB.
+type LedgerService struct {
+	VIP      string `json:"vip"`
+	Port     uint16 `json:"port"`
+	Protocol uint16 `json:"protocol"`
+}
+
+// LedgerDest is an IPVS destination created by GORB.
+type LedgerDest struct {
+	LedgerService
+	RIP   string `json:"rip"`
+	RPort uint16 `json:"rport"`
+}
+
+// ledgerState is the content of the ledger file.
+type ledgerState struct {
+	Services []LedgerService `json:"services"`
+	Dests    []LedgerDest    `json:"dests"`
+}
+
+// ownershipLedger keeps IPVS entries created by GORB in a file, so entries of
+// a previous run which wasn't shut down gracefully could be told apart from
+// entries created by someone else.
+type ownershipLedger struct {
+	mutex    sync.Mutex
+	path     string
+	services map[LedgerService]bool
+	dests    map[LedgerDest]bool
+}
+
+func loadLedger(path string) (*ownershipLedger, error) {
+	ledger := &ownershipLedger{
+		path:     path,
+		services: make(map[LedgerService]bool),
+		dests:    make(map[LedgerDest]bool),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ledger, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state ledgerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid ledger %s: %w", path, err)
+	}
+	for _, service := range state.Services {
+		ledger.services[service] = true
+	}
+	for _, dest := range state.Dests {
+		ledger.dests[dest] = true
+	}
+	return ledger, nil
+}
+
+func (l *ownershipLedger) state() ledgerState {
+	state := ledgerState{Services: []LedgerService{}, Dests: []LedgerDest{}}
+	for service := range l.services {
+		state.Services = append(state.Services, service)
+	}
+	for dest := range l.dests {
+		state.Dests = append(state.Dests, dest)
+	}
+	sort.Slice(state.Services, func(i, j int) bool {
+		return fmt.Sprint(state.Services[i]) < fmt.Sprint(state.Services[j])
+	})
+	sort.Slice(state.Dests, func(i, j int) bool {
+		return fmt.Sprint(state.Dests[i]) < fmt.Sprint(state.Dests[j])
+	})
+	return state
+}
+
+// save replaces the ledger file atomically. Ledger mutex must be held.
+func (l *ownershipLedger) save() {
+	data, err := json.MarshalIndent(l.state(), "", "  ")
+	if err == nil {
+		tmp := l.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, l.path)
+		}
+	}
+	if err != nil {
+		log.Errorf("error while saving IPVS ownership ledger %s: %s", l.path, err)
+	}
+}
+
+func (l *ownershipLedger) update(change func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	change()
+	l.save()
+}
+
+// ledgerIpvs records IPVS entries GORB creates and removes in the ledger.
+type ledgerIpvs struct {
+	Ipvs
+	ledger *ownershipLedger
+}
+
+func (l *ledgerIpvs) Flush() error {
+	if err := l.Ipvs.Flush(); err != nil {
+		return err
+	}
+	l.ledger.update(func() {
+		l.ledger.services = make(map[LedgerService]bool)
+		l.ledger.dests = make(map[LedgerDest]bool)
+	})
+	return nil
+}
+
+func (l *ledgerIpvs) addService(vip string, port uint16, protocol uint16) {
+	l.ledger.update(func() { l.ledger.services[LedgerService{vip, port, protocol}] = true })
+}
+
+func (l *ledgerIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	if err := l.Ipvs.AddService(vip, port, protocol, sched); err != nil {
+		return err
+	}
+	l.addService(vip, port, protocol)
+	return nil
+}
+
+func (l *ledgerIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	if err := l.Ipvs.AddServiceWithFlags(vip, port, protocol, sched, flags); err != nil {
+		return err
+	}
+	l.addService(vip, port, protocol)
+	return nil
+}
+
+func (l *ledgerIpvs) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	netmasker, ok := l.Ipvs.(IpvsNetmasker)
+	if !ok {
+		return ErrNetmaskUnsupported
+	}
+	if err := netmasker.AddServiceWithNetmask(vip, port, protocol, sched, flags, netmask); err != nil {
+		return err
+	}
+	l.addService(vip, port, protocol)
+	return nil
+}
+
+// UpdateService doesn't change the ledger, services are recorded by their address.
+func (l *ledgerIpvs) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	updater, ok := l.Ipvs.(IpvsServiceUpdater)
+	if !ok {
+		return ErrServiceUpdateUnsupported
+	}
+	return updater.UpdateService(vip, port, protocol, sched, flags, netmask)
+}
+
+func (l *ledgerIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	if err := l.Ipvs.DelService(vip, port, protocol); err != nil {
+		return err
+	}
+	service := LedgerService{vip, port, protocol}
+	l.ledger.update(func() {
+		delete(l.ledger.services, service)
+		// destinations are removed along with their service
+		for dest := range l.ledger.dests {
+			if dest.LedgerService == service {
+				delete(l.ledger.dests, dest)
+			}
+		}
+	})
+	return nil
+}
+
+func (l *ledgerIpvs) addDest(vip string, vport uint16, rip string, rport uint16, protocol uint16) {
+	l.ledger.update(func() { l.ledger.dests[LedgerDest{LedgerService{vip, vport, protocol}, rip, rport}] = true })
+}
+
+func (l *ledgerIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	if err := l.Ipvs.AddDestPort(vip, vport, rip, rport, protocol, weight, fwd); err != nil {
+		return err
+	}
+	l.addDest(vip, vport, rip, rport, protocol)
+	return nil
+}
+
+func (l *ledgerIpvs) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := l.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	if err := tunneler.AddDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel); err != nil {
+		return err
+	}
+	l.addDest(vip, vport, rip, rport, protocol)
+	return nil
+}
+
+func (l *ledgerIpvs) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := l.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return tunneler.UpdateDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+}
+
+func (l *ledgerIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	if err := l.Ipvs.DelDestPort(vip, vport, rip, rport, protocol); err != nil {
+		return err
+	}
+	l.ledger.update(func() { delete(l.ledger.dests, LedgerDest{LedgerService{vip, vport, protocol}, rip, rport}) })
+	return nil
+}
+
+// AddFWMService doesn't record the service, fwmark services are only created for
+// pins, which are removed along with the services they belong to.
+func (l *ledgerIpvs) AddFWMService(fwmark uint32, sched string, af uint16) error {
+	fwmarker, ok := l.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return fwmarker.AddFWMService(fwmark, sched, af)
+}
+
+func (l *ledgerIpvs) DelFWMService(fwmark uint32, af uint16) error {
+	fwmarker, ok := l.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return fwmarker.DelFWMService(fwmark, af)
+}
+
+func (l *ledgerIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	fwmarker, ok := l.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return fwmarker.AddFWMDestFWD(fwmark, rip, vaf, port, weight, fwd)
+}
+
+func (l *ledgerIpvs) GetActiveConns(vip string, port uint16, protocol uint16) (map[string]uint32, error) {
+	counter, ok := l.Ipvs.(IpvsConnCounter)
+	if !ok {
+		return nil, errIpvsConnsUnsupported
+	}
+	return counter.GetActiveConns(vip, port, protocol)
+}
+
+func (l *ledgerIpvs) ListConns(vip string, port uint16, protocol uint16) ([]IpvsConn, error) {
+	lister, ok := l.Ipvs.(IpvsConnLister)
+	if !ok {
+		return nil, errIpvsConnListUnsupported
+	}
+	return lister.ListConns(vip, port, protocol)
+}
+
+func (l *ledgerIpvs) GetServiceStats() (map[string]IpvsStats, error) {
+	reader, ok := l.Ipvs.(IpvsStatsReader)
+	if !ok {
+		return nil, errIpvsStatsUnsupported
+	}
+	return reader.GetServiceStats()
+}
+
+// cleanupOrphans removes IPVS entries recorded in the ledger by a previous run
+// of GORB, entries created by someone else are kept. Destinations GORB added to
+// services it didn't create are removed one by one.
+func (l *ledgerIpvs) cleanupOrphans() (services, dests int, err error) {
+	pools, err := l.Ipvs.GetPools()
+	if err != nil {
+		return 0, 0, err
+	}
+	l.ledger.mutex.Lock()
+	state := l.ledger.state()
+	l.ledger.mutex.Unlock()
+
+	existing := make(map[LedgerService]map[LedgerDest]bool, len(pools))
+	for _, pool := range pools {
+		service := LedgerService{pool.Service.VIP, pool.Service.Port, pool.Service.Proto}
+		existing[service] = make(map[LedgerDest]bool, len(pool.Dests))
+		for _, dest := range pool.Dests {
+			existing[service][LedgerDest{service, dest.IP, dest.Port}] = true
+		}
+	}
+
+	for _, service := range state.Services {
+		if existing[service] == nil {
+			continue
+		}
+		log.Infof("removing orphaned IPVS service %s:%d (%s)", service.VIP, service.Port, protocolName(service.Protocol))
+		if err := l.DelService(service.VIP, service.Port, service.Protocol); err != nil {
+			return services, dests, fmt.Errorf("error while removing orphaned service %s:%d: %w", service.VIP, service.Port, err)
+		}
+		services++
+		delete(existing, service)
+	}
+	for _, dest := range state.Dests {
+		if !existing[dest.LedgerService][dest] {
+			continue
+		}
+		log.Infof("removing orphaned IPVS destination %s:%d of service %s:%d (%s)", dest.RIP, dest.RPort,
+			dest.VIP, dest.Port, protocolName(dest.Protocol))
+		if err := l.DelDestPort(dest.VIP, dest.Port, dest.RIP, dest.RPort, dest.Protocol); err != nil {
+			return services, dests, fmt.Errorf("error while removing orphaned destination %s:%d: %w", dest.RIP, dest.RPort, err)
+		}
+		dests++
+	}
+
+	// entries removed by someone else are forgotten
+	l.ledger.update(func() {
+		l.ledger.services = make(map[LedgerService]bool)
+		l.ledger.dests = make(map[LedgerDest]bool)
+	})
+	return services, dests, nil
+}
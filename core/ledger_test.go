@@ -0,0 +1,51 @@
+package core
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupOrphans(t *testing.T) {
+	ipvs := NewMemoryIpvs()
+	ledger := filepath.Join(t.TempDir(), "ledger.json")
+
+	// entries of others are kept, including their destinations
+	require.NoError(t, ipvs.AddService("127.0.0.9", 80, syscall.IPPROTO_TCP, "wrr"))
+	require.NoError(t, ipvs.AddDestPort("127.0.0.9", 80, "127.0.0.10", 80, syscall.IPPROTO_TCP, 100, 0))
+
+	c, err := NewContext(ContextOptions{Ipvs: ipvs, Ledger: ledger})
+	require.NoError(t, err)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	require.NoError(t, c.CreateService("foreign", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "127.0.0.9"},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.3", Port: 8080}},
+	}))
+	// GORB exits without removing its services
+	close(c.stopCh)
+
+	_, err = NewContext(ContextOptions{Ipvs: ipvs, CleanupOrphans: true})
+	assert.ErrorIs(t, err, ErrLedgerRequired)
+
+	c, err = NewContext(ContextOptions{Ipvs: ipvs, Ledger: ledger, CleanupOrphans: true})
+	require.NoError(t, err)
+	defer close(c.stopCh)
+
+	pools, err := ipvs.GetPools()
+	require.NoError(t, err)
+	require.Len(t, pools, 1)
+	assert.Equal(t, "127.0.0.9", pools[0].Service.VIP)
+	require.Len(t, pools[0].Dests, 1)
+	assert.Equal(t, "127.0.0.10", pools[0].Dests[0].IP)
+
+	entries, err := loadLedger(ledger)
+	require.NoError(t, err)
+	assert.Empty(t, entries.services)
+	assert.Empty(t, entries.dests)
+}
@@ -0,0 +1,40 @@
+package core
+
+// isLocal checks if backend is in the same locality as GORB node.
+// Backends without locality label are considered local.
+func (ctx *Context) isLocal(opts *BackendOptions) bool {
+	return opts.Locality == "" || opts.Locality == ctx.locality
+}
+
+// localityEnabled checks if locality-aware weighting is used for the service.
+func (ctx *Context) localityEnabled(vs *Service) bool {
+	return vs.options.Locality != nil && ctx.locality != ""
+}
+
+// localHealth returns average health of local backends of the service.
+func (ctx *Context) localHealth(vs *Service) float64 {
+	var health float64
+	var count int
+	for _, rs := range vs.backends {
+		if ctx.isLocal(rs.options) {
+			health += rs.GetHealth()
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return health / float64(count)
+}
+
+// localityWeight returns a weight of healthy backend. Remote backends get full
+// weight only when health of local ones drops below the spill threshold.
+func (ctx *Context) localityWeight(vs *Service, opts *BackendOptions) int32 {
+	if !ctx.localityEnabled(vs) || ctx.isLocal(opts) {
+		return vs.options.MaxWeight
+	}
+	if ctx.localHealth(vs) < *vs.options.Locality.SpillThreshold {
+		return vs.options.MaxWeight
+	}
+	return vs.options.Locality.RemoteWeight
+}
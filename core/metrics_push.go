@@ -0,0 +1,230 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Possible modes of metrics push.
+const (
+	MetricsPushGateway     = "pushgateway"
+	MetricsPushRemoteWrite = "remote-write"
+)
+
+// metricsPushTimeout limits a single push.
+const metricsPushTimeout = 10 * time.Second
+
+// Possible metrics push errors.
+var (
+	ErrInvalidMetricsPushMode = errors.New("metrics push mode must be pushgateway or remote-write")
+	ErrInvalidMetricsPush     = errors.New("metrics push interval must be positive and job must not be empty")
+)
+
+// MetricsPushOptions configure periodic push of metrics of nodes which can't be scraped.
+type MetricsPushOptions struct {
+	// URL of Pushgateway or Prometheus remote write endpoint
+	URL string
+	// Mode is pushgateway or remote-write
+	Mode     string
+	Interval time.Duration
+	// Job and Instance label pushed metrics, Instance is the hostname by default
+	Job      string
+	Instance string
+}
+
+// Validate checks push options and fills in defaults.
+func (o *MetricsPushOptions) Validate() error {
+	if o.Mode == "" {
+		o.Mode = MetricsPushGateway
+	}
+	if o.Mode != MetricsPushGateway && o.Mode != MetricsPushRemoteWrite {
+		return ErrInvalidMetricsPushMode
+	}
+	if o.Interval <= 0 || o.Job == "" {
+		return ErrInvalidMetricsPush
+	}
+	if o.Instance == "" {
+		o.Instance, _ = os.Hostname()
+	}
+	return nil
+}
+
+// MetricsPusher periodically pushes gathered metrics to Pushgateway or remote write endpoint.
+type MetricsPusher struct {
+	options  MetricsPushOptions
+	gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// NewMetricsPusher creates a pusher of metrics of the gatherer.
+func NewMetricsPusher(gatherer prometheus.Gatherer, options MetricsPushOptions) (*MetricsPusher, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return &MetricsPusher{options: options, gatherer: gatherer, client: &http.Client{Timeout: metricsPushTimeout}}, nil
+}
+
+// Run pushes metrics every interval until stop is closed. Failed pushes are
+// logged and retried on the next interval.
+func (p *MetricsPusher) Run(stop <-chan struct{}) {
+	log.Infof("pushing metrics to %s every %s (%s)", p.options.URL, p.options.Interval, p.options.Mode)
+	ticker := time.NewTicker(p.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Push(); err != nil {
+			log.Errorf("error while pushing metrics to %s: %s", p.options.URL, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Push sends metrics once.
+func (p *MetricsPusher) Push() error {
+	if p.options.Mode == MetricsPushGateway {
+		// the group of the instance is replaced as a whole, so removed series disappear
+		return push.New(p.options.URL, p.options.Job).Gatherer(p.gatherer).Client(p.client).
+			Grouping("instance", p.options.Instance).Push()
+	}
+
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	body := s2.EncodeSnappy(nil, encodeWriteRequest(families, p.options.Job, p.options.Instance, time.Now()))
+	req, err := http.NewRequest(http.MethodPost, p.options.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write has failed with %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// remoteSeries is a single sample of a remote write request.
+type remoteSeries struct {
+	labels [][2]string
+	value  float64
+}
+
+// familySeries flattens a metric family into series the way Prometheus scrapes them,
+// i.e. histograms and summaries are split into buckets or quantiles, sum and count.
+func familySeries(family *dto.MetricFamily) []remoteSeries {
+	var series []remoteSeries
+	name := family.GetName()
+	for _, metric := range family.GetMetric() {
+		labels := make([][2]string, 0, len(metric.GetLabel())+1)
+		for _, label := range metric.GetLabel() {
+			labels = append(labels, [2]string{label.GetName(), label.GetValue()})
+		}
+		sample := func(suffix string, value float64, extra ...[2]string) {
+			series = append(series, remoteSeries{
+				labels: append(append([][2]string{{"__name__", name + suffix}}, labels...), extra...),
+				value:  value,
+			})
+		}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sample("", metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			sample("", metric.GetGauge().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			histogram := metric.GetHistogram()
+			for _, bucket := range histogram.GetBucket() {
+				sample("_bucket", float64(bucket.GetCumulativeCount()),
+					[2]string{"le", strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)})
+			}
+			sample("_bucket", float64(histogram.GetSampleCount()), [2]string{"le", "+Inf"})
+			sample("_sum", histogram.GetSampleSum())
+			sample("_count", float64(histogram.GetSampleCount()))
+		case dto.MetricType_SUMMARY:
+			summary := metric.GetSummary()
+			for _, quantile := range summary.GetQuantile() {
+				sample("", quantile.GetValue(),
+					[2]string{"quantile", strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)})
+			}
+			sample("_sum", summary.GetSampleSum())
+			sample("_count", float64(summary.GetSampleCount()))
+		default:
+			sample("", metric.GetUntyped().GetValue())
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes metric families as remote write protobuf WriteRequest,
+// series are labeled with the job and instance unless they have their own.
+func encodeWriteRequest(families []*dto.MetricFamily, job, instance string, now time.Time) []byte {
+	var request []byte
+	for _, family := range families {
+		for _, series := range familySeries(family) {
+			labels := series.labels
+			for _, target := range [][2]string{{"job", job}, {"instance", instance}} {
+				if !hasLabel(labels, target[0]) {
+					labels = append(labels, target)
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+			var timeSeries []byte
+			for _, label := range labels {
+				var pair []byte
+				pair = protowire.AppendTag(pair, 1, protowire.BytesType)
+				pair = protowire.AppendString(pair, label[0])
+				pair = protowire.AppendTag(pair, 2, protowire.BytesType)
+				pair = protowire.AppendString(pair, label[1])
+				timeSeries = protowire.AppendTag(timeSeries, 1, protowire.BytesType)
+				timeSeries = protowire.AppendBytes(timeSeries, pair)
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(series.value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(now.UnixMilli()))
+			timeSeries = protowire.AppendTag(timeSeries, 2, protowire.BytesType)
+			timeSeries = protowire.AppendBytes(timeSeries, sample)
+
+			request = protowire.AppendTag(request, 1, protowire.BytesType)
+			request = protowire.AppendBytes(request, timeSeries)
+		}
+	}
+	return request
+}
+
+func hasLabel(labels [][2]string, name string) bool {
+	for _, label := range labels {
+		if label[0] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeFields splits a protobuf message into its fields keyed by numbers.
+func decodeFields(t *testing.T, message []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		require.GreaterOrEqual(t, n, 0)
+		message = message[n:]
+		n = protowire.ConsumeFieldValue(number, typ, message)
+		require.GreaterOrEqual(t, n, 0)
+		value := message[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		fields[number] = append(fields[number], value)
+		message = message[n:]
+	}
+	return fields
+}
+
+// decodeWriteRequest returns series of remote write request as label sets with their values.
+func decodeWriteRequest(t *testing.T, request []byte) map[string]float64 {
+	series := make(map[string]float64)
+	for _, timeSeries := range decodeFields(t, request)[1] {
+		fields := decodeFields(t, timeSeries)
+		key := ""
+		for _, label := range fields[1] {
+			pair := decodeFields(t, label)
+			key += string(pair[1][0]) + "=" + string(pair[2][0]) + ","
+		}
+		require.Len(t, fields[2], 1)
+		bits, _ := protowire.ConsumeFixed64(decodeFields(t, fields[2][0])[1][0])
+		series[key] = math.Float64frombits(bits)
+	}
+	return series
+}
+
+func testGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gorb_test_weight"}, []string{"service"})
+	gauge.WithLabelValues("web").Set(100)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "gorb_test_seconds", Buckets: []float64{0.5}})
+	histogram.Observe(0.1)
+	registry.MustRegister(gauge, histogram)
+	return registry
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	families, err := testGatherer().Gather()
+	require.NoError(t, err)
+	series := decodeWriteRequest(t, encodeWriteRequest(families, "gorb", "lb1", time.Now()))
+	assert.Equal(t, map[string]float64{
+		"__name__=gorb_test_seconds_bucket,instance=lb1,job=gorb,le=+Inf,": 1,
+		"__name__=gorb_test_seconds_bucket,instance=lb1,job=gorb,le=0.5,":  1,
+		"__name__=gorb_test_seconds_count,instance=lb1,job=gorb,":          1,
+		"__name__=gorb_test_seconds_sum,instance=lb1,job=gorb,":            0.1,
+		"__name__=gorb_test_weight,instance=lb1,job=gorb,service=web,":     100,
+	}, series)
+}
+
+func TestMetricsPusher(t *testing.T) {
+	var requests []*http.Request
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests, bodies = append(requests, r), append(bodies, body)
+	}))
+	defer server.Close()
+
+	_, err := NewMetricsPusher(testGatherer(), MetricsPushOptions{URL: server.URL, Mode: "graphite",
+		Interval: time.Second, Job: "gorb"})
+	assert.Equal(t, ErrInvalidMetricsPushMode, err)
+
+	pusher, err := NewMetricsPusher(testGatherer(), MetricsPushOptions{URL: server.URL, Interval: time.Second,
+		Job: "gorb", Instance: "lb1"})
+	require.NoError(t, err)
+	require.NoError(t, pusher.Push())
+	require.Len(t, requests, 1)
+	assert.Equal(t, http.MethodPut, requests[0].Method)
+	assert.Equal(t, "/metrics/job/gorb/instance/lb1", requests[0].URL.Path)
+
+	pusher, err = NewMetricsPusher(testGatherer(), MetricsPushOptions{URL: server.URL + "/api/v1/write",
+		Mode: MetricsPushRemoteWrite, Interval: time.Second, Job: "gorb", Instance: "lb1"})
+	require.NoError(t, err)
+	require.NoError(t, pusher.Push())
+	require.Len(t, requests, 2)
+	assert.Equal(t, http.MethodPost, requests[1].Method)
+	assert.Equal(t, "snappy", requests[1].Header.Get("Content-Encoding"))
+	request, err := s2.Decode(nil, bodies[1])
+	require.NoError(t, err)
+	assert.Len(t, decodeWriteRequest(t, request), 5)
+}
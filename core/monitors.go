@@ -0,0 +1,178 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+// pulseQueueSize is the least bound of pending updates. One update per monitor
+// or backend is kept, so the queue grows with monitors and their subscribers.
+const pulseQueueSize = 4096
+
+// sharedMonitor is a pulse monitor whose updates are fanned out to all backends
+// subscribed to it, so the same target isn't checked once per service.
+type sharedMonitor struct {
+	key         string
+	monitor     *pulse.Pulse
+	subscribers map[pulse.ID]bool
+	// last metrics reported by the monitor are replayed to new subscribers
+	last *pulse.Metrics
+	// id is the source of updates of this run of the monitor, so updates of a
+	// stopped monitor aren't taken for updates of a new one of the same target
+	id pulse.ID
+	// cancel stops the monitor, running is done once it has stopped
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// monitorKey identifies a health check target, backends with the same address
+// and pulse options share the monitor. Options are compared by their encoding.
+func monitorKey(host string, port uint16, opts *pulse.Options) string {
+	encoded, _ := json.Marshal(opts)
+	sum := sha256.Sum256(encoded)
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(host, strconv.Itoa(int(port))), hex.EncodeToString(sum[:4]))
+}
+
+// sharedMonitorID is a source of updates of the generation of the shared monitor.
+// Services always have IDs, so it never collides with IDs of backends.
+func sharedMonitorID(key string, generation uint64) pulse.ID {
+	return pulse.ID{RsID: fmt.Sprintf("%s#%d", key, generation)}
+}
+
+// backendPulse returns pulse options the backend is checked with.
+func (ctx *Context) backendPulse(vs *Service, opts *BackendOptions) *pulse.Options {
+	if opts.pool != "" {
+		return ctx.backendPools[opts.pool].Pulse
+	}
+	return vs.options.Pulse
+}
+
+// backendMonitor returns the running monitor of the target or a new one, which is
+// started by subscribeMonitor. Context mutex must be held.
+func (ctx *Context) backendMonitor(host string, port uint16, opts *pulse.Options) (*sharedMonitor, error) {
+	// defaults are filled before options are compared
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	key := monitorKey(host, port, opts)
+	if m, exists := ctx.monitors[key]; exists {
+		return m, nil
+	}
+	p, err := pulse.New(host, port, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedMonitor{key: key, monitor: p, subscribers: make(map[pulse.ID]bool)}, nil
+}
+
+// subscribeMonitor subscribes the backend to the monitor, the monitor is started
+// if it isn't running yet. Context mutex must be held.
+func (ctx *Context) subscribeMonitor(m *sharedMonitor, id pulse.ID) {
+	if _, exists := ctx.monitors[m.key]; !exists {
+		if ctx.monitors == nil {
+			ctx.monitors = make(map[string]*sharedMonitor)
+		}
+		ctx.monitors[m.key] = m
+		ctx.monitorGeneration++
+		m.id = sharedMonitorID(m.key, ctx.monitorGeneration)
+		log.Infof("starting shared pulse %s", m.id.RsID)
+		ctx.startMonitor(m)
+	}
+	if !m.subscribers[id] {
+		m.subscribers[id] = true
+		ctx.monitorSubscribers++
+	}
+	ctx.resizePulses()
+	if m.last != nil {
+		// the backend shouldn't wait for the next check to get the target status
+		ctx.sendPulseUpdate(pulse.Update{Source: id, Metrics: *m.last})
+	}
+}
+
+// unsubscribeMonitor unsubscribes the backend and stops the monitor without
+// subscribers. Context mutex must be held.
+func (ctx *Context) unsubscribeMonitor(m *sharedMonitor, id pulse.ID) {
+	if m.subscribers[id] {
+		delete(m.subscribers, id)
+		ctx.monitorSubscribers--
+	}
+	if len(m.subscribers) == 0 {
+		log.Infof("stopping shared pulse %s without subscribers", m.id.RsID)
+		delete(ctx.monitors, m.key)
+		// the monitor is stopped before a backend with the same target is recreated
+		m.cancel()
+		m.running.Wait()
+	}
+	ctx.resizePulses()
+	// stash of the backend is dropped by the notification loop
+	ctx.sendPulseUpdate(pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusRemoved}})
+}
+
+// resizePulses lets the pulse queue keep an update of every monitor and backend,
+// so updates aren't dropped however many backends there are. Context mutex must be held.
+func (ctx *Context) resizePulses() {
+	ctx.pulses.Resize(max(pulseQueueSize, len(ctx.monitors)+ctx.monitorSubscribers))
+}
+
+// startMonitor runs the monitor until it's canceled or the context is stopped.
+func (ctx *Context) startMonitor(m *sharedMonitor) {
+	monitorCtx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		m.monitor.Run(monitorCtx, m.id, ctx.pulses)
+	}()
+	go func() {
+		select {
+		case <-ctx.stopCh:
+			cancel()
+		case <-monitorCtx.Done():
+		}
+	}()
+}
+
+// sendPulseUpdate queues the update without blocking, since the notification
+// loop could be waiting for the context mutex.
+func (ctx *Context) sendPulseUpdate(u pulse.Update) {
+	ctx.pulses.Push(u)
+}
+
+// pulseTargets returns backends the pulse update is for and keeps the last
+// metrics of shared monitors.
+func (ctx *Context) pulseTargets(u pulse.Update) []pulse.ID {
+	if u.Source.VsID != "" {
+		return []pulse.ID{u.Source}
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	key, _, _ := strings.Cut(u.Source.RsID, "#")
+	m, exists := ctx.monitors[key]
+	if !exists || m.id != u.Source {
+		// late update of a stopped monitor
+		return nil
+	}
+	metrics := u.Metrics
+	m.last = &metrics
+	targets := make([]pulse.ID, 0, len(m.subscribers))
+	for id := range m.subscribers {
+		targets = append(targets, id)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].VsID < targets[j].VsID || targets[i].VsID == targets[j].VsID && targets[i].RsID < targets[j].RsID
+	})
+	return targets
+}
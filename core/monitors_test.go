@@ -0,0 +1,85 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedMonitors(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	backends := map[string]*BackendOptions{"a": {Host: "127.0.0.2", Port: 8080}}
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80},
+		ServiceBackends: backends,
+	}))
+	require.NoError(t, c.CreateService("api", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 8000},
+		ServiceBackends: map[string]*BackendOptions{"b": {Host: "127.0.0.2", Port: 8080}},
+	}))
+	require.NoError(t, c.CreateService("admin", &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 9000, Pulse: &pulse.Options{Type: "http"}},
+		ServiceBackends: map[string]*BackendOptions{"a": {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	// the same target with the same check is checked once
+	require.Len(t, c.monitors, 2)
+	assert.Equal(t, 3, c.monitorSubscribers)
+	key := monitorKey("127.0.0.2", 8080, c.services["web"].options.Pulse)
+	assert.Equal(t, []pulse.ID{{VsID: "api", RsID: "b"}, {VsID: "web", RsID: "a"}},
+		c.pulseTargets(pulse.Update{Source: c.monitors[key].id, Metrics: pulse.Metrics{Status: pulse.StatusUp}}))
+
+	// new subscribers get the last status without waiting for the next check
+	require.NoError(t, c.CreateService("ops", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "localhost", Port: 7000}}))
+	require.NoError(t, c.CreateBackend("ops", "c", &BackendOptions{Host: "127.0.0.2", Port: 8080}))
+	select {
+	case <-c.pulses.Ready():
+		u, _, ok := c.pulses.Pop()
+		require.True(t, ok)
+		assert.Equal(t, pulse.ID{VsID: "ops", RsID: "c"}, u.Source)
+		assert.Equal(t, pulse.StatusUp, u.Metrics.Status)
+	case <-time.After(time.Second):
+		t.Fatal("last metrics weren't replayed")
+	}
+
+	for _, vsID := range []string{"web", "api", "ops"} {
+		_, err := c.RemoveService(vsID)
+		require.NoError(t, err)
+	}
+	assert.NotContains(t, c.monitors, key)
+	assert.Len(t, c.monitors, 1)
+	assert.Equal(t, 1, c.monitorSubscribers)
+}
+
+func TestRecreatedMonitor(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	c.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+	key := monitorKey("127.0.0.2", 8080, c.services[vsID].options.Pulse)
+	stale := c.monitors[key].id
+
+	// the old monitor is stopped before the backend is recreated
+	_, err := c.RemoveBackend(vsID, rsID)
+	require.NoError(t, err)
+	require.NoError(t, c.CreateBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}))
+	require.NotEqual(t, stale, c.monitors[key].id)
+
+	// updates still in flight from the old monitor are dropped
+	assert.Empty(t, c.pulseTargets(pulse.Update{Source: stale, Metrics: pulse.Metrics{Status: pulse.StatusDown}}))
+	assert.Equal(t, []pulse.ID{{VsID: vsID, RsID: rsID}},
+		c.pulseTargets(pulse.Update{Source: c.monitors[key].id, Metrics: pulse.Metrics{Status: pulse.StatusUp}}))
+}
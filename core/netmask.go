@@ -0,0 +1,87 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/qk4l/gorb/util"
+	"github.com/tehnerd/gnl2go"
+)
+
+// Possible netmask errors.
+var (
+	ErrInvalidNetmask     = errors.New("netmask must be a prefix length within the service address length")
+	ErrNetmaskUnsupported = errors.New("IPVS implementation doesn't support service netmasks")
+)
+
+// IpvsNetmasker is implemented by IPVS clients able to create services with a
+// netmask other than the full address.
+type IpvsNetmasker interface {
+	AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte, netmask uint32) error
+}
+
+// validateNetmask converts the netmask prefix length into the kernel form, the
+// service host must be resolved already.
+func (o *ServiceOptions) validateNetmask() error {
+	o.netmask = 0
+	if o.Netmask == 0 {
+		return nil
+	}
+	if util.AddrFamily(o.host) == util.IPv4 {
+		if o.Netmask < 0 || o.Netmask > 8*net.IPv4len {
+			return fmt.Errorf("%w: %d", ErrInvalidNetmask, o.Netmask)
+		}
+		// IPv4 netmasks are big endian masks, U32Type is encoded in little endian
+		o.netmask = binary.LittleEndian.Uint32(net.CIDRMask(o.Netmask, 8*net.IPv4len))
+		return nil
+	}
+	if o.Netmask < 0 || o.Netmask > 8*net.IPv6len {
+		return fmt.Errorf("%w: %d", ErrInvalidNetmask, o.Netmask)
+	}
+	// IPv6 netmasks are prefix lengths
+	o.netmask = uint32(o.Netmask)
+	return nil
+}
+
+// addServiceWithNetmask creates the IPVS service with the netmask of service options.
+func (ctx *Context) addServiceWithNetmask(svc gnl2go.Service, netmask uint32) error {
+	netmasker, ok := ctx.ipvs.(IpvsNetmasker)
+	if !ok {
+		return ErrNetmaskUnsupported
+	}
+	flags := svc.Flags
+	if flags == nil {
+		flags = gnl2go.BIN_NO_FLAGS
+	}
+	return netmasker.AddServiceWithNetmask(svc.VIP, svc.Port, svc.Proto, svc.Sched, flags, netmask)
+}
+
+// AddServiceWithNetmask mirrors AddServiceWithFlags of GNL2GO, which always
+// sends the full address netmask.
+func (ipvs *ipvsClient) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	af, addr, err := ipvsAddr(vip)
+	if err != nil {
+		return err
+	}
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return err
+	}
+	msg, err := mt.InitGNLMessageStr("NEW_SERVICE", gnl2go.ACK_REQUEST)
+	if err != nil {
+		return err
+	}
+
+	vAF, vAddr, vPort, proto := gnl2go.U16Type(af), gnl2go.BinaryType(addr), gnl2go.Net16Type(port), gnl2go.U16Type(protocol)
+	schedName, svcFlags := gnl2go.NulStringType(sched), gnl2go.BinaryType(flags)
+	timeout, mask := gnl2go.U32Type(0), gnl2go.U32Type(netmask)
+	svcAttrList := gnl2go.CreateAttrListType(gnl2go.ATLName2ATL["IpvsServiceAttrList"])
+	svcAttrList.Set(map[string]gnl2go.SerDes{"AF": &vAF, "ADDR": &vAddr, "PORT": &vPort, "PROTOCOL": &proto,
+		"SCHED_NAME": &schedName, "FLAGS": &svcFlags, "TIMEOUT": &timeout, "NETMASK": &mask})
+
+	msg.AttrMap["SERVICE"] = &svcAttrList
+	return ipvs.Sock.Execute(msg)
+}
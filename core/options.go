@@ -22,10 +22,16 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"net"
+	"slices"
 	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/qk4l/gorb/hooks"
 	"github.com/qk4l/gorb/pulse"
 
 	"github.com/tehnerd/gnl2go"
@@ -37,16 +43,79 @@ var (
 	ErrUnknownMethod       = errors.New("specified forwarding method is unknown")
 	ErrUnknownProtocol     = errors.New("specified protocol is unknown")
 	ErrUnknownFlag         = errors.New("specified flag is unknown")
+	ErrIncompatibleFlag    = errors.New("specified flag is not supported by scheduler")
 	ErrUnknownFallbackFlag = errors.New("specified fallback flag is unknown")
+	ErrInvalidLocality     = errors.New("locality remote weight must not be negative and spill threshold must be within [0, 1]")
+	ErrInvalidMinWeight    = errors.New("min weight must be within [0, max weight]")
 )
 
+// DefaultLbMethod is the scheduler of services without lb_method, WRR since
+// Pulse will dynamically reweight backends.
+const DefaultLbMethod = "wrr"
+
 // ContextOptions configure Context behavior.
 type ContextOptions struct {
-	Disco        string
+	Disco string
+	// DiscoProxy is a proxy URL of Consul requests, "direct" or empty for proxies of the environment.
+	DiscoProxy   string
 	Endpoints    []net.IP
 	Flush        bool
 	ListenPort   uint16
 	VipInterface string
+	// VipInterfaces services could select instead of VipInterface, e.g. sub-interfaces of VLANs.
+	VipInterfaces []string
+	IpvsTimeouts  IpvsTimeouts
+	// IpvsQueueDepth is a number of IPVS calls allowed to wait for the worker running
+	// them one by one, DefaultIpvsQueueDepth if zero. Calls fail if the queue is full.
+	IpvsQueueDepth int
+	// Locality label of GORB node, e.g. rack or availability zone.
+	Locality string
+	// Hooks run when a backend is ejected or restored.
+	Hooks hooks.Options
+	// Ipvs overrides IPVS implementation, netlink client is used by default.
+	Ipvs Ipvs
+	// ConnLimiter overrides connection limiter, nftables are used by default.
+	ConnLimiter ConnLimiter
+	// ExpireConns removes connections and persistence templates of backends going down.
+	ExpireConns bool
+	// ConnExpirer overrides connection expirer, sysctls and conntrack are used by default.
+	ConnExpirer ConnExpirer
+	// ClientPinner overrides pinning of clients to backends, nftables are used by default.
+	ClientPinner ClientPinner
+	// StrictVersions requires a version of existing objects on their modification.
+	StrictVersions bool
+	// DeleteGracePeriod keeps deleted services and backends out of traffic
+	// before their removal, so deletion could be undone. Zero removes at once.
+	DeleteGracePeriod time.Duration
+	// RemovalDelay keeps backends removed from the store or missing heartbeats at
+	// zero weight before their removal, so short flaps don't churn IPVS. Zero removes at once.
+	RemovalDelay time.Duration
+	// EventHistory is a number of lifecycle events kept per service. Zero disables the history.
+	EventHistory int
+	// Tracing records spans of store synchronization and IPVS calls.
+	Tracing bool
+	// PrometheusURL is a Prometheus server weight metrics are queried from.
+	PrometheusURL string
+	// WeightMetricsInterval is how often weight metrics are evaluated, 30s by default.
+	WeightMetricsInterval time.Duration
+	// Ledger is a file IPVS entries created by GORB are recorded in.
+	Ledger string
+	// CleanupOrphans removes IPVS entries recorded in the ledger by a previous run on start.
+	CleanupOrphans bool
+	// BackendNetworks backends are allowed in, any address is allowed if empty.
+	BackendNetworks []*net.IPNet
+	// AdoptVips takes over removal of VIPs which were already present on the
+	// interface when their services were created, they are kept by default.
+	AdoptVips bool
+	// DeferVips delays adding VIPs of services created before the first store
+	// synchronization is over until a backend of the service is found healthy.
+	DeferVips bool
+	// SyncWorkers is a number of concurrent workers of the first store
+	// synchronization, DefaultSyncWorkers if zero.
+	SyncWorkers int
+	// CheckSchedulers checks kernel modules of schedulers of services created by
+	// the first store synchronization, completing the startup preflight check.
+	CheckSchedulers bool
 }
 
 // ServiceOptions describe a virtual service.
@@ -61,9 +130,60 @@ type ServiceOptions struct {
 	Fallback   string `json:"fallback" yaml:"fallback"`
 
 	// service backends settings
-	FwdMethod string         `json:"fwd_method" yaml:"fwd_method"`
+	FwdMethod string `json:"fwd_method" yaml:"fwd_method"`
+	// Tunnel encapsulation of packets forwarded to backends, IPIP by default.
+	Tunnel    *TunnelOptions `json:"tunnel,omitempty" yaml:"tunnel,omitempty"`
 	Pulse     *pulse.Options `json:"pulse" yaml:"pulse"`
 	MaxWeight int32          `json:"max_weight" yaml:"max_weight"`
+	// MinWeight of up backends, so weights reduced by health aren't truncated to zero. Not enforced if zero.
+	MinWeight int32 `json:"min_weight,omitempty" yaml:"min_weight,omitempty"`
+	// Locality enables locality-aware weighting of backends.
+	Locality *LocalityOptions `json:"locality,omitempty" yaml:"locality,omitempty"`
+	// ConnLimit limits rate of new connections to the service.
+	ConnLimit *ConnLimitOptions `json:"conn_limit,omitempty" yaml:"conn_limit,omitempty"`
+	// ActiveColor of backends receiving traffic on start, all colors do if empty.
+	ActiveColor string `json:"active_color,omitempty" yaml:"active_color,omitempty"`
+	// Alerts are thresholds of service metrics reported when breached.
+	Alerts []AlertRule `json:"alerts,omitempty" yaml:"alerts,omitempty"`
+	// StatusThresholds of healthy backends the service is degraded or down at.
+	StatusThresholds *StatusThresholds `json:"status_thresholds,omitempty" yaml:"status_thresholds,omitempty"`
+	// DiscoStatus is the minimal status the service is exposed to discovery at, always exposed if empty.
+	DiscoStatus ServiceStatus `json:"disco_status,omitempty" yaml:"disco_status,omitempty"`
+	// DNSName is answered with the VIP by the embedded DNS responder while the service isn't down.
+	DNSName string `json:"dns_name,omitempty" yaml:"dns_name,omitempty"`
+	// Labels are arbitrary metadata of the service, e.g. team or tier.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// WeightPolicy calculates weights of healthy backends, health-proportional recovery by default.
+	WeightPolicy *WeightPolicyOptions `json:"weight_policy,omitempty" yaml:"weight_policy,omitempty"`
+	// WeightMetrics are PromQL queries evaluated per backend and fed into the weight policy.
+	WeightMetrics map[string]string `json:"weight_metrics,omitempty" yaml:"weight_metrics,omitempty"`
+	// Ports of a service group, it is expanded to a service per port with the same backends.
+	Ports []uint16 `json:"ports,omitempty" yaml:"ports,omitempty"`
+	// Host6 is an IPv6 VIP of a dual-stack service group, it is expanded to a service
+	// per address family with backends of the family.
+	Host6 string `json:"host6,omitempty" yaml:"host6,omitempty"`
+	// VipInterface the VIP is added to, one of the context VIP interfaces, the default one if empty.
+	VipInterface string `json:"vip_interface,omitempty" yaml:"vip_interface,omitempty"`
+	// VipPrefixLen of the VIP added to the interface, /32 for IPv4 and /128 for IPv6 if zero.
+	VipPrefixLen int `json:"vip_prefix_len,omitempty" yaml:"vip_prefix_len,omitempty"`
+	// VipLabel of the IPv4 VIP added to the interface, it must start with the interface name.
+	VipLabel string `json:"vip_label,omitempty" yaml:"vip_label,omitempty"`
+	// Pool is ID of a backend pool whose backends are added to the service.
+	Pool string `json:"pool,omitempty" yaml:"pool,omitempty"`
+	// Frozen in store content makes synchronization leave the service as is.
+	Frozen bool `json:"frozen,omitempty" yaml:"frozen,omitempty"`
+	// SorryServer is IP:port of a destination added with weight 1 while none of backends is healthy.
+	SorryServer string `json:"sorry_server,omitempty" yaml:"sorry_server,omitempty"`
+	// Failover sends traffic to the healthy backend of the highest priority only.
+	Failover *FailoverOptions `json:"failover,omitempty" yaml:"failover,omitempty"`
+	// Netmask is a prefix length of client addresses grouped by persistence templates, the full address if zero.
+	Netmask int `json:"netmask,omitempty" yaml:"netmask,omitempty"`
+	// DownBackends are quiescent with zero weight (default) or dropped from IPVS.
+	DownBackends string `json:"down_backends,omitempty" yaml:"down_backends,omitempty"`
+	// FlushConntrack removes conntrack entries of NAT backends going down or removed.
+	FlushConntrack bool `json:"flush_conntrack,omitempty" yaml:"flush_conntrack,omitempty"`
+	// BackendFilter keeps backends matching it out of traffic.
+	BackendFilter *BackendFilter `json:"backend_filter,omitempty" yaml:"backend_filter,omitempty"`
 
 	// Host string resolved to an IP, including DNS lookup.
 	host      net.IP
@@ -74,24 +194,50 @@ type ServiceOptions struct {
 
 	// Forwarding method string converted to a forwarding method number.
 	methodID uint32
+
+	// WeightMetrics parsed as templates.
+	weightMetrics map[string]*template.Template
+	// group is ID of the service group the service is expanded from
+	group string
+	// network of backends of a dual-stack group service, ip4 or ip6
+	network string
+	// vipAdopted is set if the VIP was already present on the interface
+	vipAdopted bool
+	// SorryServer parsed into an IP and port
+	sorryHost net.IP
+	sorryPort uint16
+	// Netmask in the kernel form
+	netmask uint32
 }
 
 // Validate fills missing fields and validates virtual service configuration.
 func (o *ServiceOptions) Validate(defaultHost net.IP) error {
+	return o.validateWith(defaultHost, resolveHost)
+}
+
+// validateWith validates virtual service configuration resolving its host with the resolver.
+func (o *ServiceOptions) validateWith(defaultHost net.IP, resolve hostResolver) error {
+	if len(o.Ports) > 0 {
+		return fieldError("ports", ErrGroupPorts)
+	}
+	if o.Host6 != "" {
+		return fieldError("host6", ErrGroupHost6)
+	}
+
 	if o.Port == 0 {
-		return ErrMissingEndpoint
+		return fieldError("port", ErrMissingEndpoint)
 	}
 
 	if len(o.Host) != 0 {
-		if addr, err := net.ResolveIPAddr("ip", o.Host); err == nil {
-			o.host = addr.IP
+		if host, err := resolve(o.Host); err == nil {
+			o.host = host
 		} else {
-			return err
+			return fieldError("host", err)
 		}
 	} else if defaultHost != nil {
 		o.host = defaultHost
 	} else {
-		return ErrMissingEndpoint
+		return fieldError("host", ErrMissingEndpoint)
 	}
 
 	if len(o.Protocol) == 0 {
@@ -106,21 +252,13 @@ func (o *ServiceOptions) Validate(defaultHost net.IP) error {
 	case "udp":
 		o.protocol = syscall.IPPROTO_UDP
 	default:
-		return ErrUnknownProtocol
-	}
-
-	if o.ShFlags != "" {
-		for _, flag := range strings.Split(o.ShFlags, "|") {
-			if _, ok := schedulerFlags[flag]; !ok {
-				return ErrUnknownFlag
-			}
-		}
+		return fieldError("protocol", ErrUnknownProtocol)
 	}
 
 	if o.Fallback != "" {
 		for _, flag := range strings.Split(o.Fallback, "|") {
 			if _, ok := fallbackFlags[flag]; !ok {
-				return ErrUnknownFallbackFlag
+				return fieldError("fallback", ErrUnknownFallbackFlag)
 			}
 		}
 	} else {
@@ -128,13 +266,31 @@ func (o *ServiceOptions) Validate(defaultHost net.IP) error {
 	}
 
 	if len(o.LbMethod) == 0 {
-		// WRR since Pulse will dynamically reweight backends.
-		o.LbMethod = "wrr"
+		o.LbMethod = DefaultLbMethod
+	}
+
+	if o.ShFlags != "" {
+		flags := strings.Split(o.ShFlags, "|")
+		for _, flag := range flags {
+			if _, ok := schedulerFlags[flag]; !ok {
+				return fieldError("sh_flags", ErrUnknownFlag)
+			}
+		}
+		for _, flag := range flags {
+			// scheduler specific flags are silently ignored by other schedulers
+			if sched, _, specific := strings.Cut(flag, "-"); specific && sched != "flag" && sched != o.LbMethod {
+				return fieldError("sh_flags", fmt.Errorf("%w: %s requires %s scheduler, not %s", ErrIncompatibleFlag,
+					flag, sched, o.LbMethod))
+			}
+		}
 	}
 
 	if o.MaxWeight <= 0 {
 		o.MaxWeight = 100
 	}
+	if o.MinWeight < 0 || o.MinWeight > o.MaxWeight {
+		return fieldError("min_weight", ErrInvalidMinWeight)
+	}
 
 	if len(o.FwdMethod) == 0 {
 		o.FwdMethod = "nat"
@@ -150,7 +306,36 @@ func (o *ServiceOptions) Validate(defaultHost net.IP) error {
 	case "tunnel", "ipip":
 		o.methodID = gnl2go.IPVS_TUNNELING
 	default:
-		return ErrUnknownMethod
+		return fieldError("fwd_method", ErrUnknownMethod)
+	}
+
+	if err := o.validateVipAddress(); err != nil {
+		return err
+	}
+
+	if err := o.validateSorryServer(); err != nil {
+		return fieldError("sorry_server", err)
+	}
+
+	if err := o.validateNetmask(); err != nil {
+		return fieldError("netmask", err)
+	}
+
+	if err := o.validateDownBackends(); err != nil {
+		return fieldError("down_backends", err)
+	}
+
+	if err := o.validateFlushConntrack(); err != nil {
+		return fieldError("flush_conntrack", err)
+	}
+
+	if o.Tunnel != nil {
+		if o.methodID != gnl2go.IPVS_TUNNELING {
+			return fieldError("tunnel", ErrTunnelMethod)
+		}
+		if err := o.Tunnel.Validate(); err != nil {
+			return fieldError("tunnel", err)
+		}
 	}
 
 	if o.Pulse == nil {
@@ -158,6 +343,73 @@ func (o *ServiceOptions) Validate(defaultHost net.IP) error {
 		o.Pulse = &pulse.Options{}
 	}
 
+	if o.Locality != nil {
+		if err := o.Locality.Validate(); err != nil {
+			return fieldError("locality", err)
+		}
+	}
+
+	if o.ConnLimit != nil {
+		if err := o.ConnLimit.Validate(); err != nil {
+			return fieldError("conn_limit", err)
+		}
+	}
+
+	if o.BackendFilter != nil {
+		if err := o.BackendFilter.Validate(); err != nil {
+			return fieldError("backend_filter", err)
+		}
+	}
+
+	if err := validateAlerts(o.Alerts); err != nil {
+		return fieldError("alerts", err)
+	}
+
+	if o.StatusThresholds != nil {
+		if err := o.StatusThresholds.Validate(); err != nil {
+			return fieldError("status_thresholds", err)
+		}
+	}
+
+	o.DiscoStatus = ServiceStatus(strings.ToLower(string(o.DiscoStatus)))
+	o.DNSName = normalizeDNSName(o.DNSName)
+	if err := validateDiscoStatus(o.DiscoStatus); err != nil {
+		return fieldError("disco_status", err)
+	}
+
+	if o.WeightPolicy != nil {
+		if err := o.WeightPolicy.Validate(); err != nil {
+			return fieldError("weight_policy", err)
+		}
+	}
+
+	var err error
+	if o.weightMetrics, err = parseWeightMetrics(o.WeightMetrics); err != nil {
+		return fieldError("weight_metrics", err)
+	}
+
+	return nil
+}
+
+// LocalityOptions describe locality-aware weighting of backends. Backends in the
+// same locality as GORB node get full weight, remote ones are used as spill-over.
+type LocalityOptions struct {
+	// RemoteWeight is a weight of remote backends while local ones are healthy.
+	RemoteWeight int32 `json:"remote_weight" yaml:"remote_weight"`
+	// SpillThreshold is a health of local backends below which remote
+	// backends get full weight. Default is 0.5, zero never gives them full weight.
+	SpillThreshold *float64 `json:"spill_threshold,omitempty" yaml:"spill_threshold,omitempty"`
+}
+
+// Validate fills missing fields and validates locality configuration.
+func (o *LocalityOptions) Validate() error {
+	if o.SpillThreshold == nil {
+		threshold := 0.5
+		o.SpillThreshold = &threshold
+	}
+	if o.RemoteWeight < 0 || *o.SpillThreshold < 0 || *o.SpillThreshold > 1 {
+		return ErrInvalidLocality
+	}
 	return nil
 }
 
@@ -186,9 +438,77 @@ func (o *ServiceOptions) CompareStoreOptions(options *ServiceOptions) bool {
 	if o.FwdMethod != options.FwdMethod {
 		return false
 	}
+	if (o.Tunnel == nil) != (options.Tunnel == nil) ||
+		o.Tunnel != nil && *o.Tunnel != *options.Tunnel {
+		return false
+	}
 	if o.MaxWeight != options.MaxWeight {
 		return false
 	}
+	if o.MinWeight != options.MinWeight {
+		return false
+	}
+	if o.ActiveColor != options.ActiveColor {
+		return false
+	}
+	if (o.Locality == nil) != (options.Locality == nil) ||
+		o.Locality != nil && *o.Locality != *options.Locality {
+		return false
+	}
+	if (o.ConnLimit == nil) != (options.ConnLimit == nil) ||
+		o.ConnLimit != nil && *o.ConnLimit != *options.ConnLimit {
+		return false
+	}
+	if !equalAlerts(o.Alerts, options.Alerts) {
+		return false
+	}
+	if (o.StatusThresholds == nil) != (options.StatusThresholds == nil) ||
+		o.StatusThresholds != nil && *o.StatusThresholds != *options.StatusThresholds {
+		return false
+	}
+	if o.DiscoStatus != options.DiscoStatus {
+		return false
+	}
+	if o.DNSName != options.DNSName {
+		return false
+	}
+	if !maps.Equal(o.Labels, options.Labels) {
+		return false
+	}
+	if !equalWeightPolicies(o.WeightPolicy, options.WeightPolicy) {
+		return false
+	}
+	if !maps.Equal(o.WeightMetrics, options.WeightMetrics) {
+		return false
+	}
+	if o.VipInterface != options.VipInterface {
+		return false
+	}
+	if o.VipPrefixLen != options.VipPrefixLen || o.VipLabel != options.VipLabel {
+		return false
+	}
+	if o.Pool != options.Pool {
+		return false
+	}
+	if o.SorryServer != options.SorryServer {
+		return false
+	}
+	if (o.Failover == nil) != (options.Failover == nil) ||
+		o.Failover != nil && *o.Failover != *options.Failover {
+		return false
+	}
+	if o.Netmask != options.Netmask {
+		return false
+	}
+	if o.DownBackends != options.DownBackends {
+		return false
+	}
+	if o.FlushConntrack != options.FlushConntrack {
+		return false
+	}
+	if !equalBackendFilters(o.BackendFilter, options.BackendFilter) {
+		return false
+	}
 	return true
 }
 
@@ -196,6 +516,17 @@ func (o *ServiceOptions) CompareStoreOptions(options *ServiceOptions) bool {
 type BackendOptions struct {
 	Host string `json:"host" yaml:"host"`
 	Port uint16 `json:"port" yaml:"port"`
+	// Locality label of backend, e.g. rack or availability zone.
+	Locality string `json:"locality,omitempty" yaml:"locality,omitempty"`
+	// Color of backend set for blue/green deployments.
+	Color string `json:"color,omitempty" yaml:"color,omitempty"`
+	// Priority of backend in a failover service, the highest one receives traffic.
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// Tags of backend, e.g. ones of its discovery record, backend filters could match them.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// Inactive backends are created with zero weight and without health checks
+	// until they are activated. It's the initial state only, so it isn't compared.
+	Inactive bool `json:"inactive,omitempty" yaml:"inactive,omitempty"`
 
 	// vsID of backend
 	vsID string
@@ -205,20 +536,59 @@ type BackendOptions struct {
 	weight int32
 	// pulse settings
 	pulse *pulse.Options
+	// pending backends get no traffic until the first successful health check
+	pending bool
+	// pool is ID of the backend pool the backend belongs to
+	pool string
+	// rangeOf is the backend range the backend is expanded from
+	rangeOf *backendRange
 }
 
 // Validate fills missing fields and validates backend configuration.
 func (o *BackendOptions) Validate() error {
-	if len(o.Host) == 0 || o.Port == 0 {
-		return ErrMissingEndpoint
+	return o.validateWith(resolveHost)
+}
+
+// validateWith validates backend configuration resolving its host with the resolver.
+func (o *BackendOptions) validateWith(resolve hostResolver) error {
+	if len(o.Host) == 0 {
+		return fieldError("host", ErrMissingEndpoint)
+	}
+	if o.Port == 0 {
+		return fieldError("port", ErrMissingEndpoint)
+	}
+	if addrs, err := rangeAddresses(o.Host); err != nil {
+		return fieldError("host", err)
+	} else if addrs != nil {
+		return fieldError("host", ErrBackendRangeNotAllowed)
 	}
 
-	if addr, err := net.ResolveIPAddr("ip", o.Host); err == nil {
-		o.host = addr.IP
+	if host, err := resolve(o.Host); err == nil {
+		o.host = host
 	} else {
-		return err
+		return fieldError("host", err)
+	}
+
+	return nil
+}
+
+// checkBackendPort checks the backend could receive traffic of the service. IPVS
+// rewrites ports of masqueraded packets only, so with dr and tunnel forwarding
+// the kernel would program a destination no packet is ever delivered to.
+func (o *ServiceOptions) checkBackendPort(rsID string, port uint16) error {
+	if o.methodID == gnl2go.IPVS_MASQUERADING || port == 0 || port == o.Port {
+		return nil
 	}
+	return fmt.Errorf("%w: backend [%s] port %d, service port %d, %s forwarding doesn't map ports",
+		ErrBackendPort, rsID, port, o.Port, o.FwdMethod)
+}
 
+func (o *ServiceOptions) checkBackendPorts(backends map[string]*BackendOptions) error {
+	for _, rsID := range sortedKeys(backends) {
+		if err := o.checkBackendPort(rsID, backends[rsID].Port); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -229,5 +599,17 @@ func (o *BackendOptions) CompareStoreOptions(options *BackendOptions) bool {
 	if o.Port != options.Port {
 		return false
 	}
+	if o.Locality != options.Locality {
+		return false
+	}
+	if o.Color != options.Color {
+		return false
+	}
+	if o.Priority != options.Priority {
+		return false
+	}
+	if !slices.Equal(o.Tags, options.Tags) {
+		return false
+	}
 	return true
 }
@@ -1,13 +1,16 @@
 package core
 
 import (
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
 )
 
 func TestValidateAcceptsAllowedServiceOptionsFlags(t *testing.T) {
-	options := ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", LbMethod: "dr", ShFlags: "sh-port|sh-fallback"}
+	options := ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", LbMethod: "sh", ShFlags: "sh-port|sh-fallback"}
 	err := options.Validate(nil)
 
 	assert.NoError(t, err)
@@ -17,7 +20,8 @@ func TestValidateRejectsInvalidServiceOptionsFlags(t *testing.T) {
 	options := ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", LbMethod: "dr", ShFlags: "sh-port|does-not-match"}
 	err := options.Validate(nil)
 
-	assert.EqualError(t, err, "specified flag is unknown")
+	assert.EqualError(t, err, "sh_flags: specified flag is unknown")
+	assert.Equal(t, "sh_flags", ErrorField(err))
 }
 
 func TestValidateAcceptsNoFlags(t *testing.T) {
@@ -26,3 +30,126 @@ func TestValidateAcceptsNoFlags(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestValidateRejectsFlagsOfAnotherScheduler(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", LbMethod: "wrr", ShFlags: "sh-port"}
+	err := options.Validate(nil)
+	assert.ErrorIs(t, err, ErrIncompatibleFlag)
+	assert.EqualError(t, err, "sh_flags: specified flag is not supported by scheduler: sh-port requires sh scheduler, not wrr")
+
+	options = ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", LbMethod: "mh", ShFlags: "mh-port|flag-3"}
+	assert.NoError(t, options.Validate(nil))
+}
+
+func TestValidateLocalityOptions(t *testing.T) {
+	options := LocalityOptions{RemoteWeight: 10}
+	require.NoError(t, options.Validate())
+	require.NotNil(t, options.SpillThreshold)
+	assert.Equal(t, 0.5, *options.SpillThreshold)
+
+	threshold := 0.0
+	options = LocalityOptions{SpillThreshold: &threshold}
+	require.NoError(t, options.Validate())
+	assert.Equal(t, 0.0, *options.SpillThreshold, "zero threshold is kept")
+
+	threshold = 1.5
+	assert.ErrorIs(t, options.Validate(), ErrInvalidLocality)
+}
+
+func TestValidateTunnelOptions(t *testing.T) {
+	tunnel := &TunnelOptions{Type: "GUE", Port: 6080, Checksum: "remcsum"}
+	options := ServiceOptions{Port: 80, Host: "localhost", FwdMethod: "tunnel", Tunnel: tunnel}
+	require.NoError(t, options.Validate(nil))
+	assert.Equal(t, DestTunnel{Type: tunnelTypeGUE, Port: 6080, Flags: tunnelFlagRemCsum}, tunnel.dest)
+
+	tunnel = &TunnelOptions{}
+	assert.NoError(t, tunnel.Validate())
+	assert.Equal(t, "ipip", tunnel.Type)
+	assert.Equal(t, "none", tunnel.Checksum)
+
+	for _, tc := range []struct {
+		fwd    string
+		tunnel TunnelOptions
+		err    error
+	}{
+		{"nat", TunnelOptions{Type: "gre"}, ErrTunnelMethod},
+		{"tunnel", TunnelOptions{Type: "vxlan"}, ErrUnknownTunnelType},
+		{"tunnel", TunnelOptions{Type: "gue"}, ErrTunnelPort},
+		{"tunnel", TunnelOptions{Type: "gre", Port: 6080}, ErrTunnelPort},
+		{"tunnel", TunnelOptions{Type: "ipip", Checksum: "csum"}, ErrUnknownTunnelChecksum},
+		{"tunnel", TunnelOptions{Type: "gre", Checksum: "remcsum"}, ErrUnknownTunnelChecksum},
+	} {
+		tunnel := tc.tunnel
+		options := ServiceOptions{Port: 80, Host: "localhost", FwdMethod: tc.fwd, Tunnel: &tunnel}
+		assert.ErrorIs(t, options.Validate(nil), tc.err, "%s %+v", tc.fwd, tc.tunnel)
+	}
+}
+
+func TestVipAddress(t *testing.T) {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1"}
+	require.NoError(t, options.Validate(nil))
+	vip, err := vipAddr(link, &options)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/32", vip.IPNet.String())
+
+	options = ServiceOptions{Port: 80, Host: "fd00::1"}
+	require.NoError(t, options.Validate(nil))
+	vip, err = vipAddr(link, &options)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::1/128", vip.IPNet.String())
+
+	options = ServiceOptions{Port: 80, Host: "10.0.0.1", VipPrefixLen: 24, VipLabel: "eth0:vip"}
+	require.NoError(t, options.Validate(nil))
+	vip, err = vipAddr(link, &options)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1/24", vip.IPNet.String())
+	assert.Equal(t, "eth0:vip", vip.Label)
+
+	_, err = vipAddr(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}, &options)
+	assert.ErrorIs(t, err, ErrInvalidVipLabel)
+
+	for _, options := range []ServiceOptions{
+		{Port: 80, Host: "10.0.0.1", VipPrefixLen: 33},
+		{Port: 80, Host: "fd00::1", VipPrefixLen: 129},
+		{Port: 80, Host: "10.0.0.1", VipPrefixLen: -1},
+	} {
+		assert.ErrorIs(t, options.Validate(nil), ErrInvalidVipPrefix, options.Host)
+	}
+	for _, options := range []ServiceOptions{
+		{Port: 80, Host: "fd00::1", VipLabel: "eth0:vip"},
+		{Port: 80, Host: "10.0.0.1", VipLabel: "eth0:too-long-label"},
+	} {
+		assert.ErrorIs(t, options.Validate(nil), ErrInvalidVipLabel, options.VipLabel)
+	}
+}
+
+func TestNetmask(t *testing.T) {
+	options := ServiceOptions{Port: 80, Host: "10.0.0.1", Netmask: 24}
+	require.NoError(t, options.Validate(nil))
+	// the kernel takes IPv4 netmasks as big endian masks
+	assert.Equal(t, uint32(0x00ffffff), options.netmask)
+
+	options = ServiceOptions{Port: 80, Host: "fd00::1", Netmask: 64}
+	require.NoError(t, options.Validate(nil))
+	assert.Equal(t, uint32(64), options.netmask)
+
+	for _, options := range []ServiceOptions{
+		{Port: 80, Host: "10.0.0.1", Netmask: 33},
+		{Port: 80, Host: "fd00::1", Netmask: 129},
+		{Port: 80, Host: "10.0.0.1", Netmask: -1},
+	} {
+		assert.ErrorIs(t, options.Validate(nil), ErrInvalidNetmask, options.Host)
+	}
+
+	ipvs := NewMemoryIpvs()
+	c := newContext(ipvs, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "10.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 80, Host: "10.0.0.1",
+		Netmask: 24}}))
+	assert.Equal(t, uint32(0x00ffffff),
+		ipvs.(*memoryIpvs).services[memoryServiceKey{"10.0.0.1", 80, syscall.IPPROTO_TCP}].netmask)
+}
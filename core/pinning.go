@@ -0,0 +1,398 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible client pinning errors.
+var (
+	ErrNotPersistent    = errors.New("service isn't persistent")
+	ErrInvalidPinClient = errors.New("client must be an address or a subnet of the service address family")
+	ErrPinsUnsupported  = errors.New("IPVS implementation doesn't support fwmark services")
+	ErrPinTunnel        = errors.New("clients can't be pinned to backends of services with tunnel encapsulation")
+	ErrPinFailed        = errors.New("error while applying client pins")
+)
+
+// nftPinTable is nftables table marking packets of pinned clients. It is replaced as a whole on every change.
+const nftPinTable = "gorb_pins"
+
+// pinMarkBase is the firewall mark below the ones of pins, so they don't clash with marks of other tools.
+const pinMarkBase uint32 = 0x47520000
+
+// IpvsFwmarker is implemented by IPVS clients able to manage firewall mark services.
+type IpvsFwmarker interface {
+	AddFWMService(fwmark uint32, sched string, af uint16) error
+	DelFWMService(fwmark uint32, af uint16) error
+	AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error
+}
+
+// clientPin sends new connections of the client subnet to a single backend
+// via a firewall mark service with the backend as its only destination.
+type clientPin struct {
+	client *net.IPNet
+	rsID   string
+	mark   uint32
+}
+
+// ClientPin is a client subnet pinned to a backend of the service.
+type ClientPin struct {
+	Client string `json:"client"`
+	RsID   string `json:"rs_id"`
+	// Mark is the firewall mark of the IPVS service forwarding the client to the backend.
+	Mark uint32 `json:"mark"`
+}
+
+// PinRule marks packets of the pinned client to the virtual service.
+type PinRule struct {
+	VsID     string
+	RsID     string
+	Client   *net.IPNet
+	Host     net.IP
+	Port     uint16
+	Protocol string
+	Mark     uint32
+}
+
+// ClientPinner marks packets of pinned clients before they reach IPVS.
+type ClientPinner interface {
+	// Apply replaces all previously applied rules.
+	Apply(rules []PinRule) error
+}
+
+// nftClientPinner marks packets of pinned clients with nftables.
+type nftClientPinner struct{}
+
+// NewClientPinner creates nftables based client pinner used by default.
+func NewClientPinner() ClientPinner {
+	return nftClientPinner{}
+}
+
+func (nftClientPinner) Apply(rules []PinRule) error {
+	return runNft(nftPinRuleset(rules))
+}
+
+// nftPinRuleset builds nftables script atomically replacing the table of pins.
+func nftPinRuleset(rules []PinRule) string {
+	var b strings.Builder
+	// declaring the table first makes deletion safe if it doesn't exist yet
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", nftPinTable, nftPinTable)
+	if len(rules) == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "table inet %s {\n\tchain pin {\n", nftPinTable)
+	b.WriteString("\t\ttype filter hook prerouting priority mangle; policy accept;\n")
+	for _, rule := range rules {
+		family := "ip"
+		if rule.Host.To4() == nil {
+			family = "ip6"
+		}
+		// services on port zero forward all ports of the protocol
+		dport := fmt.Sprintf("meta l4proto %s", rule.Protocol)
+		if rule.Port != 0 {
+			dport = fmt.Sprintf("%s dport %d", rule.Protocol, rule.Port)
+		}
+		fmt.Fprintf(&b, "\t\t%s saddr %s %s daddr %s %s meta mark set 0x%08x comment %q\n",
+			family, rule.Client, family, rule.Host, dport, rule.Mark, rule.VsID+"/"+rule.RsID)
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// parsePinClient parses the client address or subnet of the service address family.
+func parsePinClient(client string, host net.IP) (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(client)
+	if err != nil {
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPinClient, client)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		subnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if util.AddrFamily(subnet.IP) != util.AddrFamily(host) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPinClient, client)
+	}
+	return subnet, nil
+}
+
+// applyPins marks packets of pinned clients of all services. Context mutex must be held.
+func (ctx *Context) applyPins() error {
+	var rules []PinRule
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		for _, client := range sortedKeys(vs.pins) {
+			pin := vs.pins[client]
+			rules = append(rules, PinRule{
+				VsID:     vsID,
+				RsID:     pin.rsID,
+				Client:   pin.client,
+				Host:     vs.options.host,
+				Port:     vs.options.Port,
+				Protocol: vs.options.Protocol,
+				Mark:     pin.mark,
+			})
+		}
+	}
+	// don't touch nftables at all unless pins have ever been used
+	if len(rules) == 0 && !ctx.pinsApplied {
+		return nil
+	}
+	if ctx.clientPinner == nil {
+		ctx.clientPinner = NewClientPinner()
+	}
+	if err := ctx.clientPinner.Apply(rules); err != nil {
+		log.Errorf("unable to apply client pins: %s", err)
+		return ErrPinFailed
+	}
+	ctx.pinsApplied = len(rules) > 0
+	return nil
+}
+
+// pinMark returns the lowest firewall mark not used by pins. Context mutex must be held.
+func (ctx *Context) pinMark() uint32 {
+	used := make(map[uint32]bool)
+	for _, vs := range ctx.services {
+		for _, pin := range vs.pins {
+			used[pin.mark] = true
+		}
+	}
+	mark := pinMarkBase + 1
+	for used[mark] {
+		mark++
+	}
+	return mark
+}
+
+// pinByMark returns the service and the pin owning the firewall mark service,
+// nil if there are none. Context mutex must be held.
+func (ctx *Context) pinByMark(mark uint32) (*Service, *clientPin) {
+	if mark == 0 {
+		return nil, nil
+	}
+	for _, vs := range ctx.services {
+		for _, pin := range vs.pins {
+			if pin.mark == mark {
+				return vs, pin
+			}
+		}
+	}
+	return nil, nil
+}
+
+// delPinService removes the firewall mark service of the pin along with its destination.
+func (ctx *Context) delPinService(vs *Service, pin *clientPin) error {
+	fwmarker, ok := ctx.ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	if err := fwmarker.DelFWMService(pin.mark, uint16(util.AddrFamily(vs.options.host))); err != nil {
+		log.Errorf("error while removing fwmark service %#x of pin [%s] %s: %s", pin.mark, vs.vsID, pin.client, err)
+		return ErrIpvsSyscallFailed
+	}
+	return nil
+}
+
+// removePins unpins clients of the backend, or of all backends if rsID is empty.
+// Context mutex must be held.
+func (ctx *Context) removePins(vs *Service, rsID string) {
+	var removed []*clientPin
+	for _, client := range sortedKeys(vs.pins) {
+		pin := vs.pins[client]
+		if rsID != "" && pin.rsID != rsID {
+			continue
+		}
+		delete(vs.pins, client)
+		removed = append(removed, pin)
+		log.Infof("client %s is unpinned from removed backend [%s/%s]", client, vs.vsID, pin.rsID)
+	}
+	if len(removed) == 0 {
+		return
+	}
+	// packets must stop being marked before their services are gone
+	ctx.applyPins()
+	for _, pin := range removed {
+		ctx.delPinService(vs, pin)
+	}
+}
+
+// PinClient sends new connections of the client address or subnet to the backend
+// regardless of its weight and the scheduler, e.g. to reproduce issues of sticky
+// sessions. Established connections and persistence templates are left as they are.
+// Pins aren't stored and are dropped along with their backend.
+func (ctx *Context) PinClient(vsID, client, rsID string, pre Precondition) (*ClientPin, error) {
+	fwmarker, ok := ctx.ipvs.(IpvsFwmarker)
+	if !ok {
+		return nil, ErrPinsUnsupported
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return nil, err
+	}
+	rs, exists := vs.backends[rsID]
+	if !exists {
+		return nil, objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	if vs.options.Tunnel != nil {
+		return nil, ErrPinTunnel
+	}
+	subnet, err := parsePinClient(client, vs.options.host)
+	if err != nil {
+		return nil, err
+	}
+	key := subnet.String()
+	if previous, exists := vs.pins[key]; exists {
+		if previous.rsID == rsID {
+			return &ClientPin{Client: key, RsID: rsID, Mark: previous.mark}, nil
+		}
+		delete(vs.pins, key)
+		if err := ctx.applyPins(); err != nil {
+			vs.pins[key] = previous
+			return nil, err
+		}
+		ctx.delPinService(vs, previous)
+	}
+
+	pin := &clientPin{client: subnet, rsID: rsID, mark: ctx.pinMark()}
+	af := uint16(util.AddrFamily(vs.options.host))
+	if err := fwmarker.AddFWMService(pin.mark, "rr", af); err != nil {
+		log.Errorf("error while creating fwmark service %#x of pin [%s] %s: %s", pin.mark, vsID, key, err)
+		return nil, ErrIpvsSyscallFailed
+	}
+	if err := fwmarker.AddFWMDestFWD(pin.mark, rs.options.host.String(), af, rs.options.Port, 1,
+		vs.options.methodID); err != nil {
+		log.Errorf("error while adding backend [%s/%s] to fwmark service %#x: %s", vsID, rsID, pin.mark, err)
+		ctx.delPinService(vs, pin)
+		return nil, ErrIpvsSyscallFailed
+	}
+
+	if vs.pins == nil {
+		vs.pins = make(map[string]*clientPin)
+	}
+	vs.pins[key] = pin
+	if err := ctx.applyPins(); err != nil {
+		delete(vs.pins, key)
+		ctx.delPinService(vs, pin)
+		return nil, err
+	}
+	ctx.recordEvent(vsID, rsID, EventPinned, "client %s pinned", key)
+	log.Infof("client %s is pinned to backend [%s/%s]", key, vsID, rsID)
+	return &ClientPin{Client: key, RsID: rsID, Mark: pin.mark}, nil
+}
+
+// UnpinClient returns the pinned client address or subnet to the scheduler of the service.
+func (ctx *Context) UnpinClient(vsID, client string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	subnet, err := parsePinClient(client, vs.options.host)
+	if err != nil {
+		return err
+	}
+	key := subnet.String()
+	pin, exists := vs.pins[key]
+	if !exists {
+		return objectError(ErrObjectNotFound, "pin", key)
+	}
+	delete(vs.pins, key)
+	if err := ctx.applyPins(); err != nil {
+		vs.pins[key] = pin
+		return err
+	}
+	if err := ctx.delPinService(vs, pin); err != nil {
+		return err
+	}
+	ctx.recordEvent(vsID, pin.rsID, EventUnpinned, "client %s unpinned", key)
+	log.Infof("client %s is unpinned from backend [%s/%s]", key, vsID, pin.rsID)
+	return nil
+}
+
+// ClientPins returns clients pinned to backends of the service ordered by their subnets.
+func (ctx *Context) ClientPins(vsID string) ([]ClientPin, error) {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	pins := make([]ClientPin, 0, len(vs.pins))
+	for _, client := range sortedKeys(vs.pins) {
+		pin := vs.pins[client]
+		pins = append(pins, ClientPin{Client: client, RsID: pin.rsID, Mark: pin.mark})
+	}
+	return pins, nil
+}
+
+// PersistenceTemplate is an entry of the IPVS connection table sending new
+// connections of the client to the same backend.
+type PersistenceTemplate struct {
+	// Client address, masked by the netmask of the service.
+	Client  string `json:"client"`
+	Backend string `json:"backend"`
+	// RsID is empty if the destination isn't a backend of the service, e.g. a sorry server.
+	RsID string `json:"rs_id,omitempty"`
+	// Expires is a number of seconds until the template expires.
+	Expires uint32 `json:"expires"`
+}
+
+// PersistenceTemplates returns persistence templates of the persistent service
+// ordered by client addresses.
+func (ctx *Context) PersistenceTemplates(vsID string) ([]PersistenceTemplate, error) {
+	ctx.mutex.RLock()
+	vs, exists := ctx.services[vsID]
+	if exists && !vs.options.Persistent {
+		ctx.mutex.RUnlock()
+		return nil, ErrNotPersistent
+	}
+	ctx.mutex.RUnlock()
+
+	conns, backends, err := ctx.serviceConns(vsID, "")
+	if err != nil {
+		return nil, err
+	}
+	templates := []PersistenceTemplate{}
+	for _, conn := range conns {
+		// templates have no client port and no protocol state
+		if conn.ClientPort != 0 || conn.State != "NONE" {
+			continue
+		}
+		backend := net.JoinHostPort(conn.DestIP, fmt.Sprint(conn.DestPort))
+		templates = append(templates, PersistenceTemplate{
+			Client:  conn.ClientIP,
+			Backend: backend,
+			RsID:    backends[backend],
+			Expires: conn.Expires,
+		})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		if templates[i].Client != templates[j].Client {
+			return templates[i].Client < templates[j].Client
+		}
+		return templates[i].Backend < templates[j].Backend
+	})
+	return templates, nil
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingClientPinner struct {
+	applied [][]PinRule
+}
+
+func (p *recordingClientPinner) Apply(rules []PinRule) error {
+	p.applied = append(p.applied, rules)
+	return nil
+}
+
+func TestNftPinRuleset(t *testing.T) {
+	assert.Equal(t, "table inet gorb_pins\ndelete table inet gorb_pins\n", nftPinRuleset(nil))
+
+	_, client, _ := net.ParseCIDR("10.1.0.0/24")
+	_, client6, _ := net.ParseCIDR("fd01::/64")
+	ruleset := nftPinRuleset([]PinRule{
+		{VsID: "web", RsID: "web-1", Client: client, Host: net.ParseIP("10.0.0.1"), Port: 80, Protocol: "tcp",
+			Mark: pinMarkBase + 1},
+		{VsID: "dns", RsID: "dns-1", Client: client6, Host: net.ParseIP("fd00::1"), Protocol: "udp", Mark: pinMarkBase + 2},
+	})
+	assert.Contains(t, ruleset, "type filter hook prerouting priority mangle; policy accept;")
+	assert.Contains(t, ruleset, `ip saddr 10.1.0.0/24 ip daddr 10.0.0.1 tcp dport 80 meta mark set 0x47520001 comment "web/web-1"`)
+	assert.Contains(t, ruleset, `ip6 saddr fd01::/64 ip6 daddr fd00::1 meta l4proto udp meta mark set 0x47520002 comment "dns/dns-1"`)
+}
+
+func TestPinClient(t *testing.T) {
+	pinner := &recordingClientPinner{}
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.clientPinner = pinner
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost", Persistent: true},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.3", Port: 8080},
+		},
+	}))
+	assert.Empty(t, pinner.applied, "nftables must not be touched without pins")
+
+	pin, err := c.PinClient(vsID, "10.1.0.7/24", "a", Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, &ClientPin{Client: "10.1.0.0/24", RsID: "a", Mark: pinMarkBase + 1}, pin)
+	_, err = c.PinClient(vsID, "10.2.0.1", "b", Precondition{})
+	require.NoError(t, err)
+	require.Len(t, pinner.applied, 2)
+	assert.Len(t, pinner.applied[1], 2)
+
+	_, err = c.PinClient(vsID, "fd00::1", "a", Precondition{})
+	assert.ErrorIs(t, err, ErrInvalidPinClient)
+	_, err = c.PinClient(vsID, "10.3.0.1", "unknown", Precondition{})
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// fwmark services of pins belong to the service
+	table, err := c.IpvsTable()
+	require.NoError(t, err)
+	require.Len(t, table, 3)
+	assert.Equal(t, pinMarkBase+1, table[1].FWMark)
+	assert.Equal(t, vsID, table[1].VsID)
+	assert.Equal(t, []IpvsTableDest{{IP: "127.0.0.2", Port: 8080, Weight: 1, RsID: "a"}}, table[1].Destinations)
+	duplicates, err := c.Duplicates()
+	require.NoError(t, err)
+	assert.Empty(t, duplicates.StaleServices)
+	drift, err := c.IpvsDrift()
+	require.NoError(t, err)
+	assert.Empty(t, drift.Extra)
+
+	// pinning the client again moves it to another backend
+	pin, err = c.PinClient(vsID, "10.1.0.0/24", "b", Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, "b", pin.RsID)
+	pins, err := c.ClientPins(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, []ClientPin{{Client: "10.1.0.0/24", RsID: "b", Mark: pinMarkBase + 1},
+		{Client: "10.2.0.1/32", RsID: "b", Mark: pinMarkBase + 2}}, pins)
+
+	require.NoError(t, c.UnpinClient(vsID, "10.2.0.1", Precondition{}))
+	assert.ErrorIs(t, c.UnpinClient(vsID, "10.2.0.1", Precondition{}), ErrObjectNotFound)
+
+	// pins are dropped along with their backend
+	_, err = c.RemoveBackend(vsID, "b")
+	require.NoError(t, err)
+	pins, err = c.ClientPins(vsID)
+	require.NoError(t, err)
+	assert.Empty(t, pins)
+	assert.Empty(t, pinner.applied[len(pinner.applied)-1])
+	pools, err := c.ipvs.GetPools()
+	require.NoError(t, err)
+	assert.Len(t, pools, 1)
+}
+
+func TestPersistenceTemplates(t *testing.T) {
+	c := newContext(connTableIpvs{NewMemoryIpvs()}, &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost", Persistent: true},
+		ServiceBackends: map[string]*BackendOptions{rsID: {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	templates, err := c.PersistenceTemplates(vsID)
+	require.NoError(t, err)
+	assert.Equal(t, []PersistenceTemplate{{Client: "10.0.0.100", Backend: "127.0.0.2:8080", RsID: rsID, Expires: 300}},
+		templates)
+
+	require.NoError(t, c.CreateService("plain", &ServiceConfig{ServiceOptions: &ServiceOptions{Port: 81, Host: "localhost"}}))
+	_, err = c.PersistenceTemplates("plain")
+	assert.Equal(t, ErrNotPersistent, err)
+}
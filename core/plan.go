@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PlanSource is a source of desired configuration of a plan.
+type PlanSource string
+
+// Possible plan sources.
+const (
+	PlanSourceStore   PlanSource = "store"
+	PlanSourceRequest PlanSource = "request"
+)
+
+// planTTL is how long a plan could be applied after its creation.
+const planTTL = 15 * time.Minute
+
+// Possible plan errors.
+var (
+	ErrPlanOutdated = errors.New("services have been changed since the plan was created")
+	ErrStoreManaged = errors.New("services are managed by store")
+)
+
+// Plan is a SyncPlan kept by GORB, so it could be reviewed and applied later by its ID.
+type Plan struct {
+	ID      string     `json:"id"`
+	Source  PlanSource `json:"source"`
+	Created time.Time  `json:"created"`
+	Expires time.Time  `json:"expires"`
+	*SyncPlan
+
+	// revision of context the plan was built against
+	revision uint64
+}
+
+func newPlanID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// createPlan builds and keeps a plan for desired services.
+func (ctx *Context) createPlan(source PlanSource, services map[string]*ServiceConfig) *Plan {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	now := time.Now()
+	if ctx.plans == nil {
+		ctx.plans = make(map[string]*Plan)
+	}
+	for id, plan := range ctx.plans {
+		if now.After(plan.Expires) {
+			delete(ctx.plans, id)
+		}
+	}
+
+	plan := &Plan{
+		ID:       newPlanID(),
+		Source:   source,
+		Created:  now,
+		Expires:  now.Add(planTTL),
+		SyncPlan: ctx.planSync(services),
+		revision: ctx.revision,
+	}
+	ctx.plans[plan.ID] = plan
+	log.Infof("created plan [%s] from %s with %d operation(s)", plan.ID, source, len(plan.Operations))
+	return plan
+}
+
+// CreatePlan creates a plan to bring GORB to the desired services, so it could be
+// reviewed and applied later with ApplyPlan.
+func (ctx *Context) CreatePlan(services map[string]*ServiceConfig) *Plan {
+	services = normalizeServiceIDs(services)
+	validateServiceConfigs(services, ctx.endpoint, ctx.backendNetworks)
+	return ctx.createPlan(PlanSourceRequest, services)
+}
+
+// ApplyPlan applies a plan created by CreatePlan or Store.Plan. A plan could be
+// applied only once and only if services haven't been changed since its creation.
+func (ctx *Context) ApplyPlan(id string) (*StoreSyncResult, error) {
+	if ctx.StoreManaged() {
+		ctx.mutex.RLock()
+		plan, exists := ctx.plans[id]
+		ctx.mutex.RUnlock()
+		if exists && plan.Source != PlanSourceStore {
+			return nil, ErrStoreManaged
+		}
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	plan, exists := ctx.plans[id]
+	if !exists || time.Now().After(plan.Expires) {
+		delete(ctx.plans, id)
+		return nil, ErrObjectNotFound
+	}
+	if plan.revision != ctx.revision {
+		return nil, ErrPlanOutdated
+	}
+	delete(ctx.plans, id)
+
+	log.Infof("applying plan [%s]", id)
+	result := newStoreSyncResult()
+	ctx.applySyncPlan(context.Background(), plan.SyncPlan, result)
+	result.finish()
+
+	if plan.Source == PlanSourceStore && ctx.store != nil {
+		ctx.store.setLastSync(result)
+	}
+	return result, result.Err()
+}
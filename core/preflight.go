@@ -0,0 +1,87 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible preflight errors.
+var (
+	ErrMissingCapability = errors.New("CAP_NET_ADMIN capability is required to manage IPVS: " +
+		"run GORB as root or grant the capability, e.g. AmbientCapabilities=CAP_NET_ADMIN in systemd unit")
+	ErrIpvsModuleMissing = errors.New("IPVS kernel modules are neither loaded nor installed")
+)
+
+// Preflight checks that GORB is able to manage IPVS on this host with the schedulers.
+func Preflight(schedulers ...string) error {
+	if ok, err := util.HasCapability(util.CapNetAdmin); err != nil {
+		log.Warnf("unable to check process capabilities: %s", err)
+	} else if !ok {
+		return ErrMissingCapability
+	}
+	return checkIpvsModules(schedulers)
+}
+
+// checkIpvsModules checks ip_vs and modules of the schedulers, all missing
+// modules are reported at once with the remediation hint.
+func checkIpvsModules(schedulers []string) error {
+	modules := []string{"ip_vs"}
+	for _, sched := range schedulers {
+		if module := "ip_vs_" + sched; !slices.Contains(modules, module) {
+			modules = append(modules, module)
+		}
+	}
+
+	var missing []string
+	for _, module := range modules {
+		switch {
+		case util.KernelModuleLoaded(module):
+		case !util.KernelModuleInstalled(module):
+			missing = append(missing, module)
+		case module == "ip_vs":
+			// IPVS loads scheduler modules on demand, but not itself
+			log.Warn("ip_vs kernel module is not loaded yet, consider adding it to /etc/modules-load.d")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s, install kernel modules package and run 'modprobe -a %s'",
+			ErrIpvsModuleMissing, strings.Join(missing, ", "), strings.Join(missing, " "))
+	}
+	return nil
+}
+
+// checkPlannedSchedulers checks scheduler modules of services the first
+// synchronization is going to create or update, before any of them fails.
+func (ctx *Context) checkPlannedSchedulers(plan *SyncPlan) {
+	var schedulers []string
+	for _, op := range plan.Operations {
+		if op.service == nil || op.service.ServiceOptions == nil {
+			continue
+		}
+		if sched := op.service.ServiceOptions.LbMethod; !slices.Contains(schedulers, sched) {
+			schedulers = append(schedulers, sched)
+		}
+	}
+	slices.Sort(schedulers)
+	if err := checkIpvsModules(schedulers); err != nil {
+		log.Errorf("preflight check of configured services failed: %s", err)
+	}
+}
+
+// schedulerModuleError explains why IPVS scheduler could be unavailable.
+// Returns nil if scheduler module looks available.
+func schedulerModuleError(sched string) error {
+	module := "ip_vs_" + sched
+	if util.KernelModuleLoaded(module) {
+		return nil
+	}
+	if util.KernelModuleInstalled(module) {
+		return fmt.Errorf("scheduler '%s' kernel module is not loaded: run 'modprobe %s'", sched, module)
+	}
+	return fmt.Errorf("scheduler '%s' is unknown: kernel module %s is neither loaded nor installed", sched, module)
+}
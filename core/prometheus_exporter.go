@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"regexp"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,64 +13,231 @@ const (
 	namespace = "gorb" // For Prometheus metrics.
 )
 
+// Labels of backend series which could be dropped.
+const (
+	LabelBackendName = "backend_name"
+	LabelBackendHost = "backend_host"
+	LabelBackendPort = "backend_port"
+)
+
+// Possible exporter errors.
 var (
-	serviceHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_health",
-		Help:      "Health of the load balancer service",
-	}, []string{"service_name", "service_host", "service_port", "protocol"})
-
-	serviceBackends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_backends",
-		Help:      "Number of backends in the load balancer service",
-	}, []string{"service_name", "service_host", "service_port", "protocol"})
-
-	serviceBackendUptimeTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_backend_uptime_seconds",
-		Help:      "Uptime in seconds of a backend service",
-	}, []string{"service_name", "backend_name", "backend_host", "backend_port"})
-
-	serviceBackendHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_backend_health",
-		Help:      "Health of a backend service",
-	}, []string{"service_name", "backend_name", "backend_host", "backend_port"})
-
-	serviceBackendStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_backend_status",
-		Help:      "Status of a backend service",
-	}, []string{"service_name", "backend_name", "backend_host", "backend_port"})
-
-	serviceBackendWeight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "service_backend_weight",
-		Help:      "Weight of a backend service",
-	}, []string{"service_name", "backend_name", "backend_host", "backend_port"})
+	ErrUnknownBackendLabel = errors.New("specified backend label is unknown")
+	ErrAmbiguousBackends   = errors.New("backend labels must include backend_name or both backend_host and" +
+		" backend_port, use aggregated mode to drop backend series")
+	ErrInvalidMetricLabel = errors.New("specified metric label is invalid or reserved")
 )
 
+var metricLabelRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var reservedMetricLabels = map[string]bool{
+	"service_name": true, "service_host": true, "service_port": true, "protocol": true, "alert": true,
+	LabelBackendName: true, LabelBackendHost: true, LabelBackendPort: true,
+}
+
+// ExporterOptions configure labels of exported series.
+type ExporterOptions struct {
+	// BackendLabels of backend series, all of backend_name, backend_host and backend_port by default.
+	BackendLabels []string
+	// MetadataLabels are keys of service labels added to all series of the service.
+	MetadataLabels []string
+	// Aggregated mode exports per service series only.
+	Aggregated bool
+}
+
+// Validate fills missing fields and validates exporter configuration.
+func (o *ExporterOptions) Validate() error {
+	if o.BackendLabels == nil {
+		o.BackendLabels = []string{LabelBackendName, LabelBackendHost, LabelBackendPort}
+	}
+	labels := make(map[string]bool, len(o.BackendLabels))
+	for _, label := range o.BackendLabels {
+		switch label {
+		case LabelBackendName, LabelBackendHost, LabelBackendPort:
+			labels[label] = true
+		default:
+			return fmt.Errorf("%w: %s", ErrUnknownBackendLabel, label)
+		}
+	}
+	if !o.Aggregated && !labels[LabelBackendName] && !(labels[LabelBackendHost] && labels[LabelBackendPort]) {
+		return ErrAmbiguousBackends
+	}
+	for _, label := range o.MetadataLabels {
+		if !metricLabelRegexp.MatchString(label) || reservedMetricLabels[label] {
+			return fmt.Errorf("%w: %s", ErrInvalidMetricLabel, label)
+		}
+	}
+	return nil
+}
+
 type Exporter struct {
-	ctx *Context
+	ctx     *Context
+	options ExporterOptions
+
+	serviceHealth             *prometheus.GaugeVec
+	serviceStatus             *prometheus.GaugeVec
+	serviceBackends           *prometheus.GaugeVec
+	serviceBackendsHealthy    *prometheus.GaugeVec
+	serviceBackendsProgrammed *prometheus.GaugeVec
+	serviceBackendUptimeTotal *prometheus.GaugeVec
+	serviceBackendHealth      *prometheus.GaugeVec
+	serviceBackendStatus      *prometheus.GaugeVec
+	serviceBackendWeight      *prometheus.GaugeVec
+	serviceAlert              *prometheus.GaugeVec
+
+	pulseUpdatesQueued    *prometheus.Desc
+	pulseUpdatesCoalesced *prometheus.Desc
+	pulseUpdatesDropped   *prometheus.Desc
+	pulseUpdatesPending   *prometheus.Desc
+	pulseUpdateLatency    *prometheus.Desc
+
+	ipvsOperationDuration *prometheus.Desc
+	ipvsOperationErrors   *prometheus.Desc
+	ipvsQueueWait         *prometheus.Desc
+	ipvsQueuePending      *prometheus.Desc
+	ipvsQueueRejected     *prometheus.Desc
 }
 
-func NewExporter(ctx *Context) *Exporter {
+func NewExporter(ctx *Context, options ExporterOptions) (*Exporter, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	serviceLabels := append([]string{"service_name", "service_host", "service_port", "protocol"},
+		options.MetadataLabels...)
+	backendLabels := append(append([]string{"service_name"}, options.BackendLabels...), options.MetadataLabels...)
+	alertLabels := append([]string{"service_name", "alert"}, options.MetadataLabels...)
+
 	return &Exporter{
-		ctx: ctx,
+		ctx:     ctx,
+		options: options,
+
+		serviceHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_health",
+			Help:      "Health of the load balancer service",
+		}, serviceLabels),
+
+		serviceStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_status",
+			Help:      "Status of the load balancer service, 0 healthy, 1 degraded, 2 down",
+		}, serviceLabels),
+
+		serviceBackends: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backends",
+			Help:      "Number of backends configured in the load balancer service",
+		}, serviceLabels),
+
+		serviceBackendsHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backends_healthy",
+			Help:      "Number of healthy backends receiving traffic in the load balancer service",
+		}, serviceLabels),
+
+		serviceBackendsProgrammed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backends_programmed",
+			Help:      "Number of destinations programmed in IPVS for the load balancer service",
+		}, serviceLabels),
+
+		serviceBackendUptimeTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backend_uptime_seconds",
+			Help:      "Uptime in seconds of a backend service",
+		}, backendLabels),
+
+		serviceBackendHealth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backend_health",
+			Help:      "Health of a backend service",
+		}, backendLabels),
+
+		serviceBackendStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backend_status",
+			Help:      "Status of a backend service",
+		}, backendLabels),
+
+		serviceBackendWeight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_backend_weight",
+			Help:      "Weight of a backend service",
+		}, backendLabels),
+
+		serviceAlert: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "service_alert",
+			Help:      "State of the load balancer service alert, 1 if firing",
+		}, alertLabels),
+
+		pulseUpdatesQueued: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pulse_updates_queued_total"),
+			"Number of pulse updates queued for processing", nil, nil),
+		pulseUpdatesCoalesced: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pulse_updates_coalesced_total"),
+			"Number of pulse updates which replaced a pending update of the same pulse", nil, nil),
+		pulseUpdatesDropped: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pulse_updates_dropped_total"),
+			"Number of pulse updates dropped because the queue was full", nil, nil),
+		pulseUpdatesPending: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pulse_updates_pending"),
+			"Number of pulse updates waiting for processing", nil, nil),
+		pulseUpdateLatency: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pulse_update_latency_seconds"),
+			"Time from queuing of pulse updates till they were processed", nil, nil),
+
+		ipvsOperationDuration: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ipvs_operation_duration_seconds"),
+			"Time IPVS operations took", []string{"operation"}, nil),
+		ipvsOperationErrors: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ipvs_operation_errors_total"),
+			"Number of failed IPVS operations", []string{"operation"}, nil),
+		ipvsQueueWait: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ipvs_queue_wait_seconds"),
+			"Time IPVS operations waited in the queue", []string{"operation"}, nil),
+		ipvsQueuePending: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ipvs_queue_pending"),
+			"Number of IPVS operations waiting in the queue", nil, nil),
+		ipvsQueueRejected: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "ipvs_queue_rejected_total"),
+			"Number of IPVS operations rejected because the queue was full", nil, nil),
+	}, nil
+}
+
+func (e *Exporter) serviceMetrics() []*prometheus.GaugeVec {
+	return []*prometheus.GaugeVec{
+		e.serviceHealth,
+		e.serviceStatus,
+		e.serviceBackends,
+		e.serviceBackendsHealthy,
+		e.serviceBackendsProgrammed,
+		e.serviceAlert,
+	}
+}
+
+func (e *Exporter) backendMetrics() []*prometheus.GaugeVec {
+	if e.options.Aggregated {
+		return nil
+	}
+	return []*prometheus.GaugeVec{
+		e.serviceBackendUptimeTotal,
+		e.serviceBackendHealth,
+		e.serviceBackendStatus,
+		e.serviceBackendWeight,
 	}
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	serviceHealth.Describe(ch)
-	serviceBackends.Describe(ch)
-	serviceBackendUptimeTotal.Describe(ch)
-	serviceBackendHealth.Describe(ch)
-	serviceBackendStatus.Describe(ch)
-	serviceBackendWeight.Describe(ch)
+	for _, m := range append(e.serviceMetrics(), e.backendMetrics()...) {
+		m.Describe(ch)
+	}
+	ch <- e.pulseUpdatesQueued
+	ch <- e.pulseUpdatesCoalesced
+	ch <- e.pulseUpdatesDropped
+	ch <- e.pulseUpdatesPending
+	ch <- e.pulseUpdateLatency
+	ch <- e.ipvsOperationDuration
+	ch <- e.ipvsOperationErrors
+	ch <- e.ipvsQueueWait
+	ch <- e.ipvsQueuePending
+	ch <- e.ipvsQueueRejected
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.sendPulseQueueMetrics(ch)
+	e.sendIpvsQueueMetrics(ch)
 	if err := e.collect(); err != nil {
 		log.Errorf("error collecting metrics: %s", err)
 		return
@@ -78,59 +246,128 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 }
 
 func (e *Exporter) sendMetrics(ch chan<- prometheus.Metric) {
-	metrics := []*prometheus.GaugeVec{
-		serviceHealth,
-		serviceBackends,
-		serviceBackendUptimeTotal,
-		serviceBackendHealth,
-		serviceBackendStatus,
-		serviceBackendWeight,
-	}
-	for _, m := range metrics {
+	for _, m := range append(e.serviceMetrics(), e.backendMetrics()...) {
 		m.Collect(ch)
 		m.Reset()
 	}
 }
 
+// sendPulseQueueMetrics reports whether the notification loop keeps up with
+// pulse updates.
+func (e *Exporter) sendPulseQueueMetrics(ch chan<- prometheus.Metric) {
+	if e.ctx.pulses == nil {
+		return
+	}
+	stats := e.ctx.pulses.Stats()
+	ch <- prometheus.MustNewConstMetric(e.pulseUpdatesQueued, prometheus.CounterValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(e.pulseUpdatesCoalesced, prometheus.CounterValue, float64(stats.Coalesced))
+	ch <- prometheus.MustNewConstMetric(e.pulseUpdatesDropped, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(e.pulseUpdatesPending, prometheus.GaugeValue, float64(stats.Pending))
+	ch <- prometheus.MustNewConstSummary(e.pulseUpdateLatency, stats.Processed, stats.Latency.Seconds(), nil)
+}
+
+// sendIpvsQueueMetrics reports how long IPVS operations take and wait for
+// each other.
+func (e *Exporter) sendIpvsQueueMetrics(ch chan<- prometheus.Metric) {
+	stats := e.ctx.IpvsQueueStats()
+	if stats == nil {
+		return
+	}
+	for operation, op := range stats.Operations {
+		ch <- prometheus.MustNewConstSummary(e.ipvsOperationDuration, op.Calls, op.Latency.Seconds(), nil, operation)
+		ch <- prometheus.MustNewConstMetric(e.ipvsOperationErrors, prometheus.CounterValue, float64(op.Errors), operation)
+		ch <- prometheus.MustNewConstSummary(e.ipvsQueueWait, op.Calls, op.Wait.Seconds(), nil, operation)
+	}
+	ch <- prometheus.MustNewConstMetric(e.ipvsQueuePending, prometheus.GaugeValue, float64(stats.Pending))
+	ch <- prometheus.MustNewConstMetric(e.ipvsQueueRejected, prometheus.CounterValue, float64(stats.Rejected))
+}
+
+// backendLabelValues returns values of configured backend labels.
+func (e *Exporter) backendLabelValues(serviceName, backendName string, backend *BackendInfo) []string {
+	values := []string{serviceName}
+	for _, label := range e.options.BackendLabels {
+		switch label {
+		case LabelBackendName:
+			values = append(values, backendName)
+		case LabelBackendHost:
+			values = append(values, backend.Options.Host)
+		case LabelBackendPort:
+			values = append(values, fmt.Sprintf("%d", backend.Options.Port))
+		}
+	}
+	return values
+}
+
+// metadataLabelValues returns values of configured metadata labels, empty for missing ones.
+func (e *Exporter) metadataLabelValues(service *ServiceInfo) []string {
+	values := make([]string, 0, len(e.options.MetadataLabels))
+	for _, label := range e.options.MetadataLabels {
+		values = append(values, service.Options.Labels[label])
+	}
+	return values
+}
+
 func (e *Exporter) collect() error {
+	// destinations programmed in IPVS are reported only if IPVS could be read
+	programmed := make(map[string]int)
+	table, tableErr := e.ctx.IpvsTable()
+	if tableErr != nil {
+		log.Warnf("error getting IPVS table for metrics: %s", tableErr)
+	}
+	for _, ipvsService := range table {
+		if ipvsService.VsID != "" {
+			programmed[ipvsService.VsID] = len(ipvsService.Destinations)
+		}
+	}
+
 	for serviceName := range e.ctx.services {
 		service, err := e.ctx.GetService(serviceName)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("error getting service: %s", serviceName))
 		}
+		metadata := e.metadataLabelValues(service)
+		serviceLabels := append([]string{serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
+			service.Options.Protocol}, metadata...)
+
+		e.serviceHealth.WithLabelValues(serviceLabels...).Set(service.Health)
+		e.serviceStatus.WithLabelValues(serviceLabels...).Set(service.Status.value())
+		e.serviceBackends.WithLabelValues(serviceLabels...).Set(float64(len(service.Backends)))
+		e.serviceBackendsHealthy.WithLabelValues(serviceLabels...).Set(float64(service.HealthyBackends))
+		if tableErr == nil {
+			e.serviceBackendsProgrammed.WithLabelValues(serviceLabels...).Set(float64(programmed[serviceName]))
+		}
 
-		serviceHealth.WithLabelValues(serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
-			service.Options.Protocol).
-			Set(service.Health)
+		for alert, firing := range service.Alerts {
+			value := 0.0
+			if firing {
+				value = 1
+			}
+			e.serviceAlert.WithLabelValues(append([]string{serviceName, alert}, metadata...)...).Set(value)
+		}
 
-		serviceBackends.WithLabelValues(serviceName, service.Options.Host, fmt.Sprintf("%d", service.Options.Port),
-			service.Options.Protocol).
-			Set(float64(len(service.Backends)))
+		if e.options.Aggregated {
+			continue
+		}
 		for _, backendName := range service.Backends {
 			backend, err := e.ctx.GetBackend(serviceName, backendName)
 			if err != nil {
 				return errors.Wrap(err, fmt.Sprintf("error getting backend %s from service %s", backendName, serviceName))
 			}
+			backendLabels := append(e.backendLabelValues(serviceName, backendName, backend), metadata...)
 
-			serviceBackendUptimeTotal.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Uptime.Seconds())
-
-			serviceBackendHealth.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(backend.Metrics.Health)
-
-			serviceBackendStatus.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Metrics.Status))
-
-			serviceBackendWeight.WithLabelValues(serviceName, backendName, backend.Options.Host,
-				fmt.Sprintf("%d", backend.Options.Port)).
-				Set(float64(backend.Options.weight))
+			e.serviceBackendUptimeTotal.WithLabelValues(backendLabels...).Set(backend.Metrics.Uptime.Seconds())
+			e.serviceBackendHealth.WithLabelValues(backendLabels...).Set(backend.Metrics.Health)
+			e.serviceBackendStatus.WithLabelValues(backendLabels...).Set(float64(backend.Metrics.Status))
+			e.serviceBackendWeight.WithLabelValues(backendLabels...).Set(float64(backend.Options.weight))
 		}
 	}
 	return nil
 }
-func RegisterPrometheusExporter(ctx *Context) {
-	prometheus.MustRegister(NewExporter(ctx))
+
+func RegisterPrometheusExporter(ctx *Context, options ExporterOptions) error {
+	exporter, err := NewExporter(ctx, options)
+	if err != nil {
+		return err
+	}
+	return prometheus.Register(exporter)
 }
@@ -1,9 +1,14 @@
 package core
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -20,19 +25,111 @@ var (
 			Port:   1234,
 			weight: 1,
 			vsID:   "service1",
-		},
-		monitor: &pulse.Pulse{}}
+		}}
 )
 
 func TestCollector(t *testing.T) {
 	service.backends = map[string]*Backend{"service1-backend1": backend}
 	ctx := &Context{
+		ipvs:     NewMemoryIpvs(),
 		services: map[string]*Service{"service1": service},
 	}
 
-	exporter := NewExporter(ctx)
-	err := exporter.collect()
+	exporter, err := NewExporter(ctx, ExporterOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = exporter.collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectorBackendCounts(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", "service1", "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService("service1", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 8080},
+			"b": {Host: "127.0.0.3", Port: 8080},
+		}}))
+	c.services["service1"].backends["b"].metrics.Status = pulse.StatusDown
+	require.NoError(t, c.ipvs.DelDestPort("127.0.0.1", 80, "127.0.0.3", 8080, c.services["service1"].options.protocol))
+
+	exporter, err := NewExporter(c, ExporterOptions{})
+	require.NoError(t, err)
+	require.NoError(t, exporter.collect())
+
+	expected := `
+# HELP gorb_service_backends_healthy Number of healthy backends receiving traffic in the load balancer service
+# TYPE gorb_service_backends_healthy gauge
+gorb_service_backends_healthy{protocol="tcp",service_host="localhost",service_name="service1",service_port="80"} 1
+# HELP gorb_service_backends_programmed Number of destinations programmed in IPVS for the load balancer service
+# TYPE gorb_service_backends_programmed gauge
+gorb_service_backends_programmed{protocol="tcp",service_host="localhost",service_name="service1",service_port="80"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(exporter.serviceBackendsHealthy, strings.NewReader(expected),
+		"gorb_service_backends_healthy"))
+	assert.NoError(t, testutil.CollectAndCompare(exporter.serviceBackendsProgrammed, strings.NewReader(expected),
+		"gorb_service_backends_programmed"))
+}
+
+func TestCollectorLabels(t *testing.T) {
+	_, err := NewExporter(&Context{}, ExporterOptions{BackendLabels: []string{LabelBackendHost}})
+	assert.Equal(t, ErrAmbiguousBackends, err)
+	_, err = NewExporter(&Context{}, ExporterOptions{MetadataLabels: []string{"service_name"}})
+	assert.True(t, errors.Is(err, ErrInvalidMetricLabel))
+
+	service.backends = map[string]*Backend{"service1-backend1": backend}
+	service.options.Labels = map[string]string{"team": "edge"}
+	defer func() { service.options.Labels = nil }()
+	ctx := &Context{
+		ipvs:     NewMemoryIpvs(),
+		services: map[string]*Service{"service1": service},
+	}
+
+	exporter, err := NewExporter(ctx, ExporterOptions{BackendLabels: []string{LabelBackendName},
+		MetadataLabels: []string{"team"}})
+	require.NoError(t, err)
+	expected := `
+# HELP gorb_service_backend_weight Weight of a backend service
+# TYPE gorb_service_backend_weight gauge
+gorb_service_backend_weight{backend_name="service1-backend1",service_name="service1",team="edge"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(exporter, strings.NewReader(expected), "gorb_service_backend_weight"))
+
+	exporter, err = NewExporter(ctx, ExporterOptions{Aggregated: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(exporter, "gorb_service_backend_weight"))
+	assert.Equal(t, 1, testutil.CollectAndCount(exporter, "gorb_service_backends"))
+}
+
+func TestCollectorPulseQueue(t *testing.T) {
+	ctx := &Context{ipvs: NewMemoryIpvs(), pulses: pulse.NewQueue(1)}
+	ctx.pulses.Push(pulse.Update{Source: pulse.ID{VsID: "a"}})
+	ctx.pulses.Push(pulse.Update{Source: pulse.ID{VsID: "a"}})
+	ctx.pulses.Push(pulse.Update{Source: pulse.ID{VsID: "b"}})
+
+	exporter, err := NewExporter(ctx, ExporterOptions{})
+	require.NoError(t, err)
+	expected := `
+# HELP gorb_pulse_updates_coalesced_total Number of pulse updates which replaced a pending update of the same pulse
+# TYPE gorb_pulse_updates_coalesced_total counter
+gorb_pulse_updates_coalesced_total 1
+# HELP gorb_pulse_updates_dropped_total Number of pulse updates dropped because the queue was full
+# TYPE gorb_pulse_updates_dropped_total counter
+gorb_pulse_updates_dropped_total 1
+# HELP gorb_pulse_updates_pending Number of pulse updates waiting for processing
+# TYPE gorb_pulse_updates_pending gauge
+gorb_pulse_updates_pending 1
+# HELP gorb_pulse_updates_queued_total Number of pulse updates queued for processing
+# TYPE gorb_pulse_updates_queued_total counter
+gorb_pulse_updates_queued_total 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(exporter, strings.NewReader(expected),
+		"gorb_pulse_updates_queued_total", "gorb_pulse_updates_coalesced_total", "gorb_pulse_updates_dropped_total",
+		"gorb_pulse_updates_pending"))
 }
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRegistrationTTL is the time a self-registered backend is kept without heartbeats.
+const DefaultRegistrationTTL = 30 * time.Second
+
+var (
+	// ErrNotRegistered is returned when a backend added by other means is registered or deregistered.
+	ErrNotRegistered = errors.New("backend isn't self-registered")
+	// ErrInvalidTTL is returned for registrations without positive TTL.
+	ErrInvalidTTL = errors.New("registration ttl must be positive")
+)
+
+// RegisterBackend adds a backend registered by the real server itself or renews
+// its registration. New backends are pending until their first successful health
+// check and are removed unless the registration is renewed within the ttl.
+// Renewing with changed options replaces the backend, the previous one is kept
+// if the new options are invalid or the replacement fails.
+func (ctx *Context) RegisterBackend(vsID, rsID string, opts *BackendOptions, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, ErrInvalidTTL
+	}
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return false, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	var previous *BackendOptions
+	var expires time.Time
+	if rs, exists := vs.backends[rsID]; exists {
+		if rs.leaseTimer == nil {
+			return false, ErrNotRegistered
+		}
+		if rs.options.CompareStoreOptions(opts) {
+			ctx.cancelBackendRemoval(vs, rs)
+			ctx.leaseBackend(vs, rs, ttl)
+			return false, nil
+		}
+		if err := ctx.validateBackend(vs, rsID, opts); err != nil {
+			return false, err
+		}
+		log.Infof("options of registered backend [%s/%s] have changed", vsID, rsID)
+		previous, expires = rs.options, rs.leaseExpires
+		rs.leaseTimer.Stop()
+		if _, err := ctx.removeBackend(vsID, rsID); err != nil {
+			return false, err
+		}
+	}
+
+	opts.pending = true
+	if err := ctx.createBackend(vsID, rsID, opts); err != nil {
+		if previous != nil {
+			ctx.rollbackRegistration(vs, rsID, previous, expires)
+		}
+		return false, err
+	}
+	ctx.leaseBackend(vs, vs.backends[rsID], ttl)
+	log.Infof("backend [%s/%s] has registered itself for %s", vsID, rsID, ttl)
+	return true, nil
+}
+
+// rollbackRegistration restores the registered backend replaced by a failed
+// renewal until its previous registration expires. Context mutex must be held.
+func (ctx *Context) rollbackRegistration(vs *Service, rsID string, previous *BackendOptions, expires time.Time) {
+	log.Warnf("rolling back registered backend [%s/%s] to previous configuration", vs.vsID, rsID)
+	if err := ctx.createBackend(vs.vsID, rsID, previous); err != nil {
+		log.Errorf("failed to roll back registered backend [%s/%s]: %s", vs.vsID, rsID, err)
+		return
+	}
+	ctx.leaseBackend(vs, vs.backends[rsID], time.Until(expires))
+}
+
+// DeregisterBackend removes a self-registered backend before its registration expires.
+func (ctx *Context) DeregisterBackend(vsID, rsID string) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	rs, exists := vs.backends[rsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	if rs.leaseTimer == nil {
+		return ErrNotRegistered
+	}
+	rs.leaseTimer.Stop()
+	if _, err := ctx.removeBackend(vsID, rsID); err != nil {
+		return err
+	}
+	log.Infof("backend [%s/%s] has deregistered itself", vsID, rsID)
+	return nil
+}
+
+// leaseBackend (re)starts the timer removing the registered backend unless it
+// sends a heartbeat within the ttl. Context mutex must be held.
+func (ctx *Context) leaseBackend(vs *Service, rs *Backend, ttl time.Duration) {
+	if rs.leaseTimer != nil {
+		rs.leaseTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+		if ctx.services[vs.vsID] != vs || vs.backends[rs.rsID] != rs || rs.leaseTimer != timer {
+			return
+		}
+		log.Warnf("registration of backend [%s/%s] has expired without heartbeats", vs.vsID, rs.rsID)
+		if ctx.removalDelay > 0 {
+			ctx.delayBackendRemoval(vs, rs)
+			return
+		}
+		if _, err := ctx.removeBackend(vs.vsID, rs.rsID); err != nil {
+			log.Errorf("error while removing expired backend [%s/%s]: %s", vs.vsID, rs.rsID, err)
+		}
+	})
+	rs.leaseTimer = timer
+	rs.leaseExpires = time.Now().Add(ttl)
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"static": {Host: "127.0.0.3", Port: 8080}},
+	}))
+
+	_, err := c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+	_, err = c.RegisterBackend(vsID, "static", &BackendOptions{Host: "127.0.0.3", Port: 8080}, time.Hour)
+	assert.Equal(t, ErrNotRegistered, err, "backends added by other means aren't taken over")
+	assert.Equal(t, ErrNotRegistered, c.DeregisterBackend(vsID, "static"))
+
+	created, err := c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, created)
+	backend, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.True(t, backend.Pending)
+	require.NotNil(t, backend.LeaseExpires)
+
+	// heartbeats renew the registration
+	created, err = c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, created)
+	renewed, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.Equal(t, backend.Version, renewed.Version)
+
+	// changed options replace the backend
+	created, err = c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8081}, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, created)
+	backend, err = c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(8081), backend.Options.Port)
+
+	// invalid options are rejected before the backend is replaced
+	_, err = c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "::1", Port: 8080}, time.Hour)
+	assert.Equal(t, ErrIncompatibleAFs, err)
+	kept, err := c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.Equal(t, backend.Version, kept.Version)
+
+	// failed replacements restore the previous backend with its lease
+	_, err = c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.3", Port: 8080}, time.Hour)
+	assert.Equal(t, ErrDuplicateBackend, err)
+	kept, err = c.GetBackend(vsID, rsID)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(8081), kept.Options.Port)
+	require.NotNil(t, kept.LeaseExpires)
+	assert.WithinDuration(t, *backend.LeaseExpires, *kept.LeaseExpires, time.Second)
+
+	require.NoError(t, c.DeregisterBackend(vsID, rsID))
+	_, err = c.GetBackend(vsID, rsID)
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// backends missing heartbeats are removed
+	_, err = c.RegisterBackend(vsID, rsID, &BackendOptions{Host: "127.0.0.2", Port: 8080}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := c.GetBackend(vsID, rsID)
+		return errors.Is(err, ErrObjectNotFound)
+	}, time.Second, 10*time.Millisecond)
+	_, err = c.GetBackend(vsID, "static")
+	assert.NoError(t, err)
+}
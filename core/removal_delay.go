@@ -0,0 +1,93 @@
+package core
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// delayBackendRemoval takes the backend gone from the store or missing heartbeats
+// out of traffic and removes it after the removal delay unless it comes back,
+// so short flaps of discovery don't churn IPVS and break persistence. Context
+// mutex must be held.
+func (ctx *Context) delayBackendRemoval(vs *Service, rs *Backend) {
+	if rs.removalTimer != nil {
+		return
+	}
+	ctx.hideBackend(vs, rs)
+	var timer *time.Timer
+	timer = time.AfterFunc(ctx.removalDelay, func() {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+		if ctx.services[vs.vsID] != vs || vs.backends[rs.rsID] != rs || rs.removalTimer != timer {
+			return
+		}
+		log.Infof("removal delay of backend [%s/%s] is over", vs.vsID, rs.rsID)
+		if _, err := ctx.removeBackend(vs.vsID, rs.rsID); err != nil {
+			log.Errorf("error while removing backend [%s/%s]: %s", vs.vsID, rs.rsID, err)
+		}
+	})
+	rs.removalTimer = timer
+	rs.removalAt = time.Now().Add(ctx.removalDelay)
+	ctx.revision++
+	rs.version = ctx.revision
+	ctx.recordEvent(vs.vsID, rs.rsID, EventRemovalDelayed, "will be removed in %s unless it comes back", ctx.removalDelay)
+	log.Infof("backend [%s/%s] is out of traffic and will be removed in %s unless it comes back",
+		vs.vsID, rs.rsID, ctx.removalDelay)
+}
+
+// cancelBackendRemoval brings the backend whose removal is delayed back to
+// traffic. Context mutex must be held.
+func (ctx *Context) cancelBackendRemoval(vs *Service, rs *Backend) {
+	if rs.removalTimer == nil {
+		return
+	}
+	rs.removalTimer.Stop()
+	rs.removalTimer = nil
+	rs.removalAt = time.Time{}
+	if vs.deleteTimer == nil && rs.deleteTimer == nil && !rs.drained && !rs.excluded && !rs.inactive {
+		ctx.unhideBackend(vs, rs)
+	}
+	ctx.revision++
+	rs.version = ctx.revision
+	ctx.recordEvent(vs.vsID, rs.rsID, EventReturned, "came back before its removal")
+	log.Infof("backend [%s/%s] has come back before its removal", vs.vsID, rs.rsID)
+}
+
+// delayedBackend returns the backend whose removal is delayed, nil if there is none.
+// Context mutex must be held.
+func (ctx *Context) delayedBackend(vsID, rsID string) (*Service, *Backend) {
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return nil, nil
+	}
+	if rs, exists := vs.backends[rsID]; exists && rs.removalTimer != nil {
+		return vs, rs
+	}
+	return nil, nil
+}
+
+// applyStoreOperation applies the operation of synchronization. Removals of
+// backends are delayed, and backends coming back before their removal are
+// kept as is. Context mutex must be held.
+func (ctx *Context) applyStoreOperation(op *SyncOperation) error {
+	switch {
+	case op.Action == SyncActionRemove && op.RsID != "" && ctx.removalDelay > 0:
+		vs, exists := ctx.services[op.VsID]
+		if !exists {
+			return objectError(ErrObjectNotFound, "vsID", op.VsID)
+		}
+		rs, exists := vs.backends[op.RsID]
+		if !exists {
+			return objectError(ErrObjectNotFound, "rsID", op.RsID)
+		}
+		ctx.delayBackendRemoval(vs, rs)
+		return nil
+	case op.Action == SyncActionCreate && op.RsID != "":
+		if vs, rs := ctx.delayedBackend(op.VsID, op.RsID); rs != nil {
+			ctx.cancelBackendRemoval(vs, rs)
+			return nil
+		}
+	}
+	return ctx.applySyncOperation(op)
+}
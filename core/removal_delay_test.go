@@ -0,0 +1,61 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemovalDelay(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	c.removalDelay = time.Hour
+
+	config := func(rsIDs ...string) map[string]*ServiceConfig {
+		backends := make(map[string]*BackendOptions)
+		for i, rsID := range rsIDs {
+			backends[rsID] = &BackendOptions{Host: "127.0.1.1", Port: uint16(8080 + i)}
+		}
+		services := map[string]*ServiceConfig{"web": {
+			ServiceOptions:  &ServiceOptions{Host: "localhost", Port: 80},
+			ServiceBackends: backends,
+		}}
+		validateServiceConfigs(services, nil, nil)
+		return services
+	}
+	_, err := c.Synchronize(config("a", "b"))
+	require.NoError(t, err)
+	vs := c.services["web"]
+
+	// the backend gone from the store is out of traffic until the delay is over
+	_, err = c.Synchronize(config("a"))
+	require.NoError(t, err)
+	require.Contains(t, vs.backends, "b")
+	assert.Zero(t, vs.backends["b"].options.weight)
+	backend, err := c.GetBackend("web", "b")
+	require.NoError(t, err)
+	require.NotNil(t, backend.RemovalAt)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *backend.RemovalAt, time.Minute)
+	plan := c.planSync(config("a"))
+	assert.Empty(t, plan.Operations, "delayed removal isn't planned again")
+
+	// the backend coming back keeps its place in IPVS
+	_, err = c.Synchronize(config("a", "b"))
+	require.NoError(t, err)
+	assert.Nil(t, vs.backends["b"].removalTimer)
+	assert.Equal(t, int32(100), vs.backends["b"].options.weight)
+
+	// the backend is removed once the delay is over
+	c.removalDelay = 10 * time.Millisecond
+	_, err = c.Synchronize(config("a"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return !vs.BackendExist("b")
+	}, time.Second, 5*time.Millisecond)
+}
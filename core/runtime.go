@@ -21,17 +21,49 @@
 package core
 
 import (
+	"fmt"
+	"maps"
+	"net"
+	"time"
+
+	"github.com/qk4l/gorb/hooks"
 	"github.com/qk4l/gorb/pulse"
 	log "github.com/sirupsen/logrus"
 )
 
 func (ctx *Context) run() {
 	stash := make(map[pulse.ID]int32)
+	// stashedAt are times backends have been stashed, for reporting only
+	stashedAt := make(map[pulse.ID]time.Time)
 
 	for {
 		select {
-		case u := <-ctx.pulseCh:
-			ctx.processPulseUpdate(stash, u)
+		case <-ctx.pulses.Ready():
+			// while a store sync runs updates are left in the queue, which keeps
+			// only the latest one of every pulse until they're resumed
+			for ctx.pulsesPaused.Load() == 0 {
+				u, queuedAt, ok := ctx.pulses.Pop()
+				if !ok {
+					break
+				}
+				// updates of shared monitors are processed for every subscribed backend
+				targets := ctx.pulseTargets(u)
+				if ctx.pulses.Has(u.Source) {
+					// a newer update has been queued while a sync held the mutex
+					targets = nil
+				}
+				for _, id := range targets {
+					ctx.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: u.Metrics})
+				}
+				ctx.pulses.Processed(queuedAt)
+			}
+			trackStash(stash, stashedAt, time.Now())
+		case vsID := <-ctx.reweightCh:
+			ctx.applyWeights(stash, vsID)
+			trackStash(stash, stashedAt, time.Now())
+		case f := <-ctx.stashCh:
+			trackStash(stash, stashedAt, time.Now())
+			f(stash, stashedAt)
 		case <-ctx.stopCh:
 			log.Debug("notificationLoop has been stopped")
 			return
@@ -39,9 +71,40 @@ func (ctx *Context) run() {
 	}
 }
 
+// pausePulses stops the notification loop from popping pulse updates, so it
+// doesn't wait for the mutex with a stale update while a store sync holds it.
+func (ctx *Context) pausePulses() {
+	ctx.pulsesPaused.Add(1)
+}
+
+// resumePulses replays the latest pulse updates queued while processing was paused.
+func (ctx *Context) resumePulses() {
+	if ctx.pulsesPaused.Add(-1) > 0 || ctx.pulses == nil {
+		return
+	}
+	if pending := ctx.pulses.Stats().Pending; pending > 0 {
+		log.Infof("replaying %d pulse update(s) deferred during store sync", pending)
+	}
+	ctx.pulses.Wake()
+}
+
 func (ctx *Context) processPulseUpdate(stash map[pulse.ID]int32, u pulse.Update) {
 	vsID, rsID := u.Source.VsID, u.Source.RsID
+	held := false
+	defer func() {
+		if !held {
+			ctx.applyWeights(stash, vsID)
+		}
+	}()
+
 	ctx.mutex.Lock()
+	if ctx.pulses != nil && ctx.pulses.Has(u.Source) {
+		// the update has waited for a store sync and a newer one is queued
+		log.Debugf("skipping update of %s superseded during store sync", u.Source)
+		held = true
+		ctx.mutex.Unlock()
+		return
+	}
 	// check exist
 	vs, ok := ctx.services[vsID]
 	if !ok {
@@ -65,30 +128,85 @@ func (ctx *Context) processPulseUpdate(stash map[pulse.ID]int32, u pulse.Update)
 
 	if rs.metrics.Status != u.Metrics.Status {
 		log.Warnf("backend %s status: %s", u.Source, u.Metrics.Status)
+		ctx.recordEvent(vsID, rsID, EventHealthChanged, "status changed from %s to %s",
+			rs.metrics.Status, u.Metrics.Status)
+		ctx.notifyHooks(u)
 	}
+	wentDown := rs.metrics.Status != pulse.StatusDown && u.Metrics.Status == pulse.StatusDown
 	// This is a copy of metrics structure from Pulse.
 	rs.metrics = u.Metrics
+	ctx.evaluateAlerts(vs)
+	ctx.evaluateStatus(vs)
+	if vs.vipDeferred && u.Metrics.Status == pulse.StatusUp && !rs.hidden {
+		ctx.addDeferredVip(vs)
+	}
 
+	if held = vs.weightsHeld; held {
+		// metrics are kept, but weights and stash stay as is until the hold is released
+		ctx.mutex.Unlock()
+		return
+	}
+
+	if rs.hidden {
+		// weight of deleted backend is restored as is if the deletion is undone
+		ctx.mutex.Unlock()
+		return
+	}
+
+	if rs.options.pending && u.Metrics.Status == pulse.StatusUp && u.Metrics.Health > 0 {
+		// weight stashed while pending is zero and must not be restored
+		delete(stash, u.Source)
+		ctx.activatePendingBackend(vs, rs)
+		ctx.mutex.Unlock()
+		return
+	}
+
+	current := rs.options.weight
+	policy, metrics := vs.weightPolicy(), maps.Clone(rs.weightMetrics)
+	minWeight := vs.options.MinWeight
+	vip, vport, protocol := vs.options.host.String(), vs.options.Port, vs.options.protocol
+	flushConntrack := vs.options.FlushConntrack
+	rip, rport := rs.options.host.String(), rs.options.Port
 	ctx.mutex.Unlock()
 
 	switch u.Metrics.Status {
 	case pulse.StatusUp:
 		// Weight is gonna be stashed until the backend is recovered.
-		weight, exists := stash[u.Source]
+		nominal, stashed := stash[u.Source]
 
-		if !exists {
-			return
+		if !stashed {
+			nominal = current
+		}
+
+		weight := policy.Weight(WeightInput{
+			Weight:     nominal,
+			Recovering: stashed,
+			Health:     u.Metrics.Health,
+			Latency:    u.Metrics.Latency,
+			Metrics:    metrics,
+			Connections: func() (uint32, error) {
+				return ctx.backendConns(vip, vport, protocol, rip, rport)
+			},
+		})
+		// integer truncation mustn't take an up backend out of rotation,
+		// but a backend isn't given more than its nominal weight
+		if floor := min(minWeight, nominal); weight < floor {
+			weight = floor
 		}
 
-		// Calculate a relative weight considering backend's health.
-		weight = int32(float64(weight) * u.Metrics.Health)
+		if weight == current && (weight != nominal || !stashed) {
+			return
+		}
 
-		if _, err := ctx.UpdateBackend(vsID, rsID, weight); err != nil {
+		if previous, err := ctx.UpdateBackend(vsID, rsID, weight); err != nil {
 			log.Errorf("error while unstashing a backend: %s", err)
-		} else if weight == stash[u.Source] {
+		} else if weight == nominal {
 			log.Infof("backend %s has completely recovered, so deleting it from stash.", u.Source)
 			// This means that the backend has completely recovered.
 			delete(stash, u.Source)
+		} else if !stashed {
+			// Weight reduced by the policy is stashed the same way.
+			stash[u.Source] = previous
 		}
 
 	case pulse.StatusDown:
@@ -113,10 +231,104 @@ func (ctx *Context) processPulseUpdate(stash map[pulse.ID]int32, u pulse.Update)
 		if weight, err := ctx.UpdateBackend(vsID, rsID, backendWeight); err != nil {
 			log.Errorf("error while stashing a backend: %s", err)
 		} else {
+			if wentDown {
+				// connections are expired once the backend is out of traffic
+				ctx.expireConns(u.Source.String(), ConnDest{
+					VIP: net.ParseIP(vip), Port: vport, Protocol: protocol, RIP: net.ParseIP(rip), RPort: rport}, flushConntrack)
+			}
 			if _, exists := stash[u.Source]; exists {
 				return
 			}
 			stash[u.Source] = weight
 		}
+
+	case pulse.StatusFlapping:
+		// Weight reduced by pulse is held until the flapping penalty is over,
+		// then the backend is recovered from stash as usual.
+		weight, exists := stash[u.Source]
+
+		if !exists {
+			weight = current
+		}
+
+		if previous, err := ctx.UpdateBackend(vsID, rsID, int32(float64(weight)*u.Metrics.Health)); err != nil {
+			log.Errorf("error while holding a flapping backend: %s", err)
+		} else if !exists {
+			stash[u.Source] = previous
+		}
+	}
+}
+
+// backendWeight returns a weight of healthy backend considering its locality, color
+// and failover.
+func (ctx *Context) backendWeight(vs *Service, opts *BackendOptions) int32 {
+	if opts.pending || vs.failoverStandby(opts) {
+		return 0
+	}
+	return int32(float64(ctx.localityWeight(vs, opts)) * vs.colorFactor(opts.Color))
+}
+
+// applyWeights updates weights of backends after service health, active color
+// or active failover backend has been changed. Weights of backends stashed by pulse are updated in stash,
+// so they are restored correctly after recovery.
+func (ctx *Context) applyWeights(stash map[pulse.ID]int32, vsID string) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists || !ctx.localityEnabled(vs) && vs.activeColor == "" && vs.options.Failover == nil {
+		return
+	}
+	ctx.electFailoverBackend(vs)
+	for _, rsID := range sortedKeys(vs.backends) {
+		rs := vs.backends[rsID]
+		if rs.hidden {
+			continue
+		}
+		weight := ctx.backendWeight(vs, rs.options)
+		id := pulse.ID{VsID: vsID, RsID: rsID}
+		if _, stashed := stash[id]; stashed {
+			stash[id] = weight
+			continue
+		}
+		if rs.metrics.Status != pulse.StatusUp || weight == rs.options.weight {
+			continue
+		}
+		log.Infof("reweighting backend [%s/%s]: %d -> %d", vsID, rsID, rs.options.weight, weight)
+		if _, err := ctx.updateBackend(vsID, rsID, weight); err != nil {
+			log.Errorf("error while reweighting a backend: %s", err)
+		}
+	}
+}
+
+// requestReweight asks notification loop to apply weights of the service.
+func (ctx *Context) requestReweight(vsID string) {
+	select {
+	case ctx.reweightCh <- vsID:
+	case <-ctx.stopCh:
+	}
+}
+
+// notifyHooks tells external systems that a backend has been ejected or restored.
+func (ctx *Context) notifyHooks(u pulse.Update) {
+	event := hooks.Event{
+		VsID:   u.Source.VsID,
+		RsID:   u.Source.RsID,
+		Reason: fmt.Sprintf("pulse status %s, health %.2f", u.Metrics.Status, u.Metrics.Health),
+	}
+	switch u.Metrics.Status {
+	case pulse.StatusDown:
+		event.Type = hooks.EventEject
+	case pulse.StatusUp:
+		event.Type = hooks.EventRestore
+	case pulse.StatusFlapping:
+		if u.Metrics.Health > 0 {
+			// backend keeps serving at reduced weight
+			return
+		}
+		event.Type = hooks.EventEject
+	default:
+		return
 	}
+	ctx.hooks.Notify(event)
 }
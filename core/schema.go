@@ -0,0 +1,131 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceConfigVersion is the current layout of service documents.
+const ServiceConfigVersion = "v1"
+
+// unversionedServiceConfig is the layout of documents without api_version,
+// which were written before layouts got versioned.
+const unversionedServiceConfig = "v1"
+
+// ErrUnsupportedAPIVersion is returned for documents of unknown layouts, e.g. written by a newer GORB.
+var ErrUnsupportedAPIVersion = errors.New("unsupported api_version of service document")
+
+// serviceConfigMigration upgrades a service document to the next layout.
+type serviceConfigMigration struct {
+	to      string
+	migrate func(doc *yaml.Node) error
+}
+
+// serviceConfigMigrations are keyed by the layout they upgrade from. When options
+// are renamed, the layout version is bumped and a migration of the previous one is
+// added here, so stored documents keep their meaning.
+var serviceConfigMigrations = map[string]serviceConfigMigration{}
+
+// mappingValue returns the value of the key in the mapping node, nil if there's none.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// migrateServiceConfig upgrades the parsed service document to the current layout
+// in place. Documents which aren't mappings are left for decoding to report.
+func migrateServiceConfig(doc *yaml.Node) error {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	version := unversionedServiceConfig
+	versionNode := mappingValue(node, "api_version")
+	if versionNode != nil {
+		version = versionNode.Value
+	}
+	for version != ServiceConfigVersion {
+		migration, exists := serviceConfigMigrations[version]
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrUnsupportedAPIVersion, version)
+		}
+		if err := migration.migrate(node); err != nil {
+			return fmt.Errorf("error while migrating service document from %s to %s: %w", version, migration.to, err)
+		}
+		version = migration.to
+	}
+
+	if versionNode == nil {
+		// the version goes first, taking over the comment heading the document
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: "api_version"}
+		if len(node.Content) > 0 {
+			key.HeadComment, node.Content[0].HeadComment = node.Content[0].HeadComment, ""
+		}
+		versionNode = &yaml.Node{}
+		node.Content = append([]*yaml.Node{key, versionNode}, node.Content...)
+	}
+	versionNode.Encode(ServiceConfigVersion)
+	return nil
+}
+
+// ParseServiceConfigs parses YAML (or JSON) services keyed by their IDs, documents
+// of older layouts are migrated to the current one.
+func ParseServiceConfigs(data []byte) (map[string]*ServiceConfig, error) {
+	var docs map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+	services := make(map[string]*ServiceConfig, len(docs))
+	for vsID, doc := range docs {
+		if err := migrateServiceConfig(&doc); err != nil {
+			return nil, fmt.Errorf("service %s: %w", vsID, err)
+		}
+		var config ServiceConfig
+		if err := doc.Decode(&config); err != nil {
+			return nil, fmt.Errorf("service %s: %w", vsID, err)
+		}
+		services[vsID] = &config
+	}
+	return services, nil
+}
+
+// MigrateServiceDocument rewrites a single service document, e.g. a file of
+// a file store, in the current layout. Comments are kept.
+func MigrateServiceDocument(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		return data, nil
+	}
+	// changes would break the MAC of SOPS documents
+	if _, metadata := sopsDocument(&doc); metadata != nil || isAgeEncrypted(data) {
+		return nil, ErrEncryptedDocument
+	}
+	if err := migrateServiceConfig(&doc); err != nil {
+		return nil, err
+	}
+	// the document must still be a valid service
+	if err := doc.Decode(&ServiceConfig{}); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// withLegacyLayout registers a migration of a layout keeping options under "options".
+func withLegacyLayout(t *testing.T) {
+	serviceConfigMigrations["v0"] = serviceConfigMigration{to: "v1", migrate: func(doc *yaml.Node) error {
+		for i := 0; i < len(doc.Content); i += 2 {
+			if doc.Content[i].Value == "options" {
+				doc.Content[i].Value = "service_options"
+			}
+		}
+		return nil
+	}}
+	t.Cleanup(func() { delete(serviceConfigMigrations, "v0") })
+}
+
+func TestParseServiceConfigs(t *testing.T) {
+	withLegacyLayout(t)
+
+	services, err := ParseServiceConfigs([]byte("web:\n  service_options: {port: 80}\n" +
+		"legacy:\n  api_version: v0\n  options: {port: 81}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, ServiceConfigVersion, services["web"].APIVersion)
+	assert.Equal(t, uint16(80), services["web"].ServiceOptions.Port)
+	assert.Equal(t, ServiceConfigVersion, services["legacy"].APIVersion)
+	require.NotNil(t, services["legacy"].ServiceOptions)
+	assert.Equal(t, uint16(81), services["legacy"].ServiceOptions.Port)
+
+	_, err = ParseServiceConfigs([]byte("web:\n  api_version: v9\n  service_options: {port: 80}\n"))
+	assert.ErrorIs(t, err, ErrUnsupportedAPIVersion)
+}
+
+func TestMigrateServiceDocument(t *testing.T) {
+	withLegacyLayout(t)
+
+	output, err := MigrateServiceDocument([]byte("# web\napi_version: v0\noptions:\n  port: 80\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "# web\napi_version: v1\nservice_options:\n  port: 80\n", string(output))
+
+	// documents in the current layout are kept as they are
+	again, err := MigrateServiceDocument(output)
+	require.NoError(t, err)
+	assert.Equal(t, string(output), string(again))
+
+	output, err = MigrateServiceDocument([]byte("service_options:\n  port: 80\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "api_version: v1\nservice_options:\n  port: 80\n", string(output))
+}
+
+func TestStoreServicesAreMigrated(t *testing.T) {
+	withLegacyLayout(t)
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	m.On("List", "/services").Return([]*store.KVPair{
+		{Key: "/services/legacy", Value: []byte("api_version: v0\noptions:\n  host: 127.0.0.1\n  port: 80\n")},
+		{Key: "/services/newer", Value: []byte("api_version: v2\nservice_options:\n  host: 127.0.0.1\n  port: 81\n")},
+	}, nil)
+
+	layer, err := newStoreLayer([]string{"mock://127.0.0.1:2000/"}, "services", "backends", false)
+	require.NoError(t, err)
+	services, err := layer.getServices()
+	require.NoError(t, err)
+	require.NotNil(t, services["legacy"].ServiceOptions)
+	assert.Equal(t, uint16(80), services["legacy"].ServiceOptions.Port)
+	// documents of unknown layouts are invalid instead of being misread
+	assert.ErrorIs(t, services["newer"].err, ErrUnsupportedAPIVersion)
+}
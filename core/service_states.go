@@ -0,0 +1,71 @@
+package core
+
+import (
+	"time"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+)
+
+// ServiceState is a snapshot of a virtual service polled by monitoring systems.
+type ServiceState struct {
+	VsID     string
+	Host     string
+	Port     uint16
+	Protocol string
+	Health   float64
+	Status   ServiceStatus
+	// HealthyBackends is a number of backends up and receiving traffic
+	HealthyBackends int
+	Backends        []BackendState
+	// Traffic is nil if IPVS is unable to report traffic counters
+	Traffic *IpvsStats
+}
+
+// BackendState is a snapshot of a backend of a virtual service.
+type BackendState struct {
+	RsID    string
+	Host    string
+	Port    uint16
+	Health  float64
+	Status  pulse.StatusType
+	Weight  int32
+	Uptime  time.Duration
+	Latency time.Duration
+}
+
+// ServiceStates returns snapshots of all virtual services and their backends
+// ordered by their IDs.
+func (ctx *Context) ServiceStates() []ServiceState {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	var traffic map[string]IpvsStats
+	if reader, ok := ctx.ipvs.(IpvsStatsReader); ok {
+		var err error
+		if traffic, err = reader.GetServiceStats(); err != nil {
+			log.Warnf("unable to get traffic counters of services: %s", err)
+		}
+	}
+
+	states := make([]ServiceState, 0, len(ctx.services))
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		state := ServiceState{VsID: vsID, Host: vs.options.host.String(), Port: vs.options.Port,
+			Protocol: vs.options.Protocol, Health: vs.health(), Status: vs.status(),
+			HealthyBackends: vs.healthyBackends()}
+		svc := gnl2go.Service{VIP: vs.options.host.String(), Port: vs.options.Port, Proto: vs.options.protocol}
+		if stats, ok := traffic[svc.ToString()]; ok {
+			state.Traffic = &stats
+		}
+		for _, rsID := range sortedKeys(vs.backends) {
+			rs := vs.backends[rsID]
+			state.Backends = append(state.Backends, BackendState{RsID: rsID, Host: rs.options.host.String(),
+				Port: rs.options.Port, Health: rs.metrics.Health, Status: rs.metrics.Status,
+				Weight: rs.options.weight, Uptime: rs.metrics.Uptime, Latency: rs.metrics.Latency})
+		}
+		states = append(states, state)
+	}
+	return states
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/qk4l/gorb/hooks"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServiceStatus is an overall status of a service derived from its backends.
+type ServiceStatus string
+
+// Possible service statuses.
+const (
+	ServiceHealthy  ServiceStatus = "healthy"
+	ServiceDegraded ServiceStatus = "degraded"
+	ServiceDown     ServiceStatus = "down"
+)
+
+// Possible service status errors.
+var (
+	ErrInvalidStatusThresholds = errors.New("status thresholds must be within [0, 1] and down must not exceed degraded")
+	ErrUnknownDiscoStatus      = errors.New("disco status must be healthy or degraded")
+)
+
+// value of the status exported as a metric.
+func (s ServiceStatus) value() float64 {
+	switch s {
+	case ServiceDegraded:
+		return 1
+	case ServiceDown:
+		return 2
+	}
+	return 0
+}
+
+// validateDiscoStatus checks the minimal status a service is exposed to discovery at.
+func validateDiscoStatus(status ServiceStatus) error {
+	switch status {
+	case "", ServiceHealthy, ServiceDegraded:
+		return nil
+	}
+	return ErrUnknownDiscoStatus
+}
+
+// StatusThresholds are fractions of healthy backends the service status is derived from.
+type StatusThresholds struct {
+	// Degraded is a fraction of healthy backends below which the service is degraded. Default is 1.
+	Degraded float64 `json:"degraded" yaml:"degraded"`
+	// Down is a fraction of healthy backends at or below which the service is down. Default is 0.
+	Down float64 `json:"down" yaml:"down"`
+}
+
+var defaultStatusThresholds = StatusThresholds{Degraded: 1}
+
+// Validate fills missing fields and validates status thresholds.
+func (t *StatusThresholds) Validate() error {
+	if t.Degraded == 0 {
+		t.Degraded = 1
+	}
+	if t.Down < 0 || t.Degraded > 1 || t.Down > t.Degraded {
+		return ErrInvalidStatusThresholds
+	}
+	return nil
+}
+
+// status derives the service status from the fraction of healthy backends.
+func (vs *Service) status() ServiceStatus {
+	thresholds := &defaultStatusThresholds
+	if vs.options.StatusThresholds != nil {
+		thresholds = vs.options.StatusThresholds
+	}
+	backends := vs.statusBackends()
+	if backends == 0 {
+		return ServiceDown
+	}
+	healthy := float64(vs.healthyBackends()) / float64(backends)
+	switch {
+	case healthy <= thresholds.Down:
+		return ServiceDown
+	case healthy < thresholds.Degraded:
+		return ServiceDegraded
+	}
+	return ServiceHealthy
+}
+
+// evaluateStatus tracks status changes of the service and notifies hooks about
+// them. Context mutex must be held.
+func (ctx *Context) evaluateStatus(vs *Service) {
+	ctx.updateSorryServer(vs)
+
+	status := vs.status()
+	previous := vs.lastStatus
+	if status == previous {
+		return
+	}
+	vs.lastStatus = status
+	ctx.updateDiscovery(vs)
+
+	// services start without status, so there is no change to report
+	if previous == "" {
+		return
+	}
+
+	reason := fmt.Sprintf("%d of %d backends healthy", vs.healthyBackends(), vs.statusBackends())
+	if status == ServiceHealthy {
+		log.Infof("service [%s] is %s: %s", vs.vsID, status, reason)
+	} else {
+		log.Warnf("service [%s] is %s: %s", vs.vsID, status, reason)
+	}
+	ctx.recordEvent(vs.vsID, "", EventStatusChanged, "status changed from %s to %s: %s", previous, status, reason)
+	ctx.hooks.Notify(hooks.Event{
+		Type:   hooks.EventServiceStatus,
+		VsID:   vs.vsID,
+		Reason: reason,
+		Status: string(status),
+	})
+}
+
+// updateDiscovery exposes the service to discovery while its status is at least
+// DiscoStatus and removes it otherwise. Context mutex must be held.
+func (ctx *Context) updateDiscovery(vs *Service) {
+	if vs.options.DiscoStatus == "" {
+		return
+	}
+	expose := vs.lastStatus.value() <= vs.options.DiscoStatus.value()
+	if expose == vs.exposed {
+		return
+	}
+	vs.exposed = expose
+	if expose {
+		log.Infof("exposing %s service [%s] to Disco", vs.lastStatus, vs.vsID)
+		if err := ctx.disco.Expose(vs.vsID, vs.options.host.String(), vs.options.Port); err != nil {
+			log.Errorf("error while exposing service to Disco: %s", err)
+		}
+		return
+	}
+	log.Warnf("removing %s service [%s] from Disco", vs.lastStatus, vs.vsID)
+	if err := ctx.disco.Remove(vs.vsID); err != nil {
+		log.Errorf("error while removing service from Disco: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+)
+
+// Possible service update errors.
+var (
+	ErrOptionNotUpdatable       = errors.New("only lb_method, sh_flags, persistent, netmask, pulse, max_weight, min_weight, fallback, labels, alerts and status_thresholds could be changed in place, the service must be re-created to change other options")
+	ErrServiceUpdateUnsupported = errors.New("IPVS implementation doesn't support updating services")
+)
+
+// IpvsServiceUpdater is implemented by IPVS clients able to change the scheduler,
+// flags and netmask of an existing service, keeping its destinations and connections.
+type IpvsServiceUpdater interface {
+	UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte, netmask uint32) error
+}
+
+// fullNetmask returns the kernel form of the netmask of service options,
+// the full address netmask if the options have none.
+func fullNetmask(o *ServiceOptions) uint32 {
+	switch {
+	case o.netmask != 0:
+		return o.netmask
+	case util.AddrFamily(o.host) == util.IPv4:
+		return 1<<32 - 1
+	default:
+		return 128
+	}
+}
+
+// updatableOptions copies options which could be changed in place from src to dst.
+func updatableOptions(dst, src *ServiceOptions) {
+	dst.LbMethod, dst.ShFlags, dst.Persistent = src.LbMethod, src.ShFlags, src.Persistent
+	dst.Netmask, dst.netmask = src.Netmask, src.netmask
+	dst.Pulse, dst.MaxWeight, dst.MinWeight, dst.Fallback = src.Pulse, src.MaxWeight, src.MinWeight, src.Fallback
+	dst.Labels, dst.Alerts, dst.StatusThresholds = src.Labels, src.Alerts, src.StatusThresholds
+}
+
+// UpdateService applies the JSON merge patch of service options to the service
+// in place. Unlike PutService, the IPVS service is changed instead of being
+// re-created, so backends and established connections are kept. Options
+// without an in-place update are rejected with ErrOptionNotUpdatable.
+func (ctx *Context) UpdateService(vsID string, patch []byte, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if vs.options.group != "" {
+		return ErrGroupMember
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+
+	// defaults of pulse options are filled, so they aren't taken for a change,
+	// monitors fill them the same way once backends are subscribed
+	vs.options.Pulse.Validate()
+	// the patch is applied to a copy, so the service is intact if it's invalid
+	current, err := json.Marshal(vs.options)
+	if err != nil {
+		return err
+	}
+	options := &ServiceOptions{}
+	if err := json.Unmarshal(current, options); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(options); err != nil {
+		return err
+	}
+	if err := options.Validate(ctx.endpoint); err != nil {
+		return err
+	}
+	// pulse options are validated by monitors, but backends must not be left without one
+	if err := options.Pulse.Validate(); err != nil {
+		return fieldError("pulse", err)
+	}
+	// options without an in-place update must stay as they are
+	fixed := *options
+	updatableOptions(&fixed, vs.options)
+	if encoded, err := json.Marshal(&fixed); err != nil {
+		return err
+	} else if !bytes.Equal(encoded, current) {
+		return ErrOptionNotUpdatable
+	}
+	if encoded, err := json.Marshal(options); err != nil {
+		return err
+	} else if bytes.Equal(encoded, current) {
+		log.Debugf("service [%s] is up to date", vsID)
+		return nil
+	}
+
+	svc := vs.svc
+	svc.Sched, svc.Flags = options.LbMethod, serviceFlags(options.ShFlags)
+	if svc.Sched != vs.svc.Sched || !bytes.Equal(svc.Flags, vs.svc.Flags) || options.netmask != vs.options.netmask {
+		if err := ctx.updateIpvsService(svc, fullNetmask(options)); err != nil {
+			return err
+		}
+		vs.svc = svc
+	}
+
+	// unexported state of the service options, like the adopted VIP, is kept
+	updated := *vs.options
+	updatableOptions(&updated, options)
+	pulseChanged := !reflect.DeepEqual(vs.options.Pulse, updated.Pulse)
+	vs.options = &updated
+	if pulseChanged {
+		ctx.resubscribeBackends(vs)
+	}
+	ctx.revision++
+	vs.version = ctx.revision
+	ctx.recordEvent(vsID, "", EventUpdated, "options updated in place")
+	log.Infof("service [%s] has been updated in place", vsID)
+	ctx.evaluateAlerts(vs)
+	ctx.evaluateStatus(vs)
+	return nil
+}
+
+// updateIpvsService changes the scheduler, flags and netmask of the IPVS service.
+// Context mutex must be held.
+func (ctx *Context) updateIpvsService(svc gnl2go.Service, netmask uint32) error {
+	updater, ok := ctx.ipvs.(IpvsServiceUpdater)
+	if !ok {
+		return ErrServiceUpdateUnsupported
+	}
+	// flags are sent with their mask even if there are none, so the previous ones are cleared
+	flags := svc.Flags
+	if flags == nil {
+		flags = gnl2go.U32ToBinFlags(0)
+	}
+	if err := updater.UpdateService(svc.VIP, svc.Port, svc.Proto, svc.Sched, flags, netmask); err != nil {
+		log.Errorf("error while updating virtual service: %s", err)
+		if err := schedulerModuleError(svc.Sched); err != nil {
+			log.Error(err)
+		}
+		return ErrIpvsSyscallFailed
+	}
+	return nil
+}
+
+// resubscribeBackends moves monitored backends of the service to monitors of its
+// pulse options. Context mutex must be held.
+func (ctx *Context) resubscribeBackends(vs *Service) {
+	for _, rsID := range sortedKeys(vs.backends) {
+		rs := vs.backends[rsID]
+		if rs.inactive || rs.unsubscribe == nil || rs.options.pool != "" {
+			// pool backends are checked with pulse options of the pool
+			continue
+		}
+		monitor, err := ctx.backendMonitor(rs.options.host.String(), rs.options.Port, ctx.backendPulse(vs, rs.options))
+		if err != nil {
+			log.Errorf("error while changing pulse of backend [%s/%s]: %s", vs.vsID, rsID, err)
+			continue
+		}
+		if monitor.subscribers[pulse.ID{VsID: vs.vsID, RsID: rsID}] {
+			// options of the monitor are the same
+			continue
+		}
+		rs.unsubscribe()
+		ctx.subscribeBackend(vs, rs, monitor)
+	}
+}
+
+// UpdateService mirrors AddServiceWithNetmask with the command changing an existing service.
+func (ipvs *ipvsClient) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	af, addr, err := ipvsAddr(vip)
+	if err != nil {
+		return err
+	}
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return err
+	}
+	msg, err := mt.InitGNLMessageStr("SET_SERVICE", gnl2go.ACK_REQUEST)
+	if err != nil {
+		return err
+	}
+
+	vAF, vAddr, vPort, proto := gnl2go.U16Type(af), gnl2go.BinaryType(addr), gnl2go.Net16Type(port), gnl2go.U16Type(protocol)
+	schedName, svcFlags := gnl2go.NulStringType(sched), gnl2go.BinaryType(flags)
+	timeout, mask := gnl2go.U32Type(0), gnl2go.U32Type(netmask)
+	svcAttrList := gnl2go.CreateAttrListType(gnl2go.ATLName2ATL["IpvsServiceAttrList"])
+	svcAttrList.Set(map[string]gnl2go.SerDes{"AF": &vAF, "ADDR": &vAddr, "PORT": &vPort, "PROTOCOL": &proto,
+		"SCHED_NAME": &schedName, "FLAGS": &svcFlags, "TIMEOUT": &timeout, "NETMASK": &mask})
+
+	msg.AttrMap["SERVICE"] = &svcAttrList
+	return ipvs.Sock.Execute(msg)
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateService(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	require.NoError(t, c.CreateService("web", &ServiceConfig{
+		ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 80, LbMethod: "sh", ShFlags: "sh-port"},
+		ServiceBackends: map[string]*BackendOptions{
+			"a": {Host: "127.0.1.1", Port: 8080},
+			"b": {Host: "127.0.1.2", Port: 8080},
+		},
+	}))
+	vs := c.services["web"]
+	backend := vs.backends["a"]
+	version := vs.version
+	monitors := sortedKeys(c.monitors)
+
+	require.NoError(t, c.UpdateService("web", []byte(`{"lb_method": "mh", "sh_flags": "mh-port", "persistent": true}`),
+		Precondition{Version: version}))
+	pool := findPool(t, c.ipvs, "127.0.0.1", 80, syscall.IPPROTO_TCP)
+	require.NotNil(t, pool)
+	assert.Equal(t, "mh", pool.Service.Sched)
+	assert.Len(t, pool.Dests, 2)
+	assert.Same(t, backend, vs.backends["a"], "backends are kept")
+	assert.Equal(t, monitors, sortedKeys(c.monitors), "monitors are kept")
+	assert.True(t, vs.options.Persistent)
+	assert.Equal(t, "127.0.0.1", vs.options.Host, "options not in the patch are kept")
+	assert.Greater(t, vs.version, version)
+
+	// backends are moved to monitors of the new pulse options
+	require.NoError(t, c.UpdateService("web", []byte(`{"pulse": {"interval": "5s"}}`), Precondition{}))
+	assert.Len(t, c.monitors, 2)
+	assert.NotEqual(t, monitors, sortedKeys(c.monitors))
+	version = vs.version
+	require.NoError(t, c.UpdateService("web", []byte(`{"pulse": {"interval": "5s"}}`), Precondition{}))
+	assert.Equal(t, version, vs.version, "unchanged options aren't updated")
+
+	assert.ErrorIs(t, c.UpdateService("web", []byte(`{"port": 81}`), Precondition{}), ErrOptionNotUpdatable)
+	assert.ErrorIs(t, c.UpdateService("web", []byte(`{"sh_flags": "sh-port"}`), Precondition{}), ErrIncompatibleFlag)
+	assert.ErrorIs(t, c.UpdateService("web", []byte(`{"lb_method": "rr"}`), Precondition{Version: version + 1}),
+		ErrPreconditionFailed)
+	assert.ErrorIs(t, c.UpdateService("api", []byte(`{}`), Precondition{}), ErrObjectNotFound)
+	assert.Equal(t, "mh", vs.options.LbMethod, "rejected patches change nothing")
+}
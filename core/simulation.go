@@ -0,0 +1,382 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"strings"
+)
+
+const (
+	defaultSimulatedClients = 10000
+	maxSimulatedClients     = 1000000
+	// shTableBits are bits of sh and dh scheduler tables of the kernel.
+	shTableBits = 8
+	// mhTableSize is a size of mh scheduler table of the kernel built with default options.
+	mhTableSize = 4093
+)
+
+// Possible simulation errors.
+var (
+	ErrInvalidClients = fmt.Errorf("number of simulated clients must be within [1, %d]", maxSimulatedClients)
+	ErrNotSimulated   = errors.New("scheduler of the service can't be simulated")
+)
+
+// SimulationQuery configures a simulation of the service scheduler.
+type SimulationQuery struct {
+	// Clients is a number of synthetic clients, 10000 by default.
+	Clients int
+	// Healthy simulates weights backends would have if they all were healthy
+	// instead of their current weights.
+	Healthy bool
+}
+
+// SimulatedBackend is a share of clients the scheduler sent to the backend.
+type SimulatedBackend struct {
+	Weight  int32   `json:"weight"`
+	Clients int     `json:"clients"`
+	Share   float64 `json:"share"`
+}
+
+// Simulation is a distribution of synthetic clients across backends of the service.
+type Simulation struct {
+	Scheduler string `json:"scheduler"`
+	Flags     string `json:"flags,omitempty"`
+	Clients   int    `json:"clients"`
+	// Unassigned clients got no backend, e.g. sh hashed them to a backend
+	// without weight and sh-fallback isn't set.
+	Unassigned int                         `json:"unassigned"`
+	Backends   map[string]SimulatedBackend `json:"backends"`
+}
+
+// simulatedDest is a destination of the simulated service.
+type simulatedDest struct {
+	rsID   string
+	host   net.IP
+	port   uint16
+	weight int32
+}
+
+// simulatedClient is a synthetic client, addresses of IPv6 clients are folded
+// to 32 bits the way the kernel hashes them.
+type simulatedClient struct {
+	addr uint32
+	port uint16
+}
+
+// Simulate distributes synthetic clients across backends the way the service
+// scheduler would, so weights and scheduler flags could be checked before the
+// service goes live. Clients come from random addresses and ports and stay
+// connected. Hashing schedulers follow the kernel, except for mh, whose hash
+// keys are random, so its distribution is only similar to the one of the kernel.
+func (ctx *Context) Simulate(vsID string, query SimulationQuery) (*Simulation, error) {
+	if query.Clients == 0 {
+		query.Clients = defaultSimulatedClients
+	}
+	if query.Clients < 0 || query.Clients > maxSimulatedClients {
+		return nil, ErrInvalidClients
+	}
+
+	ctx.mutex.RLock()
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		ctx.mutex.RUnlock()
+		return nil, objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	// destinations are ordered by backend IDs, the kernel orders them by their creation
+	rsIDs := sortedKeys(vs.backends)
+	dests := make([]simulatedDest, 0, len(rsIDs))
+	for _, rsID := range rsIDs {
+		rs := vs.backends[rsID]
+		dest := simulatedDest{rsID: rsID, host: rs.options.host, port: rs.options.Port, weight: rs.options.weight}
+		if query.Healthy {
+			dest.weight = 0
+			if !rs.disabled() {
+				dest.weight = ctx.backendWeight(vs, rs.options)
+			}
+		} else if rs.dropped {
+			// dropped backends have no destination
+			continue
+		}
+		dests = append(dests, dest)
+	}
+	sched, flags, vip := vs.options.LbMethod, vs.options.ShFlags, vs.options.host
+	ctx.mutex.RUnlock()
+
+	schedule, err := newSimulatedScheduler(sched, flags, vip, dests)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same clients are simulated every time, so results of different settings are comparable
+	random := rand.New(rand.NewPCG(1, 2))
+	counts := make([]int, len(dests))
+	result := &Simulation{Scheduler: sched, Flags: flags, Clients: query.Clients,
+		Backends: make(map[string]SimulatedBackend, len(dests))}
+	for i := 0; i < query.Clients; i++ {
+		client := simulatedClient{addr: random.Uint32(), port: uint16(1024 + random.IntN(64512))}
+		if dest := schedule(client, counts); dest < 0 {
+			result.Unassigned++
+		} else {
+			counts[dest]++
+		}
+	}
+
+	for i, dest := range dests {
+		result.Backends[dest.rsID] = SimulatedBackend{Weight: dest.weight, Clients: counts[i],
+			Share: float64(counts[i]) / float64(query.Clients)}
+	}
+	return result, nil
+}
+
+// simulatedScheduler returns an index of the destination the client is sent to,
+// or -1 if there is none. Counts are clients sent to destinations so far.
+type simulatedScheduler func(client simulatedClient, counts []int) int
+
+func newSimulatedScheduler(sched, flags string, vip net.IP, dests []simulatedDest) (simulatedScheduler, error) {
+	flagSet := make(map[string]bool)
+	for _, flag := range strings.Split(flags, "|") {
+		flagSet[flag] = true
+	}
+
+	switch sched {
+	case "rr":
+		next := 0
+		return func(_ simulatedClient, _ []int) int {
+			for range dests {
+				i := next
+				next = (next + 1) % len(dests)
+				if dests[i].weight > 0 {
+					return i
+				}
+			}
+			return -1
+		}, nil
+	case "wrr":
+		return wrrScheduler(dests), nil
+	case "lc":
+		return leastScheduler(dests, func(count int, _ int32) float64 { return float64(count) }), nil
+	case "wlc":
+		return leastScheduler(dests, func(count int, weight int32) float64 { return float64(count) / float64(weight) }), nil
+	case "sed":
+		return leastScheduler(dests, func(count int, weight int32) float64 { return float64(count+1) / float64(weight) }), nil
+	case "nq":
+		sed := leastScheduler(dests, func(count int, weight int32) float64 { return float64(count+1) / float64(weight) })
+		return func(client simulatedClient, counts []int) int {
+			// idle servers are picked first
+			for i, dest := range dests {
+				if dest.weight > 0 && counts[i] == 0 {
+					return i
+				}
+			}
+			return sed(client, counts)
+		}, nil
+	case "fo":
+		return func(_ simulatedClient, _ []int) int { return heaviest(dests, func(int) bool { return true }) }, nil
+	case "ovf":
+		return func(_ simulatedClient, counts []int) int {
+			return heaviest(dests, func(i int) bool { return int32(counts[i]) < dests[i].weight })
+		}, nil
+	case "sh":
+		return shScheduler(dests, flagSet["sh-port"], flagSet["sh-fallback"]), nil
+	case "dh":
+		return dhScheduler(dests, vip), nil
+	case "mh":
+		// zero weight destinations take no entries of mh table, so mh-fallback changes nothing
+		return mhScheduler(dests, flagSet["mh-port"]), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotSimulated, sched)
+}
+
+// wrrScheduler interleaves destinations the way the kernel does, stepping the
+// current weight down by the greatest common divisor of weights.
+func wrrScheduler(dests []simulatedDest) simulatedScheduler {
+	var maxWeight, divisor int32
+	for _, dest := range dests {
+		if dest.weight > 0 {
+			maxWeight, divisor = max(maxWeight, dest.weight), gcd(divisor, dest.weight)
+		}
+	}
+	current, weight := -1, int32(0)
+	return func(_ simulatedClient, _ []int) int {
+		if maxWeight == 0 {
+			return -1
+		}
+		for {
+			current = (current + 1) % len(dests)
+			if current == 0 {
+				if weight -= divisor; weight <= 0 {
+					weight = maxWeight
+				}
+			}
+			if dests[current].weight >= weight {
+				return current
+			}
+		}
+	}
+}
+
+func gcd(a, b int32) int32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// leastScheduler picks the destination with the least overhead, the first one on ties.
+func leastScheduler(dests []simulatedDest, overhead func(count int, weight int32) float64) simulatedScheduler {
+	return func(_ simulatedClient, counts []int) int {
+		least := -1
+		for i, dest := range dests {
+			if dest.weight > 0 && (least < 0 || overhead(counts[i], dest.weight) < overhead(counts[least], dests[least].weight)) {
+				least = i
+			}
+		}
+		return least
+	}
+}
+
+// heaviest returns the first destination of the highest weight out of available ones.
+func heaviest(dests []simulatedDest, available func(int) bool) int {
+	found := -1
+	for i, dest := range dests {
+		if dest.weight > 0 && available(i) && (found < 0 || dest.weight > dests[found].weight) {
+			found = i
+		}
+	}
+	return found
+}
+
+// hash32 is hash_32 of the kernel.
+func hash32(value uint32, bits uint) uint32 {
+	return (value * 0x61C88647) >> (32 - bits)
+}
+
+// foldAddr folds the address to 32 bits the way sh and dh schedulers do.
+func foldAddr(ip net.IP) uint32 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return binary.BigEndian.Uint32(ip4)
+	}
+	var fold uint32
+	for i := 0; i < net.IPv6len; i += 4 {
+		fold ^= binary.BigEndian.Uint32(ip.To16()[i:])
+	}
+	return fold
+}
+
+// shScheduler hashes clients to buckets of a table where every destination
+// takes as many consecutive buckets as its weight.
+func shScheduler(dests []simulatedDest, withPort, fallback bool) simulatedScheduler {
+	const size = 1 << shTableBits
+	var table [size]int
+	if len(dests) > 0 {
+		dest, count := 0, int32(0)
+		for i := range table {
+			table[i] = dest
+			if count++; count >= dests[dest].weight {
+				dest, count = (dest+1)%len(dests), 0
+			}
+		}
+	}
+
+	return func(client simulatedClient, _ []int) int {
+		if len(dests) == 0 {
+			return -1
+		}
+		var port uint32
+		if withPort {
+			port = uint32(client.port)
+		}
+		hash := hash32(port+client.addr, shTableBits)
+		if dest := table[hash]; dests[dest].weight > 0 {
+			return dest
+		} else if !fallback {
+			return -1
+		}
+		for offset := uint32(0); offset < size; offset++ {
+			roffset := (offset + hash) % size
+			if dest := table[(roffset+hash)%size]; dests[dest].weight > 0 {
+				return dest
+			}
+		}
+		return -1
+	}
+}
+
+// dhScheduler hashes destination addresses of packets, so all clients of the
+// service go to the same backend.
+func dhScheduler(dests []simulatedDest, vip net.IP) simulatedScheduler {
+	return func(_ simulatedClient, _ []int) int {
+		if len(dests) == 0 {
+			return -1
+		}
+		// every destination takes a single bucket regardless of its weight
+		dest := int(hash32(foldAddr(vip), shTableBits)) % len(dests)
+		if dests[dest].weight <= 0 {
+			return -1
+		}
+		return dest
+	}
+}
+
+// mhScheduler builds a Maglev lookup table where destinations take entries
+// in proportion to their weights.
+func mhScheduler(dests []simulatedDest, withPort bool) simulatedScheduler {
+	type permutation struct{ offset, skip, next, turns uint32 }
+	var divisor int32
+	for _, dest := range dests {
+		if dest.weight > 0 {
+			divisor = gcd(divisor, dest.weight)
+		}
+	}
+	permutations := make([]permutation, len(dests))
+	for i, dest := range dests {
+		key := net.JoinHostPort(dest.host.String(), fmt.Sprint(dest.port))
+		permutations[i].offset = fnvHash(key, 0) % mhTableSize
+		permutations[i].skip = fnvHash(key, 1)%(mhTableSize-1) + 1
+		if dest.weight > 0 {
+			permutations[i].turns = uint32(dest.weight / divisor)
+		}
+	}
+
+	table := make([]int, mhTableSize)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := 0; filled < mhTableSize && divisor > 0; {
+		for i := range permutations {
+			p := &permutations[i]
+			for turn := uint32(0); turn < p.turns && filled < mhTableSize; turn++ {
+				entry := (p.offset + p.next*p.skip) % mhTableSize
+				for table[entry] >= 0 {
+					p.next++
+					entry = (p.offset + p.next*p.skip) % mhTableSize
+				}
+				table[entry] = i
+				p.next++
+				filled++
+			}
+		}
+	}
+
+	return func(client simulatedClient, _ []int) int {
+		var port uint16
+		if withPort {
+			port = client.port
+		}
+		var key [6]byte
+		binary.BigEndian.PutUint32(key[:], client.addr)
+		binary.BigEndian.PutUint16(key[4:], port)
+		return table[fnvHash(string(key[:]), 2)%mhTableSize]
+	}
+}
+
+func fnvHash(key string, seed byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte{seed})
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulate(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+
+	backends := func() map[string]*BackendOptions {
+		return map[string]*BackendOptions{
+			"a": {Host: "127.0.0.2", Port: 80},
+			"b": {Host: "127.0.0.3", Port: 80},
+			"c": {Host: "127.0.0.4", Port: 80},
+		}
+	}
+	for vsID, options := range map[string]*ServiceOptions{
+		"wrr": {Host: "127.0.0.1", Port: 80, LbMethod: "wrr"},
+		"sh":  {Host: "127.0.0.1", Port: 81, LbMethod: "sh", ShFlags: "sh-port"},
+		"shf": {Host: "127.0.0.1", Port: 82, LbMethod: "sh", ShFlags: "sh-port|sh-fallback"},
+		"dh":  {Host: "127.0.0.1", Port: 83, LbMethod: "dh"},
+		"mh":  {Host: "127.0.0.1", Port: 84, LbMethod: "mh"},
+		"lbl": {Host: "127.0.0.1", Port: 85, LbMethod: "lblc"},
+	} {
+		require.NoError(t, c.CreateService(vsID, &ServiceConfig{ServiceOptions: options, ServiceBackends: backends()}))
+		_, err := c.UpdateBackend(vsID, "b", 50)
+		require.NoError(t, err)
+		_, err = c.UpdateBackend(vsID, "c", 0)
+		require.NoError(t, err)
+	}
+
+	simulation, err := c.Simulate("wrr", SimulationQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 10000, simulation.Clients)
+	assert.Equal(t, 0, simulation.Unassigned)
+	assert.Equal(t, map[string]SimulatedBackend{
+		"a": {Weight: 100, Clients: 6667, Share: 0.6667},
+		"b": {Weight: 50, Clients: 3333, Share: 0.3333},
+		"c": {Weight: 0, Clients: 0, Share: 0},
+	}, simulation.Backends)
+
+	// all backends get full weight if they are healthy
+	simulation, err = c.Simulate("wrr", SimulationQuery{Clients: 300, Healthy: true})
+	require.NoError(t, err)
+	for _, backend := range simulation.Backends {
+		assert.Equal(t, SimulatedBackend{Weight: 100, Clients: 100, Share: 1.0 / 3}, backend)
+	}
+
+	// clients hashed to the backend without weight get nothing unless sh-fallback is set
+	simulation, err = c.Simulate("sh", SimulationQuery{})
+	require.NoError(t, err)
+	assert.NotZero(t, simulation.Unassigned)
+	assert.Equal(t, 10000, simulation.Unassigned+simulation.Backends["a"].Clients+simulation.Backends["b"].Clients)
+	assert.Greater(t, simulation.Backends["a"].Clients, simulation.Backends["b"].Clients)
+
+	simulation, err = c.Simulate("shf", SimulationQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, simulation.Unassigned)
+	assert.Equal(t, 0, simulation.Backends["c"].Clients)
+
+	// all clients of the service have the same destination address
+	simulation, err = c.Simulate("dh", SimulationQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 10000, simulation.Unassigned+max(simulation.Backends["a"].Clients, simulation.Backends["b"].Clients))
+
+	simulation, err = c.Simulate("mh", SimulationQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, simulation.Unassigned)
+	assert.InDelta(t, 2.0/3, simulation.Backends["a"].Share, 0.05)
+	assert.InDelta(t, 1.0/3, simulation.Backends["b"].Share, 0.05)
+
+	_, err = c.Simulate("lbl", SimulationQuery{})
+	assert.ErrorIs(t, err, ErrNotSimulated)
+	_, err = c.Simulate("wrr", SimulationQuery{Clients: maxSimulatedClients + 1})
+	assert.Equal(t, ErrInvalidClients, err)
+	_, err = c.Simulate("missing", SimulationQuery{})
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotDeleted is returned when restoring an object which isn't deleted.
+var ErrNotDeleted = errors.New("object isn't deleted")
+
+// hideBackend takes the backend out of traffic keeping its weight for restoring.
+// Context mutex must be held.
+func (ctx *Context) hideBackend(vs *Service, rs *Backend) {
+	if rs.hidden {
+		return
+	}
+	rs.hidden = true
+	rs.restoreWeight = rs.options.weight
+	if _, err := ctx.updateBackend(vs.vsID, rs.rsID, 0); err != nil {
+		log.Errorf("error while hiding backend [%s/%s]: %s", vs.vsID, rs.rsID, err)
+	}
+}
+
+// unhideBackend brings the backend back to traffic. Context mutex must be held.
+func (ctx *Context) unhideBackend(vs *Service, rs *Backend) {
+	if !rs.hidden {
+		return
+	}
+	rs.hidden = false
+	if _, err := ctx.updateBackend(vs.vsID, rs.rsID, rs.restoreWeight); err != nil {
+		log.Errorf("error while restoring backend [%s/%s]: %s", vs.vsID, rs.rsID, err)
+	}
+}
+
+// softDeleteService hides all backends of the service and removes it after
+// the grace period unless it is restored. Context mutex must be held.
+func (ctx *Context) softDeleteService(vs *Service) {
+	if vs.deleteTimer != nil {
+		return
+	}
+	for _, rsID := range sortedKeys(vs.backends) {
+		ctx.hideBackend(vs, vs.backends[rsID])
+	}
+	vs.deletedAt = time.Now()
+	var timer *time.Timer
+	timer = time.AfterFunc(ctx.deleteGracePeriod, func() {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+		if ctx.services[vs.vsID] != vs || vs.deleteTimer != timer {
+			return
+		}
+		log.Infof("grace period of deleted service [%s] is over", vs.vsID)
+		if _, err := ctx.removeService(vs.vsID); err != nil {
+			log.Errorf("error while removing deleted service [%s]: %s", vs.vsID, err)
+		}
+	})
+	vs.deleteTimer = timer
+	ctx.revision++
+	vs.version = ctx.revision
+	ctx.recordEvent(vs.vsID, "", EventDeleted, "will be removed in %s unless restored", ctx.deleteGracePeriod)
+	log.Warnf("service [%s] is deleted and will be removed in %s unless restored", vs.vsID, ctx.deleteGracePeriod)
+}
+
+// softDeleteBackend hides the backend and removes it after the grace period
+// unless it is restored. Context mutex must be held.
+func (ctx *Context) softDeleteBackend(vs *Service, rs *Backend) {
+	if rs.deleteTimer != nil {
+		return
+	}
+	ctx.hideBackend(vs, rs)
+	rs.deletedAt = time.Now()
+	var timer *time.Timer
+	timer = time.AfterFunc(ctx.deleteGracePeriod, func() {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+		if ctx.services[vs.vsID] != vs || vs.backends[rs.rsID] != rs || rs.deleteTimer != timer {
+			return
+		}
+		log.Infof("grace period of deleted backend [%s/%s] is over", vs.vsID, rs.rsID)
+		if _, err := ctx.removeBackend(vs.vsID, rs.rsID); err != nil {
+			log.Errorf("error while removing deleted backend [%s/%s]: %s", vs.vsID, rs.rsID, err)
+		}
+	})
+	rs.deleteTimer = timer
+	ctx.revision++
+	rs.version = ctx.revision
+	ctx.recordEvent(vs.vsID, rs.rsID, EventDeleted, "will be removed in %s unless restored", ctx.deleteGracePeriod)
+	log.Warnf("backend [%s/%s] is deleted and will be removed in %s unless restored",
+		vs.vsID, rs.rsID, ctx.deleteGracePeriod)
+}
+
+// RestoreService undoes deletion of the service within the grace period.
+func (ctx *Context) RestoreService(vsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	if vs.deleteTimer == nil {
+		return ErrNotDeleted
+	}
+	vs.deleteTimer.Stop()
+	vs.deleteTimer = nil
+	vs.deletedAt = time.Time{}
+	for _, rsID := range sortedKeys(vs.backends) {
+		// separately deleted, drained, excluded, inactive and removed backends stay hidden
+		if rs := vs.backends[rsID]; rs.deleteTimer == nil && !rs.drained && !rs.excluded && !rs.inactive &&
+			rs.removalTimer == nil {
+			ctx.unhideBackend(vs, rs)
+		}
+	}
+	ctx.revision++
+	vs.version = ctx.revision
+	ctx.recordEvent(vsID, "", EventRestored, "restored")
+	log.Infof("deleted service [%s] has been restored", vsID)
+	return nil
+}
+
+// RestoreBackend undoes deletion of the backend within the grace period.
+func (ctx *Context) RestoreBackend(vsID, rsID string, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	rs, exists := vs.backends[rsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "rsID", rsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, rs.version); err != nil {
+		return err
+	}
+	if rs.deleteTimer == nil {
+		return ErrNotDeleted
+	}
+	rs.deleteTimer.Stop()
+	rs.deleteTimer = nil
+	rs.deletedAt = time.Time{}
+	// backends of deleted service stay hidden until the service is restored
+	if vs.deleteTimer == nil && !rs.drained && !rs.excluded && !rs.inactive && rs.removalTimer == nil {
+		ctx.unhideBackend(vs, rs)
+	}
+	ctx.revision++
+	rs.version = ctx.revision
+	ctx.recordEvent(vsID, rsID, EventRestored, "restored")
+	log.Infof("deleted backend [%s/%s] has been restored", vsID, rsID)
+	return nil
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidSorryServer is returned if the sorry server isn't an IP:port of the service address family.
+var ErrInvalidSorryServer = errors.New("sorry server must be IP:port of the service address family")
+
+// sorryServerID is reported as ID of the sorry server destination.
+const sorryServerID = "sorry_server"
+
+// validateSorryServer parses the sorry server address, the service host must be
+// resolved already.
+func (o *ServiceOptions) validateSorryServer() error {
+	o.sorryHost, o.sorryPort = nil, 0
+	if o.SorryServer == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(o.SorryServer)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSorryServer, err)
+	}
+	ip := net.ParseIP(host)
+	number, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil || number == 0 || util.AddrFamily(ip) != util.AddrFamily(o.host) {
+		return fmt.Errorf("%w: %s", ErrInvalidSorryServer, o.SorryServer)
+	}
+	if err := o.checkBackendPort(sorryServerID, uint16(number)); err != nil {
+		return err
+	}
+	o.sorryHost, o.sorryPort = ip, uint16(number)
+	return nil
+}
+
+// isSorryServer tells if the address is the sorry server of the service.
+func (o *ServiceOptions) isSorryServer(ip net.IP, port uint16) bool {
+	return o.sorryHost != nil && o.sorryHost.Equal(ip) && o.sorryPort == port
+}
+
+// updateSorryServer inserts the sorry server of the service while none of its
+// backends is healthy and removes it once any recovers. Context mutex must be held.
+func (ctx *Context) updateSorryServer(vs *Service) {
+	if vs.options.sorryHost == nil {
+		return
+	}
+	active := vs.healthyBackends() == 0
+	if active == vs.sorryActive {
+		return
+	}
+
+	rip, rport := vs.options.sorryHost.String(), vs.options.sorryPort
+	if active {
+		log.Warnf("no backends of service [%s] are healthy, inserting sorry server %s", vs.vsID, vs.options.SorryServer)
+		if err := ctx.addDest(vs, rip, rport, 1); err != nil {
+			log.Errorf("error while inserting sorry server of service [%s]: %s", vs.vsID, err)
+			return
+		}
+		ctx.recordEvent(vs.vsID, "", EventSorryServer, "inserted %s", vs.options.SorryServer)
+	} else {
+		log.Infof("backends of service [%s] have recovered, removing sorry server %s", vs.vsID, vs.options.SorryServer)
+		if err := ctx.ipvs.DelDestPort(vs.options.host.String(), vs.options.Port, rip, rport,
+			vs.options.protocol); err != nil {
+			log.Errorf("error while removing sorry server of service [%s]: %s", vs.vsID, err)
+			return
+		}
+		ctx.recordEvent(vs.vsID, "", EventSorryServer, "removed %s", vs.options.SorryServer)
+	}
+	vs.sorryActive = active
+}
@@ -0,0 +1,377 @@
+package core
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tehnerd/gnl2go"
+)
+
+// DefaultSyncWorkers is a number of concurrent workers of the first store synchronization.
+const DefaultSyncWorkers = 8
+
+// StartupPhase is a stage of GORB startup.
+type StartupPhase string
+
+// Possible startup phases.
+const (
+	// StartupWaiting is waiting for the first store synchronization to start.
+	StartupWaiting StartupPhase = "waiting"
+	// StartupPreparing resolves hosts of services and backends to be created.
+	StartupPreparing StartupPhase = "preparing"
+	// StartupApplying creates services and backends.
+	StartupApplying StartupPhase = "applying"
+	// StartupDone is reported once the first synchronization is over or if there is no store.
+	StartupDone StartupPhase = "done"
+)
+
+// StartupProgress is progress of the first store synchronization, which could
+// take a while on cold start with thousands of services and backends.
+type StartupProgress struct {
+	Phase StartupPhase `json:"phase"`
+	// Total is a number of operations of the first synchronization
+	Total int `json:"total"`
+	// Applied is a number of operations applied so far, including failed ones
+	Applied int `json:"applied"`
+	// Failed is a number of operations which have failed
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// startupTracker keeps progress of the first synchronization apart from the
+// context mutex, which the synchronization holds until it's over.
+type startupTracker struct {
+	mutex    sync.Mutex
+	progress StartupProgress
+	// synced is set once the first synchronization has started
+	synced bool
+}
+
+// wait reports startup isn't over until the first synchronization.
+func (t *startupTracker) wait() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.synced {
+		t.progress.Phase = StartupWaiting
+	}
+}
+
+// begin starts progress of the first synchronization, false is returned for later ones.
+func (t *startupTracker) begin(total int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.synced {
+		return false
+	}
+	now := time.Now()
+	t.synced = true
+	t.progress = StartupProgress{Phase: StartupPreparing, Total: total, StartedAt: &now}
+	return true
+}
+
+func (t *startupTracker) setPhase(phase StartupPhase) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Phase = phase
+	if phase == StartupDone {
+		now := time.Now()
+		t.progress.FinishedAt = &now
+	}
+}
+
+// applied counts the applied operation while the first synchronization applies them.
+func (t *startupTracker) applied(failed bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.progress.Phase != StartupApplying {
+		return
+	}
+	t.progress.Applied++
+	if failed {
+		t.progress.Failed++
+	}
+}
+
+// StartupProgress returns progress of the first store synchronization. It
+// doesn't wait for the context, so it could be watched while the sync runs.
+func (ctx *Context) StartupProgress() StartupProgress {
+	ctx.startup.mutex.Lock()
+	defer ctx.startup.mutex.Unlock()
+	progress := ctx.startup.progress
+	if progress.Phase == "" {
+		// there is nothing to wait for without a store
+		progress.Phase = StartupDone
+	}
+	return progress
+}
+
+// poolKey identifies IPVS services the way gnl2go.Service.IsEqual compares them.
+type poolKey struct {
+	proto  uint16
+	vip    string
+	port   uint16
+	sched  string
+	fwmark uint32
+}
+
+func newPoolKey(svc gnl2go.Service) poolKey {
+	return poolKey{proto: svc.Proto, vip: svc.VIP, port: svc.Port, sched: svc.Sched, fwmark: svc.FWMark}
+}
+
+// address returns the key without the scheduler, which identifies the IPVS
+// service even if its scheduler differs from the one of GORB service.
+func (k poolKey) address() poolKey {
+	k.sched = ""
+	return k
+}
+
+// hostResolver resolves host names of services and backends into addresses.
+type hostResolver func(host string) (net.IP, error)
+
+func resolveHost(host string) (net.IP, error) {
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// resolvedHost is a host resolved ahead of the first synchronization.
+type resolvedHost struct {
+	ip  net.IP
+	err error
+}
+
+// resolveHost resolves the host with addresses resolved for the first
+// synchronization, other hosts are resolved on demand. Context mutex must be held.
+func (ctx *Context) resolveHost(host string) (net.IP, error) {
+	if resolved, exists := ctx.resolvedHosts[host]; exists {
+		return resolved.ip, resolved.err
+	}
+	return resolveHost(host)
+}
+
+// workers returns a number of sync workers for the number of jobs.
+func (ctx *Context) workers(jobs int) int {
+	return min(max(ctx.syncWorkers, 1), jobs)
+}
+
+// prepareInitialSync speeds up the first synchronization, which creates every
+// service and backend. IPVS writes can't run concurrently, so the rest of the
+// work is overlapped with them: hosts are resolved by a bounded pool of workers,
+// IPVS pools are read once instead of once per service and backend, objects are
+// created by workers of applyInitialCreates and services are exposed to Disco
+// concurrently by finishInitialSync. Context mutex must be held.
+func (ctx *Context) prepareInitialSync(plan *SyncPlan) {
+	hosts := make(map[string]bool)
+	creates := 0
+	for _, op := range plan.Operations {
+		if op.Action != SyncActionCreate {
+			continue
+		}
+		creates++
+		if op.service != nil && op.service.ServiceOptions != nil && op.service.ServiceOptions.Host != "" {
+			hosts[op.service.ServiceOptions.Host] = true
+		}
+		backends := map[string]*BackendOptions{op.RsID: op.backend}
+		if op.service != nil {
+			backends = op.service.ServiceBackends
+		}
+		for _, opts := range backends {
+			if opts != nil && opts.Host != "" {
+				hosts[opts.Host] = true
+			}
+		}
+	}
+
+	if creates == 0 {
+		return
+	}
+
+	// hosts are resolved by workers, options are only read, since they could be shared
+	names := sortedKeys(hosts)
+	resolved := make([]resolvedHost, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range ctx.workers(len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				resolved[i].ip, resolved[i].err = resolveHost(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	ctx.resolvedHosts = make(map[string]resolvedHost, len(names))
+	for i, name := range names {
+		ctx.resolvedHosts[name] = resolved[i]
+	}
+
+	pools, err := ctx.ipvs.GetPools()
+	if err != nil {
+		// pools are read for every object then, which reports the error
+		log.Errorf("Failed to get pools from ipvs: %s", err)
+	} else {
+		ctx.initialPools = make(map[poolKey]gnl2go.Pool, len(pools))
+		for _, pool := range pools {
+			ctx.initialPools[newPoolKey(pool.Service)] = pool
+		}
+	}
+	ctx.deferredExposes = make(map[string]*Service)
+	log.Infof("prepared first synchronization: %d hosts resolved by %d workers, %d IPVS pools",
+		len(names), ctx.workers(len(names)), len(pools))
+}
+
+// applyInitialCreates creates services and backends of the first synchronization
+// by a bounded pool of workers. Workers take turns under the sync lock and release
+// it while their IPVS calls wait in the queue, which keeps netlink access serialized,
+// so validation and monitor setup of some objects overlap with IPVS writes of others.
+// Objects of the same IPVS service are created by a single worker in plan order.
+// Only the worker holding the lock queues IPVS writes and changes the trace parent
+// of the context. Context mutex must be held.
+func (ctx *Context) applyInitialCreates(parent context.Context, ops []*SyncOperation, result *StoreSyncResult,
+	failed map[string]bool) {
+	if len(ops) == 0 {
+		return
+	}
+	groups := make(map[string][]*SyncOperation)
+	for _, op := range ops {
+		key := ctx.createTarget(op)
+		groups[key] = append(groups[key], op)
+	}
+
+	lock := &sync.Mutex{}
+	ctx.syncLock = lock
+	// workers could leave the trace parent of an operation of another worker
+	defer ctx.traceParent.Store(tracedOperation{ctx.tracedOperation()})
+	defer func() { ctx.syncLock = nil }()
+	jobs := make(chan []*SyncOperation)
+	var wg sync.WaitGroup
+	for range ctx.workers(len(groups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				lock.Lock()
+				for _, op := range group {
+					ctx.applyPlannedOperation(parent, op, result, failed, ctx.withTraceParent)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, key := range sortedKeys(groups) {
+		jobs <- groups[key]
+	}
+	close(jobs)
+	wg.Wait()
+	log.Infof("applied %d creations of first synchronization by %d workers", len(ops), ctx.workers(len(groups)))
+}
+
+// createTarget returns the address of the IPVS service the create operation writes
+// to, so services sharing the address are created one after another. Context mutex
+// must be held.
+func (ctx *Context) createTarget(op *SyncOperation) string {
+	if vs, exists := ctx.services[op.VsID]; exists && op.RsID != "" {
+		return net.JoinHostPort(vs.options.host.String(), strconv.Itoa(int(vs.options.Port)))
+	}
+	if op.service == nil || op.service.ServiceOptions == nil {
+		return ""
+	}
+	host := op.service.ServiceOptions.Host
+	if resolved, exists := ctx.resolvedHosts[host]; exists && resolved.err == nil {
+		host = resolved.ip.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(op.service.ServiceOptions.Port)))
+}
+
+// withoutSyncLock runs the IPVS write and releases the lock of sync workers once
+// the write is queued, so other workers go on while it waits for its turn. Spans
+// of the write are started before, the trace parent of the worker is restored
+// after. Context mutex must be held.
+func (ctx *Context) withoutSyncLock(write func() error) error {
+	lock := ctx.syncLock
+	if lock == nil || ctx.ipvsQueue == nil {
+		return write()
+	}
+	parent := ctx.tracedOperation()
+	var released atomic.Bool
+	release := func() {
+		if released.CompareAndSwap(false, true) {
+			lock.Unlock()
+		}
+	}
+	ctx.ipvsQueue.enqueued.Store(&release)
+	err := write()
+	ctx.ipvsQueue.enqueued.CompareAndSwap(&release, nil)
+	if !released.CompareAndSwap(false, true) {
+		// the write has been queued, so the lock has been released
+		lock.Lock()
+		ctx.traceParent.Store(tracedOperation{parent})
+	}
+	return err
+}
+
+// forgetInitialPool drops the IPVS service or its destination removed during the
+// first synchronization from pools read for it, so they could be created again.
+// Context mutex must be held.
+func (ctx *Context) forgetInitialPool(svc gnl2go.Service, rip string, rport uint16) {
+	key := newPoolKey(svc)
+	pool, exists := ctx.initialPools[key]
+	switch {
+	case !exists:
+	case rip == "":
+		delete(ctx.initialPools, key)
+	default:
+		pool.Dests = slices.DeleteFunc(slices.Clone(pool.Dests), func(dest gnl2go.Dest) bool {
+			return dest.IP == rip && dest.Port == rport
+		})
+		ctx.initialPools[key] = pool
+	}
+}
+
+// finishInitialSync exposes services created by the first synchronization to
+// Disco concurrently and drops state prepared for it. Context mutex must be held.
+func (ctx *Context) finishInitialSync() {
+	exposes := ctx.deferredExposes
+	ctx.resolvedHosts, ctx.initialPools, ctx.deferredExposes = nil, nil, nil
+
+	vsIDs := make([]string, 0, len(exposes))
+	for _, vsID := range sortedKeys(exposes) {
+		// services removed during the sync aren't exposed
+		if ctx.services[vsID] == exposes[vsID] {
+			vsIDs = append(vsIDs, vsID)
+		}
+	}
+	jobs := make(chan *Service)
+	var wg sync.WaitGroup
+	for range ctx.workers(len(vsIDs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for vs := range jobs {
+				if err := ctx.disco.Expose(vs.vsID, vs.options.host.String(), vs.options.Port); err != nil {
+					log.Errorf("error while exposing service to Disco: %s", err)
+				}
+			}
+		}()
+	}
+	for _, vsID := range vsIDs {
+		jobs <- ctx.services[vsID]
+		ctx.services[vsID].exposed = true
+	}
+	close(jobs)
+	wg.Wait()
+}
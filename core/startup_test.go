@@ -0,0 +1,129 @@
+package core
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/tehnerd/gnl2go"
+)
+
+// poolCountingIpvs counts reads of the whole IPVS table.
+type poolCountingIpvs struct {
+	Ipvs
+	reads atomic.Int32
+}
+
+func (p *poolCountingIpvs) GetPools() ([]gnl2go.Pool, error) {
+	p.reads.Add(1)
+	return p.Ipvs.GetPools()
+}
+
+func TestInitialSync(t *testing.T) {
+	ipvs := &poolCountingIpvs{Ipvs: NewMemoryIpvs()}
+	queue := newQueuedIpvs(ipvs, 0)
+	defer queue.Exit()
+	c := newContext(queue, &fakeDisco{})
+	c.ipvsQueue = queue
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	c.syncWorkers = 4
+	assert.Equal(t, StartupDone, c.StartupProgress().Phase, "there is nothing to wait for without a store")
+	c.startup.wait()
+	assert.Equal(t, StartupWaiting, c.StartupProgress().Phase)
+
+	// the service and the destination of web-0 are left by a previous run
+	require.NoError(t, ipvs.AddService("10.0.0.1", 80, syscall.IPPROTO_TCP, "wrr"))
+	require.NoError(t, ipvs.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, syscall.IPPROTO_TCP, 100, 0))
+	services := make(map[string]*ServiceConfig)
+	for i := range 20 {
+		backends := make(map[string]*BackendOptions)
+		for j := range 3 {
+			backends[fmt.Sprint("b", j)] = &BackendOptions{Host: fmt.Sprintf("10.1.%d.%d", i, j+1), Port: 8080}
+		}
+		services[fmt.Sprint("web-", i)] = &ServiceConfig{
+			ServiceOptions:  &ServiceOptions{Host: fmt.Sprintf("10.0.%d.1", i), Port: 80},
+			ServiceBackends: backends,
+		}
+	}
+	validateServiceConfigs(services, nil, nil)
+	ipvs.reads.Store(0)
+
+	_, err := c.Synchronize(services)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), ipvs.reads.Load(), "IPVS pools are read once")
+	assert.Len(t, c.services, 20)
+	pool := findPool(t, ipvs, "10.0.0.1", 80, syscall.IPPROTO_TCP)
+	require.NotNil(t, pool)
+	assert.Len(t, pool.Dests, 3)
+	for _, vs := range c.services {
+		assert.Len(t, vs.backends, 3)
+	}
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Expose", 20)
+	for _, vs := range c.services {
+		assert.True(t, vs.exposed)
+	}
+	assert.Nil(t, c.initialPools)
+	assert.Nil(t, c.resolvedHosts)
+
+	progress := c.StartupProgress()
+	assert.Equal(t, StartupDone, progress.Phase)
+	assert.Equal(t, 20, progress.Total)
+	assert.Equal(t, 20, progress.Applied)
+	assert.Zero(t, progress.Failed)
+	require.NotNil(t, progress.FinishedAt)
+
+	// later synchronizations don't change the startup progress
+	services["api"] = &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "10.0.100.1", Port: 80}}
+	validateServiceConfigs(services, nil, nil)
+	_, err = c.Synchronize(services)
+	require.NoError(t, err)
+	c.disco.(*fakeDisco).AssertNumberOfCalls(t, "Expose", 21)
+	assert.Equal(t, progress, c.StartupProgress())
+}
+
+// slowIpvs takes a while to write, like netlink does.
+type slowIpvs struct {
+	Ipvs
+}
+
+func (s slowIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	time.Sleep(time.Millisecond)
+	return s.Ipvs.AddService(vip, port, protocol, sched)
+}
+
+func (s slowIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	time.Sleep(time.Millisecond)
+	return s.Ipvs.AddDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+}
+
+func TestInitialSyncSharedMonitors(t *testing.T) {
+	queue := newQueuedIpvs(slowIpvs{NewMemoryIpvs()}, 0)
+	defer queue.Exit()
+	c := newContext(queue, &fakeDisco{})
+	c.ipvsQueue = queue
+	c.disco.(*fakeDisco).On("Expose", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	defer close(c.stopCh)
+	c.syncWorkers = 4
+
+	// services are created by concurrent workers, which share the monitor of the backend
+	services := make(map[string]*ServiceConfig)
+	for i := range 8 {
+		services[fmt.Sprint("web-", i)] = &ServiceConfig{
+			ServiceOptions:  &ServiceOptions{Host: fmt.Sprintf("10.0.%d.1", i), Port: 80},
+			ServiceBackends: map[string]*BackendOptions{"shared": {Host: "10.2.0.1", Port: 8080}},
+		}
+	}
+	validateServiceConfigs(services, nil, nil)
+	_, err := c.Synchronize(services)
+	require.NoError(t, err)
+	require.Len(t, c.monitors, 1)
+	for _, m := range c.monitors {
+		assert.Len(t, m.subscribers, 8)
+	}
+}
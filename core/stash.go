@@ -0,0 +1,148 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/qk4l/gorb/pulse"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotStashed is returned when the saved weight of a backend which isn't stashed is changed.
+	ErrNotStashed = errors.New("backend isn't stashed")
+	// ErrInvalidStashedWeight is returned for saved weights out of [0, max weight].
+	ErrInvalidStashedWeight = errors.New("stashed weight must be within [0, max weight]")
+)
+
+// StashedBackend is a backend whose weight is saved by pulse while it's down,
+// flapping or reduced by the weight policy, so it could be restored after recovery.
+type StashedBackend struct {
+	VsID string `json:"vs_id"`
+	RsID string `json:"rs_id"`
+	// Weight the backend returns to once it has completely recovered
+	Weight int32 `json:"weight"`
+	// CurrentWeight is the weight of the backend meanwhile
+	CurrentWeight int32 `json:"current_weight"`
+	// Status is the pulse status of the backend, e.g. Down
+	Status    string    `json:"status"`
+	StashedAt time.Time `json:"stashed_at"`
+	// StashedFor is a number of seconds since the backend has been stashed
+	StashedFor int64 `json:"stashed_for"`
+}
+
+// Stash lists backends stashed by pulse with their saved weights.
+func (ctx *Context) Stash() []StashedBackend {
+	backends := []StashedBackend{}
+	ctx.withStash(func(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time) {
+		backends = ctx.stashedBackends(stash, stashedAt, time.Now())
+	})
+	return backends
+}
+
+// SetStashedWeight overrides the weight the stashed backend returns to after
+// recovery, so capacity changes made during an outage aren't lost. Weights of
+// services with locality, colors or failover are recalculated on their changes.
+func (ctx *Context) SetStashedWeight(vsID, rsID string, weight int32, pre Precondition) error {
+	err := ErrNotStashed
+	ctx.withStash(func(stash map[pulse.ID]int32, _ map[pulse.ID]time.Time) {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+
+		vs, exists := ctx.services[vsID]
+		if !exists {
+			err = objectError(ErrObjectNotFound, "vsID", vsID)
+			return
+		}
+		rs, exists := vs.backends[rsID]
+		if !exists {
+			err = objectError(ErrObjectNotFound, "rsID", rsID)
+			return
+		}
+		if preErr := ctx.checkPrecondition(pre, true, rs.version); preErr != nil {
+			err = preErr
+			return
+		}
+		if weight < 0 || weight > vs.options.MaxWeight {
+			err = ErrInvalidStashedWeight
+			return
+		}
+		id := pulse.ID{VsID: vsID, RsID: rsID}
+		previous, stashed := stash[id]
+		if !stashed {
+			return
+		}
+		stash[id], err = weight, nil
+		ctx.recordEvent(vsID, rsID, EventStashUpdated, "weight restored after recovery changed from %d to %d",
+			previous, weight)
+		log.Infof("backend [%s/%s] will recover to weight %d instead of %d", vsID, rsID, weight, previous)
+	})
+	return err
+}
+
+// withStash runs f in the notification loop owning the stash. It returns false
+// without running f if the context is stopped.
+func (ctx *Context) withStash(f func(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time)) bool {
+	done := make(chan struct{})
+	select {
+	case ctx.stashCh <- func(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time) {
+		defer close(done)
+		f(stash, stashedAt)
+	}:
+		<-done
+		return true
+	case <-ctx.stopCh:
+		return false
+	}
+}
+
+// trackStash remembers when backends have been stashed, entries of backends
+// which have left stash are forgotten.
+func trackStash(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time, now time.Time) {
+	for id := range stashedAt {
+		if _, stashed := stash[id]; !stashed {
+			delete(stashedAt, id)
+		}
+	}
+	for id := range stash {
+		if _, exists := stashedAt[id]; !exists {
+			stashedAt[id] = now
+		}
+	}
+}
+
+// stashedBackends builds a snapshot of stash ordered by services and backends. Entries
+// of removed backends are left out, they are dropped from stash on their next update.
+func (ctx *Context) stashedBackends(stash map[pulse.ID]int32, stashedAt map[pulse.ID]time.Time, now time.Time) []StashedBackend {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	backends := []StashedBackend{}
+	for id, weight := range stash {
+		vs, exists := ctx.services[id.VsID]
+		if !exists {
+			continue
+		}
+		rs, exists := vs.backends[id.RsID]
+		if !exists {
+			continue
+		}
+		backends = append(backends, StashedBackend{
+			VsID:          id.VsID,
+			RsID:          id.RsID,
+			Weight:        weight,
+			CurrentWeight: rs.options.weight,
+			Status:        rs.metrics.Status.String(),
+			StashedAt:     stashedAt[id],
+			StashedFor:    int64(now.Sub(stashedAt[id]).Seconds()),
+		})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		if backends[i].VsID != backends[j].VsID {
+			return backends[i].VsID < backends[j].VsID
+		}
+		return backends[i].RsID < backends[j].RsID
+	})
+	return backends
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible protocols of stats emitter.
+const (
+	StatsProtocolStatsD   = "statsd"
+	StatsProtocolGraphite = "graphite"
+)
+
+const (
+	// statsTimeout limits connecting to Graphite and writing stats.
+	statsTimeout = 10 * time.Second
+	// statsdPacketSize keeps StatsD datagrams within a typical MTU.
+	statsdPacketSize = 1432
+)
+
+// Possible stats emitter errors.
+var (
+	ErrInvalidStatsProtocol = errors.New("stats protocol must be statsd or graphite")
+	ErrInvalidStatsInterval = errors.New("stats interval must be positive")
+)
+
+// StatsEmitterOptions configure emitting of service and backend stats to StatsD or Graphite.
+type StatsEmitterOptions struct {
+	// Address of StatsD (UDP) or Graphite plaintext (TCP) server, host:port
+	Address string
+	// Protocol is statsd or graphite
+	Protocol string
+	// Prefix of metric paths, e.g. gorb.lb1
+	Prefix   string
+	Interval time.Duration
+}
+
+// Validate checks emitter options and fills in defaults.
+func (o *StatsEmitterOptions) Validate() error {
+	if o.Protocol == "" {
+		o.Protocol = StatsProtocolStatsD
+	}
+	if o.Protocol != StatsProtocolStatsD && o.Protocol != StatsProtocolGraphite {
+		return ErrInvalidStatsProtocol
+	}
+	if o.Interval <= 0 {
+		return ErrInvalidStatsInterval
+	}
+	if _, _, err := net.SplitHostPort(o.Address); err != nil {
+		return err
+	}
+	o.Prefix = strings.Trim(o.Prefix, ".")
+	return nil
+}
+
+// StatsEmitter periodically emits health, weights and health check results of
+// services and backends as gauges, for setups without Prometheus.
+type StatsEmitter struct {
+	ctx     *Context
+	options StatsEmitterOptions
+}
+
+// statSample is a single gauge value.
+type statSample struct {
+	path  string
+	value float64
+}
+
+// NewStatsEmitter creates an emitter of stats of the context.
+func NewStatsEmitter(ctx *Context, options StatsEmitterOptions) (*StatsEmitter, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return &StatsEmitter{ctx: ctx, options: options}, nil
+}
+
+// Run emits stats every interval until the context is closed. Failures are
+// logged and stats are emitted again on the next interval.
+func (e *StatsEmitter) Run() {
+	log.Infof("emitting stats to %s %s every %s", e.options.Protocol, e.options.Address, e.options.Interval)
+	ticker := time.NewTicker(e.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Emit(); err != nil {
+			log.Errorf("error while emitting stats to %s: %s", e.options.Address, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-e.ctx.stopCh:
+			return
+		}
+	}
+}
+
+// Emit sends stats once.
+func (e *StatsEmitter) Emit() error {
+	samples := e.samples()
+	if e.options.Protocol == StatsProtocolGraphite {
+		return e.emitGraphite(samples, time.Now())
+	}
+	return e.emitStatsD(samples)
+}
+
+// statPath joins path elements, IDs are sanitized so they don't introduce levels.
+func statPath(elements ...string) string {
+	sanitized := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element == "" {
+			continue
+		}
+		sanitized = append(sanitized, strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+				return r
+			}
+			return '_'
+		}, element))
+	}
+	return strings.Join(sanitized, ".")
+}
+
+// samples gathers stats of services and their backends ordered by their paths.
+func (e *StatsEmitter) samples() []statSample {
+	var samples []statSample
+	services, _ := e.ctx.ListServices()
+	for _, vsID := range services {
+		service, err := e.ctx.GetService(vsID)
+		if err != nil {
+			// the service has been removed meanwhile
+			continue
+		}
+		prefix := statPath("service", vsID)
+		if e.options.Prefix != "" {
+			prefix = e.options.Prefix + "." + prefix
+		}
+		samples = append(samples,
+			statSample{prefix + ".health", service.Health},
+			statSample{prefix + ".status", service.Status.value()},
+			statSample{prefix + ".backends", float64(len(service.Backends))},
+			statSample{prefix + ".backends_healthy", float64(service.HealthyBackends)})
+
+		for _, rsID := range service.Backends {
+			backend, err := e.ctx.GetBackend(vsID, rsID)
+			if err != nil {
+				continue
+			}
+			backendPrefix := prefix + "." + statPath("backend", rsID)
+			samples = append(samples,
+				statSample{backendPrefix + ".health", backend.Metrics.Health},
+				statSample{backendPrefix + ".status", float64(backend.Metrics.Status)},
+				statSample{backendPrefix + ".weight", float64(backend.Options.weight)},
+				statSample{backendPrefix + ".uptime", backend.Metrics.Uptime.Seconds()},
+				statSample{backendPrefix + ".check_latency_ms", float64(backend.Metrics.Latency.Milliseconds())})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].path < samples[j].path })
+	return samples
+}
+
+func formatStat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// emitStatsD sends samples as StatsD gauges packed into datagrams.
+func (e *StatsEmitter) emitStatsD(samples []statSample) error {
+	conn, err := net.DialTimeout("udp", e.options.Address, statsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(bytes.TrimSuffix(packet.Bytes(), []byte("\n")))
+		packet.Reset()
+		return err
+	}
+	for _, sample := range samples {
+		line := fmt.Sprintf("%s:%s|g\n", sample.path, formatStat(sample.value))
+		if packet.Len()+len(line) > statsdPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// emitGraphite sends samples over a Graphite plaintext connection.
+func (e *StatsEmitter) emitGraphite(samples []statSample, now time.Time) error {
+	conn, err := net.DialTimeout("tcp", e.options.Address, statsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var lines bytes.Buffer
+	for _, sample := range samples {
+		fmt.Fprintf(&lines, "%s %s %d\n", sample.path, formatStat(sample.value), now.Unix())
+	}
+	conn.SetWriteDeadline(now.Add(statsTimeout))
+	_, err = conn.Write(lines.Bytes())
+	return err
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatPath(t *testing.T) {
+	assert.Equal(t, "service.web_example_com.backend.10_0_0_1_8080", statPath("service", "web.example.com", "",
+		"backend", "10.0.0.1:8080"))
+}
+
+func TestStatsEmitter(t *testing.T) {
+	c := newContext(NewMemoryIpvs(), &fakeDisco{})
+	c.disco.(*fakeDisco).On("Expose", vsID, "127.0.0.1", uint16(80)).Return(nil)
+	defer close(c.stopCh)
+	require.NoError(t, c.CreateService(vsID, &ServiceConfig{
+		ServiceOptions:  &ServiceOptions{Port: 80, Host: "localhost"},
+		ServiceBackends: map[string]*BackendOptions{"a.b": {Host: "127.0.0.2", Port: 8080}},
+	}))
+
+	_, err := NewStatsEmitter(c, StatsEmitterOptions{Address: "localhost:8125", Protocol: "influx", Interval: time.Second})
+	assert.Equal(t, ErrInvalidStatsProtocol, err)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udp.Close()
+	emitter, err := NewStatsEmitter(c, StatsEmitterOptions{Address: udp.LocalAddr().String(), Prefix: "gorb.lb1.",
+		Interval: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, emitter.Emit())
+	packet := make([]byte, statsdPacketSize)
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := udp.ReadFrom(packet)
+	require.NoError(t, err)
+	lines := strings.Split(string(packet[:n]), "\n")
+	assert.Len(t, lines, 9)
+	assert.Contains(t, lines, "gorb.lb1.service.virtualServiceId.backend.a_b.weight:100|g")
+	assert.Contains(t, lines, "gorb.lb1.service.virtualServiceId.backends_healthy:1|g")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+	emitter, err = NewStatsEmitter(c, StatsEmitterOptions{Address: tcp.Addr().String(), Protocol: StatsProtocolGraphite,
+		Interval: time.Second})
+	require.NoError(t, err)
+	received := make(chan []string)
+	go func() {
+		conn, err := tcp.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		for scanner := bufio.NewScanner(conn); scanner.Scan(); {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+	require.NoError(t, emitter.Emit())
+	graphite := <-received
+	require.Len(t, graphite, 9)
+	assert.Regexp(t, `^service\.virtualServiceId\.backend\.a_b\.check_latency_ms 0 \d+$`, graphite[0])
+}
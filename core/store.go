@@ -1,27 +1,109 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/qk4l/gorb/local_store"
 	"gopkg.in/yaml.v3"
+	"net"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"filippo.io/age"
 	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	"github.com/docker/libkv/store/boltdb"
 	"github.com/docker/libkv/store/consul"
 	"github.com/docker/libkv/store/etcd"
 	"github.com/docker/libkv/store/zookeeper"
+	"github.com/qk4l/gorb/tracing"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// Possible store synchronization errors.
+var (
+	ErrSyncInProgress = errors.New("store synchronization is already in progress")
+	ErrSyncTimeout    = errors.New("store synchronization has timed out")
+)
+
+// defaultSyncTimeout bounds a single synchronization with store.
+const defaultSyncTimeout = 60 * time.Second
+
+// storeReadWorkers is a number of store values parsed concurrently per layer.
+const storeReadWorkers = 8
+
 type ServiceConfig struct {
+	// APIVersion is a layout of the document, see ServiceConfigVersion
+	APIVersion      string                     `yaml:"api_version,omitempty"`
 	ServiceOptions  *ServiceOptions            `yaml:"service_options"`
 	ServiceBackends map[string]*BackendOptions `yaml:"service_backends"`
+
+	// err is set if store content of the service is invalid
+	err error
+	// invalidBackends backends skipped due to invalid store content
+	invalidBackends map[string]error
+	// revision of store content the service is read from, zero if unknown
+	revision uint64
+}
+
+// validate marks invalid service and backends, so they are skipped
+// during synchronization instead of failing the whole sync.
+func (c *ServiceConfig) validate(defaultHost net.IP, networks backendNetworks) {
+	if c.err != nil {
+		return
+	}
+	if err := c.ServiceOptions.Validate(defaultHost); err != nil {
+		c.err = err
+		return
+	}
+	backends, errs := expandBackendRanges(c.ServiceBackends)
+	c.ServiceBackends = backends
+	for rsID, err := range errs {
+		if c.invalidBackends == nil {
+			c.invalidBackends = make(map[string]error)
+		}
+		c.invalidBackends[rsID] = err
+	}
+	for rsID, backend := range c.ServiceBackends {
+		if backend == nil {
+			backend = &BackendOptions{}
+		}
+		err := backend.Validate()
+		if err == nil {
+			err = networks.check(backend.host)
+		}
+		if err != nil {
+			if c.invalidBackends == nil {
+				c.invalidBackends = make(map[string]error)
+			}
+			c.invalidBackends[rsID] = err
+			delete(c.ServiceBackends, rsID)
+		}
+	}
+	// the first backend (by ID) of the same address is kept, the others are skipped
+	owners := make(map[string]string, len(c.ServiceBackends))
+	for _, rsID := range sortedKeys(c.ServiceBackends) {
+		backend := c.ServiceBackends[rsID]
+		address := net.JoinHostPort(backend.host.String(), fmt.Sprint(backend.Port))
+		if owner, exists := owners[address]; exists {
+			log.Warnf("backend [%s] has the same address %s as backend [%s]. skipping", rsID, address, owner)
+			if c.invalidBackends == nil {
+				c.invalidBackends = make(map[string]error)
+			}
+			c.invalidBackends[rsID] = fmt.Errorf("%w: %s", ErrDuplicateBackend, owner)
+			delete(c.ServiceBackends, rsID)
+			continue
+		}
+		owners[address] = rsID
+	}
 }
 
 // StoreSyncStatus info about synchronization with ext-store
@@ -40,6 +122,15 @@ type StoreSyncStatus struct {
 	NewBackends []string `json:"new_backends,omitempty"`
 	// Status show final info about sync. May be 'need sync', 'ok'
 	Status string `json:"status"`
+	// SyncPause info about paused periodic synchronization
+	SyncPause *StoreSyncPause `json:"sync_pause,omitempty"`
+}
+
+// StoreSyncPause info about paused periodic synchronization with ext-store
+type StoreSyncPause struct {
+	Paused bool `json:"paused"`
+	// Until is the time when synchronization will be resumed automatically
+	Until *time.Time `json:"until,omitempty"`
 }
 
 func (sync *StoreSyncStatus) CheckStatus() string {
@@ -55,15 +146,214 @@ func (sync *StoreSyncStatus) CheckStatus() string {
 	}
 }
 
+// StoreOptions configure Store behavior.
+type StoreOptions struct {
+	// URLs of the primary store. All urls must have identical schemes and paths.
+	URLs []string
+	// Overlays are additional stores layered on top of the primary one in
+	// increasing order of precedence. Each entry follows the same rules as URLs.
+	Overlays    [][]string
+	ServicePath string
+	BackendPath string
+	SyncTime    int64
+	UseTLS      bool
+	// CanonicalIDs derives service and backend IDs from host and port
+	// instead of store keys.
+	CanonicalIDs bool
+	// SyncTimeout bounds a single synchronization, 60s by default.
+	SyncTimeout time.Duration
+	// AgeKeyFile is a file with age identities decrypting encrypted store values.
+	AgeKeyFile string
+	// Proxy is a proxy URL of requests to HTTP based stores, "direct" or empty for proxies of the environment.
+	Proxy string
+	// Primary is a URL of the primary GORB whose services and backend pools
+	// are mirrored instead of reading store URLs.
+	Primary string
+}
+
+// StoreSyncResult info about applied synchronization with ext-store
+type StoreSyncResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Duration of synchronization in seconds
+	Duration float64 `json:"duration"`
+	// Created number of created services and backends
+	Created int `json:"created"`
+	// Updated number of recreated services and backends
+	Updated int `json:"updated"`
+	// Removed number of removed services and backends
+	Removed int `json:"removed"`
+	// Unchanged number of services not compared since their store revision is the same
+	Unchanged int `json:"unchanged"`
+	// Errors list of objects failed to sync
+	Errors []StoreSyncError `json:"errors,omitempty"`
+	// Skipped list of objects skipped due to invalid store content
+	Skipped []StoreSyncError `json:"skipped,omitempty"`
+}
+
+// StoreSyncError error of a single object during synchronization
+type StoreSyncError struct {
+	Object string `json:"object"`
+	Error  string `json:"error"`
+
+	err error
+}
+
+func newStoreSyncResult() *StoreSyncResult {
+	return &StoreSyncResult{Timestamp: time.Now()}
+}
+
+func (r *StoreSyncResult) addError(object string, err error) error {
+	log.Errorf("error while syncing %s with store: %s", object, err)
+	r.Errors = append(r.Errors, StoreSyncError{Object: object, Error: err.Error(), err: err})
+	return err
+}
+
+func (r *StoreSyncResult) addSkipped(object string, err error) {
+	log.Warnf("skipping %s due to invalid store content: %s", object, err)
+	r.Skipped = append(r.Skipped, StoreSyncError{Object: object, Error: err.Error(), err: err})
+}
+
+// Err returns SyncError if some objects failed to sync
+func (r *StoreSyncResult) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return &SyncError{Errors: r.Errors}
+}
+
+func (r *StoreSyncResult) finish() {
+	r.Duration = time.Since(r.Timestamp).Seconds()
+}
+
 type Store struct {
-	ctx              *Context
+	ctx          *Context
+	layers       []*storeLayer
+	primary      *primarySource
+	stopCh       chan struct{}
+	canonicalIDs bool
+	syncTimeout  time.Duration
+	// syncMutex is held while synchronization runs, including one which has timed out
+	syncMutex sync.Mutex
+
+	lastSyncMutex sync.RWMutex
+	lastSync      *StoreSyncResult
+
+	pauseMutex  sync.Mutex
+	paused      bool
+	pausedUntil time.Time
+}
+
+// storeLayer is a single kvstore with services that could be merged
+// on top of the services from the previous layers.
+type storeLayer struct {
 	kvstore          store.Store
+	backend          store.Backend
 	storeServicePath string
 	storeBackendPath string
-	stopCh           chan struct{}
+	// identities decrypt store values encrypted with age or SOPS
+	identities []age.Identity
+
+	// mutex serializes reads of the layer, so entries are reused by one of them
+	mutex sync.Mutex
+	// entries are parsed values of the previous read keyed by store keys
+	entries map[string]*storeEntry
 }
 
-func NewStore(storeURLs []string, storeServicePath, storeBackendPath string, syncTime int64, useTLS bool, context *Context) (*Store, error) {
+// storeEntry is a parsed store value reused while the value is unchanged.
+// Services are decoded from the parsed document on every read, since their
+// options are modified during synchronization.
+type storeEntry struct {
+	index    uint64
+	value    []byte
+	node     yaml.Node
+	revision uint64
+}
+
+func (e *storeEntry) matches(kvpair *store.KVPair) bool {
+	if e.index != 0 && kvpair.LastIndex != 0 {
+		return e.index == kvpair.LastIndex
+	}
+	return bytes.Equal(e.value, kvpair.Value)
+}
+
+func NewStore(options StoreOptions, context *Context) (*Store, error) {
+	store, err := newStore(options, context)
+	if err != nil {
+		return nil, err
+	}
+
+	context.SetStore(store)
+
+	// startup is over once the store has been synchronized
+	context.startup.wait()
+	store.Sync()
+	if options.SyncTime > 0 {
+		storeTimer := time.NewTicker(time.Duration(options.SyncTime) * time.Second)
+		go func() {
+			for {
+				select {
+				case <-storeTimer.C:
+					if store.SyncPaused() {
+						log.Info("periodic store sync is paused. skipping")
+						continue
+					}
+					store.Sync()
+				case <-store.stopCh:
+					storeTimer.Stop()
+					return
+				}
+			}
+		}()
+	}
+	return store, nil
+}
+
+// newStore connects to store layers without synchronizing the context.
+func newStore(options StoreOptions, context *Context) (*Store, error) {
+	layerURLs := append([][]string{options.URLs}, options.Overlays...)
+
+	store := &Store{
+		ctx:          context,
+		stopCh:       make(chan struct{}),
+		canonicalIDs: options.CanonicalIDs,
+		syncTimeout:  options.SyncTimeout,
+	}
+	if store.syncTimeout <= 0 {
+		store.syncTimeout = defaultSyncTimeout
+	}
+	if options.Primary != "" {
+		options.SyncTimeout = store.syncTimeout
+		primary, err := newPrimarySource(options.Primary, options)
+		if err != nil {
+			return nil, err
+		}
+		store.primary = primary
+		return store, nil
+	}
+
+	var identities []age.Identity
+	if options.AgeKeyFile != "" {
+		var err error
+		if identities, err = loadAgeIdentities(options.AgeKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, urls := range layerURLs {
+		layer, err := newStoreLayer(urls, options.ServicePath, options.BackendPath, options.UseTLS)
+		if err != nil {
+			return nil, err
+		}
+		layer.identities = identities
+		if err := setStoreProxy(layer.backend, options.UseTLS, options.Proxy); err != nil {
+			return nil, err
+		}
+		store.layers = append(store.layers, layer)
+	}
+	return store, nil
+}
+
+func newStoreLayer(storeURLs []string, storeServicePath, storeBackendPath string, useTLS bool) (*storeLayer, error) {
 	var scheme string
 	var storePath string
 	var hosts []string
@@ -116,34 +406,12 @@ func NewStore(storeURLs []string, storeServicePath, storeBackendPath string, syn
 		}
 	}
 
-	store := &Store{
-		ctx:              context,
+	return &storeLayer{
 		kvstore:          kvstore,
+		backend:          storeBackend,
 		storeServicePath: path.Join(storePath, storeServicePath),
 		storeBackendPath: path.Join(storePath, storeBackendPath),
-		stopCh:           make(chan struct{}),
-	}
-
-	context.SetStore(store)
-
-	store.Sync()
-	if syncTime > 0 {
-		storeTimer := time.NewTicker(time.Duration(syncTime) * time.Second)
-		go func() {
-			for {
-				select {
-				case <-storeTimer.C:
-					store.Sync()
-				case <-time.After(60 * time.Second):
-					log.Error("Timeout 60s was reached for store.Sync()")
-				case <-store.stopCh:
-					storeTimer.Stop()
-					return
-				}
-			}
-		}()
-	}
-	return store, nil
+	}, nil
 }
 
 func createLocalStore(storePath string, storeServicePath string, storeBackendPath string) (store.Store, error) {
@@ -186,13 +454,7 @@ func createExtStore(backend store.Backend, hosts []string, useTLS bool) (store.S
 }
 
 func (s *Store) Sync() {
-	services, err := s.getStoreServices()
-	if err != nil {
-		log.Errorf("error while get data from ext-store: %s", err)
-		return
-	}
-	// synchronize context
-	s.ctx.Synchronize(services)
+	s.StartSyncWithStore()
 }
 
 func (s *Store) StoreSyncStatus() (*StoreSyncStatus, error) {
@@ -201,59 +463,352 @@ func (s *Store) StoreSyncStatus() (*StoreSyncStatus, error) {
 	if err != nil {
 		return nil, err
 	}
-	return s.ctx.CompareWith(services), nil
+	syncStatus := s.ctx.CompareWith(services)
+	if s.SyncPaused() {
+		syncStatus.SyncPause = s.SyncPauseStatus()
+	}
+	return syncStatus, nil
 }
 
-// StartSyncWithStore synchronize gorb with store
+// PauseSync stops periodic synchronization with store for the duration.
+// Zero duration pauses synchronization until ResumeSync is called.
+func (s *Store) PauseSync(duration time.Duration) *StoreSyncPause {
+	s.pauseMutex.Lock()
+	s.paused = true
+	if duration > 0 {
+		s.pausedUntil = time.Now().Add(duration)
+		log.Warnf("periodic store sync has been paused until %s", s.pausedUntil)
+	} else {
+		s.pausedUntil = time.Time{}
+		log.Warn("periodic store sync has been paused until resume")
+	}
+	s.pauseMutex.Unlock()
+	return s.SyncPauseStatus()
+}
+
+// ResumeSync resumes periodic synchronization with store.
+func (s *Store) ResumeSync() *StoreSyncPause {
+	s.pauseMutex.Lock()
+	if s.paused {
+		log.Info("periodic store sync has been resumed")
+	}
+	s.paused = false
+	s.pausedUntil = time.Time{}
+	s.pauseMutex.Unlock()
+	return s.SyncPauseStatus()
+}
+
+// SyncPaused checks if periodic synchronization is paused. Expired pause is resumed.
+func (s *Store) SyncPaused() bool {
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	if s.paused && !s.pausedUntil.IsZero() && time.Now().After(s.pausedUntil) {
+		log.Info("store sync pause has expired. resuming periodic sync")
+		s.paused = false
+		s.pausedUntil = time.Time{}
+	}
+	return s.paused
+}
+
+// SyncPauseStatus returns info about paused periodic synchronization.
+func (s *Store) SyncPauseStatus() *StoreSyncPause {
+	paused := s.SyncPaused()
+	s.pauseMutex.Lock()
+	defer s.pauseMutex.Unlock()
+	status := &StoreSyncPause{Paused: paused}
+	if paused && !s.pausedUntil.IsZero() {
+		until := s.pausedUntil
+		status.Until = &until
+	}
+	return status
+}
+
+// StartSyncWithStore synchronize gorb with store. The synchronization is given
+// up after the sync timeout, it's skipped if the previous one is still running.
 func (s *Store) StartSyncWithStore() error {
+	if !s.syncMutex.TryLock() {
+		log.Warn("previous store sync is still running. skipping")
+		return ErrSyncInProgress
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), s.syncTimeout)
+	defer cancel()
+
+	// store reads can't be interrupted, so the sync may outlive its deadline
+	// and keeps the mutex until it's over
+	done := make(chan error, 1)
+	go func() {
+		defer s.syncMutex.Unlock()
+		done <- s.syncWithStore(deadline)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-deadline.Done():
+		log.Errorf("store sync hasn't finished within %s", s.syncTimeout)
+		return ErrSyncTimeout
+	}
+}
+
+func (s *Store) syncWithStore(deadline context.Context) error {
+	syncCtx, span := tracing.Tracer().Start(deadline, "store.sync")
+	defer span.End()
+
 	// build external services map
-	services, err := s.getStoreServices()
+	_, readSpan := tracing.Tracer().Start(syncCtx, "store.read")
+	services, pools, err := s.getStoreContent()
+	if err == nil && deadline.Err() != nil {
+		// content read too late is outdated already
+		err = fmt.Errorf("%w: store read took longer than %s", ErrSyncTimeout, s.syncTimeout)
+	}
+	endSpan(readSpan, err)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		log.Errorf("error while get data from ext-store: %s", err)
+		result := newStoreSyncResult()
+		result.addError("store", err)
+		result.finish()
+		s.setLastSync(result)
 		return err
 	}
 
 	// synchronize context
-	if err = s.ctx.Synchronize(services); err != nil {
-		return err
+	if s.primary != nil {
+		s.ctx.mirrorBackendPools(pools)
+	}
+	result, err := s.ctx.synchronize(syncCtx, services)
+	if s.primary != nil {
+		s.ctx.removeMirroredBackendPools(pools)
 	}
-	return nil
+	s.setLastSync(result)
+	span.SetAttributes(attribute.Int("gorb.sync.created", result.Created),
+		attribute.Int("gorb.sync.updated", result.Updated), attribute.Int("gorb.sync.removed", result.Removed))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (s *Store) setLastSync(result *StoreSyncResult) {
+	s.lastSyncMutex.Lock()
+	defer s.lastSyncMutex.Unlock()
+	s.lastSync = result
+}
+
+// Problems returns objects skipped or failed during the last synchronization with store.
+func (s *Store) Problems() []StoreSyncError {
+	s.lastSyncMutex.RLock()
+	defer s.lastSyncMutex.RUnlock()
+	problems := []StoreSyncError{}
+	if s.lastSync != nil {
+		problems = append(problems, s.lastSync.Skipped...)
+		problems = append(problems, s.lastSync.Errors...)
+	}
+	return problems
+}
+
+// LastSync returns result of the last synchronization with store.
+func (s *Store) LastSync() (*StoreSyncResult, error) {
+	s.lastSyncMutex.RLock()
+	defer s.lastSyncMutex.RUnlock()
+	if s.lastSync == nil {
+		return nil, ErrObjectNotFound
+	}
+	return s.lastSync, nil
 }
 
 func (s *Store) getStoreServices() (map[string]*ServiceConfig, error) {
+	services, _, err := s.getStoreContent()
+	return services, err
+}
+
+// getStoreContent returns services of the store together with backend pools
+// of the primary GORB, pools are nil for store layers.
+func (s *Store) getStoreContent() (map[string]*ServiceConfig, map[string]*BackendPoolConfig, error) {
+	if s.primary != nil {
+		services, pools, err := s.primary.read()
+		if err != nil {
+			return nil, nil, err
+		}
+		validateServiceConfigs(services, s.ctx.endpoint, s.ctx.backendNetworks)
+		return services, pools, nil
+	}
+
+	// layers are read concurrently and merged in increasing order of precedence
+	layerServices := make([]map[string]*ServiceConfig, len(s.layers))
+	errs := make([]error, len(s.layers))
+	var wg sync.WaitGroup
+	for i, layer := range s.layers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			layerServices[i], errs[i] = layer.getServices()
+		}()
+	}
+	wg.Wait()
+
+	services := make(map[string]*ServiceConfig)
+	for i := range s.layers {
+		if errs[i] != nil {
+			return nil, nil, errs[i]
+		}
+		mergeServiceConfigs(services, layerServices[i])
+	}
+	validateServiceConfigs(services, s.ctx.endpoint, s.ctx.backendNetworks)
+	if s.canonicalIDs {
+		services = canonicalServiceIDs(services)
+	}
+	return services, nil, nil
+}
+
+// validateServiceConfigs drops services without options and marks invalid ones.
+func validateServiceConfigs(services map[string]*ServiceConfig, defaultHost net.IP, networks backendNetworks) {
+	expandServiceGroups(services)
+	for id, options := range services {
+		if options == nil || options.err == nil && options.ServiceOptions == nil {
+			log.Debugf("service [%s] has no service options. skipping", id)
+			delete(services, id)
+			continue
+		}
+		options.validate(defaultHost, networks)
+	}
+}
+
+// Plan creates a plan of synchronization with store which could be reviewed and applied later.
+func (s *Store) Plan() (*Plan, error) {
+	services, err := s.getStoreServices()
+	if err != nil {
+		return nil, err
+	}
+	return s.ctx.createPlan(PlanSourceStore, services), nil
+}
+
+func (l *storeLayer) getServices() (map[string]*ServiceConfig, error) {
 	services := make(map[string]*ServiceConfig)
 	// build external service map (temporary all services)
-	kvlist, err := s.kvstore.List(s.storeServicePath)
+	kvlist, err := l.kvstore.List(l.storeServicePath)
 	if err != nil {
 		if err == store.ErrKeyNotFound {
 			return services, nil
 		}
 		return nil, err
 	}
-	for _, kvpair := range kvlist {
-		if kvpair.Value == nil {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// values are parsed by a bounded pool of workers, unchanged ones are reused
+	entries := make([]*storeEntry, len(kvlist))
+	configs := make([]*ServiceConfig, len(kvlist))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(storeReadWorkers, len(kvlist)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				entries[i], configs[i] = l.decodeService(kvlist[i])
+			}
+		}()
+	}
+	for i, kvpair := range kvlist {
+		if kvpair.Value != nil {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// entries of removed keys are dropped
+	l.entries = make(map[string]*storeEntry, len(kvlist))
+	for i, kvpair := range kvlist {
+		if configs[i] == nil {
 			continue
 		}
-		id := s.getID(kvpair.Key)
-		var options ServiceConfig
-		if err := yaml.Unmarshal(kvpair.Value, &options); err != nil {
-			return nil, err
+		services[getID(kvpair.Key)] = configs[i]
+		if entries[i] != nil {
+			l.entries[kvpair.Key] = entries[i]
+		}
+	}
+	return normalizeServiceIDs(services), nil
+}
+
+// decodeService decodes the service from the store value, which is parsed
+// unless it's unchanged since the previous read. Layer mutex must be held.
+func (l *storeLayer) decodeService(kvpair *store.KVPair) (*storeEntry, *ServiceConfig) {
+	id := getID(kvpair.Key)
+	entry, exists := l.entries[kvpair.Key]
+	if !exists || !entry.matches(kvpair) {
+		entry = &storeEntry{index: kvpair.LastIndex, value: kvpair.Value, revision: storeRevision(kvpair)}
+		value, err := decryptStoreValue(kvpair.Value, l.identities)
+		if err != nil {
+			log.Errorf("unable to decrypt service [%s] from %s: %s", id, kvpair.Key, err)
+			return nil, &ServiceConfig{err: err}
+		}
+		if err := yaml.Unmarshal(value, &entry.node); err != nil {
+			log.Errorf("unable to parse service [%s] from %s: %s", id, kvpair.Key, err)
+			return nil, &ServiceConfig{err: err}
 		}
-		if options.ServiceOptions == nil {
+		// decrypted documents are kept in memory only
+		if err := decryptSopsDocument(&entry.node, l.identities); err != nil {
+			log.Errorf("unable to decrypt service [%s] from %s: %s", id, kvpair.Key, err)
+			return nil, &ServiceConfig{err: err}
+		}
+		// parsed documents are migrated once and reused in the current layout
+		if err := migrateServiceConfig(&entry.node); err != nil {
+			log.Errorf("unable to migrate service [%s] from %s: %s", id, kvpair.Key, err)
+			return nil, &ServiceConfig{err: err}
+		}
+	}
+	options := ServiceConfig{revision: entry.revision}
+	if entry.node.Kind == 0 {
+		// empty value
+		return entry, &options
+	}
+	if err := entry.node.Decode(&options); err != nil {
+		log.Errorf("unable to parse service [%s] from %s: %s", id, kvpair.Key, err)
+		return entry, &ServiceConfig{err: err}
+	}
+	return entry, &options
+}
+
+// mergeServiceConfigs layers overlay services on top of base. Service options
+// from the overlay replace the base ones, backends are merged by rsID.
+func mergeServiceConfigs(base, overlay map[string]*ServiceConfig) {
+	for id, overlayService := range overlay {
+		baseService, ok := base[id]
+		if !ok {
+			base[id] = overlayService
 			continue
-		} else {
-			options.ServiceOptions.Validate(nil)
 		}
-		services[id] = &options
+		baseService.revision = combineRevisions(baseService.revision, overlayService.revision)
+		if overlayService.err != nil {
+			baseService.err = overlayService.err
+		}
+		if overlayService.ServiceOptions != nil {
+			baseService.ServiceOptions = overlayService.ServiceOptions
+		}
+		if baseService.ServiceBackends == nil {
+			baseService.ServiceBackends = make(map[string]*BackendOptions)
+		}
+		for rsID, backend := range overlayService.ServiceBackends {
+			baseService.ServiceBackends[rsID] = backend
+			delete(baseService.invalidBackends, rsID)
+		}
+		for rsID, err := range overlayService.invalidBackends {
+			if baseService.invalidBackends == nil {
+				baseService.invalidBackends = make(map[string]error)
+			}
+			baseService.invalidBackends[rsID] = err
+			delete(baseService.ServiceBackends, rsID)
+		}
 	}
-	return services, nil
 }
 
 func (s *Store) Close() {
 	close(s.stopCh)
 }
 
-func (s *Store) getID(key string) string {
+func getID(key string) string {
 	index := strings.LastIndex(key, "/")
 	if index <= 0 {
 		return key
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Possible store decryption errors.
+var (
+	ErrStoreKeyMissing   = errors.New("store value is encrypted, but no age key is configured")
+	ErrStoreDecryption   = errors.New("unable to decrypt store value")
+	ErrEncryptedDocument = errors.New("SOPS encrypted documents must be changed with sops")
+)
+
+// ageHeader starts binary age files, armored ones start with armor.Header.
+const ageHeader = "age-encryption.org/"
+
+// sopsValuePattern matches values encrypted by SOPS with the data key.
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMACInitialization is mixed into MACs covering encrypted values only.
+var sopsMACInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1,
+	0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// sopsMetadata is the part of SOPS metadata required to decrypt documents with age.
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified     string `yaml:"lastmodified"`
+	MAC              string `yaml:"mac"`
+	MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+}
+
+// loadAgeIdentities reads age identities, e.g. a file written by age-keygen.
+func loadAgeIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age key %s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// isAgeEncrypted checks if the whole value is an armored or binary age file.
+func isAgeEncrypted(value []byte) bool {
+	value = bytes.TrimLeft(value, " \t\r\n")
+	return bytes.HasPrefix(value, []byte(armor.Header)) || bytes.HasPrefix(value, []byte(ageHeader))
+}
+
+// ageDecrypt decrypts the armored or binary age file.
+func ageDecrypt(value []byte, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, ErrStoreKeyMissing
+	}
+	var src io.Reader = bytes.NewReader(value)
+	if trimmed := bytes.TrimLeft(value, " \t\r\n"); bytes.HasPrefix(trimmed, []byte(armor.Header)) {
+		src = armor.NewReader(bytes.NewReader(trimmed))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+	}
+	return plaintext, nil
+}
+
+// decryptStoreValue returns the plaintext of store values encrypted with age as a whole,
+// other values are returned as is.
+func decryptStoreValue(value []byte, identities []age.Identity) ([]byte, error) {
+	if !isAgeEncrypted(value) {
+		return value, nil
+	}
+	return ageDecrypt(value, identities)
+}
+
+// sopsDocument returns the mapping of the document and its SOPS metadata node,
+// the node is nil if the document isn't encrypted by SOPS.
+func sopsDocument(doc *yaml.Node) (*yaml.Node, *yaml.Node) {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return node, nil
+	}
+	return node, mappingValue(node, "sops")
+}
+
+// decryptSopsDocument decrypts values of the document encrypted by SOPS with an age
+// recipient in place and verifies its MAC, so values couldn't be changed or removed
+// unnoticed. The metadata is removed. Other documents are left intact.
+func decryptSopsDocument(doc *yaml.Node, identities []age.Identity) error {
+	node, metadataNode := sopsDocument(doc)
+	if metadataNode == nil {
+		return nil
+	}
+	var metadata sopsMetadata
+	if err := metadataNode.Decode(&metadata); err != nil {
+		return fmt.Errorf("%w: invalid SOPS metadata: %w", ErrStoreDecryption, err)
+	}
+	if len(identities) == 0 {
+		return ErrStoreKeyMissing
+	}
+
+	var dataKey []byte
+	for _, recipient := range metadata.Age {
+		if key, err := ageDecrypt([]byte(recipient.Enc), identities); err == nil {
+			dataKey = key
+			break
+		}
+	}
+	if dataKey == nil {
+		return fmt.Errorf("%w: none of age keys matches SOPS recipients", ErrStoreDecryption)
+	}
+
+	hash := sha512.New()
+	if metadata.MACOnlyEncrypted {
+		hash.Write(sopsMACInitialization)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "sops" {
+			continue
+		}
+		if err := decryptSopsNode(node.Content[i+1], []string{node.Content[i].Value}, dataKey, &metadata,
+			func(value []byte) { hash.Write(value) }); err != nil {
+			return err
+		}
+	}
+
+	mac, _, err := sopsDecrypt(metadata.MAC, dataKey, metadata.LastModified)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(string(mac), fmt.Sprintf("%X", hash.Sum(nil))) {
+		return fmt.Errorf("%w: MAC mismatch", ErrStoreDecryption)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "sops" {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// decryptSopsNode walks values the way SOPS does: keys of mappings make up the path
+// authenticating encrypted values, while items of sequences share the path of their
+// sequence. Plaintext of values covered by the MAC is passed to mac in document order.
+func decryptSopsNode(node *yaml.Node, path []string, dataKey []byte, metadata *sopsMetadata,
+	mac func([]byte)) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := decryptSopsNode(node.Content[i+1], append(path, node.Content[i].Value), dataKey, metadata,
+				mac); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := decryptSopsNode(item, path, dataKey, metadata, mac); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !sopsValuePattern.MatchString(node.Value) {
+			if metadata.MACOnlyEncrypted {
+				return nil
+			}
+			var value interface{}
+			if err := node.Decode(&value); err != nil {
+				return err
+			}
+			if value != nil {
+				mac([]byte(sopsPlaintext(value)))
+			}
+			return nil
+		}
+		plaintext, tag, err := sopsDecrypt(node.Value, dataKey, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		mac(plaintext)
+		node.Value, node.Tag, node.Style = string(plaintext), tag, 0
+	}
+	return nil
+}
+
+// sopsPlaintext formats plaintext values the way SOPS does for MACs.
+func sopsPlaintext(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// sopsDecrypt decrypts the SOPS value with AES-GCM and returns its plaintext with
+// a YAML tag of its type.
+func sopsDecrypt(value string, dataKey []byte, additionalData string) ([]byte, string, error) {
+	matches := sopsValuePattern.FindStringSubmatch(value)
+	if matches == nil {
+		return nil, "", fmt.Errorf("%w: invalid SOPS value", ErrStoreDecryption)
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(matches[1+i]); err != nil {
+			return nil, "", fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrStoreDecryption, err)
+	}
+
+	switch matches[4] {
+	case "str", "bytes":
+		return plaintext, "!!str", nil
+	case "int":
+		return plaintext, "!!int", nil
+	case "float":
+		return plaintext, "!!float", nil
+	case "bool":
+		return plaintext, "!!bool", nil
+	default:
+		return nil, "", fmt.Errorf("%w: unknown SOPS value type %s", ErrStoreDecryption, matches[4])
+	}
+}
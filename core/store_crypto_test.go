@@ -0,0 +1,143 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/docker/libkv"
+	"github.com/docker/libkv/store"
+	"github.com/qk4l/gorb/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsService is encrypted by sops 3.9.4 with encrypted_regex of Authorization.
+const sopsService = `service_options:
+    host: 127.0.0.1
+    port: 80
+    pulse:
+        type: http
+        args:
+            path: /health
+            headers:
+                Authorization: ENC[AES256_GCM,data:q0A1VjmfA2qqoTSdSQ==,iv:6nay+zhN5CIRCHoSxpivLxjcN1c2xzvJWzZxlm+eI/g=,tag:YYvXmt9vkTDCpzEs7uBsiQ==,type:str]
+service_backends:
+    rs1:
+        host: 127.0.0.1
+        port: 8080
+sops:
+    kms: []
+    gcp_kms: []
+    azure_kv: []
+    hc_vault: []
+    age:
+        - recipient: age1hplv5hcfnn70gtn07aar34ect7vf05lpaek5dwj687r9tqraue9s946rxg
+          enc: |
+            -----BEGIN AGE ENCRYPTED FILE-----
+            YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSAxcSsvMmc1M25QaDJuQ0FM
+            V1FBZlo5Z2k0VVNPVWlzZU9kWGRtcTFjS0dRCnJwMkVTWWFjRm9DQktxanJCZ2tL
+            blRySk1FbGprY2lzTWRoNTlPVzlMTWsKLS0tIGpSaHRXMXNSTzkybDZ5UnpRc3Bj
+            YXkvZ25KZmdrVkhQZGx0NXZkSkgrWnMKJAIDExsdbEFWb666MkM2ruBZfbVOE5Cy
+            4dqJde+wamy7q7K+RyrWjFLgT/Krul0E98NJUFEkBtfUHEfUX0Pzpw==
+            -----END AGE ENCRYPTED FILE-----
+    lastmodified: "2026-10-17T01:16:47Z"
+    mac: ENC[AES256_GCM,data:cMbZKlo+8MR+71ZzgP0lgSItztDp1iyV09tIKia7yWJRy0lZZBCIHyeIUxv4WQtAlrP9HGCH6ZVFTjcQT1EBaOrJBIiFf3SvBRR2QfMRKjocZlUOsWK8U6Hm06XohPBDSg5U7hTarT0+O/SbdtgZywAHPw/nMSlTRQ0Ip/CiO/A=,iv:Nd4yVRNjAImZrwrjtx0sG1OLkCqsfHUwgVpT8ktXpqY=,tag:lJhKYn23Zdr9nx/JMDIKTg==,type:str]
+    pgp: []
+    encrypted_regex: ^(Authorization)$
+    version: 3.9.4
+`
+
+const sopsAgeKey = "AGE-SECRET-KEY-1RQSF4L4K65ZMAW9HE4MN2HP4844QNS0NZA9498D3YYVVR8RF4MSQ653TG9"
+
+func parseSopsService(t *testing.T, value string) *yaml.Node {
+	var doc yaml.Node
+	require.NoError(t, yaml.Unmarshal([]byte(value), &doc))
+	return &doc
+}
+
+func TestDecryptSopsDocument(t *testing.T) {
+	identities, err := age.ParseIdentities(strings.NewReader(sopsAgeKey))
+	require.NoError(t, err)
+
+	doc := parseSopsService(t, sopsService)
+	require.NoError(t, decryptSopsDocument(doc, identities))
+	var config ServiceConfig
+	require.NoError(t, doc.Decode(&config))
+	assert.Equal(t, uint16(80), config.ServiceOptions.Port)
+	assert.Equal(t, util.DynamicMap{"Authorization": "Bearer s3cret"}, config.ServiceOptions.Pulse.Args["headers"])
+	_, metadata := sopsDocument(doc)
+	assert.Nil(t, metadata)
+
+	// plaintext values are covered by the MAC too
+	doc = parseSopsService(t, strings.Replace(sopsService, "port: 8080", "port: 8081", 1))
+	assert.ErrorIs(t, decryptSopsDocument(doc, identities), ErrStoreDecryption)
+
+	doc = parseSopsService(t, sopsService)
+	assert.ErrorIs(t, decryptSopsDocument(doc, nil), ErrStoreKeyMissing)
+
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	doc = parseSopsService(t, sopsService)
+	assert.ErrorIs(t, decryptSopsDocument(doc, []age.Identity{other}), ErrStoreDecryption)
+
+	_, err = MigrateServiceDocument([]byte(sopsService))
+	assert.ErrorIs(t, err, ErrEncryptedDocument)
+}
+
+func TestDecryptStoreValue(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	var b bytes.Buffer
+	a := armor.NewWriter(&b)
+	w, err := age.Encrypt(a, identity.Recipient())
+	require.NoError(t, err)
+	w.Write([]byte("service_options:\n  port: 80\n"))
+	require.NoError(t, w.Close())
+	require.NoError(t, a.Close())
+
+	value, err := decryptStoreValue(b.Bytes(), []age.Identity{identity})
+	require.NoError(t, err)
+	assert.Equal(t, "service_options:\n  port: 80\n", string(value))
+
+	_, err = decryptStoreValue(b.Bytes(), nil)
+	assert.ErrorIs(t, err, ErrStoreKeyMissing)
+
+	plain := []byte("service_options:\n  port: 80\n")
+	value, err = decryptStoreValue(plain, nil)
+	require.NoError(t, err)
+	assert.Equal(t, plain, value)
+
+	keyFile := filepath.Join(t.TempDir(), "key.txt")
+	require.NoError(t, os.WriteFile(keyFile, []byte("# created: today\n"+identity.String()+"\n"), 0o600))
+	identities, err := loadAgeIdentities(keyFile)
+	require.NoError(t, err)
+	assert.Len(t, identities, 1)
+}
+
+func TestEncryptedStoreServices(t *testing.T) {
+	identities, err := age.ParseIdentities(strings.NewReader(sopsAgeKey))
+	require.NoError(t, err)
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	m.On("List", "/services").Return([]*store.KVPair{
+		{Key: "/services/web", Value: []byte(sopsService)},
+	}, nil)
+
+	layer, err := newStoreLayer([]string{"mock://127.0.0.1:2000/"}, "services", "backends", false)
+	require.NoError(t, err)
+	services, err := layer.getServices()
+	require.NoError(t, err)
+	assert.ErrorIs(t, services["web"].err, ErrStoreKeyMissing)
+
+	layer.identities = identities
+	services, err = layer.getServices()
+	require.NoError(t, err)
+	require.NoError(t, services["web"].err)
+	assert.Equal(t, "Bearer s3cret", services["web"].ServiceOptions.Pulse.Args["headers"].(util.DynamicMap)["Authorization"])
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+
+	etcdclient "github.com/coreos/etcd/client"
+	"github.com/docker/libkv/store"
+	"github.com/qk4l/gorb/util"
+)
+
+// ErrStoreProxyUnsupported is returned if a proxy is set for a store driver unable to use it.
+var ErrStoreProxyUnsupported = errors.New("proxies aren't supported by etcd store over TLS")
+
+// setStoreProxy routes requests of HTTP based store drivers via the proxy, proxies
+// of the environment are used if it's empty. libkv drivers don't take transports,
+// so the ones they share are configured: Consul driver sends requests with
+// http.DefaultClient and etcd driver without TLS with the etcd client default transport.
+func setStoreProxy(backend store.Backend, useTLS bool, proxy string) error {
+	proxyFunc, err := util.ProxyFunc(proxy)
+	if err != nil {
+		return err
+	}
+	switch backend {
+	case store.CONSUL:
+		// the driver replaces the transport of the default client to set up TLS
+		transport, ok := http.DefaultClient.Transport.(*http.Transport)
+		if !ok {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+			http.DefaultClient.Transport = transport
+		}
+		transport.Proxy = proxyFunc
+	case store.ETCD:
+		if useTLS {
+			if proxy != "" {
+				return ErrStoreProxyUnsupported
+			}
+			return nil
+		}
+		if transport, ok := etcdclient.DefaultTransport.(*http.Transport); ok {
+			transport.Proxy = proxyFunc
+		}
+	}
+	return nil
+}
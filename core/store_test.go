@@ -1,12 +1,16 @@
 package core
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	libkvmock "github.com/docker/libkv/store/mock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type storeMock struct {
@@ -28,7 +32,7 @@ func TestMultipleURLs(t *testing.T) {
 	m.On("List", "/").Return([]*store.KVPair{}, nil)
 
 	storeURLs := []string{"mock://127.0.0.1:2000", "mock://127.0.0.2:2001", "mock://127.0.0.3:2002"}
-	store, err := NewStore(storeURLs, "/", "/", 60, false, &Context{})
+	store, err := NewStore(StoreOptions{URLs: storeURLs, ServicePath: "/", BackendPath: "/", SyncTime: 60}, &Context{})
 
 	assert.NoError(err)
 	assert.Equal([]string{"127.0.0.1:2000", "127.0.0.2:2001", "127.0.0.3:2002"}, m.Endpoints)
@@ -43,7 +47,7 @@ func TestErrorIfSchemeMismatch(t *testing.T) {
 	m.On("List", "/").Return([]*store.KVPair{}, nil)
 
 	storeURLs := []string{"mock://127.0.0.1:2000", "mismatch://127.0.0.2:2001", "mock://127.0.0.3:2002"}
-	_, err := NewStore(storeURLs, "/", "/", 60, false, &Context{})
+	_, err := NewStore(StoreOptions{URLs: storeURLs, ServicePath: "/", BackendPath: "/", SyncTime: 60}, &Context{})
 
 	assert.Error(err)
 }
@@ -55,7 +59,263 @@ func TestErrorIfPathMismatch(t *testing.T) {
 	m.On("List", "/").Return([]*store.KVPair{}, nil)
 
 	storeURLs := []string{"mock://127.0.0.1:2000", "mock://127.0.0.2:2001/mismatched/path/", "mock://127.0.0.3:2002"}
-	_, err := NewStore(storeURLs, "/", "/", 60, false, &Context{})
+	_, err := NewStore(StoreOptions{URLs: storeURLs, ServicePath: "/", BackendPath: "/", SyncTime: 60}, &Context{})
 
 	assert.Error(err)
 }
+
+func TestMergeServiceConfigsOverlayPrecedence(t *testing.T) {
+	assert := assert.New(t)
+	base := map[string]*ServiceConfig{
+		"web": {
+			ServiceOptions: &ServiceOptions{Port: 80, Host: "10.0.0.1", LbMethod: "wrr"},
+			ServiceBackends: map[string]*BackendOptions{
+				"rs1": {Host: "10.1.0.1", Port: 80},
+				"rs2": {Host: "10.1.0.2", Port: 80},
+			},
+		},
+		"db": {ServiceOptions: &ServiceOptions{Port: 5432, Host: "10.0.0.2"}},
+	}
+	overlay := map[string]*ServiceConfig{
+		"web": {
+			ServiceBackends: map[string]*BackendOptions{
+				"rs2": {Host: "10.1.0.22", Port: 8080},
+				"rs3": {Host: "10.1.0.3", Port: 80},
+			},
+		},
+		"db":    {ServiceOptions: &ServiceOptions{Port: 5433, Host: "10.0.0.2"}},
+		"cache": {ServiceOptions: &ServiceOptions{Port: 6379, Host: "10.0.0.3"}},
+	}
+
+	mergeServiceConfigs(base, overlay)
+
+	assert.Len(base, 3)
+	// backend-only overlay keeps base service options
+	assert.Equal("wrr", base["web"].ServiceOptions.LbMethod)
+	assert.Len(base["web"].ServiceBackends, 3)
+	assert.Equal("10.1.0.1", base["web"].ServiceBackends["rs1"].Host)
+	assert.Equal("10.1.0.22", base["web"].ServiceBackends["rs2"].Host)
+	assert.Equal(uint16(8080), base["web"].ServiceBackends["rs2"].Port)
+	// overlay service options replace base ones
+	assert.Equal(uint16(5433), base["db"].ServiceOptions.Port)
+	assert.NotNil(base["db"].ServiceBackends)
+	assert.Equal(uint16(6379), base["cache"].ServiceOptions.Port)
+}
+
+func TestStoreSyncPause(t *testing.T) {
+	assert := assert.New(t)
+	s := &Store{}
+
+	assert.False(s.SyncPaused())
+
+	status := s.PauseSync(0)
+	assert.True(status.Paused)
+	assert.Nil(status.Until)
+	assert.True(s.SyncPaused())
+
+	status = s.ResumeSync()
+	assert.False(status.Paused)
+	assert.False(s.SyncPaused())
+
+	status = s.PauseSync(time.Hour)
+	assert.True(status.Paused)
+	assert.NotNil(status.Until)
+
+	// expired pause is resumed automatically
+	s.pausedUntil = time.Now().Add(-time.Second)
+	assert.False(s.SyncPaused())
+}
+
+func TestInvalidStoreEntriesAreSkipped(t *testing.T) {
+	assert := assert.New(t)
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	m.On("List", "/services").Return([]*store.KVPair{
+		{Key: "/services/broken", Value: []byte("service_options: [")},
+		{Key: "/services/web", Value: []byte("service_options:\n  host: 127.0.0.1\n  port: 80\n" +
+			"service_backends:\n  rs1:\n    host: 127.0.0.1\n    port: 8080\n  rs2:\n    port: 8080\n")},
+	}, nil)
+
+	layer, err := newStoreLayer([]string{"mock://127.0.0.1:2000/"}, "services", "backends", false)
+	assert.NoError(err)
+	s := &Store{ctx: &Context{}, layers: []*storeLayer{layer}}
+
+	services, err := s.getStoreServices()
+	assert.NoError(err)
+	assert.Error(services["broken"].err)
+	assert.NoError(services["web"].err)
+	assert.Contains(services["web"].ServiceBackends, "rs1")
+	assert.Contains(services["web"].invalidBackends, "rs2")
+
+	// existing services with invalid store content are kept as is
+	ctx := &Context{services: map[string]*Service{
+		"broken": {vsID: "broken", options: &ServiceOptions{Host: "127.0.0.1", Port: 81}, backends: map[string]*Backend{}},
+	}}
+	plan := ctx.planSync(services)
+	assert.Len(plan.Skipped, 2)
+	assert.Len(plan.Operations, 1)
+	assert.Equal(SyncActionCreate, plan.Operations[0].Action)
+	assert.Equal("web", plan.Operations[0].VsID)
+}
+
+func TestValidateStore(t *testing.T) {
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	m.On("List", "/services").Return([]*store.KVPair{
+		{Key: "/services/broken", Value: []byte("service_options: [")},
+		{Key: "/services/web", Value: []byte("service_options:\n  port: 80\n" +
+			"service_backends:\n  rs1:\n    host: 127.0.0.1\n    port: 8080\n")},
+		{Key: "/services/www", Value: []byte("service_options:\n  host: 127.0.0.1\n  port: 80\n")},
+	}, nil)
+	m.On("List", "/backends").Return([]*store.KVPair{}, nil)
+	options := StoreOptions{URLs: []string{"mock://127.0.0.1:2000/"}, ServicePath: "services", BackendPath: "backends"}
+
+	validation, err := ValidateStore(options, net.ParseIP("127.0.0.1"), nil)
+	require.NoError(t, err)
+	assert.False(t, validation.Valid())
+	require.Len(t, validation.Plan.Skipped, 1)
+	assert.Equal(t, "[broken]", validation.Plan.Skipped[0].Object)
+	require.Len(t, validation.Plan.Operations, 2)
+	assert.Empty(t, validation.Errors)
+	assert.Equal(t, map[string][]string{"127.0.0.1:80/tcp": {"web", "www"}}, validation.DuplicateServices)
+
+	// services without host are invalid without the default one
+	validation, err = ValidateStore(options, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, validation.Plan.Skipped, 2)
+}
+
+func TestFrozenServicesAreNotSynced(t *testing.T) {
+	ctx := newContext(NewMemoryIpvs(), &fakeDisco{})
+	ctx.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	ctx.eventHistory = 10
+	defer close(ctx.stopCh)
+
+	require.NoError(t, ctx.CreateService("web", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 80}}))
+	require.NoError(t, ctx.CreateService("api", &ServiceConfig{ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 81}}))
+	assert.ErrorIs(t, ctx.FreezeService("missing", Precondition{}), ErrObjectNotFound)
+	require.NoError(t, ctx.FreezeService("web", Precondition{}))
+	info, err := ctx.GetService("web")
+	require.NoError(t, err)
+	assert.True(t, info.Frozen)
+
+	// neither the frozen service is removed nor the one frozen in store is created
+	plan := ctx.planSync(map[string]*ServiceConfig{
+		"new": {ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 82, Frozen: true}},
+	})
+	assert.Equal(t, []string{"new", "web"}, plan.Frozen)
+	require.Len(t, plan.Operations, 1)
+	assert.Equal(t, SyncActionRemove, plan.Operations[0].Action)
+	assert.Equal(t, "api", plan.Operations[0].VsID)
+
+	require.NoError(t, ctx.UnfreezeService("web", Precondition{}))
+	plan = ctx.planSync(map[string]*ServiceConfig{})
+	assert.Empty(t, plan.Frozen)
+	assert.Len(t, plan.Operations, 2)
+
+	events, err := ctx.Events("web")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, EventFrozen, events[1].Type)
+	assert.Equal(t, EventUnfrozen, events[2].Type)
+}
+
+func TestStoreSyncTimeout(t *testing.T) {
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	release := make(chan time.Time)
+	m.On("List", "/services").Return([]*store.KVPair{}, nil).WaitUntil(release)
+
+	layer, err := newStoreLayer([]string{"mock://127.0.0.1:2000/"}, "services", "backends", false)
+	require.NoError(t, err)
+	ctx := newContext(NewMemoryIpvs(), &fakeDisco{})
+	defer close(ctx.stopCh)
+	s := &Store{ctx: ctx, layers: []*storeLayer{layer}, syncTimeout: 10 * time.Millisecond}
+
+	assert.ErrorIs(t, s.StartSyncWithStore(), ErrSyncTimeout)
+	// the timed out sync is still reading the store
+	assert.ErrorIs(t, s.StartSyncWithStore(), ErrSyncInProgress)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		last, err := s.LastSync()
+		return err == nil && last != nil
+	}, time.Second, time.Millisecond)
+	last, _ := s.LastSync()
+	require.Len(t, last.Errors, 1)
+	assert.ErrorIs(t, last.Errors[0].err, ErrSyncTimeout)
+}
+
+func TestStoreEntriesAreReused(t *testing.T) {
+	m := storeMock{}
+	libkv.AddStore("mock", m.mockNew())
+	web := &store.KVPair{Key: "/services/web", LastIndex: 7,
+		Value: []byte("service_options:\n  host: 127.0.0.1\n  port: 80\n")}
+	m.On("List", "/services").Return([]*store.KVPair{web, {Key: "/services/empty", Value: []byte{}}}, nil).Once()
+
+	layer, err := newStoreLayer([]string{"mock://127.0.0.1:2000/"}, "services", "backends", false)
+	require.NoError(t, err)
+	first, err := layer.getServices()
+	require.NoError(t, err)
+	assert.Nil(t, first["empty"].ServiceOptions)
+	entry := layer.entries[web.Key]
+	require.NotNil(t, entry)
+
+	// unchanged value isn't parsed again, while services are decoded anew
+	m.On("List", "/services").Return([]*store.KVPair{web}, nil).Once()
+	second, err := layer.getServices()
+	require.NoError(t, err)
+	assert.Same(t, entry, layer.entries[web.Key])
+	assert.NotSame(t, first["web"].ServiceOptions, second["web"].ServiceOptions)
+	assert.Equal(t, first["web"].ServiceOptions, second["web"].ServiceOptions)
+	assert.NotContains(t, layer.entries, "/services/empty")
+
+	changed := &store.KVPair{Key: web.Key, LastIndex: 8, Value: []byte("service_options:\n  host: 127.0.0.1\n  port: 81\n")}
+	m.On("List", "/services").Return([]*store.KVPair{changed}, nil).Once()
+	third, err := layer.getServices()
+	require.NoError(t, err)
+	assert.NotSame(t, entry, layer.entries[web.Key])
+	assert.Equal(t, uint16(81), third["web"].ServiceOptions.Port)
+	assert.Equal(t, first["web"].revision, second["web"].revision)
+	assert.NotEqual(t, first["web"].revision, third["web"].revision)
+}
+
+func TestIncrementalSync(t *testing.T) {
+	ctx := newContext(NewMemoryIpvs(), &fakeDisco{})
+	ctx.disco.(*fakeDisco).On("Expose", mock.Anything, "127.0.0.1", mock.Anything).Return(nil)
+	ctx.disco.(*fakeDisco).On("Remove", mock.Anything).Return(nil)
+	defer close(ctx.stopCh)
+
+	storeServices := func(webRevision uint64) map[string]*ServiceConfig {
+		services := map[string]*ServiceConfig{
+			"web": {ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 80}, revision: webRevision},
+			"api": {ServiceOptions: &ServiceOptions{Host: "127.0.0.1", Port: 81}, revision: 2},
+		}
+		validateServiceConfigs(services, nil, nil)
+		return services
+	}
+
+	result, err := ctx.Synchronize(storeServices(1))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Created)
+	assert.Equal(t, 0, result.Unchanged)
+
+	result, err = ctx.Synchronize(storeServices(1))
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Unchanged)
+
+	// services of changed store revisions and services missing in store are compared
+	services := storeServices(3)
+	delete(services, "api")
+	plan := ctx.planSync(services)
+	assert.Empty(t, plan.Unchanged)
+	require.Len(t, plan.Operations, 1)
+	assert.Equal(t, SyncActionRemove, plan.Operations[0].Action)
+
+	// changes outside of synchronization make all services compared
+	require.NoError(t, ctx.FreezeService("api", Precondition{}))
+	require.NoError(t, ctx.UnfreezeService("api", Precondition{}))
+	result, err = ctx.Synchronize(storeServices(1))
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Unchanged)
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"net"
+)
+
+// StoreValidation is a result of dry-run synchronization with store content.
+type StoreValidation struct {
+	// Plan of synchronization of an empty GORB with store, skipped objects have invalid content.
+	Plan *SyncPlan `json:"plan"`
+	// Errors of operations failed while applying the plan.
+	Errors []StoreSyncError `json:"errors,omitempty"`
+	// DuplicateServices are services sharing the same VIP, port and protocol keyed by "vip:port/protocol".
+	DuplicateServices map[string][]string `json:"duplicate_services,omitempty"`
+}
+
+// Valid checks if store content has neither invalid objects, failed operations nor duplicate services.
+func (v *StoreValidation) Valid() bool {
+	return len(v.Plan.Skipped) == 0 && len(v.Errors) == 0 && len(v.DuplicateServices) == 0
+}
+
+// dryRunConnLimiter accepts connection limits without touching nftables.
+type dryRunConnLimiter struct{}
+
+func (dryRunConnLimiter) Apply([]ConnLimit) error {
+	return nil
+}
+
+// ValidateStore reads store content the way synchronization does and applies it
+// to an empty context with in-memory IPVS, so errors of store content could be
+// found before it's rolled out, e.g. in CI. Neither IPVS nor VIPs are touched.
+// Services without host get the default one.
+func ValidateStore(options StoreOptions, defaultHost net.IP, networks []*net.IPNet) (*StoreValidation, error) {
+	contextOptions := ContextOptions{Ipvs: NewMemoryIpvs(), ConnLimiter: dryRunConnLimiter{}, BackendNetworks: networks}
+	if defaultHost != nil {
+		contextOptions.Endpoints = []net.IP{defaultHost}
+	}
+	ctx, err := NewContext(contextOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.Close()
+
+	store, err := newStore(options, ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	services, err := store.getStoreServices()
+	if err != nil {
+		return nil, err
+	}
+
+	plan, result := func() (*SyncPlan, *StoreSyncResult) {
+		ctx.mutex.Lock()
+		defer ctx.mutex.Unlock()
+		plan := ctx.planSync(services)
+		result := newStoreSyncResult()
+		ctx.applySyncPlan(context.Background(), plan, result)
+		return plan, result
+	}()
+
+	duplicates, err := ctx.Duplicates()
+	if err != nil {
+		return nil, err
+	}
+	return &StoreValidation{Plan: plan, Errors: result.Errors, DuplicateServices: duplicates.Services}, nil
+}
@@ -0,0 +1,337 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SyncAction is a kind of change applied during synchronization with store.
+type SyncAction string
+
+// Possible synchronization actions.
+const (
+	SyncActionRemove SyncAction = "remove"
+	SyncActionUpdate SyncAction = "update"
+	SyncActionCreate SyncAction = "create"
+)
+
+// SyncOperation is a single change of a service or a backend.
+type SyncOperation struct {
+	Action SyncAction `json:"action"`
+	VsID   string     `json:"vs_id"`
+	RsID   string     `json:"rs_id,omitempty"`
+	// Current configuration of the object, nil for create
+	Current *SyncObject `json:"current,omitempty"`
+	// Desired configuration of the object, nil for remove
+	Desired *SyncObject `json:"desired,omitempty"`
+
+	// desired configuration from store, nil for remove
+	service *ServiceConfig
+	backend *BackendOptions
+}
+
+// SyncObject is a configuration of a service with its backends or of a single backend.
+type SyncObject struct {
+	ServiceOptions  *ServiceOptions            `json:"service_options,omitempty"`
+	ServiceBackends map[string]*BackendOptions `json:"service_backends,omitempty"`
+	BackendOptions  *BackendOptions            `json:"backend_options,omitempty"`
+}
+
+func serviceObject(config *ServiceConfig) *SyncObject {
+	return &SyncObject{ServiceOptions: config.ServiceOptions, ServiceBackends: config.ServiceBackends}
+}
+
+func backendObject(options *BackendOptions) *SyncObject {
+	return &SyncObject{BackendOptions: options}
+}
+
+func (op *SyncOperation) String() string {
+	if op.RsID == "" {
+		return fmt.Sprintf("[%s]", op.VsID)
+	}
+	return fmt.Sprintf("[%s/%s]", op.VsID, op.RsID)
+}
+
+// SyncPlan is an ordered list of operations required to synchronize GORB with store.
+// Removals go first to free IPVS entries, then updates and creations.
+// Backends of created or updated services are handled by the service operation.
+type SyncPlan struct {
+	Operations []*SyncOperation `json:"operations"`
+	// Skipped objects with invalid store content. They are neither created nor removed.
+	Skipped []StoreSyncError `json:"skipped,omitempty"`
+	// Frozen services left as is, see FreezeService.
+	Frozen []string `json:"frozen,omitempty"`
+	// Unchanged services not compared since their store revision is the same as
+	// on the previous synchronization.
+	Unchanged []string `json:"unchanged,omitempty"`
+}
+
+// SyncError is returned when some operations of synchronization failed.
+type SyncError struct {
+	Errors []StoreSyncError
+}
+
+func (e *SyncError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", err.Object, err.Error))
+	}
+	return fmt.Sprintf("failed to sync %d object(s) with store: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Unwrap allows to match underlying errors with errors.Is.
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err.err)
+	}
+	return errs
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// planSync builds a SyncPlan for storeServices. Context mutex must be held.
+func (ctx *Context) planSync(storeServices map[string]*ServiceConfig) *SyncPlan {
+	var (
+		removeBackends, removeServices []*SyncOperation
+		updateServices, updateBackends []*SyncOperation
+		createServices, createBackends []*SyncOperation
+	)
+
+	plan := &SyncPlan{}
+	for _, vsID := range sortedKeys(storeServices) {
+		storeService := storeServices[vsID]
+		if storeService.err != nil {
+			plan.Skipped = append(plan.Skipped,
+				StoreSyncError{Object: fmt.Sprintf("[%s]", vsID), Error: storeService.err.Error(), err: storeService.err})
+			continue
+		}
+		for _, rsID := range sortedKeys(storeService.invalidBackends) {
+			err := storeService.invalidBackends[rsID]
+			plan.Skipped = append(plan.Skipped,
+				StoreSyncError{Object: fmt.Sprintf("[%s/%s]", vsID, rsID), Error: err.Error(), err: err})
+		}
+	}
+
+	for _, vsID := range sortedKeys(ctx.services) {
+		service := ctx.services[vsID]
+		storeService, ok := storeServices[vsID]
+		if ok && storeService.err != nil {
+			log.Debugf("service [%s] has invalid store content. keep it as is", vsID)
+			continue
+		}
+		if ctx.syncFrozen(vsID, storeService) {
+			log.Debugf("service [%s] is frozen. keep it as is", vsID)
+			plan.Frozen = append(plan.Frozen, vsID)
+			continue
+		}
+		if !ok {
+			log.Debugf("service [%s] not found in store", vsID)
+			removeServices = append(removeServices,
+				&SyncOperation{Action: SyncActionRemove, VsID: vsID, Current: serviceObject(service.config())})
+			continue
+		}
+		if ctx.storeUnchanged(vsID, storeService) {
+			plan.Unchanged = append(plan.Unchanged, vsID)
+			continue
+		}
+		if !service.options.CompareStoreOptions(storeService.ServiceOptions) {
+			log.Debugf("service [%s] is outdated.", vsID)
+			updateServices = append(updateServices, &SyncOperation{
+				Action: SyncActionUpdate, VsID: vsID, service: storeService,
+				Current: serviceObject(service.config()), Desired: serviceObject(storeService)})
+			continue
+		}
+		for _, rsID := range sortedKeys(service.backends) {
+			if service.backends[rsID].options.pool != "" {
+				// backends of pools are managed with the pool
+				continue
+			}
+			if _, invalid := storeService.invalidBackends[rsID]; invalid {
+				log.Debugf("backend [%s/%s] has invalid store content. keep it as is", vsID, rsID)
+				continue
+			}
+			storeBackendOptions, ok := storeService.ServiceBackends[rsID]
+			delayed := service.backends[rsID].removalTimer != nil
+			if !ok && delayed {
+				log.Debugf("removal of backend [%s/%s] is delayed", vsID, rsID)
+			} else if !ok {
+				log.Debugf("backend [%s/%s] not found in store", vsID, rsID)
+				removeBackends = append(removeBackends, &SyncOperation{
+					Action: SyncActionRemove, VsID: vsID, RsID: rsID, Current: backendObject(service.backends[rsID].options)})
+			} else if !service.backends[rsID].options.CompareStoreOptions(storeBackendOptions) {
+				log.Debugf("backend [%s/%s] is outdated.", vsID, rsID)
+				updateBackends = append(updateBackends, &SyncOperation{
+					Action: SyncActionUpdate, VsID: vsID, RsID: rsID, backend: storeBackendOptions,
+					Current: backendObject(service.backends[rsID].options), Desired: backendObject(storeBackendOptions)})
+			} else if delayed {
+				log.Debugf("backend [%s/%s] is back in store", vsID, rsID)
+				createBackends = append(createBackends, &SyncOperation{
+					Action: SyncActionCreate, VsID: vsID, RsID: rsID, backend: storeBackendOptions,
+					Desired: backendObject(storeBackendOptions)})
+			}
+		}
+		for _, rsID := range sortedKeys(storeService.ServiceBackends) {
+			if !service.BackendExist(rsID) {
+				log.Debugf("new backend [%s/%s] found.", vsID, rsID)
+				createBackends = append(createBackends, &SyncOperation{
+					Action: SyncActionCreate, VsID: vsID, RsID: rsID, backend: storeService.ServiceBackends[rsID],
+					Desired: backendObject(storeService.ServiceBackends[rsID])})
+			}
+		}
+	}
+
+	for _, vsID := range sortedKeys(storeServices) {
+		if storeServices[vsID].err != nil {
+			continue
+		}
+		if _, exists := ctx.services[vsID]; !exists {
+			if ctx.syncFrozen(vsID, storeServices[vsID]) {
+				log.Debugf("new service [%s] is frozen. don't create it", vsID)
+				plan.Frozen = append(plan.Frozen, vsID)
+				continue
+			}
+			log.Debugf("new service [%s] found.", vsID)
+			createServices = append(createServices, &SyncOperation{
+				Action: SyncActionCreate, VsID: vsID, service: storeServices[vsID],
+				Desired: serviceObject(storeServices[vsID])})
+		}
+	}
+
+	for _, ops := range [][]*SyncOperation{
+		removeBackends, removeServices, updateServices, updateBackends, createServices, createBackends,
+	} {
+		plan.Operations = append(plan.Operations, ops...)
+	}
+	sort.Strings(plan.Frozen)
+	return plan
+}
+
+// applySyncPlan applies all operations of the plan and records the outcome
+// into result. A failed operation doesn't stop the others, IDs of services with
+// failed operations are returned. Context mutex must be held.
+func (ctx *Context) applySyncPlan(parent context.Context, plan *SyncPlan, result *StoreSyncResult) map[string]bool {
+	failed := make(map[string]bool)
+	for _, skipped := range plan.Skipped {
+		result.addSkipped(skipped.Object, skipped.err)
+	}
+	result.Unchanged = len(plan.Unchanged)
+	log.Infof("sync services. operations: %d, unchanged services: %d", len(plan.Operations), len(plan.Unchanged))
+	ops, creates := plan.Operations, []*SyncOperation(nil)
+	if ctx.deferredExposes != nil {
+		// objects of the first synchronization are created by workers, creations go last
+		i := slices.IndexFunc(ops, func(op *SyncOperation) bool { return op.Action == SyncActionCreate })
+		if i >= 0 {
+			ops, creates = ops[:i], ops[i:]
+		}
+	}
+	for _, op := range ops {
+		ctx.applyPlannedOperation(parent, op, result, failed, ctx.withTraceParent)
+	}
+	ctx.applyInitialCreates(parent, creates, result, failed)
+	return failed
+}
+
+// applyPlannedOperation applies the operation of the plan and records its outcome.
+// withParent makes the span of the operation a parent of nested spans until the
+// returned function is called. Context mutex must be held.
+func (ctx *Context) applyPlannedOperation(parent context.Context, op *SyncOperation, result *StoreSyncResult,
+	failed map[string]bool, withParent func(context.Context) func()) {
+	if parent.Err() != nil {
+		// operations left after the deadline are applied by the next sync
+		result.addError(op.String(), ErrSyncTimeout)
+		failed[op.VsID] = true
+		ctx.startup.applied(true)
+		return
+	}
+	log.Debugf("%s %s", op.Action, op)
+	opCtx, span := ctx.startSpan("sync."+string(op.Action),
+		attribute.String("gorb.vs_id", op.VsID), attribute.String("gorb.rs_id", op.RsID))
+	restoreParent := withParent(opCtx)
+	err := ctx.applyStoreOperation(op)
+	restoreParent()
+	endSpan(span, err)
+	ctx.startup.applied(err != nil)
+	if err != nil {
+		result.addError(op.String(), err)
+		failed[op.VsID] = true
+		return
+	}
+	ctx.recordEvent(op.VsID, op.RsID, EventSynced, "%s by synchronization", op.Action)
+	switch op.Action {
+	case SyncActionCreate:
+		result.Created++
+	case SyncActionUpdate:
+		result.Updated++
+	case SyncActionRemove:
+		result.Removed++
+	}
+}
+
+// applySyncOperation applies a single operation. Failed updates are rolled back
+// to the previous configuration. Context mutex must be held.
+func (ctx *Context) applySyncOperation(op *SyncOperation) error {
+	switch {
+	case op.Action == SyncActionRemove && op.RsID == "":
+		_, err := ctx.removeService(op.VsID)
+		return err
+	case op.Action == SyncActionRemove:
+		_, err := ctx.removeBackend(op.VsID, op.RsID)
+		return err
+	case op.Action == SyncActionCreate && op.RsID == "":
+		return ctx.createService(op.VsID, op.service)
+	case op.Action == SyncActionCreate:
+		return ctx.createBackend(op.VsID, op.RsID, op.backend)
+	case op.Action == SyncActionUpdate && op.RsID == "":
+		previous := ctx.services[op.VsID].config()
+		if _, err := ctx.removeService(op.VsID); err != nil {
+			return err
+		}
+		if err := ctx.createService(op.VsID, op.service); err != nil {
+			ctx.rollbackService(op.VsID, previous)
+			return err
+		}
+		return nil
+	case op.Action == SyncActionUpdate:
+		previous, _ := ctx.services[op.VsID].backendOptions(op.RsID)
+		if _, err := ctx.removeBackend(op.VsID, op.RsID); err != nil {
+			return err
+		}
+		if err := ctx.createBackend(op.VsID, op.RsID, op.backend); err != nil {
+			log.Warnf("rolling back backend [%s/%s] to previous configuration", op.VsID, op.RsID)
+			if err := ctx.createBackend(op.VsID, op.RsID, previous); err != nil {
+				log.Errorf("failed to roll back backend [%s/%s]: %s", op.VsID, op.RsID, err)
+			}
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown sync action %q for %s", op.Action, op)
+}
+
+func (ctx *Context) rollbackService(vsID string, previous *ServiceConfig) {
+	log.Warnf("rolling back service [%s] to previous configuration", vsID)
+	// partially created service has to be cleaned up first
+	if _, exists := ctx.services[vsID]; exists {
+		if _, err := ctx.removeService(vsID); err != nil {
+			log.Errorf("failed to clean up service [%s] before roll back: %s", vsID, err)
+			return
+		}
+	}
+	if err := ctx.createService(vsID, previous); err != nil {
+		log.Errorf("failed to roll back service [%s]: %s", vsID, err)
+	}
+}
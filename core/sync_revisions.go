@@ -0,0 +1,56 @@
+package core
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/docker/libkv/store"
+)
+
+// storeRevision identifies the store value of a service, by its modify index
+// if the store keeps one and by its content otherwise.
+func storeRevision(kvpair *store.KVPair) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(kvpair.Key))
+	if kvpair.LastIndex != 0 {
+		binary.Write(h, binary.LittleEndian, kvpair.LastIndex)
+	} else {
+		h.Write(kvpair.Value)
+	}
+	return h.Sum64()
+}
+
+// combineRevisions returns a revision of a service merged from store layers,
+// it's unknown if a revision of any layer is.
+func combineRevisions(base, overlay uint64) uint64 {
+	if base == 0 || overlay == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, [2]uint64{base, overlay})
+	return h.Sum64()
+}
+
+// storeUnchanged checks if the store revision of the service hasn't changed
+// since the previous synchronization, which left it in sync with store. Any
+// change of the context since then requires comparing all services.
+// Context mutex must be held.
+func (ctx *Context) storeUnchanged(vsID string, storeService *ServiceConfig) bool {
+	return storeService.revision != 0 && ctx.syncedAt == ctx.revision &&
+		ctx.syncedRevisions[vsID] == storeService.revision
+}
+
+// recordSyncedRevisions remembers store revisions of services which are in
+// sync with store after the synchronization. Context mutex must be held.
+func (ctx *Context) recordSyncedRevisions(storeServices map[string]*ServiceConfig, failed map[string]bool) {
+	ctx.syncedRevisions = make(map[string]uint64, len(storeServices))
+	for vsID, storeService := range storeServices {
+		if _, exists := ctx.services[vsID]; !exists || storeService.err != nil || failed[vsID] || ctx.frozen[vsID] {
+			continue
+		}
+		if storeService.revision != 0 {
+			ctx.syncedRevisions[vsID] = storeService.revision
+		}
+	}
+	ctx.syncedAt = ctx.revision
+}
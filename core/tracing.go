@@ -0,0 +1,238 @@
+package core
+
+import (
+	"context"
+	"errors"
+
+	"github.com/qk4l/gorb/tracing"
+	"github.com/tehnerd/gnl2go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errIpvsConnsUnsupported = errors.New("IPVS implementation doesn't report active connections")
+
+// tracedOperation wraps context of the traced operation, since atomic.Value
+// requires values of the same type.
+type tracedOperation struct {
+	ctx context.Context
+}
+
+func (ctx *Context) tracedOperation() context.Context {
+	if op, ok := ctx.traceParent.Load().(tracedOperation); ok {
+		return op.ctx
+	}
+	return context.Background()
+}
+
+// startSpan starts a span of the operation, it is a child of the operation
+// running under context mutex if there is one.
+func (ctx *Context) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx.tracedOperation(), name, trace.WithAttributes(attrs...))
+}
+
+// withTraceParent makes spans of nested operations children of the parent
+// until the returned function is called. Context mutex must be held.
+func (ctx *Context) withTraceParent(parent context.Context) func() {
+	previous := ctx.tracedOperation()
+	ctx.traceParent.Store(tracedOperation{parent})
+	return func() { ctx.traceParent.Store(tracedOperation{previous}) }
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedIpvs records a span for every IPVS call, so netlink stalls are visible
+// within operations causing them.
+type tracedIpvs struct {
+	Ipvs
+	ctx *Context
+}
+
+func (t *tracedIpvs) trace(name string, call func() error, attrs ...attribute.KeyValue) error {
+	_, span := t.ctx.startSpan("ipvs."+name, attrs...)
+	err := call()
+	endSpan(span, err)
+	return err
+}
+
+func serviceAttributes(vip string, port uint16, protocol uint16) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("ipvs.vip", vip),
+		attribute.Int("ipvs.port", int(port)),
+		attribute.String("ipvs.protocol", protocolName(protocol)),
+	}
+}
+
+func destAttributes(vip string, vport uint16, rip string, rport uint16, protocol uint16) []attribute.KeyValue {
+	return append(serviceAttributes(vip, vport, protocol),
+		attribute.String("ipvs.rip", rip),
+		attribute.Int("ipvs.rport", int(rport)))
+}
+
+func (t *tracedIpvs) Flush() error {
+	return t.trace("Flush", t.Ipvs.Flush)
+}
+
+func (t *tracedIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return t.trace("AddService", func() error {
+		return t.Ipvs.AddService(vip, port, protocol, sched)
+	}, serviceAttributes(vip, port, protocol)...)
+}
+
+func (t *tracedIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	return t.trace("AddService", func() error {
+		return t.Ipvs.AddServiceWithFlags(vip, port, protocol, sched, flags)
+	}, serviceAttributes(vip, port, protocol)...)
+}
+
+func (t *tracedIpvs) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	netmasker, ok := t.Ipvs.(IpvsNetmasker)
+	if !ok {
+		return ErrNetmaskUnsupported
+	}
+	return t.trace("AddService", func() error {
+		return netmasker.AddServiceWithNetmask(vip, port, protocol, sched, flags, netmask)
+	}, serviceAttributes(vip, port, protocol)...)
+}
+
+func (t *tracedIpvs) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	updater, ok := t.Ipvs.(IpvsServiceUpdater)
+	if !ok {
+		return ErrServiceUpdateUnsupported
+	}
+	return t.trace("UpdateService", func() error {
+		return updater.UpdateService(vip, port, protocol, sched, flags, netmask)
+	}, serviceAttributes(vip, port, protocol)...)
+}
+
+func (t *tracedIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	return t.trace("DelService", func() error {
+		return t.Ipvs.DelService(vip, port, protocol)
+	}, serviceAttributes(vip, port, protocol)...)
+}
+
+func (t *tracedIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return t.trace("AddDest", func() error {
+		return t.Ipvs.AddDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+	}, append(destAttributes(vip, vport, rip, rport, protocol), attribute.Int("ipvs.weight", int(weight)))...)
+}
+
+func (t *tracedIpvs) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return t.trace("UpdateDest", func() error {
+		return t.Ipvs.UpdateDestPort(vip, vport, rip, rport, protocol, weight, fwd)
+	}, append(destAttributes(vip, vport, rip, rport, protocol), attribute.Int("ipvs.weight", int(weight)))...)
+}
+
+func (t *tracedIpvs) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := t.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return t.trace("AddDest", func() error {
+		return tunneler.AddDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+	}, append(destAttributes(vip, vport, rip, rport, protocol), attribute.Int("ipvs.weight", int(weight)),
+		attribute.Int("ipvs.tun_type", int(tunnel.Type)))...)
+}
+
+func (t *tracedIpvs) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel DestTunnel) error {
+	tunneler, ok := t.Ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return t.trace("UpdateDest", func() error {
+		return tunneler.UpdateDestTunnel(vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+	}, append(destAttributes(vip, vport, rip, rport, protocol), attribute.Int("ipvs.weight", int(weight)),
+		attribute.Int("ipvs.tun_type", int(tunnel.Type)))...)
+}
+
+func (t *tracedIpvs) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	return t.trace("DelDest", func() error {
+		return t.Ipvs.DelDestPort(vip, vport, rip, rport, protocol)
+	}, destAttributes(vip, vport, rip, rport, protocol)...)
+}
+
+func (t *tracedIpvs) AddFWMService(fwmark uint32, sched string, af uint16) error {
+	fwmarker, ok := t.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return t.trace("AddService", func() error {
+		return fwmarker.AddFWMService(fwmark, sched, af)
+	}, attribute.Int64("ipvs.fwmark", int64(fwmark)))
+}
+
+func (t *tracedIpvs) DelFWMService(fwmark uint32, af uint16) error {
+	fwmarker, ok := t.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return t.trace("DelService", func() error {
+		return fwmarker.DelFWMService(fwmark, af)
+	}, attribute.Int64("ipvs.fwmark", int64(fwmark)))
+}
+
+func (t *tracedIpvs) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	fwmarker, ok := t.Ipvs.(IpvsFwmarker)
+	if !ok {
+		return ErrPinsUnsupported
+	}
+	return t.trace("AddDest", func() error {
+		return fwmarker.AddFWMDestFWD(fwmark, rip, vaf, port, weight, fwd)
+	}, attribute.Int64("ipvs.fwmark", int64(fwmark)), attribute.String("ipvs.rip", rip),
+		attribute.Int("ipvs.rport", int(port)), attribute.Int("ipvs.weight", int(weight)))
+}
+
+func (t *tracedIpvs) GetPools() (pools []gnl2go.Pool, err error) {
+	err = t.trace("GetPools", func() error {
+		pools, err = t.Ipvs.GetPools()
+		return err
+	})
+	return pools, err
+}
+
+func (t *tracedIpvs) GetActiveConns(vip string, port uint16, protocol uint16) (conns map[string]uint32, err error) {
+	counter, ok := t.Ipvs.(IpvsConnCounter)
+	if !ok {
+		return nil, errIpvsConnsUnsupported
+	}
+	err = t.trace("GetActiveConns", func() error {
+		conns, err = counter.GetActiveConns(vip, port, protocol)
+		return err
+	}, serviceAttributes(vip, port, protocol)...)
+	return conns, err
+}
+
+func (t *tracedIpvs) ListConns(vip string, port uint16, protocol uint16) (conns []IpvsConn, err error) {
+	lister, ok := t.Ipvs.(IpvsConnLister)
+	if !ok {
+		return nil, errIpvsConnListUnsupported
+	}
+	err = t.trace("ListConns", func() error {
+		conns, err = lister.ListConns(vip, port, protocol)
+		return err
+	}, serviceAttributes(vip, port, protocol)...)
+	return conns, err
+}
+
+func (t *tracedIpvs) GetServiceStats() (stats map[string]IpvsStats, err error) {
+	reader, ok := t.Ipvs.(IpvsStatsReader)
+	if !ok {
+		return nil, errIpvsStatsUnsupported
+	}
+	err = t.trace("GetServiceStats", func() error {
+		stats, err = reader.GetServiceStats()
+		return err
+	})
+	return stats, err
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/tehnerd/gnl2go"
+)
+
+// Possible tunnel errors.
+var (
+	ErrUnknownTunnelType     = errors.New("specified tunnel type is unknown")
+	ErrUnknownTunnelChecksum = errors.New("specified tunnel checksum is unknown or not supported by the tunnel type")
+	ErrTunnelMethod          = errors.New("tunnel options require tunnel forwarding method")
+	ErrTunnelPort            = errors.New("tunnel port is required by and supported for gue tunnels only")
+	ErrTunnelUnsupported     = errors.New("IPVS implementation doesn't support tunnel encapsulation")
+)
+
+// Tunnel types of IPVS destinations, IP_VS_CONN_F_TUNNEL_TYPE_* of the kernel.
+const (
+	tunnelTypeIPIP uint8 = iota
+	tunnelTypeGUE
+	tunnelTypeGRE
+)
+
+// Tunnel encapsulation flags of IPVS destinations, IP_VS_TUNNEL_ENCAP_FLAG_* of the kernel.
+const (
+	tunnelFlagCsum    uint16 = 1 << 0
+	tunnelFlagRemCsum uint16 = 1 << 1
+)
+
+func init() {
+	// GNL2GO predates tunnel attributes of destinations added in Linux 5.2,
+	// attributes are numbered by their position, so they are appended
+	gnl2go.IpvsDestAttrList = gnl2go.CreateAttrListDefinition("IpvsDestAttrList", append(gnl2go.IpvsDestAttrList,
+		gnl2go.AttrTuple{Name: "TUN_TYPE", Type: "U8Type"},
+		gnl2go.AttrTuple{Name: "TUN_PORT", Type: "Net16Type"},
+		gnl2go.AttrTuple{Name: "TUN_FLAGS", Type: "U16Type"},
+	))
+}
+
+// TunnelOptions configure encapsulation of packets forwarded to backends of a
+// service with tunnel forwarding method, e.g. GUE for backends behind L3 fabrics
+// which can't route plain IPIP.
+type TunnelOptions struct {
+	// Type is ipip (default), gue or gre.
+	Type string `json:"type" yaml:"type"`
+	// Port GUE receivers of backends listen on.
+	Port uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	// Checksum of encapsulated packets is none (default), csum or remcsum (gue only).
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+
+	dest DestTunnel
+}
+
+// DestTunnel is tunnel encapsulation of an IPVS destination in kernel terms.
+type DestTunnel struct {
+	Type  uint8
+	Port  uint16
+	Flags uint16
+}
+
+// Validate fills missing fields and validates tunnel configuration.
+func (o *TunnelOptions) Validate() error {
+	if o.Type == "" {
+		o.Type = "ipip"
+	}
+	o.Type = strings.ToLower(o.Type)
+	switch o.Type {
+	case "ipip":
+		o.dest.Type = tunnelTypeIPIP
+	case "gue":
+		o.dest.Type = tunnelTypeGUE
+	case "gre":
+		o.dest.Type = tunnelTypeGRE
+	default:
+		return ErrUnknownTunnelType
+	}
+
+	if (o.Port == 0) == (o.Type == "gue") {
+		return ErrTunnelPort
+	}
+	o.dest.Port = o.Port
+
+	if o.Checksum == "" {
+		o.Checksum = "none"
+	}
+	o.Checksum = strings.ToLower(o.Checksum)
+	switch {
+	case o.Checksum == "none":
+		o.dest.Flags = 0
+	case o.Checksum == "csum" && o.Type != "ipip":
+		o.dest.Flags = tunnelFlagCsum
+	case o.Checksum == "remcsum" && o.Type == "gue":
+		o.dest.Flags = tunnelFlagRemCsum
+	default:
+		return ErrUnknownTunnelChecksum
+	}
+	return nil
+}
+
+// IpvsTunneler is implemented by IPVS clients able to set tunnel encapsulation of destinations.
+type IpvsTunneler interface {
+	AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+		tunnel DestTunnel) error
+	UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+		tunnel DestTunnel) error
+}
+
+// tunnelAttrs returns netlink attributes of the tunnel encapsulation.
+func tunnelAttrs(tunnel DestTunnel) map[string]gnl2go.SerDes {
+	tunType := gnl2go.U8Type(tunnel.Type)
+	tunPort := gnl2go.Net16Type(tunnel.Port)
+	tunFlags := gnl2go.U16Type(tunnel.Flags)
+	return map[string]gnl2go.SerDes{"TUN_TYPE": &tunType, "TUN_PORT": &tunPort, "TUN_FLAGS": &tunFlags}
+}
+
+// ipvsAddr encodes the address as IPVS netlink attributes do, padded to 16 bytes.
+func ipvsAddr(addr string) (uint16, []byte, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return 0, nil, fmt.Errorf("invalid IP address: %s", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, append(append([]byte{}, ip4...), make([]byte, net.IPv6len-net.IPv4len)...), nil
+	}
+	return syscall.AF_INET6, append([]byte{}, ip.To16()...), nil
+}
+
+// modifyDestTunnel mirrors modifyDest of GNL2GO with tunnel attributes added.
+func (ipvs *ipvsClient) modifyDestTunnel(command, vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32, tunnel DestTunnel) error {
+	vaf, vaddr, err := ipvsAddr(vip)
+	if err != nil {
+		return err
+	}
+	raf, raddr, err := ipvsAddr(rip)
+	if err != nil {
+		return err
+	}
+	mt, err := ipvs.messageType()
+	if err != nil {
+		return err
+	}
+	msg, err := mt.InitGNLMessageStr(command, gnl2go.ACK_REQUEST)
+	if err != nil {
+		return err
+	}
+
+	vAF, vAddr, vPort, proto := gnl2go.U16Type(vaf), gnl2go.BinaryType(vaddr), gnl2go.Net16Type(vport), gnl2go.U16Type(protocol)
+	svcAttrList := gnl2go.CreateAttrListType(gnl2go.ATLName2ATL["IpvsServiceAttrList"])
+	svcAttrList.Set(map[string]gnl2go.SerDes{"AF": &vAF, "ADDR": &vAddr, "PORT": &vPort, "PROTOCOL": &proto})
+
+	rAF, rAddr, rPort := gnl2go.U16Type(raf), gnl2go.BinaryType(raddr), gnl2go.Net16Type(rport)
+	w, method, thresh := gnl2go.I32Type(weight), gnl2go.U32Type(fwd), gnl2go.U32Type(0)
+	destAttrs := map[string]gnl2go.SerDes{"ADDR_FAMILY": &rAF, "ADDR": &rAddr, "PORT": &rPort, "WEIGHT": &w,
+		"FWD_METHOD": &method, "L_THRESH": &thresh, "U_THRESH": &thresh}
+	for name, attr := range tunnelAttrs(tunnel) {
+		destAttrs[name] = attr
+	}
+	destAttrList := gnl2go.CreateAttrListType(gnl2go.ATLName2ATL["IpvsDestAttrList"])
+	destAttrList.Set(destAttrs)
+
+	msg.AttrMap["SERVICE"] = &svcAttrList
+	msg.AttrMap["DEST"] = &destAttrList
+	return ipvs.Sock.Execute(msg)
+}
+
+// AddDestTunnel adds the destination with tunnel encapsulation.
+func (ipvs *ipvsClient) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32, tunnel DestTunnel) error {
+	return ipvs.modifyDestTunnel("NEW_DEST", vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+}
+
+// UpdateDestTunnel updates the destination with tunnel encapsulation. The kernel
+// resets encapsulation missing in updates, so it's sent with every update.
+func (ipvs *ipvsClient) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16,
+	weight int32, fwd uint32, tunnel DestTunnel) error {
+	return ipvs.modifyDestTunnel("SET_DEST", vip, vport, rip, rport, protocol, weight, fwd, tunnel)
+}
+
+// addDest adds the backend destination to IPVS with tunnel encapsulation of the service if it has one.
+func (ctx *Context) addDest(vs *Service, rip string, rport uint16, weight int32) error {
+	options := vs.options
+	if options.Tunnel == nil {
+		return ctx.ipvs.AddDestPort(options.host.String(), options.Port, rip, rport, options.protocol, weight,
+			options.methodID)
+	}
+	tunneler, ok := ctx.ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return tunneler.AddDestTunnel(options.host.String(), options.Port, rip, rport, options.protocol, weight,
+		options.methodID, options.Tunnel.dest)
+}
+
+// updateDest updates weight of the backend destination in IPVS.
+func (ctx *Context) updateDest(rs *Backend, weight int32) error {
+	options := rs.service.options
+	if options.Tunnel == nil {
+		return ctx.ipvs.UpdateDestPort(options.host.String(), options.Port, rs.options.host.String(), rs.options.Port,
+			options.protocol, weight, options.methodID)
+	}
+	tunneler, ok := ctx.ipvs.(IpvsTunneler)
+	if !ok {
+		return ErrTunnelUnsupported
+	}
+	return tunneler.UpdateDestTunnel(options.host.String(), options.Port, rs.options.host.String(), rs.options.Port,
+		options.protocol, weight, options.methodID, options.Tunnel.dest)
+}
@@ -0,0 +1,300 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/qk4l/gorb/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// Possible VIP interface errors.
+var (
+	ErrNoVipInterface      = errors.New("VIP interface isn't configured")
+	ErrUnknownVipInterface = errors.New("specified VIP interface isn't one of configured ones")
+	ErrInvalidVipPrefix    = errors.New("VIP prefix length must be within the address length")
+	ErrInvalidVipLabel     = errors.New("VIP label must start with the interface name and is supported for IPv4 only")
+)
+
+// VipInfo describes a VIP of services on the VIP interface.
+type VipInfo struct {
+	Address string `json:"address"`
+	// Owner is the service which has added the address, it's removed along with the service.
+	// Addresses present on the interface before GORB have no owner unless they are adopted.
+	Owner string `json:"owner,omitempty"`
+	// Adopted is true if the address was present on the interface before its services.
+	Adopted bool `json:"adopted,omitempty"`
+	// Services with the address as their VIP
+	Services []string `json:"services"`
+	// Present is false if the address is missing on the interface, e.g. removed by someone else
+	Present bool `json:"present"`
+	// Deferred is true while the address waits for a healthy backend of its services on cold start.
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// VipsInfo lists VIPs of services on a VIP interface.
+type VipsInfo struct {
+	Interface string    `json:"interface"`
+	Vips      []VipInfo `json:"vips"`
+}
+
+// VipAnnouncement is an outcome of announcing a VIP to neighbors.
+type VipAnnouncement struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	Error     string `json:"error,omitempty"`
+}
+
+// vipLinks returns all VIP interfaces keyed by their names.
+func (ctx *Context) vipLinks() map[string]netlink.Link {
+	links := make(map[string]netlink.Link, len(ctx.vipInterfaces)+1)
+	for name, link := range ctx.vipInterfaces {
+		links[name] = link
+	}
+	if ctx.vipInterface != nil {
+		links[ctx.vipInterface.Attrs().Name] = ctx.vipInterface
+	}
+	return links
+}
+
+// ListVips returns VIPs of services per VIP interface with their owners and
+// presence on the interface.
+func (ctx *Context) ListVips() ([]VipsInfo, error) {
+	links := ctx.vipLinks()
+	if len(links) == 0 {
+		return nil, ErrNoVipInterface
+	}
+	present := make(map[string]map[string]bool, len(links))
+	for name, link := range links {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			log.Errorf("error while listing addresses of VIP interface '%s': %s", name, err)
+			return nil, err
+		}
+		present[name] = make(map[string]bool, len(addrs))
+		for _, addr := range addrs {
+			present[name][addr.IP.String()] = true
+		}
+	}
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	vips := make(map[string]map[string]*VipInfo, len(links))
+	for name := range links {
+		vips[name] = make(map[string]*VipInfo)
+	}
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		options := vs.options
+		link, err := ctx.serviceVipInterface(options)
+		if link == nil || err != nil {
+			continue
+		}
+		name, address := link.Attrs().Name, options.host.String()
+		vip, exists := vips[name][address]
+		if !exists {
+			vip = &VipInfo{Address: address, Present: present[name][address], Deferred: true}
+			vips[name][address] = vip
+		}
+		vip.Services = append(vip.Services, vsID)
+		vip.Adopted = vip.Adopted || options.vipAdopted
+		// a shared address is added by the first of its services with a healthy backend
+		vip.Deferred = vip.Deferred && vs.vipDeferred
+		if options.delIfAddr {
+			vip.Owner = vsID
+		}
+	}
+
+	list := make([]VipsInfo, 0, len(links))
+	for _, name := range sortedKeys(vips) {
+		info := VipsInfo{Interface: name, Vips: make([]VipInfo, 0, len(vips[name]))}
+		for _, address := range sortedKeys(vips[name]) {
+			info.Vips = append(info.Vips, *vips[name][address])
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+// ReannounceVips sends gratuitous ARP for IPv4 and unsolicited neighbor
+// advertisements for IPv6 VIPs present on VIP interfaces, so neighbors
+// which still send traffic to the previous node after failover are corrected.
+func (ctx *Context) ReannounceVips() ([]VipAnnouncement, error) {
+	list, err := ctx.ListVips()
+	if err != nil {
+		return nil, err
+	}
+
+	announcements := []VipAnnouncement{}
+	for _, info := range list {
+		iface, err := net.InterfaceByName(info.Interface)
+		if err != nil {
+			return nil, err
+		}
+		for _, vip := range info.Vips {
+			if !vip.Present {
+				continue
+			}
+			announcement := VipAnnouncement{Interface: iface.Name, Address: vip.Address}
+			if err := util.AnnounceIP(iface, net.ParseIP(vip.Address)); err != nil {
+				log.Errorf("error while announcing VIP %s on '%s': %s", vip.Address, iface.Name, err)
+				announcement.Error = err.Error()
+			} else {
+				log.Infof("VIP %s has been announced on '%s'", vip.Address, iface.Name)
+			}
+			announcements = append(announcements, announcement)
+		}
+	}
+	return announcements, nil
+}
+
+// initVipInterfaces looks up interfaces services could select by name.
+func (ctx *Context) initVipInterfaces(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	ctx.vipInterfaces = make(map[string]netlink.Link, len(names))
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("unable to find the interface '%s' for VIPs: %s", name, err)
+		}
+		ctx.vipInterfaces[name] = link
+	}
+	log.Infof("VIPs could be added to interfaces %s", strings.Join(sortedKeys(ctx.vipInterfaces), ", "))
+	return nil
+}
+
+// serviceVipInterface returns the interface the VIP of the service is added to,
+// nil if GORB doesn't manage VIPs.
+func (ctx *Context) serviceVipInterface(options *ServiceOptions) (netlink.Link, error) {
+	if options.VipInterface == "" {
+		return ctx.vipInterface, nil
+	}
+	if link, exists := ctx.vipInterfaces[options.VipInterface]; exists {
+		return link, nil
+	}
+	if ctx.vipInterface != nil && ctx.vipInterface.Attrs().Name == options.VipInterface {
+		return ctx.vipInterface, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownVipInterface, options.VipInterface)
+}
+
+// maxVipLabel is the longest interface label, IFNAMSIZ without the terminator.
+const maxVipLabel = 15
+
+// validateVipAddress validates the mask and the label of the VIP, the label
+// prefix is checked against the interface when the VIP is added.
+func (o *ServiceOptions) validateVipAddress() error {
+	bits := 8 * net.IPv6len
+	if o.host.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	if o.VipPrefixLen < 0 || o.VipPrefixLen > bits {
+		return fieldError("vip_prefix_len", fmt.Errorf("%w: /%d", ErrInvalidVipPrefix, o.VipPrefixLen))
+	}
+	if o.VipLabel != "" && (o.host.To4() == nil || len(o.VipLabel) > maxVipLabel) {
+		return fieldError("vip_label", fmt.Errorf("%w: %s", ErrInvalidVipLabel, o.VipLabel))
+	}
+	return nil
+}
+
+// vipAddr returns the VIP address of the service added to the interface.
+func vipAddr(link netlink.Link, options *ServiceOptions) (*netlink.Addr, error) {
+	ip, bits := options.host.To4(), 8*net.IPv4len
+	if ip == nil {
+		ip, bits = options.host.To16(), 8*net.IPv6len
+	}
+	ones := options.VipPrefixLen
+	if ones == 0 {
+		ones = bits
+	}
+	if options.VipLabel != "" && !strings.HasPrefix(options.VipLabel, link.Attrs().Name) {
+		return nil, fmt.Errorf("%w: %s on '%s'", ErrInvalidVipLabel, options.VipLabel, link.Attrs().Name)
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}, Label: options.VipLabel}, nil
+}
+
+// vipSharers returns options of other services with the same VIP on the
+// interface ordered by their IDs. Context mutex must be held.
+func (ctx *Context) vipSharers(vsID string, link netlink.Link, options *ServiceOptions) []*ServiceOptions {
+	var sharers []*ServiceOptions
+	for _, id := range sortedKeys(ctx.services) {
+		other := ctx.services[id].options
+		if id == vsID || !other.host.Equal(options.host) {
+			continue
+		}
+		if otherLink, _ := ctx.serviceVipInterface(other); otherLink != nil &&
+			otherLink.Attrs().Name == link.Attrs().Name {
+			sharers = append(sharers, other)
+		}
+	}
+	return sharers
+}
+
+// addVip adds the VIP of the service to the interface. An address which is
+// already present is adopted, it's removed along with the service only if
+// VIPs adoption is enabled. Context mutex must be held.
+func (ctx *Context) addVip(vsID string, link netlink.Link, options *ServiceOptions) error {
+	ifName := link.Attrs().Name
+	vip, err := vipAddr(link, options)
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrAdd(link, vip)
+	switch {
+	case err == nil:
+		options.delIfAddr = true
+		log.Infof("VIP %s has been added to interface '%s'", options.host, ifName)
+	case errors.Is(err, syscall.EEXIST) && len(ctx.vipSharers(vsID, link, options)) > 0:
+		log.Infof("VIP %s on interface '%s' is shared with other services", options.host, ifName)
+	case errors.Is(err, syscall.EEXIST):
+		options.vipAdopted = true
+		options.delIfAddr = ctx.adoptVips
+		log.Infof("VIP %s is already present on interface '%s', adopted by service [%s]",
+			options.host, ifName, vsID)
+	default:
+		log.Infof("failed to add VIP %s to interface '%s' for service [%s]: %s",
+			options.host, ifName, vsID, err)
+	}
+	return nil
+}
+
+// delVip removes the VIP of the service from the interface, the removal is
+// handed over to another service if the VIP is shared. Context mutex must be held.
+func (ctx *Context) delVip(vsID string, link netlink.Link, options *ServiceOptions) {
+	ifName := link.Attrs().Name
+	if sharers := ctx.vipSharers(vsID, link, options); len(sharers) > 0 {
+		sharers[0].delIfAddr = true
+		sharers[0].vipAdopted = sharers[0].vipAdopted || options.vipAdopted
+		log.Infof("VIP %s on interface '%s' is kept for other services", options.host, ifName)
+		return
+	}
+	// the label was checked when the VIP was added
+	vip, _ := vipAddr(link, options)
+	if err := netlink.AddrDel(link, vip); err != nil {
+		log.Infof("failed to delete VIP %s from interface '%s' for service [%s]: %s",
+			options.host, ifName, vsID, err)
+		return
+	}
+	log.Infof("VIP %s has been deleted from interface '%s'", options.host, ifName)
+}
+
+// addDeferredVip adds the VIP deferred on cold start once a backend of the
+// service has been found healthy. Context mutex must be held.
+func (ctx *Context) addDeferredVip(vs *Service) {
+	vs.vipDeferred = false
+	link, err := ctx.serviceVipInterface(vs.options)
+	if link == nil || err != nil {
+		return
+	}
+	log.Infof("service [%s] has a healthy backend, adding its deferred VIP", vs.vsID)
+	if err := ctx.addVip(vs.vsID, link, vs.options); err != nil {
+		log.Errorf("error while adding deferred VIP of service [%s]: %s", vs.vsID, err)
+	}
+}
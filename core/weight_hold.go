@@ -0,0 +1,46 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// HoldWeights stops pulse from changing IPVS weights of the service, e.g. to keep
+// weights fixed during load tests. Health checks go on, so metrics, statuses and
+// alerts are still reported. Weights could be changed through the API meanwhile.
+func (ctx *Context) HoldWeights(vsID string, pre Precondition) error {
+	return ctx.setWeightsHeld(vsID, true, pre)
+}
+
+// ReleaseWeights lets pulse change weights of the service again, they catch up
+// with health of backends on the next health checks.
+func (ctx *Context) ReleaseWeights(vsID string, pre Precondition) error {
+	return ctx.setWeightsHeld(vsID, false, pre)
+}
+
+func (ctx *Context) setWeightsHeld(vsID string, held bool, pre Precondition) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	vs, exists := ctx.services[vsID]
+	if !exists {
+		return objectError(ErrObjectNotFound, "vsID", vsID)
+	}
+	if err := ctx.checkPrecondition(pre, true, vs.version); err != nil {
+		return err
+	}
+	if vs.weightsHeld == held {
+		return nil
+	}
+
+	vs.weightsHeld = held
+	if held {
+		ctx.recordEvent(vsID, "", EventWeightsHeld, "weights are held, pulse won't change them")
+		log.Warnf("weights of service [%s] are held, pulse won't change them", vsID)
+	} else {
+		ctx.recordEvent(vsID, "", EventHoldReleased, "weights are released to pulse")
+		log.Infof("weights of service [%s] are released", vsID)
+	}
+	ctx.revision++
+	vs.version = ctx.revision
+	return nil
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible weight metrics errors.
+var (
+	ErrInvalidWeightMetric = errors.New("weight metric query is not a valid template")
+	ErrNoWeightMetricValue = errors.New("weight metric query must return a scalar or a single sample")
+)
+
+// weightMetricsTimeout limits a single Prometheus query.
+const weightMetricsTimeout = 10 * time.Second
+
+// WeightMetricQuery is data weight metric queries are rendered with, e.g.
+// node_load1{instance="{{.Host}}:9100"}.
+type WeightMetricQuery struct {
+	VsID string
+	RsID string
+	Host string
+	Port uint16
+}
+
+func parseWeightMetrics(queries map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(queries))
+	for name, query := range queries {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(query)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidWeightMetric, name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// promQuerier evaluates instant PromQL queries with Prometheus HTTP API.
+type promQuerier struct {
+	url    string
+	client *http.Client
+}
+
+type promResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func (q *promQuerier) query(ctx context.Context, query string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(q.url, "/")+"/api/v1/query",
+		strings.NewReader(url.Values{"query": {query}}.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body promResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("unexpected Prometheus response with status %s: %w", resp.Status, err)
+	}
+	if body.Status != "success" {
+		return 0, fmt.Errorf("prometheus query failed: %s", body.Error)
+	}
+
+	// a sample value is a [timestamp, "value"] pair
+	var value [2]interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		err = json.Unmarshal(body.Data.Result, &value)
+	case "vector":
+		var samples []struct {
+			Value [2]interface{} `json:"value"`
+		}
+		if err = json.Unmarshal(body.Data.Result, &samples); err == nil {
+			if len(samples) != 1 {
+				return 0, ErrNoWeightMetricValue
+			}
+			value = samples[0].Value
+		}
+	default:
+		return 0, ErrNoWeightMetricValue
+	}
+	if err != nil {
+		return 0, err
+	}
+	s, ok := value[1].(string)
+	if !ok {
+		return 0, ErrNoWeightMetricValue
+	}
+	result, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	// NaN and infinities of empty ratios and divisions by zero aren't weights
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("%w: %s is not a finite value", ErrNoWeightMetricValue, s)
+	}
+	return result, nil
+}
+
+type weightMetricTarget struct {
+	vsID, rsID, name, query string
+}
+
+// weightMetricTargets renders queries of all backends of services with weight metrics.
+func (ctx *Context) weightMetricTargets() []weightMetricTarget {
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+
+	var targets []weightMetricTarget
+	for _, vsID := range sortedKeys(ctx.services) {
+		vs := ctx.services[vsID]
+		for _, rsID := range sortedKeys(vs.backends) {
+			rs := vs.backends[rsID]
+			data := WeightMetricQuery{VsID: vsID, RsID: rsID, Host: rs.options.host.String(), Port: rs.options.Port}
+			for _, name := range sortedKeys(vs.options.weightMetrics) {
+				var query bytes.Buffer
+				if err := vs.options.weightMetrics[name].Execute(&query, data); err != nil {
+					log.Warnf("unable to render weight metric %q of backend [%s/%s]: %s", name, vsID, rsID, err)
+					continue
+				}
+				targets = append(targets, weightMetricTarget{vsID, rsID, name, query.String()})
+			}
+		}
+	}
+	return targets
+}
+
+// updateWeightMetrics evaluates weight metrics of all backends. Metrics which
+// couldn't be evaluated are dropped, so stale values don't affect weights.
+func (ctx *Context) updateWeightMetrics(q *promQuerier) {
+	targets := ctx.weightMetricTargets()
+	values := make(map[weightMetricTarget]float64, len(targets))
+	for _, target := range targets {
+		queryCtx, cancel := context.WithTimeout(context.Background(), weightMetricsTimeout)
+		value, err := q.query(queryCtx, target.query)
+		cancel()
+		if err != nil {
+			log.Warnf("unable to evaluate weight metric %q of backend [%s/%s]: %s",
+				target.name, target.vsID, target.rsID, err)
+			continue
+		}
+		values[target] = value
+	}
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	for _, target := range targets {
+		vs, exists := ctx.services[target.vsID]
+		if !exists {
+			continue
+		}
+		rs, exists := vs.backends[target.rsID]
+		if !exists {
+			continue
+		}
+		if value, ok := values[target]; ok {
+			if rs.weightMetrics == nil {
+				rs.weightMetrics = make(map[string]float64)
+			}
+			rs.weightMetrics[target.name] = value
+		} else {
+			delete(rs.weightMetrics, target.name)
+		}
+	}
+}
+
+// runWeightMetrics periodically evaluates weight metrics until the context is closed.
+// New values are taken into account by weight policies on the next pulse update.
+func (ctx *Context) runWeightMetrics(prometheusURL string, interval time.Duration) {
+	q := &promQuerier{url: prometheusURL, client: &http.Client{}}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx.updateWeightMetrics(q)
+		select {
+		case <-ticker.C:
+		case <-ctx.stopCh:
+			return
+		}
+	}
+}
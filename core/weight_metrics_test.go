@@ -0,0 +1,95 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qk4l/gorb/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPrometheus(t *testing.T, results map[string]string) *promQuerier {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/query", r.URL.Path)
+		if result, exists := results[r.FormValue("query")]; exists {
+			fmt.Fprintf(w, `{"status": "success", "data": %s}`, result)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status": "error", "errorType": "bad_data", "error": "parse error"}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &promQuerier{url: server.URL, client: server.Client()}
+}
+
+func TestPromQuerier(t *testing.T) {
+	q := newPrometheus(t, map[string]string{
+		"scalar(1)": `{"resultType": "scalar", "result": [1700000000, "1"]}`,
+		"up":        `{"resultType": "vector", "result": [{"metric": {}, "value": [1700000000, "0.25"]}]}`,
+		"empty":     `{"resultType": "vector", "result": []}`,
+		"matrix":    `{"resultType": "matrix", "result": []}`,
+		"nan":       `{"resultType": "vector", "result": [{"metric": {}, "value": [1700000000, "NaN"]}]}`,
+		"inf":       `{"resultType": "scalar", "result": [1700000000, "+Inf"]}`,
+	})
+
+	value, err := q.query(context.Background(), "scalar(1)")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+
+	value, err = q.query(context.Background(), "up")
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, value)
+
+	_, err = q.query(context.Background(), "empty")
+	assert.ErrorIs(t, err, ErrNoWeightMetricValue)
+	_, err = q.query(context.Background(), "matrix")
+	assert.ErrorIs(t, err, ErrNoWeightMetricValue)
+	_, err = q.query(context.Background(), "nan")
+	assert.ErrorIs(t, err, ErrNoWeightMetricValue)
+	_, err = q.query(context.Background(), "inf")
+	assert.ErrorIs(t, err, ErrNoWeightMetricValue)
+	_, err = q.query(context.Background(), "invalid(")
+	assert.ErrorContains(t, err, "parse error")
+}
+
+func TestUpdateWeightMetrics(t *testing.T) {
+	_, err := parseWeightMetrics(map[string]string{"cpu": "{{.Host"})
+	assert.ErrorIs(t, err, ErrInvalidWeightMetric)
+
+	templates, err := parseWeightMetrics(map[string]string{
+		"cpu":  `cpu{instance="{{.Host}}:{{.Port}}"}`,
+		"load": `load{backend="{{.RsID}}"}`,
+	})
+	require.NoError(t, err)
+	vs := &Service{vsID: vsID, options: &ServiceOptions{weightMetrics: templates}}
+	rs := &Backend{rsID: rsID, service: vs, options: &BackendOptions{host: net.ParseIP("10.0.0.1"), Port: 8080},
+		weightMetrics: map[string]float64{"load": 3}}
+	vs.backends = map[string]*Backend{rsID: rs}
+	c := newRoutineContext(map[string]*Service{vsID: vs}, &fakeIpvs{})
+
+	c.updateWeightMetrics(newPrometheus(t, map[string]string{
+		`cpu{instance="10.0.0.1:8080"}`: `{"resultType": "vector", "result": [{"metric": {}, "value": [1700000000, "0.75"]}]}`,
+	}))
+
+	// metrics failed to evaluate are dropped
+	assert.Equal(t, map[string]float64{"cpu": 0.75}, rs.weightMetrics)
+}
+
+func TestUtilizationPolicy(t *testing.T) {
+	assert.ErrorIs(t, (&WeightPolicyOptions{Type: WeightPolicyUtilization}).Validate(), ErrInvalidWeightPolicy)
+	assert.ErrorIs(t, (&WeightPolicyOptions{Type: WeightPolicyUtilization,
+		Args: util.DynamicMap{"metric": "cpu", "max": "all"}}).Validate(), ErrInvalidWeightPolicy)
+
+	opts := &WeightPolicyOptions{Type: WeightPolicyUtilization, Args: util.DynamicMap{"metric": "cpu", "max": 100}}
+	require.NoError(t, opts.Validate())
+	policy := opts.policy
+
+	assert.Equal(t, int32(100), policy.Weight(WeightInput{Weight: 100, Health: 1}))
+	assert.Equal(t, int32(25), policy.Weight(WeightInput{Weight: 100, Health: 1, Metrics: map[string]float64{"cpu": 75}}))
+	assert.Equal(t, int32(1), policy.Weight(WeightInput{Weight: 100, Health: 1, Metrics: map[string]float64{"cpu": 120}}))
+}
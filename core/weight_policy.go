@@ -0,0 +1,204 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/qk4l/gorb/util"
+)
+
+// Possible weight policy errors.
+var (
+	ErrUnknownWeightPolicy = errors.New("specified weight policy is unknown")
+	ErrInvalidWeightPolicy = errors.New("specified weight policy arguments are invalid")
+)
+
+// Built-in weight policies.
+const (
+	// WeightPolicyBinary gives nominal weight to every healthy backend.
+	WeightPolicyBinary = "binary"
+	// WeightPolicyHealth gives weight proportional to health to recovering backends, it is the default.
+	WeightPolicyHealth = "health"
+	// WeightPolicyLatency reduces weight of backends responding to pulse slower than the target latency.
+	WeightPolicyLatency = "latency"
+	// WeightPolicyUtilization reduces weight of backends proportionally to their utilization weight metric.
+	WeightPolicyUtilization = "utilization"
+)
+
+// WeightInput is what a weight policy knows about a healthy backend.
+type WeightInput struct {
+	// Weight is the nominal weight of the backend, i.e. its weight before it went down.
+	Weight int32
+	// Recovering is set while the backend hasn't got its nominal weight back, e.g. after being down.
+	Recovering bool
+	Health     float64
+	// Latency of the last pulse check.
+	Latency time.Duration
+	// Connections returns active connections of the backend. It queries IPVS, so it is made on demand.
+	Connections func() (uint32, error)
+	// Metrics are custom metrics of the backend fed by external sources.
+	Metrics map[string]float64
+}
+
+// WeightPolicy calculates weight of a healthy backend.
+type WeightPolicy interface {
+	Weight(in WeightInput) int32
+}
+
+// WeightPolicyFactory creates a weight policy from its arguments.
+type WeightPolicyFactory func(args util.DynamicMap) (WeightPolicy, error)
+
+var weightPolicies = map[string]WeightPolicyFactory{
+	WeightPolicyBinary:      func(util.DynamicMap) (WeightPolicy, error) { return binaryPolicy{}, nil },
+	WeightPolicyHealth:      func(util.DynamicMap) (WeightPolicy, error) { return healthPolicy{}, nil },
+	WeightPolicyLatency:     newLatencyPolicy,
+	WeightPolicyUtilization: newUtilizationPolicy,
+}
+
+// RegisterWeightPolicy makes a compiled-in weight policy available to services by its name.
+// It must be called before services are created, e.g. from init of the package defining the policy.
+func RegisterWeightPolicy(name string, factory WeightPolicyFactory) {
+	weightPolicies[name] = factory
+}
+
+// WeightPolicyOptions select a weight policy of service backends.
+type WeightPolicyOptions struct {
+	Type string          `json:"type" yaml:"type"`
+	Args util.DynamicMap `json:"args,omitempty" yaml:"args,omitempty"`
+
+	policy WeightPolicy
+}
+
+// Validate creates the weight policy and validates its arguments.
+func (o *WeightPolicyOptions) Validate() error {
+	factory, exists := weightPolicies[o.Type]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUnknownWeightPolicy, o.Type)
+	}
+	policy, err := factory(o.Args)
+	if err != nil {
+		return err
+	}
+	o.policy = policy
+	return nil
+}
+
+func equalWeightPolicies(a, b *WeightPolicyOptions) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Type == b.Type && reflect.DeepEqual(a.Args, b.Args)
+}
+
+// weightPolicy returns the weight policy of service backends.
+func (vs *Service) weightPolicy() WeightPolicy {
+	if vs.options.WeightPolicy == nil || vs.options.WeightPolicy.policy == nil {
+		return healthPolicy{}
+	}
+	return vs.options.WeightPolicy.policy
+}
+
+type binaryPolicy struct{}
+
+func (binaryPolicy) Weight(in WeightInput) int32 {
+	return in.Weight
+}
+
+type healthPolicy struct{}
+
+func (healthPolicy) Weight(in WeightInput) int32 {
+	if !in.Recovering {
+		return in.Weight
+	}
+	return int32(float64(in.Weight) * in.Health)
+}
+
+// latencyPolicy scales weight by target latency to the actual one, so slow backends
+// get less traffic. Weight of a responding backend isn't reduced below 1.
+type latencyPolicy struct {
+	target time.Duration
+}
+
+func newLatencyPolicy(args util.DynamicMap) (WeightPolicy, error) {
+	target := "100ms"
+	if value, exists := args["target"]; exists {
+		if target, exists = value.(string); !exists {
+			return nil, fmt.Errorf("%w: target must be a duration", ErrInvalidWeightPolicy)
+		}
+	}
+	duration, err := time.ParseDuration(target)
+	if err != nil || duration <= 0 {
+		return nil, fmt.Errorf("%w: target must be a positive duration", ErrInvalidWeightPolicy)
+	}
+	return latencyPolicy{duration}, nil
+}
+
+func (p latencyPolicy) Weight(in WeightInput) int32 {
+	factor := in.Health
+	if in.Latency > p.target {
+		factor *= float64(p.target) / float64(in.Latency)
+	}
+	return minimalWeight(in, factor)
+}
+
+// minimalWeight keeps a responding backend in rotation, unless its weight is zero.
+func minimalWeight(in WeightInput, factor float64) int32 {
+	weight := int32(math.Round(float64(in.Weight) * factor))
+	if weight == 0 && in.Weight > 0 && in.Health > 0 {
+		return 1
+	}
+	return weight
+}
+
+// utilizationPolicy scales weight by unused share of the backend capacity, e.g.
+// by idle CPU. Until the metric is evaluated the health policy is used.
+type utilizationPolicy struct {
+	metric string
+	max    float64
+}
+
+func newUtilizationPolicy(args util.DynamicMap) (WeightPolicy, error) {
+	metric, _ := args["metric"].(string)
+	if metric == "" {
+		return nil, fmt.Errorf("%w: metric must be a name of weight metric", ErrInvalidWeightPolicy)
+	}
+	policy := utilizationPolicy{metric: metric, max: 1}
+	switch value := args["max"].(type) {
+	case nil:
+	case float64:
+		policy.max = value
+	case int:
+		policy.max = float64(value)
+	default:
+		return nil, fmt.Errorf("%w: max must be a number", ErrInvalidWeightPolicy)
+	}
+	if policy.max <= 0 {
+		return nil, fmt.Errorf("%w: max must be positive", ErrInvalidWeightPolicy)
+	}
+	return policy, nil
+}
+
+func (p utilizationPolicy) Weight(in WeightInput) int32 {
+	value, exists := in.Metrics[p.metric]
+	if !exists {
+		return healthPolicy{}.Weight(in)
+	}
+	return minimalWeight(in, in.Health*math.Max(0, math.Min(1, 1-value/p.max)))
+}
+
+// backendConns returns active connections of the backend.
+func (ctx *Context) backendConns(vip string, vport uint16, protocol uint16, rip string, rport uint16) (uint32, error) {
+	counter, ok := ctx.ipvs.(IpvsConnCounter)
+	if !ok {
+		return 0, errIpvsConnsUnsupported
+	}
+	conns, err := counter.GetActiveConns(vip, vport, protocol)
+	if err != nil {
+		return 0, err
+	}
+	return conns[net.JoinHostPort(rip, fmt.Sprint(rport))], nil
+}
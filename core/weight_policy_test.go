@@ -0,0 +1,85 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeightPolicyOptions(t *testing.T) {
+	assert.ErrorIs(t, (&WeightPolicyOptions{Type: "random"}).Validate(), ErrUnknownWeightPolicy)
+	assert.ErrorIs(t, (&WeightPolicyOptions{Type: WeightPolicyLatency, Args: util.DynamicMap{"target": 5}}).Validate(),
+		ErrInvalidWeightPolicy)
+	assert.ErrorIs(t, (&WeightPolicyOptions{Type: WeightPolicyLatency, Args: util.DynamicMap{"target": "-1s"}}).Validate(),
+		ErrInvalidWeightPolicy)
+
+	opts := &WeightPolicyOptions{Type: WeightPolicyLatency, Args: util.DynamicMap{"target": "20ms"}}
+	require.NoError(t, opts.Validate())
+	assert.Equal(t, latencyPolicy{20 * time.Millisecond}, opts.policy)
+
+	RegisterWeightPolicy("constant", func(util.DynamicMap) (WeightPolicy, error) { return binaryPolicy{}, nil })
+	defer delete(weightPolicies, "constant")
+	assert.NoError(t, (&WeightPolicyOptions{Type: "constant"}).Validate())
+}
+
+func TestWeightPolicies(t *testing.T) {
+	recovering := WeightInput{Weight: 100, Recovering: true, Health: 0.5, Latency: 10 * time.Millisecond}
+	assert.Equal(t, int32(100), binaryPolicy{}.Weight(recovering))
+	assert.Equal(t, int32(50), healthPolicy{}.Weight(recovering))
+	assert.Equal(t, int32(100), healthPolicy{}.Weight(WeightInput{Weight: 100, Health: 0.5}))
+
+	latency := latencyPolicy{20 * time.Millisecond}
+	assert.Equal(t, int32(100), latency.Weight(WeightInput{Weight: 100, Health: 1, Latency: 10 * time.Millisecond}))
+	assert.Equal(t, int32(25), latency.Weight(WeightInput{Weight: 100, Health: 1, Latency: 80 * time.Millisecond}))
+	assert.Equal(t, int32(1), latency.Weight(WeightInput{Weight: 100, Health: 1, Latency: time.Minute}))
+	assert.Equal(t, int32(0), latency.Weight(WeightInput{Weight: 100, Latency: time.Minute}))
+}
+
+func TestPulseUpdateAppliesWeightPolicy(t *testing.T) {
+	policy := &WeightPolicyOptions{Type: WeightPolicyLatency, Args: util.DynamicMap{"target": "10ms"}}
+	require.NoError(t, policy.Validate())
+	vs := &Service{options: &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", WeightPolicy: policy}}
+	vs.backends = map[string]*Backend{rsID: {service: vs, options: &BackendOptions{weight: 100}}}
+	stash := make(map[pulse.ID]int32)
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(map[string]*Service{vsID: vs}, mockIpvs)
+
+	// healthy backend is slowed down, so its weight is reduced and stashed
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(50), mock.Anything).Return(nil).Once()
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1, Latency: 20 * time.Millisecond}})
+	assert.Equal(t, map[pulse.ID]int32{id: 100}, stash)
+
+	// the same weight isn't updated again
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1, Latency: 20 * time.Millisecond}})
+
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(100), mock.Anything).Return(nil).Once()
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 1, Latency: 5 * time.Millisecond}})
+	assert.Empty(t, stash)
+	mockIpvs.AssertExpectations(t)
+}
+
+func TestPulseUpdateKeepsMinWeight(t *testing.T) {
+	vs := &Service{options: &ServiceOptions{Port: 80, Host: "localhost", Protocol: "tcp", MaxWeight: 5, MinWeight: 1}}
+	vs.backends = map[string]*Backend{rsID: {service: vs, options: &BackendOptions{weight: 0}}}
+	id := pulse.ID{VsID: vsID, RsID: rsID}
+	// the backend recovers from being down with nominal weight 5
+	stash := map[pulse.ID]int32{id: 5}
+	mockIpvs := &fakeIpvs{}
+
+	c := newRoutineContext(map[string]*Service{vsID: vs}, mockIpvs)
+
+	// 5 * 0.1 is truncated to zero, the min weight keeps the backend in rotation
+	mockIpvs.On("UpdateDestPort", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, int32(1), mock.Anything).Return(nil).Once()
+	c.processPulseUpdate(stash, pulse.Update{Source: id, Metrics: pulse.Metrics{Status: pulse.StatusUp, Health: 0.1}})
+	assert.Equal(t, int32(1), vs.backends[rsID].options.weight)
+	mockIpvs.AssertExpectations(t)
+
+	assert.ErrorIs(t, (&ServiceOptions{Port: 80, Host: "localhost", MaxWeight: 5, MinWeight: 6}).Validate(nil), ErrInvalidMinWeight)
+}
@@ -49,8 +49,14 @@ func newConsulDriver(opts util.DynamicMap) (Driver, error) {
 		return nil, err
 	}
 
+	// proxies of the environment are used unless Proxy is set
+	proxy, err := util.ProxyFunc(opts.Get("Proxy", "").(string))
+	if err != nil {
+		return nil, err
+	}
+
 	return &consulDisco{
-		client: http.Client{Timeout: 5 * time.Second},
+		client: http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{Proxy: proxy}},
 		consul: u,
 	}, nil
 }
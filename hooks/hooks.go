@@ -0,0 +1,176 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errHookError = errors.New("hook endpoint returned an error")
+)
+
+// EventType is a kind of LB-level decision about a backend.
+type EventType string
+
+// Possible backend events.
+const (
+	EventEject   EventType = "eject"
+	EventRestore EventType = "restore"
+
+	EventAlertFiring   EventType = "alert_firing"
+	EventAlertResolved EventType = "alert_resolved"
+
+	EventServiceStatus EventType = "service_status"
+)
+
+// Event is passed to hooks when GORB ejects or restores a backend,
+// when an alert of a service fires or resolves, or when a service status changes.
+type Event struct {
+	Type   EventType `json:"type"`
+	VsID   string    `json:"vs_id"`
+	RsID   string    `json:"rs_id"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	// Alert is a name of the alert for alert events.
+	Alert string `json:"alert,omitempty"`
+	// Status is a new service status for service status events.
+	Status string `json:"status,omitempty"`
+}
+
+// Hook reacts to backend events.
+type Hook interface {
+	Run(event Event) error
+}
+
+// Options contain hooks configuration.
+type Options struct {
+	// Exec is a shell command run for every event.
+	Exec string
+	// URL receives every event as JSON with POST request.
+	URL string
+	// Timeout of a single hook run.
+	Timeout time.Duration
+}
+
+// Dispatcher runs configured hooks asynchronously, so slow hooks
+// don't delay health checks processing.
+type Dispatcher struct {
+	hooks []Hook
+}
+
+// New creates a new Dispatcher from the provided options.
+func New(opts *Options) *Dispatcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	d := &Dispatcher{}
+	if opts.Exec != "" {
+		d.hooks = append(d.hooks, &execHook{command: opts.Exec, timeout: opts.Timeout})
+	}
+	if opts.URL != "" {
+		d.hooks = append(d.hooks, &httpHook{url: opts.URL, client: http.Client{Timeout: opts.Timeout}})
+	}
+	return d
+}
+
+// Notify runs all hooks for the event in background.
+func (d *Dispatcher) Notify(event Event) {
+	if d == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, hook := range d.hooks {
+		go func(hook Hook) {
+			if err := hook.Run(event); err != nil {
+				log.Errorf("%s hook for backend [%s/%s] failed: %s", event.Type, event.VsID, event.RsID, err)
+			}
+		}(hook)
+	}
+}
+
+// execHook runs a shell command. Event is passed with environment
+// variables and as JSON on stdin.
+type execHook struct {
+	command string
+	timeout time.Duration
+}
+
+func (h *execHook) Run(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Env = append(cmd.Environ(),
+		"GORB_EVENT="+string(event.Type),
+		"GORB_VS_ID="+event.VsID,
+		"GORB_RS_ID="+event.RsID,
+		"GORB_REASON="+event.Reason,
+		"GORB_ALERT="+event.Alert,
+		"GORB_STATUS="+event.Status,
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	// don't wait for children of killed shell holding the output
+	cmd.WaitDelay = time.Second
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// httpHook posts event as JSON to the URL.
+type httpHook struct {
+	url    string
+	client http.Client
+}
+
+func (h *httpHook) Run(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: %s", errHookError, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var event = Event{Type: EventEject, VsID: "vs", RsID: "rs", Reason: "pulse status Down, health 0.00"}
+
+func TestHTTPHook(t *testing.T) {
+	events := make(chan Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		events <- e
+	}))
+	defer ts.Close()
+
+	New(&Options{URL: ts.URL}).Notify(event)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, event.Type, e.Type)
+		assert.Equal(t, event.RsID, e.RsID)
+		assert.False(t, e.Time.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("hook has not been called")
+	}
+
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	assert.ErrorIs(t, (&httpHook{url: ts.URL}).Run(event), errHookError)
+}
+
+func TestExecHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	hook := &execHook{command: `echo "$GORB_EVENT $GORB_VS_ID/$GORB_RS_ID" > ` + out, timeout: time.Second}
+	require.NoError(t, hook.Run(event))
+
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "eject vs/rs\n", string(content))
+
+	assert.Error(t, (&execHook{command: "exit 1", timeout: time.Second}).Run(event))
+	assert.Error(t, (&execHook{command: "sleep 5", timeout: 50 * time.Millisecond}).Run(event))
+}
+
+func TestNilDispatcher(t *testing.T) {
+	var d *Dispatcher
+	d.Notify(event)
+}
@@ -21,23 +21,70 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"hash/fnv"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/tracing"
 	"github.com/qk4l/gorb/util"
 
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // possible api errors
 var (
 	operationNotSupportedStore = errors.New("operation not supported with store")
+	errInvalidPrecondition     = errors.New("If-Match must be \"*\" or a single version matching the body," +
+		" If-None-Match must be \"*\"")
+	errInvalidDuration = errors.New("duration must not be negative")
+	errInvalidToken    = errors.New("missing or invalid registration token")
+	errMissingWeight   = errors.New("weight is required")
 )
 
+// errorResponse is a body of failed API requests.
 type errorResponse struct {
 	Error string `json:"error"`
+	// Code is a stable machine-readable class of the error
+	Code core.ErrorCode `json:"code"`
+	// Field is a path of the invalid field of the request body
+	Field string `json:"field,omitempty"`
+	// Details are IDs of objects the error is about, e.g. vs_id and rs_id
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// API specific error codes.
+const (
+	codeInvalidRequest  core.ErrorCode = "invalid_request"
+	codeNotSupported    core.ErrorCode = "not_supported"
+	codeUnauthorized    core.ErrorCode = "unauthorized"
+	codeRequestTooLarge core.ErrorCode = "request_too_large"
+)
+
+var errorStatuses = map[core.ErrorCode]int{
+	core.CodeObjectNotFound:     http.StatusNotFound,
+	core.CodeObjectExists:       http.StatusConflict,
+	core.CodeConflict:           http.StatusConflict,
+	core.CodePreconditionFailed: http.StatusPreconditionFailed,
+	core.CodeVersionRequired:    http.StatusPreconditionRequired,
+	core.CodeIpvsError:          http.StatusInternalServerError,
+	core.CodeInternalError:      http.StatusInternalServerError,
+	core.CodeTimeout:            http.StatusGatewayTimeout,
+	codeUnauthorized:            http.StatusUnauthorized,
+	codeRequestTooLarge:         http.StatusRequestEntityTooLarge,
 }
 
 func writeJSON(w http.ResponseWriter, obj interface{}) {
@@ -45,23 +92,167 @@ func writeJSON(w http.ResponseWriter, obj interface{}) {
 	w.Write(util.MustMarshal(obj, util.JSONOptions{Indent: true}))
 }
 
+// newErrorResponse classifies the error, errors of request bodies which
+// couldn't be decoded are invalid requests, the rest is classified by core.
+func newErrorResponse(err error) *errorResponse {
+	response := &errorResponse{Error: err.Error(), Code: core.ErrorCodeOf(err), Field: core.ErrorField(err),
+		Details: core.ErrorDetails(err)}
+
+	var (
+		tooLarge  *http.MaxBytesError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, errInvalidToken):
+		response.Code = codeUnauthorized
+	case errors.Is(err, operationNotSupportedStore):
+		response.Code = codeNotSupported
+	case errors.As(err, &tooLarge):
+		response.Code = codeRequestTooLarge
+	case errors.As(err, &typeErr):
+		response.Code, response.Field = codeInvalidRequest, typeErr.Field
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		response.Code = codeInvalidRequest
+	}
+	return response
+}
+
 func writeError(w http.ResponseWriter, err error) {
-	var code int
-
-	switch err {
-	case core.ErrIpvsSyscallFailed:
-		code = http.StatusInternalServerError
-	case core.ErrObjectExists:
-		code = http.StatusConflict
-	case core.ErrObjectNotFound:
-		code = http.StatusNotFound
-	default:
+	response := newErrorResponse(err)
+	code, ok := errorStatuses[response.Code]
+	if !ok {
 		code = http.StatusBadRequest
 	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(code)
-	w.Write(util.MustMarshal(&errorResponse{err.Error()}, util.JSONOptions{Indent: true}))
+	w.Write(util.MustMarshal(response, util.JSONOptions{Indent: true}))
+}
+
+// writeVersioned writes an object with its version as ETag, so it could be used in If-Match.
+func writeVersioned(w http.ResponseWriter, created bool, version uint64, obj interface{}) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(version, 10)))
+	w.Header().Add("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(util.MustMarshal(obj, util.JSONOptions{Indent: true}))
+}
+
+// parsePrecondition converts If-Match and If-None-Match headers into a write precondition.
+func parsePrecondition(r *http.Request) (core.Precondition, error) {
+	var pre core.Precondition
+	if ifMatch := strings.TrimSpace(r.Header.Get("If-Match")); ifMatch == "*" {
+		pre.MustExist = true
+	} else if ifMatch != "" {
+		version, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+		if err != nil || version == 0 {
+			return pre, errInvalidPrecondition
+		}
+		pre.Version = version
+	}
+	if ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match")); ifNoneMatch == "*" {
+		pre.MustNotExist = true
+	} else if ifNoneMatch != "" {
+		return pre, errInvalidPrecondition
+	}
+	return pre, nil
+}
+
+// decodeVersioned decodes JSON body into obj. Version of the object in the body
+// is used as a precondition unless it is set by If-Match.
+func decodeVersioned(r *http.Request, obj interface{}, pre *core.Precondition) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, obj); err != nil {
+		return err
+	}
+	var versioned struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal(body, &versioned); err != nil {
+		return err
+	}
+	if pre.Version == 0 {
+		pre.Version = versioned.Version
+	} else if versioned.Version != 0 && versioned.Version != pre.Version {
+		return errInvalidPrecondition
+	}
+	return nil
+}
+
+// normalizeIDs validates service and backend IDs of requests and converts them to lower case.
+func normalizeIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, key := range []string{"vsID", "rsID", "poolID"} {
+			if id, ok := vars[key]; ok {
+				normalized, err := core.NormalizeID(id)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				vars[key] = normalized
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBodies caps sizes of request bodies, routes taking configuration of all
+// services in bulk are given a separate limit.
+func limitBodies(limit, bulkLimit int64, bulkRoutes ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			max := limit
+			if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil && slices.Contains(bulkRoutes, template) {
+				max = bulkLimit
+			}
+			if r.ContentLength > max {
+				writeError(w, &http.MaxBytesError{Limit: max})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// traceRequests records a span for every API request.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if template, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			route = template
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route)))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
 }
 
 type serviceCreateHandler struct {
@@ -73,14 +264,49 @@ func (h serviceCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		serviceConfig core.ServiceConfig
 		vars          = mux.Vars(r)
 	)
-	if h.ctx.StoreExist() {
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := decodeVersioned(r, &serviceConfig, &pre); err != nil {
+		writeError(w, err)
+	} else if created, err := h.ctx.PutService(vars["vsID"], &serviceConfig, pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetService(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+type serviceUpdateHandler struct {
+	ctx *core.Context
+}
+
+func (h serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if h.ctx.StoreManagedService(vars["vsID"]) {
 		writeError(w, operationNotSupportedStore)
 		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&serviceConfig); err != nil {
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if patch, err := io.ReadAll(r.Body); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.UpdateService(vars["vsID"], patch, pre); err != nil {
 		writeError(w, err)
-	} else if err := h.ctx.CreateService(vars["vsID"], &serviceConfig); err != nil {
+	} else if info, err := h.ctx.GetService(vars["vsID"]); err != nil {
 		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
 	}
 }
 
@@ -94,15 +320,58 @@ func (h backendCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		vars = mux.Vars(r)
 	)
 
-	if h.ctx.StoreExist() {
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := decodeVersioned(r, &opts, &pre); err != nil {
+		writeError(w, err)
+	} else if created, err := h.ctx.PutBackend(vars["vsID"], vars["rsID"], &opts, pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+// backendsDiff is the outcome of reconciling service backends.
+type backendsDiff struct {
+	Operations []*core.SyncOperation `json:"operations"`
+}
+
+type serviceBackendsHandler struct {
+	ctx *core.Context
+}
+
+func (h serviceBackendsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		backends map[string]*core.BackendOptions
+		vars     = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManagedService(vars["vsID"]) {
 		writeError(w, operationNotSupportedStore)
 		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&backends); err != nil {
 		writeError(w, err)
-	} else if err := h.ctx.CreateBackend(vars["vsID"], vars["rsID"], &opts); err != nil {
+	} else if operations, err := h.ctx.PutBackends(vars["vsID"], backends, pre); err != nil {
 		writeError(w, err)
+	} else {
+		writeJSON(w, backendsDiff{operations})
 	}
 }
 
@@ -113,12 +382,14 @@ type serviceRemoveHandler struct {
 func (h serviceRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	if h.ctx.StoreExist() {
+	if h.ctx.StoreManagedService(vars["vsID"]) {
 		writeError(w, operationNotSupportedStore)
 		return
 	}
 
-	if _, err := h.ctx.RemoveService(vars["vsID"]); err != nil {
+	if pre, err := parsePrecondition(r); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.DeleteService(vars["vsID"], pre); err != nil {
 		writeError(w, err)
 	}
 }
@@ -130,12 +401,151 @@ type backendRemoveHandler struct {
 func (h backendRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	if h.ctx.StoreExist() {
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	if pre, err := parsePrecondition(r); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.DeleteBackend(vars["vsID"], vars["rsID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type serviceRestoreHandler struct {
+	ctx *core.Context
+}
+
+func (h serviceRestoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.ctx.RestoreService(vars["vsID"], pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetService(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type backendRestoreHandler struct {
+	ctx *core.Context
+}
+
+func (h backendRestoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if h.ctx.StoreManagedService(vars["vsID"]) {
 		writeError(w, operationNotSupportedStore)
 		return
 	}
 
-	if _, err := h.ctx.RemoveBackend(vars["vsID"], vars["rsID"]); err != nil {
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.ctx.RestoreBackend(vars["vsID"], vars["rsID"], pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type backendDrainHandler struct {
+	ctx     *core.Context
+	drained bool
+}
+
+// ServeHTTP drains or enables the backend. It's an operational state rather than
+// configuration, so it's allowed for services managed by store too.
+func (h backendDrainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	change := h.ctx.EnableBackend
+	if h.drained {
+		change = h.ctx.DrainBackend
+	}
+	if err := change(vars["vsID"], vars["rsID"], pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type backendActivateHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP activates the backend created inactive. Like draining it's allowed
+// for services managed by store too.
+func (h backendActivateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.ctx.ActivateBackend(vars["vsID"], vars["rsID"], pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type stashedWeightRequest struct {
+	Weight *int32 `json:"weight"`
+}
+
+type stashedWeightHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP overrides the weight the stashed backend recovers to. It's an operational
+// state rather than configuration, so it's allowed for services managed by store too.
+func (h stashedWeightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		req  stashedWeightRequest
+		vars = mux.Vars(r)
+	)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Weight == nil {
+		writeError(w, &core.FieldError{Field: "weight", Err: errMissingWeight})
+		return
+	}
+	if err := h.ctx.SetStashedWeight(vars["vsID"], vars["rsID"], *req.Weight, pre); err != nil {
 		writeError(w, err)
 	}
 }
@@ -162,7 +572,7 @@ func (h serviceStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	if opts, err := h.ctx.GetService(vars["vsID"]); err != nil {
 		writeError(w, err)
 	} else {
-		writeJSON(w, opts)
+		writeVersioned(w, false, opts.Version, opts)
 	}
 }
 
@@ -176,40 +586,926 @@ func (h backendStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	if opts, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
 		writeError(w, err)
 	} else {
-		writeJSON(w, opts)
+		writeVersioned(w, false, opts.Version, opts)
 	}
 }
 
-type storeSyncHandler struct {
-	store *core.Store
+type serviceEventsHandler struct {
+	ctx *core.Context
 }
 
-func (h storeSyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.store != nil {
-		if err := h.store.StartSyncWithStore(); err != nil {
-			writeError(w, err)
-		} else {
-			writeJSON(w, map[string]string{"status": "ok"})
+func (h serviceEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if events, err := h.ctx.Events(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, events)
+	}
+}
+
+type serviceConnectionsHandler struct {
+	ctx *core.Context
+}
+
+func (h serviceConnectionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars, params := mux.Vars(r), r.URL.Query()
+	query := core.ConnectionsQuery{RsID: params.Get("rs_id")}
+
+	for name, value := range map[string]*int{"offset": &query.Offset, "limit": &query.Limit} {
+		if param := params.Get(name); param != "" {
+			var err error
+			if *value, err = strconv.Atoi(param); err != nil {
+				writeError(w, core.ErrInvalidPage)
+				return
+			}
 		}
+	}
+
+	if connections, err := h.ctx.ServiceConnections(vars["vsID"], query); err != nil {
+		writeError(w, err)
 	} else {
-		writeError(w, core.ErrObjectNotFound)
+		writeJSON(w, connections)
 	}
+}
 
+type serviceSimulateHandler struct {
+	ctx *core.Context
 }
 
-type storeSyncStatusHandler struct {
-	store *core.Store
+func (h serviceSimulateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars, params := mux.Vars(r), r.URL.Query()
+	query := core.SimulationQuery{Healthy: params.Get("healthy") == "true"}
+
+	if param := params.Get("clients"); param != "" {
+		var err error
+		if query.Clients, err = strconv.Atoi(param); err != nil || query.Clients == 0 {
+			writeError(w, core.ErrInvalidClients)
+			return
+		}
+	}
+
+	if simulation, err := h.ctx.Simulate(vars["vsID"], query); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, simulation)
+	}
 }
 
-func (h storeSyncStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.store != nil {
-		if syncStatus, err := h.store.StoreSyncStatus(); err != nil {
+type persistenceTemplatesHandler struct {
+	ctx *core.Context
+}
+
+func (h persistenceTemplatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if templates, err := h.ctx.PersistenceTemplates(mux.Vars(r)["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, templates)
+	}
+}
+
+type clientPinsHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP lists, pins or unpins clients of the service. Pins are an operational
+// state rather than configuration, so they're allowed for services managed by store too.
+func (h clientPinsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vsID := mux.Vars(r)["vsID"]
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var pin core.ClientPin
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+			writeError(w, err)
+			return
+		}
+		rsID, err := core.NormalizeID(pin.RsID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if result, err := h.ctx.PinClient(vsID, pin.Client, rsID, pre); err != nil {
 			writeError(w, err)
 		} else {
-			writeJSON(w, syncStatus)
+			writeJSON(w, result)
+		}
+	case http.MethodDelete:
+		if err := h.ctx.UnpinClient(vsID, r.URL.Query().Get("client"), pre); err != nil {
+			writeError(w, err)
+		}
+	default:
+		if pins, err := h.ctx.ClientPins(vsID); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, pins)
 		}
-	} else {
-		writeError(w, core.ErrObjectNotFound)
 	}
+}
+
+type groupCreateHandler struct {
+	ctx *core.Context
+}
+
+func (h groupCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		serviceConfig core.ServiceConfig
+		vars          = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := decodeVersioned(r, &serviceConfig, &pre); err != nil {
+		writeError(w, err)
+	} else if created, err := h.ctx.PutServiceGroup(vars["vsID"], &serviceConfig, pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetServiceGroup(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+type groupStatusHandler struct {
+	ctx *core.Context
+}
+
+func (h groupStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if info, err := h.ctx.GetServiceGroup(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type groupRemoveHandler struct {
+	ctx *core.Context
+}
+
+func (h groupRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+	} else if pre, err := parsePrecondition(r); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.RemoveServiceGroup(vars["vsID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type groupBackendCreateHandler struct {
+	ctx *core.Context
+}
+
+func (h groupBackendCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		opts core.BackendOptions
+		vars = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := decodeVersioned(r, &opts, &pre); err != nil {
+		writeError(w, err)
+	} else if created, err := h.ctx.PutGroupBackend(vars["vsID"], vars["rsID"], &opts, pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetServiceGroup(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+type groupBackendRemoveHandler struct {
+	ctx *core.Context
+}
+
+func (h groupBackendRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+	} else if pre, err := parsePrecondition(r); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.RemoveGroupBackend(vars["vsID"], vars["rsID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type poolCreateHandler struct {
+	ctx *core.Context
+}
+
+func (h poolCreateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		config core.BackendPoolConfig
+		vars   = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := decodeVersioned(r, &config, &pre); err != nil {
+		writeError(w, err)
+	} else if created, err := h.ctx.PutBackendPool(vars["poolID"], &config, pre); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackendPool(vars["poolID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+type poolListHandler struct {
+	ctx *core.Context
+}
+
+func (h poolListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.ctx.ListBackendPools())
+}
+
+type poolStatusHandler struct {
+	ctx *core.Context
+}
+
+func (h poolStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if info, err := h.ctx.GetBackendPool(vars["poolID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, false, info.Version, info)
+	}
+}
+
+type poolRemoveHandler struct {
+	ctx *core.Context
+}
+
+func (h poolRemoveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+	} else if pre, err := parsePrecondition(r); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.RemoveBackendPool(vars["poolID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type storeSyncHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		if err := h.store.StartSyncWithStore(); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, map[string]string{"status": "ok"})
+		}
+	} else {
+		writeError(w, core.ErrObjectNotFound)
+	}
+
+}
+
+type storeSyncStatusHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		if syncStatus, err := h.store.StoreSyncStatus(); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, syncStatus)
+		}
+	} else {
+		writeError(w, core.ErrObjectNotFound)
+	}
+
+}
+
+type storeSyncPauseHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncPauseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var duration time.Duration
+
+	if h.store == nil {
+		writeError(w, core.ErrObjectNotFound)
+		return
+	}
+
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		if duration, err = util.ParseInterval(d); err != nil {
+			writeError(w, err)
+			return
+		} else if duration < 0 {
+			writeError(w, errInvalidDuration)
+			return
+		}
+	}
+
+	writeJSON(w, h.store.PauseSync(duration))
+}
+
+type storeSyncResumeHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncResumeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		writeJSON(w, h.store.ResumeSync())
+	} else {
+		writeError(w, core.ErrObjectNotFound)
+	}
+}
+
+type storeSyncLastHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncLastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		if lastSync, err := h.store.LastSync(); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, lastSync)
+		}
+	} else {
+		writeError(w, core.ErrObjectNotFound)
+	}
+}
+
+type storeSyncProblemsHandler struct {
+	store *core.Store
+}
+
+func (h storeSyncProblemsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		writeJSON(w, h.store.Problems())
+	} else {
+		writeError(w, core.ErrObjectNotFound)
+	}
+}
+
+type connLimitHandler struct {
+	ctx *core.Context
+}
+
+func (h connLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		opts *core.ConnLimitOptions
+		vars = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// DELETE removes the limit
+	if r.Method == http.MethodPut {
+		opts = &core.ConnLimitOptions{}
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if err := h.ctx.SetConnLimit(vars["vsID"], opts, pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type serviceFreezeHandler struct {
+	ctx *core.Context
+}
+
+func (h serviceFreezeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// DELETE unfreezes the service
+	freeze := h.ctx.FreezeService
+	if r.Method == http.MethodDelete {
+		freeze = h.ctx.UnfreezeService
+	}
+	if err := freeze(vars["vsID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type weightHoldHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP holds or releases weights of the service. It's an operational state
+// rather than configuration, so it's allowed for services managed by store too.
+func (h weightHoldHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// DELETE releases weights
+	hold := h.ctx.HoldWeights
+	if r.Method == http.MethodDelete {
+		hold = h.ctx.ReleaseWeights
+	}
+	if err := hold(vars["vsID"], pre); err != nil {
+		writeError(w, err)
+	}
+}
+
+type colorSwitchRequest struct {
+	Color string `json:"color"`
+	// Duration of gradual switch, e.g. 5m. Immediate switch if omitted.
+	Duration string `json:"duration"`
+	Steps    int    `json:"steps"`
+}
+
+type colorSwitchHandler struct {
+	ctx *core.Context
+}
+
+func (h colorSwitchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		req      colorSwitchRequest
+		duration time.Duration
+		vars     = mux.Vars(r)
+	)
+
+	pre, err := parsePrecondition(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Duration != "" {
+		var err error
+		if duration, err = util.ParseInterval(req.Duration); err != nil {
+			writeError(w, err)
+			return
+		} else if duration < 0 {
+			writeError(w, errInvalidDuration)
+			return
+		}
+	}
+
+	if err := h.ctx.SwitchColor(vars["vsID"], req.Color, duration, req.Steps, pre); err != nil {
+		writeError(w, err)
+	} else if serviceInfo, err := h.ctx.GetService(vars["vsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, serviceInfo)
+	}
+}
+
+type ipvsTableHandler struct {
+	ctx *core.Context
+}
+
+func (h ipvsTableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if table, err := h.ctx.IpvsTable(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, table)
+	}
+}
+
+type vipsHandler struct {
+	ctx *core.Context
+}
+
+func (h vipsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if vips, err := h.ctx.ListVips(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, vips)
+	}
+}
+
+type vipsReannounceHandler struct {
+	ctx *core.Context
+}
+
+func (h vipsReannounceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if announcements, err := h.ctx.ReannounceVips(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, announcements)
+	}
+}
+
+type diagnosticsDriftHandler struct {
+	ctx *core.Context
+}
+
+func (h diagnosticsDriftHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if report, err := h.ctx.IpvsDrift(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, report)
+	}
+}
+
+type diagnosticsDuplicatesHandler struct {
+	ctx *core.Context
+}
+
+func (h diagnosticsDuplicatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if report, err := h.ctx.Duplicates(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, report)
+	}
+}
+
+type diagnosticsStashHandler struct {
+	ctx *core.Context
+}
+
+func (h diagnosticsStashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.ctx.Stash())
+}
+
+type autoscalerLoadHandler struct {
+	ctx *core.Context
+}
+
+func (h autoscalerLoadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.ctx.ServicesLoad())
+}
+
+type scaleEvent struct {
+	// Backends incoming with the scale out
+	Backends map[string]*core.BackendOptions `json:"backends"`
+}
+
+type autoscalerScaleHandler struct {
+	ctx *core.Context
+}
+
+func (h autoscalerScaleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		event scaleEvent
+		vars  = mux.Vars(r)
+	)
+
+	if h.ctx.StoreManaged() {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.PreRegisterBackends(vars["vsID"], event.Backends); err != nil {
+		writeError(w, err)
+	}
+}
+
+// registration is a backend registering itself with the ttl its heartbeats must come within.
+type registration struct {
+	core.BackendOptions
+	TTL string `json:"ttl,omitempty"`
+}
+
+// checkToken checks the bearer token of the request in constant time.
+func checkToken(r *http.Request, token []byte) error {
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(presented), token) != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+type registerHandler struct {
+	ctx   *core.Context
+	token []byte
+}
+
+func (h registerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		reg  registration
+		vars = mux.Vars(r)
+		ttl  = core.DefaultRegistrationTTL
+	)
+
+	if err := checkToken(r, h.token); err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		writeError(w, err)
+		return
+	}
+	if reg.TTL != "" {
+		interval, err := util.ParseInterval(reg.TTL)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		ttl = interval
+	}
+	if created, err := h.ctx.RegisterBackend(vars["vsID"], vars["rsID"], &reg.BackendOptions, ttl); err != nil {
+		writeError(w, err)
+	} else if info, err := h.ctx.GetBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeVersioned(w, created, info.Version, info)
+	}
+}
+
+type deregisterHandler struct {
+	ctx   *core.Context
+	token []byte
+}
+
+func (h deregisterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := checkToken(r, h.token); err != nil {
+		writeError(w, err)
+	} else if h.ctx.StoreManagedService(vars["vsID"]) {
+		writeError(w, operationNotSupportedStore)
+	} else if err := h.ctx.DeregisterBackend(vars["vsID"], vars["rsID"]); err != nil {
+		writeError(w, err)
+	}
+}
+
+type planHandler struct {
+	ctx   *core.Context
+	store *core.Store
+}
+
+func (h planHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// without desired services the plan is built against store
+	if len(bytes.TrimSpace(body)) == 0 {
+		if h.store == nil {
+			writeError(w, core.ErrObjectNotFound)
+		} else if plan, err := h.store.Plan(); err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, plan)
+		}
+		return
+	}
+
+	// services are described the same way as in store, JSON is accepted as well
+	if services, err := core.ParseServiceConfigs(body); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, h.ctx.CreatePlan(services))
+	}
+}
+
+type importHandler struct {
+	convert func(io.Reader) (map[string]*core.ServiceConfig, []string, error)
+}
+
+func (h importHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	services, warnings, err := h.convert(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	output, err := renderImport(services, warnings)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/yaml")
+	w.Write(output)
+}
+
+type exportIpvsadmHandler struct {
+	ctx *core.Context
+}
+
+func (h exportIpvsadmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain")
+	io.WriteString(w, h.ctx.ExportIpvsadm())
+}
+
+type applyHandler struct {
+	ctx *core.Context
+}
+
+func (h applyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if result, err := h.ctx.ApplyPlan(vars["planID"]); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, result)
+	}
+}
+
+type backupHandler struct {
+	ctx *core.Context
+	key []byte
+}
+
+func (h backupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	archive, err := h.ctx.Backup(h.key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Content-Disposition", `attachment; filename="gorb-backup.json"`)
+	w.Write(archive)
+}
+
+type restoreHandler struct {
+	ctx *core.Context
+	key []byte
+}
+
+func (h restoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	archive, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if result, err := h.ctx.Restore(archive, h.key); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, result)
+	}
+}
+
+type mirrorHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP writes configuration mirrored by followers. ETag is a hash of the
+// body, so followers polling with If-None-Match get 304 until anything changes.
+func (h mirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config, err := h.ctx.MirrorConfig()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body := util.MustMarshal(config, util.JSONOptions{})
+	hash := fnv.New64a()
+	hash.Write(body)
+	etag := strconv.Quote(strconv.FormatUint(hash.Sum64(), 16))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body)
+}
+
+type ipvsTimeoutsHandler struct {
+	ctx *core.Context
+}
+
+func (h ipvsTimeoutsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if timeouts, err := h.ctx.GetIpvsTimeouts(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, timeouts)
+	}
+}
+
+type ipvsQueueHandler struct {
+	ctx *core.Context
+}
+
+func (h ipvsQueueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if stats := h.ctx.IpvsQueueStats(); stats == nil {
+		writeError(w, core.ErrObjectNotFound)
+	} else {
+		writeJSON(w, stats)
+	}
+}
+
+type startupHandler struct {
+	ctx *core.Context
+}
+
+// ServeHTTP reports progress of the first store synchronization, it answers while the sync runs.
+func (h startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.ctx.StartupProgress())
+}
+
+type ipvsTimeoutsUpdateHandler struct {
+	ctx *core.Context
+}
+
+func (h ipvsTimeoutsUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var timeouts core.IpvsTimeouts
+
+	if err := json.NewDecoder(r.Body).Decode(&timeouts); err != nil {
+		writeError(w, err)
+	} else if err := h.ctx.SetIpvsTimeouts(timeouts); err != nil {
+		writeError(w, err)
+	} else if timeouts, err = h.ctx.GetIpvsTimeouts(); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, timeouts)
+	}
+}
+
+type logLevelHandler struct{}
+
+func (h logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, util.GetLogLevels())
+}
+
+type logLevelRequest struct {
+	// Component is empty to change the global level.
+	Component string `json:"component"`
+	// Level is empty to reset the component to the global level.
+	Level string `json:"level"`
+}
+
+type logLevelUpdateHandler struct{}
+
+func (h logLevelUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, err)
+	} else if err := util.SetLogLevel(req.Component, req.Level); err != nil {
+		writeError(w, err)
+	} else {
+		writeJSON(w, util.GetLogLevels())
+	}
+}
+
+type healthzHandler struct{}
 
+// ServeHTTP reports the daemon is up, so it could be used as a liveness probe.
+func (h healthzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
 }
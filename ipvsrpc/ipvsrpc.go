@@ -0,0 +1,387 @@
+// Package ipvsrpc allows to split GORB into a small privileged helper, which owns
+// IPVS netlink socket, and an unprivileged daemon with API, pulse and store logic.
+// They talk over net/rpc on a local unix socket.
+package ipvsrpc
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/tehnerd/gnl2go"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const serviceName = "Ipvs"
+
+var errNotSupported = errors.New("operation is not supported by helper IPVS")
+
+// ServiceArgs describe a virtual service in IPVS requests.
+type ServiceArgs struct {
+	VIP      string
+	Port     uint16
+	Protocol uint16
+	Sched    string
+	Flags    []byte
+	// Netmask of persistence granularity in the kernel form, default if zero
+	Netmask uint32
+}
+
+// DestArgs describe a virtual service destination in IPVS requests.
+type DestArgs struct {
+	VIP      string
+	VPort    uint16
+	RIP      string
+	RPort    uint16
+	Protocol uint16
+	Weight   int32
+	Fwd      uint32
+	// Tunnel encapsulation of the destination, plain IPIP if missing
+	Tunnel *core.DestTunnel
+}
+
+// FwmArgs describe a firewall mark service or its destination in IPVS requests.
+type FwmArgs struct {
+	FWMark uint32
+	AF     uint16
+	Sched  string
+	RIP    string
+	Port   uint16
+	Weight int32
+	Fwd    uint32
+}
+
+// Empty is used for requests and replies without payload.
+// gob is unable to encode structs without exported fields.
+type Empty bool
+
+// Server exposes IPVS operations over net/rpc.
+type Server struct {
+	ipvs core.Ipvs
+}
+
+func (s *Server) Flush(_ Empty, _ *Empty) error {
+	log.Info("flushing IPVS pools by helper request")
+	return s.ipvs.Flush()
+}
+
+func (s *Server) AddService(args ServiceArgs, _ *Empty) error {
+	if args.Flags != nil {
+		return s.ipvs.AddServiceWithFlags(args.VIP, args.Port, args.Protocol, args.Sched, args.Flags)
+	}
+	return s.ipvs.AddService(args.VIP, args.Port, args.Protocol, args.Sched)
+}
+
+func (s *Server) AddServiceWithNetmask(args ServiceArgs, _ *Empty) error {
+	netmasker, ok := s.ipvs.(core.IpvsNetmasker)
+	if !ok {
+		return errNotSupported
+	}
+	return netmasker.AddServiceWithNetmask(args.VIP, args.Port, args.Protocol, args.Sched, args.Flags, args.Netmask)
+}
+
+func (s *Server) UpdateService(args ServiceArgs, _ *Empty) error {
+	updater, ok := s.ipvs.(core.IpvsServiceUpdater)
+	if !ok {
+		return errNotSupported
+	}
+	return updater.UpdateService(args.VIP, args.Port, args.Protocol, args.Sched, args.Flags, args.Netmask)
+}
+
+func (s *Server) DelService(args ServiceArgs, _ *Empty) error {
+	return s.ipvs.DelService(args.VIP, args.Port, args.Protocol)
+}
+
+func (s *Server) AddDestPort(args DestArgs, _ *Empty) error {
+	if args.Tunnel != nil {
+		tunneler, ok := s.ipvs.(core.IpvsTunneler)
+		if !ok {
+			return errNotSupported
+		}
+		return tunneler.AddDestTunnel(args.VIP, args.VPort, args.RIP, args.RPort, args.Protocol, args.Weight, args.Fwd,
+			*args.Tunnel)
+	}
+	return s.ipvs.AddDestPort(args.VIP, args.VPort, args.RIP, args.RPort, args.Protocol, args.Weight, args.Fwd)
+}
+
+func (s *Server) UpdateDestPort(args DestArgs, _ *Empty) error {
+	if args.Tunnel != nil {
+		tunneler, ok := s.ipvs.(core.IpvsTunneler)
+		if !ok {
+			return errNotSupported
+		}
+		return tunneler.UpdateDestTunnel(args.VIP, args.VPort, args.RIP, args.RPort, args.Protocol, args.Weight, args.Fwd,
+			*args.Tunnel)
+	}
+	return s.ipvs.UpdateDestPort(args.VIP, args.VPort, args.RIP, args.RPort, args.Protocol, args.Weight, args.Fwd)
+}
+
+func (s *Server) DelDestPort(args DestArgs, _ *Empty) error {
+	return s.ipvs.DelDestPort(args.VIP, args.VPort, args.RIP, args.RPort, args.Protocol)
+}
+
+func (s *Server) GetPools(_ Empty, pools *[]gnl2go.Pool) error {
+	var err error
+	*pools, err = s.ipvs.GetPools()
+	return err
+}
+
+func (s *Server) GetTimeouts(_ Empty, timeouts *core.IpvsTimeouts) error {
+	var err error
+	*timeouts, err = s.ipvs.GetTimeouts()
+	return err
+}
+
+func (s *Server) SetTimeouts(timeouts core.IpvsTimeouts, _ *Empty) error {
+	return s.ipvs.SetTimeouts(timeouts)
+}
+
+func (s *Server) GetActiveConns(args ServiceArgs, conns *map[string]uint32) error {
+	counter, ok := s.ipvs.(core.IpvsConnCounter)
+	if !ok {
+		return errNotSupported
+	}
+	var err error
+	*conns, err = counter.GetActiveConns(args.VIP, args.Port, args.Protocol)
+	return err
+}
+
+func (s *Server) GetServiceStats(_ Empty, stats *map[string]core.IpvsStats) error {
+	reader, ok := s.ipvs.(core.IpvsStatsReader)
+	if !ok {
+		return errNotSupported
+	}
+	var err error
+	*stats, err = reader.GetServiceStats()
+	return err
+}
+
+func (s *Server) ListConns(args ServiceArgs, conns *[]core.IpvsConn) error {
+	lister, ok := s.ipvs.(core.IpvsConnLister)
+	if !ok {
+		return errNotSupported
+	}
+	var err error
+	*conns, err = lister.ListConns(args.VIP, args.Port, args.Protocol)
+	return err
+}
+
+func (s *Server) AddFWMService(args FwmArgs, _ *Empty) error {
+	fwmarker, ok := s.ipvs.(core.IpvsFwmarker)
+	if !ok {
+		return errNotSupported
+	}
+	return fwmarker.AddFWMService(args.FWMark, args.Sched, args.AF)
+}
+
+func (s *Server) DelFWMService(args FwmArgs, _ *Empty) error {
+	fwmarker, ok := s.ipvs.(core.IpvsFwmarker)
+	if !ok {
+		return errNotSupported
+	}
+	return fwmarker.DelFWMService(args.FWMark, args.AF)
+}
+
+func (s *Server) AddFWMDest(args FwmArgs, _ *Empty) error {
+	fwmarker, ok := s.ipvs.(core.IpvsFwmarker)
+	if !ok {
+		return errNotSupported
+	}
+	return fwmarker.AddFWMDestFWD(args.FWMark, args.RIP, args.AF, args.Port, args.Weight, args.Fwd)
+}
+
+// Serve handles IPVS requests on the unix socket. Only the socket owner
+// and group are allowed to connect.
+func Serve(socketPath string, ipvs core.Ipvs) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(serviceName, &Server{ipvs: ipvs}); err != nil {
+		return err
+	}
+
+	// remove stale socket left by previous run
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the socket is created without access for others, so no other user could
+	// connect before its mode is set
+	umask := syscall.Umask(0o117)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(umask)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		return err
+	}
+
+	log.Infof("serving IPVS requests on %s", socketPath)
+	server.Accept(listener)
+	return nil
+}
+
+// Client implements core.Ipvs by forwarding operations to the helper.
+type Client struct {
+	socketPath string
+	mutex      sync.Mutex
+	client     *rpc.Client
+}
+
+// NewClient creates a client for the helper listening on socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+func (c *Client) call(method string, args interface{}, reply interface{}) error {
+	c.mutex.Lock()
+	client := c.client
+	c.mutex.Unlock()
+
+	if client != nil {
+		err := client.Call(serviceName+"."+method, args, reply)
+		if err != rpc.ErrShutdown {
+			return err
+		}
+		log.Warnf("connection to IPVS helper %s is lost, reconnecting", c.socketPath)
+	}
+
+	if err := c.Init(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	client = c.client
+	c.mutex.Unlock()
+	return client.Call(serviceName+"."+method, args, reply)
+}
+
+func (c *Client) Init() error {
+	client, err := rpc.Dial("unix", c.socketPath)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.client = client
+	return nil
+}
+
+func (c *Client) Exit() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+func (c *Client) Flush() error {
+	return c.call("Flush", Empty(false), new(Empty))
+}
+
+func (c *Client) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	return c.call("AddService", ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched}, new(Empty))
+}
+
+func (c *Client) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	return c.call("AddService",
+		ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags}, new(Empty))
+}
+
+func (c *Client) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	return c.call("AddServiceWithNetmask",
+		ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags, Netmask: netmask}, new(Empty))
+}
+
+func (c *Client) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	return c.call("UpdateService",
+		ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags, Netmask: netmask}, new(Empty))
+}
+
+func (c *Client) DelService(vip string, port uint16, protocol uint16) error {
+	return c.call("DelService", ServiceArgs{VIP: vip, Port: port, Protocol: protocol}, new(Empty))
+}
+
+func (c *Client) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return c.call("AddDestPort", DestArgs{
+		VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol, Weight: weight, Fwd: fwd}, new(Empty))
+}
+
+func (c *Client) UpdateDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	return c.call("UpdateDestPort", DestArgs{
+		VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol, Weight: weight, Fwd: fwd}, new(Empty))
+}
+
+func (c *Client) AddDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel core.DestTunnel) error {
+	return c.call("AddDestPort", DestArgs{
+		VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol, Weight: weight, Fwd: fwd, Tunnel: &tunnel},
+		new(Empty))
+}
+
+func (c *Client) UpdateDestTunnel(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32,
+	tunnel core.DestTunnel) error {
+	return c.call("UpdateDestPort", DestArgs{
+		VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol, Weight: weight, Fwd: fwd, Tunnel: &tunnel},
+		new(Empty))
+}
+
+func (c *Client) DelDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16) error {
+	return c.call("DelDestPort", DestArgs{VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol}, new(Empty))
+}
+
+func (c *Client) GetPools() ([]gnl2go.Pool, error) {
+	var pools []gnl2go.Pool
+	err := c.call("GetPools", Empty(false), &pools)
+	return pools, err
+}
+
+func (c *Client) GetTimeouts() (core.IpvsTimeouts, error) {
+	var timeouts core.IpvsTimeouts
+	err := c.call("GetTimeouts", Empty(false), &timeouts)
+	return timeouts, err
+}
+
+func (c *Client) SetTimeouts(timeouts core.IpvsTimeouts) error {
+	return c.call("SetTimeouts", timeouts, new(Empty))
+}
+
+func (c *Client) GetActiveConns(vip string, port uint16, protocol uint16) (map[string]uint32, error) {
+	var conns map[string]uint32
+	err := c.call("GetActiveConns", ServiceArgs{VIP: vip, Port: port, Protocol: protocol}, &conns)
+	return conns, err
+}
+
+func (c *Client) GetServiceStats() (map[string]core.IpvsStats, error) {
+	var stats map[string]core.IpvsStats
+	err := c.call("GetServiceStats", Empty(false), &stats)
+	return stats, err
+}
+
+func (c *Client) ListConns(vip string, port uint16, protocol uint16) ([]core.IpvsConn, error) {
+	var conns []core.IpvsConn
+	err := c.call("ListConns", ServiceArgs{VIP: vip, Port: port, Protocol: protocol}, &conns)
+	return conns, err
+}
+
+func (c *Client) AddFWMService(fwmark uint32, sched string, af uint16) error {
+	return c.call("AddFWMService", FwmArgs{FWMark: fwmark, AF: af, Sched: sched}, new(Empty))
+}
+
+func (c *Client) DelFWMService(fwmark uint32, af uint16) error {
+	return c.call("DelFWMService", FwmArgs{FWMark: fwmark, AF: af}, new(Empty))
+}
+
+func (c *Client) AddFWMDestFWD(fwmark uint32, rip string, vaf uint16, port uint16, weight int32, fwd uint32) error {
+	return c.call("AddFWMDest", FwmArgs{FWMark: fwmark, AF: vaf, RIP: rip, Port: port, Weight: weight, Fwd: fwd},
+		new(Empty))
+}
@@ -0,0 +1,136 @@
+package ipvsrpc
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tehnerd/gnl2go"
+)
+
+type recordingIpvs struct {
+	core.Ipvs
+	services []ServiceArgs
+	dests    []DestArgs
+	timeouts core.IpvsTimeouts
+}
+
+func (f *recordingIpvs) AddService(vip string, port uint16, protocol uint16, sched string) error {
+	f.services = append(f.services, ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched})
+	return nil
+}
+
+func (f *recordingIpvs) AddServiceWithFlags(vip string, port uint16, protocol uint16, sched string, flags []byte) error {
+	f.services = append(f.services, ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags})
+	return nil
+}
+
+func (f *recordingIpvs) AddServiceWithNetmask(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	f.services = append(f.services, ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags,
+		Netmask: netmask})
+	return nil
+}
+
+func (f *recordingIpvs) UpdateService(vip string, port uint16, protocol uint16, sched string, flags []byte,
+	netmask uint32) error {
+	for i, svc := range f.services {
+		if svc.VIP == vip && svc.Port == port && svc.Protocol == protocol {
+			f.services[i] = ServiceArgs{VIP: vip, Port: port, Protocol: protocol, Sched: sched, Flags: flags,
+				Netmask: netmask}
+			return nil
+		}
+	}
+	return errors.New("no such service")
+}
+
+func (f *recordingIpvs) DelService(vip string, port uint16, protocol uint16) error {
+	return errors.New("no such service")
+}
+
+func (f *recordingIpvs) AddDestPort(vip string, vport uint16, rip string, rport uint16, protocol uint16, weight int32, fwd uint32) error {
+	f.dests = append(f.dests, DestArgs{VIP: vip, VPort: vport, RIP: rip, RPort: rport, Protocol: protocol, Weight: weight, Fwd: fwd})
+	return nil
+}
+
+func (f *recordingIpvs) GetPools() ([]gnl2go.Pool, error) {
+	var pools []gnl2go.Pool
+	for _, svc := range f.services {
+		pool := gnl2go.Pool{Service: gnl2go.Service{VIP: svc.VIP, Port: svc.Port, Proto: svc.Protocol, Sched: svc.Sched}}
+		for _, dest := range f.dests {
+			pool.Dests = append(pool.Dests, gnl2go.Dest{IP: dest.RIP, Port: dest.RPort, Weight: dest.Weight})
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+func (f *recordingIpvs) GetServiceStats() (map[string]core.IpvsStats, error) {
+	stats := make(map[string]core.IpvsStats)
+	for _, svc := range f.services {
+		service := gnl2go.Service{VIP: svc.VIP, Port: svc.Port, Proto: svc.Protocol}
+		stats[service.ToString()] = core.IpvsStats{Conns: 1}
+	}
+	return stats, nil
+}
+
+func (f *recordingIpvs) GetTimeouts() (core.IpvsTimeouts, error) {
+	return f.timeouts, nil
+}
+
+func (f *recordingIpvs) SetTimeouts(timeouts core.IpvsTimeouts) error {
+	f.timeouts = timeouts
+	return nil
+}
+
+func TestClientServerRoundTrip(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "ipvs.sock")
+	ipvs := &recordingIpvs{}
+	go Serve(socketPath, ipvs)
+
+	c := NewClient(socketPath)
+	require.Eventually(t, func() bool { return c.Init() == nil }, time.Second, 10*time.Millisecond)
+	defer c.Exit()
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	flags := gnl2go.U32ToBinFlags(gnl2go.IP_VS_SVC_F_SCHED_SH_PORT)
+	assert.NoError(t, c.AddService("10.0.0.1", 80, 6, "wrr"))
+	assert.NoError(t, c.AddServiceWithFlags("10.0.0.2", 80, 6, "sh", flags))
+	assert.NoError(t, c.AddDestPort("10.0.0.1", 80, "10.1.0.1", 8080, 6, 100, gnl2go.IPVS_MASQUERADING))
+	assert.EqualError(t, c.DelService("10.0.0.3", 80, 6), "no such service")
+
+	pools, err := c.GetPools()
+	require.NoError(t, err)
+	require.Len(t, pools, 2)
+	assert.Equal(t, "10.0.0.1", pools[0].Service.VIP)
+	assert.Equal(t, int32(100), pools[0].Dests[0].Weight)
+	assert.Equal(t, flags, ipvs.services[1].Flags)
+
+	require.Implements(t, (*core.IpvsNetmasker)(nil), c)
+	assert.NoError(t, c.AddServiceWithNetmask("fd00::1", 80, 6, "sh", flags, 64))
+	assert.Equal(t, ServiceArgs{VIP: "fd00::1", Port: 80, Protocol: 6, Sched: "sh", Flags: flags, Netmask: 64},
+		ipvs.services[2])
+
+	require.Implements(t, (*core.IpvsServiceUpdater)(nil), c)
+	assert.NoError(t, c.UpdateService("fd00::1", 80, 6, "mh", nil, 48))
+	assert.Equal(t, ServiceArgs{VIP: "fd00::1", Port: 80, Protocol: 6, Sched: "mh", Netmask: 48}, ipvs.services[2])
+	assert.EqualError(t, c.UpdateService("10.0.0.3", 80, 6, "rr", nil, 32), "no such service")
+
+	require.Implements(t, (*core.IpvsStatsReader)(nil), c)
+	stats, err := c.GetServiceStats()
+	require.NoError(t, err)
+	assert.Len(t, stats, 3)
+	assert.Equal(t, core.IpvsStats{Conns: 1}, stats[pools[0].Service.ToString()])
+
+	assert.NoError(t, c.SetTimeouts(core.IpvsTimeouts{TCP: 7200}))
+	timeouts, err := c.GetTimeouts()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7200), timeouts.TCP)
+}
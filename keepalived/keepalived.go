@@ -0,0 +1,306 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package keepalived converts virtual servers of keepalived.conf into GORB services.
+package keepalived
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/util"
+)
+
+// Possible parsing errors.
+var (
+	ErrUnbalancedBraces = errors.New("unbalanced braces in keepalived configuration")
+)
+
+// lvs forwarding methods and their GORB names
+var fwdMethods = map[string]string{"nat": "nat", "dr": "dr", "tun": "tunnel"}
+
+// scheduler flags supported by keepalived as standalone keywords
+var schedulerFlags = []string{"sh-port", "sh-fallback", "mh-port", "mh-fallback"}
+
+// block is a statement of keepalived configuration with optional nested statements.
+type block struct {
+	name     string
+	args     []string
+	children []*block
+}
+
+func (b *block) child(name string) *block {
+	for _, child := range b.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func (b *block) value(name string) (string, bool) {
+	if child := b.child(name); child != nil && len(child.args) > 0 {
+		return child.args[0], true
+	}
+	return "", false
+}
+
+// tokenize splits configuration into tokens. Statements are separated by "\n" tokens.
+func tokenize(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			if strings.HasPrefix(field, "#") || strings.HasPrefix(field, "!") {
+				break
+			}
+			// braces are usually separated by spaces, but not always
+			for field != "" {
+				i := strings.IndexAny(field, "{}")
+				if i < 0 {
+					tokens = append(tokens, strings.Trim(field, `"`))
+					break
+				}
+				if i > 0 {
+					tokens = append(tokens, strings.Trim(field[:i], `"`))
+				}
+				tokens = append(tokens, field[i:i+1])
+				field = field[i+1:]
+			}
+		}
+		tokens = append(tokens, "\n")
+	}
+	return tokens, scanner.Err()
+}
+
+// parse builds a tree of configuration statements.
+func parse(r io.Reader) (*block, error) {
+	tokens, err := tokenize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &block{}
+	stack := []*block{root}
+	var statement []string
+	flush := func() {
+		if len(statement) > 0 {
+			top := stack[len(stack)-1]
+			top.children = append(top.children, &block{name: statement[0], args: statement[1:]})
+			statement = nil
+		}
+	}
+	for _, token := range tokens {
+		switch token {
+		case "{":
+			b := &block{}
+			if len(statement) > 0 {
+				b.name, b.args = statement[0], statement[1:]
+			}
+			statement = nil
+			top := stack[len(stack)-1]
+			top.children = append(top.children, b)
+			stack = append(stack, b)
+		case "}":
+			flush()
+			if len(stack) == 1 {
+				return nil, ErrUnbalancedBraces
+			}
+			stack = stack[:len(stack)-1]
+		case "\n":
+			flush()
+		default:
+			statement = append(statement, token)
+		}
+	}
+	flush()
+	if len(stack) != 1 {
+		return nil, ErrUnbalancedBraces
+	}
+	return root, nil
+}
+
+// Result is a set of GORB services converted from keepalived configuration.
+type Result struct {
+	Services map[string]*core.ServiceConfig
+	// Warnings about configuration which couldn't be converted exactly
+	Warnings []string
+}
+
+func (r *Result) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Convert parses keepalived configuration and converts its virtual servers
+// into GORB services. Service IDs are "<host>-<port>-<protocol>",
+// backend IDs are "<host>-<port>".
+func Convert(r io.Reader) (*Result, error) {
+	root, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Services: make(map[string]*core.ServiceConfig)}
+	for _, b := range root.children {
+		switch b.name {
+		case "virtual_server":
+			result.convertVirtualServer(b)
+		case "virtual_server_group":
+			result.warnf("virtual_server_group %s is not supported", strings.Join(b.args, " "))
+		case "include":
+			result.warnf("include %s is not supported, convert included files separately", strings.Join(b.args, " "))
+		}
+	}
+	return result, nil
+}
+
+func (r *Result) convertVirtualServer(b *block) {
+	name := strings.Join(b.args, " ")
+	if len(b.args) != 2 || b.args[0] == "fwmark" || b.args[0] == "group" {
+		r.warnf("virtual_server %s is not supported, only IP and port are", name)
+		return
+	}
+	port, err := strconv.ParseUint(b.args[1], 10, 16)
+	if err != nil {
+		r.warnf("virtual_server %s has invalid port", name)
+		return
+	}
+
+	options := &core.ServiceOptions{Host: b.args[0], Port: uint16(port), Protocol: "tcp"}
+	if protocol, ok := b.value("protocol"); ok {
+		options.Protocol = strings.ToLower(protocol)
+	}
+	if lbAlgo, ok := b.value("lb_algo"); ok {
+		options.LbMethod = lbAlgo
+	}
+	if lbKind, ok := b.value("lb_kind"); ok {
+		if method, ok := fwdMethods[strings.ToLower(lbKind)]; ok {
+			options.FwdMethod = method
+		} else {
+			r.warnf("virtual_server %s: lb_kind %s is not supported", name, lbKind)
+		}
+	}
+	if b.child("persistence_timeout") != nil {
+		options.Persistent = true
+	}
+	var flags []string
+	for _, flag := range schedulerFlags {
+		if b.child(flag) != nil {
+			flags = append(flags, flag)
+		}
+	}
+	options.ShFlags = strings.Join(flags, "|")
+
+	vsID := fmt.Sprintf("%s-%d-%s", options.Host, options.Port, options.Protocol)
+	config := &core.ServiceConfig{ServiceOptions: options, ServiceBackends: make(map[string]*core.BackendOptions)}
+	var weights []string
+	for _, child := range b.children {
+		if child.name != "real_server" {
+			continue
+		}
+		if len(child.args) != 2 {
+			r.warnf("virtual_server %s: real_server %s is not supported", name, strings.Join(child.args, " "))
+			continue
+		}
+		port, err := strconv.ParseUint(child.args[1], 10, 16)
+		if err != nil {
+			r.warnf("virtual_server %s: real_server %s has invalid port", name, strings.Join(child.args, " "))
+			continue
+		}
+		backend := &core.BackendOptions{Host: child.args[0], Port: uint16(port)}
+		config.ServiceBackends[fmt.Sprintf("%s-%d", backend.Host, backend.Port)] = backend
+
+		if weight, ok := child.value("weight"); ok {
+			weights = append(weights, weight)
+		}
+		check := r.convertCheck(name, child)
+		if options.Pulse == nil {
+			options.Pulse = check
+		} else if !reflect.DeepEqual(options.Pulse, check) {
+			r.warnf("virtual_server %s: real servers have different checks, the first one is used", name)
+		}
+	}
+	if options.Pulse != nil {
+		if delayLoop, ok := b.value("delay_loop"); ok {
+			options.Pulse.Interval = delayLoop + "s"
+		}
+	}
+	for _, weight := range weights {
+		if weight != weights[0] {
+			r.warnf("virtual_server %s: per real server weights are not supported", name)
+			break
+		}
+	}
+	r.Services[vsID] = config
+}
+
+// convertCheck converts health check of a real server into pulse options.
+func (r *Result) convertCheck(name string, b *block) *pulse.Options {
+	for _, check := range b.children {
+		options := &pulse.Options{Args: util.DynamicMap{}}
+		switch check.name {
+		case "TCP_CHECK":
+			options.Type = "tcp"
+		case "HTTP_GET", "SSL_GET":
+			options.Type = "http"
+			if check.name == "SSL_GET" {
+				options.Args["scheme"] = "https"
+			}
+			if url := check.child("url"); url != nil {
+				if path, ok := url.value("path"); ok {
+					options.Args["path"] = path
+				}
+				if status, ok := url.value("status_code"); ok {
+					if code, err := strconv.Atoi(status); err == nil {
+						options.Args["expect"] = code
+					}
+				}
+			}
+		case "MISC_CHECK", "SMTP_CHECK", "DNS_CHECK", "BFD_CHECK", "UDP_CHECK", "PING_CHECK", "FILE_CHECK":
+			r.warnf("virtual_server %s: %s is not supported, pulse is disabled", name, check.name)
+			return &pulse.Options{Type: "none"}
+		default:
+			continue
+		}
+		if port, ok := check.value("connect_port"); ok {
+			if value, err := strconv.Atoi(port); err == nil {
+				options.Args["port"] = value
+			}
+		}
+		if timeout, ok := check.value("connect_timeout"); ok {
+			if value, err := strconv.ParseFloat(timeout, 64); err == nil {
+				options.Args["timeout"] = int(math.Ceil(value))
+			}
+		}
+		if len(options.Args) == 0 {
+			options.Args = nil
+		}
+		return options
+	}
+	return &pulse.Options{Type: "none"}
+}
@@ -0,0 +1,99 @@
+package keepalived
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const config = `
+! Configuration File for keepalived
+global_defs {
+    router_id LVS_1
+}
+
+virtual_server 10.0.0.1 80 {
+    delay_loop 6
+    lb_algo sh
+    lb_kind DR
+    persistence_timeout 50
+    protocol TCP
+    sh-port
+
+    real_server 10.1.0.1 8080 {
+        weight 1
+        HTTP_GET {
+            url {
+              path /health
+              status_code 204
+            }
+            connect_port 8081
+            connect_timeout 2.5
+        }
+    }
+    real_server 10.1.0.2 8080 {
+        weight 2
+        HTTP_GET {
+            url { path /health
+              status_code 204 }
+            connect_port 8081
+            connect_timeout 2.5
+        }
+    }
+}
+
+virtual_server 10.0.0.2 53 {
+    protocol UDP
+    real_server 10.1.0.3 53 {
+        MISC_CHECK {
+            misc_path "/usr/local/bin/check_dns"
+        }
+    }
+}
+
+virtual_server fwmark 1 {
+    lb_algo rr
+}
+`
+
+func TestConvert(t *testing.T) {
+	result, err := Convert(strings.NewReader(config))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]*core.ServiceConfig{
+		"10.0.0.1-80-tcp": {
+			ServiceOptions: &core.ServiceOptions{Host: "10.0.0.1", Port: 80, Protocol: "tcp", LbMethod: "sh",
+				ShFlags: "sh-port", Persistent: true, FwdMethod: "dr", Pulse: &pulse.Options{
+					Type: "http", Interval: "6s",
+					Args: util.DynamicMap{"path": "/health", "expect": 204, "port": 8081, "timeout": 3}}},
+			ServiceBackends: map[string]*core.BackendOptions{
+				"10.1.0.1-8080": {Host: "10.1.0.1", Port: 8080},
+				"10.1.0.2-8080": {Host: "10.1.0.2", Port: 8080},
+			},
+		},
+		"10.0.0.2-53-udp": {
+			ServiceOptions: &core.ServiceOptions{Host: "10.0.0.2", Port: 53, Protocol: "udp",
+				Pulse: &pulse.Options{Type: "none"}},
+			ServiceBackends: map[string]*core.BackendOptions{
+				"10.1.0.3-53": {Host: "10.1.0.3", Port: 53},
+			},
+		},
+	}, result.Services)
+	assert.Equal(t, []string{
+		"virtual_server 10.0.0.1 80: per real server weights are not supported",
+		"virtual_server 10.0.0.2 53: MISC_CHECK is not supported, pulse is disabled",
+		"virtual_server fwmark 1 is not supported, only IP and port are",
+	}, result.Warnings)
+}
+
+func TestConvertUnbalancedBraces(t *testing.T) {
+	_, err := Convert(strings.NewReader("virtual_server 10.0.0.1 80 {\n"))
+	assert.Equal(t, ErrUnbalancedBraces, err)
+	_, err = Convert(strings.NewReader("}\n"))
+	assert.Equal(t, ErrUnbalancedBraces, err)
+}
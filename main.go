@@ -21,13 +21,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
-	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/hooks"
+	"github.com/qk4l/gorb/ipvsrpc"
+	"github.com/qk4l/gorb/nameserver"
+	"github.com/qk4l/gorb/pulse"
+	"github.com/qk4l/gorb/snmp"
+	"github.com/qk4l/gorb/tracing"
+	"github.com/qk4l/gorb/ui"
 	"github.com/qk4l/gorb/util"
 
 	"github.com/gorilla/mux"
@@ -36,39 +47,167 @@ import (
 	_ "net/http/pprof"
 	"strings"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sys/unix"
 )
 
 var (
 	// Version get dynamically set to git rev by ldflags at build time
 	Version = "0.3.0"
 
-	debug        = flag.Bool("v", false, "enable verbose output")
-	device       = flag.String("i", "eth0", "default interface to bind services on")
-	flush        = flag.Bool("f", false, "flush IPVS pools on start")
-	listen       = flag.String("l", ":4672", "endpoint to listen for HTTP requests")
-	consul       = flag.String("c", "", "URL for Consul HTTP API")
-	vipInterface = flag.String("vipi", "", "interface to add VIPs")
-	storeURLs    = flag.String("store", "", "comma delimited list of store urls for sync data. All urls must have"+
+	debug         = flag.Bool("v", false, "enable verbose output")
+	device        = flag.String("i", "eth0", "default interface to bind services on")
+	flush         = flag.Bool("f", false, "flush IPVS pools on start")
+	listen        = flag.String("l", ":4672", "comma delimited endpoints to listen for HTTP requests, unix:///path for a unix socket")
+	reusePort     = flag.Bool("l-reuseport", false, "set SO_REUSEPORT on API listeners, so processes could share them")
+	socketMode    = flag.String("l-mode", "0660", "octal file mode of the unix socket the API listens on")
+	webUI         = flag.Bool("ui", false, "serve embedded web UI on /ui")
+	consul        = flag.String("c", "", "URL for Consul HTTP API")
+	consulProxy   = flag.String("c-proxy", "", "proxy URL of Consul requests, \"direct\" to ignore HTTP_PROXY")
+	vipInterface  = flag.String("vipi", "", "interface to add VIPs")
+	hookExec      = flag.String("hook-exec", "", "shell command run when a backend is ejected or restored")
+	hookURL       = flag.String("hook-url", "", "URL receiving POST request when a backend is ejected or restored")
+	hookTimeout   = flag.String("hook-timeout", "10s", "timeout of a single hook run")
+	secretDir     = flag.String("pulse-secret-dir", "", "directory of files pulse args could reference, none if empty")
+	backupKey     = flag.String("backup-key-file", "", "file with a secret key signing backups. Backups are disabled if empty")
+	registerToken = flag.String("register-token-file", "", "file with a token backends registering themselves"+
+		" must present. Self-registration is disabled if empty")
+	locality = flag.String("locality", "", "locality label of this node, e.g. rack or availability zone."+
+		" Used by services with locality-aware weighting")
+	adoptVips = flag.Bool("adopt-vips", false, "remove VIPs already present on the interface when their services"+
+		" are created along with the services. Such VIPs are kept by default")
+	deferVips = flag.Bool("defer-vips", false, "add VIPs of services created before the first store sync is over"+
+		" once a backend of the service is healthy, so traffic isn't attracted on cold start")
+	vipInterfaces = flag.String("vip-interfaces", "", "comma delimited interfaces services could select for their"+
+		" VIPs with vip_interface option instead of -vipi, e.g. sub-interfaces of VLANs")
+	backendCIDRs = flag.String("backend-cidrs", "", "comma delimited networks backends are allowed in, e.g."+
+		" 10.0.0.0/8,172.16.0.0/12,192.168.0.0/16. Any address is allowed if empty")
+	strictVersions = flag.Bool("strict-versions", false, "require version of services and backends on their"+
+		" modification via If-Match header or version field of the body")
+	deleteGracePeriod = flag.String("delete-grace-period", "0", "keep deleted services and backends out of traffic"+
+		" for the period before their removal, so deletion could be undone. Zero removes them at once")
+	removalDelay = flag.String("removal-delay", "0s", "keep backends removed from the store or missing heartbeats"+
+		" at weight 0 for the period before their removal, so short flaps don't churn IPVS. Zero removes them at once")
+	eventHistory = flag.Int("event-history", 50, "number of lifecycle events kept per service. Zero disables"+
+		" the history")
+	metricsBackendLabels = flag.String("metrics-backend-labels", "backend_name,backend_host,backend_port",
+		"comma delimited labels of backend metrics. Drop some of them to reduce cardinality")
+	metricsLabels = flag.String("metrics-labels", "", "comma delimited keys of service labels added to its"+
+		" metrics")
+	metricsListen = flag.String("metrics-listen", "", "endpoint to serve /metrics and /healthz on instead of -l,"+
+		" so the management API could be firewalled apart from monitoring, e.g. :9672")
+	metricsAggregated = flag.Bool("metrics-aggregated", false, "export per service metrics only, without"+
+		" per backend series")
+	metricsPushMode     = flag.String("metrics-push-mode", core.MetricsPushGateway, "pushgateway or remote-write")
+	metricsPushInterval = flag.String("metrics-push-interval", "30s", "how often metrics are pushed")
+	metricsPushJob      = flag.String("metrics-push-job", "gorb", "job label of pushed metrics")
+	metricsPushURL      = flag.String("metrics-push-url", "", "URL of Pushgateway or Prometheus remote write endpoint"+
+		" metrics are pushed to for nodes which can't be scraped. Disabled if empty")
+	statsProtocol = flag.String("stats-protocol", core.StatsProtocolStatsD, "statsd or graphite")
+	statsPrefix   = flag.String("stats-prefix", "gorb", "prefix of emitted stats paths")
+	statsInterval = flag.String("stats-interval", "10s", "how often stats are emitted")
+	statsAddress  = flag.String("stats-address", "", "host:port of StatsD or Graphite server health, weights and"+
+		" health check results of services and backends are emitted to. Disabled if empty")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "base URL of OTLP/HTTP collector receiving traces of API"+
+		" requests, store syncs and IPVS calls, e.g. http://localhost:4318. Tracing is disabled if empty")
+	prometheusURL = flag.String("prometheus-url", "", "URL of Prometheus server weight metrics of services are"+
+		" queried from, e.g. http://localhost:9090")
+	weightMetricsInterval = flag.String("weight-metrics-interval", "30s", "how often weight metrics of"+
+		" services are evaluated")
+	snmpCommunity = flag.String("snmp-community", "public", "read-only community of embedded SNMP agent")
+	snmpRoot      = flag.String("snmp-root", snmp.DefaultRoot, "OID of GORB-MIB served by embedded SNMP agent")
+	snmpListen    = flag.String("snmp-listen", "", "UDP address of embedded SNMPv2c agent exposing states of"+
+		" services and backends with GORB-MIB, e.g. :161. Disabled if empty")
+	dnsListen = flag.String("dns-listen", "", "address of embedded DNS responder answering DNS names of services"+
+		" with their VIPs, e.g. :53. Disabled if empty")
+	dnsTTL    = flag.String("dns-ttl", "5s", "TTL of answers of embedded DNS responder")
+	storeURLs = flag.String("store", "", "comma delimited list of store urls for sync data. All urls must have"+
 		" identical schemes and paths.")
+	storeOverlays = flag.String("store-overlays", "", "semicolon delimited list of additional stores layered on top of"+
+		" -store in increasing order of precedence. Each entry follows the same rules as -store.")
 	storeUseTLS      = flag.Bool("store-use-tls", false, "Use TLS to connect to store backend")
 	storeSyncTime    = flag.Int64("store-sync-time", 60, "sync-time for store")
-	storeServicePath = flag.String("store-service-path", "services", "store service path")
-	storeBackendPath = flag.String("store-backend-path", "backends", "store backend path")
+	storeSyncTimeout = flag.String("store-sync-timeout", "60s", "timeout of a single store sync")
+	syncWorkers      = flag.Int("sync-workers", core.DefaultSyncWorkers, "number of concurrent workers resolving"+
+		" hosts and exposing services during the first store sync")
+	storeServicePath  = flag.String("store-service-path", "services", "store service path")
+	storeBackendPath  = flag.String("store-backend-path", "backends", "store backend path")
+	storeCanonicalIDs = flag.Bool("store-canonical-ids", false, "derive service IDs from host, port and protocol and"+
+		" backend IDs from host and port instead of store keys")
+	storeAgeKey = flag.String("store-age-key", "", "file with age identities decrypting store values encrypted"+
+		" with age or SOPS")
+	storeProxy = flag.String("store-proxy", "", "proxy URL of requests to consul and etcd stores, \"direct\" to"+
+		" ignore HTTP_PROXY and HTTPS_PROXY")
+	follow = flag.String("follow", "", "URL of the primary GORB API, e.g. http://10.0.0.1:4672. Its services and"+
+		" backend pools are mirrored like a store every -store-sync-time seconds. Can't be used with -store")
+	noIpvs = flag.Bool("no-ipvs", false, "use in-memory IPVS instead of the kernel one. Neither privileges nor"+
+		" ip_vs module are required, useful for testing and store content validation")
+	ipvsHelper = flag.String("ipvs-helper", "", "run as privileged IPVS helper serving requests on the unix socket")
+	ipvsSocket = flag.String("ipvs-socket", "", "unix socket of privileged IPVS helper. GORB doesn't need privileges"+
+		" to manage IPVS if set")
+	ledger         = flag.String("ledger", "", "file IPVS services and destinations created by GORB are recorded in")
+	cleanupOrphans = flag.Bool("cleanup-orphans", false, "remove IPVS entries recorded in the ledger by a previous"+
+		" run on start, entries created by others are kept")
+	expireConns = flag.Bool("expire-conns", false, "expire IPVS connections and persistence templates of backends"+
+		" going down, so sticky clients fail over at once instead of timing out")
+	ipvsQueueDepth    = flag.Int("ipvs-queue-depth", core.DefaultIpvsQueueDepth, "number of queued IPVS calls, more calls fail")
+	ipvsTimeoutTCP    = flag.Uint("ipvs-timeout-tcp", 0, "IPVS timeout in seconds for established TCP sessions. 0 keeps kernel value")
+	ipvsTimeoutTCPFin = flag.Uint("ipvs-timeout-tcpfin", 0, "IPVS timeout in seconds for TCP sessions after receiving FIN. 0 keeps kernel value")
+	ipvsTimeoutUDP    = flag.Uint("ipvs-timeout-udp", 0, "IPVS timeout in seconds for UDP packets. 0 keeps kernel value")
+	apiHeaderTimeout  = flag.String("api-header-timeout", "10s", "time to read headers of an API request")
+	apiReadTimeout    = flag.String("api-read-timeout", "60s", "time to read an API request including its body")
+	apiWriteTimeout   = flag.String("api-write-timeout", "120s", "time to handle an API request and write its"+
+		" response, it must exceed -store-sync-timeout")
+	apiIdleTimeout = flag.String("api-idle-timeout", "120s", "time idle keep-alive API connections are kept open")
+	apiMaxHeader   = flag.Int("api-max-header-bytes", 64<<10, "maximum size of API request headers in bytes")
+	apiMaxBody     = flag.Int64("api-max-body", 1<<20, "maximum size of API request bodies in bytes")
+	apiMaxBulkBody = flag.Int64("api-max-bulk-body", 32<<20, "maximum size of request bodies of restores, imports"+
+		" and plans in bytes")
 )
 
 func main() {
+	if found, err := runCommand(os.Args[1:]); found {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Called first to interrupt bootstrap and display usage if the user passed -h.
 	flag.Parse()
 
 	if *debug {
-		log.SetLevel(log.DebugLevel)
+		util.SetLogLevel("", log.DebugLevel.String())
 	}
 
 	log.Info("starting GORB Daemon v" + Version)
+	pulse.SetSecretDir(*secretDir)
 
-	if os.Geteuid() != 0 {
-		log.Fatalf("this program has to be run with root priveleges to access IPVS")
+	managesVips := *vipInterface != "" || *vipInterfaces != ""
+	if *noIpvs && managesVips {
+		log.Fatalf("VIP interface could not be used with in-memory IPVS")
+	}
+
+	kernelIpvs := *ipvsSocket == "" && !*noIpvs
+	if kernelIpvs || managesVips {
+		if err := core.Preflight(core.DefaultLbMethod); err != nil {
+			log.Fatalf("preflight check failed: %s", err)
+		}
+	}
+
+	if *ipvsHelper != "" {
+		runIpvsHelper(*ipvsHelper)
+		return
+	}
+
+	var ipvs core.Ipvs
+	if *noIpvs {
+		log.Warn("using in-memory IPVS, kernel IPVS will not be changed")
+		ipvs = core.NewMemoryIpvs()
+	} else if *ipvsSocket != "" {
+		log.Infof("using privileged IPVS helper on %s", *ipvsSocket)
+		ipvs = ipvsrpc.NewClient(*ipvsSocket)
 	}
 
 	hostIPs, err := util.InterfaceIPs(*device)
@@ -77,27 +216,142 @@ func main() {
 		log.Fatalf("error while obtaining interface addresses: %s", err)
 	}
 
-	listenAddr, err := net.ResolveTCPAddr("tcp", *listen)
+	// the API is exposed in Consul with the first TCP endpoint, it isn't
+	// exposed when it's served on unix sockets only
 	listenPort := uint16(0)
-
-	if err != nil {
-		log.Fatalf("error while obtaining listening port from '%s': %s", *listen, err)
-	} else {
+	debugHost := "localhost"
+	endpoints := splitList(*listen)
+	if len(endpoints) == 0 {
+		log.Fatalf("no endpoint to listen for HTTP requests")
+	}
+	for _, endpoint := range endpoints {
+		if strings.HasPrefix(endpoint, "unix://") {
+			continue
+		}
+		listenAddr, err := net.ResolveTCPAddr("tcp", endpoint)
+		if err != nil {
+			log.Fatalf("error while obtaining listening port from '%s': %s", endpoint, err)
+		}
+		if listenPort != 0 {
+			continue
+		}
 		listenPort = uint16(listenAddr.Port)
+		if listenAddr.IP != nil {
+			debugHost = listenAddr.IP.String()
+		}
+	}
+	socketPerm, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil || socketPerm > 0777 {
+		log.Fatalf("invalid unix socket mode '%s'", *socketMode)
+	}
+	var apiTimeouts [4]time.Duration
+	for i, timeout := range []*string{apiHeaderTimeout, apiReadTimeout, apiWriteTimeout, apiIdleTimeout} {
+		if apiTimeouts[i], err = util.ParseInterval(*timeout); err != nil {
+			log.Fatalf("error while parsing API timeout '%s': %s", *timeout, err)
+		}
+	}
+	// servers of the API and metrics are hardened against slow and oversized requests
+	newServer := func(handler http.Handler) *http.Server {
+		return &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: apiTimeouts[0],
+			ReadTimeout:       apiTimeouts[1],
+			WriteTimeout:      apiTimeouts[2],
+			IdleTimeout:       apiTimeouts[3],
+			MaxHeaderBytes:    *apiMaxHeader,
+		}
 	}
 
 	if *debug {
 		go func() {
-			log.Println(http.ListenAndServe(fmt.Sprintf("%s:6061", listenAddr.IP), nil))
+			log.Println(http.ListenAndServe(net.JoinHostPort(debugHost, "6061"), nil))
 		}()
 	}
 
+	var backupKeyData []byte
+	if *backupKey != "" {
+		if backupKeyData, err = os.ReadFile(*backupKey); err != nil {
+			log.Fatalf("error while reading backup key: %s", err)
+		}
+		backupKeyData = bytes.TrimSpace(backupKeyData)
+	}
+
+	var registerTokenData []byte
+	if *registerToken != "" {
+		if registerTokenData, err = os.ReadFile(*registerToken); err != nil {
+			log.Fatalf("error while reading registration token: %s", err)
+		}
+		registerTokenData = bytes.TrimSpace(registerTokenData)
+	}
+
+	shutdownTracing, err := tracing.Init(tracing.Options{Endpoint: *otlpEndpoint})
+	if err != nil {
+		log.Fatalf("error while initializing tracing: %s", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	hookTimeoutDuration, err := util.ParseInterval(*hookTimeout)
+	if err != nil {
+		log.Fatalf("error while parsing hook timeout '%s': %s", *hookTimeout, err)
+	}
+
+	deleteGracePeriodDuration, err := util.ParseInterval(*deleteGracePeriod)
+	if err != nil {
+		log.Fatalf("error while parsing delete grace period '%s': %s", *deleteGracePeriod, err)
+	}
+
+	removalDelayDuration, err := util.ParseInterval(*removalDelay)
+	if err != nil {
+		log.Fatalf("error while parsing removal delay '%s': %s", *removalDelay, err)
+	}
+
+	weightMetricsIntervalDuration, err := util.ParseInterval(*weightMetricsInterval)
+	if err != nil {
+		log.Fatalf("error while parsing weight metrics interval '%s': %s", *weightMetricsInterval, err)
+	}
+
+	storeSyncTimeoutDuration, err := util.ParseInterval(*storeSyncTimeout)
+	if err != nil {
+		log.Fatalf("error while parsing store sync timeout '%s': %s", *storeSyncTimeout, err)
+	}
+
+	backendNetworks, err := core.ParseBackendNetworks(splitList(*backendCIDRs))
+	if err != nil {
+		log.Fatalf("error while parsing backend networks '%s': %s", *backendCIDRs, err)
+	}
+
 	ctx, err := core.NewContext(core.ContextOptions{
 		Disco:        *consul,
+		DiscoProxy:   *consulProxy,
 		Endpoints:    hostIPs,
 		Flush:        *flush,
 		ListenPort:   listenPort,
-		VipInterface: *vipInterface})
+		VipInterface: *vipInterface,
+		Locality:     *locality,
+		Hooks:        hooks.Options{Exec: *hookExec, URL: *hookURL, Timeout: hookTimeoutDuration},
+		Ipvs:         ipvs,
+		IpvsTimeouts: core.IpvsTimeouts{
+			TCP:    uint32(*ipvsTimeoutTCP),
+			TCPFin: uint32(*ipvsTimeoutTCPFin),
+			UDP:    uint32(*ipvsTimeoutUDP)},
+		IpvsQueueDepth:    *ipvsQueueDepth,
+		Ledger:            *ledger,
+		CleanupOrphans:    *cleanupOrphans,
+		ExpireConns:       *expireConns,
+		VipInterfaces:     splitList(*vipInterfaces),
+		AdoptVips:         *adoptVips,
+		DeferVips:         *deferVips,
+		SyncWorkers:       *syncWorkers,
+		CheckSchedulers:   kernelIpvs,
+		BackendNetworks:   backendNetworks,
+		StrictVersions:    *strictVersions,
+		DeleteGracePeriod: deleteGracePeriodDuration,
+		RemovalDelay:      removalDelayDuration,
+		EventHistory:      *eventHistory,
+		Tracing:           *otlpEndpoint != "",
+
+		PrometheusURL:         *prometheusURL,
+		WeightMetricsInterval: weightMetricsIntervalDuration})
 
 	if err != nil {
 		log.Fatalf("error while initializing server context: %s", err)
@@ -106,30 +360,286 @@ func main() {
 	// While it's not strictly required, close IPVS socket explicitly.
 	defer ctx.Close()
 	var store *core.Store
+	if *follow != "" && *storeURLs != "" {
+		log.Fatal("-follow and -store are mutually exclusive")
+	}
 	// sync with external store
 	if storeURLs != nil && len(*storeURLs) > 0 {
-		urls := strings.Split(*storeURLs, ",")
-		store, err = core.NewStore(urls, *storeServicePath, *storeBackendPath, *storeSyncTime, *storeUseTLS, ctx)
+		store, err = core.NewStore(core.StoreOptions{
+			URLs:         strings.Split(*storeURLs, ","),
+			Overlays:     splitOverlays(*storeOverlays),
+			ServicePath:  *storeServicePath,
+			BackendPath:  *storeBackendPath,
+			SyncTime:     *storeSyncTime,
+			SyncTimeout:  storeSyncTimeoutDuration,
+			UseTLS:       *storeUseTLS,
+			CanonicalIDs: *storeCanonicalIDs,
+			AgeKeyFile:   *storeAgeKey,
+			Proxy:        *storeProxy}, ctx)
 		if err != nil {
 			log.Fatalf("error while initializing external store sync: %s", err)
 		}
 		defer store.Close()
+	} else if *follow != "" {
+		store, err = core.NewStore(core.StoreOptions{
+			Primary:     *follow,
+			SyncTime:    *storeSyncTime,
+			SyncTimeout: storeSyncTimeoutDuration,
+			Proxy:       *storeProxy}, ctx)
+		if err != nil {
+			log.Fatalf("error while initializing sync with primary: %s", err)
+		}
+		defer store.Close()
 	}
 
-	core.RegisterPrometheusExporter(ctx)
+	if err := core.RegisterPrometheusExporter(ctx, core.ExporterOptions{
+		BackendLabels:  splitList(*metricsBackendLabels),
+		MetadataLabels: splitList(*metricsLabels),
+		Aggregated:     *metricsAggregated}); err != nil {
+		log.Fatalf("error while registering metrics exporter: %s", err)
+	}
+	if *metricsPushURL != "" {
+		interval, err := util.ParseInterval(*metricsPushInterval)
+		if err != nil {
+			log.Fatalf("error while parsing metrics push interval '%s': %s", *metricsPushInterval, err)
+		}
+		pusher, err := core.NewMetricsPusher(prometheus.DefaultGatherer, core.MetricsPushOptions{
+			URL: *metricsPushURL, Mode: *metricsPushMode, Interval: interval, Job: *metricsPushJob})
+		if err != nil {
+			log.Fatalf("error while configuring metrics push: %s", err)
+		}
+		// metrics are pushed until the process exits
+		go pusher.Run(nil)
+	}
+	if *statsAddress != "" {
+		interval, err := util.ParseInterval(*statsInterval)
+		if err != nil {
+			log.Fatalf("error while parsing stats interval '%s': %s", *statsInterval, err)
+		}
+		emitter, err := core.NewStatsEmitter(ctx, core.StatsEmitterOptions{
+			Address: *statsAddress, Protocol: *statsProtocol, Prefix: *statsPrefix, Interval: interval})
+		if err != nil {
+			log.Fatalf("error while configuring stats emitter: %s", err)
+		}
+		go emitter.Run()
+	}
+	if *snmpListen != "" {
+		agent, err := snmp.New(ctx, snmp.Options{Listen: *snmpListen, Community: *snmpCommunity, Root: *snmpRoot})
+		if err != nil {
+			log.Fatalf("error while configuring SNMP agent: %s", err)
+		}
+		defer agent.Shutdown()
+		go func() {
+			log.Fatalf("error while serving SNMP: %s", agent.ListenAndServe())
+		}()
+	}
+	if *dnsListen != "" {
+		dnsTTLDuration, err := util.ParseInterval(*dnsTTL)
+		if err != nil {
+			log.Fatalf("error while parsing DNS TTL '%s': %s", *dnsTTL, err)
+		}
+		responder := nameserver.New(ctx, nameserver.Options{Listen: *dnsListen, TTL: dnsTTLDuration})
+		defer responder.Shutdown()
+		go func() {
+			log.Fatalf("error while serving DNS: %s", responder.ListenAndServe())
+		}()
+	}
+
+	info := newVersionInfo()
+	registerBuildInfo(info)
 	r := mux.NewRouter()
+	r.Use(normalizeIDs)
+	r.Use(traceRequests)
+	// backups, imports and plans carry configuration of all services
+	r.Use(limitBodies(*apiMaxBody, *apiMaxBulkBody, "/restore", "/import/keepalived", "/import/ipvsadm", "/plan"))
 
+	// resources of services shadow backends, their names are reserved by core.NormalizeBackendID
+	r.Handle("/service/{vsID}/conn_limit", connLimitHandler{ctx}).Methods("PUT", "DELETE")
+	r.Handle("/service/{vsID}/backends", serviceBackendsHandler{ctx}).Methods("PUT")
+	r.Handle("/service/{vsID}/freeze", serviceFreezeHandler{ctx}).Methods("PUT", "DELETE")
+	r.Handle("/service/{vsID}/weight_hold", weightHoldHandler{ctx}).Methods("PUT", "DELETE")
+	r.Handle("/service/{vsID}/switch", colorSwitchHandler{ctx}).Methods("POST")
+	r.Handle("/service/{vsID}/events", serviceEventsHandler{ctx}).Methods("GET")
+	r.Handle("/service/{vsID}/connections", serviceConnectionsHandler{ctx}).Methods("GET")
+	r.Handle("/service/{vsID}/persistence", persistenceTemplatesHandler{ctx}).Methods("GET")
+	r.Handle("/service/{vsID}/simulate", serviceSimulateHandler{ctx}).Methods("GET")
+	r.Handle("/service/{vsID}/pins", clientPinsHandler{ctx}).Methods("GET", "PUT", "DELETE")
+	r.Handle("/service/{vsID}/restore", serviceRestoreHandler{ctx}).Methods("POST")
+	r.Handle("/service/{vsID}/{rsID}/restore", backendRestoreHandler{ctx}).Methods("POST")
+	r.Handle("/service/{vsID}/{rsID}/drain", backendDrainHandler{ctx, true}).Methods("POST")
+	r.Handle("/service/{vsID}/{rsID}/enable", backendDrainHandler{ctx, false}).Methods("POST")
+	r.Handle("/service/{vsID}/{rsID}/activate", backendActivateHandler{ctx}).Methods("POST")
+	r.Handle("/service/{vsID}/{rsID}/stash", stashedWeightHandler{ctx}).Methods("PATCH")
 	r.Handle("/service/{vsID}", serviceCreateHandler{ctx}).Methods("PUT")
+	r.Handle("/service/{vsID}", serviceUpdateHandler{ctx}).Methods("PATCH")
 	r.Handle("/service/{vsID}/{rsID}", backendCreateHandler{ctx}).Methods("PUT")
 	r.Handle("/service/{vsID}", serviceRemoveHandler{ctx}).Methods("DELETE")
 	r.Handle("/service/{vsID}/{rsID}", backendRemoveHandler{ctx}).Methods("DELETE")
 	r.Handle("/service", serviceListHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}", serviceStatusHandler{ctx}).Methods("GET")
 	r.Handle("/service/{vsID}/{rsID}", backendStatusHandler{ctx}).Methods("GET")
+	r.Handle("/group/{vsID}", groupCreateHandler{ctx}).Methods("PUT")
+	r.Handle("/group/{vsID}", groupStatusHandler{ctx}).Methods("GET")
+	r.Handle("/group/{vsID}", groupRemoveHandler{ctx}).Methods("DELETE")
+	r.Handle("/group/{vsID}/{rsID}", groupBackendCreateHandler{ctx}).Methods("PUT")
+	r.Handle("/group/{vsID}/{rsID}", groupBackendRemoveHandler{ctx}).Methods("DELETE")
+	r.Handle("/pool", poolListHandler{ctx}).Methods("GET")
+	r.Handle("/pool/{poolID}", poolCreateHandler{ctx}).Methods("PUT")
+	r.Handle("/pool/{poolID}", poolStatusHandler{ctx}).Methods("GET")
+	r.Handle("/pool/{poolID}", poolRemoveHandler{ctx}).Methods("DELETE")
 	r.Handle("/store/sync", storeSyncHandler{store}).Methods("GET")
 	r.Handle("/store/sync/status", storeSyncStatusHandler{store}).Methods("GET")
-	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.Handle("/store/sync/last", storeSyncLastHandler{store}).Methods("GET")
+	r.Handle("/store/sync/problems", storeSyncProblemsHandler{store}).Methods("GET")
+	r.Handle("/store/sync/pause", storeSyncPauseHandler{store}).Methods("POST")
+	r.Handle("/store/sync/resume", storeSyncResumeHandler{store}).Methods("POST")
+	r.Handle("/diagnostics/duplicates", diagnosticsDuplicatesHandler{ctx}).Methods("GET")
+	r.Handle("/diagnostics/ipvs-drift", diagnosticsDriftHandler{ctx}).Methods("GET")
+	r.Handle("/diagnostics/stash", diagnosticsStashHandler{ctx}).Methods("GET")
+	r.Handle("/autoscaler/load", autoscalerLoadHandler{ctx}).Methods("GET")
+	r.Handle("/autoscaler/scale/{vsID}", autoscalerScaleHandler{ctx}).Methods("POST")
+	if len(registerTokenData) > 0 {
+		r.Handle("/register/{vsID}/{rsID}", registerHandler{ctx, registerTokenData}).Methods("PUT")
+		r.Handle("/register/{vsID}/{rsID}", deregisterHandler{ctx, registerTokenData}).Methods("DELETE")
+	}
+	r.Handle("/backup", backupHandler{ctx, backupKeyData}).Methods("GET")
+	r.Handle("/mirror", mirrorHandler{ctx}).Methods("GET")
+	r.Handle("/restore", restoreHandler{ctx, backupKeyData}).Methods("POST")
+	r.Handle("/import/keepalived", importHandler{convertKeepalived}).Methods("POST")
+	r.Handle("/import/ipvsadm", importHandler{core.ParseIpvsadm}).Methods("POST")
+	r.Handle("/export/ipvsadm", exportIpvsadmHandler{ctx}).Methods("GET")
+	r.Handle("/plan", planHandler{ctx, store}).Methods("POST")
+	r.Handle("/apply/{planID}", applyHandler{ctx}).Methods("POST")
+	r.Handle("/system/ipvs", ipvsTableHandler{ctx}).Methods("GET")
+	r.Handle("/system/vips", vipsHandler{ctx}).Methods("GET")
+	r.Handle("/system/vips/reannounce", vipsReannounceHandler{ctx}).Methods("POST")
+	r.Handle("/system/ipvs/timeouts", ipvsTimeoutsHandler{ctx}).Methods("GET")
+	r.Handle("/system/ipvs/timeouts", ipvsTimeoutsUpdateHandler{ctx}).Methods("PUT")
+	r.Handle("/system/ipvs/queue", ipvsQueueHandler{ctx}).Methods("GET")
+	r.Handle("/system/startup", startupHandler{ctx}).Methods("GET")
+	r.Handle("/system/loglevel", logLevelHandler{}).Methods("GET")
+	r.Handle("/system/loglevel", logLevelUpdateHandler{}).Methods("PUT")
+	r.Handle("/version", versionHandler{info}).Methods("GET")
+	if *webUI {
+		r.Handle("/ui", ui.Handler()).Methods("GET")
+	}
+
+	// metrics and health are served apart from the management API if requested
+	metricsRouter := r
+	if *metricsListen != "" {
+		metricsRouter = mux.NewRouter()
+	}
+	metricsRouter.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	metricsRouter.Handle("/healthz", healthzHandler{}).Methods("GET")
+	if *metricsListen != "" {
+		log.Infof("setting up metrics HTTP server on %s", *metricsListen)
+		go func() {
+			log.Fatalf("error while serving metrics: %s", newServer(metricsRouter).ListenAndServe())
+		}()
+	}
+
+	log.Infof("setting up HTTP server on %s", strings.Join(endpoints, ", "))
+	listeners := make([]net.Listener, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		listener, err := listenAPI(endpoint, os.FileMode(socketPerm), *reusePort)
+		if err != nil {
+			log.Fatalf("error while listening on '%s': %s", endpoint, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	server := newServer(r)
+	for _, listener := range listeners[1:] {
+		go func(listener net.Listener) {
+			log.Fatalf("error while serving HTTP on %s: %s", listener.Addr(), server.Serve(listener))
+		}(listener)
+	}
+	log.Fatal(server.Serve(listeners[0]))
+}
 
-	log.Infof("setting up HTTP server on %s", *listen)
-	log.Fatal(http.ListenAndServe(*listen, r))
+// listenAPI listens on the TCP endpoint or on the unix socket given as unix:///path.
+// IPv4 and IPv6 addresses are bound to their own stack, so they could share a port.
+func listenAPI(endpoint string, mode os.FileMode, reusePort bool) (net.Listener, error) {
+	if path, onSocket := strings.CutPrefix(endpoint, "unix://"); onSocket {
+		return listenUnix(path, mode)
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	network := "tcp"
+	if ip := net.ParseIP(host); ip != nil {
+		network = "tcp6"
+		if ip.To4() != nil {
+			network = "tcp4"
+		}
+	}
+	var config net.ListenConfig
+	if reusePort {
+		config.Control = func(network, address string, conn syscall.RawConn) error {
+			var sockErr error
+			if err := conn.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return config.Listen(context.Background(), network, endpoint)
+}
+
+// listenUnix listens on the unix socket with the file mode, replacing the
+// socket left by a previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// the socket is created accessible to its owner only, so no other user could
+	// connect before its mode is set
+	umask := syscall.Umask(0o177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// runIpvsHelper serves IPVS requests of unprivileged GORB daemon.
+func runIpvsHelper(socketPath string) {
+	ipvs := core.NewIpvs()
+	if err := ipvs.Init(); err != nil {
+		log.Fatalf("unable to initialize IPVS: %s", err)
+	}
+	defer ipvs.Exit()
+
+	if err := ipvsrpc.Serve(socketPath, ipvs); err != nil {
+		log.Fatalf("error while serving IPVS helper socket: %s", err)
+	}
+}
+
+// splitList splits comma delimited flag value skipping empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// splitOverlays splits semicolon delimited store overlays into their URLs.
+func splitOverlays(value string) [][]string {
+	var overlays [][]string
+	if len(value) > 0 {
+		for _, overlay := range strings.Split(value, ";") {
+			overlays = append(overlays, strings.Split(overlay, ","))
+		}
+	}
+	return overlays
 }
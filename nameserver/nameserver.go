@@ -0,0 +1,141 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package nameserver is a small authoritative DNS responder answering names of
+// services with their VIPs, so clients could find VIPs without Consul.
+package nameserver
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/qk4l/gorb/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolver returns records of a DNS name, exists is false for unknown names.
+type Resolver interface {
+	DNSRecords(name string) (records []core.DNSRecord, exists bool)
+}
+
+// Options contain DNS responder configuration.
+type Options struct {
+	// Listen is an address the responder listens on with both UDP and TCP.
+	Listen string
+	// TTL of answers, short so clients notice VIPs going down.
+	TTL time.Duration
+}
+
+// Server answers A and AAAA queries with VIPs of services. Records are
+// ordered randomly weighted by backends of services, so clients using the
+// first answer spread their traffic proportionally.
+type Server struct {
+	resolver Resolver
+	ttl      uint32
+	servers  []*dns.Server
+}
+
+// New creates a DNS responder, it doesn't listen until ListenAndServe.
+func New(resolver Resolver, opts Options) *Server {
+	s := &Server{resolver: resolver, ttl: uint32(opts.TTL / time.Second)}
+	for _, network := range []string{"udp", "tcp"} {
+		s.servers = append(s.servers, &dns.Server{Addr: opts.Listen, Net: network, Handler: s})
+	}
+	return s
+}
+
+// ListenAndServe serves queries until Shutdown or the first error of listeners.
+func (s *Server) ListenAndServe() error {
+	errCh := make(chan error, len(s.servers))
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			log.Infof("setting up DNS responder on %s/%s", server.Addr, server.Net)
+			errCh <- server.ListenAndServe()
+		}(server)
+	}
+	return <-errCh
+}
+
+// Shutdown stops listeners of the responder.
+func (s *Server) Shutdown() {
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil {
+			log.Errorf("error while stopping DNS responder on %s/%s: %s", server.Addr, server.Net, err)
+		}
+	}
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if len(r.Question) == 1 {
+		m.Answer, m.Rcode = s.answer(r.Question[0])
+	} else {
+		m.Rcode = dns.RcodeFormatError
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Errorf("error while answering DNS query: %s", err)
+	}
+}
+
+// answer returns records of the question and the response code.
+func (s *Server) answer(q dns.Question) ([]dns.RR, int) {
+	records, exists := s.resolver.DNSRecords(q.Name)
+	if !exists {
+		return nil, dns.RcodeNameError
+	}
+	if q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY {
+		return nil, dns.RcodeSuccess
+	}
+
+	var answers []dns.RR
+	for _, record := range order(records) {
+		header := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: s.ttl}
+		if ip4 := record.IP.To4(); ip4 != nil {
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+				header.Rrtype = dns.TypeA
+				answers = append(answers, &dns.A{Hdr: header, A: ip4})
+			}
+		} else if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+			header.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: record.IP.To16()})
+		}
+	}
+	return answers, dns.RcodeSuccess
+}
+
+// order shuffles records so a record is first with probability proportional
+// to its weight (weighted random sampling without replacement).
+func order(records []core.DNSRecord) []core.DNSRecord {
+	keys := make(map[string]float64, len(records))
+	for _, record := range records {
+		keys[record.IP.String()] = math.Pow(rand.Float64(), 1/float64(record.Weight))
+	}
+	ordered := append([]core.DNSRecord(nil), records...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return keys[ordered[i].IP.String()] > keys[ordered[j].IP.String()]
+	})
+	return ordered
+}
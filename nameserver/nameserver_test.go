@@ -0,0 +1,83 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nameserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/qk4l/gorb/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string][]core.DNSRecord
+
+func (r fakeResolver) DNSRecords(name string) ([]core.DNSRecord, bool) {
+	records, exists := r[name]
+	return records, exists
+}
+
+func TestAnswer(t *testing.T) {
+	s := New(fakeResolver{
+		"web.lb.": {
+			{IP: net.ParseIP("10.0.0.1"), Weight: 10},
+			{IP: net.ParseIP("fd00::1"), Weight: 10},
+		},
+		"down.lb.": nil,
+	}, Options{TTL: 5 * time.Second})
+
+	answers, rcode := s.answer(dns.Question{Name: "web.lb.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "10.0.0.1", answers[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(5), answers[0].Header().Ttl)
+
+	answers, _ = s.answer(dns.Question{Name: "web.lb.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	require.Len(t, answers, 1)
+	assert.Equal(t, "fd00::1", answers[0].(*dns.AAAA).AAAA.String())
+
+	// known names without healthy services have no answers, unknown names don't exist
+	answers, rcode = s.answer(dns.Question{Name: "down.lb.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Empty(t, answers)
+	_, rcode = s.answer(dns.Question{Name: "unknown.lb.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	assert.Equal(t, dns.RcodeNameError, rcode)
+}
+
+func TestOrder(t *testing.T) {
+	records := []core.DNSRecord{
+		{IP: net.ParseIP("10.0.0.1"), Weight: 1},
+		{IP: net.ParseIP("10.0.0.2"), Weight: 9},
+	}
+	first := 0
+	for i := 0; i < 1000; i++ {
+		ordered := order(records)
+		require.Len(t, ordered, 2)
+		if ordered[0].IP.Equal(records[1].IP) {
+			first++
+		}
+	}
+	// the heavier record is first in 90% of answers
+	assert.InDelta(t, 900, first, 60)
+}
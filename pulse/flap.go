@@ -0,0 +1,114 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"errors"
+	"time"
+
+	"github.com/qk4l/gorb/util"
+)
+
+// ErrInvalidFlapOptions is returned if flap detection is misconfigured.
+var ErrInvalidFlapOptions = errors.New("flap changes must be positive and weight must be within [0, 1]")
+
+// FlapOptions configure flap detection. A backend changing its status more than
+// Changes times within Window is reported as flapping for Penalty, so it is held
+// down or at reduced weight instead of churning IPVS weights.
+type FlapOptions struct {
+	Changes int    `json:"changes"`
+	Window  string `json:"window"`
+	Penalty string `json:"penalty"`
+	// Weight is a fraction of weight the flapping backend keeps, 0 holds it down.
+	Weight float64 `json:"weight"`
+
+	window  time.Duration
+	penalty time.Duration
+}
+
+// Validate fills missing fields and validates flap detection configuration.
+func (o *FlapOptions) Validate() error {
+	if o.Changes <= 0 || o.Weight < 0 || o.Weight > 1 {
+		return ErrInvalidFlapOptions
+	}
+
+	if len(o.Window) == 0 {
+		o.Window = "10m"
+	}
+
+	if len(o.Penalty) == 0 {
+		o.Penalty = "10m"
+	}
+
+	var err error
+
+	if o.window, err = util.ParseInterval(o.Window); err != nil {
+		return err
+	}
+
+	if o.penalty, err = util.ParseInterval(o.Penalty); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// flapDetector counts status changes of a backend within the window.
+type flapDetector struct {
+	opts *FlapOptions
+
+	last    StatusType
+	changes []time.Time
+	until   time.Time
+}
+
+func newFlapDetector(opts *FlapOptions) *flapDetector {
+	// backends are considered up until the first check, same as metrics
+	return &flapDetector{opts: opts, last: StatusUp}
+}
+
+// observe records the checked status and tells if the backend is flapping.
+func (f *flapDetector) observe(status StatusType, now time.Time) bool {
+	if status != f.last {
+		f.last = status
+		f.changes = append(f.changes, now)
+	}
+
+	for len(f.changes) > 0 && now.Sub(f.changes[0]) > f.opts.window {
+		f.changes = f.changes[1:]
+	}
+
+	if len(f.changes) > f.opts.Changes {
+		// the penalty is extended while the backend keeps flapping
+		f.until = now.Add(f.opts.penalty)
+	}
+
+	return now.Before(f.until)
+}
+
+// apply reports metrics of the flapping backend with its reduced health.
+func (f *flapDetector) apply(metrics Metrics, now time.Time) Metrics {
+	if f.observe(metrics.Status, now) {
+		metrics.Status = StatusFlapping
+		metrics.Health *= f.opts.Weight
+	}
+	return metrics
+}
@@ -54,11 +54,18 @@ func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error
 	pulseTimeout := opts.Get("timeout", 2).(int)
 	pulsePath := opts.Get("path", "/").(string)
 
+	// proxies of the environment are used unless the check sets its own or "direct"
+	proxy, err := util.ProxyFunc(opts.Get("proxy", "").(string))
+	if err != nil {
+		return nil, err
+	}
+
 	c := http.Client{}
 	urlHost := fmt.Sprintf("%s:%d", pulseHost, pulsePort)
 
 	if pulseScheme == "https" {
 		tr := &http.Transport{
+			Proxy:           proxy,
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
 		c = http.Client{Timeout: time.Duration(pulseTimeout) * time.Second, Transport: tr, CheckRedirect: func(
@@ -73,12 +80,13 @@ func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error
 		}
 
 	} else {
-		c = http.Client{Timeout: time.Duration(pulseTimeout) * time.Second, CheckRedirect: func(
-			req *http.Request,
-			via []*http.Request,
-		) error {
-			return errRedirects
-		}}
+		c = http.Client{Timeout: time.Duration(pulseTimeout) * time.Second, Transport: &http.Transport{Proxy: proxy},
+			CheckRedirect: func(
+				req *http.Request,
+				via []*http.Request,
+			) error {
+				return errRedirects
+			}}
 		// Do not pass port to Host header
 		if pulsePort == 80 {
 			urlHost = pulseHost
@@ -102,6 +110,14 @@ func newGETDriver(host string, port uint16, opts util.DynamicMap) (Driver, error
 	if err != nil {
 		return nil, err
 	}
+	// headers decoded from YAML have the type of opts
+	headers, _ := opts["headers"].(map[string]interface{})
+	if dm, ok := opts["headers"].(util.DynamicMap); ok {
+		headers = dm
+	}
+	for name, value := range headers {
+		r.Header.Set(name, fmt.Sprint(value))
+	}
 
 	return &httpPulse{
 		client: c,
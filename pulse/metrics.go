@@ -29,6 +29,8 @@ type Metrics struct {
 	Status StatusType    `json:"status"`
 	Health float64       `json:"health"`
 	Uptime time.Duration `json:"uptime"`
+	// Latency of the last health check.
+	Latency time.Duration `json:"latency"`
 
 	// Historical information for statistics calculation.
 	lastTs time.Time
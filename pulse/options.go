@@ -39,6 +39,8 @@ type Options struct {
 	Type     string          `json:"type"`
 	Interval string          `json:"interval"`
 	Args     util.DynamicMap `json:"args"`
+	// Flap detection is disabled if not set.
+	Flap *FlapOptions `json:"flap,omitempty"`
 
 	interval time.Duration
 }
@@ -68,5 +70,11 @@ func (o *Options) Validate() error {
 		return ErrInvalidPulseInterval
 	}
 
+	if o.Flap != nil {
+		if err := o.Flap.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -21,7 +21,9 @@
 package pulse
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/qk4l/gorb/util"
@@ -43,14 +45,16 @@ var (
 
 	// Use a separate random device to avoid fucking with other packages.
 	rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// rngMutex guards rng, which isn't safe for concurrent use by pulses.
+	rngMutex sync.Mutex
 )
 
 // Pulse is an health check manager for a backend.
 type Pulse struct {
 	driver   Driver
 	interval time.Duration
-	stopCh   chan struct{}
 	metrics  *Metrics
+	flap     *flapDetector
 }
 
 // New creates a new Pulse from the provided endpoint and options.
@@ -59,14 +63,35 @@ func New(host string, port uint16, opts *Options) (*Pulse, error) {
 		return nil, err
 	}
 
-	d, err := get[opts.Type](host, port, opts.Args)
+	args, err := expandArgs(opts.Args)
 	if err != nil {
 		return nil, err
 	}
 
-	stopCh := make(chan struct{})
+	d, err := get[opts.Type](host, port, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var flap *flapDetector
+	if opts.Flap != nil {
+		flap = newFlapDetector(opts.Flap)
+	}
 
-	return &Pulse{d, opts.interval, stopCh, NewMetrics()}, nil
+	return &Pulse{d, opts.interval, NewMetrics(), flap}, nil
+}
+
+// check runs the health check and recalculates metrics and statistics.
+func (p *Pulse) check() Metrics {
+	start := time.Now()
+	status := p.driver.Check()
+	p.metrics.Latency = time.Since(start)
+
+	metrics := p.metrics.Update(status)
+	if p.flap != nil {
+		metrics = p.flap.apply(metrics, time.Now())
+	}
+	return metrics
 }
 
 // Update is a Pulse notification message.
@@ -75,40 +100,39 @@ type Update struct {
 	Metrics Metrics
 }
 
-// Loop starts the Pulse.
-func (p *Pulse) Loop(id ID, pulseCh chan Update, consumerStopCh <-chan struct{}) {
+// Run checks the backend until the context is canceled. A check in progress
+// is abandoned on cancellation, so Run returns promptly and its caller could
+// wait for it before the backend is checked by another Pulse.
+func (p *Pulse) Run(ctx context.Context, id ID, updates *Queue) {
 	log.Infof("starting pulse for %s", id)
+	defer log.Infof("stopping pulse for %s", id)
 
 	// Randomize the first health-check to avoid thundering herd syndrome.
+	rngMutex.Lock()
 	interval := time.Duration(rng.Int63n(int64(p.interval)))
+	rngMutex.Unlock()
 
 	for {
 		select {
 		case <-time.After(interval):
-			select {
-			// Recalculate metrics and statistics and send them to Context.
-			case pulseCh <- Update{id, p.metrics.Update(p.driver.Check())}:
-			// prevent blocking if the consumer stops before us
-			case <-consumerStopCh:
-				// case <-time.After(p.interval):
-				// log.Errorf("Timeout was reached for check: %s", id)
-				// pulseCh <- Update{id, p.metrics.Update(StatusDown)}
-				// log.Error("Changed backend status to %s", StatusDown)
-			}
-		case <-p.stopCh:
-			log.Infof("stopping pulse for %s", id)
-			pulseCh <- Update{id, p.metrics.Update(StatusRemoved)}
+		case <-ctx.Done():
 			return
 		}
 
+		// Recalculate metrics and statistics and send them to Context.
+		checked := make(chan Metrics, 1)
+		go func() { checked <- p.check() }()
+		var metrics Metrics
+		select {
+		case metrics = <-checked:
+		case <-ctx.Done():
+			return
+		}
+		updates.Push(Update{id, metrics})
+
 		// TODO(@kobolog): Add exponential back-offs, thresholds.
 		interval = p.interval
 
-		log.Infof("current pulse for %s: %s", id, p.metrics.Status.String())
+		log.Infof("current pulse for %s: %s", id, metrics.Status.String())
 	}
 }
-
-// Stop stops the Pulse.
-func (p *Pulse) Stop() {
-	close(p.stopCh)
-}
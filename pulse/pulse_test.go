@@ -21,9 +21,12 @@
 package pulse
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -119,23 +122,20 @@ func TestMetrics(t *testing.T) {
 
 func TestPulseChannel(t *testing.T) {
 	var (
-		pulseCh = make(chan Update)
+		updates = NewQueue(1)
 		id      = ID{"VsID", "rsID"}
 	)
 
-	defer close(pulseCh)
-
 	bp, err := New("", 0, &Options{Type: "none", Interval: "1s"})
 	require.NoError(t, err)
 
-	go bp.Loop(id, pulseCh, make(chan struct{}))
-	defer func() {
-		// stop and consume the status remove update
-		bp.Stop()
-		<-pulseCh
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bp.Run(ctx, id, updates)
 
-	update := <-pulseCh
+	<-updates.Ready()
+	update, _, ok := updates.Pop()
+	require.True(t, ok)
 
 	assert.Equal(t, id, update.Source)
 	assert.Equal(t, StatusUp, update.Metrics.Status)
@@ -147,31 +147,34 @@ func TestPulseChannel(t *testing.T) {
 
 func TestPulseStop(t *testing.T) {
 	var (
-		pulseCh = make(chan Update)
+		updates = NewQueue(1)
 		wg      sync.WaitGroup
 		id      = ID{"VsID", "rsID"}
 	)
 
-	defer close(pulseCh)
-
 	bp, err := New("unknown-host", 80, &Options{Type: "tcp", Interval: "1s"})
 	require.NoError(t, err)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	wg.Add(1)
 	go func() {
-		bp.Loop(id, pulseCh, make(chan struct{}))
+		bp.Run(ctx, id, updates)
 		wg.Done()
 	}()
 
-	bp.Stop()
-
-	// consume the status remove update
-	update := <-pulseCh
-
-	wg.Wait()
+	cancel()
 
-	assert.Equal(t, id, update.Source)
-	assert.Equal(t, StatusRemoved, update.Metrics.Status)
+	// a check in progress doesn't hold the pulse
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("pulse hasn't stopped")
+	}
 }
 
 func TestNopDriver(t *testing.T) {
@@ -278,3 +281,157 @@ func TestGETDriverNoConnection(t *testing.T) {
 	// Connection failure.
 	assert.Equal(t, StatusDown, bp.driver.Check())
 }
+
+func TestGETDriverWithSecrets(t *testing.T) {
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			if r.URL.Query().Get("token") != "t0ken" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		},
+	))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(secret, []byte("t0ken\n"), 0o600))
+	t.Setenv("GORB_TEST_USER", "gorb")
+	SetSecretDir(dir)
+	defer SetSecretDir("")
+
+	tcpAddr := ts.Listener.Addr().(*net.TCPAddr)
+	opts := &Options{Type: "http", Args: util.DynamicMap{
+		"port":    tcpAddr.Port,
+		"path":    "/?token=${file:" + secret + "}",
+		"headers": util.DynamicMap{"Authorization": "Basic ${GORB_TEST_USER}:$${literal}"},
+	}}
+	bp, err := New("localhost", 80, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check())
+	assert.Equal(t, "Basic gorb:${literal}", authorization)
+	// options keep references, so secrets aren't exposed with them
+	assert.Equal(t, "/?token=${file:"+secret+"}", opts.Args["path"])
+
+	opts.Args["path"] = "/?token=${file:token}"
+	bp, err = New("localhost", 80, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check(), "names are resolved in the secret directory")
+
+	// only files of the secret directory and variables of GORB could be referenced
+	outside := filepath.Join(t.TempDir(), "outside")
+	require.NoError(t, os.WriteFile(outside, []byte("t0ken"), 0o600))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	t.Setenv("TEST_USER", "gorb")
+	for _, path := range []string{"/${GORB_TEST_UNSET}", "/${TEST_USER}", "/${file:" + outside + "}",
+		"/${file:../" + filepath.Base(filepath.Dir(outside)) + "/outside}", "/${file:link}"} {
+		opts.Args["path"] = path
+		_, err = New("localhost", 80, opts)
+		assert.ErrorIs(t, err, ErrUnresolvedReference, path)
+	}
+	SetSecretDir("")
+	opts.Args["path"] = "/?token=${file:" + secret + "}"
+	_, err = New("localhost", 80, opts)
+	assert.ErrorIs(t, err, ErrUnresolvedReference, "files are rejected without a secret directory")
+}
+
+func TestGETDriverWithProxy(t *testing.T) {
+	var target string
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			target = r.URL.String()
+		},
+	))
+	defer proxy.Close()
+
+	bp, err := New("backend.invalid", 8080, &Options{Type: "http", Args: util.DynamicMap{"proxy": proxy.URL}})
+	require.NoError(t, err)
+	assert.Equal(t, StatusUp, bp.driver.Check())
+	assert.Equal(t, "http://backend.invalid:8080/", target)
+
+	_, err = New("backend.invalid", 8080, &Options{Type: "http", Args: util.DynamicMap{"proxy": "proxy:3128"}})
+	assert.Error(t, err)
+}
+
+func TestFlapDetector(t *testing.T) {
+	opts := &FlapOptions{Changes: 2, Window: "1m", Penalty: "5m", Weight: 0.5}
+	require.NoError(t, opts.Validate())
+
+	f := newFlapDetector(opts)
+	now := time.Now()
+
+	// two changes are allowed within the window
+	assert.False(t, f.observe(StatusDown, now))
+	assert.False(t, f.observe(StatusUp, now.Add(10*time.Second)))
+	assert.False(t, f.observe(StatusUp, now.Add(20*time.Second)))
+
+	metrics := f.apply(Metrics{Status: StatusDown, Health: 0.8}, now.Add(30*time.Second))
+	assert.Equal(t, StatusFlapping, metrics.Status)
+	assert.Equal(t, 0.4, metrics.Health)
+
+	// the backend is held for the penalty after the last change even if stable
+	assert.True(t, f.observe(StatusDown, now.Add(5*time.Minute)))
+	assert.False(t, f.observe(StatusDown, now.Add(6*time.Minute)))
+
+	// old changes are out of the window
+	assert.False(t, f.observe(StatusUp, now.Add(7*time.Minute)))
+}
+
+func TestFlapOptions(t *testing.T) {
+	assert.Equal(t, ErrInvalidFlapOptions, (&FlapOptions{}).Validate())
+	assert.Equal(t, ErrInvalidFlapOptions, (&FlapOptions{Changes: 1, Weight: 2}).Validate())
+
+	opts := &Options{Flap: &FlapOptions{Changes: 3}}
+	require.NoError(t, opts.Validate())
+	assert.Equal(t, "10m", opts.Flap.Window)
+	assert.Equal(t, 10*time.Minute, opts.Flap.penalty)
+}
+
+func TestQueue(t *testing.T) {
+	var (
+		a = ID{"VsID", "a"}
+		b = ID{"VsID", "b"}
+		c = ID{"VsID", "c"}
+	)
+	updates := NewQueue(2)
+
+	assert.True(t, updates.Push(Update{a, Metrics{Status: StatusUp}}))
+	assert.True(t, updates.Push(Update{b, Metrics{Status: StatusUp}}))
+	// the latest update of a pulse wins and keeps its place
+	assert.True(t, updates.Push(Update{a, Metrics{Status: StatusDown}}))
+	// updates of other pulses are dropped once the queue is full
+	assert.False(t, updates.Push(Update{c, Metrics{Status: StatusUp}}))
+
+	select {
+	case <-updates.Ready():
+	default:
+		t.Fatal("queue isn't ready")
+	}
+	u, queuedAt, ok := updates.Pop()
+	require.True(t, ok)
+	assert.Equal(t, Update{a, Metrics{Status: StatusDown}}, u)
+	updates.Processed(queuedAt)
+	u, _, ok = updates.Pop()
+	require.True(t, ok)
+	assert.Equal(t, Update{b, Metrics{Status: StatusUp}}, u)
+	_, _, ok = updates.Pop()
+	assert.False(t, ok)
+
+	stats := updates.Stats()
+	assert.Equal(t, uint64(2), stats.Queued)
+	assert.Equal(t, uint64(1), stats.Coalesced)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Zero(t, stats.Pending)
+	assert.Equal(t, uint64(1), stats.Processed)
+	assert.Positive(t, stats.Latency)
+
+	// removals are queued even if the queue is full
+	updates.Resize(1)
+	assert.True(t, updates.Push(Update{a, Metrics{Status: StatusUp}}))
+	assert.False(t, updates.Push(Update{b, Metrics{Status: StatusUp}}))
+	assert.True(t, updates.Push(Update{c, Metrics{Status: StatusRemoved}}))
+	updates.Resize(3)
+	assert.True(t, updates.Push(Update{b, Metrics{Status: StatusUp}}))
+	assert.Equal(t, 3, updates.Stats().Pending)
+}
@@ -0,0 +1,176 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Queue is a bounded queue of pulse updates which keeps only the latest update
+// of every pulse, so a busy consumer never blocks pulses. Updates are popped in
+// the order their pulses were first queued.
+type Queue struct {
+	mutex   sync.Mutex
+	size    int
+	pending map[ID]queuedUpdate
+	order   []ID
+	ready   chan struct{}
+	stats   QueueStats
+}
+
+type queuedUpdate struct {
+	Update
+	queuedAt time.Time
+}
+
+// QueueStats are counters of updates passed through the queue.
+type QueueStats struct {
+	// Queued updates of pulses without a pending update.
+	Queued uint64
+	// Coalesced updates replaced a pending update of the same pulse.
+	Coalesced uint64
+	// Dropped updates didn't fit into the queue.
+	Dropped uint64
+	// Pending updates not popped yet.
+	Pending int
+	// Processed updates and the total time from their queuing till they
+	// were processed.
+	Processed uint64
+	Latency   time.Duration
+}
+
+// NewQueue creates a queue holding updates of up to size pulses.
+func NewQueue(size int) *Queue {
+	return &Queue{
+		size:    size,
+		pending: make(map[ID]queuedUpdate),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues the update, replacing a pending update of the same pulse. The
+// update is dropped if the queue is full, the pulse sends a fresh one on its
+// next check anyway. Removals are never dropped, since none follows them.
+func (q *Queue) Push(u Update) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	queued, exists := q.pending[u.Source]
+	switch {
+	case exists:
+		// the update waits since the replaced one was queued
+		q.stats.Coalesced++
+	case len(q.order) >= q.size && u.Metrics.Status != StatusRemoved:
+		q.stats.Dropped++
+		log.Warnf("pulse queue is full, dropping update of %s", u.Source)
+		return false
+	default:
+		q.stats.Queued++
+		q.order = append(q.order, u.Source)
+		queued.queuedAt = time.Now()
+	}
+	queued.Update = u
+	q.pending[u.Source] = queued
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Resize changes the number of pulses whose updates could be pending, pending
+// updates beyond the new size are kept.
+func (q *Queue) Resize(size int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.size = size
+}
+
+// Pop returns the oldest pending update and the time it was queued at, if
+// there is one.
+func (q *Queue) Pop() (Update, time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.order) == 0 {
+		return Update{}, time.Time{}, false
+	}
+	id := q.order[0]
+	q.order = q.order[1:]
+	queued := q.pending[id]
+	delete(q.pending, id)
+	return queued.Update, queued.queuedAt, true
+}
+
+// Has reports whether an update of the pulse is pending, so an update popped
+// before is superseded.
+func (q *Queue) Has(id ID) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	_, exists := q.pending[id]
+	return exists
+}
+
+// Wake signals Ready if updates are pending, so a consumer which has paused
+// popping them picks them up without waiting for the next push.
+func (q *Queue) Wake() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.order) == 0 {
+		return
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Processed records the latency of a popped update once it's processed.
+func (q *Queue) Processed(queuedAt time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.stats.Processed++
+	q.stats.Latency += time.Since(queuedAt)
+}
+
+// Stats returns counters of the queue.
+func (q *Queue) Stats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Pending = len(q.order)
+	return stats
+}
+
+// Ready is signaled when updates are pushed, pending updates should be popped
+// until none is left.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pulse
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/qk4l/gorb/util"
+)
+
+// ErrUnresolvedReference is returned if a reference in pulse args can't be resolved.
+var ErrUnresolvedReference = errors.New("unable to resolve reference in pulse args")
+
+// SecretEnvPrefix is the prefix of environment variables pulse args could reference,
+// so other variables of GORB couldn't be read through the store.
+const SecretEnvPrefix = "GORB_"
+
+// secretDir is the directory files referenced in pulse args must be in, file
+// references are rejected if it isn't set.
+var secretDir string
+
+// SetSecretDir sets the directory files referenced in pulse args must be in.
+func SetSecretDir(dir string) {
+	secretDir = dir
+}
+
+// referencePattern matches ${GORB_VAR} and ${file:name} references, $${...} is
+// an escaped reference kept literally.
+var referencePattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// expandArgs returns a copy of args with references in string values resolved,
+// so credentials could be kept out of store. Args themselves keep references,
+// which are resolved every time a driver is created.
+func expandArgs(args util.DynamicMap) (util.DynamicMap, error) {
+	if args == nil {
+		return nil, nil
+	}
+	expanded, err := expandMap(args)
+	if err != nil {
+		return nil, err
+	}
+	return util.DynamicMap(expanded), nil
+}
+
+func expandValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandString(v)
+	case map[string]interface{}:
+		return expandMap(v)
+	case util.DynamicMap:
+		// nested maps decoded from YAML have the type of args
+		expanded, err := expandMap(v)
+		return util.DynamicMap(expanded), err
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if expanded[i], err = expandValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	default:
+		return value, nil
+	}
+}
+
+func expandMap(m map[string]interface{}) (map[string]interface{}, error) {
+	expanded := make(map[string]interface{}, len(m))
+	for key, item := range m {
+		var err error
+		if expanded[key], err = expandValue(item); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+func expandString(s string) (string, error) {
+	var err error
+	expanded := referencePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		value, resolveErr := resolveReference(match[2 : len(match)-1])
+		if resolveErr != nil && err == nil {
+			err = resolveErr
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// resolveReference returns the value of the environment variable or the content
+// of the file without trailing newlines. Resolved values aren't put into errors.
+func resolveReference(ref string) (string, error) {
+	if name, isFile := strings.CutPrefix(ref, "file:"); isFile {
+		path, err := secretPath(name)
+		if err != nil {
+			return "", fmt.Errorf("%w ${%s}: %w", ErrUnresolvedReference, ref, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%w ${%s}: %w", ErrUnresolvedReference, ref, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if !strings.HasPrefix(ref, SecretEnvPrefix) {
+		return "", fmt.Errorf("%w ${%s}: only variables prefixed with %s could be referenced",
+			ErrUnresolvedReference, ref, SecretEnvPrefix)
+	}
+	value, exists := os.LookupEnv(ref)
+	if !exists {
+		return "", fmt.Errorf("%w ${%s}: environment variable is not set", ErrUnresolvedReference, ref)
+	}
+	return value, nil
+}
+
+// secretPath returns the path of the referenced file, relative names are resolved
+// in the secret directory. Symlinks are followed, so the file can't be outside of it.
+func secretPath(name string) (string, error) {
+	if secretDir == "" {
+		return "", errors.New("files could be referenced only with a secret directory")
+	}
+	dir, err := filepath.EvalSymlinks(secretDir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(secretDir, name)
+	}
+	path, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", errors.New("file is outside of the secret directory")
+	}
+	return path, nil
+}
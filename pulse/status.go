@@ -34,6 +34,9 @@ const (
 	StatusDown
 	// StatusRemoved means the backend has been removed
 	StatusRemoved
+	// StatusFlapping means the backend changes its status too often and is
+	// held down or at reduced weight for a penalty period.
+	StatusFlapping
 )
 
 func (status StatusType) String() string {
@@ -44,6 +47,8 @@ func (status StatusType) String() string {
 		return "Down"
 	case StatusRemoved:
 		return "Removed"
+	case StatusFlapping:
+		return "Flapping"
 	}
 
 	return "Unknown"
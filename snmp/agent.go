@@ -0,0 +1,319 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package snmp is a read-only SNMPv2c agent exposing states of services and
+// backends with GORB-MIB, so NMS platforms could monitor GORB without HTTP polling.
+package snmp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/qk4l/gorb/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRoot is OID of GORB-MIB, it's under netSnmpPlaypen reserved for local use.
+const DefaultRoot = "1.3.6.1.4.1.8072.9999.9999.4726"
+
+const (
+	// snmpVersion2c is the version field of SNMPv2c messages.
+	snmpVersion2c = 1
+	// maxMessageSize of responses, the maximum of UDP payloads.
+	maxMessageSize = 65507
+)
+
+// Error statuses of responses.
+const (
+	errStatusTooBig      = 1
+	errStatusNotWritable = 17
+)
+
+// ErrMissingCommunity is returned if the agent is configured without community.
+var ErrMissingCommunity = errors.New("SNMP community must not be empty")
+
+// Source returns states of services the agent exposes.
+type Source interface {
+	ServiceStates() []core.ServiceState
+}
+
+// Options contain SNMP agent configuration.
+type Options struct {
+	// Listen is an UDP address the agent listens on.
+	Listen string
+	// Community requests must have, there is no write access.
+	Community string
+	// Root is OID of GORB-MIB, DefaultRoot if empty.
+	Root string
+}
+
+// Agent answers SNMPv2c Get, GetNext and GetBulk requests. Objects are read from
+// the source on every request, so walks of changing services may skip rows.
+type Agent struct {
+	source    Source
+	listen    string
+	community []byte
+	// objects is gorbObjects subtree of the MIB
+	objects oid
+
+	mutex sync.Mutex
+	conn  net.PacketConn
+}
+
+// New creates an SNMP agent, it doesn't listen until ListenAndServe.
+func New(source Source, opts Options) (*Agent, error) {
+	if opts.Community == "" {
+		return nil, ErrMissingCommunity
+	}
+	if opts.Root == "" {
+		opts.Root = DefaultRoot
+	}
+	root, err := parseOID(opts.Root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNMP root OID %s: %w", opts.Root, err)
+	}
+	return &Agent{source: source, listen: opts.Listen, community: []byte(opts.Community), objects: root.append(1)}, nil
+}
+
+// ListenAndServe serves requests until Shutdown or the first error of the listener.
+func (a *Agent) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", a.listen)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	a.conn = conn
+	a.mutex.Unlock()
+	log.Infof("setting up SNMP agent on %s", conn.LocalAddr())
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		response, err := a.handle(buf[:n])
+		if err != nil {
+			log.Debugf("dropping SNMP request from %s: %s", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			log.Errorf("error while answering SNMP request from %s: %s", addr, err)
+		}
+	}
+}
+
+// Shutdown stops the listener of the agent.
+func (a *Agent) Shutdown() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.conn != nil {
+		if err := a.conn.Close(); err != nil {
+			log.Errorf("error while stopping SNMP agent on %s: %s", a.listen, err)
+		}
+	}
+}
+
+// request is a decoded SNMPv2c request PDU.
+type request struct {
+	pdu byte
+	id  int64
+	// nonRepeaters and maxRepetitions are error status and index fields of non-bulk requests
+	nonRepeaters   int64
+	maxRepetitions int64
+	names          []oid
+}
+
+// parseRequest decodes an SNMPv2c message, messages of other versions or communities are rejected.
+func (a *Agent) parseRequest(packet []byte) (*request, error) {
+	message, rest, err := readElement(packet)
+	if err != nil || message.tag != tagSequence || len(rest) != 0 {
+		return nil, errMalformed
+	}
+	fields, err := readElements(message.value)
+	if err != nil || len(fields) != 3 || fields[0].tag != tagInteger || fields[1].tag != tagOctetString {
+		return nil, errMalformed
+	}
+	if version, err := parseInt(fields[0].value); err != nil || version != snmpVersion2c {
+		return nil, fmt.Errorf("unsupported SNMP version %x", fields[0].value)
+	}
+	if subtle.ConstantTimeCompare(fields[1].value, a.community) != 1 {
+		return nil, errors.New("unknown community")
+	}
+
+	pdu, err := readElements(fields[2].value)
+	if err != nil || len(pdu) != 4 || pdu[3].tag != tagSequence {
+		return nil, errMalformed
+	}
+	req := &request{pdu: fields[2].tag}
+	for i, n := range []*int64{&req.id, &req.nonRepeaters, &req.maxRepetitions} {
+		if pdu[i].tag != tagInteger {
+			return nil, errMalformed
+		}
+		if *n, err = parseInt(pdu[i].value); err != nil {
+			return nil, err
+		}
+	}
+	varbinds, err := readElements(pdu[3].value)
+	if err != nil {
+		return nil, err
+	}
+	for _, varbind := range varbinds {
+		pair, err := readElements(varbind.value)
+		if err != nil || varbind.tag != tagSequence || len(pair) != 2 || pair[0].tag != tagOID {
+			return nil, errMalformed
+		}
+		name, err := decodeOID(pair[0].value)
+		if err != nil {
+			return nil, err
+		}
+		req.names = append(req.names, name)
+	}
+	return req, nil
+}
+
+// handle answers an SNMP request packet.
+func (a *Agent) handle(packet []byte) ([]byte, error) {
+	req, err := a.parseRequest(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		objects  = mibObjects(a.objects, a.source.ServiceStates())
+		varbinds []object
+		status   int64
+		index    int64
+	)
+	switch req.pdu {
+	case pduGet:
+		for _, name := range req.names {
+			varbinds = append(varbinds, a.get(objects, name))
+		}
+	case pduGetNext:
+		for _, name := range req.names {
+			varbinds = append(varbinds, next(objects, name))
+		}
+	case pduGetBulk:
+		varbinds = bulk(objects, req)
+	case pduSet:
+		status, index = errStatusNotWritable, 1
+		for _, name := range req.names {
+			varbinds = append(varbinds, object{name, value{tag: tagNull}})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU %#x", req.pdu)
+	}
+
+	response := encodeResponse(a.community, req.id, status, index, varbinds)
+	if len(response) > maxMessageSize && req.pdu == pduGetBulk {
+		// bulk responses are allowed to have fewer repetitions
+		for len(response) > maxMessageSize && len(varbinds) > 0 {
+			varbinds = varbinds[:len(varbinds)*3/4]
+			response = encodeResponse(a.community, req.id, status, index, varbinds)
+		}
+	} else if len(response) > maxMessageSize {
+		response = encodeResponse(a.community, req.id, errStatusTooBig, 0, nil)
+	}
+	return response, nil
+}
+
+// search returns position of the first object with OID not less than the name.
+func search(objects []object, name oid) int {
+	return sort.Search(len(objects), func(i int) bool { return slices.Compare(objects[i].oid, name) >= 0 })
+}
+
+// get returns the object instance, or noSuchInstance for missing rows of
+// known columns and noSuchObject otherwise.
+func (a *Agent) get(objects []object, name oid) object {
+	if i := search(objects, name); i < len(objects) && slices.Equal(objects[i].oid, name) {
+		return objects[i]
+	}
+	if len(name) > len(a.objects)+2 && name.hasPrefix(a.objects) {
+		table, entry, column := name[len(a.objects)], name[len(a.objects)+1], name[len(a.objects)+2]
+		if last, ok := columns[table]; ok && entry == 1 && column >= 1 && column <= last {
+			return object{name, value{tag: tagNoSuchInstance}}
+		}
+	}
+	return object{name, value{tag: tagNoSuchObject}}
+}
+
+// next returns the object following the name or endOfMibView.
+func next(objects []object, name oid) object {
+	i := search(objects, name)
+	if i < len(objects) && slices.Equal(objects[i].oid, name) {
+		i++
+	}
+	if i == len(objects) {
+		return object{name, value{tag: tagEndOfMibView}}
+	}
+	return objects[i]
+}
+
+// bulk answers GetBulk requests: names up to non-repeaters get the next object
+// once, the rest get the next objects up to max-repetitions times.
+func bulk(objects []object, req *request) []object {
+	nonRepeaters := int(min(max(req.nonRepeaters, 0), int64(len(req.names))))
+	repetitions := int(min(max(req.maxRepetitions, 0), int64(len(objects)+1)))
+
+	var varbinds []object
+	for _, name := range req.names[:nonRepeaters] {
+		varbinds = append(varbinds, next(objects, name))
+	}
+	repeaters := slices.Clone(req.names[nonRepeaters:])
+	for i := 0; i < repetitions && len(repeaters) > 0; i++ {
+		done := true
+		for j, name := range repeaters {
+			o := next(objects, name)
+			varbinds = append(varbinds, o)
+			repeaters[j] = o.oid
+			done = done && o.value.tag == tagEndOfMibView
+		}
+		if done {
+			break
+		}
+	}
+	return varbinds
+}
+
+func encodeResponse(community []byte, id, status, index int64, varbinds []object) []byte {
+	var list []byte
+	for _, varbind := range varbinds {
+		pair := appendElement(nil, tagOID, varbind.oid.encode())
+		pair = appendElement(pair, varbind.value.tag, varbind.value.data)
+		list = appendElement(list, tagSequence, pair)
+	}
+	pdu := appendElement(nil, tagInteger, encodeInt(id))
+	pdu = appendElement(pdu, tagInteger, encodeInt(status))
+	pdu = appendElement(pdu, tagInteger, encodeInt(index))
+	pdu = appendElement(pdu, tagSequence, list)
+
+	message := appendElement(nil, tagInteger, encodeInt(snmpVersion2c))
+	message = appendElement(message, tagOctetString, community)
+	message = appendElement(message, pduResponse, pdu)
+	return appendElement(nil, tagSequence, message)
+}
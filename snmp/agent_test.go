@@ -0,0 +1,237 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snmp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qk4l/gorb/core"
+	"github.com/qk4l/gorb/pulse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource []core.ServiceState
+
+func (s fakeSource) ServiceStates() []core.ServiceState {
+	return s
+}
+
+var testStates = fakeSource{
+	{VsID: "web", Host: "10.0.0.1", Port: 80, Protocol: "tcp", Health: 0.5, Status: core.ServiceDegraded,
+		HealthyBackends: 1, Traffic: &core.IpvsStats{Conns: 3, InBytes: 1 << 40},
+		Backends: []core.BackendState{
+			{RsID: "a", Host: "10.1.0.1", Port: 8080, Health: 1, Status: pulse.StatusUp, Weight: 100,
+				Uptime: time.Minute, Latency: 15 * time.Millisecond},
+			{RsID: "b", Host: "10.1.0.2", Port: 8080, Status: pulse.StatusDown},
+		}},
+	{VsID: "dns", Host: "10.0.0.2", Port: 53, Protocol: "udp", Status: core.ServiceDown},
+}
+
+// encodeRequest encodes an SNMPv2c request with names bound to NULL values.
+func encodeRequest(community string, pdu byte, id, a, b int64, names ...oid) []byte {
+	var list []byte
+	for _, name := range names {
+		pair := appendElement(nil, tagOID, name.encode())
+		list = appendElement(list, tagSequence, appendElement(pair, tagNull, nil))
+	}
+	body := appendElement(nil, tagInteger, encodeInt(id))
+	body = appendElement(body, tagInteger, encodeInt(a))
+	body = appendElement(body, tagInteger, encodeInt(b))
+	body = appendElement(body, tagSequence, list)
+
+	message := appendElement(nil, tagInteger, encodeInt(snmpVersion2c))
+	message = appendElement(message, tagOctetString, []byte(community))
+	message = appendElement(message, pdu, body)
+	return appendElement(nil, tagSequence, message)
+}
+
+type testResponse struct {
+	id, status, index int64
+	varbinds          []object
+}
+
+func decodeResponse(t *testing.T, packet []byte) testResponse {
+	message, _, err := readElement(packet)
+	require.NoError(t, err)
+	fields, err := readElements(message.value)
+	require.NoError(t, err)
+	require.Len(t, fields, 3)
+	assert.Equal(t, []byte("public"), fields[1].value)
+	require.Equal(t, byte(pduResponse), fields[2].tag)
+
+	pdu, err := readElements(fields[2].value)
+	require.NoError(t, err)
+	var response testResponse
+	for i, n := range []*int64{&response.id, &response.status, &response.index} {
+		*n, err = parseInt(pdu[i].value)
+		require.NoError(t, err)
+	}
+	varbinds, err := readElements(pdu[3].value)
+	require.NoError(t, err)
+	for _, varbind := range varbinds {
+		pair, err := readElements(varbind.value)
+		require.NoError(t, err)
+		name, err := decodeOID(pair[0].value)
+		require.NoError(t, err)
+		response.varbinds = append(response.varbinds, object{name, value{pair[1].tag, pair[1].value}})
+	}
+	return response
+}
+
+func TestBER(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40, -1 << 62} {
+		decoded, err := parseInt(encodeInt(n))
+		require.NoError(t, err)
+		assert.Equal(t, n, decoded)
+	}
+	assert.Equal(t, []byte{0x00, 0x80}, encodeUint(128))
+	assert.Equal(t, []byte{0x00, 0xff, 0xff, 0xff, 0xff}, gauge(1<<40).data)
+
+	o, err := parseOID(DefaultRoot)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xbf, 0x08, 0xce, 0x0f, 0xce, 0x0f, 0xa4, 0x76}, o.encode())
+	decoded, err := decodeOID(o.encode())
+	require.NoError(t, err)
+	assert.Equal(t, o, decoded)
+	assert.Equal(t, DefaultRoot, decoded.String())
+
+	_, err = parseOID("3.1")
+	assert.Equal(t, errInvalidOID, err)
+	_, err = decodeOID([]byte{0x2b, 0x86})
+	assert.Equal(t, errMalformed, err)
+	_, _, err = readElement([]byte{tagSequence, 0x05, 0x01})
+	assert.Equal(t, errMalformed, err)
+}
+
+func TestHandle(t *testing.T) {
+	agent, err := New(testStates, Options{Community: "public"})
+	require.NoError(t, err)
+	column := func(table, column uint32, index ...string) oid {
+		o := agent.objects.append(table, 1, column)
+		for _, s := range index {
+			o = o.append(stringIndex(s)...)
+		}
+		return o
+	}
+
+	// wrong communities and versions aren't answered
+	_, err = agent.handle(encodeRequest("private", pduGet, 1, 0, 0, column(serviceTable, serviceHealth, "web")))
+	assert.Error(t, err)
+	packet := encodeRequest("public", pduGet, 1, 0, 0, column(serviceTable, serviceHealth, "web"))
+	packet[4] = 0
+	_, err = agent.handle(packet)
+	assert.Error(t, err)
+
+	packet, err = agent.handle(encodeRequest("public", pduGet, 7, 0, 0,
+		column(serviceTable, serviceHealth, "web"),
+		column(serviceTable, serviceStatus, "dns"),
+		column(serviceTable, serviceInBytes, "web"),
+		column(serviceTable, serviceInBytes, "dns"),
+		column(backendTable, backendUptime, "web", "a"),
+		column(backendTable, backendStatus, "web", "b"),
+		agent.objects.append(3)))
+	require.NoError(t, err)
+	response := decodeResponse(t, packet)
+	assert.Equal(t, int64(7), response.id)
+	assert.Equal(t, int64(0), response.status)
+	require.Len(t, response.varbinds, 7)
+	assert.Equal(t, gauge(50), response.varbinds[0].value)
+	assert.Equal(t, integer(3), response.varbinds[1].value)
+	assert.Equal(t, counter64(1<<40), response.varbinds[2].value)
+	// services without traffic counters have no instances of their columns
+	assert.Equal(t, byte(tagNoSuchInstance), response.varbinds[3].value.tag)
+	assert.Equal(t, timeTicks(time.Minute), response.varbinds[4].value)
+	assert.Equal(t, integer(2), response.varbinds[5].value)
+	assert.Equal(t, byte(tagNoSuchObject), response.varbinds[6].value.tag)
+
+	// walks go column by column with rows ordered by indexes
+	packet, err = agent.handle(encodeRequest("public", pduGetNext, 8, 0, 0, agent.objects))
+	require.NoError(t, err)
+	response = decodeResponse(t, packet)
+	require.Len(t, response.varbinds, 1)
+	assert.Equal(t, column(serviceTable, serviceName, "dns"), response.varbinds[0].oid)
+	assert.Equal(t, octets("dns"), response.varbinds[0].value)
+
+	packet, err = agent.handle(encodeRequest("public", pduGetNext, 9, 0, 0,
+		column(backendTable, backendCheckLatency, "web", "b")))
+	require.NoError(t, err)
+	response = decodeResponse(t, packet)
+	assert.Equal(t, byte(tagEndOfMibView), response.varbinds[0].value.tag)
+
+	// the first name isn't repeated, the rest is repeated until the end of MIB
+	packet, err = agent.handle(encodeRequest("public", pduGetBulk, 10, 1, 100,
+		agent.objects, column(backendTable, backendUptime, "web", "b")))
+	require.NoError(t, err)
+	response = decodeResponse(t, packet)
+	require.Len(t, response.varbinds, 4)
+	assert.Equal(t, column(serviceTable, serviceName, "dns"), response.varbinds[0].oid)
+	assert.Equal(t, column(backendTable, backendCheckLatency, "web", "a"), response.varbinds[1].oid)
+	assert.Equal(t, gauge(15), response.varbinds[1].value)
+	assert.Equal(t, column(backendTable, backendCheckLatency, "web", "b"), response.varbinds[2].oid)
+	assert.Equal(t, byte(tagEndOfMibView), response.varbinds[3].value.tag)
+
+	packet, err = agent.handle(encodeRequest("public", pduSet, 11, 0, 0, column(serviceTable, serviceHealth, "web")))
+	require.NoError(t, err)
+	response = decodeResponse(t, packet)
+	assert.Equal(t, int64(errStatusNotWritable), response.status)
+	assert.Equal(t, int64(1), response.index)
+}
+
+func TestAgent(t *testing.T) {
+	_, err := New(testStates, Options{})
+	assert.Equal(t, ErrMissingCommunity, err)
+
+	agent, err := New(testStates, Options{Listen: "127.0.0.1:0", Community: "public"})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- agent.ListenAndServe() }()
+	defer func() {
+		agent.Shutdown()
+		assert.NoError(t, <-done)
+	}()
+
+	var addr net.Addr
+	require.Eventually(t, func() bool {
+		agent.mutex.Lock()
+		defer agent.mutex.Unlock()
+		if agent.conn != nil {
+			addr = agent.conn.LocalAddr()
+		}
+		return addr != nil
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("udp", addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	name := agent.objects.append(serviceTable, 1, serviceBackends).append(stringIndex("web")...)
+	_, err = conn.Write(encodeRequest("public", pduGet, 1, 0, 0, name))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	response := decodeResponse(t, buf[:n])
+	require.Len(t, response.varbinds, 1)
+	assert.Equal(t, gauge(2), response.varbinds[0].value)
+}
@@ -0,0 +1,263 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snmp
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BER tags of SNMP types and PDUs.
+const (
+	tagInteger        = 0x02
+	tagOctetString    = 0x04
+	tagNull           = 0x05
+	tagOID            = 0x06
+	tagSequence       = 0x30
+	tagGauge32        = 0x42
+	tagTimeTicks      = 0x43
+	tagCounter64      = 0x46
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduSet      = 0xa3
+	pduGetBulk  = 0xa5
+)
+
+var (
+	errMalformed  = errors.New("malformed BER encoding")
+	errInvalidOID = errors.New("OID must have at least two arcs, the first one within [0, 2]")
+)
+
+// element is a decoded BER type-length-value.
+type element struct {
+	tag   byte
+	value []byte
+}
+
+// readElement decodes the first element of data and returns the rest.
+func readElement(data []byte) (element, []byte, error) {
+	if len(data) < 2 {
+		return element{}, nil, errMalformed
+	}
+	tag, length := data[0], int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < n {
+			return element{}, nil, errMalformed
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length > len(data) {
+		return element{}, nil, errMalformed
+	}
+	return element{tag: tag, value: data[:length]}, data[length:], nil
+}
+
+// readElements decodes all elements of a sequence.
+func readElements(data []byte) ([]element, error) {
+	var elements []element
+	for len(data) > 0 {
+		var (
+			e   element
+			err error
+		)
+		if e, data, err = readElement(data); err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+func appendElement(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+func parseInt(value []byte) (int64, error) {
+	if len(value) == 0 || len(value) > 8 {
+		return 0, errMalformed
+	}
+	n := int64(int8(value[0]))
+	for _, b := range value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// encodeInt encodes a signed integer in the minimal two's complement form.
+func encodeInt(n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if n >= -128 && n < 128 {
+			return b
+		}
+		n >>= 8
+	}
+}
+
+// encodeUint encodes an unsigned integer, prefixed with zero if its high bit is set.
+func encodeUint(n uint64) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// oid is an object identifier.
+type oid []uint32
+
+// parseOID parses dotted notation of OIDs, e.g. 1.3.6.1.
+func parseOID(s string) (oid, error) {
+	var o oid
+	for _, arc := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(arc, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		o = append(o, uint32(n))
+	}
+	if len(o) < 2 || o[0] > 2 {
+		return nil, errInvalidOID
+	}
+	return o, nil
+}
+
+func decodeOID(value []byte) (oid, error) {
+	if len(value) == 0 || value[len(value)-1]&0x80 != 0 {
+		return nil, errMalformed
+	}
+	var (
+		o   oid
+		arc uint64
+	)
+	for _, b := range value {
+		if arc = arc<<7 | uint64(b&0x7f); arc > math.MaxUint32 {
+			return nil, errMalformed
+		}
+		if b&0x80 != 0 {
+			continue
+		}
+		// the first two arcs are encoded together
+		switch {
+		case len(o) > 0:
+			o = append(o, uint32(arc))
+		case arc < 80:
+			o = append(o, uint32(arc/40), uint32(arc%40))
+		default:
+			o = append(o, 2, uint32(arc-80))
+		}
+		arc = 0
+	}
+	return o, nil
+}
+
+func (o oid) encode() []byte {
+	b := appendArc(nil, uint64(o[0])*40+uint64(o[1]))
+	for _, arc := range o[2:] {
+		b = appendArc(b, uint64(arc))
+	}
+	return b
+}
+
+func appendArc(b []byte, arc uint64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(arc & 0x7f)
+	for arc >>= 7; arc > 0; arc >>= 7 {
+		i--
+		buf[i] = byte(arc&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+// append returns a new OID with the arcs appended.
+func (o oid) append(arcs ...uint32) oid {
+	return append(slices.Clip(o), arcs...)
+}
+
+func (o oid) hasPrefix(prefix oid) bool {
+	return len(o) >= len(prefix) && slices.Equal(o[:len(prefix)], prefix)
+}
+
+func (o oid) String() string {
+	arcs := make([]string, len(o))
+	for i, arc := range o {
+		arcs[i] = strconv.FormatUint(uint64(arc), 10)
+	}
+	return strings.Join(arcs, ".")
+}
+
+// value is an encoded value of a MIB object.
+type value struct {
+	tag  byte
+	data []byte
+}
+
+func integer(n int64) value {
+	return value{tagInteger, encodeInt(n)}
+}
+
+func octets(s string) value {
+	return value{tagOctetString, []byte(s)}
+}
+
+func gauge(n uint64) value {
+	return value{tagGauge32, encodeUint(min(n, math.MaxUint32))}
+}
+
+func counter64(n uint64) value {
+	return value{tagCounter64, encodeUint(n)}
+}
+
+// timeTicks are hundredths of a second, they stop at the maximum instead of wrapping.
+func timeTicks(d time.Duration) value {
+	return value{tagTimeTicks, encodeUint(min(uint64(max(d, 0)/(10*time.Millisecond)), math.MaxUint32))}
+}
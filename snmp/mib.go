@@ -0,0 +1,147 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package snmp
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/qk4l/gorb/core"
+)
+
+// Tables of GORB-MIB under gorbObjects.
+const (
+	serviceTable = 1
+	backendTable = 2
+)
+
+// Columns of gorbServiceEntry.
+const (
+	serviceName = iota + 1
+	serviceHost
+	servicePort
+	serviceProtocol
+	serviceHealth
+	serviceStatus
+	serviceBackends
+	serviceBackendsHealthy
+	serviceConns
+	serviceInPkts
+	serviceOutPkts
+	serviceInBytes
+	serviceOutBytes
+)
+
+// Columns of gorbBackendEntry.
+const (
+	backendName = iota + 1
+	backendHost
+	backendPort
+	backendHealth
+	backendStatus
+	backendWeight
+	backendUptime
+	backendCheckLatency
+)
+
+// columns of tables, requests of missing instances of them get noSuchInstance.
+var columns = map[uint32]uint32{serviceTable: serviceOutBytes, backendTable: backendCheckLatency}
+
+// maxOIDLength is the maximum number of sub-identifiers of OIDs, rows with longer
+// indexes are left out.
+const maxOIDLength = 128
+
+// object is an instance of a MIB object.
+type object struct {
+	oid   oid
+	value value
+}
+
+// stringIndex encodes a string as an index of a table row, prefixed with its length.
+func stringIndex(s string) oid {
+	index := oid{uint32(len(s))}
+	for i := 0; i < len(s); i++ {
+		index = append(index, uint32(s[i]))
+	}
+	return index
+}
+
+// serviceStatusValue maps service statuses to gorbServiceStatus.
+func serviceStatusValue(status core.ServiceStatus) int64 {
+	switch status {
+	case core.ServiceHealthy:
+		return 1
+	case core.ServiceDegraded:
+		return 2
+	}
+	return 3
+}
+
+// percent converts health within [0, 1] to gauge in percent.
+func percent(health float64) value {
+	return gauge(uint64(math.Round(min(max(health, 0), 1) * 100)))
+}
+
+// mibObjects returns instances of MIB objects of the states ordered by their OIDs.
+func mibObjects(root oid, states []core.ServiceState) []object {
+	var objects []object
+	add := func(table, column uint32, index oid, v value) {
+		o := root.append(table, 1, column).append(index...)
+		if len(o) <= maxOIDLength {
+			objects = append(objects, object{o, v})
+		}
+	}
+
+	for _, state := range states {
+		index := stringIndex(state.VsID)
+		add(serviceTable, serviceName, index, octets(state.VsID))
+		add(serviceTable, serviceHost, index, octets(state.Host))
+		add(serviceTable, servicePort, index, integer(int64(state.Port)))
+		add(serviceTable, serviceProtocol, index, octets(state.Protocol))
+		add(serviceTable, serviceHealth, index, percent(state.Health))
+		add(serviceTable, serviceStatus, index, integer(serviceStatusValue(state.Status)))
+		add(serviceTable, serviceBackends, index, gauge(uint64(len(state.Backends))))
+		add(serviceTable, serviceBackendsHealthy, index, gauge(uint64(state.HealthyBackends)))
+		if traffic := state.Traffic; traffic != nil {
+			add(serviceTable, serviceConns, index, counter64(traffic.Conns))
+			add(serviceTable, serviceInPkts, index, counter64(traffic.InPkts))
+			add(serviceTable, serviceOutPkts, index, counter64(traffic.OutPkts))
+			add(serviceTable, serviceInBytes, index, counter64(traffic.InBytes))
+			add(serviceTable, serviceOutBytes, index, counter64(traffic.OutBytes))
+		}
+
+		for _, backend := range state.Backends {
+			index := append(stringIndex(state.VsID), stringIndex(backend.RsID)...)
+			add(backendTable, backendName, index, octets(backend.RsID))
+			add(backendTable, backendHost, index, octets(backend.Host))
+			add(backendTable, backendPort, index, integer(int64(backend.Port)))
+			add(backendTable, backendHealth, index, percent(backend.Health))
+			// pulse statuses are numbered from zero, enumerations from one
+			add(backendTable, backendStatus, index, integer(int64(backend.Status)+1))
+			add(backendTable, backendWeight, index, integer(int64(backend.Weight)))
+			add(backendTable, backendUptime, index, timeTicks(backend.Uptime))
+			add(backendTable, backendCheckLatency, index, gauge(uint64(max(backend.Latency.Milliseconds(), 0))))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return slices.Compare(objects[i].oid, objects[j].oid) < 0 })
+	return objects
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package tracing exports spans of GORB operations to OpenTelemetry collectors via OTLP.
+package tracing
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is a name of the tracer used by all GORB packages.
+const instrumentationName = "github.com/qk4l/gorb"
+
+// Options contain tracing configuration.
+type Options struct {
+	// Endpoint is a base URL of OTLP/HTTP collector, e.g. http://collector:4318.
+	// Tracing is disabled if empty.
+	Endpoint string
+	// ServiceName reported as service.name resource attribute, "gorb" by default.
+	ServiceName string
+	// Timeout of a single export request.
+	Timeout time.Duration
+}
+
+// Init sets up global tracer provider exporting spans to the configured endpoint.
+// The returned function flushes pending spans and must be called on shutdown.
+func Init(opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "gorb"
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	exporter := newOTLPExporter(strings.TrimSuffix(opts.Endpoint, "/")+"/v1/traces", opts.Timeout)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", opts.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of GORB, it is a no-op one unless Init is called.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrNoHardwareAddr is returned when announcing addresses on interfaces without link layer addresses.
+var ErrNoHardwareAddr = errors.New("interface has no hardware address to announce")
+
+const (
+	ethTypeARP       = 0x0806
+	ethTypeIPv4      = 0x0800
+	arpRequest       = 1
+	icmpv6NeighAdv   = 136
+	naFlagOverride   = 0x20
+	ndOptTargetLLA   = 2
+	ndHopLimit       = 255
+	arpHardwareEther = 1
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// GratuitousARP returns an Ethernet frame of ARP request announcing the IPv4 address.
+func GratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcastMAC...)
+	frame = append(frame, mac...)
+	frame = binary.BigEndian.AppendUint16(frame, ethTypeARP)
+	frame = binary.BigEndian.AppendUint16(frame, arpHardwareEther)
+	frame = binary.BigEndian.AppendUint16(frame, ethTypeIPv4)
+	frame = append(frame, byte(len(mac)), net.IPv4len)
+	frame = binary.BigEndian.AppendUint16(frame, arpRequest)
+	// both sender and target protocol addresses are the announced one
+	frame = append(frame, mac...)
+	frame = append(frame, ip.To4()...)
+	frame = append(frame, make([]byte, len(mac))...)
+	return append(frame, ip.To4()...)
+}
+
+// UnsolicitedNA returns ICMPv6 neighbor advertisement overriding cached link
+// layer address of the IPv6 address. The checksum is filled by the kernel.
+func UnsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	message := []byte{icmpv6NeighAdv, 0, 0, 0, naFlagOverride, 0, 0, 0}
+	message = append(message, ip.To16()...)
+	message = append(message, ndOptTargetLLA, byte((len(mac)+2+7)/8))
+	message = append(message, mac...)
+	// options are padded to 8 bytes
+	for len(message)%8 != 0 {
+		message = append(message, 0)
+	}
+	return message
+}
+
+// AnnounceIP sends gratuitous ARP for IPv4 or unsolicited neighbor advertisement
+// for IPv6 address on the interface, so neighbors update their caches after the
+// address has moved to this node.
+func AnnounceIP(iface *net.Interface, ip net.IP) error {
+	if len(iface.HardwareAddr) == 0 {
+		return ErrNoHardwareAddr
+	}
+	if AddrFamily(ip) == IPv4 {
+		return sendGratuitousARP(iface, ip)
+	}
+	return sendUnsolicitedNA(iface, ip)
+}
+
+func sendGratuitousARP(iface *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethTypeARP)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethTypeARP),
+		Ifindex:  iface.Index,
+		Halen:    uint8(len(broadcastMAC)),
+	}
+	copy(addr.Addr[:], broadcastMAC)
+	return syscall.Sendto(fd, GratuitousARP(iface.HardwareAddr, ip), 0, addr)
+}
+
+func sendUnsolicitedNA(iface *net.Interface, ip net.IP) error {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// neighbor discovery messages with another hop limit are dropped by receivers
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ndHopLimit); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return err
+	}
+	source := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(source.Addr[:], ip.To16())
+	if err := syscall.Bind(fd, source); err != nil {
+		return err
+	}
+	// all nodes multicast address
+	target := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(target.Addr[:], net.IPv6linklocalallnodes)
+	return syscall.Sendto(fd, UnsolicitedNA(iface.HardwareAddr, ip), 0, target)
+}
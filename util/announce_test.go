@@ -0,0 +1,56 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package util
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+func TestGratuitousARP(t *testing.T) {
+	frame := GratuitousARP(testMAC, net.ParseIP("10.0.0.1"))
+
+	assert.Len(t, frame, 42)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 0x01, 0x08, 0x06}, frame[:14])
+	// request from 10.0.0.1 for 10.0.0.1
+	assert.Equal(t, []byte{0, 1, 0x08, 0x00, 6, 4, 0, 1}, frame[14:22])
+	assert.Equal(t, []byte(testMAC), frame[22:28])
+	assert.Equal(t, []byte{10, 0, 0, 1}, frame[28:32])
+	assert.Equal(t, []byte{10, 0, 0, 1}, frame[38:42])
+}
+
+func TestUnsolicitedNA(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	message := UnsolicitedNA(testMAC, ip)
+
+	assert.Len(t, message, 32)
+	assert.Equal(t, []byte{136, 0, 0, 0, 0x20, 0, 0, 0}, message[:8])
+	assert.Equal(t, []byte(ip), message[8:24])
+	assert.Equal(t, append([]byte{2, 1}, testMAC...), message[24:32])
+}
+
+func TestAnnounceIPWithoutHardwareAddr(t *testing.T) {
+	assert.Equal(t, ErrNoHardwareAddr, AnnounceIP(&net.Interface{Name: "lo"}, net.ParseIP("10.0.0.1")))
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CapNetAdmin is the capability required to configure IPVS and network interfaces.
+const CapNetAdmin = 12
+
+var errNoCapEff = errors.New("effective capabilities are not found")
+
+// HasCapability checks if the current process has the capability in its effective set.
+// Capabilities could be granted without full root privileges, e.g. as ambient ones.
+func HasCapability(capability uint) (bool, error) {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	capEff, err := parseCapEff(string(status))
+	if err != nil {
+		return false, err
+	}
+	return capEff&(1<<capability) != 0, nil
+}
+
+func parseCapEff(status string) (uint64, error) {
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "CapEff:"); found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	return 0, errNoCapEff
+}
+
+// KernelModuleLoaded checks if the kernel module is loaded or built into the kernel.
+func KernelModuleLoaded(name string) bool {
+	_, err := os.Stat(path.Join("/sys/module", name))
+	return err == nil
+}
+
+// KernelModuleInstalled checks if the kernel module could be loaded with modprobe.
+func KernelModuleInstalled(name string) bool {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	modulesDir := path.Join("/lib/modules", strings.TrimSpace(string(release)))
+	for _, index := range []string{"modules.dep", "modules.builtin"} {
+		content, err := os.ReadFile(path.Join(modulesDir, index))
+		if err != nil {
+			continue
+		}
+		if hasModule(string(content), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasModule(index, name string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(index))
+	for scanner.Scan() {
+		module, _, _ := strings.Cut(scanner.Text(), ":")
+		base := path.Base(module)
+		for _, ext := range []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"} {
+			if base == fmt.Sprintf("%s%s", name, ext) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetSysctl writes the value of the kernel parameter, e.g. net.ipv4.vs.expire_nodest_conn.
+func SetSysctl(name, value string) error {
+	return os.WriteFile(path.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")), []byte(value), 0o644)
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Possible log level errors.
+var (
+	ErrUnknownLogComponent = errors.New("specified log component is unknown")
+	ErrUnknownLogLevel     = errors.New("specified log level is unknown")
+)
+
+const modulePath = "github.com/qk4l/gorb"
+
+// logComponent is a part of GORB which log level could be changed separately,
+// its messages are matched by the package and optionally by the file of the caller.
+type logComponent struct {
+	name  string
+	pkg   string
+	files []string
+}
+
+// Components are matched in order, so specific files go before their packages.
+var logComponents = []logComponent{
+	{name: "store", pkg: modulePath + "/core", files: []string{"store.go", "sync_plan.go", "plan.go"}},
+	{name: "store", pkg: modulePath + "/local_store"},
+	{name: "core", pkg: modulePath + "/core"},
+	{name: "pulse", pkg: modulePath + "/pulse"},
+	{name: "disco", pkg: modulePath + "/disco"},
+	{name: "hooks", pkg: modulePath + "/hooks"},
+	{name: "ipvsrpc", pkg: modulePath + "/ipvsrpc"},
+	{name: "dns", pkg: modulePath + "/nameserver"},
+	{name: "api", pkg: "main"},
+}
+
+// LogComponents returns names of components which log level could be changed separately.
+func LogComponents() []string {
+	var names []string
+	for _, c := range logComponents {
+		if !isLogComponent(c.name, names) {
+			names = append(names, c.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isLogComponent(name string, names []string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LogLevels describes the global log level and overrides of components.
+type LogLevels struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// logLevels keeps levels of the standard logger, it could be changed at runtime.
+var logLevels = struct {
+	sync.RWMutex
+	global     log.Level
+	components map[string]log.Level
+}{global: log.InfoLevel}
+
+// GetLogLevels returns current log levels.
+func GetLogLevels() LogLevels {
+	logLevels.RLock()
+	defer logLevels.RUnlock()
+
+	levels := LogLevels{Level: logLevels.global.String()}
+	if len(logLevels.components) > 0 {
+		levels.Components = make(map[string]string, len(logLevels.components))
+		for name, level := range logLevels.components {
+			levels.Components[name] = level.String()
+		}
+	}
+	return levels
+}
+
+// SetLogLevel changes the log level of the component, or the global one if the
+// component is empty. An empty level of a component resets it to the global level.
+func SetLogLevel(component, level string) error {
+	var parsed log.Level
+	if component == "" || level != "" {
+		var err error
+		if parsed, err = log.ParseLevel(level); err != nil {
+			return fmt.Errorf("%w: %s", ErrUnknownLogLevel, level)
+		}
+	}
+	if component != "" && !isLogComponent(component, LogComponents()) {
+		return fmt.Errorf("%w: %s", ErrUnknownLogComponent, component)
+	}
+
+	logLevels.Lock()
+	defer logLevels.Unlock()
+
+	switch {
+	case component == "":
+		logLevels.global = parsed
+	case level == "":
+		delete(logLevels.components, component)
+	default:
+		if logLevels.components == nil {
+			logLevels.components = make(map[string]log.Level)
+		}
+		logLevels.components[component] = parsed
+	}
+
+	// the standard logger drops messages above the most verbose level, the rest
+	// is filtered by the formatter which needs callers to find out components
+	maxLevel := logLevels.global
+	for _, l := range logLevels.components {
+		if l > maxLevel {
+			maxLevel = l
+		}
+	}
+	formatter := log.StandardLogger().Formatter
+	if _, ok := formatter.(*componentFormatter); !ok && len(logLevels.components) > 0 {
+		log.SetFormatter(&componentFormatter{formatter})
+	}
+	log.SetReportCaller(len(logLevels.components) > 0)
+	log.SetLevel(maxLevel)
+	return nil
+}
+
+// componentFormatter drops messages above the level of their component.
+type componentFormatter struct {
+	log.Formatter
+}
+
+func callerComponent(entry *log.Entry) string {
+	if entry.Caller == nil {
+		return ""
+	}
+	// function is like github.com/qk4l/gorb/core.(*Context).createService
+	function := entry.Caller.Function
+	pkg := function
+	if slash := strings.LastIndex(function, "/"); slash >= 0 {
+		if dot := strings.Index(function[slash:], "."); dot >= 0 {
+			pkg = function[:slash+dot]
+		}
+	} else if dot := strings.Index(function, "."); dot >= 0 {
+		pkg = function[:dot]
+	}
+	file := path.Base(entry.Caller.File)
+
+	for _, c := range logComponents {
+		if c.pkg != pkg {
+			continue
+		}
+		if len(c.files) == 0 {
+			return c.name
+		}
+		for _, f := range c.files {
+			if f == file {
+				return c.name
+			}
+		}
+	}
+	return ""
+}
+
+func (f *componentFormatter) Format(entry *log.Entry) ([]byte, error) {
+	logLevels.RLock()
+	level := logLevels.global
+	if l, ok := logLevels.components[callerComponent(entry)]; ok {
+		level = l
+	}
+	logLevels.RUnlock()
+
+	if entry.Level > level {
+		return nil, nil
+	}
+	// callers are reported only to find out components
+	entry.Caller = nil
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,82 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package util
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallerComponent(t *testing.T) {
+	for _, tc := range []struct {
+		function, file, component string
+	}{
+		{"github.com/qk4l/gorb/core.(*Context).createService", "/src/core/context.go", "core"},
+		{"github.com/qk4l/gorb/core.(*Store).sync", "/src/core/store.go", "store"},
+		{"github.com/qk4l/gorb/local_store.(*FileStore).read", "/src/local_store/file.go", "store"},
+		{"github.com/qk4l/gorb/pulse.(*Pulse).Loop", "/src/pulse/pulse.go", "pulse"},
+		{"main.main", "/src/main.go", "api"},
+		{"github.com/gorilla/mux.(*Router).ServeHTTP", "/src/mux.go", ""},
+	} {
+		entry := &log.Entry{Caller: &runtime.Frame{Function: tc.function, File: tc.file}}
+		assert.Equal(t, tc.component, callerComponent(entry), tc.function)
+	}
+	assert.Equal(t, "", callerComponent(&log.Entry{}))
+}
+
+func TestSetLogLevel(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.StandardLogger()
+	formatter, level, output := logger.Formatter, logger.Level, logger.Out
+	logger.SetOutput(&out)
+	defer func() {
+		SetLogLevel("store", "")
+		SetLogLevel("", level.String())
+		logger.SetFormatter(formatter)
+		logger.SetOutput(output)
+	}()
+
+	assert.ErrorIs(t, SetLogLevel("", "chatty"), ErrUnknownLogLevel)
+	assert.ErrorIs(t, SetLogLevel("unknown", "debug"), ErrUnknownLogComponent)
+
+	require.NoError(t, SetLogLevel("", "warning"))
+	require.NoError(t, SetLogLevel("store", "debug"))
+	assert.Equal(t, LogLevels{Level: "warning", Components: map[string]string{"store": "debug"}}, GetLogLevels())
+	assert.Equal(t, log.DebugLevel, logger.Level)
+	assert.True(t, logger.ReportCaller)
+
+	// messages of the test aren't of any component, so the global level applies
+	log.Info("hidden message")
+	log.Warn("shown message")
+	assert.NotContains(t, out.String(), "hidden message")
+	assert.Contains(t, out.String(), "shown message")
+	assert.NotContains(t, out.String(), "loglevel_test.go")
+
+	require.NoError(t, SetLogLevel("store", ""))
+	assert.Equal(t, LogLevels{Level: "warning"}, GetLogLevels())
+	assert.Equal(t, log.WarnLevel, logger.Level)
+	assert.False(t, logger.ReportCaller)
+}
@@ -22,7 +22,10 @@ package util
 
 import (
 	"bytes"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"syscall"
 )
 
@@ -74,3 +77,22 @@ func InterfaceIPs(device string) (ips []net.IP, _ error) {
 	// and no error indicator. Maybe that's not super-perfect.
 	return ips, nil
 }
+
+// ProxyDirect disables proxies otherwise taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+const ProxyDirect = "direct"
+
+// ProxyFunc returns the proxy selection of HTTP transports: proxies of the
+// environment if proxy is empty, no proxy if it's "direct" and the proxy URL otherwise.
+func ProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case ProxyDirect:
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+	}
+	return http.ProxyURL(u), nil
+}
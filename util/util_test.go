@@ -23,6 +23,8 @@ package util
 import (
 	"encoding/json"
 	"net"
+	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
@@ -136,3 +138,42 @@ func TestParseIntervalErrors(t *testing.T) {
 	}
 }
 
+func TestProxyFunc(t *testing.T) {
+	proxy, err := ProxyFunc("")
+	require.NoError(t, err)
+	assert.NotNil(t, proxy)
+
+	proxy, err = ProxyFunc(ProxyDirect)
+	require.NoError(t, err)
+	assert.Nil(t, proxy)
+
+	proxy, err = ProxyFunc("http://proxy:3128")
+	require.NoError(t, err)
+	u, err := proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "consul:8501"}})
+	require.NoError(t, err)
+	assert.Equal(t, "http://proxy:3128", u.String())
+
+	_, err = ProxyFunc("proxy:3128")
+	assert.Error(t, err)
+}
+
+func TestParseCapEff(t *testing.T) {
+	status := "Name:\tgorb\nCapInh:\t0000000000000000\nCapEff:\t0000000000001000\nCapBnd:\t000001ffffffffff\n"
+
+	capEff, err := parseCapEff(status)
+
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<CapNetAdmin), capEff)
+
+	_, err = parseCapEff("Name:\tgorb\n")
+	assert.Equal(t, errNoCapEff, err)
+}
+
+func TestHasModule(t *testing.T) {
+	index := "kernel/net/netfilter/ipvs/ip_vs.ko.zst: kernel/net/netfilter/nf_conntrack.ko.zst\n" +
+		"kernel/net/netfilter/ipvs/ip_vs_wrr.ko.zst: kernel/net/netfilter/ipvs/ip_vs.ko.zst\n"
+
+	assert.True(t, hasModule(index, "ip_vs"))
+	assert.True(t, hasModule(index, "ip_vs_wrr"))
+	assert.False(t, hasModule(index, "ip_vs_sh"))
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright (c) 2015 Andrey Sibiryov <me@kobology.ru>
+   Copyright (c) 2015 Other contributors as noted in the AUTHORS file.
+
+   This file is part of GORB - Go Routing and Balancing.
+
+   GORB is free software; you can redistribute it and/or modify
+   it under the terms of the GNU Lesser General Public License as published by
+   the Free Software Foundation; either version 3 of the License, or
+   (at your option) any later version.
+
+   GORB is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+   GNU Lesser General Public License for more details.
+
+   You should have received a copy of the GNU Lesser General Public License
+   along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"runtime"
+	buildinfo "runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GitCommit could be set by ldflags at build time, otherwise it is taken from
+// VCS information embedded by go build.
+var GitCommit = ""
+
+// versionInfo describes the running GORB build.
+type versionInfo struct {
+	Version   string   `json:"version"`
+	GitCommit string   `json:"git_commit"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+}
+
+func gitCommit() string {
+	if GitCommit != "" {
+		return GitCommit
+	}
+	if info, ok := buildinfo.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// enabledFeatures lists optional features enabled by flags.
+func enabledFeatures() []string {
+	features := []string{}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"store", *storeURLs != ""},
+		{"follower", *follow != ""},
+		{"consul", *consul != ""},
+		{"vip-interface", *vipInterface != "" || *vipInterfaces != ""},
+		{"in-memory-ipvs", *noIpvs},
+		{"ipvs-helper", *ipvsSocket != ""},
+		{"hooks", *hookExec != "" || *hookURL != ""},
+		{"backup", *backupKey != ""},
+		{"locality", *locality != ""},
+		{"strict-versions", *strictVersions},
+		{"soft-delete", *deleteGracePeriod != "" && *deleteGracePeriod != "0"},
+		{"removal-delay", *removalDelay != "" && *removalDelay != "0" && *removalDelay != "0s"},
+		{"event-history", *eventHistory > 0},
+		{"aggregated-metrics", *metricsAggregated},
+		{"tracing", *otlpEndpoint != ""},
+		{"weight-metrics", *prometheusURL != ""},
+		{"dns", *dnsListen != ""},
+		{"ui", *webUI},
+	} {
+		if feature.enabled {
+			features = append(features, feature.name)
+		}
+	}
+	return features
+}
+
+func newVersionInfo() versionInfo {
+	return versionInfo{
+		Version:   Version,
+		GitCommit: gitCommit(),
+		GoVersion: runtime.Version(),
+		Features:  enabledFeatures(),
+	}
+}
+
+// registerBuildInfo exports build of GORB as gorb_build_info metric.
+func registerBuildInfo(info versionInfo) {
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gorb",
+		Name:      "build_info",
+		Help:      "Build of GORB, the value is always 1",
+	}, []string{"version", "git_commit", "go_version"})
+	buildInfo.WithLabelValues(info.Version, info.GitCommit, info.GoVersion).Set(1)
+	prometheus.MustRegister(buildInfo)
+}
+
+type versionHandler struct {
+	info versionInfo
+}
+
+func (h versionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, h.info)
+}